@@ -0,0 +1,312 @@
+// Package admin serves an HTTP API to operate running pipelines
+// (flows) from orchestration tooling rather than process signals.
+//
+// Endpoints, all returning JSON:
+//
+//	GET  /flows               status of every flow
+//	GET  /flows/<name>        status of a flow
+//	POST /flows/<name>/pause  stop reading from the source
+//	POST /flows/<name>/resume resume reading from the source
+//	POST /flows/<name>/flush  flush the destination (e.g. commit and
+//	                          upload the S3 buffer)
+//	POST /flows/<name>/stop   drain the messages read and stop
+//	POST /flows/<name>/sampling?enabled=true|false
+//	                          turn payload sampling on or off (see
+//	                          stream.Sampler)
+//	POST /flows/<name>/log-level?level=debug
+//	                          set the log level of the flow and its
+//	                          connectors (see stream.LevelLogger)
+//	GET  /health              status of every flow, 503 if one is
+//	                          unhealthy
+//	GET  /canaries            stable and canary versions of flows
+//	                          compared (see config.Runner)
+//
+// A flow is unhealthy while its source is idle (see
+// stream.Pipeline.IdleTimeout), its circuit breaker is open or
+// partitions are paused, or while a stream.Supervisor restarts it
+// after a failure (it is listed without a pipeline then).
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abstractpaper/manifold/stream"
+	log "github.com/sirupsen/logrus"
+)
+
+// Flows is the set of running flows operated by a Server, e.g. a
+// config.Runner.
+type Flows interface {
+	Pipelines() map[string]*stream.Pipeline
+	// StopPipeline drains and stops a flow.
+	StopPipeline(name string) error
+}
+
+// Canaries is an optional interface implemented by Flows running
+// canary versions of flows (e.g. a config.Runner), served on
+// /canaries.
+type Canaries interface {
+	Canaries() map[string]stream.CanaryStats
+}
+
+// Supervised is an optional interface implemented by Flows
+// restarting flows that fail (e.g. a stream.Supervisor): the restarts
+// and last error of flows are reported, and flows restarting or
+// failed are listed as unhealthy.
+type Supervised interface {
+	Health() stream.SupervisorHealth
+}
+
+// Server is the admin API server. If Token is set, requests must
+// carry it in an `Authorization: Bearer <token>` header.
+type Server struct {
+	Addr     string // listen address, e.g. "localhost:9090"
+	Token    string
+	Flows    Flows
+	server   *http.Server
+	listener net.Listener
+}
+
+// Status is the state of a flow.
+type Status struct {
+	Name       string            `json:"name"`
+	State      string            `json:"state"` // running or paused (or restarting or failed)
+	Sampling   bool              `json:"sampling"`
+	LogLevel   string            `json:"logLevel,omitempty"` // flows with a stream.Leveled logger
+	Healthy    bool              `json:"healthy"`
+	Problems   []string          `json:"problems,omitempty"`
+	IdleSince  *time.Time        `json:"idleSince,omitempty"`
+	LagMillis  *int64            `json:"lagMillis,omitempty"` // sources implementing stream.Lagging
+	Guarantees stream.Guarantees `json:"guarantees"`          // given the capabilities of its connectors
+	Stats      stream.Stats      `json:"stats"`
+	Restarts   uint64            `json:"restarts,omitempty"`  // by a Supervised
+	LastError  string            `json:"lastError,omitempty"` // by a Supervised
+}
+
+// Health is the state of every flow.
+type Health struct {
+	Healthy bool     `json:"healthy"`
+	Flows   []Status `json:"flows"`
+}
+
+// Start listens on Addr and serves the API in a goroutine.
+func (s *Server) Start() (err error) {
+	s.listener, err = net.Listen("tcp", s.Addr)
+	if err != nil {
+		return
+	}
+	s.server = &http.Server{Handler: s.Handler()}
+	go func() {
+		log.Info("Admin: Listening on ", s.listener.Addr())
+		err := s.server.Serve(s.listener)
+		if err != http.ErrServerClosed {
+			log.Error("Admin: Serve: ", err)
+		}
+	}()
+	return
+}
+
+// Stop gracefully shuts the server down.
+func (s *Server) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// Handler returns the API handler.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flows", s.authorize(s.list))
+	mux.HandleFunc("/flows/", s.authorize(s.flow))
+	mux.HandleFunc("/health", s.authorize(s.health))
+	mux.HandleFunc("/canaries", s.authorize(s.canaries))
+	return mux
+}
+
+// authorize checks the bearer token of requests against Token.
+func (s *Server) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.statuses())
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	health := Health{Healthy: true, Flows: s.statuses()}
+	for _, status := range health.Flows {
+		health.Healthy = health.Healthy && status.Healthy
+	}
+	code := http.StatusOK
+	if !health.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, health)
+}
+
+// canaries compares the stable and canary versions of flows, by
+// name.
+func (s *Server) canaries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	canaries := map[string]stream.CanaryStats{}
+	if c, ok := s.Flows.(Canaries); ok {
+		canaries = c.Canaries()
+	}
+	writeJSON(w, http.StatusOK, canaries)
+}
+
+// flow handles /flows/<name> and /flows/<name>/<action>.
+func (s *Server) flow(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/flows/"), "/", 2)
+	name := parts[0]
+	p, ok := s.Flows.Pipelines()[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("no flow named %q", name), http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, status(name, p))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var err error
+	switch action := parts[1]; action {
+	case "pause":
+		p.Pause()
+	case "resume":
+		p.Resume()
+	case "flush":
+		err = p.Flush()
+	case "stop":
+		err = s.Flows.StopPipeline(name)
+	case "sampling":
+		enabled, perr := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if perr != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		p.Sampling().SetEnabled(enabled)
+	case "log-level":
+		level, perr := stream.ParseLevel(r.URL.Query().Get("level"))
+		if perr != nil {
+			http.Error(w, perr.Error(), http.StatusBadRequest)
+			return
+		}
+		err = p.SetLogLevel(level)
+	default:
+		http.Error(w, fmt.Sprintf("unknown action %q", action), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Admin: %s %s", r.Method, r.URL.Path)
+	writeJSON(w, http.StatusOK, status(name, p))
+}
+
+// statuses returns the status of every flow, by name.
+func (s *Server) statuses() []Status {
+	statuses := []Status{}
+	pipelines := s.Flows.Pipelines()
+	for name, p := range pipelines {
+		statuses = append(statuses, status(name, p))
+	}
+	if sup, ok := s.Flows.(Supervised); ok {
+		flows := sup.Health().Flows
+		for i, st := range statuses {
+			statuses[i].Restarts = flows[st.Name].Restarts
+			statuses[i].LastError = flows[st.Name].LastError
+		}
+		for name, flow := range flows {
+			if pipelines[name] != nil || (flow.State != stream.FlowRestarting && flow.State != stream.FlowFailed) {
+				continue
+			}
+			statuses = append(statuses, Status{
+				Name:      name,
+				State:     flow.State,
+				Problems:  []string{fmt.Sprintf("%s since %s", flow.State, flow.Since.UTC().Format(time.RFC3339))},
+				Restarts:  flow.Restarts,
+				LastError: flow.LastError,
+			})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// status returns the status of flow `p`.
+func status(name string, p *stream.Pipeline) Status {
+	st := Status{Name: name, State: "running", Guarantees: p.Guarantees(), Stats: p.Stats()}
+	if p.Paused() {
+		st.State = "paused"
+	}
+	st.Sampling = p.Sampling().IsEnabled()
+	if level, ok := p.LogLevel(); ok {
+		st.LogLevel = level.String()
+	}
+	if !st.Stats.IdleSince.IsZero() {
+		since := st.Stats.IdleSince.UTC()
+		st.IdleSince = &since
+		st.Problems = append(st.Problems, "source idle since "+since.Format(time.RFC3339))
+	}
+	if p.BreakerOpen() {
+		st.Problems = append(st.Problems, "circuit breaker open")
+	}
+	if st.Stats.Paused > 0 {
+		st.Problems = append(st.Problems, fmt.Sprintf("%d partition(s) paused", st.Stats.Paused))
+	}
+	if lag, ok := p.Lag(); ok {
+		millis := int64(lag / time.Millisecond)
+		st.LagMillis = &millis
+	}
+	st.Healthy = len(st.Problems) == 0
+	return st
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
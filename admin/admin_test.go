@@ -0,0 +1,139 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abstractpaper/manifold/stream"
+	"github.com/abstractpaper/manifold/stream/streamtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// flows is a fixed set of flows.
+type flows struct {
+	pipelines map[string]*stream.Pipeline
+	stopped   []string
+}
+
+func (f *flows) Pipelines() map[string]*stream.Pipeline { return f.pipelines }
+
+func (f *flows) StopPipeline(name string) error {
+	f.stopped = append(f.stopped, name)
+	return nil
+}
+
+// flushed counts flushes.
+type flushed struct {
+	streamtest.CaptureDestination
+	flushes int
+}
+
+func (f *flushed) Flush() error {
+	f.flushes++
+	return nil
+}
+
+func request(t *testing.T, h http.Handler, method, path string, v interface{}) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if v != nil && (rec.Code < 400 || rec.Code == http.StatusServiceUnavailable) {
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+	return rec.Code
+}
+
+func TestServer(t *testing.T) {
+	dest := &flushed{}
+	f := &flows{pipelines: map[string]*stream.Pipeline{
+		"orders": {Source: streamtest.NewSliceSource(), Destination: dest, Logger: stream.NewLevelLogger(stream.InfoLevel)},
+		"events": {Source: streamtest.NewSliceSource(), Destination: &streamtest.CaptureDestination{}},
+	}}
+	s := &Server{Token: "secret", Flows: f}
+	h := s.Handler()
+
+	var statuses []Status
+	assert.Equal(t, http.StatusOK, request(t, h, http.MethodGet, "/flows", &statuses))
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, "events", statuses[0].Name)
+	assert.Equal(t, stream.AtMostOnce, statuses[0].Guarantees.Delivery)
+	assert.Equal(t, "running", statuses[1].State)
+	assert.True(t, statuses[1].Healthy)
+
+	var status Status
+	assert.Equal(t, http.StatusOK, request(t, h, http.MethodPost, "/flows/orders/pause", &status))
+	assert.Equal(t, "paused", status.State)
+	assert.True(t, f.pipelines["orders"].Paused())
+	assert.Equal(t, http.StatusOK, request(t, h, http.MethodPost, "/flows/orders/resume", &status))
+	assert.Equal(t, "running", status.State)
+	assert.Equal(t, http.StatusOK, request(t, h, http.MethodPost, "/flows/orders/flush", nil))
+	assert.Equal(t, 1, dest.flushes)
+	assert.Equal(t, http.StatusOK, request(t, h, http.MethodPost, "/flows/orders/sampling?enabled=true", &status))
+	assert.True(t, status.Sampling)
+	assert.True(t, f.pipelines["orders"].Sampler.IsEnabled())
+	assert.Equal(t, http.StatusBadRequest, request(t, h, http.MethodPost, "/flows/orders/sampling", nil))
+	assert.Equal(t, "info", status.LogLevel)
+	assert.Equal(t, http.StatusOK, request(t, h, http.MethodPost, "/flows/orders/log-level?level=debug", &status))
+	assert.Equal(t, "debug", status.LogLevel)
+	assert.Equal(t, http.StatusBadRequest, request(t, h, http.MethodPost, "/flows/orders/log-level?level=loud", nil))
+	assert.Equal(t, http.StatusInternalServerError, request(t, h, http.MethodPost, "/flows/events/log-level?level=debug", nil))
+	assert.Equal(t, http.StatusOK, request(t, h, http.MethodPost, "/flows/orders/stop", nil))
+	assert.Equal(t, []string{"orders"}, f.stopped)
+
+	assert.Equal(t, http.StatusNotFound, request(t, h, http.MethodGet, "/flows/nope", nil))
+	assert.Equal(t, http.StatusNotFound, request(t, h, http.MethodPost, "/flows/orders/restart", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, request(t, h, http.MethodGet, "/flows/orders/pause", nil))
+
+	var health Health
+	assert.Equal(t, http.StatusOK, request(t, h, http.MethodGet, "/health", &health))
+	assert.True(t, health.Healthy)
+
+	// unauthorized
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+// canaryFlows are flows with a canary.
+type canaryFlows struct {
+	flows
+}
+
+func (c *canaryFlows) Canaries() map[string]stream.CanaryStats {
+	return map[string]stream.CanaryStats{"orders": {Percent: 10, Canary: stream.VersionStats{Routed: 5}}}
+}
+
+func TestServer_Canaries(t *testing.T) {
+	h := (&Server{Flows: &flows{}}).Handler()
+	var canaries map[string]stream.CanaryStats
+	assert.Equal(t, http.StatusOK, request(t, h, http.MethodGet, "/canaries", &canaries))
+	assert.Empty(t, canaries)
+
+	h = (&Server{Flows: &canaryFlows{}}).Handler()
+	assert.Equal(t, http.StatusOK, request(t, h, http.MethodGet, "/canaries", &canaries))
+	assert.Equal(t, 10, canaries["orders"].Percent)
+	assert.Equal(t, uint64(5), canaries["orders"].Canary.Routed)
+	assert.Equal(t, http.StatusMethodNotAllowed, request(t, h, http.MethodPost, "/canaries", nil))
+}
+
+func TestServer_Supervised(t *testing.T) {
+	s := &stream.Supervisor{}
+	err := s.Add(stream.SupervisedFlow{Name: "orders", Restart: stream.RestartNever, Build: func() (*stream.Pipeline, error) {
+		return nil, errors.New("no credentials")
+	}})
+	assert.NoError(t, err)
+	s.Run()
+
+	var health Health
+	h := (&Server{Flows: s}).Handler()
+	assert.Equal(t, http.StatusServiceUnavailable, request(t, h, http.MethodGet, "/health", &health))
+	if assert.Len(t, health.Flows, 1) {
+		assert.Equal(t, "failed", health.Flows[0].State)
+		assert.Equal(t, "no credentials", health.Flows[0].LastError)
+		assert.False(t, health.Flows[0].Healthy)
+	}
+}
@@ -0,0 +1,238 @@
+// Command manifold runs pipelines defined in a YAML or JSON file.
+//
+// Usage:
+//
+//	manifold run [-log-level info] [-admin localhost:9090] pipeline.yaml
+//	manifold replay [-list] [-provider stripe] [-from ...] http://localhost:8080/_replay
+//	manifold convert [-from fluentbit|logstash] [-o pipeline.yaml] fluent-bit.conf
+//	manifold resources [-format json|yaml] pipeline.yaml
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/abstractpaper/manifold/admin"
+	"github.com/abstractpaper/manifold/config"
+	"github.com/abstractpaper/manifold/config/convert"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `Usage:
+  manifold run [flags] <pipeline.yaml>
+  manifold replay [flags] <replay API URL>
+  manifold convert [flags] <Fluent Bit or Logstash config>
+  manifold resources [flags] <pipeline.yaml>
+
+Flags:
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "run":
+		run(os.Args[2:])
+	case "replay":
+		replay(os.Args[2:])
+	case "convert":
+		convertConfig(os.Args[2:])
+	case "resources":
+		resources(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
+
+func run(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	level := flags.String("log-level", "info", "log level (trace, debug, info, warn, error)")
+	adminAddr := flags.String("admin", "", "listen address of the admin API (disabled by default)")
+	adminToken := flags.String("admin-token", os.Getenv("MANIFOLD_ADMIN_TOKEN"), "bearer token of the admin API (defaults to $MANIFOLD_ADMIN_TOKEN)")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	lvl, err := log.ParseLevel(*level)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetLevel(lvl)
+
+	c, err := config.Load(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// reload the config when the file changes or on SIGHUP
+	runner := &config.Runner{Config: c, Path: flags.Arg(0)}
+	if *adminAddr != "" {
+		server := &admin.Server{Addr: *adminAddr, Token: *adminToken, Flows: runner}
+		err = server.Start()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer server.Stop()
+	}
+	err = runner.Run()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// replay lists or re-emits webhooks stored by an HTTP source through
+// its replay API.
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	token := flags.String("token", os.Getenv("MANIFOLD_TOKEN"), "bearer token of the HTTP source (defaults to $MANIFOLD_TOKEN)")
+	provider := flags.String("provider", "", "provider of the webhooks")
+	event := flags.String("event", "", "event type of the webhooks")
+	from := flags.String("from", "", "start time (RFC 3339)")
+	to := flags.String("to", "", "end time (RFC 3339), defaults to now")
+	list := flags.Bool("list", false, "list the webhooks rather than replaying them")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	u, err := url.Parse(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	q := u.Query()
+	for name, v := range map[string]string{"provider": *provider, "event": *event, "from": *from, "to": *to} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	method := http.MethodPost
+	if *list {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Fatal("replay failed: ", resp.Status)
+	}
+}
+
+// convertConfig translates a Fluent Bit or Logstash config into a
+// manifold config, printing what couldn't be converted.
+func convertConfig(args []string) {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	from := flags.String("from", "", "format of the config, fluentbit or logstash (detected by default)")
+	out := flags.String("o", "", "file to write the manifold config to (defaults to stdout)")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	result, err := convert.Convert(*from, data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, w := range result.Warnings {
+		log.Warn("Not converted: ", w)
+	}
+	data, err = result.YAML()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *out == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	err = ioutil.WriteFile(*out, data, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// resources prints the infrastructure the pipelines of a config need
+// (streams, buckets, tables...), to generate it with Terraform or
+// CloudFormation.
+func resources(args []string) {
+	flags := flag.NewFlagSet("resources", flag.ExitOnError)
+	format := flags.String("format", "json", "output format, json or yaml")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	c, err := config.Load(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	list, err := c.Resources()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if list == nil {
+		list = []config.Resource{}
+	}
+
+	switch *format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(list)
+	case "yaml":
+		err = yaml.NewEncoder(os.Stdout).Encode(list)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
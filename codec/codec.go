@@ -0,0 +1,114 @@
+// Package codec serializes messages for connectors: a codec decodes
+// the bytes a source reads into a message and encodes messages into
+// the bytes a destination writes, so that e.g. a pipeline reading
+// msgpack can write JSON lines without bespoke transforms.
+//
+// Transforms work on the decoded messages, JSON for the json and
+// msgpack codecs. Codecs are registered by name, third party codecs
+// can register themselves in an init function.
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// Codec converts messages from and to the bytes of a connector.
+// Codecs must be safe for concurrent use.
+type Codec interface {
+	// Decode decodes `data`, read from a source. The metadata of the
+	// returned message (if any) is added to the source's.
+	Decode(data []byte) (message.Message, error)
+	// Encode encodes `m` to write it to a destination.
+	Encode(m message.Message) ([]byte, error)
+}
+
+// Names of the built-in codecs.
+const (
+	JSONName    = "json"
+	MsgpackName = "msgpack"
+	RawName     = "raw"
+)
+
+var registry = struct {
+	sync.RWMutex
+	codecs map[string]Codec
+}{
+	codecs: map[string]Codec{
+		JSONName:    JSON{},
+		MsgpackName: Msgpack{},
+		RawName:     Raw{},
+	},
+}
+
+// Register makes a codec available by name, replacing any codec
+// registered with the same name.
+func Register(name string, c Codec) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.codecs[name] = c
+}
+
+// Get returns the codec registered as `name`.
+func Get(name string) (Codec, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	c, ok := registry.codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return c, nil
+}
+
+// Names returns the names of the registered codecs, sorted.
+func Names() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	names := make([]string, 0, len(registry.codecs))
+	for name := range registry.codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// errInvalidJSON is returned for messages that aren't valid JSON.
+var errInvalidJSON = errors.New("codec: invalid JSON")
+
+// JSON decodes and encodes JSON documents. Decode checks that data
+// is valid JSON and Encode writes messages on a single line, e.g.
+// for JSON lines files.
+type JSON struct{}
+
+func (JSON) Decode(data []byte) (message.Message, error) {
+	if !json.Valid(data) {
+		return message.Message{}, errInvalidJSON
+	}
+	return message.New(string(data)), nil
+}
+
+func (JSON) Encode(m message.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	err := json.Compact(&buf, []byte(m.Body))
+	if err != nil {
+		return nil, errInvalidJSON
+	}
+	return buf.Bytes(), nil
+}
+
+// Raw passes bytes through as is.
+type Raw struct{}
+
+func (Raw) Decode(data []byte) (message.Message, error) {
+	return message.New(string(data)), nil
+}
+
+func (Raw) Encode(m message.Message) ([]byte, error) {
+	return []byte(m.Body), nil
+}
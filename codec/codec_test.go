@@ -0,0 +1,115 @@
+package codec
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSON(t *testing.T) {
+	m, err := JSON{}.Decode([]byte(`{"a": 1}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a": 1}`, m.Body)
+	_, err = JSON{}.Decode([]byte(`{"a": `))
+	assert.Equal(t, errInvalidJSON, err)
+
+	// a line per message
+	data, err := JSON{}.Encode(message.New("{\n  \"a\": [1, 2]\n}\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":[1,2]}`, string(data))
+	_, err = JSON{}.Encode(message.New("text"))
+	assert.Equal(t, errInvalidJSON, err)
+}
+
+func TestRaw(t *testing.T) {
+	m, err := Raw{}.Decode([]byte{0xff, 0x00})
+	assert.NoError(t, err)
+	assert.Equal(t, "\xff\x00", m.Body)
+
+	data, err := Raw{}.Encode(m)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0xff, 0x00}, data)
+}
+
+func TestMsgpack(t *testing.T) {
+	for _, body := range []string{
+		`{"id":1,"name":"order","tags":["a","b"],"total":12.5,"paid":true,"note":null}`,
+		`{"z":{"y":-1,"x":-200,"w":70000,"v":-70000,"u":5000000000,"t":18446744073709551615}}`,
+		`[` + strings.Repeat(`"`+strings.Repeat("s", 300)+`",`, 20) + `{}]`,
+		`"<html> & unicode: é"`,
+	} {
+		data, err := Msgpack{}.Encode(message.New(body))
+		assert.NoError(t, err)
+		m, err := Msgpack{}.Decode(data)
+		assert.NoError(t, err)
+		assert.Equal(t, body, m.Body)
+	}
+
+	// {"compact": true, "schema": 0}
+	data, err := Msgpack{}.Encode(message.New(`{"compact": true, "schema": 0}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "82a7636f6d70616374c3a6736368656d6100", hex.EncodeToString(data))
+
+	_, err = Msgpack{}.Encode(message.New(`{"a": 1} trailing`))
+	assert.Equal(t, errInvalidJSON, err)
+}
+
+func TestMsgpack_Decode(t *testing.T) {
+	for encoded, expected := range map[string]string{
+		// float32 1.5, bin "hi", int key 1
+		"83a166ca3fc00000a162c4026869" + "01c0": `{"f":1.5,"b":"aGk=","1":null}`,
+		// timestamp 32 of 2020-10-01T00:00:00Z
+		"d6ff5f751c00": `"2020-10-01T00:00:00Z"`,
+		// int8 -100, int16 -1000, uint8 200
+		"93d09cd1fc18ccc8": `[-100,-1000,200]`,
+	} {
+		data, _ := hex.DecodeString(encoded)
+		m, err := Msgpack{}.Decode(data)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, m.Body)
+	}
+
+	for encoded, expected := range map[string]string{
+		"92a161":   "codec: truncated msgpack",
+		"dcffff01": "codec: truncated msgpack",
+		"c1":       "codec: msgpack: unknown code c1 decoding interface{}",
+		"d40100":   "codec: msgpack: unknown ext id=1",
+		"0102":     "codec: 1 bytes after msgpack value",
+	} {
+		data, _ := hex.DecodeString(encoded)
+		_, err := Msgpack{}.Decode(data)
+		assert.EqualError(t, err, expected, encoded)
+	}
+
+	_, err := Msgpack{}.Decode([]byte(strings.Repeat("\x91", maxDepth+2) + "\xc0"))
+	assert.Equal(t, errDepth, err)
+}
+
+type upper struct{ Raw }
+
+func (upper) Encode(m message.Message) ([]byte, error) {
+	return []byte(strings.ToUpper(m.Body)), nil
+}
+
+func TestRegister(t *testing.T) {
+	c, err := Get("msgpack")
+	assert.NoError(t, err)
+	assert.Equal(t, Msgpack{}, c)
+	_, err = Get("upper")
+	assert.EqualError(t, err, `unknown codec "upper"`)
+
+	Register("upper", upper{})
+	t.Cleanup(func() {
+		registry.Lock()
+		defer registry.Unlock()
+		delete(registry.codecs, "upper")
+	})
+	c, err = Get("upper")
+	assert.NoError(t, err)
+	data, _ := c.Encode(message.New("abc"))
+	assert.Equal(t, "ABC", string(data))
+	assert.Equal(t, []string{"json", "msgpack", "raw", "upper"}, Names())
+}
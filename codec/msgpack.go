@@ -0,0 +1,276 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// Msgpack decodes MessagePack into JSON and encodes JSON into
+// MessagePack. Keys keep their order. Binary values are decoded as
+// base64 strings (as encoding/json does), timestamps as RFC 3339
+// strings and non-string map keys as their JSON text; other
+// extension types aren't supported.
+type Msgpack struct{}
+
+// maxDepth bounds the nesting of documents, so that a small message
+// can't exhaust the stack.
+const maxDepth = 1000
+
+var (
+	errDepth     = errors.New("codec: document nested too deeply")
+	errTruncated = errors.New("codec: truncated msgpack")
+)
+
+func (Msgpack) Decode(data []byte) (message.Message, error) {
+	r := bytes.NewReader(data)
+	decoder := msgpack.NewDecoder(r)
+	var buf bytes.Buffer
+	err := transcode(decoder, &buf, 0)
+	if err != nil {
+		return message.Message{}, msgpackError(err)
+	}
+	if r.Len() > 0 {
+		return message.Message{}, fmt.Errorf("codec: %d bytes after msgpack value", r.Len())
+	}
+	return message.New(buf.String()), nil
+}
+
+func (Msgpack) Encode(m message.Message) ([]byte, error) {
+	decoder := json.NewDecoder(strings.NewReader(m.Body))
+	decoder.UseNumber()
+	var buf bytes.Buffer
+	err := encodeMsgpack(decoder, msgpack.NewEncoder(&buf), 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errInvalidJSON
+	}
+	return buf.Bytes(), nil
+}
+
+// msgpackError prefixes errors of the msgpack package.
+func msgpackError(err error) error {
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return errTruncated
+	case strings.HasPrefix(err.Error(), "codec: "):
+		return err
+	}
+	return fmt.Errorf("codec: %w", err)
+}
+
+// transcode writes the next value of `d` as JSON to `w`. Containers
+// are walked so that keys keep their order, other values are decoded
+// by the msgpack package.
+func transcode(d *msgpack.Decoder, w *bytes.Buffer, depth int) error {
+	if depth > maxDepth {
+		return errDepth
+	}
+	c, err := d.PeekCode()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case msgpcode.IsFixedMap(c) || c == msgpcode.Map16 || c == msgpcode.Map32:
+		n, err := d.DecodeMapLen()
+		if err != nil {
+			return err
+		}
+		return transcodeMap(d, w, n, depth)
+	case msgpcode.IsFixedArray(c) || c == msgpcode.Array16 || c == msgpcode.Array32:
+		n, err := d.DecodeArrayLen()
+		if err != nil {
+			return err
+		}
+		return transcodeArray(d, w, n, depth)
+	}
+
+	// extensions other than timestamps aren't registered
+	v, err := d.DecodeInterface()
+	if err != nil {
+		return err
+	}
+	return writeValue(w, v)
+}
+
+func transcodeArray(d *msgpack.Decoder, w *bytes.Buffer, n int, depth int) error {
+	w.WriteByte('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		err := transcode(d, w, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	w.WriteByte(']')
+	return nil
+}
+
+func transcodeMap(d *msgpack.Decoder, w *bytes.Buffer, n int, depth int) error {
+	w.WriteByte('{')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		c, err := d.PeekCode()
+		if err != nil {
+			return err
+		}
+		// keys are strings in JSON
+		if msgpcode.IsString(c) {
+			err = transcode(d, w, depth+1)
+		} else {
+			var key bytes.Buffer
+			err = transcode(d, &key, depth+1)
+			writeString(w, key.String())
+		}
+		if err != nil {
+			return err
+		}
+		w.WriteByte(':')
+		err = transcode(d, w, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	w.WriteByte('}')
+	return nil
+}
+
+// writeValue writes a scalar decoded by the msgpack package as JSON.
+func writeValue(w *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		w.WriteString("null")
+	case bool:
+		w.WriteString(strconv.FormatBool(v))
+	case string:
+		writeString(w, v)
+	case []byte:
+		writeString(w, base64.StdEncoding.EncodeToString(v))
+	case time.Time:
+		writeString(w, v.UTC().Format(time.RFC3339Nano))
+	case float32:
+		return writeFloat(w, float64(v), 32)
+	case float64:
+		return writeFloat(w, v, 64)
+	case int8:
+		w.WriteString(strconv.FormatInt(int64(v), 10))
+	case int16:
+		w.WriteString(strconv.FormatInt(int64(v), 10))
+	case int32:
+		w.WriteString(strconv.FormatInt(int64(v), 10))
+	case int64:
+		w.WriteString(strconv.FormatInt(v, 10))
+	case uint8:
+		w.WriteString(strconv.FormatUint(uint64(v), 10))
+	case uint16:
+		w.WriteString(strconv.FormatUint(uint64(v), 10))
+	case uint32:
+		w.WriteString(strconv.FormatUint(uint64(v), 10))
+	case uint64:
+		w.WriteString(strconv.FormatUint(v, 10))
+	default:
+		return fmt.Errorf("codec: unsupported msgpack value %T", v)
+	}
+	return nil
+}
+
+// writeString writes `s` as a JSON string.
+func writeString(w *bytes.Buffer, s string) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	// drop the newline of Encode
+	w.Truncate(w.Len() - 1)
+}
+
+// writeFloat writes `f` as a JSON number.
+func writeFloat(w *bytes.Buffer, f float64, bits int) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("codec: unsupported float %v", f)
+	}
+	w.WriteString(strconv.FormatFloat(f, 'g', -1, bits))
+	return nil
+}
+
+// encodeMsgpack writes the next JSON value of `d` as MessagePack to
+// `e`.
+func encodeMsgpack(d *json.Decoder, e *msgpack.Encoder, depth int) error {
+	if depth > maxDepth {
+		return errDepth
+	}
+	token, err := d.Token()
+	if err != nil {
+		return errInvalidJSON
+	}
+
+	switch t := token.(type) {
+	case json.Delim:
+		// containers are written once their length is known
+		var body bytes.Buffer
+		elements := msgpack.NewEncoder(&body)
+		n := 0
+		for d.More() {
+			if t == '{' {
+				key, err := d.Token()
+				if err != nil {
+					return errInvalidJSON
+				}
+				elements.EncodeString(key.(string))
+			}
+			err := encodeMsgpack(d, elements, depth+1)
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		// closing delimiter
+		if _, err := d.Token(); err != nil {
+			return errInvalidJSON
+		}
+		if t == '{' {
+			err = e.EncodeMapLen(n)
+		} else {
+			err = e.EncodeArrayLen(n)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = e.Writer().Write(body.Bytes())
+		return err
+	case string:
+		return e.EncodeString(t)
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return e.EncodeInt(i)
+		}
+		if u, err := strconv.ParseUint(string(t), 10, 64); err == nil {
+			return e.EncodeUint(u)
+		}
+		f, err := t.Float64()
+		if err != nil {
+			return fmt.Errorf("codec: number %s out of range", t)
+		}
+		return e.EncodeFloat64(f)
+	case bool:
+		return e.EncodeBool(t)
+	}
+	return e.EncodeNil()
+}
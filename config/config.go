@@ -0,0 +1,584 @@
+// Package config builds pipelines from a declarative YAML or JSON
+// definition, so pipelines can be deployed without writing Go.
+//
+// Example:
+//
+//	pipelines:
+//	  - name: orders-archiver
+//	    source:
+//	      type: kinesis
+//	      settings:
+//	        consumerName: archiver
+//	        streamARN: arn:aws:kinesis:us-east-1:999999999999:stream/orders
+//	        args:
+//	          mode: polling
+//	    transforms:
+//	      - type: json
+//	        settings:
+//	          append:
+//	            source: kinesis
+//	    destination:
+//	      type: s3
+//	      codec: json
+//	      settings:
+//	        region: us-east-1
+//	        bucketName: logs
+//	        config:
+//	          folder: orders
+//	          commitFileSize: 1024
+//	          commitDuration: 5
+//	          uploadEvery: 10
+//	    maxAttempts: 3
+//	    retryDelay: 1s
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/abstractpaper/manifold/stream"
+	"github.com/abstractpaper/manifold/transform"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a set of pipeline definitions.
+type Config struct {
+	Pipelines []Pipeline `json:"pipelines" yaml:"pipelines"`
+}
+
+// Pipeline defines a stream.Pipeline, see its documentation for the
+// meaning of each option. Durations are strings such as "10s".
+type Pipeline struct {
+	Name          string  `json:"name" yaml:"name"`
+	Source        Stage   `json:"source" yaml:"source"`
+	Transforms    []Stage `json:"transforms,omitempty" yaml:"transforms,omitempty"`
+	Destination   Stage   `json:"destination" yaml:"destination"`
+	DLQ           *Stage  `json:"dlq,omitempty" yaml:"dlq,omitempty"`
+	MaxAttempts   int     `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty"`
+	RetryDelay    string  `json:"retryDelay,omitempty" yaml:"retryDelay,omitempty"`
+	OnFailure     string  `json:"onFailure,omitempty" yaml:"onFailure,omitempty"` // quarantine or pausePartition
+	PartitionKey  string  `json:"partitionKey,omitempty" yaml:"partitionKey,omitempty"`
+	ProbeInterval string  `json:"probeInterval,omitempty" yaml:"probeInterval,omitempty"`
+	WriteTimeout  string  `json:"writeTimeout,omitempty" yaml:"writeTimeout,omitempty"`
+	// consecutive failed writes that open the circuit breaker
+	BreakerThreshold int    `json:"breakerThreshold,omitempty" yaml:"breakerThreshold,omitempty"`
+	BreakerCooldown  string `json:"breakerCooldown,omitempty" yaml:"breakerCooldown,omitempty"`
+	// earliest, latest or an RFC 3339 time, the source must support
+	// seeking
+	StartFrom string `json:"startFrom,omitempty" yaml:"startFrom,omitempty"`
+	// resume after these offsets per partition (e.g. Kinesis shard
+	// id to sequence number) instead
+	StartOffsets map[string]string `json:"startOffsets,omitempty" yaml:"startOffsets,omitempty"`
+	// compress messages queued in partition lanes
+	CompressBuffers bool `json:"compressBuffers,omitempty" yaml:"compressBuffers,omitempty"`
+	// warn when the source delivers nothing for idleTimeout, and
+	// write heartbeats every heartbeat meanwhile
+	IdleTimeout string `json:"idleTimeout,omitempty" yaml:"idleTimeout,omitempty"`
+	Heartbeat   string `json:"heartbeat,omitempty" yaml:"heartbeat,omitempty"`
+	// log sampled payloads, see stream.Sampler
+	Sample *Sample `json:"sample,omitempty" yaml:"sample,omitempty"`
+	// guarantees the pipeline must provide, see stream.Guarantees
+	Require *Require `json:"require,omitempty" yaml:"require,omitempty"`
+	// log level of the pipeline and its connectors (trace, debug,
+	// info, warn or error), defaults to the level of the process
+	LogLevel string `json:"logLevel,omitempty" yaml:"logLevel,omitempty"`
+	// largest body in bytes, defaults to the destination's limit,
+	// and what happens to larger messages: reject (to the DLQ,
+	// default), truncate or offload (to the `offload` store)
+	MaxMessageSize int    `json:"maxMessageSize,omitempty" yaml:"maxMessageSize,omitempty"`
+	OnOversize     string `json:"onOversize,omitempty" yaml:"onOversize,omitempty"`
+	Offload        *Stage `json:"offload,omitempty" yaml:"offload,omitempty"`
+	// apply erasure requests read from a control source
+	Erasure *Erasure `json:"erasure,omitempty" yaml:"erasure,omitempty"`
+	// route a percentage of the source's messages through a canary
+	// version of the pipeline (see Runner)
+	Canary *Canary `json:"canary,omitempty" yaml:"canary,omitempty"`
+	// write messages to a local WAL before the destination (see
+	// stream.Spool)
+	Spool *Spool `json:"spool,omitempty" yaml:"spool,omitempty"`
+	// bounds the graceful drain on SIGINT or SIGTERM, defaults to 25s
+	DrainTimeout string `json:"drainTimeout,omitempty" yaml:"drainTimeout,omitempty"`
+	// process messages with workers, in order per partitionKey value
+	// with the byKey ordering (see stream.OrderedByKey)
+	Workers         int    `json:"workers,omitempty" yaml:"workers,omitempty"`
+	Ordering        string `json:"ordering,omitempty" yaml:"ordering,omitempty"` // unordered or byKey
+	WorkerQueueSize int    `json:"workerQueueSize,omitempty" yaml:"workerQueueSize,omitempty"`
+}
+
+// Require defines the guarantees a pipeline must provide.
+type Require struct {
+	Delivery string `json:"delivery,omitempty" yaml:"delivery,omitempty"` // at-most-once, at-least-once or exactly-once
+	Ordered  bool   `json:"ordered,omitempty" yaml:"ordered,omitempty"`
+}
+
+// Spool defines the WAL of a pipeline's destination. Messages failing
+// MaxAttempts writes are quarantined to the pipeline's DLQ.
+type Spool struct {
+	Path          string `json:"path,omitempty" yaml:"path,omitempty"`               // defaults to /tmp/manifold/spool/<name>
+	SegmentSize   int    `json:"segmentSize,omitempty" yaml:"segmentSize,omitempty"` // KB
+	MaxSize       int    `json:"maxSize,omitempty" yaml:"maxSize,omitempty"`         // KB
+	Sync          bool   `json:"sync,omitempty" yaml:"sync,omitempty"`
+	RetryDelay    string `json:"retryDelay,omitempty" yaml:"retryDelay,omitempty"`
+	MaxRetryDelay string `json:"maxRetryDelay,omitempty" yaml:"maxRetryDelay,omitempty"`
+	MaxAttempts   int    `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty"`
+}
+
+// Canary defines the canary version of a pipeline, which reads
+// Percent of the messages of its source (see stream.Split). Its
+// transforms and destination replace those of the pipeline if set
+// (an empty list of transforms removes them). Erasure requests are
+// applied by the stable version only.
+type Canary struct {
+	Percent     int     `json:"percent" yaml:"percent"`
+	Key         string  `json:"key,omitempty" yaml:"key,omitempty"`
+	Transforms  []Stage `json:"transforms,omitempty" yaml:"transforms,omitempty"`
+	Destination *Stage  `json:"destination,omitempty" yaml:"destination,omitempty"`
+}
+
+// Erasure configures a stream.Erasure, Control is a source stage.
+type Erasure struct {
+	Control       Stage  `json:"control" yaml:"control"`
+	SubjectField  string `json:"subjectField" yaml:"subjectField"`
+	DeleteMarkers bool   `json:"deleteMarkers,omitempty" yaml:"deleteMarkers,omitempty"`
+	Retention     string `json:"retention,omitempty" yaml:"retention,omitempty"`
+}
+
+// Sample configures a stream.Sampler.
+type Sample struct {
+	Enabled        bool     `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	Every          int      `json:"every,omitempty" yaml:"every,omitempty"`
+	Stages         []string `json:"stages,omitempty" yaml:"stages,omitempty"`
+	MaxLength      int      `json:"maxLength,omitempty" yaml:"maxLength,omitempty"`
+	Redact         []string `json:"redact,omitempty" yaml:"redact,omitempty"`
+	RedactPatterns []string `json:"redactPatterns,omitempty" yaml:"redactPatterns,omitempty"`
+}
+
+// Stage is a connector or transform: a registered type and its
+// settings.
+type Stage struct {
+	Type     string   `json:"type" yaml:"type"`
+	Settings Settings `json:"settings,omitempty" yaml:"settings,omitempty"`
+	// registered codec (see codec.Register) decoding the messages of
+	// a source or encoding those written to a destination or DLQ
+	Codec string `json:"codec,omitempty" yaml:"codec,omitempty"`
+}
+
+// Load reads a config file, it is parsed as JSON if its extension
+// is .json and as YAML otherwise.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return ParseJSON(data)
+	}
+	return ParseYAML(data)
+}
+
+// ParseYAML parses a YAML config. Unknown keys are an error.
+func ParseYAML(data []byte) (*Config, error) {
+	var c Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&c)
+	if err != nil {
+		return nil, err
+	}
+	return &c, c.validate()
+}
+
+// ParseJSON parses a JSON config. Unknown keys are an error.
+func ParseJSON(data []byte) (*Config, error) {
+	var c Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&c)
+	if err != nil {
+		return nil, err
+	}
+	return &c, c.validate()
+}
+
+func (c *Config) validate() error {
+	if len(c.Pipelines) == 0 {
+		return errors.New("config: no pipelines defined")
+	}
+
+	names := map[string]bool{}
+	for i, p := range c.Pipelines {
+		if p.Name == "" {
+			return fmt.Errorf("config: pipeline #%d has no name", i+1)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("config: duplicate pipeline name %q", p.Name)
+		}
+		names[p.Name] = true
+	}
+	return nil
+}
+
+// Build creates the pipeline's connectors and transforms.
+func (p Pipeline) Build() (*stream.Pipeline, error) {
+	return p.build(true)
+}
+
+// build builds the pipeline, without its source unless `source` is
+// set (e.g. canary versions share the source of the pipeline).
+func (p Pipeline) build(source bool) (pipeline *stream.Pipeline, err error) {
+	pipeline = &stream.Pipeline{
+		Name:             p.Name,
+		MaxAttempts:      p.MaxAttempts,
+		PartitionKey:     p.PartitionKey,
+		BreakerThreshold: p.BreakerThreshold,
+		CompressBuffers:  p.CompressBuffers,
+	}
+
+	if source {
+		pipeline.Source, err = newSource(p.Source)
+		if err != nil {
+			return nil, p.errorf("source", err)
+		}
+	}
+	// canary versions decode the messages of the shared source too
+	pipeline.Codecs.Source, err = newCodec(p.Source)
+	if err != nil {
+		return nil, p.errorf("source", err)
+	}
+	pipeline.Destination, err = newDestination(p.Destination)
+	if err != nil {
+		return nil, p.errorf("destination", err)
+	}
+	pipeline.Codecs.Destination, err = newCodec(p.Destination)
+	if err != nil {
+		return nil, p.errorf("destination", err)
+	}
+	if p.DLQ != nil {
+		pipeline.DLQ, err = newDestination(*p.DLQ)
+		if err != nil {
+			return nil, p.errorf("dlq", err)
+		}
+		pipeline.Codecs.DLQ, err = newCodec(*p.DLQ)
+		if err != nil {
+			return nil, p.errorf("dlq", err)
+		}
+	}
+
+	var chain transform.Chain
+	for _, stage := range p.Transforms {
+		if stage.Codec != "" {
+			return nil, p.errorf("transform", errors.New("codecs are set on sources and destinations"))
+		}
+		t, err := newTransform(stage)
+		if err != nil {
+			return nil, p.errorf("transform", err)
+		}
+		chain = append(chain, t)
+	}
+	switch len(chain) {
+	case 0:
+	case 1:
+		pipeline.Transformer = chain[0]
+	default:
+		pipeline.Transformer = chain
+	}
+
+	switch p.OnFailure {
+	case "", "quarantine":
+		pipeline.OnFailure = stream.Quarantine
+	case "pausePartition":
+		pipeline.OnFailure = stream.PausePartition
+	default:
+		return nil, p.errorf("onFailure", fmt.Errorf("unknown policy %q", p.OnFailure))
+	}
+
+	pipeline.Workers = p.Workers
+	pipeline.WorkerQueueSize = p.WorkerQueueSize
+	switch p.Ordering {
+	case "", "unordered":
+		pipeline.Ordering = stream.Unordered
+	case "byKey":
+		pipeline.Ordering = stream.OrderedByKey
+		if p.PartitionKey == "" {
+			return nil, p.errorf("ordering", errors.New("partitionKey is required to order messages by key"))
+		}
+	default:
+		return nil, p.errorf("ordering", fmt.Errorf("unknown ordering %q", p.Ordering))
+	}
+
+	pipeline.RetryDelay, err = parseDuration(p.RetryDelay)
+	if err != nil {
+		return nil, p.errorf("retryDelay", err)
+	}
+	pipeline.ProbeInterval, err = parseDuration(p.ProbeInterval)
+	if err != nil {
+		return nil, p.errorf("probeInterval", err)
+	}
+	pipeline.WriteTimeout, err = parseDuration(p.WriteTimeout)
+	if err != nil {
+		return nil, p.errorf("writeTimeout", err)
+	}
+	pipeline.BreakerCooldown, err = parseDuration(p.BreakerCooldown)
+	if err != nil {
+		return nil, p.errorf("breakerCooldown", err)
+	}
+	pipeline.IdleTimeout, err = parseDuration(p.IdleTimeout)
+	if err != nil {
+		return nil, p.errorf("idleTimeout", err)
+	}
+	pipeline.Heartbeat, err = parseDuration(p.Heartbeat)
+	if err != nil {
+		return nil, p.errorf("heartbeat", err)
+	}
+	pipeline.DrainTimeout, err = parseDuration(p.DrainTimeout)
+	if err != nil {
+		return nil, p.errorf("drainTimeout", err)
+	}
+	if p.Sample != nil {
+		pipeline.Sampler = &stream.Sampler{
+			Enabled:        p.Sample.Enabled,
+			Every:          p.Sample.Every,
+			Stages:         p.Sample.Stages,
+			MaxLength:      p.Sample.MaxLength,
+			Redact:         p.Sample.Redact,
+			RedactPatterns: p.Sample.RedactPatterns,
+		}
+		err = pipeline.Sampler.Compile()
+		if err != nil {
+			return nil, p.errorf("sample", err)
+		}
+	}
+	level := stream.StandardLevel()
+	if p.LogLevel != "" {
+		level, err = stream.ParseLevel(p.LogLevel)
+		if err != nil {
+			return nil, p.errorf("logLevel", err)
+		}
+	}
+	pipeline.Logger = stream.NewLevelLogger(level)
+	pipeline.StartFrom, err = p.startFrom()
+	if err != nil {
+		return nil, p.errorf("startFrom", err)
+	}
+
+	pipeline.MaxMessageSize = p.MaxMessageSize
+	switch p.OnOversize {
+	case "", "reject":
+		pipeline.OnOversize = stream.RejectOversize
+	case "truncate":
+		pipeline.OnOversize = stream.TruncateOversize
+	case "offload":
+		pipeline.OnOversize = stream.OffloadOversize
+		if p.Offload == nil {
+			return nil, p.errorf("offload", errors.New("an offload store is required to offload messages"))
+		}
+	default:
+		return nil, p.errorf("onOversize", fmt.Errorf("unknown policy %q", p.OnOversize))
+	}
+	if p.Offload != nil {
+		pipeline.Offloader, err = newOffloader(*p.Offload)
+		if err != nil {
+			return nil, p.errorf("offload", err)
+		}
+	}
+	if p.Erasure != nil {
+		pipeline.Erasure, err = p.Erasure.build()
+		if err != nil {
+			return nil, p.errorf("erasure", err)
+		}
+	}
+	if p.Spool != nil {
+		pipeline.Destination, err = p.Spool.build(p.Name, pipeline.Destination, pipeline.DLQ)
+		if err != nil {
+			return nil, p.errorf("spool", err)
+		}
+	}
+	if p.Require != nil {
+		pipeline.Require.Ordered = p.Require.Ordered
+		if p.Require.Delivery != "" {
+			pipeline.Require.Delivery, err = stream.ParseDelivery(p.Require.Delivery)
+			if err != nil {
+				return nil, p.errorf("require", err)
+			}
+		}
+		// canary versions are validated once their source is set
+		if source {
+			err = pipeline.Validate()
+			if err != nil {
+				return nil, p.errorf("require", err)
+			}
+		}
+	}
+	if p.Canary != nil && (p.Canary.Percent < 1 || p.Canary.Percent > 100) {
+		return nil, p.errorf("canary", errors.New("percent must be between 1 and 100"))
+	}
+
+	return
+}
+
+// Resource is a resource needed by a stage of a pipeline (see
+// stream.Provisioned).
+type Resource struct {
+	Pipeline        string `json:"pipeline" yaml:"pipeline"`
+	Stage           string `json:"stage" yaml:"stage"` // source, destination, dlq, offload, erasure or canary
+	Type            string `json:"type" yaml:"type"`   // connector type of the stage
+	stream.Resource `yaml:",inline"`
+}
+
+// Resources builds the pipeline, without connecting, and returns the
+// resources its source, destination, DLQ, offload store, erasure
+// control source and canary destination need.
+func (p Pipeline) Resources() ([]Resource, error) {
+	pipeline, err := p.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []Resource
+	add := func(stage string, typ string, connector interface{}) {
+		for _, r := range stream.Resources(connector) {
+			resources = append(resources, Resource{Pipeline: p.Name, Stage: stage, Type: typ, Resource: r})
+		}
+	}
+	add("source", p.Source.Type, pipeline.Source)
+	add("destination", p.Destination.Type, pipeline.Destination)
+	if p.DLQ != nil {
+		add("dlq", p.DLQ.Type, pipeline.DLQ)
+	}
+	if p.Offload != nil {
+		add("offload", p.Offload.Type, pipeline.Offloader)
+	}
+	if p.Erasure != nil {
+		add("erasure", p.Erasure.Control.Type, pipeline.Erasure.Control)
+	}
+	if p.Canary != nil && p.Canary.Destination != nil {
+		dest, err := newDestination(*p.Canary.Destination)
+		if err != nil {
+			return nil, p.errorf("canary", err)
+		}
+		add("canary", p.Canary.Destination.Type, dest)
+	}
+	return resources, nil
+}
+
+// Resources returns the resources needed by the pipelines of the
+// config, in order.
+func (c *Config) Resources() ([]Resource, error) {
+	var resources []Resource
+	for _, p := range c.Pipelines {
+		r, err := p.Resources()
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, r...)
+	}
+	return resources, nil
+}
+
+// canaryVersion returns the definition of the canary version of the
+// pipeline, named <Name>:canary.
+func (p Pipeline) canaryVersion() Pipeline {
+	canary := p
+	canary.Name = p.Name + ":canary"
+	canary.Canary = nil
+	// requests are read by the stable version
+	canary.Erasure = nil
+	if p.Canary.Transforms != nil {
+		canary.Transforms = p.Canary.Transforms
+	}
+	if p.Canary.Destination != nil {
+		canary.Destination = *p.Canary.Destination
+	}
+	// spools don't share their WAL
+	if p.Spool != nil {
+		spool := *p.Spool
+		spool.Path = filepath.Join(spool.path(p.Name), "canary")
+		canary.Spool = &spool
+	}
+	return canary
+}
+
+// path returns the WAL directory of the pipeline `name`.
+func (s Spool) path(name string) string {
+	if s.Path == "" {
+		return filepath.Join("/tmp/manifold/spool", name)
+	}
+	return s.Path
+}
+
+func (s Spool) build(name string, dest stream.Destination, dlq stream.Destination) (stream.Destination, error) {
+	opts := stream.SpoolOptions{
+		Path:        s.path(name),
+		SegmentSize: int64(s.SegmentSize) << 10,
+		MaxSize:     int64(s.MaxSize) << 10,
+		Sync:        s.Sync,
+		MaxAttempts: s.MaxAttempts,
+		DLQ:         dlq,
+	}
+	var err error
+	opts.RetryDelay, err = parseDuration(s.RetryDelay)
+	if err != nil {
+		return nil, err
+	}
+	opts.MaxRetryDelay, err = parseDuration(s.MaxRetryDelay)
+	if err != nil {
+		return nil, err
+	}
+	return stream.Spool(dest, opts), nil
+}
+
+func (e Erasure) build() (*stream.Erasure, error) {
+	if e.SubjectField == "" {
+		return nil, errors.New("subjectField is required")
+	}
+	erasure := &stream.Erasure{SubjectField: e.SubjectField, DeleteMarkers: e.DeleteMarkers}
+	var err error
+	erasure.Retention, err = parseDuration(e.Retention)
+	if err != nil {
+		return nil, err
+	}
+	erasure.Control, err = newSource(e.Control)
+	return erasure, err
+}
+
+// startFrom returns the position set by StartFrom or StartOffsets.
+func (p Pipeline) startFrom() (*stream.Position, error) {
+	if len(p.StartOffsets) > 0 {
+		if p.StartFrom != "" {
+			return nil, errors.New("startFrom and startOffsets are exclusive")
+		}
+		return &stream.Position{Type: stream.AfterOffsets, Offsets: p.StartOffsets}, nil
+	}
+
+	switch p.StartFrom {
+	case "":
+		return nil, nil
+	case "earliest":
+		return &stream.Position{Type: stream.Earliest}, nil
+	case "latest":
+		return &stream.Position{Type: stream.Latest}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, p.StartFrom)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not earliest, latest or an RFC 3339 time", p.StartFrom)
+	}
+	return &stream.Position{Type: stream.AtTimestamp, Timestamp: t}, nil
+}
+
+func (p Pipeline) errorf(stage string, err error) error {
+	return fmt.Errorf("pipeline %s: %s: %s", p.Name, stage, err)
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
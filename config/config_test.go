@@ -0,0 +1,397 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/codec"
+	"github.com/abstractpaper/manifold/stream"
+	"github.com/abstractpaper/manifold/transform"
+	"github.com/abstractpaper/manifold/transform/decode"
+	transformJSON "github.com/abstractpaper/manifold/transform/json"
+	"github.com/stretchr/testify/assert"
+)
+
+const pipelineYAML = `
+pipelines:
+  - name: ingest
+    source:
+      type: http
+      settings:
+        addr: ":8080"
+        token: secret
+        config:
+          maxRequestSize: 512
+          sync: true
+    transforms:
+      - type: json
+        settings:
+          append:
+            source: http
+      - type: json
+        settings:
+          metadata:
+            path: http.path
+    destination:
+      type: webhook
+      settings:
+        url: https://example.com/{{.Fields.type}}
+        config:
+          batchSize: 10
+    dlq:
+      type: stdio
+    maxAttempts: 3
+    retryDelay: 2s
+    onFailure: pausePartition
+    partitionKey: http.path
+    drainTimeout: 20s
+`
+
+func TestParseYAML_Build(t *testing.T) {
+	c, err := ParseYAML([]byte(pipelineYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := c.Pipelines[0].Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "ingest", p.Name)
+	assert.Equal(t, &stream.HTTP{
+		Addr:   ":8080",
+		Token:  "secret",
+		Config: &stream.HTTPConfig{MaxRequestSize: 512, Sync: true},
+	}, p.Source)
+	assert.Equal(t, transform.Chain{
+		&transformJSON.JSON{Append: map[string]interface{}{"source": "http"}},
+		&transformJSON.JSON{Metadata: map[string]string{"path": "http.path"}},
+	}, p.Transformer)
+	assert.Equal(t, "https://example.com/{{.Fields.type}}", p.Destination.(*stream.Webhook).URL)
+	assert.Equal(t, 10, p.Destination.(*stream.Webhook).Config.BatchSize)
+	assert.IsType(t, &stream.Stdio{}, p.DLQ)
+	assert.Equal(t, 3, p.MaxAttempts)
+	assert.Equal(t, 2*time.Second, p.RetryDelay)
+	assert.Equal(t, stream.PausePartition, p.OnFailure)
+	assert.Equal(t, "http.path", p.PartitionKey)
+	assert.Equal(t, 20*time.Second, p.DrainTimeout)
+}
+
+func TestParseJSON_Errors(t *testing.T) {
+	_, err := ParseJSON([]byte(`{"pipelines": []}`))
+	assert.Error(t, err)
+
+	_, err = ParseJSON([]byte(`{"pipelines": [{"name": "a"}, {"name": "a"}]}`))
+	assert.Error(t, err)
+
+	c, err := ParseJSON([]byte(`{"pipelines": [{"name": "a", "source": {"type": "nope"}}]}`))
+	assert.NoError(t, err)
+	_, err = c.Pipelines[0].Build()
+	assert.EqualError(t, err, `pipeline a: source: unknown source type "nope"`)
+}
+
+func TestParse_UnknownKeys(t *testing.T) {
+	_, err := ParseYAML([]byte("pipelines:\n  - name: a\n    maxAtempts: 3\n"))
+	assert.Error(t, err)
+	_, err = ParseJSON([]byte(`{"pipelines": [{"name": "a", "maxAtempts": 3}]}`))
+	assert.Error(t, err)
+
+	// settings are checked when the pipeline is built
+	for _, stage := range []string{
+		`{"type": "http", "settings": {"adr": ":8080"}}`,
+		`{"type": "http", "settings": {"config": {"maxRequestSise": 512}}}`,
+		`{"type": "stdio", "settings": {"mode": "json"}}`,
+	} {
+		c, err := ParseJSON([]byte(`{"pipelines": [{"name": "a", "source": ` + stage + `}]}`))
+		assert.NoError(t, err)
+		_, err = c.Pipelines[0].Build()
+		assert.Error(t, err, stage)
+	}
+}
+
+func TestPipeline_StartFrom(t *testing.T) {
+	for startFrom, want := range map[string]*stream.Position{
+		"":                     nil,
+		"earliest":             {Type: stream.Earliest},
+		"latest":               {Type: stream.Latest},
+		"2020-10-01T12:00:00Z": {Type: stream.AtTimestamp, Timestamp: time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)},
+	} {
+		pos, err := Pipeline{StartFrom: startFrom}.startFrom()
+		assert.NoError(t, err)
+		assert.Equal(t, want, pos)
+	}
+
+	pos, err := Pipeline{StartOffsets: map[string]string{"shardId-0": "42"}}.startFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, &stream.Position{Type: stream.AfterOffsets, Offsets: map[string]string{"shardId-0": "42"}}, pos)
+
+	_, err = Pipeline{StartFrom: "yesterday"}.startFrom()
+	assert.Error(t, err)
+	_, err = Pipeline{StartFrom: "latest", StartOffsets: map[string]string{"shardId-0": "42"}}.startFrom()
+	assert.Error(t, err)
+}
+
+func TestBuild_Router(t *testing.T) {
+	c, err := ParseYAML([]byte(`
+pipelines:
+  - name: routed
+    source:
+      type: stdio
+    destination:
+      type: router
+      settings:
+        routes:
+          - name: purchases
+            when: payload.type == "purchase"
+            destination:
+              type: stdio
+        default:
+          type: stdio
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.Pipelines[0].Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := p.Destination.(*stream.Router)
+	assert.Len(t, r.Routes, 1)
+	assert.Equal(t, "purchases", r.Routes[0].Name)
+	assert.Equal(t, `payload.type == "purchase"`, r.Routes[0].When)
+	assert.IsType(t, &stream.Stdio{}, r.Routes[0].Destination)
+	assert.IsType(t, &stream.Stdio{}, r.Default)
+}
+
+func TestBuild_Oversize(t *testing.T) {
+	p := Pipeline{
+		Name:           "truncated",
+		Source:         Stage{Type: "stdio"},
+		Destination:    Stage{Type: "stdio"},
+		MaxMessageSize: 1024,
+		OnOversize:     "truncate",
+	}
+	pipeline, err := p.Build()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1024, pipeline.MaxMessageSize)
+		assert.Equal(t, stream.TruncateOversize, pipeline.OnOversize)
+	}
+
+	p.OnOversize = "offload"
+	_, err = p.Build()
+	assert.EqualError(t, err, "pipeline truncated: offload: an offload store is required to offload messages")
+	p.Offload = &Stage{Type: "ftp"}
+	_, err = p.Build()
+	assert.EqualError(t, err, `pipeline truncated: offload: unknown offload type "ftp"`)
+	p.OnOversize = "split"
+	_, err = p.Build()
+	assert.EqualError(t, err, `pipeline truncated: onOversize: unknown policy "split"`)
+}
+
+func TestBuild_LogLevel(t *testing.T) {
+	p := Pipeline{
+		Name:        "noisy",
+		Source:      Stage{Type: "stdio"},
+		Destination: Stage{Type: "stdio"},
+		LogLevel:    "warn",
+	}
+	pipeline, err := p.Build()
+	if assert.NoError(t, err) {
+		level, ok := pipeline.LogLevel()
+		assert.True(t, ok)
+		assert.Equal(t, stream.WarnLevel, level)
+	}
+
+	p.LogLevel = "loud"
+	_, err = p.Build()
+	assert.EqualError(t, err, `pipeline noisy: logLevel: unknown log level "loud"`)
+}
+
+func TestBuild_Require(t *testing.T) {
+	p := Pipeline{
+		Name:        "archive",
+		Source:      Stage{Type: "redis", Settings: map[string]interface{}{"url": "redis://localhost", "args": map[string]interface{}{"mode": "list", "key": "events"}}},
+		Destination: Stage{Type: "stdio"},
+		Require:     &Require{Delivery: "at-least-once", Ordered: true},
+	}
+	pipeline, err := p.Build()
+	if assert.NoError(t, err) {
+		assert.Equal(t, stream.Guarantees{Delivery: stream.AtLeastOnce, Ordered: true}, pipeline.Require)
+	}
+
+	p.Require.Delivery = "exactly-once"
+	_, err = p.Build()
+	assert.EqualError(t, err, "pipeline archive: require: exactly-once delivery required, the pipeline provides at-least-once: destination *stream.Stdio isn't idempotent")
+	p.Require.Delivery = "twice"
+	_, err = p.Build()
+	assert.EqualError(t, err, `pipeline archive: require: unknown delivery guarantee "twice"`)
+}
+
+func TestBuild_Spool(t *testing.T) {
+	c, err := ParseYAML([]byte(`
+pipelines:
+  - name: orders
+    source:
+      type: stdio
+    destination:
+      type: stdio
+    dlq:
+      type: stdio
+    spool:
+      segmentSize: 1024
+      retryDelay: 2s
+      maxAttempts: 5
+    canary:
+      percent: 10
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := c.Pipelines[0].Build()
+	if !assert.NoError(t, err) {
+		return
+	}
+	spool, ok := pipeline.Destination.(*stream.SpoolDestination)
+	if assert.True(t, ok) {
+		assert.Equal(t, "/tmp/manifold/spool/orders", spool.Options.Path)
+		assert.Equal(t, int64(1<<20), spool.Options.SegmentSize)
+		assert.Equal(t, 2*time.Second, spool.Options.RetryDelay)
+		assert.Equal(t, pipeline.DLQ, spool.Options.DLQ)
+		assert.IsType(t, &stream.Stdio{}, spool.Destination)
+	}
+	assert.Equal(t, "/tmp/manifold/spool/orders/canary", c.Pipelines[0].canaryVersion().Spool.Path)
+
+	c.Pipelines[0].Spool.RetryDelay = "soon"
+	_, err = c.Pipelines[0].Build()
+	assert.Error(t, err)
+}
+
+func TestBuild_Erasure(t *testing.T) {
+	c, err := ParseYAML([]byte(`
+pipelines:
+  - name: profiles
+    source:
+      type: stdio
+    destination:
+      type: stdio
+    erasure:
+      control:
+        type: rabbitmq
+        settings:
+          url: amqp://localhost
+          args:
+            queue: erasures
+      subjectField: user.id
+      deleteMarkers: true
+      retention: 48h
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.Pipelines[0].Build()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "user.id", p.Erasure.SubjectField)
+		assert.True(t, p.Erasure.DeleteMarkers)
+		assert.Equal(t, 48*time.Hour, p.Erasure.Retention)
+		assert.IsType(t, &stream.RabbitMQ{}, p.Erasure.Control)
+	}
+	resources, err := c.Resources()
+	assert.NoError(t, err)
+	assert.Equal(t, []Resource{{Pipeline: "profiles", Stage: "erasure", Type: "rabbitmq", Resource: stream.Resource{Kind: "rabbitmq_queue", Name: "erasures"}}}, resources)
+
+	c.Pipelines[0].Erasure.SubjectField = ""
+	_, err = c.Pipelines[0].Build()
+	assert.EqualError(t, err, "pipeline profiles: erasure: subjectField is required")
+}
+
+func TestBuild_Decode(t *testing.T) {
+	c, err := ParseYAML([]byte(`
+pipelines:
+  - name: logs
+    source:
+      type: stdio
+    transforms:
+      - type: decompress
+      - type: unwrap
+        settings:
+          records: records
+          value: data
+          fields: [invocationId]
+      - type: base64Decode
+    destination:
+      type: stdio
+`))
+	assert.NoError(t, err)
+	p, err := c.Pipelines[0].Build()
+	assert.NoError(t, err)
+	assert.Equal(t, transform.Chain{
+		&decode.Decompress{},
+		&decode.Unwrap{Records: "records", Value: "data", Fields: []string{"invocationId"}},
+		&decode.Base64{},
+	}, p.Transformer)
+
+	for _, stage := range []Stage{
+		{Type: "decompress", Settings: Settings{"codec": "lz4"}},
+		{Type: "unwrap", Settings: Settings{"value": "data"}},
+		{Type: "base64Decode", Settings: Settings{"url": true}},
+	} {
+		_, err = newTransform(stage)
+		assert.Error(t, err, stage.Type)
+	}
+}
+
+func TestBuild_Codecs(t *testing.T) {
+	c, err := ParseYAML([]byte(`
+pipelines:
+  - name: events
+    source:
+      type: stdio
+      codec: msgpack
+    destination:
+      type: stdio
+      codec: json
+`))
+	assert.NoError(t, err)
+	p, err := c.Pipelines[0].Build()
+	assert.NoError(t, err)
+	assert.Equal(t, stream.Codecs{Source: codec.Msgpack{}, Destination: codec.JSON{}}, p.Codecs)
+
+	c.Pipelines[0].DLQ = &Stage{Type: "stdio", Codec: "avro"}
+	_, err = c.Pipelines[0].Build()
+	assert.EqualError(t, err, `pipeline events: dlq: unknown codec "avro"`)
+
+	c.Pipelines[0].DLQ = nil
+	c.Pipelines[0].Transforms = []Stage{{Type: "json", Codec: "json"}}
+	_, err = c.Pipelines[0].Build()
+	assert.EqualError(t, err, "pipeline events: transform: codecs are set on sources and destinations")
+}
+
+func TestBuild_Workers(t *testing.T) {
+	c, err := ParseYAML([]byte(`
+pipelines:
+  - name: entities
+    source:
+      type: stdio
+    destination:
+      type: stdio
+    partitionKey: entity
+    workers: 8
+    ordering: byKey
+    workerQueueSize: 100
+`))
+	assert.NoError(t, err)
+	p, err := c.Pipelines[0].Build()
+	assert.NoError(t, err)
+	assert.Equal(t, 8, p.Workers)
+	assert.Equal(t, stream.OrderedByKey, p.Ordering)
+	assert.Equal(t, 100, p.WorkerQueueSize)
+
+	c.Pipelines[0].PartitionKey = ""
+	_, err = c.Pipelines[0].Build()
+	assert.EqualError(t, err, "pipeline entities: ordering: partitionKey is required to order messages by key")
+	c.Pipelines[0].Ordering = "byTime"
+	_, err = c.Pipelines[0].Build()
+	assert.EqualError(t, err, `pipeline entities: ordering: unknown ordering "byTime"`)
+}
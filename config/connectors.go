@@ -0,0 +1,273 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/abstractpaper/manifold/stream"
+	"github.com/abstractpaper/manifold/transform"
+	"github.com/abstractpaper/manifold/transform/avro"
+	"github.com/abstractpaper/manifold/transform/decode"
+	"github.com/abstractpaper/manifold/transform/dedup"
+	"github.com/abstractpaper/manifold/transform/filter"
+	transformJSON "github.com/abstractpaper/manifold/transform/json"
+	"github.com/abstractpaper/manifold/transform/protobuf"
+	"github.com/abstractpaper/manifold/transform/schema"
+)
+
+// Built-in connectors and transforms. Cloud connectors are registered
+// by the files of their build tag (see connectors_aws.go).
+func init() {
+	RegisterSource("flight", func(s Settings) (stream.Source, error) {
+		src := &stream.FlightServer{}
+		return src, s.Decode(src)
+	})
+	RegisterSource("http", func(s Settings) (stream.Source, error) {
+		src := &stream.HTTP{}
+		return src, s.Decode(src)
+	})
+	RegisterSource("rabbitmq", func(s Settings) (stream.Source, error) {
+		src := &stream.RabbitMQ{}
+		return src, s.Decode(src)
+	})
+	RegisterSource("redis", func(s Settings) (stream.Source, error) {
+		src := &stream.Redis{}
+		return src, s.Decode(src)
+	})
+	RegisterSource("stdio", func(s Settings) (stream.Source, error) {
+		src := &stream.Stdio{}
+		return src, s.Decode(src)
+	})
+	RegisterSource("websocket", func(s Settings) (stream.Source, error) {
+		src := &stream.WebSocket{Header: http.Header{}}
+		return src, s.Decode(src)
+	})
+
+	RegisterDestination("flight", func(s Settings) (stream.Destination, error) {
+		dest := &stream.Flight{}
+		return dest, s.Decode(dest)
+	})
+	RegisterDestination("neo4j", func(s Settings) (stream.Destination, error) {
+		dest := &stream.Neo4j{}
+		return dest, s.Decode(dest)
+	})
+	RegisterDestination("opensearch", func(s Settings) (stream.Destination, error) {
+		dest := &stream.OpenSearch{}
+		return dest, s.Decode(dest)
+	})
+	RegisterDestination("questdb", func(s Settings) (stream.Destination, error) {
+		dest := &stream.QuestDB{}
+		return dest, s.Decode(dest)
+	})
+	RegisterDestination("rabbitmq", func(s Settings) (stream.Destination, error) {
+		dest := &stream.RabbitMQ{}
+		return dest, s.Decode(dest)
+	})
+	RegisterDestination("redis", func(s Settings) (stream.Destination, error) {
+		dest := &stream.Redis{}
+		return dest, s.Decode(dest)
+	})
+	RegisterDestination("router", func(s Settings) (stream.Destination, error) {
+		err := s.Only("routes", "default")
+		if err != nil {
+			return nil, err
+		}
+
+		// routes and the default are nested destinations
+		var routes []struct {
+			Name        string
+			When        string
+			Destination Stage
+		}
+		_, err = s.Sub("routes", &routes)
+		if err != nil {
+			return nil, err
+		}
+		dest := &stream.Router{}
+		for _, r := range routes {
+			route := stream.Route{Name: r.Name, When: r.When}
+			route.Destination, err = newDestination(r.Destination)
+			if err != nil {
+				return nil, fmt.Errorf("router: route %q: %s", r.Name, err)
+			}
+			dest.Routes = append(dest.Routes, route)
+		}
+
+		var stage Stage
+		ok, err := s.Sub("default", &stage)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			dest.Default, err = newDestination(stage)
+		}
+		return dest, err
+	})
+	RegisterDestination("stdio", func(s Settings) (stream.Destination, error) {
+		dest := &stream.Stdio{}
+		return dest, s.Decode(dest)
+	})
+	RegisterDestination("timescaledb", func(s Settings) (stream.Destination, error) {
+		dest := &stream.TimescaleDB{}
+		return dest, s.Decode(dest)
+	})
+	RegisterDestination("webhook", func(s Settings) (stream.Destination, error) {
+		dest := &stream.Webhook{}
+		return dest, s.Decode(dest)
+	})
+	RegisterDestination("window", func(s Settings) (stream.Destination, error) {
+		dest := &stream.Window{}
+		err := s.Decode(dest, "destination")
+		if err != nil {
+			return nil, err
+		}
+
+		// aggregates are written to a nested destination
+		var stage Stage
+		ok, err := s.Sub("destination", &stage)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("window: destination is required")
+		}
+		dest.Destination, err = newDestination(stage)
+		return dest, err
+	})
+	RegisterDestination("websocket", func(s Settings) (stream.Destination, error) {
+		dest := &stream.WebSocket{Header: http.Header{}}
+		return dest, s.Decode(dest)
+	})
+
+	RegisterTransform("avroDecode", func(s Settings) (transform.Transformer, error) {
+		err := s.Only("registry")
+		if err != nil {
+			return nil, err
+		}
+		registry, err := schemaRegistry(s)
+		return &avro.Decoder{Registry: registry}, err
+	})
+	RegisterTransform("avroEncode", func(s Settings) (transform.Transformer, error) {
+		err := s.Only("registry", "subject")
+		if err != nil {
+			return nil, err
+		}
+		registry, err := schemaRegistry(s)
+		return &avro.Encoder{Registry: registry, Subject: s.String("subject")}, err
+	})
+	RegisterTransform("base64Decode", func(s Settings) (transform.Transformer, error) {
+		return &decode.Base64{}, s.Only()
+	})
+	RegisterTransform("cloudwatchLogs", func(s Settings) (transform.Transformer, error) {
+		t := &decode.CloudWatchLogs{}
+		return t, s.Decode(t)
+	})
+	RegisterTransform("decompress", func(s Settings) (transform.Transformer, error) {
+		t := &decode.Decompress{}
+		err := s.Decode(t)
+		if err != nil {
+			return nil, err
+		}
+		switch t.Codec {
+		case "", decode.Gzip, decode.Zstd:
+			return t, nil
+		}
+		return nil, fmt.Errorf("unknown codec %q", t.Codec)
+	})
+	RegisterTransform("dedup", func(s Settings) (transform.Transformer, error) {
+		t := &dedup.Dedup{}
+		err := s.Decode(t, "redisURL", "redisPrefix")
+		if err != nil {
+			return nil, err
+		}
+		// keys are shared through Redis if `redisURL` is set
+		if url := s.String("redisURL"); url != "" {
+			t.Store = &dedup.Redis{URL: url, Prefix: s.String("redisPrefix")}
+		}
+		return t, nil
+	})
+	RegisterTransform("filter", func(s Settings) (transform.Transformer, error) {
+		t := &filter.Filter{}
+		err := s.Decode(t)
+		if err != nil {
+			return nil, err
+		}
+		// invalid expressions fail when the config is loaded
+		return t, t.Compile()
+	})
+	RegisterTransform("json", func(s Settings) (transform.Transformer, error) {
+		t := &transformJSON.JSON{}
+		return t, s.Decode(t)
+	})
+	RegisterTransform("protobufDecode", func(s Settings) (transform.Transformer, error) {
+		err := s.Only("registry", "messageName")
+		if err != nil {
+			return nil, err
+		}
+		registry, err := schemaRegistry(s)
+		return &protobuf.Decoder{Registry: registry, MessageName: s.String("messageName")}, err
+	})
+	RegisterTransform("protobufEncode", func(s Settings) (transform.Transformer, error) {
+		err := s.Only("registry", "subject", "messageName")
+		if err != nil {
+			return nil, err
+		}
+		registry, err := schemaRegistry(s)
+		return &protobuf.Encoder{
+			Registry:    registry,
+			Subject:     s.String("subject"),
+			MessageName: s.String("messageName"),
+		}, err
+	})
+	RegisterTransform("unwrap", func(s Settings) (transform.Transformer, error) {
+		t := &decode.Unwrap{}
+		err := s.Decode(t)
+		if err == nil && t.Records == "" {
+			err = errors.New("records must be set")
+		}
+		return t, err
+	})
+}
+
+// offloaders create the offload stores of oversized messages by
+// type (see Pipeline.Offload).
+var offloaders = map[string]func(Settings) (stream.Offloader, error){}
+
+// newOffloader creates the offload store of `stage`.
+func newOffloader(stage Stage) (stream.Offloader, error) {
+	create, ok := offloaders[stage.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown offload type %q", stage.Type)
+	}
+	return create(stage.Settings)
+}
+
+// schemaRegistries creates schema registry clients by type.
+var schemaRegistries = map[string]func(Settings) (schema.Registry, error){
+	"confluent": func(s Settings) (schema.Registry, error) {
+		registry := &schema.Confluent{}
+		return registry, s.Decode(registry, "type")
+	},
+}
+
+// schemaRegistry creates the schema registry client of the
+// `registry` setting, whose `type` is `confluent` (default) or
+// `glue`.
+func schemaRegistry(s Settings) (schema.Registry, error) {
+	var r Settings
+	_, err := s.Sub("registry", &r)
+	if err != nil {
+		return nil, err
+	}
+
+	typ := r.String("type")
+	if typ == "" {
+		typ = "confluent"
+	}
+	create, ok := schemaRegistries[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema registry type %q", typ)
+	}
+	return create(r)
+}
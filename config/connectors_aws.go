@@ -0,0 +1,118 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package config
+
+import (
+	"context"
+	"strings"
+
+	"github.com/abstractpaper/manifold/stream"
+	"github.com/abstractpaper/manifold/transform/schema"
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// AWS connectors, built with the `aws` or `all` tag or without a
+// connector set tag.
+func init() {
+	RegisterSource("kinesis", func(s Settings) (stream.Source, error) {
+		src := &stream.Kinesis{}
+		err := s.Decode(src, "region", "profile")
+		if err != nil {
+			return nil, err
+		}
+		src.AWSConfig, err = awsConfig(s, arnRegion(src.StreamARN))
+		return src, err
+	})
+	RegisterDestination("deltalake", func(s Settings) (stream.Destination, error) {
+		dest := &stream.DeltaLake{}
+		err := s.Decode(dest, "region", "profile")
+		if err != nil {
+			return nil, err
+		}
+		dest.AWSConfig, err = awsConfig(s, "")
+		return dest, err
+	})
+	RegisterDestination("kinesis", func(s Settings) (stream.Destination, error) {
+		dest := &stream.Kinesis{}
+		err := s.Decode(dest, "region", "profile")
+		if err != nil {
+			return nil, err
+		}
+		dest.AWSConfig, err = awsConfig(s, arnRegion(dest.StreamARN))
+		return dest, err
+	})
+	RegisterDestination("parquet", func(s Settings) (stream.Destination, error) {
+		dest := &stream.ParquetDataset{}
+		err := s.Decode(dest, "region", "profile")
+		if err != nil {
+			return nil, err
+		}
+		dest.AWSConfig, err = awsConfig(s, "")
+		return dest, err
+	})
+	RegisterDestination("s3", func(s Settings) (stream.Destination, error) {
+		dest := &stream.S3{}
+		err := s.Decode(dest, "profile")
+		if err != nil {
+			return nil, err
+		}
+		dest.AWSConfig, err = awsConfig(s, dest.Region)
+		return dest, err
+	})
+	RegisterDestination("timestream", func(s Settings) (stream.Destination, error) {
+		dest := &stream.Timestream{}
+		err := s.Decode(dest, "region", "profile")
+		if err != nil {
+			return nil, err
+		}
+		dest.AWSConfig, err = awsConfig(s, "")
+		return dest, err
+	})
+
+	offloaders["s3"] = func(s Settings) (stream.Offloader, error) {
+		store := &stream.OffloadStore{}
+		err := s.Decode(store, "profile")
+		if err != nil {
+			return nil, err
+		}
+		store.AWSConfig, err = awsConfig(s, store.Region)
+		return store, err
+	}
+
+	schemaRegistries["glue"] = func(s Settings) (schema.Registry, error) {
+		registry := &schema.Glue{}
+		err := s.Decode(registry, "type", "region", "profile", "roleARN", "externalID")
+		if err != nil {
+			return nil, err
+		}
+		registry.AWSConfig, err = awsConfig(s, "")
+		if err == nil && s.String("roleARN") != "" {
+			cfg := stream.AssumeRoleConfig(*registry.AWSConfig, s.String("roleARN"), s.String("externalID"))
+			registry.AWSConfig = &cfg
+		}
+		return registry, err
+	}
+}
+
+// awsConfig creates a config using the default credential chain
+// (see stream.AWSConfig). The region is taken from the `region`
+// setting, or `region` if it is not set; `profile` selects a shared
+// config profile. Connectors assume their `roleARN` setting
+// themselves.
+func awsConfig(s Settings, region string) (*aws.Config, error) {
+	if r := s.String("region"); r != "" {
+		region = r
+	}
+	cfg, err := stream.AWSConfig(context.Background(), region, s.String("profile"))
+	return &cfg, err
+}
+
+// arnRegion returns the region part of `arn`.
+func arnRegion(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 4 {
+		return ""
+	}
+	return parts[3]
+}
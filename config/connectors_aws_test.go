@@ -0,0 +1,115 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package config
+
+import (
+	"testing"
+
+	"github.com/abstractpaper/manifold/stream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAWS_RoleSettings(t *testing.T) {
+	c, err := ParseYAML([]byte(`
+pipelines:
+  - name: cross-account
+    source:
+      type: kinesis
+      settings:
+        streamARN: arn:aws:kinesis:us-east-1:111111111111:stream/events
+        roleARN: arn:aws:iam::111111111111:role/reader
+    destination:
+      type: s3
+      settings:
+        region: eu-west-1
+        bucketName: archive
+        roleARN: arn:aws:iam::222222222222:role/writer
+        externalID: archive-ext
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.Pipelines[0].Build()
+	assert.NoError(t, err)
+	src := p.Source.(*stream.Kinesis)
+	assert.Equal(t, "arn:aws:iam::111111111111:role/reader", src.RoleARN)
+	assert.Equal(t, "us-east-1", src.AWSConfig.Region)
+	dest := p.Destination.(*stream.S3)
+	assert.Equal(t, "arn:aws:iam::222222222222:role/writer", dest.RoleARN)
+	assert.Equal(t, "archive-ext", dest.ExternalID)
+	assert.Equal(t, "eu-west-1", dest.AWSConfig.Region)
+}
+
+func TestAWS_Resources(t *testing.T) {
+	c, err := ParseYAML([]byte(`
+pipelines:
+  - name: archive
+    source:
+      type: kinesis
+      settings:
+        streamARN: arn:aws:kinesis:us-east-1:111111111111:stream/events
+        leaseTable: archive-leases
+    destination:
+      type: s3
+      settings:
+        region: eu-west-1
+        bucketName: archive
+        config:
+          serverSideEncryption: aws:kms
+          sseKMSKeyID: alias/archive
+    dlq:
+      type: stdio
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources, err := c.Resources()
+	assert.NoError(t, err)
+	assert.Equal(t, []Resource{
+		{Pipeline: "archive", Stage: "source", Type: "kinesis", Resource: stream.Resource{
+			Kind: "aws_kinesis_stream", Name: "events", Region: "us-east-1",
+		}},
+		{Pipeline: "archive", Stage: "source", Type: "kinesis", Resource: stream.Resource{
+			Kind: "aws_dynamodb_table", Name: "archive-leases", Region: "us-east-1",
+			Settings: map[string]string{"hash_key": "shardId", "hash_key_type": "S"},
+		}},
+		{Pipeline: "archive", Stage: "destination", Type: "s3", Resource: stream.Resource{
+			Kind: "aws_s3_bucket", Name: "archive", Region: "eu-west-1",
+			Settings: map[string]string{"sse_algorithm": "aws:kms", "kms_master_key_id": "alias/archive"},
+		}},
+	}, resources)
+}
+
+func TestAWS_Offload(t *testing.T) {
+	c, err := ParseYAML([]byte(`
+pipelines:
+  - name: events
+    source:
+      type: stdio
+    destination:
+      type: kinesis
+      settings:
+        streamARN: arn:aws:kinesis:us-east-1:111111111111:stream/events
+    onOversize: offload
+    offload:
+      type: s3
+      settings:
+        location: s3://payloads/events
+        region: us-east-1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.Pipelines[0].Build()
+	assert.NoError(t, err)
+	assert.Equal(t, stream.OffloadOversize, p.OnOversize)
+	assert.Equal(t, "s3://payloads/events", p.Offloader.(*stream.OffloadStore).Location)
+	assert.Equal(t, 1<<20, stream.DestinationLimits(p.Destination).MaxMessageSize)
+
+	resources, err := c.Resources()
+	assert.NoError(t, err)
+	assert.Equal(t, Resource{Pipeline: "events", Stage: "offload", Type: "s3", Resource: stream.Resource{
+		Kind: "aws_s3_bucket", Name: "payloads", Region: "us-east-1",
+	}}, resources[1])
+}
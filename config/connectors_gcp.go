@@ -0,0 +1,15 @@
+//go:build gcp || all || (!aws && !kafka)
+// +build gcp all !aws,!kafka
+
+package config
+
+import "github.com/abstractpaper/manifold/stream"
+
+// GCP connectors, built with the `gcp` or `all` tag or without a
+// connector set tag.
+func init() {
+	RegisterDestination("bigtable", func(s Settings) (stream.Destination, error) {
+		dest := &stream.BigTable{}
+		return dest, s.Decode(dest)
+	})
+}
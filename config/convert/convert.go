@@ -0,0 +1,190 @@
+// Package convert translates Fluent Bit and Logstash pipeline
+// definitions into manifold configs, to ease migrations.
+//
+// Plugins with a manifold equivalent are converted, the others are
+// reported as warnings (as are settings that can't be carried over),
+// so a converted config is a starting point to review rather than a
+// drop-in replacement. Each pair of an input and an output it
+// receives records from becomes a pipeline.
+package convert
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abstractpaper/manifold/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of source definitions.
+const (
+	FluentBit = "fluentbit"
+	Logstash  = "logstash"
+)
+
+// Result is a converted config and what couldn't be converted.
+type Result struct {
+	Config   *config.Config
+	Warnings []string
+}
+
+// warnf records a warning.
+func (r *Result) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// YAML returns the config as YAML, preceded by the warnings as
+// comments.
+func (r *Result) YAML() ([]byte, error) {
+	var buf bytes.Buffer
+	if len(r.Warnings) > 0 {
+		buf.WriteString("# Not converted, review before use:\n")
+		for _, w := range r.Warnings {
+			buf.WriteString("#   - " + w + "\n")
+		}
+		buf.WriteString("\n")
+	}
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	err := encoder.Encode(r.Config)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), encoder.Close()
+}
+
+// Detect returns the format of `data`, FluentBit or Logstash, or ""
+// if it is neither.
+func Detect(data []byte) string {
+	switch {
+	case fluentBitSection.Match(data):
+		return FluentBit
+	case logstashSection.Match(data):
+		return Logstash
+	}
+	return ""
+}
+
+var (
+	fluentBitSection = regexp.MustCompile(`(?mi)^\s*\[(INPUT|FILTER|OUTPUT|SERVICE)\]`)
+	logstashSection  = regexp.MustCompile(`(?m)^\s*(input|filter|output)\s*\{`)
+)
+
+// Convert converts `data` of `format`, detected if empty.
+func Convert(format string, data []byte) (*Result, error) {
+	if format == "" {
+		format = Detect(data)
+	}
+	switch format {
+	case FluentBit:
+		return ConvertFluentBit(data)
+	case Logstash:
+		return ConvertLogstash(data)
+	case "":
+		return nil, errors.New("convert: neither a Fluent Bit nor a Logstash config")
+	}
+	return nil, fmt.Errorf("convert: unknown format %q", format)
+}
+
+// stage is a converted input, filter or output.
+type stage struct {
+	name  string // plugin name, to name pipelines
+	stage config.Stage
+}
+
+// route is a pipeline to create: an input, its filters and an
+// output.
+type route struct {
+	input   stage
+	filters []config.Stage
+	output  stage
+}
+
+// pipelines returns a pipeline per route, named after its input and
+// output plugins.
+func pipelines(routes []route) (*config.Config, error) {
+	if len(routes) == 0 {
+		return nil, errors.New("convert: no input and output to convert")
+	}
+	c := &config.Config{}
+	names := map[string]int{}
+	for _, r := range routes {
+		name := r.input.name + "-to-" + r.output.name
+		names[name]++
+		if n := names[name]; n > 1 {
+			name = fmt.Sprintf("%s-%d", name, n)
+		}
+		c.Pipelines = append(c.Pipelines, config.Pipeline{
+			Name:        name,
+			Source:      r.input.stage,
+			Transforms:  r.filters,
+			Destination: r.output.stage,
+		})
+	}
+	return c, nil
+}
+
+// hostURL returns a URL of `scheme`, `host` (defaults to localhost),
+// `port` (if set) and `path`, with `user` and `password` if set.
+func hostURL(scheme, user, password, host, port, path string) string {
+	if host == "" {
+		host = "localhost"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	auth := ""
+	if user != "" || password != "" {
+		auth = user
+		if password != "" {
+			auth += ":" + password
+		}
+		auth += "@"
+	}
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return scheme + "://" + auth + host + path
+}
+
+// kinesisARN returns a placeholder ARN of stream `name`, whose
+// account ID must be filled in.
+func kinesisARN(region, name string) string {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return fmt.Sprintf("arn:aws:kinesis:%s:ACCOUNT_ID:stream/%s", region, name)
+}
+
+// kilobytes returns a size such as "50M" or "1G" (or bytes) in KB.
+func kilobytes(size string) int {
+	size = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	unit := 1
+	for suffix, u := range map[string]int{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if strings.HasSuffix(size, suffix) {
+			size, unit = strings.TrimSuffix(size, suffix), u
+		}
+	}
+	n, _ := strconv.ParseFloat(size, 64)
+	kb := int(n * float64(unit) / 1024)
+	if kb < 1 {
+		kb = 1
+	}
+	return kb
+}
+
+// minutes returns a duration such as "10m" or "1h" in whole minutes,
+// at least 1.
+func minutes(duration string) int {
+	d, _ := time.ParseDuration(duration)
+	m := int((d + time.Minute - 1) / time.Minute)
+	if m < 1 {
+		m = 1
+	}
+	return m
+}
@@ -0,0 +1,228 @@
+package convert
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/abstractpaper/manifold/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const fluentBitConf = `
+[SERVICE]
+    Flush 1
+
+[INPUT]
+    Name stdin
+    Tag  app.logs
+
+[INPUT]
+    Name tail
+    Path /var/log/*.log
+
+[INPUT]
+    Name   http
+    Listen 0.0.0.0
+    Port   8888
+    Tag    hooks
+
+[FILTER]
+    Name    grep
+    Match   app.*
+    Regex   level ^(error|warn)$
+    Exclude $kubernetes['labels']['app'] debug\d+
+
+[FILTER]
+    Name   modify
+    Match  *
+    Set    env prod
+
+[OUTPUT]
+    Name  stdout
+    Match app.*
+
+[OUTPUT]
+    Name   http
+    Match  hooks
+    Host   collector.internal
+    Port   443
+    URI    /ingest
+    tls    on
+    Header X-Team logging
+
+[OUTPUT]
+    Name  s3
+    Match *
+    bucket logs
+    region eu-west-1
+    total_file_size 50M
+    upload_timeout 90s
+    s3_key_format /$TAG/%Y/%m/%d/$UUID.gz
+
+[OUTPUT]
+    Name  es
+    Match *
+`
+
+func TestConvertFluentBit(t *testing.T) {
+	assert.Equal(t, FluentBit, Detect([]byte(fluentBitConf)))
+	r, err := Convert("", []byte(fluentBitConf))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	c := r.Config
+	assert.Len(t, c.Pipelines, 4)
+	assert.Equal(t, "stdin-to-stdout", c.Pipelines[0].Name)
+	assert.Equal(t, config.Stage{Type: "stdio"}, c.Pipelines[0].Source)
+	assert.Equal(t, []config.Stage{
+		{Type: "filter", Settings: config.Settings{
+			"expression": `matches(payload.level, "^(error|warn)$") && !matches(payload.kubernetes.labels.app, "debug\\d+")`,
+		}},
+		{Type: "json", Settings: config.Settings{"append": map[string]interface{}{"env": "prod"}}},
+	}, c.Pipelines[0].Transforms)
+	assert.Equal(t, "stdin-to-s3", c.Pipelines[1].Name)
+	assert.Equal(t, config.Settings{
+		"bucketName": "logs",
+		"region":     "eu-west-1",
+		"config":     map[string]interface{}{"commitFileSize": 51200, "commitDuration": 2},
+	}, c.Pipelines[1].Destination.Settings)
+
+	assert.Equal(t, "http-to-http", c.Pipelines[2].Name)
+	assert.Equal(t, config.Settings{"addr": "0.0.0.0:8888"}, c.Pipelines[2].Source.Settings)
+	assert.Len(t, c.Pipelines[2].Transforms, 1)
+	assert.Equal(t, config.Stage{Type: "webhook", Settings: config.Settings{
+		"url":    "https://collector.internal:443/ingest",
+		"header": map[string][]string{"X-Team": {"logging"}},
+	}}, c.Pipelines[2].Destination)
+	assert.Equal(t, "http-to-s3", c.Pipelines[3].Name)
+
+	assert.Equal(t, []string{
+		"line 43: s3 s3_key_format, keys are <folder>/<date>/<time>",
+		"line 52: output es",
+		"line 9: input tail",
+	}, sorted(r.Warnings))
+
+	// the converted config loads and builds
+	data, err := r.YAML()
+	assert.NoError(t, err)
+	parsed, err := config.ParseYAML(data)
+	if assert.NoError(t, err) {
+		_, err = parsed.Pipelines[0].Build()
+		assert.NoError(t, err)
+		_, err = parsed.Pipelines[2].Build()
+		assert.NoError(t, err)
+	}
+}
+
+func TestFluentBitField(t *testing.T) {
+	for key, want := range map[string]string{
+		"level":                  "payload.level",
+		"$log['level']":          "payload.log.level",
+		"user-agent":             "[payload.user-agent]",
+		"$labels['app.io/name']": "[payload.labels.app.io/name]",
+		"$labels['a]b']":         `[payload.labels.a\]b]`,
+	} {
+		assert.Equal(t, want, fluentBitField(key), key)
+	}
+}
+
+const logstashConf = `
+# shipped by the platform team
+input {
+  kinesis {
+    kinesis_stream_name => "events"
+    region => "us-east-2"
+    application_name => "archiver"
+    codec => json { charset => "UTF-8" }
+  }
+  redis { host => "cache" data_type => "list" key => "jobs" password => 's3cret' }
+}
+
+filter {
+  json { source => "message" }
+  mutate {
+    add_field => { "pipeline" => "archiver" "host_copy" => "%{host}" }
+    remove_field => [ "tmp", "debug" ]
+  }
+  if [type] == "noise" { drop { } } else { grok { match => { "message" => "%{COMBINEDAPACHELOG}" } } }
+}
+
+output {
+  s3 {
+    bucket => "archive"
+    region => "us-east-2"
+    prefix => "events/"
+    size_file => 10485760
+    time_file => 5
+  }
+  stdout { codec => rubydebug }
+  elasticsearch { hosts => ["http://es:9200"] }
+}
+`
+
+func TestConvertLogstash(t *testing.T) {
+	assert.Equal(t, Logstash, Detect([]byte(logstashConf)))
+	r, err := Convert("", []byte(logstashConf))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	c := r.Config
+	assert.Len(t, c.Pipelines, 4)
+	names := []string{}
+	for _, p := range c.Pipelines {
+		names = append(names, p.Name)
+	}
+	assert.Equal(t, []string{"kinesis-to-s3", "kinesis-to-stdout", "redis-to-s3", "redis-to-stdout"}, names)
+
+	p := c.Pipelines[0]
+	assert.Equal(t, config.Stage{Type: "kinesis", Settings: config.Settings{
+		"streamARN":    "arn:aws:kinesis:us-east-2:ACCOUNT_ID:stream/events",
+		"consumerName": "archiver",
+	}}, p.Source)
+	assert.Equal(t, []config.Stage{
+		{Type: "json", Settings: config.Settings{"append": map[string]interface{}{"pipeline": "archiver"}}},
+	}, p.Transforms)
+	assert.Equal(t, config.Stage{Type: "s3", Settings: config.Settings{
+		"bucketName": "archive",
+		"region":     "us-east-2",
+		"config":     map[string]interface{}{"folder": "events", "commitFileSize": 10240, "commitDuration": 5},
+	}}, p.Destination)
+	assert.Equal(t, config.Stage{Type: "redis", Settings: config.Settings{
+		"url":  "redis://:s3cret@cache:6379",
+		"args": map[string]interface{}{"mode": "list", "key": "jobs"},
+	}}, c.Pipelines[2].Source)
+	assert.Equal(t, config.Settings{"config": map[string]interface{}{"format": "pretty"}}, c.Pipelines[3].Destination.Settings)
+
+	assert.Equal(t, []string{
+		"line 15: mutate add_field host_copy references fields",
+		"line 15: mutate remove_field",
+		"line 19: conditional in filter",
+		"line 19: conditional in filter",
+		"line 31: output elasticsearch",
+		"line 4: kinesis streamARN needs the stream's account ID",
+	}, sorted(r.Warnings))
+
+	data, err := r.YAML()
+	assert.NoError(t, err)
+	_, err = config.ParseYAML(data)
+	assert.NoError(t, err)
+}
+
+func TestConvert_Errors(t *testing.T) {
+	_, err := Convert("", []byte("pipelines: []"))
+	assert.Error(t, err)
+	_, err = Convert(Logstash, []byte("input { stdin { } "))
+	assert.Error(t, err)
+	_, err = Convert(FluentBit, []byte("Name stdin"))
+	assert.Error(t, err)
+	_, err = Convert(FluentBit, []byte("[INPUT]\n    Name tail\n"))
+	assert.Error(t, err)
+}
+
+func sorted(s []string) []string {
+	s = append([]string{}, s...)
+	sort.Strings(s)
+	return s
+}
@@ -0,0 +1,307 @@
+package convert
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/abstractpaper/manifold/config"
+)
+
+// fluentBitPlugin is a section of a Fluent Bit classic config, its
+// keys are lower case and may repeat (e.g. grep's Regex).
+type fluentBitPlugin struct {
+	kind     string // INPUT, FILTER or OUTPUT
+	line     int
+	settings map[string][]string
+}
+
+func (p *fluentBitPlugin) get(key string) string {
+	if values := p.settings[key]; len(values) > 0 {
+		return values[len(values)-1]
+	}
+	return ""
+}
+
+func (p *fluentBitPlugin) name() string {
+	return strings.ToLower(p.get("name"))
+}
+
+// tag returns the tag of an input, defaulting to its plugin name.
+func (p *fluentBitPlugin) tag() string {
+	if tag := p.get("tag"); tag != "" {
+		return tag
+	}
+	return p.name()
+}
+
+// matches reports whether the Match pattern of a filter or output
+// matches `tag`.
+func (p *fluentBitPlugin) matches(tag string) bool {
+	if pattern := p.get("match_regex"); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		return err == nil && re.MatchString(tag)
+	}
+	pattern := p.get("match")
+	if pattern == "" {
+		return false
+	}
+	re := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$"
+	return regexp.MustCompile(re).MatchString(tag)
+}
+
+// ConvertFluentBit converts a Fluent Bit config in the classic
+// format: records of each input go through the filters matching its
+// tag to each output matching it.
+//
+// Inputs: stdin, http. Filters: grep, modify (Add, Set),
+// record_modifier (Record). Outputs: stdout, s3, kinesis_streams,
+// http.
+func ConvertFluentBit(data []byte) (*Result, error) {
+	plugins, err := parseFluentBit(data)
+	if err != nil {
+		return nil, err
+	}
+	r := &Result{}
+
+	var inputs, filters, outputs []*fluentBitPlugin
+	for _, p := range plugins {
+		switch p.kind {
+		case "INPUT":
+			inputs = append(inputs, p)
+		case "FILTER":
+			filters = append(filters, p)
+		case "OUTPUT":
+			outputs = append(outputs, p)
+		case "SERVICE":
+		default:
+			r.warnf("line %d: [%s] section", p.line, p.kind)
+		}
+	}
+
+	// converted outputs, nil if they can't be
+	converted := map[*fluentBitPlugin]*stage{}
+	for _, out := range outputs {
+		converted[out] = r.fluentBitOutput(out)
+	}
+
+	var routes []route
+	for _, in := range inputs {
+		src := r.fluentBitInput(in)
+		if src == nil {
+			continue
+		}
+		tag := in.tag()
+		var transforms []config.Stage
+		for _, f := range filters {
+			if f.matches(tag) {
+				transforms = append(transforms, r.fluentBitFilter(f)...)
+			}
+		}
+		for _, out := range outputs {
+			if dest := converted[out]; dest != nil && out.matches(tag) {
+				routes = append(routes, route{input: *src, filters: transforms, output: *dest})
+			}
+		}
+	}
+
+	r.Config, err = pipelines(routes)
+	return r, err
+}
+
+// parseFluentBit parses the sections of a classic config.
+func parseFluentBit(data []byte) (plugins []*fluentBitPlugin, err error) {
+	var current *fluentBitPlugin
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			current = &fluentBitPlugin{
+				kind:     strings.ToUpper(strings.Trim(line, "[]")),
+				line:     n,
+				settings: map[string][]string{},
+			}
+			plugins = append(plugins, current)
+		case strings.HasPrefix(line, "@"):
+			return nil, fmt.Errorf("convert: line %d: %s is not supported, inline included files and variables first", n, strings.Fields(line)[0])
+		case current == nil:
+			return nil, fmt.Errorf("convert: line %d: setting outside of a section", n)
+		default:
+			key, value := splitField(line)
+			key = strings.ToLower(key)
+			current.settings[key] = append(current.settings[key], value)
+		}
+	}
+	return plugins, scanner.Err()
+}
+
+func (r *Result) fluentBitInput(p *fluentBitPlugin) *stage {
+	s := &stage{name: p.name()}
+	switch p.name() {
+	case "stdin":
+		s.stage = config.Stage{Type: "stdio"}
+	case "http":
+		port := p.get("port")
+		if port == "" {
+			port = "9880"
+		}
+		s.stage = config.Stage{Type: "http", Settings: config.Settings{"addr": p.get("listen") + ":" + port}}
+	default:
+		r.warnf("line %d: input %s", p.line, p.name())
+		return nil
+	}
+	return s
+}
+
+func (r *Result) fluentBitFilter(p *fluentBitPlugin) []config.Stage {
+	switch p.name() {
+	case "grep":
+		var conditions []string
+		for _, rule := range p.settings["regex"] {
+			conditions = append(conditions, fluentBitRegex(rule))
+		}
+		for _, rule := range p.settings["exclude"] {
+			conditions = append(conditions, "!"+fluentBitRegex(rule))
+		}
+		if len(conditions) == 0 {
+			return nil
+		}
+		return []config.Stage{{Type: "filter", Settings: config.Settings{"expression": strings.Join(conditions, " && ")}}}
+	case "modify", "record_modifier":
+		appended := map[string]interface{}{}
+		for _, key := range []string{"add", "set", "record"} {
+			for _, kv := range p.settings[key] {
+				if key, value := splitField(kv); value != "" {
+					appended[key] = value
+				}
+			}
+		}
+		if len(p.settings["add"]) > 0 {
+			r.warnf("line %d: modify Add overwrites existing fields", p.line)
+		}
+		for key := range p.settings {
+			switch key {
+			case "name", "match", "match_regex", "add", "set", "record":
+			default:
+				r.warnf("line %d: %s %s", p.line, p.name(), key)
+			}
+		}
+		if len(appended) == 0 {
+			return nil
+		}
+		return []config.Stage{{Type: "json", Settings: config.Settings{"append": appended}}}
+	}
+	r.warnf("line %d: filter %s", p.line, p.name())
+	return nil
+}
+
+// fluentBitRegex returns a filter expression of a grep rule, a
+// record key (or accessor, e.g. $kubernetes['labels']['app']) and a
+// regular expression.
+func fluentBitRegex(rule string) string {
+	key, re := splitField(rule)
+	return fmt.Sprintf("matches(%s, %s)", fluentBitField(key), quote(re))
+}
+
+// splitField splits `s` at its first whitespace.
+func splitField(s string) (string, string) {
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+var accessorKey = regexp.MustCompile(`\[['"]([^'"]*)['"]\]`)
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// fluentBitField returns the payload field of a record key, escaped
+// in brackets if it isn't an identifier.
+func fluentBitField(key string) string {
+	key = strings.TrimPrefix(key, "$")
+	field := "payload." + key
+	if i := strings.Index(key, "["); i >= 0 {
+		field = "payload." + key[:i]
+		for _, m := range accessorKey.FindAllStringSubmatch(key[i:], -1) {
+			field += "." + m[1]
+		}
+	}
+	if identifier.MatchString(field) {
+		return field
+	}
+	return "[" + strings.NewReplacer(`\`, `\\`, "]", `\]`).Replace(field) + "]"
+}
+
+// quote returns `s` as a filter expression string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (r *Result) fluentBitOutput(p *fluentBitPlugin) *stage {
+	s := &stage{name: p.name()}
+	switch p.name() {
+	case "stdout":
+		s.stage = config.Stage{Type: "stdio"}
+	case "s3":
+		settings := config.Settings{"bucketName": p.get("bucket"), "region": p.get("region")}
+		if role := p.get("role_arn"); role != "" {
+			settings["roleARN"] = role
+		}
+		cfg := map[string]interface{}{}
+		if size := p.get("total_file_size"); size != "" {
+			cfg["commitFileSize"] = kilobytes(size)
+		}
+		if timeout := p.get("upload_timeout"); timeout != "" {
+			cfg["commitDuration"] = minutes(timeout)
+		}
+		if len(cfg) > 0 {
+			settings["config"] = cfg
+		}
+		if p.get("s3_key_format") != "" {
+			r.warnf("line %d: s3 s3_key_format, keys are <folder>/<date>/<time>", p.line)
+		}
+		s.stage = config.Stage{Type: "s3", Settings: settings}
+	case "kinesis_streams":
+		settings := config.Settings{
+			"region": p.get("region"),
+			"args":   map[string]interface{}{"streamName": p.get("stream")},
+		}
+		if role := p.get("role_arn"); role != "" {
+			settings["roleARN"] = role
+		}
+		s.stage = config.Stage{Type: "kinesis", Settings: settings}
+	case "http":
+		scheme := "http"
+		if strings.EqualFold(p.get("tls"), "on") {
+			scheme = "https"
+		}
+		port := p.get("port")
+		if port == "" {
+			port = "80"
+		}
+		uri := p.get("uri")
+		if uri == "" {
+			uri = "/"
+		}
+		settings := config.Settings{"url": hostURL(scheme, p.get("http_user"), p.get("http_passwd"), p.get("host"), port, uri)}
+		header := map[string][]string{}
+		for _, kv := range p.settings["header"] {
+			if key, value := splitField(kv); value != "" {
+				header[key] = append(header[key], value)
+			}
+		}
+		if len(header) > 0 {
+			settings["header"] = header
+		}
+		s.stage = config.Stage{Type: "webhook", Settings: settings}
+	default:
+		r.warnf("line %d: output %s", p.line, p.name())
+		return nil
+	}
+	return s
+}
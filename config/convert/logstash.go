@@ -0,0 +1,444 @@
+package convert
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/abstractpaper/manifold/config"
+)
+
+// logstashPlugin is a plugin block of a Logstash config.
+type logstashPlugin struct {
+	section  string // input, filter or output
+	name     string
+	line     int
+	settings map[string]interface{} // strings, []interface{} or map[string]interface{}
+}
+
+func (p *logstashPlugin) get(key string) string {
+	switch v := p.settings[key].(type) {
+	case string:
+		return v
+	case []interface{}:
+		if len(v) > 0 {
+			s, _ := v[0].(string)
+			return s
+		}
+	}
+	return ""
+}
+
+// ConvertLogstash converts a Logstash config: events of every input
+// go through the filters to every output. Conditionals aren't
+// converted.
+//
+// Inputs: stdin, http, kinesis, rabbitmq, redis. Filters: mutate
+// (add_field), json (bodies are JSON already). Outputs: stdout, s3,
+// kinesis, http, rabbitmq, redis.
+func ConvertLogstash(data []byte) (*Result, error) {
+	r := &Result{}
+	p := &logstashParser{tokens: tokenize(string(data)), r: r}
+	plugins, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	var inputs []stage
+	var filters []config.Stage
+	var outputs []stage
+	for _, plugin := range plugins {
+		switch plugin.section {
+		case "input":
+			if s := r.logstashInput(plugin); s != nil {
+				inputs = append(inputs, *s)
+			}
+		case "filter":
+			filters = append(filters, r.logstashFilter(plugin)...)
+		case "output":
+			if s := r.logstashOutput(plugin); s != nil {
+				outputs = append(outputs, *s)
+			}
+		}
+	}
+
+	var routes []route
+	for _, in := range inputs {
+		for _, out := range outputs {
+			routes = append(routes, route{input: in, filters: filters, output: out})
+		}
+	}
+	r.Config, err = pipelines(routes)
+	return r, err
+}
+
+// token is a token of a Logstash config.
+type token struct {
+	text   string
+	quoted bool // a string literal
+	line   int
+}
+
+// tokenize splits a Logstash config into barewords, strings and
+// symbols, dropping comments.
+func tokenize(text string) (tokens []token) {
+	line := 1
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case unicode.IsSpace(rune(c)) || c == ',':
+			i++
+		case c == '#':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			start := line
+			for i++; i < len(text) && text[i] != c; i++ {
+				if text[i] == '\\' && i+1 < len(text) && (text[i+1] == c || text[i+1] == '\\') {
+					i++
+				}
+				if text[i] == '\n' {
+					line++
+				}
+				b.WriteByte(text[i])
+			}
+			i++
+			tokens = append(tokens, token{text: b.String(), quoted: true, line: start})
+		case strings.HasPrefix(text[i:], "=>"):
+			tokens = append(tokens, token{text: "=>", line: line})
+			i += 2
+		case strings.IndexByte("{}[]()", c) >= 0:
+			tokens = append(tokens, token{text: string(c), line: line})
+			i++
+		default:
+			start := i
+			for i < len(text) && !unicode.IsSpace(rune(text[i])) && strings.IndexByte("{}[](),#\"'", text[i]) < 0 && !strings.HasPrefix(text[i:], "=>") {
+				i++
+			}
+			tokens = append(tokens, token{text: text[start:i], line: line})
+		}
+	}
+	return
+}
+
+// logstashParser parses the sections of a Logstash config.
+type logstashParser struct {
+	tokens []token
+	pos    int
+	r      *Result
+}
+
+func (p *logstashParser) peek() token {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return token{}
+}
+
+func (p *logstashParser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *logstashParser) expect(text string) error {
+	t := p.next()
+	if t.text != text || t.quoted {
+		return fmt.Errorf("convert: line %d: expected %q, found %q", t.line, text, t.text)
+	}
+	return nil
+}
+
+func (p *logstashParser) parse() (plugins []*logstashPlugin, err error) {
+	for p.pos < len(p.tokens) {
+		section := p.next()
+		switch section.text {
+		case "input", "filter", "output":
+		default:
+			return nil, fmt.Errorf("convert: line %d: unknown section %q", section.line, section.text)
+		}
+		err = p.expect("{")
+		if err != nil {
+			return
+		}
+		for p.peek().text != "}" {
+			if p.pos >= len(p.tokens) {
+				return nil, fmt.Errorf("convert: unterminated %s section", section.text)
+			}
+			name := p.next()
+			switch name.text {
+			case "if", "else":
+				p.r.warnf("line %d: conditional in %s", name.line, section.text)
+				err = p.skipConditional()
+				if err != nil {
+					return
+				}
+				continue
+			}
+			plugin := &logstashPlugin{section: section.text, name: name.text, line: name.line}
+			plugin.settings, err = p.hash()
+			if err != nil {
+				return
+			}
+			plugins = append(plugins, plugin)
+		}
+		p.next()
+	}
+	return
+}
+
+// skipConditional skips the condition and block of an if, else if or
+// else.
+func (p *logstashParser) skipConditional() error {
+	for p.pos < len(p.tokens) && p.peek().text != "{" {
+		p.next()
+	}
+	depth := 0
+	for p.pos < len(p.tokens) {
+		t := p.next()
+		if t.quoted {
+			continue
+		}
+		switch t.text {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("convert: unterminated conditional")
+}
+
+// hash parses `{ key => value ... }`.
+func (p *logstashParser) hash() (map[string]interface{}, error) {
+	err := p.expect("{")
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]interface{}{}
+	for p.peek().text != "}" || p.peek().quoted {
+		if p.pos >= len(p.tokens) {
+			return nil, fmt.Errorf("convert: unterminated block")
+		}
+		key := p.next()
+		err = p.expect("=>")
+		if err != nil {
+			return nil, err
+		}
+		settings[key.text], err = p.value()
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.next()
+	return settings, nil
+}
+
+// value parses a string, number, bareword, array or hash.
+func (p *logstashParser) value() (interface{}, error) {
+	t := p.peek()
+	if !t.quoted {
+		switch t.text {
+		case "{":
+			return p.hash()
+		case "[":
+			p.next()
+			var values []interface{}
+			for p.peek().text != "]" || p.peek().quoted {
+				if p.pos >= len(p.tokens) {
+					return nil, fmt.Errorf("convert: line %d: unterminated array", t.line)
+				}
+				v, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, v)
+			}
+			p.next()
+			return values, nil
+		}
+	}
+	p.next()
+	if next := p.peek(); !t.quoted && next.text == "{" && !next.quoted {
+		// a codec with options, e.g. json { charset => "UTF-8" }
+		_, err := p.hash()
+		return t.text, err
+	}
+	return t.text, nil
+}
+
+func (r *Result) logstashInput(p *logstashPlugin) *stage {
+	s := &stage{name: p.name}
+	switch p.name {
+	case "stdin":
+		s.stage = config.Stage{Type: "stdio"}
+	case "http":
+		port := p.get("port")
+		if port == "" {
+			port = "8080"
+		}
+		s.stage = config.Stage{Type: "http", Settings: config.Settings{"addr": p.get("host") + ":" + port}}
+	case "kinesis":
+		region := p.get("region")
+		settings := config.Settings{"streamARN": kinesisARN(region, p.get("kinesis_stream_name"))}
+		r.warnf("line %d: kinesis streamARN needs the stream's account ID", p.line)
+		if name := p.get("application_name"); name != "" {
+			settings["consumerName"] = name
+		}
+		if role := p.get("role_arn"); role != "" {
+			settings["roleARN"] = role
+		}
+		s.stage = config.Stage{Type: "kinesis", Settings: settings}
+	case "rabbitmq":
+		args := map[string]interface{}{"queue": p.get("queue")}
+		if ack := p.get("ack"); ack != "" {
+			args["autoAck"] = strconv.FormatBool(ack == "false")
+		}
+		s.stage = config.Stage{Type: "rabbitmq", Settings: config.Settings{"url": amqpURL(p), "args": args}}
+	case "redis":
+		s.stage = config.Stage{Type: "redis", Settings: config.Settings{"url": redisURL(p), "args": redisArgs(p)}}
+	default:
+		r.warnf("line %d: input %s", p.line, p.name)
+		return nil
+	}
+	return s
+}
+
+func (r *Result) logstashFilter(p *logstashPlugin) []config.Stage {
+	switch p.name {
+	case "json":
+		// manifold messages are JSON bodies, fields are parsed by
+		// transforms and destinations that need them
+		if source := p.get("source"); source != "" && source != "message" {
+			r.warnf("line %d: json source %s", p.line, source)
+		}
+		return nil
+	case "mutate":
+		appended := map[string]interface{}{}
+		if fields, ok := p.settings["add_field"].(map[string]interface{}); ok {
+			for field, v := range fields {
+				value, _ := v.(string)
+				if strings.Contains(value, "%{") {
+					r.warnf("line %d: mutate add_field %s references fields", p.line, field)
+					continue
+				}
+				appended[field] = value
+			}
+		}
+		var others []string
+		for key := range p.settings {
+			if key != "add_field" {
+				others = append(others, key)
+			}
+		}
+		sort.Strings(others)
+		for _, key := range others {
+			r.warnf("line %d: mutate %s", p.line, key)
+		}
+		if len(appended) == 0 {
+			return nil
+		}
+		return []config.Stage{{Type: "json", Settings: config.Settings{"append": appended}}}
+	}
+	r.warnf("line %d: filter %s", p.line, p.name)
+	return nil
+}
+
+func (r *Result) logstashOutput(p *logstashPlugin) *stage {
+	s := &stage{name: p.name}
+	switch p.name {
+	case "stdout":
+		settings := config.Settings{}
+		if codec := p.get("codec"); codec == "rubydebug" || codec == "" {
+			settings["config"] = map[string]interface{}{"format": "pretty"}
+		}
+		s.stage = config.Stage{Type: "stdio", Settings: settings}
+	case "s3":
+		settings := config.Settings{"bucketName": p.get("bucket"), "region": p.get("region")}
+		if role := p.get("role_arn"); role != "" {
+			settings["roleARN"] = role
+		}
+		cfg := map[string]interface{}{}
+		if prefix := strings.Trim(p.get("prefix"), "/"); prefix != "" {
+			if strings.Contains(prefix, "%{") {
+				r.warnf("line %d: s3 prefix %s references fields", p.line, prefix)
+			} else {
+				cfg["folder"] = prefix
+			}
+		}
+		if size := p.get("size_file"); size != "" {
+			cfg["commitFileSize"] = kilobytes(size)
+		}
+		if m, err := strconv.Atoi(p.get("time_file")); err == nil && m > 0 {
+			cfg["commitDuration"] = m
+		}
+		if len(cfg) > 0 {
+			settings["config"] = cfg
+		}
+		s.stage = config.Stage{Type: "s3", Settings: settings}
+	case "kinesis":
+		settings := config.Settings{
+			"region": p.get("region"),
+			"args":   map[string]interface{}{"streamName": p.get("stream_name")},
+		}
+		if role := p.get("role_arn"); role != "" {
+			settings["roleARN"] = role
+		}
+		s.stage = config.Stage{Type: "kinesis", Settings: settings}
+	case "http":
+		if method := strings.ToLower(p.get("http_method")); method != "" && method != "post" {
+			r.warnf("line %d: http http_method %s, webhooks POST", p.line, method)
+		}
+		s.stage = config.Stage{Type: "webhook", Settings: config.Settings{"url": p.get("url")}}
+	case "rabbitmq":
+		args := map[string]interface{}{"exchange": p.get("exchange"), "key": p.get("key")}
+		s.stage = config.Stage{Type: "rabbitmq", Settings: config.Settings{"url": amqpURL(p), "args": args}}
+	case "redis":
+		s.stage = config.Stage{Type: "redis", Settings: config.Settings{"url": redisURL(p), "args": redisArgs(p)}}
+	default:
+		r.warnf("line %d: output %s", p.line, p.name)
+		return nil
+	}
+	return s
+}
+
+// amqpURL returns the URL of a rabbitmq plugin.
+func amqpURL(p *logstashPlugin) string {
+	port := p.get("port")
+	if port == "" {
+		port = "5672"
+	}
+	user, password := p.get("user"), p.get("password")
+	if user == "" {
+		user, password = "guest", "guest"
+	}
+	return hostURL("amqp", user, password, p.get("host"), port, p.get("vhost"))
+}
+
+// redisURL returns the URL of a redis plugin.
+func redisURL(p *logstashPlugin) string {
+	port := p.get("port")
+	if port == "" {
+		port = "6379"
+	}
+	return hostURL("redis", "", p.get("password"), p.get("host"), port, p.get("db"))
+}
+
+// redisArgs returns the Args of a redis plugin: lists are consumed
+// from (or pushed to) `key`, channels subscribed (or published) to.
+func redisArgs(p *logstashPlugin) map[string]interface{} {
+	if strings.HasSuffix(p.get("data_type"), "channel") {
+		return map[string]interface{}{"mode": "pubsub", "channel": p.get("key")}
+	}
+	return map[string]interface{}{"mode": "list", "key": p.get("key")}
+}
@@ -0,0 +1,22 @@
+//go:build all || (!aws && !gcp && !kafka)
+// +build all !aws,!gcp,!kafka
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The example uses connectors of every set.
+func TestLoad_Example(t *testing.T) {
+	c, err := Load("../examples/config/pipeline.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range c.Pipelines {
+		_, err := p.Build()
+		assert.NoError(t, err, p.Name)
+	}
+}
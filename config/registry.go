@@ -0,0 +1,158 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/abstractpaper/manifold/codec"
+	"github.com/abstractpaper/manifold/stream"
+	"github.com/abstractpaper/manifold/transform"
+)
+
+// Settings are the settings of a stage as found in the config.
+type Settings map[string]interface{}
+
+// Decode decodes the settings into `v`, typically a pointer to a
+// connector struct. Keys are matched to exported field names
+// case-insensitively. Keys that match no field are an error, except
+// for the `handled` keys which the caller reads itself.
+func (s Settings) Decode(v interface{}, handled ...string) error {
+	data, err := json.Marshal(s.without(handled...))
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// Only returns an error if the settings have keys other than `keys`.
+func (s Settings) Only(keys ...string) error {
+	for key := range s.without(keys...) {
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	return nil
+}
+
+// Sub decodes the nested setting `key` into `v`. It returns false if
+// the setting is not set.
+func (s Settings) Sub(key string, v interface{}) (bool, error) {
+	value, ok := s[key]
+	if !ok || value == nil {
+		return false, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return true, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return true, decoder.Decode(v)
+}
+
+// without returns the settings less `keys`, matched
+// case-insensitively.
+func (s Settings) without(keys ...string) Settings {
+	rest := Settings{}
+	for key, value := range s {
+		rest[key] = value
+		for _, k := range keys {
+			if strings.EqualFold(key, k) {
+				delete(rest, key)
+			}
+		}
+	}
+	return rest
+}
+
+// String returns the string setting `key`, or an empty string.
+func (s Settings) String(key string) string {
+	v, _ := s[key].(string)
+	return v
+}
+
+// SourceFactory creates a source from its settings.
+type SourceFactory func(Settings) (stream.Source, error)
+
+// DestinationFactory creates a destination from its settings.
+type DestinationFactory func(Settings) (stream.Destination, error)
+
+// TransformFactory creates a transformer from its settings.
+type TransformFactory func(Settings) (transform.Transformer, error)
+
+var registry = struct {
+	sync.RWMutex
+	sources      map[string]SourceFactory
+	destinations map[string]DestinationFactory
+	transforms   map[string]TransformFactory
+}{
+	sources:      map[string]SourceFactory{},
+	destinations: map[string]DestinationFactory{},
+	transforms:   map[string]TransformFactory{},
+}
+
+// RegisterSource makes a source type available to configs. Third
+// party connectors can register themselves in an init function.
+func RegisterSource(name string, factory SourceFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.sources[name] = factory
+}
+
+// RegisterDestination makes a destination type available to
+// configs.
+func RegisterDestination(name string, factory DestinationFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.destinations[name] = factory
+}
+
+// RegisterTransform makes a transform type available to configs.
+func RegisterTransform(name string, factory TransformFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.transforms[name] = factory
+}
+
+func newSource(stage Stage) (stream.Source, error) {
+	registry.RLock()
+	factory, ok := registry.sources[stage.Type]
+	registry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown source type %q", stage.Type)
+	}
+	return factory(stage.Settings)
+}
+
+func newDestination(stage Stage) (stream.Destination, error) {
+	registry.RLock()
+	factory, ok := registry.destinations[stage.Type]
+	registry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown destination type %q", stage.Type)
+	}
+	return factory(stage.Settings)
+}
+
+func newTransform(stage Stage) (transform.Transformer, error) {
+	registry.RLock()
+	factory, ok := registry.transforms[stage.Type]
+	registry.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transform type %q", stage.Type)
+	}
+	return factory(stage.Settings)
+}
+
+// newCodec returns the codec of `stage`, or nil if it has none.
+func newCodec(stage Stage) (codec.Codec, error) {
+	if stage.Codec == "" {
+		return nil, nil
+	}
+	return codec.Get(stage.Codec)
+}
@@ -0,0 +1,395 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/abstractpaper/manifold/stream"
+	log "github.com/sirupsen/logrus"
+)
+
+// Runner runs every pipeline of a config.
+//
+// If Path is set, the config is reloaded from it when the file
+// changes (checked every WatchInterval, defaults to 5 seconds) or on
+// SIGHUP. Reloads apply changes pipeline by pipeline: pipelines whose
+// definition changed (e.g. a destination or a batch size) or that
+// were removed are stopped, draining the messages they have read,
+// and changed or added pipelines are started. The other pipelines
+// keep running.
+//
+// Pipelines with a Canary run as two versions sharing their source:
+// the stable one, and the canary one named <name>:canary reading a
+// percentage of the messages (see stream.Split). Canaries compares
+// them; stopping the canary with StopPipeline rolls it back, sending
+// every message through the stable version.
+type Runner struct {
+	Config        *Config
+	Path          string
+	WatchInterval time.Duration
+	mu            sync.Mutex
+	running       map[string]*running
+	wg            sync.WaitGroup
+	stopped       bool
+	stop          chan struct{}
+	finished      chan struct{}
+}
+
+// running is a pipeline started by a Runner.
+type running struct {
+	def      Pipeline
+	pipeline *stream.Pipeline
+	canary   *version // nil without Canary
+	done     chan struct{}
+}
+
+// version is the canary version of a running pipeline.
+type version struct {
+	pipeline *stream.Pipeline
+	split    *stream.Split
+	stopped  bool // by StopPipeline
+	done     chan struct{}
+}
+
+// Run builds all pipelines and runs them concurrently until an
+// interrupt signal (SIGINT or SIGTERM, on which pipelines drain, see
+// stream.Pipeline.Drain) is received, Stop is called or every pipeline
+// has finished on its own (e.g. at the end of stdin). Nothing is
+// started if a pipeline fails to build.
+func (r *Runner) Run() error {
+	stop := r.stopping()
+	finished := r.finishing()
+	err := r.Apply(r.Config)
+	if err != nil {
+		return err
+	}
+
+	// pipelines drain on interrupt signals themselves
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	var hup chan os.Signal
+	var watch <-chan time.Time
+	if r.Path != "" {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+
+		interval := r.WatchInterval
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watch = ticker.C
+	}
+	modified := r.modified()
+
+loop:
+	for {
+		select {
+		case <-interrupt:
+			break loop
+		case <-stop:
+			break loop
+		case <-finished:
+			if r.finishedAll() {
+				log.Info("All pipelines finished.")
+				break loop
+			}
+		case <-hup:
+			log.Info("SIGHUP received, reloading ", r.Path)
+			r.Reload()
+		case <-watch:
+			if m := r.modified(); !m.Equal(modified) {
+				modified = m
+				log.Info("Config changed, reloading ", r.Path)
+				r.Reload()
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.stopped = true
+	r.mu.Unlock()
+	r.wg.Wait()
+
+	return nil
+}
+
+// Stop stops the pipelines, draining the messages they have read,
+// and makes Run return.
+func (r *Runner) Stop() {
+	r.stopping()
+	r.mu.Lock()
+	r.stopped = true
+	for _, run := range r.running {
+		run.stop()
+	}
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+// stopping returns a channel closed by Stop.
+func (r *Runner) stopping() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop == nil {
+		r.stop = make(chan struct{})
+	}
+	return r.stop
+}
+
+// finishing returns a channel signalled when a pipeline finishes.
+func (r *Runner) finishing() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.finished == nil {
+		r.finished = make(chan struct{}, 1)
+	}
+	return r.finished
+}
+
+// finishedAll reports whether every running pipeline has finished on
+// its own. Pipelines stopped with StopPipeline don't count.
+func (r *Runner) finishedAll() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.running) == 0 {
+		return false
+	}
+	for _, run := range r.running {
+		select {
+		case <-run.done:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Reload loads the config from Path and applies it. The running
+// pipelines are kept if it fails to load or build.
+func (r *Runner) Reload() error {
+	c, err := Load(r.Path)
+	if err == nil {
+		err = r.Apply(c)
+	}
+	if err != nil {
+		log.Error("Failed to reload the config: ", err)
+	}
+	return err
+}
+
+// Apply runs the pipelines of `c`: new pipelines are started,
+// changed ones restarted and removed ones stopped. Nothing changes if
+// a pipeline fails to build.
+func (r *Runner) Apply(c *Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return errors.New("config: runner stopped")
+	}
+	if r.running == nil {
+		r.running = map[string]*running{}
+	}
+
+	// build before stopping anything
+	defs := map[string]Pipeline{}
+	built := map[string]*running{}
+	for _, def := range c.Pipelines {
+		defs[def.Name] = def
+		if run, ok := r.running[def.Name]; ok && reflect.DeepEqual(run.def, def) {
+			continue
+		}
+		run, err := build(def)
+		if err != nil {
+			return err
+		}
+		built[def.Name] = run
+	}
+
+	// stop removed and changed pipelines, sources must release their
+	// partitions (e.g. Kinesis leases) before new pipelines start
+	var stopping []*running
+	for name, run := range r.running {
+		if _, ok := defs[name]; ok && built[name] == nil {
+			continue
+		}
+		log.Infof("Stopping pipeline %s.", name)
+		run.stop()
+		stopping = append(stopping, run)
+		delete(r.running, name)
+	}
+	for _, run := range stopping {
+		<-run.done
+	}
+
+	for _, def := range c.Pipelines {
+		if run := built[def.Name]; run != nil {
+			r.start(run)
+		}
+	}
+	r.Config = c
+	if len(stopping) > 0 || len(built) > 0 {
+		log.Infof("Config applied: %d pipeline(s) stopped, %d started.", len(stopping), len(built))
+	}
+	return nil
+}
+
+// Pipelines returns the running pipelines by name.
+func (r *Runner) Pipelines() map[string]*stream.Pipeline {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pipelines := make(map[string]*stream.Pipeline, len(r.running))
+	for name, run := range r.running {
+		pipelines[name] = run.pipeline
+		if run.canary != nil && !run.canary.stopped {
+			pipelines[run.canary.pipeline.Name] = run.canary.pipeline
+		}
+	}
+	return pipelines
+}
+
+// Canaries compares the stable and canary versions of the running
+// pipelines with a canary, by name.
+func (r *Runner) Canaries() map[string]stream.CanaryStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	canaries := map[string]stream.CanaryStats{}
+	for name, run := range r.running {
+		if run.canary != nil {
+			canaries[name] = run.canary.split.Compare(run.pipeline, run.canary.pipeline)
+		}
+	}
+	return canaries
+}
+
+// StopPipeline stops pipeline `name`, draining the messages it has
+// read. It runs again after the next reload. Stopping the canary
+// version of a pipeline (<name>:canary) rolls it back: the stable
+// version reads every message until the next reload changing it.
+func (r *Runner) StopPipeline(name string) error {
+	r.mu.Lock()
+	if stable := strings.TrimSuffix(name, ":canary"); stable != name {
+		run, ok := r.running[stable]
+		if !ok || run.canary == nil || run.canary.stopped {
+			r.mu.Unlock()
+			return fmt.Errorf("config: no pipeline named %q", name)
+		}
+		run.canary.stopped = true
+		r.mu.Unlock()
+
+		log.Infof("Stopping canary %s, rolling back to the stable version.", name)
+		run.canary.pipeline.Stop()
+		<-run.canary.done
+		return nil
+	}
+	run, ok := r.running[name]
+	if ok {
+		delete(r.running, name)
+	}
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("config: no pipeline named %q", name)
+	}
+
+	log.Infof("Stopping pipeline %s.", name)
+	run.stop()
+	<-run.done
+	return nil
+}
+
+// build builds the pipeline `def`, and its canary version.
+func build(def Pipeline) (*running, error) {
+	pipeline, err := def.Build()
+	if err != nil {
+		return nil, err
+	}
+	run := &running{def: def, pipeline: pipeline, done: make(chan struct{})}
+	if def.Canary == nil {
+		return run, nil
+	}
+
+	canary, err := def.canaryVersion().build(false)
+	if err != nil {
+		return nil, err
+	}
+	split := &stream.Split{Source: pipeline.Source, Percent: def.Canary.Percent, Key: def.Canary.Key}
+	pipeline.Source = split.Stable()
+	canary.Source = split.Canary()
+	run.canary = &version{pipeline: canary, split: split, done: make(chan struct{})}
+	return run, nil
+}
+
+// stop stops both versions of the pipeline.
+func (run *running) stop() {
+	run.pipeline.Stop()
+	if run.canary != nil {
+		run.canary.pipeline.Stop()
+	}
+}
+
+// runPipeline runs `p` and logs how it stopped.
+func runPipeline(p *stream.Pipeline) {
+	err := p.Run()
+	if err != nil {
+		log.Errorf("Pipeline %s failed: %s", p.Name, err)
+		return
+	}
+	log.Infof("Pipeline %s stopped.", p.Name)
+}
+
+// start runs the pipeline (and its canary version) of `run` in a
+// goroutine.
+func (r *Runner) start(run *running) {
+	r.running[run.def.Name] = run
+	if r.finished == nil {
+		r.finished = make(chan struct{}, 1)
+	}
+	finished := r.finished
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		if run.canary != nil {
+			go func() {
+				runPipeline(run.canary.pipeline)
+				close(run.canary.done)
+			}()
+		}
+		runPipeline(run.pipeline)
+		if run.canary != nil {
+			<-run.canary.done
+		}
+		close(run.done)
+		select {
+		case finished <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+// modified returns the modification time of Path, if set.
+func (r *Runner) modified() time.Time {
+	if r.Path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(r.Path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
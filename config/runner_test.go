@@ -0,0 +1,228 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/stream"
+	"github.com/abstractpaper/manifold/stream/streamtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// sources counts the sources built per "id" setting.
+var sources = struct {
+	sync.Mutex
+	built map[string]int
+}{built: map[string]int{}}
+
+func resetBuilds() {
+	sources.Lock()
+	defer sources.Unlock()
+	sources.built = map[string]int{}
+}
+
+func builds(id string) int {
+	sources.Lock()
+	defer sources.Unlock()
+	return sources.built[id]
+}
+
+// openSource is a source that delivers nothing until it is
+// disconnected.
+type openSource struct{}
+
+func (openSource) Connect() error    { return nil }
+func (openSource) Disconnect() error { return nil }
+func (openSource) Info()             {}
+
+func (openSource) Read() (chan string, error) {
+	return make(chan string), nil
+}
+
+func init() {
+	RegisterSource("runnertest", func(s Settings) (stream.Source, error) {
+		sources.Lock()
+		defer sources.Unlock()
+		sources.built[s.String("id")]++
+		return openSource{}, nil
+	})
+	// finishes once its message is read
+	RegisterSource("runnertestFinite", func(s Settings) (stream.Source, error) {
+		return streamtest.NewSliceSource("a"), nil
+	})
+}
+
+func runnerConfig(t *testing.T, yaml string) *Config {
+	c, err := ParseYAML([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRunner_Apply(t *testing.T) {
+	resetBuilds()
+	r := &Runner{}
+	err := r.Apply(runnerConfig(t, `
+pipelines:
+  - name: a
+    source: {type: runnertest, settings: {id: a1}}
+    destination: {type: stdio}
+  - name: b
+    source: {type: runnertest, settings: {id: b1}}
+    destination: {type: stdio}
+`))
+	assert.NoError(t, err)
+	defer r.Stop()
+
+	// a is kept, b changes, c is added
+	err = r.Apply(runnerConfig(t, `
+pipelines:
+  - name: a
+    source: {type: runnertest, settings: {id: a1}}
+    destination: {type: stdio}
+  - name: b
+    source: {type: runnertest, settings: {id: b2}}
+    destination: {type: stdio}
+  - name: c
+    source: {type: runnertest, settings: {id: c1}}
+    destination: {type: stdio}
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, builds("a1"))
+	assert.Equal(t, 1, builds("b1"))
+	assert.Equal(t, 1, builds("b2"))
+	assert.Equal(t, 1, builds("c1"))
+	assert.Len(t, r.running, 3)
+
+	// nothing changes if a pipeline fails to build
+	err = r.Apply(runnerConfig(t, `
+pipelines:
+  - name: a
+    source: {type: runnertest, settings: {id: a1}}
+    destination: {type: nope}
+`))
+	assert.Error(t, err)
+	assert.Len(t, r.running, 3)
+
+	// b and c are removed
+	err = r.Apply(runnerConfig(t, `
+pipelines:
+  - name: a
+    source: {type: runnertest, settings: {id: a1}}
+    destination: {type: stdio}
+`))
+	assert.NoError(t, err)
+	assert.Len(t, r.running, 1)
+	// built again by the failed Apply only
+	assert.Equal(t, 2, builds("a1"))
+}
+
+func TestRunner_WatchPath(t *testing.T) {
+	resetBuilds()
+	dir, _ := ioutil.TempDir("", "runner")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pipeline.yaml")
+	write := func(id string, modified time.Time) {
+		yaml := "pipelines:\n  - name: w\n    source: {type: runnertest, settings: {id: " + id + "}}\n    destination: {type: stdio}\n"
+		ioutil.WriteFile(path, []byte(yaml), 0644)
+		os.Chtimes(path, modified, modified)
+	}
+	write("w1", time.Now())
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Runner{Config: c, Path: path, WatchInterval: 10 * time.Millisecond}
+	done := make(chan error)
+	go func() { done <- r.Run() }()
+
+	assert.Eventually(t, func() bool { return builds("w1") == 1 }, time.Second, 10*time.Millisecond)
+	write("w2", time.Now().Add(time.Minute))
+	assert.Eventually(t, func() bool { return builds("w2") == 1 }, time.Second, 10*time.Millisecond)
+
+	r.Stop()
+	assert.NoError(t, <-done)
+	assert.Error(t, r.Apply(c))
+}
+
+func TestRunner_Finished(t *testing.T) {
+	r := &Runner{Config: runnerConfig(t, `
+pipelines:
+  - name: a
+    source: {type: runnertestFinite}
+    destination: {type: stdio}
+  - name: b
+    source: {type: runnertestFinite}
+    destination: {type: stdio}
+`)}
+	done := make(chan error)
+	go func() { done <- r.Run() }()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		r.Stop()
+		t.Fatal("Run didn't return once every pipeline finished")
+	}
+}
+
+func TestRunner_Canary(t *testing.T) {
+	resetBuilds()
+	r := &Runner{Config: runnerConfig(t, `
+pipelines:
+  - name: a
+    source: {type: runnertest, settings: {id: canary}}
+    destination: {type: stdio}
+    canary:
+      percent: 10
+      transforms:
+        - type: json
+          settings: {append: {version: 2}}
+`)}
+	done := make(chan error)
+	go func() { done <- r.Run() }()
+	defer func() {
+		r.Stop()
+		assert.NoError(t, <-done)
+	}()
+
+	assert.Eventually(t, func() bool { return len(r.Pipelines()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	pipelines := r.Pipelines()
+	assert.Nil(t, pipelines["a"].Transformer)
+	assert.NotNil(t, pipelines["a:canary"].Transformer)
+	assert.Equal(t, 10, r.Canaries()["a"].Percent)
+	// the canary shares the source of the stable version
+	assert.Equal(t, 1, builds("canary"))
+
+	// stopping the canary rolls back to the stable version
+	assert.NoError(t, r.StopPipeline("a:canary"))
+	assert.Len(t, r.Pipelines(), 1)
+	assert.Error(t, r.StopPipeline("a:canary"))
+	assert.Error(t, r.StopPipeline("b:canary"))
+}
+
+func TestBuild_Canary(t *testing.T) {
+	p := Pipeline{
+		Name:        "a",
+		Source:      Stage{Type: "stdio"},
+		Destination: Stage{Type: "stdio"},
+		Canary:      &Canary{Percent: 0},
+	}
+	_, err := p.Build()
+	assert.EqualError(t, err, "pipeline a: canary: percent must be between 1 and 100")
+
+	p.Transforms = []Stage{{Type: "json"}}
+	p.Canary = &Canary{Percent: 5, Transforms: []Stage{}, Destination: &Stage{Type: "webhook", Settings: Settings{"url": "http://canary"}}}
+	canary := p.canaryVersion()
+	assert.Equal(t, "a:canary", canary.Name)
+	assert.Empty(t, canary.Transforms)
+	assert.Equal(t, "webhook", canary.Destination.Type)
+	assert.Nil(t, canary.Canary)
+}
@@ -1,15 +1,15 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 
 	"github.com/abstractpaper/manifold/stream"
 	swissOS "github.com/abstractpaper/swissarmy/os"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -21,22 +21,20 @@ func main() {
 
 	// aws config
 	awsRegion := swissOS.GetEnv("MANIFOLD_AWS_REGION", "us-east-1")
-	awsAccessKey := swissOS.GetEnv("MANIFOLD_AWS_ACCESS_KEY", "")
-	awsSecretKey := swissOS.GetEnv("MANIFOLD_AWS_SECRET_KEY", "")
-
-	// AWS setup
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(awsRegion),
-		Credentials: credentials.NewStaticCredentials(awsAccessKey, awsSecretKey, ""),
-	})
+	awsRoleARN := swissOS.GetEnv("MANIFOLD_AWS_ROLE_ARN", "")
+
+	// AWS setup: credentials come from the default chain (environment,
+	// shared config, IAM role)
+	cfg, err := stream.AWSConfig(context.Background(), awsRegion, "")
 	if err != nil {
-		log.Fatalln("Error creating session: ", err)
+		log.Fatalln("Error loading AWS config: ", err)
 	}
 
 	src := stream.Kinesis{
 		ConsumerName: "test-consumer",
 		StreamARN:    "arn:aws:kinesis:us-east-1:999999999999:stream/test",
-		AWSSess:      sess,
+		AWSConfig:    &cfg,
+		RoleARN:      awsRoleARN,
 		Args: map[string]string{
 			"shardId":       "shardId-000000000000",
 			"shardIterator": "LATEST",
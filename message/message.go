@@ -0,0 +1,62 @@
+// Package message defines the unit of data that flows through a
+// manifold pipeline.
+package message
+
+import "errors"
+
+// ErrQuarantined is (wrapped in) the error a message is acknowledged
+// with when it couldn't be delivered but was quarantined, e.g. to a
+// DLQ. The message has been handled and must not be redelivered.
+var ErrQuarantined = errors.New("message quarantined")
+
+// Message is a payload read from a source together with the
+// metadata describing where it came from.
+type Message struct {
+	Body     string
+	Metadata Metadata
+	// Ack is called once the message has been handled, with a
+	// non-nil error if it could not be delivered. Sources that
+	// redeliver unacknowledged messages set it, it is nil otherwise.
+	Ack func(err error)
+}
+
+// Handled reports whether a message acknowledged with `err` has
+// been handled, i.e. delivered or quarantined.
+func Handled(err error) bool {
+	return err == nil || errors.Is(err, ErrQuarantined)
+}
+
+// Done acknowledges the message with `err` if it has an Ack
+// callback.
+func (m Message) Done(err error) {
+	if m.Ack != nil {
+		m.Ack(err)
+	}
+}
+
+// Metadata holds key/value context attached to a message by a
+// source (e.g. a Kinesis sequence number or shard id).
+type Metadata map[string]string
+
+// New returns a message with `body` and empty metadata.
+func New(body string) Message {
+	return Message{Body: body, Metadata: Metadata{}}
+}
+
+// Get returns the value of `key`, or an empty string if it is not
+// set. It is safe to call on a nil Metadata.
+func (m Metadata) Get(key string) string {
+	if m == nil {
+		return ""
+	}
+	return m[key]
+}
+
+// Copy returns a shallow copy of the metadata.
+func (m Metadata) Copy() Metadata {
+	c := make(Metadata, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,37 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataGet(t *testing.T) {
+	var nilMeta Metadata
+	assert.Equal(t, "", nilMeta.Get("key"))
+
+	m := New("body")
+	m.Metadata["key"] = "value"
+	assert.Equal(t, "value", m.Metadata.Get("key"))
+}
+
+func TestMetadataCopy(t *testing.T) {
+	m := Metadata{"a": "1"}
+	c := m.Copy()
+	c["a"] = "2"
+
+	assert.Equal(t, "1", m["a"])
+	assert.Equal(t, "2", c["a"])
+}
+
+func TestMessageDone(t *testing.T) {
+	// no Ack set
+	New("body").Done(nil)
+
+	var acked error
+	m := New("body")
+	m.Ack = func(err error) { acked = err }
+	m.Done(assert.AnError)
+
+	assert.Equal(t, assert.AnError, acked)
+}
@@ -0,0 +1,454 @@
+package stream
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/flight"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// MetaFlightPath is the metadata key of the descriptor path of
+// messages read by FlightServer, joined with "/".
+const MetaFlightPath = "flight.path"
+
+// FlightServer runs an Arrow Flight server and reads the record
+// batches uploaded to it with DoPut, as a JSON object message per
+// row, so batch-oriented systems (e.g. pyarrow, DuckDB, Spark) can
+// stream data into a pipeline.
+//
+// Each batch is acknowledged with a PutResult (whose app metadata is
+// the batch's row count) once all of its messages have been handled;
+// the upload fails if one couldn't be delivered, so clients can
+// retry it. If Token is set, calls must send an `authorization:
+// Bearer <token>` header.
+type FlightServer struct {
+	Addr     string // listen address, e.g. ":8815"
+	Token    string
+	server   *grpc.Server
+	listener net.Listener
+	messages chan message.Message
+	done     chan bool
+	logged
+}
+
+func (f *FlightServer) Connect() (err error) {
+	f.listener, err = net.Listen("tcp", f.Addr)
+	if err != nil {
+		f.logger().Error("FlightServer: Failed to listen: ", err)
+		return
+	}
+	f.messages = make(chan message.Message)
+	f.done = make(chan bool)
+
+	f.server = grpc.NewServer(grpc.StreamInterceptor(f.authorize))
+	flight.RegisterFlightServiceService(f.server, &flight.FlightServiceService{DoPut: f.doPut})
+	go func() {
+		f.logger().Info("FlightServer: Listening on ", f.listener.Addr())
+		err := f.server.Serve(f.listener)
+		if err != nil {
+			f.logger().Error("FlightServer: ", err)
+		}
+	}()
+	return
+}
+
+// Disconnect stops the server, uploads still waiting for
+// acknowledgements are failed.
+func (f *FlightServer) Disconnect() (err error) {
+	if f.server != nil {
+		f.logger().Info("FlightServer: Shutting down server...")
+		close(f.done)
+		f.server.GracefulStop()
+	}
+	return
+}
+
+// Capabilities of the server: uploads complete once their rows are
+// acknowledged, so clients retry failed ones.
+func (f *FlightServer) Capabilities() Capabilities {
+	return Capabilities{Acks: true, Ordering: true, Schemas: true}
+}
+
+func (f *FlightServer) Info() {
+	f.logger().Info("FlightServer.Addr: ", f.Addr)
+}
+
+func (f *FlightServer) Read() (channel chan string, err error) {
+	messages, err := f.ReadMessages()
+	if err != nil {
+		return
+	}
+
+	channel = make(chan string)
+	go func() {
+		for m := range messages {
+			channel <- m.Body
+			m.Done(nil)
+		}
+	}()
+	return
+}
+
+// ReadMessages returns the channel of uploaded rows, each message
+// carries its descriptor path as metadata.
+func (f *FlightServer) ReadMessages() (chan message.Message, error) {
+	return f.messages, nil
+}
+
+// authorize checks the bearer token of a call.
+func (f *FlightServer) authorize(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if f.Token != "" {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		auth := md.Get("authorization")
+		if len(auth) == 0 || subtle.ConstantTimeCompare([]byte(auth[0]), []byte("Bearer "+f.Token)) != 1 {
+			return status.Error(codes.Unauthenticated, "unauthorized")
+		}
+	}
+	return handler(srv, ss)
+}
+
+// doPut reads the batches of an upload.
+func (f *FlightServer) doPut(stream flight.FlightService_DoPutServer) error {
+	in := &descriptorReader{stream: stream}
+	reader, err := ipc.NewFlightDataReader(in)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	defer reader.Release()
+
+	for reader.Next() {
+		n, err := f.read(reader.Record(), strings.Join(in.path, "/"))
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&flight.PutResult{AppMetadata: []byte(fmt.Sprint(n))})
+		if err != nil {
+			return err
+		}
+	}
+	if err := reader.Err(); err != nil && err != io.EOF {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+// read pushes the rows of `rec` and waits for their
+// acknowledgements.
+func (f *FlightServer) read(rec array.Record, path string) (int, error) {
+	rows, err := recordRows(rec)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	acks := make(chan error, len(rows))
+	for _, body := range rows {
+		m := message.New(body)
+		m.Metadata[MetaFlightPath] = path
+		m.Ack = func(err error) { acks <- err }
+		select {
+		case f.messages <- m:
+		case <-f.done:
+			return 0, status.Error(codes.Unavailable, "server is shutting down")
+		}
+	}
+	for range rows {
+		select {
+		case err := <-acks:
+			if !message.Handled(err) {
+				f.logger().Warn("FlightServer: Upload failed: ", err)
+				return 0, status.Error(codes.Unavailable, err.Error())
+			}
+		case <-f.done:
+			return 0, status.Error(codes.Unavailable, "server is shutting down")
+		}
+	}
+	return len(rows), nil
+}
+
+// descriptorReader keeps the descriptor path of an upload.
+type descriptorReader struct {
+	stream flight.FlightService_DoPutServer
+	path   []string
+}
+
+func (r *descriptorReader) Recv() (*flight.FlightData, error) {
+	data, err := r.stream.Recv()
+	if err == nil && data.FlightDescriptor != nil {
+		r.path = data.FlightDescriptor.Path
+	}
+	return data, err
+}
+
+// recordRows returns the rows of `rec` as JSON objects.
+func recordRows(rec array.Record) ([]string, error) {
+	rows := make([]map[string]interface{}, rec.NumRows())
+	for i := range rows {
+		rows[i] = map[string]interface{}{}
+	}
+	for j, field := range rec.Schema().Fields() {
+		column := rec.Column(j)
+		for i := range rows {
+			v, err := jsonValue(column, i)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %s", field.Name, err)
+			}
+			rows[i][field.Name] = v
+		}
+	}
+
+	bodies := make([]string, len(rows))
+	for i, row := range rows {
+		data, err := json.Marshal(row)
+		if err != nil {
+			return nil, err
+		}
+		bodies[i] = string(data)
+	}
+	return bodies, nil
+}
+
+// timeUnits maps Arrow time units to durations.
+var timeUnits = map[arrow.TimeUnit]time.Duration{
+	arrow.Second:      time.Second,
+	arrow.Millisecond: time.Millisecond,
+	arrow.Microsecond: time.Microsecond,
+	arrow.Nanosecond:  time.Nanosecond,
+}
+
+// jsonValue returns the value of row `i` of `column` as a JSON
+// value. Timestamps and dates are formatted as RFC 3339 strings,
+// binary values are base64 encoded.
+func jsonValue(column array.Interface, i int) (interface{}, error) {
+	if column.IsNull(i) {
+		return nil, nil
+	}
+	switch column := column.(type) {
+	case *array.String:
+		return column.Value(i), nil
+	case *array.Binary:
+		return column.Value(i), nil
+	case *array.Boolean:
+		return column.Value(i), nil
+	case *array.Int8:
+		return column.Value(i), nil
+	case *array.Int16:
+		return column.Value(i), nil
+	case *array.Int32:
+		return column.Value(i), nil
+	case *array.Int64:
+		return column.Value(i), nil
+	case *array.Uint8:
+		return column.Value(i), nil
+	case *array.Uint16:
+		return column.Value(i), nil
+	case *array.Uint32:
+		return column.Value(i), nil
+	case *array.Uint64:
+		return column.Value(i), nil
+	case *array.Float32:
+		return column.Value(i), nil
+	case *array.Float64:
+		return column.Value(i), nil
+	case *array.Timestamp:
+		d := time.Duration(column.Value(i)) * timeUnits[column.DataType().(*arrow.TimestampType).Unit]
+		return time.Unix(0, int64(d)).UTC().Format(time.RFC3339Nano), nil
+	case *array.Date32:
+		return time.Unix(int64(column.Value(i))*86400, 0).UTC().Format("2006-01-02"), nil
+	case *array.Date64:
+		return time.Unix(0, int64(column.Value(i))*int64(time.Millisecond)).UTC().Format("2006-01-02"), nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", column.DataType())
+}
+
+// Flight writes JSON messages to an Arrow Flight server, uploading
+// them with DoPut to the Path descriptor as record batches of
+// Config.Columns (see ParquetColumn), so analytical systems receive
+// columnar batches rather than rows.
+//
+// Messages are parsed when they're written and buffered as Arrow
+// records (see columnarRow), which are uploaded every
+// Config.FlushEvery seconds or Config.BatchSize rows. Failed uploads
+// are retried Config.MaxRetries times. Messages written with
+// WriteAsync (as pipelines do) are acknowledged once the server
+// acknowledged their batch.
+type Flight struct {
+	Addr    string // e.g. localhost:8815
+	Path    []string
+	Token   string
+	TLS     bool // connect with TLS, using the system's roots
+	Config  *FlightConfig
+	conn    *grpc.ClientConn
+	client  flight.FlightServiceClient
+	schema  *arrow.Schema
+	batcher *batcher
+	clocked
+	logged
+}
+
+// FlightConfig configures the schema and batches.
+type FlightConfig struct {
+	Columns    []ParquetColumn
+	BatchSize  int // rows per record batch, defaults to 1000
+	FlushEvery int // seconds, defaults to 1
+	MaxRetries int // retries of failed uploads, defaults to 3
+}
+
+func (f *Flight) Connect() (err error) {
+	if f.Config == nil {
+		f.Config = &FlightConfig{}
+	}
+	if f.Config.BatchSize < 1 {
+		f.Config.BatchSize = 1000
+	}
+	if f.Config.FlushEvery < 1 {
+		f.Config.FlushEvery = 1
+	}
+	if f.Config.MaxRetries < 1 {
+		f.Config.MaxRetries = 3
+	}
+	if len(f.Config.Columns) == 0 {
+		return errors.New("Flight: at least one column must be configured")
+	}
+	f.schema, err = arrowSchema(f.Config.Columns)
+	if err != nil {
+		return fmt.Errorf("Flight: %s", err)
+	}
+
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if f.TLS {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, ""))}
+	}
+	f.conn, err = grpc.Dial(f.Addr, opts...)
+	if err != nil {
+		f.logger().Error("Flight: Failed to connect: ", err)
+		return
+	}
+	f.client = flight.NewFlightServiceClient(f.conn)
+
+	f.batcher = newBatcher("Flight", f.logger(), f.clock(), f.Config.BatchSize, time.Duration(f.Config.FlushEvery)*time.Second, f.Config.MaxRetries, f.flush)
+	return
+}
+
+// Disconnect uploads buffered rows and closes the connection.
+func (f *Flight) Disconnect() (err error) {
+	if f.batcher != nil {
+		f.batcher.close()
+		f.batcher = nil
+	}
+	if f.conn != nil {
+		err = f.conn.Close()
+		f.conn = nil
+	}
+	return
+}
+
+func (f *Flight) Capabilities() Capabilities {
+	return Capabilities{ConfirmedWrites: true, Batching: true, Schemas: true}
+}
+
+func (f *Flight) Info() {
+	f.logger().Infof("Flight: %s %s", f.Addr, strings.Join(f.Path, "/"))
+	f.logger().Infof("FlightConfig: %+v", *f.Config)
+}
+
+func (f *Flight) Write(body string) (err error) {
+	return f.WriteMessage(message.New(body))
+}
+
+// WriteMessage buffers a row for `m`.
+func (f *Flight) WriteMessage(m message.Message) (err error) {
+	r, err := parseColumnarRow(m, nil, f.Config.Columns, nil)
+	if err != nil {
+		return
+	}
+	f.batcher.add(r, nil)
+	return
+}
+
+// WriteAsync buffers a row for `m` and calls `done` once its batch
+// has been acknowledged.
+func (f *Flight) WriteAsync(m message.Message, done func(error)) {
+	r, err := parseColumnarRow(m, nil, f.Config.Columns, nil)
+	if err != nil {
+		done(err)
+		return
+	}
+	f.batcher.add(r, done)
+}
+
+// flush uploads `batch` as a record batch.
+func (f *Flight) flush(batch []*batchEntry) error {
+	batches, err := partitionBatch(batchRows(batch), nil, f.Config.Columns)
+	if err != nil {
+		return err
+	}
+	defer releaseBatches(batches)
+
+	ctx := context.Background()
+	if f.Token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+f.Token)
+	}
+	stream, err := f.client.DoPut(ctx)
+	if err != nil {
+		return err
+	}
+	w := ipc.NewFlightDataWriter(&descriptorWriter{stream: stream, path: f.Path}, ipc.WithSchema(f.schema))
+	for _, b := range batches {
+		err = w.Write(b.record)
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Close()
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	if err != nil {
+		return err
+	}
+
+	// the upload succeeded once the server ends the stream
+	for {
+		_, err = stream.Recv()
+		if err == io.EOF {
+			f.logger().Infof("Flight: Uploaded %d row(s)", len(batch))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// descriptorWriter sends the descriptor with the first message of an
+// upload.
+type descriptorWriter struct {
+	stream flight.FlightService_DoPutClient
+	path   []string
+	sent   bool
+}
+
+func (w *descriptorWriter) Send(data *flight.FlightData) error {
+	data.FlightDescriptor = nil
+	if !w.sent {
+		data.FlightDescriptor = &flight.FlightDescriptor{Type: flight.FlightDescriptor_PATH, Path: w.path}
+		w.sent = true
+	}
+	return w.stream.Send(data)
+}
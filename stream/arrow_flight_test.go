@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlight_Upload(t *testing.T) {
+	src := &FlightServer{Addr: "127.0.0.1:0", Token: "token"}
+	assert.NoError(t, src.Connect())
+	defer src.Disconnect()
+
+	dest := &Flight{
+		Addr:  src.listener.Addr().String(),
+		Path:  []string{"events", "clicks"},
+		Token: "token",
+		Config: &FlightConfig{
+			Columns: []ParquetColumn{
+				{Name: "device", Type: "string"},
+				{Name: "count", Type: "long"},
+				{Name: "ts", Type: "timestamp"},
+			},
+			BatchSize:  2,
+			FlushEvery: 60,
+			MaxRetries: 1,
+		},
+	}
+	assert.NoError(t, dest.Connect())
+	defer dest.Disconnect()
+
+	messages, _ := src.ReadMessages()
+	received := make(chan message.Message, 2)
+	go func() {
+		for m := range messages {
+			received <- m
+			m.Done(nil)
+		}
+	}()
+
+	acks := make(chan error, 2)
+	dest.WriteAsync(message.New(`{"device":"d1","count":1,"ts":"2020-10-01T12:00:00Z"}`), func(err error) { acks <- err })
+	dest.WriteAsync(message.New(`{"device":"d2"}`), func(err error) { acks <- err })
+	assert.NoError(t, <-acks)
+	assert.NoError(t, <-acks)
+
+	m := <-received
+	assert.JSONEq(t, `{"device":"d1","count":1,"ts":"2020-10-01T12:00:00Z"}`, m.Body)
+	assert.Equal(t, "events/clicks", m.Metadata[MetaFlightPath])
+	assert.JSONEq(t, `{"device":"d2","count":null,"ts":null}`, (<-received).Body)
+}
+
+func TestFlight_FailedUpload(t *testing.T) {
+	src := &FlightServer{Addr: "127.0.0.1:0", Token: "token"}
+	assert.NoError(t, src.Connect())
+	defer src.Disconnect()
+
+	dest := &Flight{
+		Addr:   src.listener.Addr().String(),
+		Config: &FlightConfig{Columns: []ParquetColumn{{Name: "a", Type: "long"}}, MaxRetries: 1},
+	}
+	assert.NoError(t, dest.Connect())
+	defer dest.Disconnect()
+
+	// unauthorized
+	err := dest.flush([]*batchEntry{{value: columnarRow{values: []interface{}{int64(1)}}}})
+	assert.Error(t, err)
+
+	// not delivered by the pipeline
+	dest.Token = "token"
+	messages, _ := src.ReadMessages()
+	go func() {
+		(<-messages).Done(errors.New("write failed"))
+	}()
+	err = dest.flush([]*batchEntry{{value: columnarRow{values: []interface{}{int64(1)}}}})
+	assert.Error(t, err)
+
+	// rows are validated when written
+	done := make(chan error, 1)
+	dest.WriteAsync(message.New(`{"a":"one"}`), func(err error) { done <- err })
+	assert.Error(t, <-done)
+}
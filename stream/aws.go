@@ -0,0 +1,84 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// AWSSession returns a session using the default credential chain:
+// environment variables, the shared credentials and config files
+// (with `profile` if set), then the web identity or IAM role of the
+// pod, container or instance. `region` overrides the region of the
+// shared config if set.
+//
+// AWS connectors use it when their session isn't set.
+func AWSSession(region string, profile string) (*session.Session, error) {
+	opts := session.Options{
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if region != "" {
+		opts.Config.Region = aws.String(region)
+	}
+	return session.NewSessionWithOptions(opts)
+}
+
+// AssumeRole returns a copy of `sess` whose credentials are those of
+// `roleARN`, assumed with the credentials of `sess` and `externalID`
+// (if set) through STS. The credentials are refreshed a minute before
+// they expire, so long running connectors keep working.
+func AssumeRole(sess *session.Session, roleARN string, externalID string) *session.Session {
+	return assumeRole(sess, sts.New(sess), roleARN, externalID)
+}
+
+func assumeRole(sess *session.Session, svc stscreds.AssumeRoler, roleARN string, externalID string) *session.Session {
+	creds := stscreds.NewCredentialsWithClient(svc, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.ExpiryWindow = time.Minute
+		if externalID != "" {
+			p.ExternalID = aws.String(externalID)
+		}
+	})
+	return sess.Copy(&aws.Config{Credentials: creds})
+}
+
+// connectorSession returns the session of an AWS connector: `sess`,
+// or one using the default credential chain in `region` if it is
+// nil, assuming `roleARN` if set.
+func connectorSession(sess *session.Session, region string, roleARN string, externalID string) (*session.Session, error) {
+	if sess == nil {
+		var err error
+		sess, err = AWSSession(region, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if roleARN != "" {
+		sess = AssumeRole(sess, roleARN, externalID)
+	}
+	return sess, nil
+}
+
+// arnRegion returns the region of `resource`, an ARN.
+func arnRegion(resource string) string {
+	a, err := arn.Parse(resource)
+	if err != nil {
+		return ""
+	}
+	return a.Region
+}
+
+// sessionRegion returns the region of `sess`, if any.
+func sessionRegion(sess *session.Session) string {
+	if sess == nil || sess.Config.Region == nil {
+		return ""
+	}
+	return *sess.Config.Region
+}
@@ -0,0 +1,129 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Connectors ported to aws-sdk-go-v2 (Kinesis and S3, and AWS
+// connectors added from now on) take an aws.Config. They still
+// accept a v1 session.Session during the transition, whose region
+// and credentials are used through SessionConfig.
+
+// AWSConfig returns an aws-sdk-go-v2 config using the default
+// credential chain, like AWSSession: environment variables, the
+// shared credentials and config files (with `profile` if set), then
+// the web identity or IAM role of the pod, container or instance.
+// `region` overrides the region of the shared config if set.
+func AWSConfig(ctx context.Context, region string, profile string) (aws.Config, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	if profile != "" {
+		opts = append(opts, awsconfig.WithSharedConfigProfile(profile))
+	}
+	return awsconfig.LoadDefaultConfig(ctx, opts...)
+}
+
+// SessionConfig returns an aws-sdk-go-v2 config with the region,
+// endpoint and credentials of `sess`, a v1 session.
+func SessionConfig(sess *session.Session) aws.Config {
+	cfg := aws.Config{Credentials: sessionCredentials{sess.Config.Credentials}}
+	if sess.Config.Region != nil {
+		cfg.Region = *sess.Config.Region
+	}
+	if sess.Config.Endpoint != nil && *sess.Config.Endpoint != "" {
+		cfg.BaseEndpoint = sess.Config.Endpoint
+	}
+	return cfg
+}
+
+// sessionCredentials provides the credentials of a v1 session, which
+// caches and refreshes them itself.
+type sessionCredentials struct {
+	creds *credentials.Credentials
+}
+
+func (c sessionCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	value, err := c.creds.GetWithContext(ctx)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	creds := aws.Credentials{
+		AccessKeyID:     value.AccessKeyID,
+		SecretAccessKey: value.SecretAccessKey,
+		SessionToken:    value.SessionToken,
+		Source:          value.ProviderName,
+	}
+	if expires, err := c.creds.ExpiresAt(); err == nil {
+		creds.CanExpire = true
+		creds.Expires = expires
+	}
+	return creds, nil
+}
+
+// AssumeRoleConfig is AssumeRole for aws-sdk-go-v2: it returns a copy
+// of `cfg` whose credentials are those of `roleARN`, refreshed a
+// minute before they expire.
+func AssumeRoleConfig(cfg aws.Config, roleARN string, externalID string) aws.Config {
+	return assumeRoleConfig(cfg, sts.NewFromConfig(cfg), roleARN, externalID)
+}
+
+func assumeRoleConfig(cfg aws.Config, svc stscreds.AssumeRoleAPIClient, roleARN string, externalID string) aws.Config {
+	provider := stscreds.NewAssumeRoleProvider(svc, roleARN, func(o *stscreds.AssumeRoleOptions) {
+		if externalID != "" {
+			o.ExternalID = aws.String(externalID)
+		}
+	})
+	cfg = cfg.Copy()
+	cfg.Credentials = aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = time.Minute
+	})
+	return cfg
+}
+
+// connectorConfig returns the config of an AWS connector: `cfg`, one
+// adapted from `sess` or one using the default credential chain, in
+// `region` unless it has one, assuming `roleARN` if set.
+func connectorConfig(ctx context.Context, cfg *aws.Config, sess *session.Session, region string, roleARN string, externalID string) (aws.Config, error) {
+	var c aws.Config
+	switch {
+	case cfg != nil:
+		c = cfg.Copy()
+	case sess != nil:
+		c = SessionConfig(sess)
+	default:
+		var err error
+		c, err = AWSConfig(ctx, region, "")
+		if err != nil {
+			return c, err
+		}
+	}
+	if c.Region == "" {
+		c.Region = region
+	}
+	if roleARN != "" {
+		c = AssumeRoleConfig(c, roleARN, externalID)
+	}
+	return c, nil
+}
+
+// configRegion returns the region of `cfg`, or of `sess` if it is
+// nil.
+func configRegion(cfg *aws.Config, sess *session.Session) string {
+	if cfg != nil {
+		return cfg.Region
+	}
+	return sessionRegion(sess)
+}
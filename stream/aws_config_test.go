@@ -0,0 +1,100 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+	v1aws "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConfigSTS issues credentials expiring after `ttl`.
+type fakeConfigSTS struct {
+	ttl    time.Duration
+	inputs []*sts.AssumeRoleInput
+}
+
+func (f *fakeConfigSTS) AssumeRole(_ context.Context, input *sts.AssumeRoleInput, _ ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	f.inputs = append(f.inputs, input)
+	return &sts.AssumeRoleOutput{Credentials: &types.Credentials{
+		AccessKeyId:     aws.String("role-key"),
+		SecretAccessKey: aws.String("role-secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(f.ttl)),
+	}}, nil
+}
+
+func TestSessionConfig(t *testing.T) {
+	sess := session.Must(session.NewSession(&v1aws.Config{
+		Region:      v1aws.String("eu-west-1"),
+		Endpoint:    v1aws.String("http://localhost:4566"),
+		Credentials: credentials.NewStaticCredentials("key", "secret", ""),
+	}))
+
+	cfg := SessionConfig(sess)
+	assert.Equal(t, "eu-west-1", cfg.Region)
+	assert.Equal(t, "http://localhost:4566", *cfg.BaseEndpoint)
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "key", creds.AccessKeyID)
+	assert.Equal(t, "secret", creds.SecretAccessKey)
+	assert.False(t, creds.CanExpire)
+}
+
+func TestAssumeRoleConfig(t *testing.T) {
+	ctx := context.Background()
+	base := aws.Config{Region: "eu-west-1", Credentials: aws.AnonymousCredentials{}}
+
+	svc := &fakeConfigSTS{ttl: time.Hour}
+	cfg := assumeRoleConfig(base, svc, "arn:aws:iam::111111111111:role/reader", "ext")
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "role-key", creds.AccessKeyID)
+	assert.Equal(t, "eu-west-1", cfg.Region)
+	assert.Equal(t, "arn:aws:iam::111111111111:role/reader", *svc.inputs[0].RoleArn)
+	assert.Equal(t, "ext", *svc.inputs[0].ExternalId)
+	// the base config keeps its credentials
+	assert.Equal(t, aws.AnonymousCredentials{}, base.Credentials)
+
+	// cached until a minute before they expire
+	cfg.Credentials.Retrieve(ctx)
+	assert.Len(t, svc.inputs, 1)
+	svc = &fakeConfigSTS{ttl: 30 * time.Second}
+	cfg = assumeRoleConfig(base, svc, "arn:aws:iam::111111111111:role/reader", "")
+	cfg.Credentials.Retrieve(ctx)
+	cfg.Credentials.Retrieve(ctx)
+	assert.Len(t, svc.inputs, 2)
+	assert.Nil(t, svc.inputs[0].ExternalId)
+}
+
+func TestConnectorConfig(t *testing.T) {
+	ctx := context.Background()
+	region := arnRegion("arn:aws:kinesis:us-east-2:999999999999:stream/events")
+
+	// a config wins over a session, and keeps its region
+	sess := session.Must(session.NewSession(&v1aws.Config{Region: v1aws.String("eu-west-1")}))
+	cfg, err := connectorConfig(ctx, &aws.Config{Region: "ap-south-1"}, sess, region, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "ap-south-1", cfg.Region)
+
+	cfg, err = connectorConfig(ctx, nil, sess, region, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "eu-west-1", cfg.Region)
+
+	cfg, err = connectorConfig(ctx, &aws.Config{}, nil, region, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "us-east-2", cfg.Region)
+
+	cfg, err = connectorConfig(ctx, nil, nil, region, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "us-east-2", cfg.Region)
+}
@@ -1,115 +1,345 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
 package stream
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/abstractpaper/manifold/message"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/kinesis"
+)
 
-	log "github.com/sirupsen/logrus"
+// Metadata keys attached to messages read from Kinesis.
+const (
+	MetaKinesisArrivalTimestamp = "kinesis.approximate_arrival_timestamp"
+	MetaKinesisPartitionKey     = "kinesis.partition_key"
+	MetaKinesisSequenceNumber   = "kinesis.sequence_number"
+	MetaKinesisShardID          = "kinesis.shard_id"
 )
 
+// Kinesis source modes.
+const (
+	kinesisModeFanOut  = "fanout"
+	kinesisModePolling = "polling"
+)
+
+// Kinesis reads from or writes to a Kinesis Data Stream.
+//
+// As a source, all shards of the stream are consumed concurrently
+// (or only `shardId` if set in Args). Shards are tracked for
+// resharding: once a parent shard is fully read, its child shards
+// are picked up.
+//
+// Args:
+//
+//	mode: "fanout" (default) uses enhanced fan-out (SubscribeToShard)
+//	with a registered consumer, "polling" uses GetRecords.
+//	shardIterator: starting position of shards without a checkpoint,
+//	e.g. LATEST (default) or TRIM_HORIZON.
+//	shardId: consume a single shard.
+//	pollInterval: milliseconds between GetRecords calls (polling
+//	mode), defaults to 1000.
+//
+// If LeaseTable is set, multiple consumer instances coordinate shard
+// ownership through leases stored in that DynamoDB table (see
+// kinesisLeases), so consumption can be scaled horizontally.
+//
+// Seek starts shards from TRIM_HORIZON, LATEST, a timestamp or the
+// sequence numbers of a previous run, e.g. to backfill.
+//
+// Calls to Kinesis are cancelled when the connector disconnects, or
+// when the consumer of their shard is stopped.
 type Kinesis struct {
 	ConsumerName string
 	StreamARN    string
-	AWSSess      *session.Session
+	AWSConfig    *aws.Config      // defaults to the default credential chain
+	AWSSess      *session.Session // v1 session used if AWSConfig isn't set
+	RoleARN      string           // role assumed to read or write the stream
+	ExternalID   string           // external ID of RoleARN, if required
 	Args         map[string]string
-	client       *kinesis.Kinesis
-	consumer     *kinesis.Consumer
-	stream       *kinesis.SubscribeToShardEventStream
+	// LeaseTable is the DynamoDB table holding shard leases. The
+	// table's partition key must be a string named `shardId`.
+	LeaseTable string
+	// WorkerID identifies this instance in the lease table, defaults
+	// to hostname-pid.
+	WorkerID string
+	client   kinesisAPI
+	consumer *types.Consumer
+	shards   *shardCoordinator
+	start    *Position // see Seek
+	cfg      aws.Config
+	ctx      context.Context
+	cancel   context.CancelFunc
+	clocked
+	logged
+}
+
+// kinesisAPI is the part of the Kinesis client used by the connector.
+type kinesisAPI interface {
+	DescribeStreamConsumer(ctx context.Context, input *kinesis.DescribeStreamConsumerInput, opts ...func(*kinesis.Options)) (*kinesis.DescribeStreamConsumerOutput, error)
+	RegisterStreamConsumer(ctx context.Context, input *kinesis.RegisterStreamConsumerInput, opts ...func(*kinesis.Options)) (*kinesis.RegisterStreamConsumerOutput, error)
+	DeregisterStreamConsumer(ctx context.Context, input *kinesis.DeregisterStreamConsumerInput, opts ...func(*kinesis.Options)) (*kinesis.DeregisterStreamConsumerOutput, error)
+	SubscribeToShard(ctx context.Context, input *kinesis.SubscribeToShardInput, opts ...func(*kinesis.Options)) (*kinesis.SubscribeToShardOutput, error)
+	ListShards(ctx context.Context, input *kinesis.ListShardsInput, opts ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error)
+	GetShardIterator(ctx context.Context, input *kinesis.GetShardIteratorInput, opts ...func(*kinesis.Options)) (*kinesis.GetShardIteratorOutput, error)
+	GetRecords(ctx context.Context, input *kinesis.GetRecordsInput, opts ...func(*kinesis.Options)) (*kinesis.GetRecordsOutput, error)
+	PutRecord(ctx context.Context, input *kinesis.PutRecordInput, opts ...func(*kinesis.Options)) (*kinesis.PutRecordOutput, error)
 }
 
 func (k *Kinesis) Connect() (err error) {
+	k.ctx, k.cancel = context.WithCancel(context.Background())
+	k.cfg, err = connectorConfig(k.ctx, k.AWSConfig, k.AWSSess, arnRegion(k.StreamARN), k.RoleARN, k.ExternalID)
+	if err != nil {
+		return
+	}
+
 	// kinesis client
-    k.client = kinesis.New(k.AWSSess)
+	k.client = kinesis.NewFromConfig(k.cfg)
 
 	return
 }
 
 func (k *Kinesis) Disconnect() (err error) {
+	if k.shards != nil {
+		k.logger().Info("Stopping shard consumers...")
+		k.shards.stop()
+	}
+	if k.cancel != nil {
+		k.cancel()
+	}
+
 	if k.consumer != nil {
-		log.Info("Deregistering consumer...")
-		_, err = deregisterConsumer(k.client, k.ConsumerName, k.StreamARN)
+		k.logger().Info("Deregistering consumer...")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err = deregisterConsumer(ctx, k.client, k.ConsumerName, k.StreamARN)
 		if err != nil {
-			log.Error(err)
+			k.logger().Error(err)
 		}
 	}
 
 	return
 }
 
+// Drain stores the checkpoints of the shards it reads in the lease
+// table now rather than at the next shard refresh, with LeaseTable,
+// so that another worker taking them over doesn't read the
+// acknowledged records again.
+func (k *Kinesis) Drain(ctx context.Context) error {
+	if k.shards == nil {
+		return nil
+	}
+	return k.shards.checkpoint(ctx)
+}
+
+// context returns the context of calls to Kinesis, cancelled by
+// Disconnect.
+func (k *Kinesis) context() context.Context {
+	if k.ctx == nil {
+		return context.Background()
+	}
+	return k.ctx
+}
+
+// Limits returns the 1 MiB limit of Kinesis records (which includes
+// the partition key).
+func (k *Kinesis) Limits() Limits {
+	return Limits{MaxMessageSize: 1 << 20}
+}
+
+// Resources returns the stream and the lease table, if any.
+func (k *Kinesis) Resources() []Resource {
+	region := arnRegion(k.StreamARN)
+	resources := []Resource{{Kind: "aws_kinesis_stream", Name: k.streamName(), Region: region}}
+	if k.LeaseTable != "" {
+		resources = append(resources, Resource{
+			Kind:     "aws_dynamodb_table",
+			Name:     k.LeaseTable,
+			Region:   region,
+			Settings: map[string]string{"hash_key": "shardId", "hash_key_type": "S"},
+		})
+	}
+	return resources
+}
+
+// Capabilities of Kinesis: records are read in order per shard, and
+// written in order per partition key. Read records are only
+// redelivered after a restart if checkpoints are stored, i.e. with
+// LeaseTable.
+func (k *Kinesis) Capabilities() Capabilities {
+	return Capabilities{Acks: k.LeaseTable != "", ConfirmedWrites: true, Ordering: true}
+}
+
 func (k *Kinesis) Info() {
-	log.Infof("Kinesis.Args: %+v", k.Args)
+	k.logger().Infof("Kinesis.Args: %+v", k.Args)
+	if k.LeaseTable != "" {
+		k.logger().Infof("Kinesis.LeaseTable: %s (worker %s)", k.LeaseTable, k.WorkerID)
+	}
 }
 
-func (k *Kinesis) Read() (channel chan string, err error) {
-    shardID, ok := k.Args["shardId"]
-    if !ok {
-        return nil, errors.New("shardId must be specified in Args.")
-    }
-
-    shardIterator, ok := k.Args["shardIterator"]
-    if !ok {
-        return nil, errors.New("shardIterator must be specified in Args.")
-    }
-
-	// get a consumer
-	k.consumer, err = getConsumer(k.client, k.ConsumerName, k.StreamARN)
-	if err != nil {
-		log.Fatalln("Error getting a consumer: ", err)
-		return
+// Lag returns how far behind the latest record of the stream the
+// shard furthest behind is read (its MillisBehindLatest).
+func (k *Kinesis) Lag() time.Duration {
+	if k.shards == nil {
+		return 0
 	}
+	return k.shards.maxLag()
+}
+
+// Seek sets where shards start being read, see startingPosition.
+func (k *Kinesis) Seek(pos Position) error {
+	switch pos.Type {
+	case Earliest, Latest, AtTimestamp, AfterOffsets:
+	default:
+		return fmt.Errorf("Kinesis: unsupported position %s", pos)
+	}
+	k.start = &pos
+	return nil
+}
 
-	// subscribe
-	log.Println("Subscribing to shard.")
-	k.stream, err = shardSubscribe(k.client, k.consumer, shardID, shardIterator)
+func (k *Kinesis) Read() (channel chan string, err error) {
+	messages, err := k.ReadMessages()
 	if err != nil {
-		log.Fatalln("Error subscribing to a shard: ", err)
+		return
 	}
 
-	// loop through stream and push messages into channel
 	channel = make(chan string)
 	go func() {
-		log.Println("Looping over event stream...")
-		for e := range k.stream.Reader.Events() {
-			records := e.(*kinesis.SubscribeToShardEvent).Records
-
-			for _, rec := range records {
-				log.Trace(string(rec.Data))
-				channel <- string(rec.Data)
-			}
+		for m := range messages {
+			channel <- m.Body
+			m.Done(nil)
 		}
 	}()
 	return
 }
 
+// ReadMessages consumes the stream's shards and pushes their
+// records into a channel. Each message carries the record's
+// approximate arrival timestamp, partition key, sequence number
+// and shard id in its metadata.
+func (k *Kinesis) ReadMessages() (channel chan message.Message, err error) {
+	if _, ok := k.Args["shardIterator"]; !ok {
+		k.setArg("shardIterator", string(types.ShardIteratorTypeLatest))
+	}
+
+	mode := k.Args["mode"]
+	switch mode {
+	case "", kinesisModeFanOut:
+		// get a consumer
+		k.consumer, err = getConsumer(k.context(), k.client, k.logger(), k.ConsumerName, k.StreamARN)
+		if err != nil {
+			k.logger().Error("Error getting a consumer: ", err)
+			return
+		}
+	case kinesisModePolling:
+	default:
+		return nil, errors.New("mode must be either fanout or polling.")
+	}
+
+	var leases *kinesisLeases
+	if k.LeaseTable != "" {
+		if k.WorkerID == "" {
+			hostname, _ := os.Hostname()
+			k.WorkerID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		}
+		leases = newKinesisLeases(dynamodb.NewFromConfig(k.cfg), k.LeaseTable, k.WorkerID)
+	}
+
+	channel = make(chan message.Message)
+	k.shards = newShardCoordinator(k, channel, leases)
+	go k.shards.run()
+
+	return
+}
+
+func (k *Kinesis) setArg(key string, value string) {
+	if k.Args == nil {
+		k.Args = map[string]string{}
+	}
+	k.Args[key] = value
+}
+
+// streamName returns the stream name part of StreamARN.
+func (k *Kinesis) streamName() string {
+	if name, ok := k.Args["streamName"]; ok {
+		return name
+	}
+	return k.StreamARN[strings.LastIndex(k.StreamARN, "/")+1:]
+}
+
 func (k *Kinesis) Write(message string) (err error) {
-    partitionKey, ok := k.Args["partitionKey"]
-    if !ok {
-        return errors.New("partitionKey must be specified in Args.")
-    }
+	partitionKey, ok := k.Args["partitionKey"]
+	if !ok {
+		return errors.New("partitionKey must be specified in Args.")
+	}
+
+	return k.putRecord(message, partitionKey)
+}
 
-    streamName, ok := k.Args["streamName"]
-    if !ok {
-        return errors.New("streamName must be specified in Args.")
-    }
+// WriteMessage writes `m` to the stream. If `partitionKey` is not
+// specified in Args, the partition key of the record `m` was read
+// from (if any) is used.
+func (k *Kinesis) WriteMessage(m message.Message) (err error) {
+	partitionKey, ok := k.Args["partitionKey"]
+	if !ok {
+		partitionKey = m.Metadata.Get(MetaKinesisPartitionKey)
+	}
+	if partitionKey == "" {
+		return errors.New("partitionKey must be specified in Args or message metadata.")
+	}
+
+	return k.putRecord(m.Body, partitionKey)
+}
+
+func (k *Kinesis) putRecord(message string, partitionKey string) (err error) {
+	streamName, ok := k.Args["streamName"]
+	if !ok {
+		return errors.New("streamName must be specified in Args.")
+	}
 
 	record := kinesis.PutRecordInput{
 		Data:         []byte(message),
 		PartitionKey: &partitionKey,
 		StreamName:   &streamName,
 	}
-	_, err = k.client.PutRecord(&record)
+	_, err = k.client.PutRecord(k.context(), &record)
 	if err != nil {
-		log.Errorln("PutRecord failed: ", err)
-    }
+		k.logger().Error("PutRecord failed: ", err)
+	}
 
 	return
 }
 
+// kinesisMessage converts a Kinesis record into a message with
+// the record's context in its metadata.
+func kinesisMessage(rec types.Record, shardID string) message.Message {
+	m := message.New(string(rec.Data))
+	m.Metadata[MetaKinesisShardID] = shardID
+	if rec.PartitionKey != nil {
+		m.Metadata[MetaKinesisPartitionKey] = *rec.PartitionKey
+	}
+	if rec.SequenceNumber != nil {
+		m.Metadata[MetaKinesisSequenceNumber] = *rec.SequenceNumber
+	}
+	if rec.ApproximateArrivalTimestamp != nil {
+		m.Metadata[MetaKinesisArrivalTimestamp] = rec.ApproximateArrivalTimestamp.UTC().Format(time.RFC3339Nano)
+	}
+	return m
+}
+
 // Return a consumer object
-func getConsumer(svc *kinesis.Kinesis, consumerName string, awsKinesisStreamARN string) (consumer *kinesis.Consumer, err error) {
+func getConsumer(ctx context.Context, svc kinesisAPI, logger Logger, consumerName string, awsKinesisStreamARN string) (consumer *types.Consumer, err error) {
 	tries := 1
 	for {
 		if tries >= 5 {
@@ -117,37 +347,38 @@ func getConsumer(svc *kinesis.Kinesis, consumerName string, awsKinesisStreamARN
 		}
 
 		// Try to get consumer details first
-		log.Info("Getting consumer details.")
-		var consumerDesc *kinesis.ConsumerDescription
-		consumerDesc, err = describeConsumer(svc, consumerName, awsKinesisStreamARN)
+		logger.Info("Getting consumer details.")
+		var consumerDesc *types.ConsumerDescription
+		consumerDesc, err = describeConsumer(ctx, svc, logger, consumerName, awsKinesisStreamARN)
 		if err != nil {
-			if _, ok := err.(*kinesis.ResourceNotFoundException); ok {
-				log.Info("ResourceNotFound")
+			var notFound *types.ResourceNotFoundException
+			if errors.As(err, &notFound) {
+				logger.Info("ResourceNotFound")
 
 				// consumer not found, register it.
-				log.Info("Registering consumer...")
-				_, err := registerConsumer(svc, consumerName, awsKinesisStreamARN)
+				logger.Info("Registering consumer...")
+				_, err := registerConsumer(ctx, svc, logger, consumerName, awsKinesisStreamARN)
 				if err != nil {
-					log.Error(err)
+					logger.Error(err)
 					return nil, err
 				}
 
 				// getting created consumer information
-				consumerDesc, err = describeConsumer(svc, consumerName, awsKinesisStreamARN)
+				consumerDesc, err = describeConsumer(ctx, svc, logger, consumerName, awsKinesisStreamARN)
 				if err != nil {
-					log.Error("Error creating a consumer: ", err)
+					logger.Error("Error creating a consumer: ", err)
 					return nil, err
 				}
 			} else {
-				log.Error("describeConsumer: ", err)
+				logger.Error("describeConsumer: ", err)
 				return nil, err
 			}
 
 		}
-		log.Info(consumerDesc)
+		logger.Info(*consumerDesc.ConsumerARN)
 
 		// copy ConsumerDecsription -> Consumer
-		consumer = &kinesis.Consumer{
+		consumer = &types.Consumer{
 			ConsumerARN:               consumerDesc.ConsumerARN,
 			ConsumerCreationTimestamp: consumerDesc.ConsumerCreationTimestamp,
 			ConsumerName:              consumerDesc.ConsumerName,
@@ -157,40 +388,41 @@ func getConsumer(svc *kinesis.Kinesis, consumerName string, awsKinesisStreamARN
 		// if ACTIVE then return the consumer
 		// if CREATING or DELETING then wait 5 times for 5 seconds each
 		// else register a new consumer
-		switch *consumer.ConsumerStatus {
-		case kinesis.ConsumerStatusActive:
-			log.Info("Consumer is ACTIVE, returning object.")
+		switch consumer.ConsumerStatus {
+		case types.ConsumerStatusActive:
+			logger.Info("Consumer is ACTIVE, returning object.")
 			return consumer, err
-		case kinesis.ConsumerStatusCreating, kinesis.ConsumerStatusDeleting:
-			log.Info("Consumer is ", *consumer.ConsumerStatus)
-			log.Info("Retrying in 5 seconds...")
+		case types.ConsumerStatusCreating, types.ConsumerStatusDeleting:
+			logger.Info("Consumer is ", consumer.ConsumerStatus)
+			logger.Info("Retrying in 5 seconds...")
 			time.Sleep(5 * time.Second)
 			tries++
 			continue
 		}
 
-		log.Info("Registering consumer...")
-		consumer, err := registerConsumer(svc, consumerName, awsKinesisStreamARN)
+		logger.Info("Registering consumer...")
+		consumer, err := registerConsumer(ctx, svc, logger, consumerName, awsKinesisStreamARN)
 		if err != nil {
-			log.Error(err)
+			logger.Error(err)
 			return nil, err
 		}
-		log.Info(consumer)
+		logger.Info(*consumer.ConsumerARN)
 	}
 
 	return
 }
 
 // Describe a consumer of Kinesis Data Stream.
-func describeConsumer(svc *kinesis.Kinesis, consumerName string, awsKinesisStreamARN string) (consumer *kinesis.ConsumerDescription, err error) {
+func describeConsumer(ctx context.Context, svc kinesisAPI, logger Logger, consumerName string, awsKinesisStreamARN string) (consumer *types.ConsumerDescription, err error) {
 	describeInput := kinesis.DescribeStreamConsumerInput{
 		ConsumerName: &consumerName,
 		StreamARN:    &awsKinesisStreamARN,
 	}
 
-	out, err := svc.DescribeStreamConsumer(&describeInput)
+	out, err := svc.DescribeStreamConsumer(ctx, &describeInput)
 	if err != nil {
-		log.Warn(err)
+		logger.Warn(err)
+		return
 	}
 	consumer = out.ConsumerDescription
 
@@ -198,14 +430,15 @@ func describeConsumer(svc *kinesis.Kinesis, consumerName string, awsKinesisStrea
 }
 
 // Register a consumer on a Kinesis Data Stream.
-func registerConsumer(svc *kinesis.Kinesis, consumerName string, awsKinesisStreamARN string) (consumer *kinesis.Consumer, err error) {
+func registerConsumer(ctx context.Context, svc kinesisAPI, logger Logger, consumerName string, awsKinesisStreamARN string) (consumer *types.Consumer, err error) {
 	registerInput := kinesis.RegisterStreamConsumerInput{
 		ConsumerName: &consumerName,
 		StreamARN:    &awsKinesisStreamARN,
 	}
-	out, err := svc.RegisterStreamConsumer(&registerInput)
+	out, err := svc.RegisterStreamConsumer(ctx, &registerInput)
 	if err != nil {
-		log.Error(err)
+		logger.Error(err)
+		return
 	}
 	consumer = out.Consumer
 
@@ -213,36 +446,71 @@ func registerConsumer(svc *kinesis.Kinesis, consumerName string, awsKinesisStrea
 }
 
 // Deregister a consumer on a Kinesis Data Stream.
-func deregisterConsumer(svc *kinesis.Kinesis, consumerName string, awsKinesisStreamARN string) (out string, err error) {
+func deregisterConsumer(ctx context.Context, svc kinesisAPI, consumerName string, awsKinesisStreamARN string) (err error) {
 	deregisterInput := kinesis.DeregisterStreamConsumerInput{
 		ConsumerName: &consumerName,
 		StreamARN:    &awsKinesisStreamARN,
 	}
 
-	resp, err := svc.DeregisterStreamConsumer(&deregisterInput)
-	if err != nil {
-		return
-	}
-	out = resp.GoString()
+	_, err = svc.DeregisterStreamConsumer(ctx, &deregisterInput)
 
 	return
 }
 
 // Subscribe to a shard on a Kinesis Data Stream.
-func shardSubscribe(svc *kinesis.Kinesis, consumer *kinesis.Consumer, shardId string, shardIteratorType string) (eventStream *kinesis.SubscribeToShardEventStream, err error) {
+func shardSubscribe(ctx context.Context, svc kinesisAPI, logger Logger, consumer *types.Consumer, shardId string, pos position) (eventStream *kinesis.SubscribeToShardEventStream, err error) {
 	subscribeInput := kinesis.SubscribeToShardInput{
-		ConsumerARN: consumer.ConsumerARN,
-		ShardId:     &shardId,
-		StartingPosition: &kinesis.StartingPosition{
-			Type: &shardIteratorType,
-		},
+		ConsumerARN:      consumer.ConsumerARN,
+		ShardId:          &shardId,
+		StartingPosition: pos.startingPosition(),
 	}
 	// SubscribeToShard
-	out, err := svc.SubscribeToShard(&subscribeInput)
+	out, err := svc.SubscribeToShard(ctx, &subscribeInput)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	eventStream = out.GetStream()
+
+	return
+}
+
+// List all shards of a Kinesis Data Stream.
+func listShards(ctx context.Context, svc kinesisAPI, streamName string) (shards []types.Shard, err error) {
+	input := &kinesis.ListShardsInput{StreamName: &streamName}
+	for {
+		var out *kinesis.ListShardsOutput
+		out, err = svc.ListShards(ctx, input)
+		if err != nil {
+			return
+		}
+		shards = append(shards, out.Shards...)
+
+		if out.NextToken == nil {
+			return
+		}
+		// StreamName must not be set along with NextToken
+		input = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+}
+
+// Get an iterator for a shard on a Kinesis Data Stream.
+func getShardIterator(ctx context.Context, svc kinesisAPI, streamName string, shardId string, pos position) (iterator *string, err error) {
+	input := kinesis.GetShardIteratorInput{
+		StreamName:        &streamName,
+		ShardId:           &shardId,
+		ShardIteratorType: types.ShardIteratorType(pos.Type),
+		Timestamp:         pos.Timestamp,
+	}
+	if pos.SequenceNumber != "" {
+		input.StartingSequenceNumber = aws.String(pos.SequenceNumber)
+	}
+
+	out, err := svc.GetShardIterator(ctx, &input)
 	if err != nil {
-		log.Error(err)
+		return
 	}
-	eventStream = out.EventStream
+	iterator = out.ShardIterator
 
 	return
 }
@@ -0,0 +1,285 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// leaseDuration is how long a shard lease (or worker heartbeat) is
+// valid without being renewed. Leases are renewed every shardRefresh.
+const leaseDuration = 30 * time.Second
+
+// workerKeyPrefix prefixes the keys of worker heartbeat items.
+const workerKeyPrefix = "worker:"
+
+// kinesisLeases coordinates shard ownership between workers using a
+// DynamoDB table with an item per shard:
+//
+//	shardId    (S) partition key
+//	owner      (S) worker holding the lease
+//	expiresAt  (N) lease expiry in unix milliseconds
+//	checkpoint (S) last acknowledged sequence number
+//	finished   (BOOL) shard was closed and fully read
+//
+// and a heartbeat item per live worker, keyed `worker:<id>` with its
+// own expiresAt.
+//
+// A worker only reads the shards it holds a lease on. Leases of dead
+// workers expire and are taken over by others, and workers holding
+// more than their share of shards (out of all live workers, leasing
+// or not) release leases so they can be rebalanced.
+//
+// kinesisLeases holds no state of its own, it is safe for concurrent
+// use.
+type kinesisLeases struct {
+	svc    DynamoDBAPI
+	table  string
+	worker string
+}
+
+// leaseState is the state of the lease table as read by sync.
+type leaseState struct {
+	owned       map[string]bool   // shards leased by this worker
+	finished    map[string]bool   // finished shards
+	checkpoints map[string]string // checkpoints of all shards
+	workers     int               // live workers, including this one
+}
+
+func newKinesisLeases(svc DynamoDBAPI, table string, worker string) *kinesisLeases {
+	return &kinesisLeases{svc: svc, table: table, worker: worker}
+}
+
+// sync renews this worker's heartbeat and the leases it holds
+// (storing their `checkpoints`) and reads the state of the whole
+// table.
+func (l *kinesisLeases) sync(ctx context.Context, checkpoints map[string]string) (state leaseState, err error) {
+	err = l.heartbeat(ctx)
+	if err != nil {
+		return
+	}
+	items, err := l.scan(ctx)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	state = leaseState{
+		owned:       map[string]bool{},
+		finished:    map[string]bool{},
+		checkpoints: map[string]string{},
+	}
+	workers := map[string]bool{l.worker: true}
+	for _, item := range items {
+		id := stringValue(item["shardId"])
+		if strings.HasPrefix(id, workerKeyPrefix) {
+			if !leaseExpiry(item).Before(now) {
+				workers[strings.TrimPrefix(id, workerKeyPrefix)] = true
+			}
+			continue
+		}
+
+		if item["checkpoint"] != nil {
+			state.checkpoints[id] = stringValue(item["checkpoint"])
+		}
+		if finished, ok := item["finished"].(*types.AttributeValueMemberBOOL); ok && finished.Value {
+			state.finished[id] = true
+			continue
+		}
+		if item["owner"] == nil || leaseExpiry(item).Before(now) {
+			continue
+		}
+		if stringValue(item["owner"]) == l.worker {
+			renewed, err := l.renew(ctx, id, checkpoints[id])
+			if err != nil {
+				return state, err
+			}
+			state.owned[id] = renewed
+			if renewed && checkpoints[id] != "" {
+				state.checkpoints[id] = checkpoints[id]
+			}
+		}
+	}
+	state.workers = len(workers)
+
+	return
+}
+
+// target returns the number of shards a worker should own out of
+// `shards` readable shards shared by `workers` workers.
+func target(shards int, workers int) int {
+	if workers < 1 {
+		workers = 1
+	}
+	return (shards + workers - 1) / workers
+}
+
+// heartbeat records this worker as live.
+func (l *kinesisLeases) heartbeat(ctx context.Context) error {
+	_, err := l.svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &l.table,
+		Item: map[string]types.AttributeValue{
+			"shardId":   stringAttribute(workerKeyPrefix + l.worker),
+			"expiresAt": millis(time.Now().Add(leaseDuration)),
+		},
+	})
+	return err
+}
+
+// leave removes this worker's heartbeat, so that other workers
+// rebalance without waiting for it to expire.
+func (l *kinesisLeases) leave(ctx context.Context) error {
+	_, err := l.svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &l.table,
+		Key:       leaseKey(workerKeyPrefix + l.worker),
+	})
+	return err
+}
+
+// acquire takes the lease on shard `id` if it is free or expired.
+func (l *kinesisLeases) acquire(ctx context.Context, id string) (bool, error) {
+	now := time.Now()
+	_, err := l.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &l.table,
+		Key:                 leaseKey(id),
+		UpdateExpression:    aws.String("SET #owner = :worker, expiresAt = :expiresAt"),
+		ConditionExpression: aws.String("(attribute_not_exists(#owner) OR #owner = :worker OR expiresAt < :now) AND NOT finished = :true"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":worker":    stringAttribute(l.worker),
+			":expiresAt": millis(now.Add(leaseDuration)),
+			":now":       millis(now),
+			":true":      &types.AttributeValueMemberBOOL{Value: true},
+		},
+	})
+	return conditional(err)
+}
+
+// renew extends the lease on shard `id` and stores `checkpoint`.
+// It returns false if the lease was lost.
+func (l *kinesisLeases) renew(ctx context.Context, id string, checkpoint string) (bool, error) {
+	update := "SET expiresAt = :expiresAt"
+	values := map[string]types.AttributeValue{
+		":worker":    stringAttribute(l.worker),
+		":expiresAt": millis(time.Now().Add(leaseDuration)),
+	}
+	if checkpoint != "" {
+		update += ", checkpoint = :checkpoint"
+		values[":checkpoint"] = stringAttribute(checkpoint)
+	}
+
+	_, err := l.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 &l.table,
+		Key:                       leaseKey(id),
+		UpdateExpression:          &update,
+		ConditionExpression:       aws.String("#owner = :worker"),
+		ExpressionAttributeNames:  map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: values,
+	})
+	return conditional(err)
+}
+
+// release gives up the lease on shard `id`, storing `checkpoint`.
+func (l *kinesisLeases) release(ctx context.Context, id string, checkpoint string) error {
+	update := "REMOVE #owner"
+	values := map[string]types.AttributeValue{":worker": stringAttribute(l.worker)}
+	if checkpoint != "" {
+		update = "SET checkpoint = :checkpoint " + update
+		values[":checkpoint"] = stringAttribute(checkpoint)
+	}
+
+	_, err := l.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 &l.table,
+		Key:                       leaseKey(id),
+		UpdateExpression:          &update,
+		ConditionExpression:       aws.String("#owner = :worker"),
+		ExpressionAttributeNames:  map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: values,
+	})
+	_, err = conditional(err)
+	return err
+}
+
+// finish marks shard `id` as fully read so that its children can be
+// picked up by any worker.
+func (l *kinesisLeases) finish(ctx context.Context, id string) error {
+	_, err := l.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 &l.table,
+		Key:                       leaseKey(id),
+		UpdateExpression:          aws.String("SET finished = :true REMOVE #owner"),
+		ExpressionAttributeNames:  map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":true": &types.AttributeValueMemberBOOL{Value: true}},
+	})
+	return err
+}
+
+// scan reads all items of the lease table.
+func (l *kinesisLeases) scan(ctx context.Context) (items []map[string]types.AttributeValue, err error) {
+	pages := dynamodb.NewScanPaginator(l.svc, &dynamodb.ScanInput{
+		TableName:      &l.table,
+		ConsistentRead: aws.Bool(true),
+	})
+	for pages.HasMorePages() {
+		var out *dynamodb.ScanOutput
+		out, err = pages.NextPage(ctx)
+		if err != nil {
+			return
+		}
+		items = append(items, out.Items...)
+	}
+	return
+}
+
+func leaseKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"shardId": stringAttribute(id)}
+}
+
+func leaseExpiry(item map[string]types.AttributeValue) time.Time {
+	n, ok := item["expiresAt"].(*types.AttributeValueMemberN)
+	if !ok {
+		return time.Time{}
+	}
+	ms, _ := strconv.ParseInt(n.Value, 10, 64)
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func millis(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)}
+}
+
+func stringAttribute(s string) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: s}
+}
+
+// stringValue returns the value of a string attribute, "" if it is
+// missing or of another type.
+func stringValue(v types.AttributeValue) string {
+	if s, ok := v.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
+
+// conditional returns false (and no error) if `err` is a failed
+// condition check.
+func conditional(err error) (bool, error) {
+	if err == nil {
+		return true, nil
+	}
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,329 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	kinesistypes "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLeaseTable keeps lease items in memory. It understands the
+// update and condition expressions used by kinesisLeases only.
+type fakeLeaseTable struct {
+	DynamoDBAPI
+	sync.Mutex
+	items map[string]map[string]types.AttributeValue
+}
+
+func newFakeLeaseTable() *fakeLeaseTable {
+	return &fakeLeaseTable{items: map[string]map[string]types.AttributeValue{}}
+}
+
+func (f *fakeLeaseTable) Scan(_ context.Context, input *dynamodb.ScanInput, _ ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	out := &dynamodb.ScanOutput{}
+	for _, item := range f.items {
+		copied := map[string]types.AttributeValue{}
+		for k, v := range item {
+			copied[k] = v
+		}
+		out.Items = append(out.Items, copied)
+	}
+	return out, nil
+}
+
+func (f *fakeLeaseTable) PutItem(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.items[stringValue(input.Item["shardId"])] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeLeaseTable) DeleteItem(_ context.Context, input *dynamodb.DeleteItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.items, stringValue(input.Key["shardId"]))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (f *fakeLeaseTable) UpdateItem(_ context.Context, input *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	id := stringValue(input.Key["shardId"])
+	item := f.items[id]
+	if item == nil {
+		item = map[string]types.AttributeValue{"shardId": stringAttribute(id)}
+	}
+	values := input.ExpressionAttributeValues
+	owner := stringValue(item["owner"])
+	owned := owner != "" && owner == stringValue(values[":worker"])
+
+	ok := true
+	switch cond := aws.ToString(input.ConditionExpression); {
+	case strings.HasPrefix(cond, "(attribute_not_exists"):
+		now, _ := strconv.ParseInt(values[":now"].(*types.AttributeValueMemberN).Value, 10, 64)
+		expired := leaseExpiry(item).Before(time.Unix(0, now*int64(time.Millisecond)))
+		finished, _ := item["finished"].(*types.AttributeValueMemberBOOL)
+		ok = (owner == "" || owned || expired) && (finished == nil || !finished.Value)
+	case cond == "#owner = :worker":
+		ok = owned
+	}
+	if !ok {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("condition failed")}
+	}
+
+	update := *input.UpdateExpression
+	var remove string
+	if i := strings.Index(update, "REMOVE "); i >= 0 {
+		update, remove = update[:i], update[i+len("REMOVE "):]
+	}
+	update = strings.TrimPrefix(strings.TrimSpace(update), "SET ")
+	for _, assignment := range strings.Split(update, ",") {
+		if parts := strings.Split(assignment, " = "); len(parts) == 2 {
+			item[f.name(input, parts[0])] = values[strings.TrimSpace(parts[1])]
+		}
+	}
+	if remove != "" {
+		delete(item, f.name(input, remove))
+	}
+	f.items[id] = item
+
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeLeaseTable) name(input *dynamodb.UpdateItemInput, name string) string {
+	name = strings.TrimSpace(name)
+	if alias, ok := input.ExpressionAttributeNames[name]; ok {
+		return alias
+	}
+	return name
+}
+
+func (f *fakeLeaseTable) owner(id string) string {
+	f.Lock()
+	defer f.Unlock()
+	return stringValue(f.items[id]["owner"])
+}
+
+func TestTarget(t *testing.T) {
+	assert.Equal(t, 4, target(4, 1))
+	assert.Equal(t, 2, target(4, 2))
+	assert.Equal(t, 2, target(4, 3))
+	assert.Equal(t, 1, target(1, 3))
+	assert.Equal(t, 3, target(3, 0))
+}
+
+func TestKinesisLeases(t *testing.T) {
+	ctx := context.Background()
+	table := newFakeLeaseTable()
+	a := newKinesisLeases(table, "leases", "a")
+	b := newKinesisLeases(table, "leases", "b")
+
+	state, err := a.sync(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, state.workers)
+
+	acquired, err := a.acquire(ctx, "s1")
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, err = b.acquire(ctx, "s1")
+	assert.NoError(t, err)
+	assert.False(t, acquired, "held by a")
+
+	// b is live without holding any lease
+	state, err = b.sync(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, state.workers)
+	assert.Empty(t, state.owned)
+
+	// renewing stores the checkpoint
+	state, err = a.sync(ctx, map[string]string{"s1": "42"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, state.workers)
+	assert.Equal(t, map[string]bool{"s1": true}, state.owned)
+	assert.Equal(t, "42", state.checkpoints["s1"])
+
+	// a released lease can be taken by another worker
+	assert.NoError(t, a.release(ctx, "s1", "43"))
+	acquired, err = b.acquire(ctx, "s1")
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	state, err = b.sync(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "43", state.checkpoints["s1"])
+
+	// finished shards can't be acquired
+	assert.NoError(t, b.finish(ctx, "s1"))
+	acquired, err = a.acquire(ctx, "s1")
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+
+	// a worker that left isn't counted
+	assert.NoError(t, b.leave(ctx))
+	state, err = a.sync(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, state.workers)
+	assert.True(t, state.finished["s1"])
+}
+
+func TestKinesisLeases_ExpiredLeaseIsTakenOver(t *testing.T) {
+	ctx := context.Background()
+	table := newFakeLeaseTable()
+	a := newKinesisLeases(table, "leases", "a")
+	b := newKinesisLeases(table, "leases", "b")
+
+	acquired, _ := a.acquire(ctx, "s1")
+	assert.True(t, acquired)
+	a.heartbeat(ctx)
+
+	// a dies, its lease and heartbeat expire
+	table.items["s1"]["expiresAt"] = millis(time.Now().Add(-time.Second))
+	table.items[workerKeyPrefix+"a"]["expiresAt"] = millis(time.Now().Add(-time.Second))
+
+	state, err := b.sync(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, state.workers)
+	acquired, err = b.acquire(ctx, "s1")
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, "b", table.owner("s1"))
+}
+
+func TestShardCoordinator_Checkpoint(t *testing.T) {
+	ctx := context.Background()
+	table := newFakeLeaseTable()
+	c := newShardCoordinator(&Kinesis{}, make(chan message.Message), newKinesisLeases(table, "leases", "a"))
+	acquired, err := c.leases.acquire(ctx, "s1")
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	c.running["s1"] = make(chan bool)
+	c.checkpoints["s1"] = "42"
+
+	assert.NoError(t, (&Kinesis{shards: c}).Drain(ctx))
+	state, err := c.leases.sync(ctx, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "42", state.checkpoints["s1"])
+}
+
+func TestShardCoordinator_Rebalance(t *testing.T) {
+	client := &fakeKinesis{
+		records: map[string][]string{},
+		open:    map[string]bool{},
+	}
+	for _, id := range []string{"s1", "s2", "s3", "s4"} {
+		client.shards = append(client.shards, kinesistypes.Shard{ShardId: aws.String(id)})
+		client.open[id] = true
+	}
+	table := newFakeLeaseTable()
+	newWorker := func(id string) *shardCoordinator {
+		k := &Kinesis{
+			StreamARN: "arn:aws:kinesis:us-east-1:999999999999:stream/test",
+			Args:      map[string]string{"pollInterval": "1"},
+			client:    client,
+		}
+		return newShardCoordinator(k, make(chan message.Message), newKinesisLeases(table, "leases", id))
+	}
+	running := func(c *shardCoordinator) int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.running)
+	}
+
+	a := newWorker("a")
+	go a.run()
+	assert.Eventually(t, func() bool { return running(a) == 4 }, time.Second, 10*time.Millisecond)
+
+	// b joins without any lease, it is counted all the same
+	b := newWorker("b")
+	go b.run()
+	assert.Eventually(t, func() bool {
+		table.Lock()
+		defer table.Unlock()
+		return table.items[workerKeyPrefix+"b"] != nil
+	}, time.Second, 10*time.Millisecond)
+	a.sync()
+	assert.Equal(t, 2, running(a))
+	b.sync()
+	assert.Equal(t, 2, running(b))
+
+	// leaving releases leases and the heartbeat
+	b.stop()
+	for _, shard := range client.shards {
+		assert.NotEqual(t, "b", table.owner(*shard.ShardId))
+	}
+	a.sync()
+	assert.Equal(t, 4, running(a))
+	a.stop()
+}
+
+// iterators records the shard iterators requested from a fakeKinesis.
+type iterators struct {
+	*fakeKinesis
+	requested sync.Map // shard ID: *kinesis.GetShardIteratorInput
+}
+
+func (i *iterators) GetShardIterator(ctx context.Context, input *kinesis.GetShardIteratorInput, opts ...func(*kinesis.Options)) (*kinesis.GetShardIteratorOutput, error) {
+	i.requested.Store(*input.ShardId, input)
+	return i.fakeKinesis.GetShardIterator(ctx, input, opts...)
+}
+
+func TestShardCoordinator_TakeoverWithStartFrom(t *testing.T) {
+	ctx := context.Background()
+	client := &iterators{fakeKinesis: &fakeKinesis{records: map[string][]string{}, open: map[string]bool{}}}
+	for _, id := range []string{"s1", "s2"} {
+		client.shards = append(client.shards, kinesistypes.Shard{ShardId: aws.String(id)})
+		client.open[id] = true
+	}
+	table := newFakeLeaseTable()
+
+	// a checkpointed s1 and died
+	a := newShardCoordinator(&Kinesis{}, make(chan message.Message), newKinesisLeases(table, "leases", "a"))
+	acquired, err := a.leases.acquire(ctx, "s1")
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	a.running["s1"] = make(chan bool)
+	a.checkpoints["s1"] = "42"
+	assert.NoError(t, (&Kinesis{shards: a}).Drain(ctx))
+	table.items["s1"]["expiresAt"] = millis(time.Now().Add(-time.Second))
+
+	// b takes s1 over from its checkpoint, despite StartFrom
+	k := &Kinesis{
+		StreamARN: "arn:aws:kinesis:us-east-1:999999999999:stream/test",
+		Args:      map[string]string{"pollInterval": "1"},
+		client:    client,
+	}
+	assert.NoError(t, k.Seek(Position{Type: Earliest}))
+	b := newShardCoordinator(k, make(chan message.Message), newKinesisLeases(table, "leases", "b"))
+	go b.run()
+	defer b.stop()
+	requested := func(id string) *kinesis.GetShardIteratorInput {
+		var input interface{}
+		assert.Eventually(t, func() bool {
+			var ok bool
+			input, ok = client.requested.Load(id)
+			return ok
+		}, time.Second, time.Millisecond)
+		return input.(*kinesis.GetShardIteratorInput)
+	}
+	s1 := requested("s1")
+	assert.Equal(t, "b", table.owner("s1"))
+	assert.Equal(t, kinesistypes.ShardIteratorTypeAfterSequenceNumber, s1.ShardIteratorType)
+	assert.Equal(t, "42", aws.ToString(s1.StartingSequenceNumber))
+	// StartFrom applies to s2, which has no checkpoint
+	assert.Equal(t, kinesistypes.ShardIteratorTypeTrimHorizon, requested("s2").ShardIteratorType)
+}
@@ -0,0 +1,694 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+)
+
+// shardRefresh is how often shards (and leases) are synced.
+const shardRefresh = 10 * time.Second
+
+// position is where reading a shard starts.
+type position struct {
+	Type           string // a types.ShardIteratorType
+	SequenceNumber string
+	Timestamp      *time.Time // AT_TIMESTAMP
+}
+
+func (p position) startingPosition() *types.StartingPosition {
+	sp := &types.StartingPosition{Type: types.ShardIteratorType(p.Type), Timestamp: p.Timestamp}
+	if p.SequenceNumber != "" {
+		sp.SequenceNumber = aws.String(p.SequenceNumber)
+	}
+	return sp
+}
+
+func (p position) String() string {
+	switch {
+	case p.SequenceNumber != "":
+		return p.Type + " " + p.SequenceNumber
+	case p.Timestamp != nil:
+		return p.Type + " " + p.Timestamp.Format(time.RFC3339Nano)
+	}
+	return p.Type
+}
+
+func after(sequenceNumber string) position {
+	return position{Type: string(types.ShardIteratorTypeAfterSequenceNumber), SequenceNumber: sequenceNumber}
+}
+
+// shardCoordinator discovers the shards of a stream and runs a
+// consumer per shard, picking up child shards once their parents
+// are fully read. With leases, it only runs consumers for shards
+// this worker holds a lease on.
+//
+// Lease table calls are never made while holding mu, so consumers
+// pushing and acknowledging records aren't held up by DynamoDB.
+type shardCoordinator struct {
+	k                *Kinesis
+	channel          chan message.Message
+	leases           *kinesisLeases
+	mu               sync.Mutex
+	finished         map[string]bool           // shards read to their end
+	running          map[string]chan bool      // stop channels of running consumers
+	checkpoints      map[string]string         // last acknowledged sequence number per shard
+	leaseCheckpoints map[string]string         // checkpoints stored in the lease table
+	progress         map[string]*shardProgress // records in flight per running shard
+	lag              map[string]time.Duration  // MillisBehindLatest per running shard
+	wake             chan bool
+	done             chan bool
+	exited           chan bool // closed when run returns
+	wg               sync.WaitGroup
+}
+
+func newShardCoordinator(k *Kinesis, channel chan message.Message, leases *kinesisLeases) *shardCoordinator {
+	return &shardCoordinator{
+		k:                k,
+		channel:          channel,
+		leases:           leases,
+		finished:         map[string]bool{},
+		running:          map[string]chan bool{},
+		checkpoints:      map[string]string{},
+		leaseCheckpoints: map[string]string{},
+		progress:         map[string]*shardProgress{},
+		lag:              map[string]time.Duration{},
+		wake:             make(chan bool, 1),
+		done:             make(chan bool),
+		exited:           make(chan bool),
+	}
+}
+
+// run syncs shards every shardRefresh (or when a shard finishes)
+// until stop is called.
+func (c *shardCoordinator) run() {
+	defer close(c.exited)
+
+	for {
+		c.sync()
+
+		refresh := c.k.clock().NewTimer(shardRefresh)
+		select {
+		case <-c.done:
+			refresh.Stop()
+			return
+		case <-c.wake:
+		case <-refresh.C():
+		}
+		refresh.Stop()
+	}
+}
+
+// stop stops all consumers and releases held leases. It waits for
+// run to return first, so no consumer is started after it.
+func (c *shardCoordinator) stop() {
+	close(c.done)
+	<-c.exited
+
+	c.mu.Lock()
+	var stopped []string
+	for id, stop := range c.running {
+		close(stop)
+		delete(c.running, id)
+		stopped = append(stopped, id)
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+
+	if c.leases == nil {
+		return
+	}
+	checkpoints := c.snapshot()
+	for _, id := range stopped {
+		err := c.leases.release(c.k.context(), id, checkpoints[id])
+		if err != nil {
+			c.k.logger().Error("Kinesis: Failed to release lease: ", err)
+		}
+	}
+	err := c.leases.leave(c.k.context())
+	if err != nil {
+		c.k.logger().Error("Kinesis: Failed to remove worker heartbeat: ", err)
+	}
+}
+
+// checkpoint stores the checkpoints of running shards in the lease
+// table.
+func (c *shardCoordinator) checkpoint(ctx context.Context) (err error) {
+	if c.leases == nil {
+		return nil
+	}
+	c.mu.Lock()
+	checkpoints := map[string]string{}
+	for id := range c.running {
+		if seq := c.checkpoints[id]; seq != "" {
+			checkpoints[id] = seq
+		}
+	}
+	c.mu.Unlock()
+
+	for id, seq := range checkpoints {
+		_, rerr := c.leases.renew(ctx, id, seq)
+		if rerr != nil {
+			c.logger(id).Error("Kinesis: Failed to store checkpoint: ", rerr)
+			err = rerr
+		}
+	}
+	return
+}
+
+// setLag records how far behind the tip of shard `id` its consumer
+// reads, nil removes it.
+func (c *shardCoordinator) setLag(id string, millisBehindLatest *int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if millisBehindLatest == nil {
+		delete(c.lag, id)
+		return
+	}
+	c.lag[id] = time.Duration(*millisBehindLatest) * time.Millisecond
+}
+
+// maxLag returns the lag of the shard furthest behind.
+func (c *shardCoordinator) maxLag() (lag time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, l := range c.lag {
+		if l > lag {
+			lag = l
+		}
+	}
+	return
+}
+
+// snapshot returns a copy of the shards' checkpoints.
+func (c *shardCoordinator) snapshot() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	checkpoints := make(map[string]string, len(c.checkpoints))
+	for id, seq := range c.checkpoints {
+		checkpoints[id] = seq
+	}
+	return checkpoints
+}
+
+// sync lists the stream's shards and starts consumers for shards
+// that are ready to be read.
+func (c *shardCoordinator) sync() {
+	ctx := c.k.context()
+	shards, err := listShards(ctx, c.k.client, c.k.streamName())
+	if err != nil {
+		c.k.logger().Error("Kinesis: Failed to list shards: ", err)
+		return
+	}
+	if id, ok := c.k.Args["shardId"]; ok {
+		shards = filterShard(shards, id)
+	}
+
+	if c.leases == nil {
+		c.mu.Lock()
+		for _, shard := range readyShards(shards, c.finished, c.running) {
+			c.start(shard)
+		}
+		c.mu.Unlock()
+		return
+	}
+
+	state, err := c.leases.sync(ctx, c.snapshot())
+	if err != nil {
+		c.k.logger().Error("Kinesis: Failed to sync leases: ", err)
+		return
+	}
+
+	c.mu.Lock()
+	for id := range state.finished {
+		c.finished[id] = true
+	}
+	c.leaseCheckpoints = state.checkpoints
+
+	// stop consumers of lost leases
+	for id, stop := range c.running {
+		if !state.owned[id] {
+			c.logger(id).Warnf("Kinesis: Lost lease on shard %s, stopping consumer.", id)
+			close(stop)
+			delete(c.running, id)
+		}
+	}
+
+	target := target(len(readyShards(shards, c.finished, nil)), state.workers)
+	// shed leases above target so other workers can take them
+	shed := map[string]string{}
+	for id, stop := range c.running {
+		if len(c.running) <= target {
+			break
+		}
+		c.logger(id).Infof("Kinesis: Releasing lease on shard %s to rebalance.", id)
+		close(stop)
+		delete(c.running, id)
+		shed[id] = c.checkpoints[id]
+	}
+	need := target - len(c.running)
+	ready := readyShards(shards, c.finished, c.running)
+	c.mu.Unlock()
+
+	for id, checkpoint := range shed {
+		err := c.leases.release(ctx, id, checkpoint)
+		if err != nil {
+			c.logger(id).Error("Kinesis: Failed to release lease: ", err)
+		}
+	}
+
+	for _, shard := range ready {
+		if need <= 0 {
+			break
+		}
+		acquired, err := c.leases.acquire(ctx, *shard.ShardId)
+		if err != nil {
+			c.k.logger().Error("Kinesis: Failed to acquire lease: ", err)
+			continue
+		}
+		if !acquired {
+			continue
+		}
+		need--
+
+		c.mu.Lock()
+		c.start(shard)
+		c.mu.Unlock()
+	}
+}
+
+// logger returns the logger of the consumer of shard `id`.
+func (c *shardCoordinator) logger(id string) Logger {
+	return c.k.logger().WithField("shard", id)
+}
+
+// start runs a consumer for `shard`, c.mu must be held.
+func (c *shardCoordinator) start(shard types.Shard) {
+	id := *shard.ShardId
+	if _, ok := c.running[id]; ok {
+		return
+	}
+	c.consume(id, c.startingPosition(shard))
+}
+
+// consume runs a consumer for shard `id` reading from `pos`, c.mu
+// must be held.
+func (c *shardCoordinator) consume(id string, pos position) {
+	c.logger(id).Infof("Kinesis: Consuming shard %s from %s", id, pos)
+	stop := make(chan bool)
+	c.running[id] = stop
+	// records still in flight from a previous consumer only
+	// advance the checkpoint if they are later than it
+	c.progress[id] = &shardProgress{}
+	c.wg.Add(1)
+	if c.k.consumer != nil {
+		go c.subscribe(id, pos, stop)
+	} else {
+		go c.poll(id, pos, stop)
+	}
+}
+
+// startingPosition returns where to start reading `shard`: after
+// its checkpoint if there is one (the later of this run's and the
+// lease table's, e.g. when taking the shard over again after another
+// worker advanced it, or restarting), from the start if
+// it is the child of a shard that was read, the position the source
+// was seeked to or the `shardIterator` in Args. Seeking only applies
+// to shards without a checkpoint, so that restarts don't read the
+// stream again.
+func (c *shardCoordinator) startingPosition(shard types.Shard) position {
+	id := *shard.ShardId
+	seq := c.checkpoints[id]
+	if laterSequence(c.leaseCheckpoints[id], seq) {
+		seq = c.leaseCheckpoints[id]
+	}
+	if seq != "" {
+		return after(seq)
+	}
+	for _, parent := range []*string{shard.ParentShardId, shard.AdjacentParentShardId} {
+		if parent != nil && c.finished[*parent] {
+			return position{Type: string(types.ShardIteratorTypeTrimHorizon)}
+		}
+	}
+	if c.k.start != nil {
+		return seekPosition(*c.k.start, id)
+	}
+	return position{Type: c.k.Args["shardIterator"]}
+}
+
+// seekPosition returns where `pos` starts reading shard `id`. Shards
+// missing from AfterOffsets positions are read from the start.
+func seekPosition(pos Position, id string) position {
+	switch pos.Type {
+	case Latest:
+		return position{Type: string(types.ShardIteratorTypeLatest)}
+	case AtTimestamp:
+		return position{Type: string(types.ShardIteratorTypeAtTimestamp), Timestamp: aws.Time(pos.Timestamp)}
+	case AfterOffsets:
+		if seq := pos.Offsets[id]; seq != "" {
+			return after(seq)
+		}
+	}
+	return position{Type: string(types.ShardIteratorTypeTrimHorizon)}
+}
+
+// shardProgress tracks the records of a shard consumer that were
+// pushed into the channel but not yet acknowledged.
+type shardProgress struct {
+	records []*trackedRecord
+}
+
+type trackedRecord struct {
+	seq   string
+	acked bool
+}
+
+// push sends `rec` into the channel. The shard's checkpoint advances
+// past it once it and every record before it are acknowledged. It
+// returns false if the consumer was stopped.
+func (c *shardCoordinator) push(id string, rec types.Record, stop chan bool) bool {
+	c.logger(id).Trace(string(rec.Data))
+
+	c.mu.Lock()
+	progress := c.progress[id]
+	tracked := &trackedRecord{seq: *rec.SequenceNumber}
+	progress.records = append(progress.records, tracked)
+	c.mu.Unlock()
+
+	m := kinesisMessage(rec, id)
+	m.Ack = func(err error) { c.ack(id, progress, tracked, err) }
+
+	select {
+	case c.channel <- m:
+		return true
+	case <-stop:
+		// never handed over, it is the latest record
+		c.mu.Lock()
+		progress.records = progress.records[:len(progress.records)-1]
+		c.mu.Unlock()
+		return false
+	}
+}
+
+// ack records the acknowledgement of `rec` and advances the shard's
+// checkpoint to the highest contiguous acknowledged record. Records
+// that failed (and weren't quarantined) hold the checkpoint back and
+// the shard is read again from them (see retry).
+func (c *shardCoordinator) ack(id string, progress *shardProgress, rec *trackedRecord, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !message.Handled(err) {
+		c.retry(id, progress, rec, err)
+		return
+	}
+
+	rec.acked = true
+	n := 0
+	for n < len(progress.records) && progress.records[n].acked {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	seq := progress.records[n-1].seq
+	progress.records = append([]*trackedRecord{}, progress.records[n:]...)
+
+	if laterSequence(seq, c.checkpoints[id]) {
+		c.checkpoints[id] = seq
+	}
+}
+
+// retry restarts the consumer of shard `id` from the first record of
+// `progress` not acknowledged, once `rec` failed, so that the records
+// from it on are read again. `rec` is left unacknowledged: records
+// of the stopped consumer after it never advance the checkpoint, and
+// the new consumer tracks its records afresh. Records of consumers
+// that were stopped or restarted already are left to the next owner
+// of the shard. c.mu must be held.
+func (c *shardCoordinator) retry(id string, progress *shardProgress, rec *trackedRecord, err error) {
+	stop, ok := c.running[id]
+	if !ok || c.progress[id] != progress {
+		c.logger(id).Errorf("Kinesis: Record %s of shard %s failed, holding back its checkpoint: %s", rec.seq, id, err)
+		return
+	}
+
+	from := rec.seq
+	for _, r := range progress.records {
+		if !r.acked {
+			from = r.seq
+			break
+		}
+	}
+	c.logger(id).Errorf("Kinesis: Record %s of shard %s failed, reading the shard again from %s: %s", rec.seq, id, from, err)
+	close(stop)
+	delete(c.running, id)
+	c.consume(id, position{Type: string(types.ShardIteratorTypeAtSequenceNumber), SequenceNumber: from})
+}
+
+// drained reports whether every record pushed by the consumer of
+// shard `id` has been acknowledged, c.mu must be held.
+func (c *shardCoordinator) drained(id string) bool {
+	return len(c.progress[id].records) == 0
+}
+
+// finishDrained marks shard `id` as fully read if its consumer,
+// stopped by `stop`, is still running and every record it pushed has
+// been acknowledged.
+func (c *shardCoordinator) finishDrained(id string, stop chan bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running[id] != stop || !c.drained(id) {
+		return false
+	}
+	c.finished[id] = true
+	delete(c.running, id)
+	delete(c.progress, id)
+	return true
+}
+
+// laterSequence reports whether sequence number `a` comes after `b`.
+// Sequence numbers are decimal strings of up to 128 bits.
+func laterSequence(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// finish marks shard `id` as fully read and wakes the coordinator
+// up to pick up its children, once all of its records have been
+// acknowledged. It returns false if the consumer was stopped first,
+// e.g. restarted by retry.
+func (c *shardCoordinator) finish(id string, stop chan bool) bool {
+	for !c.finishDrained(id, stop) {
+		if !c.sleep(100*time.Millisecond, stop) {
+			return false
+		}
+	}
+	c.logger(id).Infof("Kinesis: Shard %s is closed and fully read.", id)
+
+	if c.leases != nil {
+		err := c.leases.finish(c.k.context(), id)
+		if err != nil {
+			c.logger(id).Error("Kinesis: Failed to mark lease finished: ", err)
+		}
+	}
+
+	select {
+	case c.wake <- true:
+	default:
+	}
+	return true
+}
+
+// subscribe reads shard `id` using enhanced fan-out. Subscriptions
+// expire after 5 minutes, so it resubscribes from the last
+// continuation sequence number until the shard is closed.
+func (c *shardCoordinator) subscribe(id string, pos position, stop chan bool) {
+	defer c.wg.Done()
+	defer c.setLag(id, nil)
+	ctx, cancel := stopContext(c.k.context(), stop)
+	defer cancel()
+
+	for {
+		stream, err := shardSubscribe(ctx, c.k.client, c.k.logger(), c.k.consumer, id, pos)
+		if err != nil {
+			if !c.sleep(5*time.Second, stop) {
+				return
+			}
+			continue
+		}
+
+		for e := range stream.Events() {
+			member, ok := e.(*types.SubscribeToShardEventStreamMemberSubscribeToShardEvent)
+			if !ok {
+				continue
+			}
+			event := member.Value
+			c.setLag(id, event.MillisBehindLatest)
+			for _, rec := range event.Records {
+				if !c.push(id, rec, stop) {
+					stream.Close()
+					return
+				}
+			}
+
+			if event.ContinuationSequenceNumber == nil {
+				stream.Close()
+				c.finish(id, stop)
+				return
+			}
+			pos = after(*event.ContinuationSequenceNumber)
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err := stream.Err(); err != nil {
+			c.logger(id).Warnf("Kinesis: Subscription to shard %s ended: %s", id, err)
+		}
+		c.logger(id).Debugf("Kinesis: Resubscribing to shard %s", id)
+	}
+}
+
+// poll reads shard `id` with GetRecords until the shard is closed.
+func (c *shardCoordinator) poll(id string, pos position, stop chan bool) {
+	defer c.wg.Done()
+	defer c.setLag(id, nil)
+	ctx, cancel := stopContext(c.k.context(), stop)
+	defer cancel()
+
+	interval := time.Second
+	if val, ok := c.k.Args["pollInterval"]; ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			interval = time.Duration(n) * time.Millisecond
+		}
+	}
+
+	var iterator *string
+	for {
+		if iterator == nil {
+			var err error
+			iterator, err = getShardIterator(ctx, c.k.client, c.k.streamName(), id, pos)
+			if err != nil {
+				c.logger(id).Error("Kinesis: GetShardIterator: ", err)
+				if !c.sleep(5*time.Second, stop) {
+					return
+				}
+				continue
+			}
+		}
+
+		out, err := c.k.client.GetRecords(ctx, &kinesis.GetRecordsInput{ShardIterator: iterator})
+		if err != nil {
+			var expired *types.ExpiredIteratorException
+			if errors.As(err, &expired) {
+				iterator = nil
+			} else {
+				c.logger(id).Warn("Kinesis: GetRecords: ", err)
+			}
+			if !c.sleep(interval, stop) {
+				return
+			}
+			continue
+		}
+
+		c.setLag(id, out.MillisBehindLatest)
+		for _, rec := range out.Records {
+			if !c.push(id, rec, stop) {
+				return
+			}
+			pos = after(*rec.SequenceNumber)
+		}
+
+		if out.NextShardIterator == nil {
+			c.finish(id, stop)
+			return
+		}
+		iterator = out.NextShardIterator
+
+		if !c.sleep(interval, stop) {
+			return
+		}
+	}
+}
+
+// stopContext returns a context derived from `parent` that is
+// cancelled when `stop` is closed.
+func stopContext(parent context.Context, stop chan bool) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// sleep waits for `d` on the connector's clock, it returns false if
+// `stop` is closed first.
+func (c *shardCoordinator) sleep(d time.Duration, stop chan bool) bool {
+	t := c.k.clock().NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-t.C():
+		return true
+	}
+}
+
+// readyShards returns the shards that are not finished nor running
+// and whose parents (if still known) are finished.
+func readyShards(shards []types.Shard, finished map[string]bool, running map[string]chan bool) (ready []types.Shard) {
+	known := map[string]bool{}
+	for _, shard := range shards {
+		known[*shard.ShardId] = true
+	}
+
+	for _, shard := range shards {
+		id := *shard.ShardId
+		if finished[id] {
+			continue
+		}
+		if _, ok := running[id]; ok {
+			continue
+		}
+
+		parentsDone := true
+		for _, parent := range []*string{shard.ParentShardId, shard.AdjacentParentShardId} {
+			if parent != nil && known[*parent] && !finished[*parent] {
+				parentsDone = false
+			}
+		}
+		if parentsDone {
+			ready = append(ready, shard)
+		}
+	}
+	return
+}
+
+func filterShard(shards []types.Shard, id string) []types.Shard {
+	for _, shard := range shards {
+		if *shard.ShardId == id {
+			return []types.Shard{shard}
+		}
+	}
+	return nil
+}
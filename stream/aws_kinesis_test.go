@@ -0,0 +1,282 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKinesisMessage(t *testing.T) {
+	arrival := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	rec := types.Record{
+		Data:                        []byte(`{"a":1}`),
+		PartitionKey:                aws.String("partition1"),
+		SequenceNumber:              aws.String("49590338271490256608559692538361571095921575989136588898"),
+		ApproximateArrivalTimestamp: &arrival,
+	}
+
+	m := kinesisMessage(rec, "shardId-000000000000")
+
+	assert.Equal(t, `{"a":1}`, m.Body)
+	assert.Equal(t, "shardId-000000000000", m.Metadata[MetaKinesisShardID])
+	assert.Equal(t, "partition1", m.Metadata[MetaKinesisPartitionKey])
+	assert.Equal(t, *rec.SequenceNumber, m.Metadata[MetaKinesisSequenceNumber])
+	assert.Equal(t, "2020-10-01T12:00:00Z", m.Metadata[MetaKinesisArrivalTimestamp])
+}
+
+// fakeKinesis serves shards from memory, every shard is read in a
+// single GetRecords call and closed shards return no next iterator.
+type fakeKinesis struct {
+	kinesisAPI
+	sync.Mutex
+	shards  []types.Shard
+	records map[string][]string
+	open    map[string]bool
+}
+
+func (f *fakeKinesis) ListShards(_ context.Context, input *kinesis.ListShardsInput, _ ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error) {
+	return &kinesis.ListShardsOutput{Shards: f.shards}, nil
+}
+
+func (f *fakeKinesis) GetShardIterator(_ context.Context, input *kinesis.GetShardIteratorInput, _ ...func(*kinesis.Options)) (*kinesis.GetShardIteratorOutput, error) {
+	return &kinesis.GetShardIteratorOutput{ShardIterator: input.ShardId}, nil
+}
+
+func (f *fakeKinesis) GetRecords(_ context.Context, input *kinesis.GetRecordsInput, _ ...func(*kinesis.Options)) (*kinesis.GetRecordsOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	id := *input.ShardIterator
+	out := &kinesis.GetRecordsOutput{}
+	for i, data := range f.records[id] {
+		out.Records = append(out.Records, types.Record{
+			Data:           []byte(data),
+			SequenceNumber: aws.String(fmt.Sprintf("%s-%d", id, i)),
+		})
+	}
+	f.records[id] = nil
+	if f.open[id] {
+		out.NextShardIterator = input.ShardIterator
+	}
+	return out, nil
+}
+
+func TestReadyShards(t *testing.T) {
+	shards := []types.Shard{
+		{ShardId: aws.String("parent")},
+		{ShardId: aws.String("child"), ParentShardId: aws.String("parent")},
+		{ShardId: aws.String("orphan"), ParentShardId: aws.String("expired")},
+	}
+
+	ready := readyShards(shards, map[string]bool{}, nil)
+	assert.Equal(t, []types.Shard{shards[0], shards[2]}, ready)
+
+	ready = readyShards(shards, map[string]bool{"parent": true}, map[string]chan bool{"orphan": nil})
+	assert.Equal(t, []types.Shard{shards[1]}, ready)
+}
+
+func TestKinesis_PollingResharding(t *testing.T) {
+	client := &fakeKinesis{
+		shards: []types.Shard{
+			{ShardId: aws.String("parent")},
+			{ShardId: aws.String("child-1"), ParentShardId: aws.String("parent")},
+			{ShardId: aws.String("child-2"), ParentShardId: aws.String("parent")},
+		},
+		records: map[string][]string{
+			"parent":  {"p1", "p2"},
+			"child-1": {"c1"},
+			"child-2": {"c2"},
+		},
+		open: map[string]bool{"child-1": true, "child-2": true},
+	}
+	src := &Kinesis{
+		StreamARN: "arn:aws:kinesis:us-east-1:999999999999:stream/test",
+		Args:      map[string]string{"mode": "polling", "pollInterval": "1"},
+		client:    client,
+	}
+
+	messages, err := src.ReadMessages()
+	assert.NoError(t, err)
+	defer src.Disconnect()
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		m := <-messages
+		got = append(got, m.Body)
+		m.Done(nil)
+	}
+
+	// parent records are read before its children's
+	assert.Equal(t, []string{"p1", "p2"}, got[:2])
+	assert.ElementsMatch(t, []string{"c1", "c2"}, got[2:])
+	assert.Equal(t, "test", src.streamName())
+}
+
+func TestShardCoordinator_CheckpointOnAck(t *testing.T) {
+	c := newShardCoordinator(&Kinesis{}, make(chan message.Message, 3), nil)
+	c.progress["s"] = &shardProgress{}
+	stop := make(chan bool)
+
+	for _, seq := range []string{"8", "9", "10"} {
+		assert.True(t, c.push("s", types.Record{SequenceNumber: aws.String(seq)}, stop))
+	}
+	m8, m9, m10 := <-c.channel, <-c.channel, <-c.channel
+	assert.Empty(t, c.checkpoints["s"])
+
+	// 9 and 10 are written before 8
+	m10.Done(nil)
+	m9.Done(nil)
+	assert.Empty(t, c.checkpoints["s"])
+	assert.False(t, c.drained("s"))
+
+	m8.Done(nil)
+	assert.Equal(t, "10", c.checkpoints["s"])
+	assert.True(t, c.drained("s"))
+
+	// a failed record holds the checkpoint back
+	assert.True(t, c.push("s", types.Record{SequenceNumber: aws.String("11")}, stop))
+	assert.True(t, c.push("s", types.Record{SequenceNumber: aws.String("12")}, stop))
+	m11, m12 := <-c.channel, <-c.channel
+	m11.Done(errors.New("write failed"))
+	m12.Done(nil)
+	assert.Equal(t, "10", c.checkpoints["s"])
+}
+
+// replayKinesis serves closed shards from memory, reading them from
+// the requested sequence number. Sequence numbers are the positions
+// of records in their shard, from 1.
+type replayKinesis struct {
+	kinesisAPI
+	shards  []types.Shard
+	records map[string][]string
+}
+
+func (f *replayKinesis) ListShards(_ context.Context, input *kinesis.ListShardsInput, _ ...func(*kinesis.Options)) (*kinesis.ListShardsOutput, error) {
+	return &kinesis.ListShardsOutput{Shards: f.shards}, nil
+}
+
+func (f *replayKinesis) GetShardIterator(_ context.Context, input *kinesis.GetShardIteratorInput, _ ...func(*kinesis.Options)) (*kinesis.GetShardIteratorOutput, error) {
+	from := 0
+	if input.StartingSequenceNumber != nil {
+		from, _ = strconv.Atoi(*input.StartingSequenceNumber)
+		if input.ShardIteratorType == types.ShardIteratorTypeAtSequenceNumber {
+			from--
+		}
+	}
+	return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(fmt.Sprintf("%s/%d", *input.ShardId, from))}, nil
+}
+
+func (f *replayKinesis) GetRecords(_ context.Context, input *kinesis.GetRecordsInput, _ ...func(*kinesis.Options)) (*kinesis.GetRecordsOutput, error) {
+	parts := strings.Split(*input.ShardIterator, "/")
+	from, _ := strconv.Atoi(parts[1])
+	out := &kinesis.GetRecordsOutput{}
+	for i, data := range f.records[parts[0]][from:] {
+		out.Records = append(out.Records, types.Record{
+			Data:           []byte(data),
+			SequenceNumber: aws.String(strconv.Itoa(from + i + 1)),
+		})
+	}
+	return out, nil
+}
+
+func TestShardCoordinator_RetryFailedRecord(t *testing.T) {
+	client := &replayKinesis{
+		shards: []types.Shard{
+			{ShardId: aws.String("parent")},
+			{ShardId: aws.String("child"), ParentShardId: aws.String("parent")},
+		},
+		records: map[string][]string{
+			"parent": {"p1", "p2", "p3"},
+			"child":  {"c1"},
+		},
+	}
+	k := &Kinesis{
+		StreamARN: "arn:aws:kinesis:us-east-1:999999999999:stream/test",
+		Args:      map[string]string{"shardIterator": string(types.ShardIteratorTypeTrimHorizon), "pollInterval": "1"},
+		client:    client,
+	}
+	c := newShardCoordinator(k, make(chan message.Message), nil)
+	go c.run()
+	defer c.stop()
+	checkpoint := func() string {
+		return c.snapshot()["parent"]
+	}
+
+	p1, p2, p3 := receive(t, c.channel), receive(t, c.channel), receive(t, c.channel)
+	assert.Equal(t, []string{"p1", "p2", "p3"}, []string{p1.Body, p2.Body, p3.Body})
+	p1.Done(nil)
+	// the shard is read again from the failed record
+	p2.Done(errors.New("write failed"))
+	p3.Done(nil)
+	assert.Equal(t, "1", checkpoint())
+
+	p2, p3 = receive(t, c.channel), receive(t, c.channel)
+	assert.Equal(t, []string{"p2", "p3"}, []string{p2.Body, p3.Body})
+	p2.Done(nil)
+	p3.Done(nil)
+	assert.Equal(t, "3", checkpoint())
+
+	// the parent is finished and hands over to its child
+	c1 := receive(t, c.channel)
+	assert.Equal(t, "c1", c1.Body)
+	c1.Done(nil)
+}
+
+func TestShardCoordinator_Seek(t *testing.T) {
+	k := &Kinesis{Args: map[string]string{"shardIterator": string(types.ShardIteratorTypeLatest)}}
+	c := newShardCoordinator(k, make(chan message.Message), nil)
+	c.leaseCheckpoints["s1"] = "5"
+	shard := func(id string) types.Shard { return types.Shard{ShardId: aws.String(id)} }
+
+	assert.Equal(t, after("5"), c.startingPosition(shard("s1")))
+	assert.Equal(t, position{Type: string(types.ShardIteratorTypeLatest)}, c.startingPosition(shard("s2")))
+
+	// seeking applies to shards without a checkpoint
+	ts := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, k.Seek(Position{Type: AtTimestamp, Timestamp: ts}))
+	assert.Equal(t, position{Type: string(types.ShardIteratorTypeAtTimestamp), Timestamp: &ts}, c.startingPosition(shard("s2")))
+	assert.Equal(t, after("5"), c.startingPosition(shard("s1")))
+
+	assert.NoError(t, k.Seek(Position{Type: AfterOffsets, Offsets: map[string]string{"s1": "9", "s2": "7"}}))
+	assert.Equal(t, after("7"), c.startingPosition(shard("s2")))
+	assert.Equal(t, position{Type: string(types.ShardIteratorTypeTrimHorizon)}, c.startingPosition(shard("s3")))
+
+	// nor to the checkpoints of this run
+	c.checkpoints["s2"] = "12"
+	assert.Equal(t, after("12"), c.startingPosition(shard("s2")))
+
+	// the later of this run's and the lease table's checkpoints wins,
+	// e.g. once another worker advanced a shard taken over again
+	c.checkpoints["s1"] = "3"
+	assert.Equal(t, after("5"), c.startingPosition(shard("s1")))
+	c.leaseCheckpoints["s2"] = "9"
+	assert.Equal(t, after("12"), c.startingPosition(shard("s2")))
+
+	assert.Error(t, k.Seek(Position{}))
+}
+
+func TestKinesis_Lag(t *testing.T) {
+	src := &Kinesis{}
+	assert.Equal(t, time.Duration(0), src.Lag())
+
+	src.shards = newShardCoordinator(src, nil, nil)
+	src.shards.setLag("a", aws.Int64(1500))
+	src.shards.setLag("b", aws.Int64(200))
+	assert.Equal(t, 1500*time.Millisecond, src.Lag())
+	src.shards.setLag("a", nil)
+	assert.Equal(t, 200*time.Millisecond, src.Lag())
+}
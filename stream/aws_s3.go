@@ -1,19 +1,29 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
 package stream
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 
-	"bytes"
-	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	swissIO "github.com/abstractpaper/swissarmy/io"
-	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	log "github.com/sirupsen/logrus"
 )
 
 type S3 struct {
@@ -21,8 +31,33 @@ type S3 struct {
 	BucketName string
 	Config     *S3Config
 	Args       map[string]string
-	Sess       *session.Session
+	AWSConfig  *aws.Config      // defaults to the default credential chain
+	Sess       *session.Session // v1 session used if AWSConfig isn't set
+	RoleARN    string           // role assumed to write to the bucket
+	ExternalID string           // external ID of RoleARN, if required
+	Manifest   CommitManifest   // defaults to Config.ManifestPath or ManifestTable
 	buffer     *buffer
+	kms        kmsAPI
+	cipher     *bufferCipher
+	compressor *compressor
+	commitMu   sync.Mutex // guards the buffer files
+	committed  time.Time  // time of the last commit (of the unsplit buffer)
+	splits     map[string]*split
+	uploading  map[string]bool
+	uploadNow  chan bool
+	failed     chan error    // see Failed
+	failMu     sync.Mutex    // guards failure
+	failure    error         // the last error of the collector or uploader
+	done       chan struct{} // closed by Disconnect
+	cfg        aws.Config
+	clocked
+	logged
+}
+
+// s3Uploader is the part of the S3 upload manager used by the
+// connector.
+type s3Uploader interface {
+	Upload(ctx context.Context, input *s3.PutObjectInput, opts ...func(*manager.Uploader)) (*manager.UploadOutput, error)
 }
 
 type S3Config struct {
@@ -30,14 +65,118 @@ type S3Config struct {
 	CommitFileSize int
 	CommitDuration int
 	UploadEvery    int
+	// Files are streamed to S3 in multipart uploads of PartSize MB
+	// parts (defaults to 5, the minimum), uploading
+	// UploadConcurrency parts of a file at once (defaults to 5) and
+	// MaxInFlightUploads files at once (defaults to 1).
+	PartSize           int
+	UploadConcurrency  int
+	MaxInFlightUploads int
+	// Objects are encrypted by S3 with ServerSideEncryption, "AES256"
+	// (SSE-S3) or "aws:kms" (SSE-KMS) with the SSEKMSKeyID key ARN
+	// (defaults to the AWS managed key).
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+	// With BufferKMSKeyID, files buffered on local disk are encrypted
+	// with a data key of this KMS key (see bufferCipher).
+	BufferKMSKeyID string
+	// BufferCompression "lz4" compresses messages buffered on local
+	// disk, trading CPU for disk space; CommitFileSize is then the
+	// compressed size. Compressed or encrypted buffers must be
+	// uploaded before either option changes.
+	BufferCompression string
+	// With a commit manifest, kept in the local ManifestPath file or
+	// the DynamoDB ManifestTable table, object keys end with the hash
+	// of their content and uploads are recorded, so that restarts
+	// never upload a file twice (see CommitManifest).
+	ManifestPath  string
+	ManifestTable string
+	// With SplitField, messages are buffered in a file per value of
+	// this JSON field (a dotted path, e.g. tenant.id), uploaded under
+	// <Folder>/<value>/ (see split). Splits are committed on their
+	// own size and duration, and at most MaxOpenSplits (defaults to
+	// 100) are buffered at once: the least recently written split is
+	// committed to open another.
+	SplitField    string
+	MaxOpenSplits int
+	// The buffer path holds at most MaxBufferSize KB and
+	// MaxBufferFiles committed files waiting for their upload (both
+	// optional), e.g. while S3 is unreachable. OnBufferFull is the
+	// policy applied to messages that don't fit: BufferFullBlock
+	// (default), BufferFullDropOldest or BufferFullDropNew. A warning
+	// is logged from 80% of the quota (see BufferStats).
+	MaxBufferSize  int
+	MaxBufferFiles int
+	OnBufferFull   string
 }
 
 type buffer struct {
 	path     string
 	messages chan string
+	queued   int64 // messages not appended to the buffer yet
+	usage    bufferUsage
 }
 
 func (s *S3) Connect() (err error) {
+	if s.Config.PartSize < 5 {
+		s.Config.PartSize = 5
+	}
+	if s.Config.UploadConcurrency < 1 {
+		s.Config.UploadConcurrency = manager.DefaultUploadConcurrency
+	}
+	if s.Config.MaxInFlightUploads < 1 {
+		s.Config.MaxInFlightUploads = 1
+	}
+	if s.Config.MaxOpenSplits < 1 {
+		s.Config.MaxOpenSplits = 100
+	}
+	switch s.Config.ServerSideEncryption {
+	case "", string(types.ServerSideEncryptionAes256), string(types.ServerSideEncryptionAwsKms):
+	default:
+		return errors.New("S3: ServerSideEncryption must be AES256 or aws:kms")
+	}
+	if s.Config.SSEKMSKeyID != "" && s.Config.ServerSideEncryption != string(types.ServerSideEncryptionAwsKms) {
+		return errors.New("S3: SSEKMSKeyID requires aws:kms ServerSideEncryption")
+	}
+	switch s.Config.OnBufferFull {
+	case "", BufferFullBlock, BufferFullDropOldest, BufferFullDropNew:
+	default:
+		return errors.New("S3: OnBufferFull must be block, dropOldest or dropNew")
+	}
+	switch s.Config.BufferCompression {
+	case "":
+	case "lz4":
+		s.compressor = &compressor{}
+	default:
+		return errors.New("S3: BufferCompression must be lz4")
+	}
+	ctx := context.Background()
+	s.cfg, err = connectorConfig(ctx, s.AWSConfig, s.Sess, s.Region, s.RoleARN, s.ExternalID)
+	if err != nil {
+		return
+	}
+	if s.Config.BufferKMSKeyID != "" {
+		if s.kms == nil {
+			s.kms = kms.NewFromConfig(s.cfg)
+		}
+		s.cipher, err = newBufferCipher(ctx, s.kms, s.Config.BufferKMSKeyID)
+		if err != nil {
+			s.logger().Error("S3: Failed to generate buffer data key: ", err)
+			return
+		}
+	}
+
+	if s.Manifest == nil {
+		switch {
+		case s.Config.ManifestPath != "" && s.Config.ManifestTable != "":
+			return errors.New("S3: ManifestPath and ManifestTable are exclusive")
+		case s.Config.ManifestPath != "":
+			s.Manifest = &FileManifest{Path: s.Config.ManifestPath}
+		case s.Config.ManifestTable != "":
+			s.Manifest = &DynamoDBManifest{Table: s.Config.ManifestTable, Svc: dynamodb.NewFromConfig(s.cfg)}
+		}
+	}
+
 	s.buffer = &buffer{}
 	// overwrite buffer.path with Args, if specified
 	if val, ok := s.Args["bufferPath"]; ok {
@@ -49,6 +188,13 @@ func (s *S3) Connect() (err error) {
 
 	// create messages channel
 	s.buffer.messages = make(chan string, 1000)
+	s.uploadNow = make(chan bool, 1)
+	s.failed = make(chan error, 1)
+	// forget the error of a previous connection
+	s.failMu.Lock()
+	s.failure = nil
+	s.failMu.Unlock()
+	s.done = make(chan struct{})
 	// create a collector
 	go s.collector()
 	// create an uploader
@@ -59,36 +205,162 @@ func (s *S3) Connect() (err error) {
 
 func (s *S3) Disconnect() (err error) {
 	close(s.buffer.messages)
+	close(s.done)
 	return
 }
 
+// Write queues `message` for the collector, or returns the last error
+// of the collector or uploader if they failed.
 func (s *S3) Write(message string) (err error) {
+	err = s.err()
+	if err != nil {
+		return
+	}
+	atomic.AddInt64(&s.buffer.queued, 1)
 	s.buffer.messages <- message
 	return
 }
 
+// Resources returns the bucket, the manifest table and the buffer's
+// KMS key, if any.
+func (s *S3) Resources() []Resource {
+	bucket := Resource{Kind: "aws_s3_bucket", Name: s.BucketName, Region: s.Region}
+	resources := []Resource{bucket}
+	if s.Config == nil {
+		return resources
+	}
+	if s.Config.ServerSideEncryption != "" {
+		bucket.Settings = map[string]string{"sse_algorithm": s.Config.ServerSideEncryption}
+		if s.Config.SSEKMSKeyID != "" {
+			bucket.Settings["kms_master_key_id"] = s.Config.SSEKMSKeyID
+		}
+		resources[0] = bucket
+	}
+	if s.Config.ManifestTable != "" {
+		resources = append(resources, Resource{
+			Kind:     "aws_dynamodb_table",
+			Name:     s.Config.ManifestTable,
+			Region:   s.Region,
+			Settings: map[string]string{"hash_key": "key", "hash_key_type": "S"},
+		})
+	}
+	if s.Config.BufferKMSKeyID != "" {
+		resources = append(resources, Resource{Kind: "aws_kms_key", Name: s.Config.BufferKMSKeyID, Region: s.Region})
+	}
+	return resources
+}
+
+// Capabilities of S3: writes aren't confirmed, Write returns once the
+// message is queued for the collector (lost if the process crashes)
+// and a full buffer may drop it (see S3Config.OnBufferFull). Files
+// are uploaded once with a commit manifest, but messages redelivered
+// by the source are written again.
+func (s *S3) Capabilities() Capabilities {
+	return Capabilities{Batching: true, Ordering: true}
+}
+
 func (s *S3) Info() {
-	log.Info("S3.BucketName: ", s.BucketName)
-	log.Infof("S3Config.CommitFileSize: every %d KB\n", s.Config.CommitFileSize)
-	log.Infof("S3Config.CommitDuration: every %d minutes\n", s.Config.CommitDuration)
-	log.Infof("S3Config.UploadEvery: %d seconds\n", s.Config.UploadEvery)
+	s.logger().Info("S3.BucketName: ", s.BucketName)
+	s.logger().Infof("S3Config.CommitFileSize: every %d KB\n", s.Config.CommitFileSize)
+	s.logger().Infof("S3Config.CommitDuration: every %d minutes\n", s.Config.CommitDuration)
+	s.logger().Infof("S3Config.UploadEvery: %d seconds\n", s.Config.UploadEvery)
+	s.logger().Infof("S3Config.PartSize: %d MB, %d part(s) and %d file(s) at once\n", s.Config.PartSize, s.Config.UploadConcurrency, s.Config.MaxInFlightUploads)
+	if s.Config.ServerSideEncryption != "" {
+		s.logger().Infof("S3Config.ServerSideEncryption: %s %s\n", s.Config.ServerSideEncryption, s.Config.SSEKMSKeyID)
+	}
+	if s.Config.BufferKMSKeyID != "" {
+		s.logger().Info("S3Config.BufferKMSKeyID: ", s.Config.BufferKMSKeyID)
+	}
+	if s.Config.BufferCompression != "" {
+		s.logger().Info("S3Config.BufferCompression: ", s.Config.BufferCompression)
+	}
+	if s.Config.ManifestPath != "" {
+		s.logger().Info("S3Config.ManifestPath: ", s.Config.ManifestPath)
+	}
+	if s.Config.ManifestTable != "" {
+		s.logger().Info("S3Config.ManifestTable: ", s.Config.ManifestTable)
+	}
+	if s.Config.SplitField != "" {
+		s.logger().Infof("S3Config.SplitField: %s, up to %d open splits\n", s.Config.SplitField, s.Config.MaxOpenSplits)
+	}
+	if s.quotaEnabled() {
+		s.logger().Infof("S3Config.MaxBufferSize: %d KB, MaxBufferFiles: %d, OnBufferFull: %s\n", s.Config.MaxBufferSize, s.Config.MaxBufferFiles, s.Config.OnBufferFull)
+	}
+}
+
+// Failed receives the errors of the collector and the uploader, which
+// keep retrying meanwhile (see Failing).
+func (s *S3) Failed() <-chan error {
+	return s.failed
+}
+
+// fail logs `err` and reports it to Failed.
+func (s *S3) fail(err error) {
+	s.logger().Error("S3: ", err)
+	s.failMu.Lock()
+	s.failure = err
+	s.failMu.Unlock()
+	select {
+	case s.failed <- err:
+	default:
+	}
+}
+
+// err returns the last error reported to Failed since Connect, if
+// any.
+func (s *S3) err() error {
+	s.failMu.Lock()
+	defer s.failMu.Unlock()
+	return s.failure
+}
+
+// disconnected reports whether Disconnect was called.
+func (s *S3) disconnected() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// CompressionStats returns the bytes of messages compressed into the
+// buffer, with BufferCompression.
+func (s *S3) CompressionStats() CompressionStats {
+	if s.compressor == nil {
+		return CompressionStats{}
+	}
+	return s.compressor.snapshot()
 }
 
 // Receive data on messages channel and write them
 // to buf.path.
 //
-// Files are aggregated on a 5 minutes interval.
+// Files are aggregated on a 5 minutes interval. Errors are reported
+// to Failed.
 func (s *S3) collector() {
 	// create buf.path if it doesn't exist
 	err := os.MkdirAll(s.buffer.path, os.ModePerm)
 	if err != nil {
-		log.Fatal(err)
+		s.fail(err)
+		return
+	}
+	s.commitMu.Lock()
+	s.committed = s.clock().Now()
+	err = s.restoreSplits()
+	s.commitMu.Unlock()
+	if err != nil {
+		s.fail(err)
+		return
+	}
+	err = s.scanBuffer()
+	if err != nil {
+		s.fail(err)
+		return
 	}
-
-	bufferPath := filepath.Join(s.buffer.path, "buffer")
 
 	// read messages from channel and write them to a file
-	go func(bufferPath string) {
+	go func() {
 		for {
 			// read buf.messages channel
 			msg, ok := <-s.buffer.messages
@@ -96,120 +368,360 @@ func (s *S3) collector() {
 				return // channel closed
 			}
 
+			if !s.reserve(msg) {
+				// dropped, the buffer is full
+				atomic.AddInt64(&s.buffer.queued, -1)
+				continue
+			}
 			// append (or create) to buffer
-			err = swissIO.AppendFile(bufferPath, msg+"\n")
+			s.commitMu.Lock()
+			err := s.bufferMessage(msg)
+			s.commitMu.Unlock()
 			if err != nil {
-				log.Fatal(err)
+				s.fail(fmt.Errorf("failed to buffer a message: %w", err))
+				atomic.AddInt64(&s.buffer.queued, -1)
+				continue
 			}
+			atomic.AddInt64(&s.buffer.usage.size, int64(len(msg))+1)
+			s.checkQuota()
+			atomic.AddInt64(&s.buffer.queued, -1)
 		}
-	}(bufferPath)
+	}()
 
 	// roll files
-	go func(bufferPath string) {
-		timeCommitted := time.Now()
-		for {
-			// check if file 'buffer' exists
-			exists, err := swissIO.FileExists(bufferPath)
+	go func() {
+		for !s.disconnected() {
+			committed, err := s.commit(false)
 			if err != nil {
-				log.Fatal(err)
+				s.fail(err)
 			}
-
-			if !exists {
+			if s.quotaEnabled() {
+				err = s.scanBuffer()
+				if err != nil {
+					s.fail(err)
+				}
+			}
+			if !committed {
 				// one second interval loop
-				time.Sleep(1 * time.Second)
-				continue
+				sleepOn(s.clock(), 1*time.Second)
 			}
+		}
+	}()
+}
 
-			// commit buffer if it's >= Config.CommitFileSize KB
-			// or time elapsed >= Config.CommitDuration minutes
-			info, err := os.Stat(bufferPath)
-			fileSizeReached := info.Size() >= int64(s.Config.CommitFileSize)*1024
-			durationElapsed := int(time.Since(timeCommitted).Minutes()) >= s.Config.CommitDuration
-			if fileSizeReached || durationElapsed {
-				// current point in time
-				currentTime := time.Now()
-				// organize buffer by creating a folder for each day
-				commitDir := filepath.Join(s.buffer.path, currentTime.Format("2006-01-02"))
-				// create the day directory if it doesn't exists
-				err := os.MkdirAll(commitDir, os.ModePerm)
-				if err != nil {
-					log.Fatal(err)
-				}
+// bufferMessage appends `msg` to the buffer, or to the buffer of its
+// split with Config.SplitField. It's called with commitMu held.
+func (s *S3) bufferMessage(msg string) error {
+	dir := s.buffer.path
+	if s.Config.SplitField != "" {
+		name := s.splitOf(msg)
+		err := s.openSplit(name)
+		if err != nil {
+			return err
+		}
+		dir = s.splitDir(name)
+	}
+	return s.appendBuffer(filepath.Join(dir, "buffer"), msg)
+}
 
-				// rename buffer to the current time in nanoseconds
-				commitPath := filepath.Join(commitDir, currentTime.Format("150405.000000000"))
-				err = os.Rename(bufferPath, commitPath)
-				if err != nil {
-					log.Fatal(err)
-				}
+// commit renames the buffer, and the buffer of every split, to a
+// file named after the current time, to be uploaded, if its size is
+// >= Config.CommitFileSize KB or Config.CommitDuration minutes
+// elapsed since its last commit, or `force` is set. It returns false
+// if there was nothing to commit.
+func (s *S3) commit(force bool) (bool, error) {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
 
-				timeCommitted = time.Now()
-				log.Info("Committed file ", commitPath)
-			}
+	committed, err := s.commitBuffer(s.buffer.path, &s.committed, force)
+	if err != nil {
+		return committed, err
+	}
+	for name, sp := range s.splits {
+		ok, err := s.commitBuffer(s.splitDir(name), &sp.committed, force)
+		if err != nil {
+			return committed, err
+		}
+		if ok {
+			// closed until its next message
+			delete(s.splits, name)
+			committed = true
 		}
-	}(bufferPath)
+	}
+	return committed, nil
 }
 
-// Scan buf.path for files and upload them once found.
-func (s *S3) uploader() {
-	uploader := s3manager.NewUploader(s.Sess)
+// commitBuffer commits the buffer in `dir` (see commit), `last`
+// being the time of its last commit. It's called with commitMu held.
+func (s *S3) commitBuffer(dir string, last *time.Time, force bool) (bool, error) {
+	bufferPath := filepath.Join(dir, "buffer")
+	info, err := os.Stat(bufferPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	fileSizeReached := info.Size() >= int64(s.Config.CommitFileSize)*1024
+	durationElapsed := int(s.clock().Now().Sub(*last).Minutes()) >= s.Config.CommitDuration
+	if !(force || fileSizeReached || durationElapsed) {
+		return false, nil
+	}
+
+	// current point in time
+	currentTime := s.clock().Now()
+	// organize buffer by creating a folder for each day
+	commitDir := filepath.Join(dir, currentTime.Format("2006-01-02"))
+	// create the day directory if it doesn't exists
+	err = os.MkdirAll(commitDir, os.ModePerm)
+	if err != nil {
+		return false, err
+	}
+
+	// rename buffer to the current time in nanoseconds
+	commitPath := filepath.Join(commitDir, currentTime.Format("150405.000000000"))
+	err = os.Rename(bufferPath, commitPath)
+	if err != nil {
+		return false, err
+	}
+	if s.cipher != nil {
+		s.cipher.forget(bufferPath)
+	}
+	atomic.AddInt64(&s.buffer.usage.files, 1)
+
+	*last = s.clock().Now()
+	s.logger().Info("Committed file ", commitPath)
+	return true, nil
+}
+
+// Flush commits the buffers now and wakes the uploader up, without
+// waiting for the upload. Messages still queued for the collector
+// are committed with the next file.
+func (s *S3) Flush() error {
+	_, err := s.commit(true)
+	select {
+	case s.uploadNow <- true:
+	default:
+	}
+	return err
+}
+
+// Drain commits the buffer once the messages queued for the
+// collector are appended to it, and waits for the committed files to
+// be uploaded, e.g. before the process exits.
+func (s *S3) Drain(ctx context.Context) error {
+	ticker := s.clock().NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.buffer.queued) > 0 {
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	err := s.Flush()
+	if err != nil {
+		return err
+	}
 	for {
+		files, err := s.committedFiles()
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return fmt.Errorf("S3: %d file(s) not uploaded: %w", len(files), ctx.Err())
+		}
+	}
+}
+
+// committedFiles returns the files of buf.path to upload.
+func (s *S3) committedFiles() (files []string, err error) {
+	err = filepath.Walk(s.buffer.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			s.logger().Error("Walkpath error: ", err)
+			return err
+		}
+		if info.IsDir() || info.Name() == "buffer" || strings.HasSuffix(info.Name(), erasingSuffix) {
+			return nil
+		}
+
+		files = append(files, path)
+
+		return nil
+	})
+	return
+}
+
+// Scan buf.path for files and upload them once found. Errors are
+// reported to Failed.
+func (s *S3) uploader() {
+	ctx := context.Background()
+	uploader := manager.NewUploader(s3.NewFromConfig(s.cfg), func(u *manager.Uploader) {
+		u.PartSize = int64(s.Config.PartSize) * 1024 * 1024
+		u.Concurrency = s.Config.UploadConcurrency
+	})
+	for !s.disconnected() {
 		// check if folder exists
 		exists, err := swissIO.DirExists(s.buffer.path)
 		if err != nil {
-			log.Fatal(err)
+			s.fail(err)
 		}
 
 		if !exists {
 			// one second interval loop
-			time.Sleep(1 * time.Second)
+			sleepOn(s.clock(), 1*time.Second)
 			continue
 		}
 
-		var files []string
-		err = filepath.Walk(s.buffer.path, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				log.Error("Walkpath error: ", err)
-				return err
-			}
-			if info.IsDir() || info.Name() == "buffer" {
-				return nil
-			}
+		files, err := s.committedFiles()
+		if err != nil {
+			// retried on the next scan
+			s.fail(err)
+		}
+		// upload up to Config.MaxInFlightUploads files at once
+		slots := make(chan bool, s.Config.MaxInFlightUploads)
+		var wg sync.WaitGroup
+		for _, file := range files {
+			slots <- true
+			wg.Add(1)
+			go func(file string) {
+				defer wg.Done()
+				s.upload(ctx, uploader, file)
+				<-slots
+			}(file)
+		}
+		wg.Wait()
 
-			files = append(files, path)
+		// wait for UploadEvery or a flush
+		t := s.clock().NewTimer(time.Duration(s.Config.UploadEvery) * time.Second)
+		select {
+		case <-t.C():
+		case <-s.uploadNow:
+			t.Stop()
+		case <-s.done:
+			t.Stop()
+		}
+	}
+}
 
-			return nil
-		})
+// upload streams `file` to S3 and removes it. Files that fail to
+// upload are kept and retried on the next scan of the uploader.
+//
+// With a manifest, the key ends with the hash of the file, files
+// already recorded are removed without being uploaded again and files
+// are removed once recorded only.
+func (s *S3) upload(ctx context.Context, uploader s3Uploader, file string) {
+	if !s.startUpload(file) {
+		// erased meanwhile
+		return
+	}
+	defer s.endUpload(file)
+
+	// truncate buf.path (S3 path)
+	key := splitKey(strings.Replace(file, s.buffer.path, "", 1))
+	// prefix it with Config.Folder
+	key = filepath.Join(s.Config.Folder, key)
+	var hash string
+	if s.Manifest != nil {
+		var err error
+		hash, err = fileHash(file)
 		if err != nil {
-			panic(err)
+			s.logger().Error("S3: Couldn't read file ", file, ": ", err)
+			return // retried on the next scan
 		}
-		for _, file := range files {
-			// truncate buf.path (S3 path)
-			key := strings.Replace(file, s.buffer.path, "", 1)
-			// prefix it with Config.Folder
-			key = filepath.Join(s.Config.Folder, key)
-			// read file
-			body, err := ioutil.ReadFile(file)
-			if err != nil {
-				log.Fatalln("Couldn't read file: ", file)
-			}
-			// upload the file to S3
-			_, err = uploader.Upload(&s3manager.UploadInput{
-				Bucket: aws.String(s.BucketName),
-				Key:    aws.String(key),
-				Body:   bytes.NewReader(body),
-			})
-			if err != nil {
-				log.Fatalln("Failed to upload file: ", file)
-			}
-			// file uploaded successfully
-			err = os.Remove(file)
-			if err != nil {
-				log.Errorln("Couldn't remove file: ", file)
-			}
+		key += "-" + hash[:16]
 
-			log.Info("Uploaded ", key)
+		recorded, ok, err := s.Manifest.Uploaded(key)
+		if err != nil {
+			s.logger().WithField("key", key).Error("S3: Couldn't read the commit manifest: ", err)
+			return // retried on the next scan
+		}
+		if ok && recorded == hash {
+			// uploaded before a restart
+			s.remove(file)
+			s.logger().WithField("key", key).Info("Already uploaded ", key)
+			return
 		}
-		time.Sleep(time.Duration(s.Config.UploadEvery) * time.Second)
+	}
+	// open file, it's read part by part rather than in memory
+	f, err := os.Open(file)
+	if err != nil {
+		s.logger().Error("S3: Couldn't read file ", file, ": ", err)
+		return // retried on the next scan
+	}
+	var body io.Reader = f
+	if s.cipher != nil || s.compressor != nil {
+		// decode the file while it's uploaded
+		r, w := io.Pipe()
+		go func() {
+			w.CloseWithError(decodeBuffer(ctx, w, f, s.cipher))
+		}()
+		defer r.Close()
+		body = r
+	}
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(s.BucketName),
+		Key:                  aws.String(key),
+		Body:                 body,
+		ServerSideEncryption: types.ServerSideEncryption(s.Config.ServerSideEncryption),
+	}
+	if s.Config.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.Config.SSEKMSKeyID)
+	}
+	// upload the file to S3
+	_, err = uploader.Upload(ctx, input)
+	f.Close()
+	if err != nil {
+		// kept in the buffer, within its quota, until S3 is reachable
+		s.logger().WithField("key", key).Error("S3: Failed to upload ", file, ": ", err)
+		return // retried on the next scan
+	}
+	if s.Manifest != nil {
+		err = s.Manifest.Record(key, hash)
+		if err != nil {
+			// keep the file, uploading it again overwrites the object
+			s.logger().WithField("key", key).Error("S3: Couldn't record the upload of ", key, ": ", err)
+			return
+		}
+	}
+	// file uploaded successfully
+	s.remove(file)
+
+	s.logger().WithField("key", key).Info("Uploaded ", key)
+}
+
+// startUpload marks `file` as uploading, so that it isn't rewritten
+// by Erase, unless it doesn't exist anymore.
+func (s *S3) startUpload(file string) bool {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+	if _, err := os.Stat(file); err != nil {
+		return false
+	}
+	if s.uploading == nil {
+		s.uploading = map[string]bool{}
+	}
+	s.uploading[file] = true
+	return true
+}
+
+func (s *S3) endUpload(file string) {
+	s.commitMu.Lock()
+	delete(s.uploading, file)
+	s.commitMu.Unlock()
+}
+
+// remove removes an uploaded file.
+func (s *S3) remove(file string) {
+	err := os.Remove(file)
+	if err != nil {
+		s.logger().Error("Couldn't remove file: ", file)
 	}
 }
@@ -0,0 +1,211 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	swissIO "github.com/abstractpaper/swissarmy/io"
+)
+
+// Buffered files are newline-delimited messages, unless they're
+// compressed (S3Config.BufferCompression) or encrypted
+// (S3Config.BufferKMSKeyID), in which case messages are appended as
+// frames:
+//
+//	'k' <length> <encrypted data key>
+//	'm' <length> <nonce> <ciphertext>
+//	'c' <length> <nonce> <ciphertext of an LZ4 block>
+//	'p' <length> <message>
+//	'z' <length> <LZ4 block>
+//
+// Lengths are big-endian uint32. Messages that don't shrink when
+// compressed are kept as is.
+const (
+	frameKey          = 'k'
+	frameEncrypted    = 'm'
+	frameEncryptedLZ4 = 'c'
+	framePlain        = 'p'
+	frameLZ4          = 'z'
+)
+
+// appendBuffer appends `msg` to the buffered file at `path`.
+func (s *S3) appendBuffer(path string, msg string) (err error) {
+	if s.cipher == nil && s.compressor == nil {
+		return swissIO.AppendFile(path, msg+"\n")
+	}
+
+	data, compressed := []byte(msg), false
+	if s.compressor != nil {
+		data, compressed = s.compressor.compress(data)
+	}
+	if s.cipher != nil {
+		return s.cipher.append(path, data, compressed)
+	}
+	kind := byte(framePlain)
+	if compressed {
+		kind = frameLZ4
+	}
+	return swissIO.AppendFile(path, string(appendFrame(nil, kind, data)))
+}
+
+// decodeBuffer writes the messages of the framed file `r` to `w`, one
+// per line. `c` decrypts encrypted frames, with `ctx` for KMS calls.
+func decodeBuffer(ctx context.Context, w io.Writer, r io.Reader, c *bufferCipher) error {
+	reader := bufio.NewReader(r)
+	var aead cipher.AEAD
+	// data keys of files written before a restart differ
+	var keys map[string]cipher.AEAD
+	if c != nil {
+		keys = map[string]cipher.AEAD{string(c.encryptedKey): c.aead}
+	}
+	for {
+		kind, payload, err := readFrame(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var msg []byte
+		switch kind {
+		case frameKey:
+			if c == nil {
+				return errors.New("S3: encrypted buffer file without BufferKMSKeyID")
+			}
+			aead, err = c.key(ctx, keys, payload)
+			if err != nil {
+				return err
+			}
+			continue
+		case frameEncrypted, frameEncryptedLZ4:
+			msg, err = openFrame(aead, payload)
+			if err == nil && kind == frameEncryptedLZ4 {
+				msg, err = decompress(msg)
+			}
+		case framePlain:
+			msg = payload
+		case frameLZ4:
+			msg, err = decompress(payload)
+		default:
+			return fmt.Errorf("S3: unknown buffer frame %q", kind)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(msg, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// erasingSuffix is the suffix of buffered files being rewritten by
+// Erase, which aren't uploaded.
+const erasingSuffix = ".erasing"
+
+// Erase rewrites the buffered files without the messages `erased`
+// matches (see Erasable). Files being uploaded are left as they are,
+// as are messages not yet appended to the buffer.
+func (s *S3) Erase(erased func(body string) bool) (n int, err error) {
+	if s.buffer == nil {
+		return 0, nil
+	}
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	var files []string
+	err = filepath.Walk(s.buffer.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || s.uploading[path] || strings.HasSuffix(path, erasingSuffix) {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		erasedN, ferr := s.eraseFile(file, erased)
+		n += erasedN
+		if ferr != nil {
+			return n, ferr
+		}
+	}
+	return
+}
+
+// eraseFile rewrites the buffered file at `path` without the
+// messages `erased` matches, and removes it if none is left.
+func (s *S3) eraseFile(path string, erased func(body string) bool) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if s.cipher != nil || s.compressor != nil {
+		var out bytes.Buffer
+		err = decodeBuffer(context.Background(), &out, bytes.NewReader(data), s.cipher)
+		if err != nil {
+			return 0, err
+		}
+		data = out.Bytes()
+	}
+
+	var kept []string
+	n := 0
+	for _, msg := range strings.SplitAfter(string(data), "\n") {
+		msg = strings.TrimSuffix(msg, "\n")
+		if msg == "" {
+			continue
+		}
+		if erased(msg) {
+			n++
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if len(kept) == 0 {
+		return n, os.Remove(path)
+	}
+
+	// rewrite then rename, the file is never partially erased
+	tmp := path + erasingSuffix
+	os.Remove(tmp)
+	if s.cipher != nil {
+		// the file may reuse the inode of a removed one, make sure
+		// its data key is written
+		s.cipher.forget(tmp)
+	}
+	for _, msg := range kept {
+		err = s.appendBuffer(tmp, msg)
+		if err != nil {
+			os.Remove(tmp)
+			return 0, err
+		}
+	}
+	if s.cipher != nil {
+		s.cipher.forget(tmp)
+	}
+	return n, os.Rename(tmp, path)
+}
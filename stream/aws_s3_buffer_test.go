@@ -0,0 +1,208 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3_BufferCompression(t *testing.T) {
+	large := strings.Repeat(`{"event":"page_view"}`, 50)
+	messages := []string{large, `{"a":1}`, large + "!"}
+	want := strings.Join(messages, "\n") + "\n"
+
+	for name, s := range map[string]*S3{
+		"plain":      {},
+		"lz4":        {compressor: &compressor{}},
+		"encrypted":  {cipher: mustCipher(t)},
+		"lz4+cipher": {compressor: &compressor{}, cipher: mustCipher(t)},
+	} {
+		dir, _ := ioutil.TempDir("", "s3")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "buffer")
+		for _, m := range messages {
+			assert.NoError(t, s.appendBuffer(path, m), name)
+		}
+
+		data, _ := ioutil.ReadFile(path)
+		if s.compressor == nil && s.cipher == nil {
+			assert.Equal(t, want, string(data), name)
+			continue
+		}
+		if s.compressor != nil {
+			assert.Less(t, len(data), len(want), name)
+			assert.Greater(t, s.CompressionStats().Ratio(), 1.0, name)
+		}
+
+		var out bytes.Buffer
+		assert.NoError(t, decodeBuffer(context.Background(), &out, bytes.NewReader(data), s.cipher), name)
+		assert.Equal(t, want, out.String(), name)
+	}
+}
+
+func TestDecodeBuffer_Errors(t *testing.T) {
+	var out bytes.Buffer
+	// encrypted frames need the cipher
+	c := mustCipher(t)
+	dir, _ := ioutil.TempDir("", "s3")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "buffer")
+	assert.NoError(t, c.append(path, []byte("a"), false))
+	data, _ := ioutil.ReadFile(path)
+	assert.Error(t, decodeBuffer(context.Background(), &out, bytes.NewReader(data), nil))
+
+	assert.Error(t, decodeBuffer(context.Background(), &out, bytes.NewReader(appendFrame(nil, 'x', []byte("a"))), nil))
+	assert.Error(t, decodeBuffer(context.Background(), &out, bytes.NewReader(appendFrame(nil, frameLZ4, []byte("a"))), nil))
+}
+
+func TestS3_Erase(t *testing.T) {
+	erased := func(body string) bool { return strings.Contains(body, `"u1"`) }
+	for name, s := range map[string]*S3{
+		"plain":      {},
+		"lz4+cipher": {compressor: &compressor{}, cipher: mustCipher(t)},
+	} {
+		dir, _ := ioutil.TempDir("", "s3")
+		defer os.RemoveAll(dir)
+		s.buffer = &buffer{path: dir}
+		buffered := filepath.Join(dir, "buffer")
+		committed := filepath.Join(dir, "2020-10-01", "150405.000000000")
+		uploading := filepath.Join(dir, "2020-10-01", "140405.000000000")
+		os.MkdirAll(filepath.Dir(committed), os.ModePerm)
+		for _, m := range []string{`{"id":"u1"}`, `{"id":"u2"}`} {
+			assert.NoError(t, s.appendBuffer(buffered, m), name)
+			assert.NoError(t, s.appendBuffer(uploading, m), name)
+		}
+		assert.NoError(t, s.appendBuffer(committed, `{"id":"u1","n":2}`), name)
+		s.uploading = map[string]bool{uploading: true}
+
+		n, err := s.Erase(erased)
+		assert.NoError(t, err, name)
+		assert.Equal(t, 2, n, name)
+
+		data, _ := ioutil.ReadFile(buffered)
+		var out bytes.Buffer
+		if s.cipher == nil {
+			out.Write(data)
+		} else {
+			assert.NoError(t, decodeBuffer(context.Background(), &out, bytes.NewReader(data), s.cipher), name)
+		}
+		assert.Equal(t, `{"id":"u2"}`+"\n", out.String(), name)
+		// emptied files are removed, uploading ones are left
+		assert.NoFileExists(t, committed, name)
+		assert.FileExists(t, uploading, name)
+		assert.False(t, s.startUpload(committed), name)
+	}
+}
+
+func mustCipher(t *testing.T) *bufferCipher {
+	c, err := newBufferCipher(context.Background(), fakeKMS{}, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestS3_Flush(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "s3")
+	defer os.RemoveAll(dir)
+	clock := NewFakeClock(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC))
+	s := &S3{
+		Config:    &S3Config{CommitFileSize: 1024, CommitDuration: 5},
+		buffer:    &buffer{path: dir},
+		uploadNow: make(chan bool, 1),
+	}
+	s.SetClock(clock)
+	s.committed = clock.Now()
+
+	// nothing to commit
+	committed, err := s.commit(false)
+	assert.NoError(t, err)
+	assert.False(t, committed)
+
+	assert.NoError(t, s.appendBuffer(filepath.Join(dir, "buffer"), "a"))
+	committed, err = s.commit(false)
+	assert.NoError(t, err)
+	assert.False(t, committed)
+
+	assert.NoError(t, s.Flush())
+	assert.FileExists(t, filepath.Join(dir, "2020-10-01", "120000.000000000"))
+	assert.NoFileExists(t, filepath.Join(dir, "buffer"))
+	assert.Len(t, s.uploadNow, 1)
+}
+
+func TestS3_Drain(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "s3")
+	defer os.RemoveAll(dir)
+	clock := NewFakeClock(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC))
+	s := &S3{
+		Config:    &S3Config{CommitFileSize: 1024, CommitDuration: 5},
+		buffer:    &buffer{path: dir},
+		uploadNow: make(chan bool, 1),
+	}
+	s.SetClock(clock)
+	assert.NoError(t, s.appendBuffer(filepath.Join(dir, "buffer"), "a"))
+
+	// the committed file isn't uploaded in time
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := s.Drain(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	assert.FileExists(t, filepath.Join(dir, "2020-10-01", "120000.000000000"))
+
+	// the uploader removes uploaded files, Drain polls on the clock
+	go func() {
+		for clock.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		os.Remove(filepath.Join(dir, "2020-10-01", "120000.000000000"))
+		clock.Advance(100 * time.Millisecond)
+	}()
+	assert.NoError(t, s.Drain(context.Background()))
+}
+
+func TestS3_Failed(t *testing.T) {
+	// the buffer path can't be created
+	file := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, ioutil.WriteFile(file, nil, 0644))
+	s := &S3{
+		Config: &S3Config{},
+		buffer: &buffer{path: filepath.Join(file, "buffer"), messages: make(chan string, 1)},
+		failed: make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+	go s.collector()
+	assert.Error(t, <-s.Failed())
+	assert.Error(t, s.Write("a"))
+	assert.Implements(t, (*Failing)(nil), s)
+
+	// reconnecting clears the error
+	s = &S3{
+		Region:    "us-east-1",
+		AWSConfig: &aws.Config{Region: "us-east-1"},
+		Config:    &S3Config{CommitFileSize: 1024, CommitDuration: 5, UploadEvery: 60},
+		Args:      map[string]string{"bufferPath": t.TempDir()},
+		failure:   errors.New("listing failed"),
+	}
+	assert.NoError(t, s.Connect())
+	defer s.Disconnect()
+	assert.NoError(t, s.Write("a"))
+}
+
+func TestS3_Guarantees(t *testing.T) {
+	// messages queued for the collector aren't confirmed
+	list := &Redis{Args: map[string]string{"mode": "list"}}
+	p := &Pipeline{Source: list, Destination: &S3{Config: &S3Config{}}}
+	assert.Equal(t, Guarantees{Delivery: AtMostOnce, Ordered: true}, p.Guarantees())
+}
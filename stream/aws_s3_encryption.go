@@ -0,0 +1,137 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// Buffered files are encrypted with envelope encryption: a data key
+// is generated by KMS once, its encrypted copy is written to every
+// buffered file before messages, which are appended as AES-GCM
+// frames (see aws_s3_buffer.go). Files are decrypted while streamed
+// to S3, decrypting data keys with KMS.
+
+// bufferCipher encrypts messages with a KMS data key.
+type bufferCipher struct {
+	kms          kmsAPI
+	encryptedKey []byte
+	aead         cipher.AEAD
+	files        map[string]os.FileInfo // files appended to, by path
+}
+
+// kmsAPI is the part of the KMS client used by bufferCipher.
+type kmsAPI interface {
+	GenerateDataKey(ctx context.Context, input *kms.GenerateDataKeyInput, opts ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, input *kms.DecryptInput, opts ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// newBufferCipher generates a data key with `keyID`.
+func newBufferCipher(ctx context.Context, svc kmsAPI, keyID string) (*bufferCipher, error) {
+	out, err := svc.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(keyID),
+		KeySpec: types.DataKeySpecAes256,
+	})
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(out.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferCipher{kms: svc, encryptedKey: out.CiphertextBlob, aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// append encrypts `msg` to the file at `path`, preceded by the
+// encrypted data key in files it hasn't appended to yet (e.g. a
+// buffer left by a previous process). `compressed` messages are LZ4
+// blocks.
+func (c *bufferCipher) append(path string, msg []byte, compressed bool) (err error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	// stat the open file, the buffer may be renamed meanwhile
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	var data []byte
+	if last, ok := c.files[path]; !ok || !os.SameFile(info, last) {
+		data = appendFrame(data, frameKey, c.encryptedKey)
+		if c.files == nil {
+			c.files = map[string]os.FileInfo{}
+		}
+		c.files[path] = info
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return
+	}
+	kind := byte(frameEncrypted)
+	if compressed {
+		kind = frameEncryptedLZ4
+	}
+	data = appendFrame(data, kind, c.aead.Seal(nonce, nonce, msg, nil))
+	_, err = f.Write(data)
+	return
+}
+
+// forget forgets the file at `path`, e.g. once it is committed, so
+// that the data key is written to the next file created there even
+// if it reuses its inode.
+func (c *bufferCipher) forget(path string) {
+	delete(c.files, path)
+}
+
+// openFrame decrypts `payload`, a message frame, with `aead`.
+func openFrame(aead cipher.AEAD, payload []byte) ([]byte, error) {
+	if aead == nil || len(payload) < aead.NonceSize() {
+		return nil, errors.New("S3: corrupted buffer file")
+	}
+	size := aead.NonceSize()
+	return aead.Open(nil, payload[:size], payload[size:], nil)
+}
+
+// key returns the AEAD of an encrypted data key, decrypting it with
+// KMS unless it's cached in `keys`.
+func (c *bufferCipher) key(ctx context.Context, keys map[string]cipher.AEAD, encryptedKey []byte) (cipher.AEAD, error) {
+	if aead, ok := keys[string(encryptedKey)]; ok {
+		return aead, nil
+	}
+	out, err := c.kms.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: encryptedKey})
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(out.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	keys[string(encryptedKey)] = aead
+	return aead, nil
+}
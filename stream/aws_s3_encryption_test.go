@@ -0,0 +1,72 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKMS "encrypts" data keys by prefixing them.
+type fakeKMS struct{}
+
+func (fakeKMS) GenerateDataKey(_ context.Context, in *kms.GenerateDataKeyInput, _ ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &kms.GenerateDataKeyOutput{
+		Plaintext:      key,
+		CiphertextBlob: append([]byte(*in.KeyId+":"), key...),
+	}, nil
+}
+
+func (fakeKMS) Decrypt(_ context.Context, in *kms.DecryptInput, _ ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	return &kms.DecryptOutput{Plaintext: bytes.SplitN(in.CiphertextBlob, []byte(":"), 2)[1]}, nil
+}
+
+func TestBufferCipher(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "s3")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "buffer")
+
+	c, err := newBufferCipher(context.Background(), fakeKMS{}, "key")
+	assert.NoError(t, err)
+	assert.NoError(t, c.append(path, []byte(`{"a":1}`), false))
+	assert.NoError(t, c.append(path, []byte(`{"a":2}`), false))
+
+	data, _ := ioutil.ReadFile(path)
+	assert.NotContains(t, string(data), `{"a":1}`)
+
+	// a restarted process appends with another data key
+	restarted, err := newBufferCipher(context.Background(), fakeKMS{}, "key")
+	assert.NoError(t, err)
+	assert.NoError(t, restarted.append(path, []byte(`{"a":3}`), false))
+
+	var out bytes.Buffer
+	f, _ := os.Open(path)
+	defer f.Close()
+	assert.NoError(t, decodeBuffer(context.Background(), &out, f, c))
+	assert.Equal(t, "{\"a\":1}\n{\"a\":2}\n{\"a\":3}\n", out.String())
+
+	// truncated files fail
+	out.Reset()
+	err = decodeBuffer(context.Background(), &out, bytes.NewReader(data[:len(data)-1]), c)
+	assert.Error(t, err)
+}
+
+func TestS3_ServerSideEncryption(t *testing.T) {
+	s := &S3{Config: &S3Config{ServerSideEncryption: "aws:kms", SSEKMSKeyID: "arn:aws:kms:us-east-1:1:key/1"}, Args: map[string]string{"bufferPath": "/nonexistent"}}
+	s.Config.ServerSideEncryption = "rot13"
+	assert.Error(t, s.Connect())
+
+	s.Config.ServerSideEncryption = "AES256"
+	assert.Error(t, s.Connect())
+}
@@ -0,0 +1,192 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// CommitManifest records the objects uploaded by an S3 destination
+// with the hash of their content, so that a file uploaded before a
+// crash (and not removed) isn't uploaded again after a restart.
+//
+// With a manifest, object keys end with the hash of their content:
+//
+//	<Folder>/2020-10-01/150405.000000000-<hash>
+//
+// so an upload retried after a crash always lands on the same key,
+// and a new file never overwrites another.
+type CommitManifest interface {
+	// Uploaded returns the hash recorded for `key`, if any.
+	Uploaded(key string) (hash string, ok bool, err error)
+	// Record records that `key` was uploaded with content `hash`.
+	Record(key string, hash string) error
+}
+
+// manifestEntry is a line of a FileManifest.
+type manifestEntry struct {
+	Key  string    `json:"key"`
+	Hash string    `json:"hash"`
+	Time time.Time `json:"time"`
+}
+
+// FileManifest is a CommitManifest kept in a local NDJSON file, one
+// line per uploaded object. It must be on durable storage, next to
+// the buffered files.
+type FileManifest struct {
+	Path   string
+	once   sync.Once
+	mu     sync.Mutex
+	hashes map[string]string
+	err    error
+}
+
+// load reads the entries of the manifest, once.
+func (m *FileManifest) load() error {
+	m.once.Do(func() {
+		m.hashes = map[string]string{}
+		f, err := os.Open(m.Path)
+		if os.IsNotExist(err) {
+			return
+		}
+		if err != nil {
+			m.err = err
+			return
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e manifestEntry
+			if json.Unmarshal(scanner.Bytes(), &e) != nil {
+				continue // partially written line
+			}
+			m.hashes[e.Key] = e.Hash
+		}
+		m.err = scanner.Err()
+	})
+	return m.err
+}
+
+func (m *FileManifest) Uploaded(key string) (string, bool, error) {
+	err := m.load()
+	if err != nil {
+		return "", false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash, ok := m.hashes[key]
+	return hash, ok, nil
+}
+
+// Record appends an entry and syncs the file.
+func (m *FileManifest) Record(key string, hash string) (err error) {
+	err = m.load()
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(manifestEntry{Key: key, Hash: hash, Time: time.Now().UTC()})
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err = os.MkdirAll(filepath.Dir(m.Path), os.ModePerm)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		m.hashes[key] = hash
+	}
+	return
+}
+
+// DynamoDBManifest is a CommitManifest kept in a DynamoDB table with
+// an item per uploaded object:
+//
+//	key        (S) partition key
+//	hash       (S) SHA-256 of the content
+//	uploadedAt (N) unix milliseconds
+//
+// It can be shared by the instances of a destination, and read by
+// downstream jobs to find complete objects.
+type DynamoDBManifest struct {
+	Table string
+	Svc   DynamoDBAPI
+}
+
+// DynamoDBAPI is the part of the DynamoDB client used by manifests
+// and Kinesis leases.
+type DynamoDBAPI interface {
+	GetItem(ctx context.Context, input *dynamodb.GetItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, input *dynamodb.PutItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, input *dynamodb.UpdateItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(ctx context.Context, input *dynamodb.DeleteItemInput, opts ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	Scan(ctx context.Context, input *dynamodb.ScanInput, opts ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+}
+
+func (m *DynamoDBManifest) Uploaded(key string) (string, bool, error) {
+	out, err := m.Svc.GetItem(context.Background(), &dynamodb.GetItemInput{
+		TableName:      &m.Table,
+		Key:            map[string]types.AttributeValue{"key": stringAttribute(key)},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || out.Item == nil || out.Item["hash"] == nil {
+		return "", false, err
+	}
+	return stringValue(out.Item["hash"]), true, nil
+}
+
+func (m *DynamoDBManifest) Record(key string, hash string) error {
+	_, err := m.Svc.PutItem(context.Background(), &dynamodb.PutItemInput{
+		TableName: &m.Table,
+		Item: map[string]types.AttributeValue{
+			"key":        stringAttribute(key),
+			"hash":       stringAttribute(hash),
+			"uploadedAt": millis(time.Now()),
+		},
+	})
+	return err
+}
+
+// fileHash returns the hex SHA-256 of the content of `file`.
+func fileHash(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,100 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeUploader keeps uploaded objects in memory.
+type fakeUploader struct {
+	sync.Mutex
+	objects map[string]string
+	uploads int
+}
+
+func (f *fakeUploader) Upload(_ context.Context, input *s3.PutObjectInput, _ ...func(*manager.Uploader)) (*manager.UploadOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.objects[*input.Key] = string(data)
+	f.uploads++
+	return &manager.UploadOutput{}, nil
+}
+
+// fakeManifestTable keeps manifest items in memory.
+type fakeManifestTable struct {
+	DynamoDBAPI
+	items map[string]map[string]types.AttributeValue
+}
+
+func (f *fakeManifestTable) GetItem(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.items[stringValue(input.Key["key"])]}, nil
+}
+
+func (f *fakeManifestTable) PutItem(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.items[stringValue(input.Item["key"])] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestS3_Manifest(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "s3")
+	defer os.RemoveAll(dir)
+
+	for name, manifest := range map[string]func() CommitManifest{
+		"file": func() CommitManifest {
+			// reloaded from disk, as after a restart
+			return &FileManifest{Path: filepath.Join(dir, "manifest.ndjson")}
+		},
+		"dynamodb": func() func() CommitManifest {
+			table := &fakeManifestTable{items: map[string]map[string]types.AttributeValue{}}
+			return func() CommitManifest { return &DynamoDBManifest{Table: "manifest", Svc: table} }
+		}(),
+	} {
+		bufferPath := filepath.Join(dir, name) + "/"
+		file := filepath.Join(bufferPath, "2020-10-01", "150405.000000000")
+		commit := func(content string) {
+			os.MkdirAll(filepath.Dir(file), os.ModePerm)
+			ioutil.WriteFile(file, []byte(content), 0644)
+		}
+		uploader := &fakeUploader{objects: map[string]string{}}
+		s := &S3{Config: &S3Config{Folder: "events"}, buffer: &buffer{path: bufferPath}, Manifest: manifest()}
+
+		commit("a\n")
+		s.upload(context.Background(), uploader, file)
+		assert.Equal(t, 1, uploader.uploads, name)
+		var key string
+		for key = range uploader.objects {
+		}
+		assert.Regexp(t, `^events/2020-10-01/150405\.000000000-[0-9a-f]{16}$`, key, name)
+		assert.NoFileExists(t, file, name)
+
+		// crash before the file was removed: it isn't uploaded again
+		commit("a\n")
+		s.Manifest = manifest()
+		s.upload(context.Background(), uploader, file)
+		assert.Equal(t, 1, uploader.uploads, name)
+		assert.NoFileExists(t, file, name)
+
+		// another file with the same name gets another key
+		commit("b\n")
+		s.upload(context.Background(), uploader, file)
+		assert.Equal(t, 2, uploader.uploads, name)
+		assert.Len(t, uploader.objects, 2, name)
+	}
+}
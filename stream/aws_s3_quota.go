@@ -0,0 +1,269 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Policies of S3Config.OnBufferFull, applied to messages that don't
+// fit in the buffer quota (S3Config.MaxBufferSize and
+// MaxBufferFiles).
+const (
+	// BufferFullBlock waits for uploads to make room, which blocks
+	// Write once the collector's queue is full and so applies
+	// backpressure to the pipeline.
+	BufferFullBlock = "block"
+	// BufferFullDropOldest removes the oldest committed files that
+	// aren't being uploaded, or drops the message if there are none.
+	BufferFullDropOldest = "dropOldest"
+	// BufferFullDropNew drops the message.
+	BufferFullDropNew = "dropNew"
+)
+
+// bufferWarnRatio is the usage of the buffer quota from which a
+// warning is logged.
+const bufferWarnRatio = 0.8
+
+// S3BufferStats are the usage of the local buffer of S3.
+type S3BufferStats struct {
+	Size         int64   `json:"size"`         // bytes of buffered files
+	Files        int64   `json:"files"`        // committed files waiting for their upload
+	Usage        float64 `json:"usage"`        // fraction of the quota used, 0 without one
+	Waits        uint64  `json:"waits"`        // messages that waited for room (block)
+	DroppedFiles uint64  `json:"droppedFiles"` // committed files removed (dropOldest)
+	Dropped      uint64  `json:"dropped"`      // messages dropped
+}
+
+// bufferUsage tracks the usage of the buffer path: it's scanned every
+// second by the collector, and messages appended meanwhile are
+// added to it.
+type bufferUsage struct {
+	size         int64 // atomic, bytes
+	files        int64 // atomic, committed files
+	level        int32 // atomic, 0, 1 once warned, 2 once full
+	waits        uint64
+	droppedFiles uint64
+	dropped      uint64
+}
+
+// BufferStats returns the usage of the local buffer.
+func (s *S3) BufferStats() S3BufferStats {
+	if s.buffer == nil {
+		return S3BufferStats{}
+	}
+	u := &s.buffer.usage
+	return S3BufferStats{
+		Size:         atomic.LoadInt64(&u.size),
+		Files:        atomic.LoadInt64(&u.files),
+		Usage:        s.quotaUsage(),
+		Waits:        atomic.LoadUint64(&u.waits),
+		DroppedFiles: atomic.LoadUint64(&u.droppedFiles),
+		Dropped:      atomic.LoadUint64(&u.dropped),
+	}
+}
+
+// quotaEnabled reports whether the buffer has a quota.
+func (s *S3) quotaEnabled() bool {
+	return s.Config.MaxBufferSize > 0 || s.Config.MaxBufferFiles > 0
+}
+
+// quotaUsage returns the fraction of the quota used, the highest of
+// size and files.
+func (s *S3) quotaUsage() (usage float64) {
+	u := &s.buffer.usage
+	if s.Config.MaxBufferSize > 0 {
+		usage = float64(atomic.LoadInt64(&u.size)) / float64(int64(s.Config.MaxBufferSize)*1024)
+	}
+	if s.Config.MaxBufferFiles > 0 {
+		files := float64(atomic.LoadInt64(&u.files)) / float64(s.Config.MaxBufferFiles)
+		if files > usage {
+			usage = files
+		}
+	}
+	return
+}
+
+// full reports whether `n` more bytes don't fit in the quota. A
+// message always fits in an empty buffer.
+func (s *S3) full(n int64) bool {
+	u := &s.buffer.usage
+	size := atomic.LoadInt64(&u.size)
+	if s.Config.MaxBufferSize > 0 && size > 0 && size+n > int64(s.Config.MaxBufferSize)*1024 {
+		return true
+	}
+	return s.Config.MaxBufferFiles > 0 && atomic.LoadInt64(&u.files) >= int64(s.Config.MaxBufferFiles)
+}
+
+// reserve makes room for `msg` in the buffer quota according to
+// Config.OnBufferFull. It returns false if the message is dropped,
+// including when the connector is disconnected while blocked.
+func (s *S3) reserve(msg string) bool {
+	n := int64(len(msg)) + 1
+	if !s.quotaEnabled() || !s.full(n) {
+		return true
+	}
+	s.checkQuota()
+
+	switch s.Config.OnBufferFull {
+	case BufferFullDropNew:
+	case BufferFullDropOldest:
+		s.commitMu.Lock()
+		err := s.dropOldest(n)
+		s.commitMu.Unlock()
+		if err != nil {
+			s.logger().Error("S3: Failed to drop buffered files: ", err)
+		}
+		if !s.full(n) {
+			return true
+		}
+	default:
+		atomic.AddUint64(&s.buffer.usage.waits, 1)
+		if s.waitForRoom(n) {
+			return true
+		}
+		s.logger().Warn("S3: Disconnected while waiting for room in the buffer, dropped a message")
+	}
+
+	atomic.AddUint64(&s.buffer.usage.dropped, 1)
+	return false
+}
+
+// waitForRoom waits until `n` more bytes fit in the quota, as the
+// collector rescans the buffer. It returns false if the connector is
+// disconnected meanwhile.
+func (s *S3) waitForRoom(n int64) bool {
+	for s.full(n) {
+		t := s.clock().NewTimer(time.Second)
+		select {
+		case <-s.done:
+			t.Stop()
+			return false
+		case <-t.C():
+		}
+	}
+	return true
+}
+
+// dropOldest removes the oldest committed files, except those being
+// uploaded, until `n` more bytes fit in the quota. It's called with
+// commitMu held.
+func (s *S3) dropOldest(n int64) error {
+	type committed struct {
+		path string
+		info os.FileInfo
+	}
+	var files []committed
+	err := s.walkBuffer(func(path string, info os.FileInfo) {
+		if info.Name() != "buffer" && !s.uploading[path] {
+			files = append(files, committed{path, info})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].info.ModTime().Equal(files[j].info.ModTime()) {
+			return files[i].info.ModTime().Before(files[j].info.ModTime())
+		}
+		return files[i].path < files[j].path
+	})
+
+	u := &s.buffer.usage
+	for _, f := range files {
+		if !s.full(n) {
+			break
+		}
+		err = os.Remove(f.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&u.size, -f.info.Size())
+		atomic.AddInt64(&u.files, -1)
+		atomic.AddUint64(&u.droppedFiles, 1)
+		s.logger().Warn("S3: Buffer full, dropped ", f.path)
+	}
+	return nil
+}
+
+// scanBuffer updates the usage of the buffer from its files.
+func (s *S3) scanBuffer() error {
+	s.commitMu.Lock()
+	var size, files int64
+	err := s.walkBuffer(func(path string, info os.FileInfo) {
+		size += info.Size()
+		if info.Name() != "buffer" {
+			files++
+		}
+	})
+	s.commitMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&s.buffer.usage.size, size)
+	atomic.StoreInt64(&s.buffer.usage.files, files)
+	s.checkQuota()
+	return nil
+}
+
+// walkBuffer calls `fn` for the buffers and committed files of the
+// buffer path, skipping files removed meanwhile (e.g. uploaded).
+func (s *S3) walkBuffer(fn func(path string, info os.FileInfo)) error {
+	return filepath.Walk(s.buffer.path, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !strings.HasSuffix(path, erasingSuffix) {
+			fn(path, info)
+		}
+		return nil
+	})
+}
+
+// checkQuota logs a warning once the buffer reaches bufferWarnRatio
+// of its quota and once it's full, and when it's back under
+// bufferWarnRatio.
+func (s *S3) checkQuota() {
+	if !s.quotaEnabled() {
+		return
+	}
+	usage := s.quotaUsage()
+	level := int32(0)
+	switch {
+	case usage >= 1:
+		level = 2
+	case usage >= bufferWarnRatio:
+		level = 1
+	}
+	previous := atomic.SwapInt32(&s.buffer.usage.level, level)
+	if level == previous {
+		return
+	}
+
+	size, files := atomic.LoadInt64(&s.buffer.usage.size), atomic.LoadInt64(&s.buffer.usage.files)
+	switch {
+	case level == 2:
+		policy := s.Config.OnBufferFull
+		if policy == "" {
+			policy = BufferFullBlock
+		}
+		s.logger().Warnf("S3: Buffer quota reached (%d KB, %d files waiting for upload), applying %s", size/1024, files, policy)
+	case level == 1 && previous == 0:
+		s.logger().Warnf("S3: Buffer at %.0f%% of its quota (%d KB, %d files waiting for upload)", usage*100, size/1024, files)
+	case level == 0:
+		s.logger().Infof("S3: Buffer back under %.0f%% of its quota", bufferWarnRatio*100)
+	}
+}
@@ -0,0 +1,157 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+// committedFile writes a committed file of `size` bytes to `dir`,
+// modified at `modTime`.
+func committedFile(t *testing.T, dir string, name string, size int, modTime time.Time) string {
+	path := filepath.Join(dir, "2020-10-01", name)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(path, []byte(strings.Repeat("a", size)), 0644))
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	return path
+}
+
+func TestS3_BufferQuota(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	oldest := committedFile(t, dir, "120000.000000000", 600, start)
+	newest := committedFile(t, dir, "120100.000000000", 300, start.Add(time.Minute))
+	uploading := committedFile(t, dir, "115900.000000000", 100, start.Add(-time.Minute))
+	s := &S3{
+		Config:    &S3Config{MaxBufferSize: 1, OnBufferFull: BufferFullDropOldest},
+		buffer:    &buffer{path: dir},
+		uploading: map[string]bool{uploading: true},
+	}
+	assert.NoError(t, s.scanBuffer())
+	stats := s.BufferStats()
+	assert.Equal(t, int64(1000), stats.Size)
+	assert.Equal(t, int64(3), stats.Files)
+	assert.InDelta(t, 0.98, stats.Usage, 0.01)
+
+	// the oldest file not being uploaded makes room
+	assert.True(t, s.reserve(strings.Repeat("m", 99)))
+	assert.NoFileExists(t, oldest)
+	assert.FileExists(t, newest)
+	assert.FileExists(t, uploading)
+	stats = s.BufferStats()
+	assert.Equal(t, int64(400), stats.Size)
+	assert.Equal(t, uint64(1), stats.DroppedFiles)
+
+	// messages are dropped if no file can make room
+	s.uploading[newest] = true
+	assert.False(t, s.reserve(strings.Repeat("m", 1000)))
+	assert.Equal(t, uint64(1), s.BufferStats().Dropped)
+
+	s.Config.OnBufferFull = BufferFullDropNew
+	assert.True(t, s.reserve("fits"))
+	assert.False(t, s.reserve(strings.Repeat("m", 700)))
+	assert.Equal(t, uint64(2), s.BufferStats().Dropped)
+	assert.FileExists(t, newest)
+}
+
+func TestS3_BufferQuotaBlocks(t *testing.T) {
+	dir := t.TempDir()
+	clock := NewFakeClock(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC))
+	s := &S3{
+		Config: &S3Config{MaxBufferFiles: 2},
+		buffer: &buffer{path: dir},
+		done:   make(chan struct{}),
+	}
+	s.SetClock(clock)
+	committedFile(t, dir, "120000.000000000", 10, clock.Now())
+	uploaded := committedFile(t, dir, "120100.000000000", 10, clock.Now())
+	assert.NoError(t, s.scanBuffer())
+	assert.Equal(t, 1.0, s.BufferStats().Usage)
+
+	reserved := make(chan bool)
+	go func() { reserved <- s.reserve("message") }()
+	assert.Eventually(t, func() bool { return clock.Waiters() == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(1), s.BufferStats().Waits)
+
+	// an upload makes room
+	assert.NoError(t, os.Remove(uploaded))
+	assert.NoError(t, s.scanBuffer())
+	clock.Advance(time.Second)
+	assert.True(t, <-reserved)
+	assert.Equal(t, uint64(0), s.BufferStats().Dropped)
+
+	// disconnecting drops a waiting message
+	committedFile(t, dir, "120200.000000000", 10, clock.Now())
+	assert.NoError(t, s.scanBuffer())
+	go func() { reserved <- s.reserve("message") }()
+	assert.Eventually(t, func() bool { return clock.Waiters() == 1 }, time.Second, time.Millisecond)
+	close(s.done)
+	assert.False(t, <-reserved)
+	assert.Equal(t, uint64(1), s.BufferStats().Dropped)
+}
+
+// failingUploader fails every upload, as while S3 is unreachable.
+type failingUploader struct{}
+
+func (failingUploader) Upload(context.Context, *s3.PutObjectInput, ...func(*manager.Uploader)) (*manager.UploadOutput, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestS3_BufferQuotaFailedUploads(t *testing.T) {
+	dir := t.TempDir()
+	clock := NewFakeClock(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC))
+	s := &S3{
+		Config: &S3Config{MaxBufferFiles: 2, OnBufferFull: BufferFullDropNew},
+		buffer: &buffer{path: dir},
+	}
+	s.SetClock(clock)
+	write := func(msg string) bool {
+		if !s.reserve(msg) {
+			return false
+		}
+		s.commitMu.Lock()
+		assert.NoError(t, s.bufferMessage(msg))
+		s.commitMu.Unlock()
+		_, err := s.commit(true)
+		assert.NoError(t, err)
+		clock.Advance(time.Second)
+		return true
+	}
+	uploadAll := func(uploader s3Uploader) {
+		files, err := s.committedFiles()
+		assert.NoError(t, err)
+		for _, file := range files {
+			s.upload(context.Background(), uploader, file)
+		}
+		assert.NoError(t, s.scanBuffer())
+	}
+
+	// failed uploads are kept until the quota is full
+	assert.True(t, write("a"))
+	uploadAll(failingUploader{})
+	assert.True(t, write("b"))
+	uploadAll(failingUploader{})
+	files, _ := s.committedFiles()
+	assert.Len(t, files, 2)
+	assert.False(t, write("c"))
+	assert.Equal(t, uint64(1), s.BufferStats().Dropped)
+
+	// and uploaded once S3 is back
+	uploader := &fakeUploader{objects: map[string]string{}}
+	uploadAll(uploader)
+	assert.Equal(t, 2, uploader.uploads)
+	assert.Equal(t, int64(0), s.BufferStats().Files)
+	assert.True(t, write("d"))
+}
@@ -0,0 +1,138 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With S3Config.SplitField, messages are buffered in a directory per
+// split, the value of the field made safe for object keys (other
+// characters than letters, digits, '-', '_', '.' and '=' are replaced
+// with '_'), or "unknown" for messages without it. Directories are
+// prefixed with splitDirPrefix, so that no value names the buffer or
+// a day of the unsplit buffer:
+//
+//	<bufferPath>/split-<split>/buffer
+//	<bufferPath>/split-<split>/<day>/<time> (committed, uploaded to
+//	                                          <Folder>/<split>/<day>/<time>)
+//
+// Splits are open while they have a buffer file.
+
+// split is an open split of S3.
+type split struct {
+	committed time.Time // time of the last commit, or of its opening
+	written   time.Time // time of the last message
+}
+
+// splitUnknown is the split of messages without S3Config.SplitField.
+const splitUnknown = "unknown"
+
+// splitDirPrefix prefixes the buffer directories of splits.
+const splitDirPrefix = "split-"
+
+// splitDir returns the buffer directory of split `name`.
+func (s *S3) splitDir(name string) string {
+	return filepath.Join(s.buffer.path, splitDirPrefix+name)
+}
+
+// splitKey returns the object key of committed file `path`, relative
+// to the buffer path, without the prefix of its split directory.
+func splitKey(path string) string {
+	path = strings.TrimPrefix(path, string(filepath.Separator))
+	if strings.HasPrefix(path, splitDirPrefix) {
+		return strings.TrimPrefix(path, splitDirPrefix)
+	}
+	return path
+}
+
+// splitOf returns the split of `msg`.
+func (s *S3) splitOf(msg string) string {
+	var v interface{}
+	if json.Unmarshal([]byte(msg), &v) == nil {
+		for _, key := range strings.Split(s.Config.SplitField, ".") {
+			object, _ := v.(map[string]interface{})
+			v = object[key]
+		}
+	}
+
+	var value string
+	switch v := v.(type) {
+	case string:
+		value = v
+	case float64:
+		value = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		value = strconv.FormatBool(v)
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case r == '-', r == '_', r == '.', r == '=':
+		default:
+			return '_'
+		}
+		return r
+	}, value)
+	// e.g. "" or ".."
+	if strings.Trim(name, ".") == "" {
+		return splitUnknown
+	}
+	return name
+}
+
+// openSplit marks split `name` written, opening it if needed: if
+// Config.MaxOpenSplits are open, the least recently written one is
+// committed first. It's called with commitMu held.
+func (s *S3) openSplit(name string) error {
+	now := s.clock().Now()
+	if sp, ok := s.splits[name]; ok {
+		sp.written = now
+		return nil
+	}
+
+	if len(s.splits) >= s.Config.MaxOpenSplits {
+		var lru string
+		for n, sp := range s.splits {
+			if lru == "" || sp.written.Before(s.splits[lru].written) {
+				lru = n
+			}
+		}
+		s.logger().Infof("S3: %d splits open, committing split %s", len(s.splits), lru)
+		_, err := s.commitBuffer(s.splitDir(lru), &s.splits[lru].committed, true)
+		if err != nil {
+			return err
+		}
+		delete(s.splits, lru)
+	}
+
+	if s.splits == nil {
+		s.splits = map[string]*split{}
+	}
+	s.splits[name] = &split{committed: now, written: now}
+	return os.MkdirAll(s.splitDir(name), os.ModePerm)
+}
+
+// restoreSplits opens the splits buffered before a restart. It's
+// called with commitMu held.
+func (s *S3) restoreSplits() error {
+	buffers, err := filepath.Glob(filepath.Join(s.buffer.path, splitDirPrefix+"*", "buffer"))
+	if err != nil {
+		return err
+	}
+	now := s.clock().Now()
+	for _, buffer := range buffers {
+		if s.splits == nil {
+			s.splits = map[string]*split{}
+		}
+		name := strings.TrimPrefix(filepath.Base(filepath.Dir(buffer)), splitDirPrefix)
+		s.splits[name] = &split{committed: now, written: now}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3_SplitOf(t *testing.T) {
+	s := &S3{Config: &S3Config{SplitField: "tenant.id"}}
+	for msg, split := range map[string]string{
+		`{"tenant": {"id": "acme"}}`:        "acme",
+		`{"tenant": {"id": 42}}`:            "42",
+		`{"tenant": {"id": "../a/b c"}}`:    ".._a_b_c",
+		`{"tenant": {"id": ".."}}`:          "unknown",
+		`{"tenant": {"id": ["a"]}}`:         "unknown",
+		`{"tenant": "acme"}`:                "unknown",
+		`not json`:                          "unknown",
+		`{"tenant": {"id": "region=eu-1"}}`: "region=eu-1",
+	} {
+		assert.Equal(t, split, s.splitOf(msg), msg)
+	}
+}
+
+func TestS3_Splits(t *testing.T) {
+	dir := t.TempDir()
+	clock := NewFakeClock(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC))
+	s := &S3{
+		Config: &S3Config{CommitFileSize: 1024, CommitDuration: 5, SplitField: "tenant", MaxOpenSplits: 2},
+		buffer: &buffer{path: dir},
+	}
+	s.SetClock(clock)
+	s.committed = clock.Now()
+
+	assert.NoError(t, s.bufferMessage(`{"tenant":"acme","n":1}`))
+	assert.NoError(t, s.bufferMessage(`{"tenant":"globex","n":1}`))
+	clock.Advance(time.Minute)
+	assert.NoError(t, s.bufferMessage(`{"tenant":"acme","n":2}`))
+
+	// a third split commits the least recently written one
+	assert.NoError(t, s.bufferMessage(`{"tenant":"initech","n":1}`))
+	assert.FileExists(t, filepath.Join(dir, "split-globex", "2020-10-01", "120100.000000000"))
+	assert.Len(t, s.splits, 2)
+
+	// splits are committed on their own duration
+	clock.Advance(4 * time.Minute)
+	committed, err := s.commit(false)
+	assert.NoError(t, err)
+	assert.True(t, committed)
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "split-acme", "2020-10-01", "120500.000000000"))
+	assert.Equal(t, `{"tenant":"acme","n":1}`+"\n"+`{"tenant":"acme","n":2}`+"\n", string(data))
+	assert.FileExists(t, filepath.Join(dir, "split-initech", "buffer"))
+
+	files, err := s.committedFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "split-acme", "2020-10-01", "120500.000000000"),
+		filepath.Join(dir, "split-globex", "2020-10-01", "120100.000000000"),
+	}, files)
+
+	// splits buffered before a restart are committed as well
+	s = &S3{Config: s.Config, buffer: &buffer{path: dir}}
+	s.SetClock(clock)
+	assert.NoError(t, s.restoreSplits())
+	assert.NoError(t, s.Flush())
+	assert.FileExists(t, filepath.Join(dir, "split-initech", "2020-10-01", "120500.000000000"))
+}
+
+func TestS3_SplitReservedNames(t *testing.T) {
+	dir := t.TempDir()
+	clock := NewFakeClock(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC))
+	s := &S3{
+		Config: &S3Config{CommitFileSize: 1024, CommitDuration: 5, SplitField: "tenant", MaxOpenSplits: 10},
+		buffer: &buffer{path: dir},
+	}
+	s.SetClock(clock)
+	s.committed = clock.Now()
+
+	// values naming the buffer or a day of the unsplit buffer
+	assert.NoError(t, s.bufferMessage(`{"tenant":"buffer"}`))
+	assert.NoError(t, s.bufferMessage(`{"tenant":"2020-10-01"}`))
+	assert.DirExists(t, filepath.Join(dir, "split-buffer"))
+	assert.NoFileExists(t, filepath.Join(dir, "buffer"))
+	assert.NoError(t, s.Flush())
+
+	files, err := s.committedFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "split-2020-10-01", "2020-10-01", "120000.000000000"),
+		filepath.Join(dir, "split-buffer", "2020-10-01", "120000.000000000"),
+	}, files)
+	// uploaded under the split's value
+	assert.Equal(t, "buffer/2020-10-01/120000.000000000", splitKey(strings.Replace(files[1], dir, "", 1)))
+	assert.Equal(t, "2020-10-01/120000.000000000", splitKey("/2020-10-01/120000.000000000"))
+}
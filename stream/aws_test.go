@@ -0,0 +1,71 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSTS issues credentials expiring after `ttl`.
+type fakeSTS struct {
+	ttl    time.Duration
+	inputs []*sts.AssumeRoleInput
+}
+
+func (f *fakeSTS) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	f.inputs = append(f.inputs, input)
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("role-key"),
+		SecretAccessKey: aws.String("role-secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(f.ttl)),
+	}}, nil
+}
+
+func TestAssumeRole(t *testing.T) {
+	base := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("key", "secret", ""),
+	}))
+
+	svc := &fakeSTS{ttl: time.Hour}
+	sess := assumeRole(base, svc, "arn:aws:iam::111111111111:role/reader", "ext")
+	creds, err := sess.Config.Credentials.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, "role-key", creds.AccessKeyID)
+	assert.Equal(t, "eu-west-1", *sess.Config.Region)
+	assert.Equal(t, "arn:aws:iam::111111111111:role/reader", *svc.inputs[0].RoleArn)
+	assert.Equal(t, "ext", *svc.inputs[0].ExternalId)
+	// the base session keeps its credentials
+	creds, _ = base.Config.Credentials.Get()
+	assert.Equal(t, "key", creds.AccessKeyID)
+
+	// cached until a minute before they expire
+	sess.Config.Credentials.Get()
+	assert.Len(t, svc.inputs, 1)
+	svc = &fakeSTS{ttl: 30 * time.Second}
+	sess = assumeRole(base, svc, "arn:aws:iam::111111111111:role/reader", "")
+	sess.Config.Credentials.Get()
+	sess.Config.Credentials.Get()
+	assert.Len(t, svc.inputs, 2)
+	assert.Nil(t, svc.inputs[0].ExternalId)
+}
+
+func TestConnectorSession(t *testing.T) {
+	base := session.Must(session.NewSession(&aws.Config{Region: aws.String("eu-west-1")}))
+	sess, err := connectorSession(base, "us-east-1", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, base, sess)
+
+	sess, err = connectorSession(nil, arnRegion("arn:aws:kinesis:us-east-2:999999999999:stream/events"), "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "us-east-2", *sess.Config.Region)
+}
@@ -0,0 +1,337 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/timestreamwrite"
+	"github.com/aws/aws-sdk-go-v2/service/timestreamwrite/types"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// timestreamMaxBatch is the maximum number of records per
+// WriteRecords call.
+const timestreamMaxBatch = 100
+
+// Timestream writes JSON messages to an AWS Timestream table.
+//
+// Fields listed in Config.Dimensions become dimensions and every
+// field listed in Config.Measures becomes a record (measure) sharing
+// those dimensions. The measure value type is inferred from the JSON
+// value: numbers are DOUBLE, booleans BOOLEAN and strings VARCHAR.
+// The record time is read from Config.TimeField (milliseconds since
+// epoch, or an RFC 3339 string) and defaults to the current time.
+//
+// Records are written in batches with WriteRecords; attributes shared
+// by every record of a batch are sent once as common attributes.
+// Messages written with WriteAsync (as pipelines do) are acknowledged
+// once all of their records are written. Messages that can't be
+// mapped, or whose records were rejected by Timestream, fail with the
+// rejection reason so the pipeline quarantines them.
+type Timestream struct {
+	Database   string
+	Table      string
+	AWSConfig  *aws.Config      // defaults to the default credential chain
+	AWSSess    *session.Session // v1 session used if AWSConfig isn't set
+	RoleARN    string           // role assumed to write to the table
+	ExternalID string           // external ID of RoleARN, if required
+	Config     *TimestreamConfig
+	client     timestreamAPI
+	batcher    *batcher
+	ctx        context.Context
+	cancel     context.CancelFunc
+	clocked
+	logged
+}
+
+// timestreamAPI is the part of the Timestream client used by the
+// connector.
+type timestreamAPI interface {
+	WriteRecords(ctx context.Context, input *timestreamwrite.WriteRecordsInput, opts ...func(*timestreamwrite.Options)) (*timestreamwrite.WriteRecordsOutput, error)
+}
+
+// TimestreamConfig configures the field mapping and batching.
+type TimestreamConfig struct {
+	Dimensions []string
+	Measures   []string
+	TimeField  string
+	BatchSize  int // records per WriteRecords, at most 100
+	FlushEvery int // seconds, defaults to 1
+	MaxRetries int // retries of failed batches, defaults to 3
+}
+
+func (t *Timestream) Connect() (err error) {
+	if t.Config == nil {
+		t.Config = &TimestreamConfig{}
+	}
+	if t.Config.BatchSize < 1 || t.Config.BatchSize > timestreamMaxBatch {
+		t.Config.BatchSize = timestreamMaxBatch
+	}
+	if t.Config.FlushEvery < 1 {
+		t.Config.FlushEvery = 1
+	}
+	if t.Config.MaxRetries < 1 {
+		t.Config.MaxRetries = 3
+	}
+	if len(t.Config.Measures) == 0 {
+		return errors.New("Timestream: at least one measure must be configured")
+	}
+
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	if t.client == nil {
+		cfg, err := connectorConfig(t.ctx, t.AWSConfig, t.AWSSess, "", t.RoleARN, t.ExternalID)
+		if err != nil {
+			return err
+		}
+		t.client = timestreamwrite.NewFromConfig(cfg)
+	}
+
+	t.batcher = newBatcher("Timestream", t.logger(), t.clock(), t.Config.BatchSize, time.Duration(t.Config.FlushEvery)*time.Second, t.Config.MaxRetries, t.writeBatch)
+
+	return
+}
+
+// Disconnect flushes buffered records.
+func (t *Timestream) Disconnect() (err error) {
+	if t.batcher != nil {
+		t.batcher.close()
+		t.batcher = nil
+	}
+	if t.cancel != nil {
+		t.cancel()
+	}
+	return
+}
+
+// Resources returns the database and the table.
+func (t *Timestream) Resources() []Resource {
+	region := configRegion(t.AWSConfig, t.AWSSess)
+	return []Resource{
+		{Kind: "aws_timestreamwrite_database", Name: t.Database, Region: region},
+		{Kind: "aws_timestreamwrite_table", Name: t.Table, Region: region, Settings: map[string]string{"database_name": t.Database}},
+	}
+}
+
+// Capabilities of Timestream: writing a record again with the same
+// dimensions, time and measures is ignored.
+func (t *Timestream) Capabilities() Capabilities {
+	return Capabilities{ConfirmedWrites: true, Batching: true, Schemas: true, Idempotent: true}
+}
+
+func (t *Timestream) Info() {
+	t.logger().Infof("Timestream: %s.%s", t.Database, t.Table)
+	t.logger().Infof("TimestreamConfig: %+v", *t.Config)
+}
+
+func (t *Timestream) Write(body string) (err error) {
+	return t.WriteMessage(message.New(body))
+}
+
+// WriteMessage maps `m` to records and buffers them.
+func (t *Timestream) WriteMessage(m message.Message) (err error) {
+	records, err := t.toRecords(m.Body)
+	if err != nil {
+		return
+	}
+
+	done := group(len(records), nil)
+	for _, rec := range records {
+		t.batcher.add(rec, done)
+	}
+	return
+}
+
+// WriteAsync maps `m` to records, buffers them and calls `done` once
+// they have all been written.
+func (t *Timestream) WriteAsync(m message.Message, done func(error)) {
+	records, err := t.toRecords(m.Body)
+	if err != nil {
+		done(err)
+		return
+	}
+
+	written := group(len(records), done)
+	for _, rec := range records {
+		t.batcher.add(rec, written)
+	}
+}
+
+// toRecords maps a JSON message to a record per measure.
+func (t *Timestream) toRecords(body string) (records []*types.Record, err error) {
+	var fields map[string]interface{}
+	err = json.Unmarshal([]byte(body), &fields)
+	if err != nil {
+		return
+	}
+
+	var dimensions []types.Dimension
+	for _, name := range t.Config.Dimensions {
+		val, ok := fields[name]
+		if !ok || val == nil {
+			continue
+		}
+		dimensions = append(dimensions, types.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(fmt.Sprint(val)),
+		})
+	}
+
+	ts, err := t.recordTime(fields)
+	if err != nil {
+		return
+	}
+
+	for _, name := range t.Config.Measures {
+		val, ok := fields[name]
+		if !ok || val == nil {
+			continue
+		}
+
+		rec := &types.Record{
+			Dimensions:  dimensions,
+			MeasureName: aws.String(name),
+			Time:        aws.String(ts),
+			TimeUnit:    types.TimeUnitMilliseconds,
+		}
+		switch v := val.(type) {
+		case float64:
+			rec.MeasureValueType = types.MeasureValueTypeDouble
+			rec.MeasureValue = aws.String(strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			rec.MeasureValueType = types.MeasureValueTypeBoolean
+			rec.MeasureValue = aws.String(strconv.FormatBool(v))
+		case string:
+			rec.MeasureValueType = types.MeasureValueTypeVarchar
+			rec.MeasureValue = aws.String(v)
+		default:
+			return nil, fmt.Errorf("measure %s has unsupported type %T", name, val)
+		}
+		records = append(records, rec)
+	}
+
+	if len(records) == 0 {
+		err = errors.New("message has no measures")
+	}
+	return
+}
+
+// recordTime returns the time of a message in milliseconds since
+// epoch.
+func (t *Timestream) recordTime(fields map[string]interface{}) (string, error) {
+	ts := time.Now()
+	if v, ok := fields[t.Config.TimeField]; ok && v != nil {
+		var err error
+		ts, err = fieldTime(v)
+		if err != nil {
+			return "", fmt.Errorf("time field %s: %s", t.Config.TimeField, err)
+		}
+	}
+
+	return strconv.FormatInt(ts.UnixNano()/int64(time.Millisecond), 10), nil
+}
+
+// writeBatch writes a batch of records. Records rejected by
+// Timestream fail without being retried, the other records of the
+// batch were written.
+func (t *Timestream) writeBatch(batch []*batchEntry) error {
+	records := make([]*types.Record, len(batch))
+	for i, e := range batch {
+		records[i] = e.value.(*types.Record)
+	}
+
+	input := &timestreamwrite.WriteRecordsInput{
+		DatabaseName: aws.String(t.Database),
+		TableName:    aws.String(t.Table),
+	}
+	input.CommonAttributes, input.Records = commonAttributes(records)
+
+	_, err := t.client.WriteRecords(t.ctx, input)
+	var rejected *types.RejectedRecordsException
+	if errors.As(err, &rejected) {
+		for _, r := range rejected.RejectedRecords {
+			i := int(r.RecordIndex)
+			if i >= 0 && i < len(batch) {
+				t.logger().Warn("Timestream: Record rejected: ", aws.ToString(r.Reason))
+				batch[i].err = errors.New(aws.ToString(r.Reason))
+				batch[i].permanent = true
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+// commonAttributes moves the attributes shared by all records of
+// `batch` (dimensions, measure value type, time and time unit) to a
+// common attributes record and returns it with the slimmed records.
+func commonAttributes(batch []*types.Record) (common *types.Record, records []types.Record) {
+	common = &types.Record{}
+	first := batch[0]
+
+	shared := func(get func(*types.Record) string) bool {
+		for _, rec := range batch {
+			if get(rec) != get(first) {
+				return false
+			}
+		}
+		return true
+	}
+	if shared(func(r *types.Record) string { return string(r.MeasureValueType) }) {
+		common.MeasureValueType = first.MeasureValueType
+	}
+	if shared(func(r *types.Record) string { return aws.ToString(r.Time) }) {
+		common.Time = first.Time
+	}
+	if shared(func(r *types.Record) string { return string(r.TimeUnit) }) {
+		common.TimeUnit = first.TimeUnit
+	}
+
+	sharedDimensions := map[string]bool{}
+	for _, d := range first.Dimensions {
+		name, value := aws.ToString(d.Name), aws.ToString(d.Value)
+		if shared(func(r *types.Record) string { return aws.ToString(dimension(r, name)) }) && value != "" {
+			sharedDimensions[name] = true
+			common.Dimensions = append(common.Dimensions, d)
+		}
+	}
+
+	for _, rec := range batch {
+		r := *rec
+		if common.MeasureValueType != "" {
+			r.MeasureValueType = ""
+		}
+		if common.Time != nil {
+			r.Time = nil
+		}
+		if common.TimeUnit != "" {
+			r.TimeUnit = ""
+		}
+		r.Dimensions = nil
+		for _, d := range rec.Dimensions {
+			if !sharedDimensions[aws.ToString(d.Name)] {
+				r.Dimensions = append(r.Dimensions, d)
+			}
+		}
+		records = append(records, r)
+	}
+	return
+}
+
+// dimension returns the value of dimension `name` of `r`, or nil.
+func dimension(r *types.Record, name string) *string {
+	for _, d := range r.Dimensions {
+		if aws.ToString(d.Name) == name {
+			return d.Value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/timestreamwrite"
+	"github.com/aws/aws-sdk-go-v2/service/timestreamwrite/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTimestream records inputs and rejects the records at
+// `reject` indexes.
+type fakeTimestream struct {
+	inputs []*timestreamwrite.WriteRecordsInput
+	reject []int32
+}
+
+func (f *fakeTimestream) WriteRecords(ctx context.Context, input *timestreamwrite.WriteRecordsInput, opts ...func(*timestreamwrite.Options)) (*timestreamwrite.WriteRecordsOutput, error) {
+	f.inputs = append(f.inputs, input)
+	if len(f.reject) > 0 {
+		exc := &types.RejectedRecordsException{}
+		for _, i := range f.reject {
+			exc.RejectedRecords = append(exc.RejectedRecords, types.RejectedRecord{
+				RecordIndex: i,
+				Reason:      aws.String("record is older than the memory store retention"),
+			})
+		}
+		return nil, exc
+	}
+	return &timestreamwrite.WriteRecordsOutput{}, nil
+}
+
+func TestTimestream_Write(t *testing.T) {
+	client := &fakeTimestream{reject: []int32{2}}
+	dest := &Timestream{
+		Database: "iot",
+		Table:    "readings",
+		Config: &TimestreamConfig{
+			Dimensions: []string{"region", "device"},
+			Measures:   []string{"temp", "online"},
+			TimeField:  "ts",
+		},
+		client: client,
+	}
+	assert.NoError(t, dest.Connect())
+
+	results := make([]error, 3)
+	for i, body := range []string{
+		`{"region":"eu","device":"d1","temp":21.5,"online":true,"ts":1601553600000}`,
+		`{"region":"eu","device":"d2","temp":19,"ts":"2020-10-01T12:00:00Z"}`,
+		`{"region":"eu","device":"d3"}`, // no measures
+	} {
+		i := i
+		dest.WriteAsync(message.New(body), func(err error) { results[i] = err })
+	}
+	assert.NoError(t, dest.Disconnect())
+
+	input := client.inputs[0]
+	assert.Len(t, input.Records, 3)
+	// shared attributes
+	assert.Equal(t, "1601553600000", aws.ToString(input.CommonAttributes.Time))
+	assert.Equal(t, types.TimeUnitMilliseconds, input.CommonAttributes.TimeUnit)
+	assert.Empty(t, input.CommonAttributes.MeasureValueType)
+	assert.Len(t, input.CommonAttributes.Dimensions, 1)
+	assert.Equal(t, "region", aws.ToString(input.CommonAttributes.Dimensions[0].Name))
+	// per-record attributes
+	assert.Equal(t, "device", aws.ToString(input.Records[0].Dimensions[0].Name))
+	assert.Equal(t, "online", aws.ToString(input.Records[1].MeasureName))
+	assert.Equal(t, types.MeasureValueTypeBoolean, input.Records[1].MeasureValueType)
+
+	// both of d1's records were written, d2's was rejected and isn't
+	// retried, d3 has no measures
+	assert.Len(t, client.inputs, 1)
+	assert.NoError(t, results[0])
+	assert.EqualError(t, results[1], "record is older than the memory store retention")
+	assert.EqualError(t, results[2], "message has no measures")
+}
+
+func TestTimestream_QuarantinedOnce(t *testing.T) {
+	client := &fakeTimestream{reject: []int32{0, 1}}
+	dest := &Timestream{
+		Config: &TimestreamConfig{Measures: []string{"temp", "humidity"}},
+		client: client,
+	}
+	dlq := &memory{}
+	p := &Pipeline{Destination: dest, DLQ: dlq, MaxAttempts: 1}
+	assert.NoError(t, dest.Connect())
+
+	var ack error
+	m := message.New(`{"temp":21.5,"humidity":40}`)
+	m.Ack = func(err error) { ack = err }
+	channel := make(chan message.Message, 1)
+	channel <- m
+	close(channel)
+	p.flow(channel)
+	assert.NoError(t, dest.Disconnect())
+	assert.True(t, errors.Is(ack, message.ErrQuarantined))
+
+	// both measures were rejected, the message is quarantined once
+	assert.Len(t, dlq.messages, 1)
+	var letter DeadLetter
+	assert.NoError(t, json.Unmarshal([]byte(dlq.messages[0]), &letter))
+	assert.Equal(t, []string{"record is older than the memory store retention"}, letter.Errors)
+}
@@ -0,0 +1,151 @@
+package stream
+
+import (
+	"sync"
+	"time"
+)
+
+// batcher buffers values and writes them in batches, of `size`
+// values or every `every` if fewer are buffered. Values that fail are
+// retried with backoff up to `retries` times, then the result of each
+// value is reported to its done callback, so that destinations
+// implementing AsyncDestination acknowledge a message only once its
+// batch has been written.
+type batcher struct {
+	name    string // used in logs
+	logger  Logger
+	size    int
+	every   time.Duration
+	retries int
+	clock   Clock
+	write   func(batch []*batchEntry) error
+	entries chan *batchEntry
+	wg      sync.WaitGroup
+}
+
+// batchEntry is a value buffered by a batcher. `write` sets err on
+// entries that failed on their own, and permanent on those that
+// mustn't be retried (e.g. rejected as invalid).
+type batchEntry struct {
+	value     interface{}
+	done      func(error)
+	err       error
+	permanent bool
+}
+
+// newBatcher starts a batcher writing batches with `write`, timed by
+// `clock` and logging to `logger`. If `write` returns an error, every
+// entry of the batch failed.
+func newBatcher(name string, logger Logger, clock Clock, size int, every time.Duration, retries int, write func([]*batchEntry) error) *batcher {
+	b := &batcher{
+		name:    name,
+		logger:  logger,
+		size:    size,
+		every:   every,
+		retries: retries,
+		clock:   clock,
+		write:   write,
+		entries: make(chan *batchEntry, size),
+	}
+	b.wg.Add(1)
+	go b.run()
+	return b
+}
+
+// add buffers `value`, `done` (if not nil) is called with the result
+// of its write.
+func (b *batcher) add(value interface{}, done func(error)) {
+	b.entries <- &batchEntry{value: value, done: done}
+}
+
+// close writes buffered values and stops the batcher.
+func (b *batcher) close() {
+	close(b.entries)
+	b.wg.Wait()
+}
+
+func (b *batcher) run() {
+	defer b.wg.Done()
+
+	var batch []*batchEntry
+	ticker := b.clock.NewTicker(b.every)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-b.entries:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= b.size {
+				b.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C():
+			b.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// flush writes `batch`, retrying failed entries with backoff.
+func (b *batcher) flush(batch []*batchEntry) {
+	backoff := 500 * time.Millisecond
+	for attempt := 0; len(batch) > 0; attempt++ {
+		for _, e := range batch {
+			e.err, e.permanent = nil, false
+		}
+		err := b.write(batch)
+
+		var failed []*batchEntry
+		for _, e := range batch {
+			if e.err == nil {
+				e.err = err
+			}
+			switch {
+			case e.err == nil:
+				e.finish()
+			case e.permanent || attempt >= b.retries:
+				b.logger.Errorf("%s: Write failed after %d retries: %s", b.name, attempt, e.err)
+				e.finish()
+			default:
+				failed = append(failed, e)
+			}
+		}
+
+		if len(failed) > 0 {
+			b.logger.Warnf("%s: %d of %d value(s) failed: %s, retrying in %s...", b.name, len(failed), len(batch), failed[0].err, backoff)
+			sleepOn(b.clock, backoff)
+			backoff *= 2
+		}
+		batch = failed
+	}
+}
+
+func (e *batchEntry) finish() {
+	if e.done != nil {
+		e.done(e.err)
+	}
+}
+
+// group returns a callback for each of `n` values of a single
+// message, `done` is called once all of them have been written, with
+// the first error if any.
+func group(n int, done func(error)) func(error) {
+	var mu sync.Mutex
+	var first error
+	return func(err error) {
+		mu.Lock()
+		n--
+		if first == nil {
+			first = err
+		}
+		last := n == 0
+		mu.Unlock()
+
+		if last && done != nil {
+			done(first)
+		}
+	}
+}
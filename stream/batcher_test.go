@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatcher(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]interface{}
+	attempts := map[interface{}]int{}
+	b := newBatcher("test", DefaultLogger, SystemClock, 3, time.Hour, 1, func(batch []*batchEntry) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var values []interface{}
+		for _, e := range batch {
+			values = append(values, e.value)
+			attempts[e.value]++
+			switch e.value {
+			case "flaky":
+				if attempts[e.value] == 1 {
+					e.err = errors.New("unavailable")
+				}
+			case "invalid":
+				e.err, e.permanent = errors.New("invalid"), true
+			case "down":
+				e.err = errors.New("unavailable")
+			}
+		}
+		batches = append(batches, values)
+		return nil
+	})
+
+	results := map[string]error{}
+	var wg sync.WaitGroup
+	for _, v := range []string{"ok", "flaky", "invalid", "down"} {
+		v := v
+		wg.Add(1)
+		b.add(v, func(err error) {
+			mu.Lock()
+			results[v] = err
+			mu.Unlock()
+			wg.Done()
+		})
+	}
+	b.close()
+	wg.Wait()
+
+	assert.NoError(t, results["ok"])
+	assert.NoError(t, results["flaky"], "retried")
+	assert.EqualError(t, results["invalid"], "invalid")
+	assert.EqualError(t, results["down"], "unavailable")
+	assert.Equal(t, 1, attempts["invalid"], "permanent errors aren't retried")
+	assert.Equal(t, 2, attempts["down"])
+	// a full batch, its retry and the remainder flushed on close
+	assert.Equal(t, [][]interface{}{{"ok", "flaky", "invalid"}, {"flaky"}, {"down"}, {"down"}}, batches)
+}
+
+func TestBatcher_WriteError(t *testing.T) {
+	b := newBatcher("test", DefaultLogger, SystemClock, 10, 10*time.Millisecond, 0, func(batch []*batchEntry) error {
+		return errors.New("unavailable")
+	})
+	defer b.close()
+
+	result := make(chan error, 2)
+	b.add(1, func(err error) { result <- err })
+	b.add(2, func(err error) { result <- err })
+	assert.EqualError(t, <-result, "unavailable")
+	assert.EqualError(t, <-result, "unavailable")
+}
+
+func TestGroup(t *testing.T) {
+	var results []error
+	done := group(3, func(err error) { results = append(results, err) })
+
+	done(nil)
+	done(errors.New("rejected"))
+	assert.Empty(t, results)
+	done(nil)
+	assert.Equal(t, []error{errors.New("rejected")}, results)
+}
@@ -0,0 +1,83 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned for writes rejected by an open circuit
+// breaker.
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// ErrWriteTimeout is returned for writes that didn't complete within
+// the pipeline's WriteTimeout.
+var ErrWriteTimeout = errors.New("write timed out")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is a circuit breaker: it opens after `threshold`
+// consecutive failures and rejects calls until `cooldown` has
+// elapsed, then lets a single probe through (half-open). A
+// successful probe closes it, a failed one opens it again.
+type breaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+}
+
+// allow reports whether a call may go through.
+func (b *breaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if b.clock.Now().Sub(b.openedAt) >= b.cooldown {
+			b.state = breakerHalfOpen
+			return true
+		}
+	}
+	// a probe is already in flight
+	return false
+}
+
+// isOpen reports whether the breaker is open or half-open.
+func (b *breaker) isOpen() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.state != breakerClosed
+}
+
+// record records the result of an allowed call and returns the
+// state transition it caused, if any.
+func (b *breaker) record(err error) (from, to breakerState) {
+	b.Lock()
+	defer b.Unlock()
+
+	from = b.state
+	if err == nil {
+		b.failures = 0
+		b.state = breakerClosed
+		return from, b.state
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = b.clock.Now()
+	}
+	return from, b.state
+}
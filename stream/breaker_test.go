@@ -0,0 +1,38 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	b := &breaker{threshold: 2, cooldown: 20 * time.Second, clock: clock}
+	failed := errors.New("failed")
+
+	assert.True(t, b.allow())
+	b.record(failed)
+	assert.True(t, b.allow())
+	_, to := b.record(failed)
+	assert.Equal(t, breakerOpen, to)
+	assert.False(t, b.allow())
+
+	// a single probe is let through after the cooldown
+	clock.Advance(20 * time.Second)
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+	_, to = b.record(failed)
+	assert.Equal(t, breakerOpen, to)
+	assert.False(t, b.allow())
+
+	clock.Advance(20 * time.Second)
+	assert.True(t, b.allow())
+	from, to := b.record(nil)
+	assert.Equal(t, breakerHalfOpen, from)
+	assert.Equal(t, breakerClosed, to)
+	assert.True(t, b.allow())
+	assert.True(t, b.allow())
+}
@@ -0,0 +1,263 @@
+package stream
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// Split shares Source between a stable and a canary version of a
+// pipeline, to roll out changes (e.g. new transforms or destination
+// prefix) under live load: Percent of the messages are read by the
+// pipeline of Canary(), the rest by the pipeline of Stable().
+//
+// With Key, messages are assigned by the hash of their Key metadata
+// value (e.g. the partition key), so that a key always goes through
+// the same version; otherwise every 100/Percent-th message goes
+// through the canary.
+//
+// Source is connected by the first version connecting and
+// disconnected by the last one. Once a version disconnects (e.g. the
+// canary is stopped), every message goes to the other one.
+type Split struct {
+	Source  Source
+	Percent int
+	Key     string
+	mu      sync.Mutex
+	sides   [2]*splitSide // stable, canary
+	refs    int           // connected sides
+	reading bool
+	n       uint64 // messages split without Key
+	logged
+}
+
+// splitSide is the source read by a version of a Split.
+type splitSide struct {
+	split    *Split
+	canary   bool
+	messages chan message.Message
+	closed   chan struct{} // closed on Disconnect
+	routed   uint64
+	logged
+}
+
+// CanaryStats compares the versions of a Split.
+type CanaryStats struct {
+	Percent int          `json:"percent"`
+	Stable  VersionStats `json:"stable"`
+	Canary  VersionStats `json:"canary"`
+}
+
+// VersionStats are the stats of a version of a Split. Rates are
+// fractions of the messages routed to the version.
+type VersionStats struct {
+	Routed      uint64  `json:"routed"`
+	DropRate    float64 `json:"dropRate"`    // dropped by transforms
+	FailureRate float64 `json:"failureRate"` // quarantined
+	Stats       Stats   `json:"stats"`
+}
+
+// Stable returns the source of the stable version.
+func (s *Split) Stable() Source {
+	return s.side(false)
+}
+
+// Canary returns the source of the canary version.
+func (s *Split) Canary() Source {
+	return s.side(true)
+}
+
+// Compare returns the stats of `stable` and `canary`, the pipelines
+// reading Stable() and Canary().
+func (s *Split) Compare(stable *Pipeline, canary *Pipeline) CanaryStats {
+	return CanaryStats{
+		Percent: s.Percent,
+		Stable:  versionStats(atomic.LoadUint64(&s.side(false).routed), stable.Stats()),
+		Canary:  versionStats(atomic.LoadUint64(&s.side(true).routed), canary.Stats()),
+	}
+}
+
+func versionStats(routed uint64, stats Stats) VersionStats {
+	v := VersionStats{Routed: routed, Stats: stats}
+	if routed > 0 {
+		v.DropRate = float64(stats.Dropped) / float64(routed)
+		v.FailureRate = float64(stats.Quarantined) / float64(routed)
+	}
+	return v
+}
+
+func (s *Split) side(canary bool) *splitSide {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := 0
+	if canary {
+		i = 1
+	}
+	if s.sides[i] == nil {
+		s.sides[i] = &splitSide{
+			split:    s,
+			canary:   canary,
+			messages: make(chan message.Message),
+			closed:   make(chan struct{}),
+		}
+	}
+	return s.sides[i]
+}
+
+// connect connects Source unless the other side did.
+func (s *Split) connect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs == 0 {
+		err := s.Source.Connect()
+		if err != nil {
+			return err
+		}
+	}
+	s.refs++
+	return nil
+}
+
+// disconnect disconnects Source once both sides did.
+func (s *Split) disconnect() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs--
+	if s.refs == 0 {
+		return s.Source.Disconnect()
+	}
+	return nil
+}
+
+// read starts splitting the messages of Source, unless the other
+// side did.
+func (s *Split) read() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reading {
+		return nil
+	}
+	channel, err := readMessages(s.Source)
+	if err != nil {
+		return err
+	}
+	s.reading = true
+	go s.run(channel)
+	return nil
+}
+
+// run sends the messages of `channel` to their side.
+func (s *Split) run(channel chan message.Message) {
+	stable, canary := s.side(false), s.side(true)
+	defer close(stable.messages)
+	defer close(canary.messages)
+
+	for m := range channel {
+		to, other := stable, canary
+		if s.canary(m) {
+			to, other = canary, stable
+		}
+		select {
+		case <-to.closed:
+			to = other
+		default:
+		}
+		select {
+		case to.messages <- m:
+			atomic.AddUint64(&to.routed, 1)
+		case <-to.closed:
+			select {
+			case other.messages <- m:
+				atomic.AddUint64(&other.routed, 1)
+			case <-other.closed:
+				s.logger().Warn("Split: both versions disconnected, message not delivered.")
+				m.Done(errors.New("split: no version reading"))
+			}
+		}
+	}
+}
+
+// canary reports whether `m` goes through the canary.
+func (s *Split) canary(m message.Message) bool {
+	if s.Percent <= 0 {
+		return false
+	}
+	if s.Key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(m.Metadata.Get(s.Key)))
+		return int(h.Sum32()%100) < s.Percent
+	}
+	// spread canary messages evenly
+	n := atomic.AddUint64(&s.n, 1) - 1
+	return (n+1)*uint64(s.Percent)/100 > n*uint64(s.Percent)/100
+}
+
+func (side *splitSide) Connect() error {
+	return side.split.connect()
+}
+
+func (side *splitSide) Disconnect() error {
+	select {
+	case <-side.closed:
+		return nil
+	default:
+		close(side.closed)
+	}
+	return side.split.disconnect()
+}
+
+// Capabilities returns the capabilities of the shared source, which
+// can't be sought.
+func (side *splitSide) Capabilities() Capabilities {
+	c := ConnectorCapabilities(side.split.Source)
+	c.Replay = false
+	return c
+}
+
+func (side *splitSide) Info() {
+	version := "stable"
+	if side.canary {
+		version = "canary"
+	}
+	side.logger().Infof("Split: %s version of %d%% canary", version, side.split.Percent)
+	side.split.Source.Info()
+}
+
+func (side *splitSide) Read() (chan string, error) {
+	messages, err := side.ReadMessages()
+	if err != nil {
+		return nil, err
+	}
+	channel := make(chan string)
+	go func() {
+		defer close(channel)
+		for m := range messages {
+			channel <- m.Body
+			m.Done(nil)
+		}
+	}()
+	return channel, nil
+}
+
+func (side *splitSide) ReadMessages() (chan message.Message, error) {
+	err := side.split.read()
+	return side.messages, err
+}
+
+// SetLogger sets the logger of the version. The stable version's is
+// also the logger of the Split and of Source.
+func (side *splitSide) SetLogger(logger Logger) {
+	side.logged.SetLogger(logger)
+	if !side.canary {
+		side.split.SetLogger(logger)
+		setLogger(side.split.Source, logger)
+	}
+}
+
+// Resources returns the resources of the shared source.
+func (side *splitSide) Resources() []Resource {
+	return Resources(side.split.Source)
+}
@@ -0,0 +1,77 @@
+package stream
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/abstractpaper/manifold/transform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplit(t *testing.T) {
+	src := make(channelSource)
+	split := &Split{Source: src, Percent: 25}
+	stableDest, canaryDest := &memory{}, &memory{}
+	stable := &Pipeline{Source: split.Stable(), Destination: stableDest}
+	canary := &Pipeline{Source: split.Canary(), Destination: canaryDest, Transformer: dropper{}}
+
+	done := make(chan error, 2)
+	go func() { done <- stable.RunUntilDrained() }()
+	go func() { done <- canary.RunUntilDrained() }()
+	for i := 0; i < 7; i++ {
+		src <- message.New(fmt.Sprint(i))
+	}
+	src <- message.New("")
+	close(src)
+	assert.NoError(t, <-done)
+	assert.NoError(t, <-done)
+
+	// every fourth message goes through the canary
+	assert.Equal(t, []string{"0", "1", "2", "4", "5", "6"}, stableDest.messages)
+	assert.Equal(t, []string{"3"}, canaryDest.messages)
+	stats := split.Compare(stable, canary)
+	assert.Equal(t, 25, stats.Percent)
+	assert.Equal(t, uint64(6), stats.Stable.Routed)
+	assert.Equal(t, uint64(6), stats.Stable.Stats.Sent)
+	assert.Equal(t, uint64(2), stats.Canary.Routed)
+	assert.Equal(t, 0.5, stats.Canary.DropRate)
+	assert.Equal(t, 0.0, stats.Canary.FailureRate)
+}
+
+func TestSplit_Key(t *testing.T) {
+	split := &Split{Percent: 50, Key: "user"}
+	versions := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		m := message.New("")
+		m.Metadata["user"] = fmt.Sprint(i % 10)
+		canary := split.canary(m)
+		if v, ok := versions[m.Metadata["user"]]; ok {
+			assert.Equal(t, v, canary)
+		}
+		versions[m.Metadata["user"]] = canary
+	}
+	assert.False(t, (&Split{}).canary(message.New("")))
+}
+
+func TestSplit_CanaryStopped(t *testing.T) {
+	src := make(channelSource)
+	split := &Split{Source: src, Percent: 50}
+	stableDest := &memory{}
+	stable := &Pipeline{Source: split.Stable(), Destination: stableDest}
+	canary := &Pipeline{Source: split.Canary(), Destination: &memory{}, Transformer: transform.Chain{}}
+
+	done := make(chan error, 2)
+	go func() { done <- stable.RunUntilDrained() }()
+	go func() { done <- canary.RunUntilDrained() }()
+	canary.Stop()
+	assert.NoError(t, <-done)
+
+	// messages go to the stable version once the canary disconnected
+	for i := 0; i < 4; i++ {
+		src <- message.New(fmt.Sprint(i))
+	}
+	close(src)
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{"0", "1", "2", "3"}, stableDest.messages)
+}
@@ -0,0 +1,187 @@
+package stream
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Capabilities describe what a connector supports, so that pipelines
+// can report the guarantees they provide and refuse to run without
+// those they require (see Pipeline.Require).
+type Capabilities struct {
+	// Acks: as a source, messages are redelivered unless they are
+	// acknowledged, including after a restart.
+	Acks bool `json:"acks"`
+	// ConfirmedWrites: as a destination, writes complete once the
+	// message is stored.
+	ConfirmedWrites bool `json:"confirmedWrites"`
+	// Batching: as a destination, messages are written in batches.
+	Batching bool `json:"batching"`
+	// Ordering: messages are read or written in order (per shard or
+	// partition).
+	Ordering bool `json:"ordering"`
+	// Replay: as a source, messages can be read again from a past
+	// position (see SeekableSource).
+	Replay bool `json:"replay"`
+	// Schemas: messages are written as typed records of a schema
+	// (e.g. table columns).
+	Schemas bool `json:"schemas"`
+	// Idempotent: as a destination, writing a message again doesn't
+	// duplicate it (e.g. upserts).
+	Idempotent bool `json:"idempotent"`
+}
+
+// Capable is an optional interface implemented by connectors to
+// publish their capabilities. Connectors that don't implement it are
+// assumed to support none.
+type Capable interface {
+	Capabilities() Capabilities
+}
+
+// ConnectorCapabilities returns the capabilities of `connector`, a
+// source or a destination. Replay is set for a SeekableSource.
+func ConnectorCapabilities(connector interface{}) (c Capabilities) {
+	if capable, ok := connector.(Capable); ok {
+		c = capable.Capabilities()
+	}
+	if _, ok := connector.(SeekableSource); ok {
+		c.Replay = true
+	}
+	return
+}
+
+// intersect returns the capabilities of writing to destinations `a`
+// and `b`: those both support, and batching if either does.
+func intersect(a Capabilities, b Capabilities) Capabilities {
+	return Capabilities{
+		Acks:            a.Acks && b.Acks,
+		ConfirmedWrites: a.ConfirmedWrites && b.ConfirmedWrites,
+		Batching:        a.Batching || b.Batching,
+		Ordering:        a.Ordering && b.Ordering,
+		Replay:          a.Replay && b.Replay,
+		Schemas:         a.Schemas && b.Schemas,
+		Idempotent:      a.Idempotent && b.Idempotent,
+	}
+}
+
+// Delivery is a delivery guarantee.
+type Delivery int
+
+const (
+	// AtMostOnce messages may be lost, e.g. if the source doesn't
+	// redeliver messages that weren't written.
+	AtMostOnce Delivery = iota
+	// AtLeastOnce messages are written, possibly more than once.
+	AtLeastOnce
+	// ExactlyOnce messages are written at least once to a
+	// destination that ignores duplicates (effectively once).
+	ExactlyOnce
+)
+
+var deliveryNames = []string{"at-most-once", "at-least-once", "exactly-once"}
+
+func (d Delivery) String() string {
+	if d >= 0 && int(d) < len(deliveryNames) {
+		return deliveryNames[d]
+	}
+	return fmt.Sprintf("Delivery(%d)", d)
+}
+
+func (d Delivery) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Delivery) UnmarshalText(text []byte) (err error) {
+	*d, err = ParseDelivery(string(text))
+	return
+}
+
+// ParseDelivery parses a delivery guarantee: at-most-once,
+// at-least-once or exactly-once.
+func ParseDelivery(name string) (Delivery, error) {
+	for i, n := range deliveryNames {
+		if n == name {
+			return Delivery(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown delivery guarantee %q", name)
+}
+
+// Guarantees are the guarantees a pipeline provides, or requires.
+type Guarantees struct {
+	Delivery Delivery `json:"delivery"`
+	// Ordered: messages of a shard or partition are written in the
+	// order they are read.
+	Ordered bool `json:"ordered"`
+}
+
+func (g Guarantees) String() string {
+	if g.Ordered {
+		return g.Delivery.String() + ", ordered"
+	}
+	return g.Delivery.String()
+}
+
+// Guarantees returns the guarantees the pipeline provides, given the
+// capabilities of its source and destination:
+//   - at-least-once delivery if the source redelivers unacknowledged
+//     messages and the destination confirms writes, exactly-once if
+//     the destination is idempotent as well,
+//   - ordering if both preserve order, and messages aren't written
+//     concurrently to an AsyncDestination (unless partitions are
+//     paused on failure, see PausePartition) or processed by Workers
+//     in any order (see OrderedByKey).
+func (p *Pipeline) Guarantees() (g Guarantees) {
+	src, dest := ConnectorCapabilities(p.Source), ConnectorCapabilities(p.Destination)
+	switch {
+	case !src.Acks || !dest.ConfirmedWrites:
+		g.Delivery = AtMostOnce
+	case dest.Idempotent:
+		g.Delivery = ExactlyOnce
+	default:
+		g.Delivery = AtLeastOnce
+	}
+	g.Ordered = src.Ordering && dest.Ordering && p.ordered()
+	return
+}
+
+// Validate checks that the pipeline provides the guarantees of
+// Require, and returns an error explaining why it doesn't otherwise.
+func (p *Pipeline) Validate() error {
+	g := p.Guarantees()
+	var reasons []string
+	if g.Delivery < p.Require.Delivery {
+		src, dest := ConnectorCapabilities(p.Source), ConnectorCapabilities(p.Destination)
+		if !src.Acks {
+			reasons = append(reasons, fmt.Sprintf("source %s doesn't redeliver unacknowledged messages", typeName(p.Source)))
+		}
+		if !dest.ConfirmedWrites {
+			reasons = append(reasons, fmt.Sprintf("destination %s doesn't confirm writes", typeName(p.Destination)))
+		}
+		if p.Require.Delivery == ExactlyOnce && !dest.Idempotent {
+			reasons = append(reasons, fmt.Sprintf("destination %s isn't idempotent", typeName(p.Destination)))
+		}
+		return fmt.Errorf("%s delivery required, the pipeline provides %s: %s", p.Require.Delivery, g.Delivery, strings.Join(reasons, ", "))
+	}
+	if p.Require.Ordered && !g.Ordered {
+		for _, c := range []interface{}{p.Source, p.Destination} {
+			if !ConnectorCapabilities(c).Ordering {
+				reasons = append(reasons, fmt.Sprintf("%s doesn't preserve order", typeName(c)))
+			}
+		}
+		if len(reasons) == 0 && p.Workers > 1 {
+			reasons = append(reasons, "messages are processed by workers in any order (order them by key)")
+		}
+		if len(reasons) == 0 {
+			reasons = append(reasons, "messages are written concurrently (pause partitions on failure to write them in order)")
+		}
+		return fmt.Errorf("ordering required: %s", strings.Join(reasons, ", "))
+	}
+	return nil
+}
+
+// typeName returns the type of `connector`, e.g. *stream.Kinesis.
+func typeName(connector interface{}) string {
+	return reflect.TypeOf(connector).String()
+}
@@ -0,0 +1,78 @@
+package stream
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// capable is a destination with the capabilities of `caps`.
+type capable struct {
+	memory
+	caps Capabilities
+}
+
+func (c *capable) Capabilities() Capabilities { return c.caps }
+
+// orderedQueue is an asynchronous destination preserving order.
+type orderedQueue struct {
+	queue
+}
+
+func (q *orderedQueue) Capabilities() Capabilities {
+	return Capabilities{ConfirmedWrites: true, Ordering: true}
+}
+
+func TestParseDelivery(t *testing.T) {
+	for _, d := range []Delivery{AtMostOnce, AtLeastOnce, ExactlyOnce} {
+		parsed, err := ParseDelivery(d.String())
+		assert.NoError(t, err)
+		assert.Equal(t, d, parsed)
+	}
+	_, err := ParseDelivery("twice")
+	assert.Error(t, err)
+
+	data, err := json.Marshal(Guarantees{Delivery: ExactlyOnce, Ordered: true})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"delivery": "exactly-once", "ordered": true}`, string(data))
+}
+
+func TestConnectorCapabilities(t *testing.T) {
+	assert.Equal(t, Capabilities{}, ConnectorCapabilities(&memory{}))
+	assert.True(t, ConnectorCapabilities(&Redis{Args: map[string]string{"mode": "list"}}).Acks)
+	assert.False(t, ConnectorCapabilities(&Redis{Args: map[string]string{"mode": "pubsub"}}).Acks)
+
+	r := &Router{
+		Routes:  []Route{{Name: "upserts", When: "true", Destination: &capable{caps: Capabilities{ConfirmedWrites: true, Idempotent: true}}}},
+		Default: &capable{caps: Capabilities{ConfirmedWrites: true, Batching: true}},
+	}
+	assert.Equal(t, Capabilities{ConfirmedWrites: true, Batching: true}, ConnectorCapabilities(r))
+}
+
+func TestPipeline_Guarantees(t *testing.T) {
+	list := &Redis{Args: map[string]string{"mode": "list"}}
+	p := &Pipeline{Source: list, Destination: &Stdio{}}
+	assert.Equal(t, Guarantees{Delivery: AtLeastOnce, Ordered: true}, p.Guarantees())
+	assert.NoError(t, p.Validate())
+
+	p.Require = Guarantees{Delivery: ExactlyOnce}
+	assert.EqualError(t, p.Validate(), "exactly-once delivery required, the pipeline provides at-least-once: destination *stream.Stdio isn't idempotent")
+	assert.Error(t, p.RunUntilDrained())
+	assert.Error(t, p.Run())
+
+	p.Destination = &capable{caps: Capabilities{ConfirmedWrites: true, Idempotent: true}}
+	assert.Equal(t, ExactlyOnce, p.Guarantees().Delivery)
+	assert.NoError(t, p.Validate())
+
+	p.Source = &RabbitMQ{}
+	assert.Equal(t, AtMostOnce, p.Guarantees().Delivery)
+	assert.EqualError(t, p.Validate(), "exactly-once delivery required, the pipeline provides at-most-once: source *stream.RabbitMQ doesn't redeliver unacknowledged messages")
+
+	// asynchronous writes are concurrent unless partitions pause
+	p = &Pipeline{Source: list, Destination: &orderedQueue{}, Require: Guarantees{Ordered: true}}
+	assert.False(t, p.Guarantees().Ordered)
+	assert.Contains(t, p.Validate().Error(), "written concurrently")
+	p.OnFailure = PausePartition
+	assert.NoError(t, p.Validate())
+}
@@ -0,0 +1,205 @@
+package stream
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of pipelines and connectors: retry
+// delays and probes, commit timers, flush schedules, windows and
+// their watermarks. It defaults to SystemClock; tests and backfills
+// use a FakeClock instead (see Pipeline.Clock).
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Timer
+}
+
+// Timer is a timer, which fires once, or a ticker of a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Clocked is implemented by connectors that use a Clock, so that
+// pipelines can set theirs before connecting them.
+type Clocked interface {
+	SetClock(Clock)
+}
+
+// SystemClock is the wall clock.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Timer {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+func (t systemTimer) Stop()               { t.Timer.Stop() }
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// clocked is embedded by connectors to implement Clocked.
+type clocked struct {
+	c Clock
+}
+
+func (c *clocked) SetClock(clock Clock) {
+	c.c = clock
+}
+
+// clock returns the clock set, or SystemClock.
+func (c *clocked) clock() Clock {
+	if c.c == nil {
+		return SystemClock
+	}
+	return c.c
+}
+
+// sleepOn waits for `d` to pass on `clock`.
+func sleepOn(clock Clock, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := clock.NewTimer(d)
+	<-t.C()
+}
+
+// FakeClock is a Clock that only moves when told to. Advance and
+// AdvanceTo fire the timers and tickers they pass (tickers once, with
+// their last tick passed), so that tests don't wait, and
+// backfills can replay hours of windows and commits in seconds by
+// advancing the clock to the times of replayed events, e.g. from a
+// transformer:
+//
+//	clock := stream.NewFakeClock(start)
+//	p := stream.Pipeline{Clock: clock, ...}
+//	... clock.AdvanceTo(eventTime)
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	every time.Duration // tickers
+	c     chan time.Time
+}
+
+// NewFakeClock returns a FakeClock set to `now`.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) NewTimer(d time.Duration) Timer {
+	return f.add(d, 0)
+}
+
+func (f *FakeClock) NewTicker(d time.Duration) Timer {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	return f.add(d, d)
+}
+
+func (f *FakeClock) add(d, every time.Duration) *fakeTimer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{clock: f, at: f.now.Add(d), every: every, c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- f.now
+		return t
+	}
+	f.timers = append(f.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by `d`.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.AdvanceTo(f.Now().Add(d))
+}
+
+// AdvanceTo moves the clock forward to `t`, it doesn't move back.
+func (f *FakeClock) AdvanceTo(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !t.After(f.now) {
+		return
+	}
+	f.now = t
+
+	// fire in order of time
+	sort.SliceStable(f.timers, func(i, j int) bool { return f.timers[i].at.Before(f.timers[j].at) })
+	var pending []*fakeTimer
+	for _, timer := range f.timers {
+		if timer.at.After(t) {
+			pending = append(pending, timer)
+			continue
+		}
+		// tickers send their last tick passed
+		at := timer.at
+		for timer.every > 0 && !timer.at.After(t) {
+			at = timer.at
+			timer.at = timer.at.Add(timer.every)
+		}
+		select {
+		case timer.c <- at:
+		default:
+		}
+		if timer.every > 0 {
+			pending = append(pending, timer)
+		}
+	}
+	f.timers = pending
+}
+
+// Waiters returns the number of active timers and tickers, so that
+// tests can wait for goroutines to start waiting before advancing.
+func (f *FakeClock) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, timer := range f.timers {
+		if timer == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	timer := clock.NewTimer(time.Minute)
+	ticker := clock.NewTicker(20 * time.Second)
+	stopped := clock.NewTimer(time.Second)
+	stopped.Stop()
+	assert.Equal(t, 2, clock.Waiters())
+
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, start.Add(30*time.Second), clock.Now())
+	assert.Equal(t, start.Add(20*time.Second), <-ticker.C())
+	assert.Empty(t, timer.C())
+	assert.Empty(t, stopped.C())
+
+	// tickers send their last tick passed, the others are dropped
+	clock.AdvanceTo(start.Add(2 * time.Minute))
+	assert.Equal(t, start.Add(time.Minute), <-timer.C())
+	assert.Equal(t, start.Add(2*time.Minute), <-ticker.C())
+	assert.Empty(t, ticker.C())
+	assert.Equal(t, 1, clock.Waiters())
+
+	// the clock doesn't move back
+	clock.AdvanceTo(start)
+	assert.Equal(t, start.Add(2*time.Minute), clock.Now())
+	ticker.Stop()
+	assert.Equal(t, 0, clock.Waiters())
+
+	// expired timers fire right away
+	assert.Equal(t, clock.Now(), <-clock.NewTimer(0).C())
+}
+
+func TestWindow_FakeClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 10, 1, 12, 0, 30, 0, time.UTC))
+	dest := &outage{}
+	w := &Window{Destination: dest, Config: &WindowConfig{Size: 60}}
+	w.SetClock(clock)
+	assert.NoError(t, w.Connect())
+	defer w.Disconnect()
+
+	// processing time windows close as the clock moves
+	assert.NoError(t, w.Write(`{}`))
+	assert.NoError(t, w.Write(`{}`))
+	assert.Eventually(t, func() bool { return clock.Waiters() == 1 }, time.Second, time.Millisecond)
+	clock.Advance(time.Minute)
+	assert.Eventually(t, func() bool { return len(dest.written()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, `{"count":2,"end":"2020-10-01T12:01:00Z","key":"","start":"2020-10-01T12:00:00Z"}`, dest.written()[0])
+}
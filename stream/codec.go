@@ -0,0 +1,91 @@
+package stream
+
+import (
+	"github.com/abstractpaper/manifold/codec"
+	"github.com/abstractpaper/manifold/message"
+)
+
+// Codecs are the codecs of a pipeline's connectors (see codec.Codec),
+// each optional: Source decodes the messages read from the source
+// before they're transformed, Destination encodes the messages
+// written to the destination and DLQ the dead letters written to
+// the DLQ.
+//
+// Messages failing to decode are quarantined, as are messages
+// failing to encode, without retrying them.
+type Codecs struct {
+	Source      codec.Codec
+	Destination codec.Codec
+	DLQ         codec.Codec
+}
+
+// encodeError is the error of a message the destination's codec
+// failed to encode.
+type encodeError struct{ err error }
+
+func (e encodeError) Error() string { return "failed to encode message: " + e.err.Error() }
+func (e encodeError) Unwrap() error { return e.err }
+
+// decode decodes `msg` with the source's codec (if any). It returns
+// false if decoding failed, in which case the message is
+// quarantined.
+func (p *Pipeline) decode(msg message.Message) (message.Message, bool) {
+	if p.Codecs.Source == nil {
+		return msg, true
+	}
+
+	decoded, err := p.Codecs.Source.Decode([]byte(msg.Body))
+	if err != nil {
+		p.logger().Error("Failed to decode message: ", err)
+		msg.Done(p.reject(recordAttempt(msg, err), err))
+		return msg, false
+	}
+	metadata := msg.Metadata.Copy()
+	for k, v := range decoded.Metadata {
+		metadata[k] = v
+	}
+	msg.Body, msg.Metadata = decoded.Body, metadata
+	return msg, true
+}
+
+// encode encodes `msg` with the codec of `dest` if it is the
+// destination.
+func (p *Pipeline) encode(dest Destination, msg message.Message) (message.Message, error) {
+	if dest != p.Destination || p.Codecs.Destination == nil {
+		return msg, nil
+	}
+	data, err := p.Codecs.Destination.Encode(msg)
+	if err != nil {
+		return msg, encodeError{err}
+	}
+	msg.Body = string(data)
+	return msg, nil
+}
+
+// dlq returns the DLQ, encoding dead letters with the DLQ's codec.
+func (p *Pipeline) dlq() Destination {
+	if p.Codecs.DLQ == nil {
+		return p.DLQ
+	}
+	return &encoding{Destination: p.DLQ, codec: p.Codecs.DLQ}
+}
+
+// encoding encodes messages with codec before writing them to
+// Destination.
+type encoding struct {
+	Destination
+	codec codec.Codec
+}
+
+func (e *encoding) Write(body string) error {
+	return e.WriteMessage(message.New(body))
+}
+
+func (e *encoding) WriteMessage(m message.Message) error {
+	data, err := e.codec.Encode(m)
+	if err != nil {
+		return encodeError{err}
+	}
+	m.Body = string(data)
+	return writeMessage(e.Destination, m)
+}
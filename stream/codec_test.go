@@ -0,0 +1,65 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/abstractpaper/manifold/codec"
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeline_Codecs(t *testing.T) {
+	src := make(channelSource)
+	dest := &memory{}
+	dlq := &memory{}
+	p := &Pipeline{
+		Source:      src,
+		Destination: dest,
+		DLQ:         dlq,
+		Codecs:      Codecs{Source: codec.Msgpack{}, Destination: codec.JSON{}},
+	}
+	go func() {
+		// {"id": 1, "tags": ["a"]}
+		src <- message.New("\x82\xa2id\x01\xa4tags\x91\xa1a")
+		// fixint 49 and a byte too many
+		src <- message.New("12")
+		close(src)
+	}()
+	assert.NoError(t, p.RunUntilDrained())
+	assert.Equal(t, []string{`{"id":1,"tags":["a"]}`}, dest.messages)
+
+	// messages failing to decode are quarantined as read
+	if assert.Len(t, dlq.messages, 1) {
+		var letter DeadLetter
+		assert.NoError(t, json.Unmarshal([]byte(dlq.messages[0]), &letter))
+		assert.Equal(t, "12", letter.Message)
+		assert.Equal(t, []string{"codec: 1 bytes after msgpack value"}, letter.Errors)
+	}
+}
+
+func TestPipeline_EncodeFailure(t *testing.T) {
+	dest := &memory{}
+	dlq := &memory{}
+	p := &Pipeline{
+		Destination: dest,
+		DLQ:         dlq,
+		MaxAttempts: 3,
+		Codecs:      Codecs{Destination: codec.JSON{}, DLQ: codec.Msgpack{}},
+	}
+
+	// not retried
+	err := p.deliver(message.New("not JSON"))
+	assert.True(t, errors.Is(err, message.ErrQuarantined))
+	assert.Empty(t, dest.messages)
+	if assert.Len(t, dlq.messages, 1) {
+		decoded, err := codec.Msgpack{}.Decode([]byte(dlq.messages[0]))
+		assert.NoError(t, err)
+		var letter DeadLetter
+		assert.NoError(t, json.Unmarshal([]byte(decoded.Body), &letter))
+		assert.Equal(t, "not JSON", letter.Message)
+		assert.Equal(t, 1, letter.Attempts)
+		assert.Equal(t, []string{"failed to encode message: codec: invalid JSON"}, letter.Errors)
+	}
+}
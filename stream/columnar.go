@@ -0,0 +1,194 @@
+package stream
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	arrowMemory "github.com/apache/arrow/go/arrow/memory"
+)
+
+// Columnar destinations (ParquetDataset, DeltaLake) parse messages
+// once, when they're written, into columnarRows whose values have
+// the types of the columns. Batches of rows are then held as Arrow
+// records, an array per column, which are encoded without going
+// through JSON again.
+
+// arrowTypes maps column types to Arrow types.
+var arrowTypes = map[string]arrow.DataType{
+	"string":    arrow.BinaryTypes.String,
+	"long":      arrow.PrimitiveTypes.Int64,
+	"double":    arrow.PrimitiveTypes.Float64,
+	"boolean":   arrow.FixedWidthTypes.Boolean,
+	"timestamp": arrow.FixedWidthTypes.Timestamp_us,
+}
+
+// columnarRow is a message parsed for columnar destinations.
+type columnarRow struct {
+	partition []string      // values of the partition fields
+	values    []interface{} // see parquetRow
+}
+
+// parseColumnarRow decodes `m` as a JSON object and converts its
+// fields to the types of `columns` (see parquetRow). Values of the
+// `by` fields are formatted as strings, missing values are empty.
+// `defaults` are set for missing fields.
+func parseColumnarRow(m message.Message, by []string, columns []ParquetColumn, defaults map[string]interface{}) (r columnarRow, err error) {
+	p, err := parsePoint(m, "")
+	if err != nil {
+		return
+	}
+	for name, v := range defaults {
+		if _, ok := p.fields[name]; !ok {
+			p.fields[name] = v
+		}
+	}
+
+	for _, name := range by {
+		v := ""
+		if val, ok := p.fields[name]; ok && val != nil {
+			v = fmt.Sprint(val)
+		}
+		r.partition = append(r.partition, v)
+	}
+	r.values, err = parquetRow(p.fields, columns)
+	return
+}
+
+// batchRows returns the rows of a batcher's batch.
+func batchRows(batch []*batchEntry) []columnarRow {
+	rows := make([]columnarRow, len(batch))
+	for i, e := range batch {
+		rows[i] = e.value.(columnarRow)
+	}
+	return rows
+}
+
+// columnBatch is the rows of a partition as an Arrow record.
+type columnBatch struct {
+	values map[string]string // partition values
+	record array.Record
+	rows   []int // indexes of the rows in their batch
+}
+
+// arrowSchema returns the Arrow schema of `columns`; all columns are
+// nullable.
+func arrowSchema(columns []ParquetColumn) (*arrow.Schema, error) {
+	var fields []arrow.Field
+	for _, c := range columns {
+		t, ok := arrowTypes[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("column %s has unsupported type %q", c.Name, c.Type)
+		}
+		fields = append(fields, arrow.Field{Name: c.Name, Type: t, Nullable: true})
+	}
+	return arrow.NewSchema(fields, nil), nil
+}
+
+// partitionBatch groups `rows` by partition values into records of
+// `columns`. Records must be released.
+func partitionBatch(rows []columnarRow, by []string, columns []ParquetColumn) ([]*columnBatch, error) {
+	schema, err := arrowSchema(columns)
+	if err != nil {
+		return nil, err
+	}
+
+	type partition struct {
+		batch   *columnBatch
+		builder *array.RecordBuilder
+	}
+	var order []string
+	partitions := map[string]*partition{}
+	for i, r := range rows {
+		k := strings.Join(r.partition, "\x00")
+		part, ok := partitions[k]
+		if !ok {
+			values := map[string]string{}
+			for j, name := range by {
+				values[name] = r.partition[j]
+			}
+			part = &partition{
+				batch:   &columnBatch{values: values},
+				builder: array.NewRecordBuilder(arrowMemory.DefaultAllocator, schema),
+			}
+			partitions[k] = part
+			order = append(order, k)
+		}
+		appendRow(part.builder, r.values)
+		part.batch.rows = append(part.batch.rows, i)
+	}
+
+	var batches []*columnBatch
+	for _, k := range order {
+		part := partitions[k]
+		part.batch.record = part.builder.NewRecord()
+		part.builder.Release()
+		batches = append(batches, part.batch)
+	}
+	return batches, nil
+}
+
+// appendRow appends converted `values` to the builders of a record.
+func appendRow(b *array.RecordBuilder, values []interface{}) {
+	for i, v := range values {
+		field := b.Field(i)
+		if v == nil {
+			field.AppendNull()
+			continue
+		}
+		switch field := field.(type) {
+		case *array.StringBuilder:
+			field.Append(v.(string))
+		case *array.Int64Builder:
+			field.Append(v.(int64))
+		case *array.Float64Builder:
+			field.Append(v.(float64))
+		case *array.BooleanBuilder:
+			field.Append(v.(bool))
+		case *array.TimestampBuilder:
+			field.Append(arrow.Timestamp(v.(int64)))
+		}
+	}
+}
+
+// arrowValues returns a function returning the value of a row of
+// `column`, as converted by parquetRow, or nil. The type of the
+// column is resolved once, rather than for every value.
+func arrowValues(column array.Interface) func(i int) interface{} {
+	var value func(i int) interface{}
+	switch column := column.(type) {
+	case *array.String:
+		value = func(i int) interface{} { return column.Value(i) }
+	case *array.Int64:
+		values := column.Int64Values()
+		value = func(i int) interface{} { return values[i] }
+	case *array.Float64:
+		values := column.Float64Values()
+		value = func(i int) interface{} { return values[i] }
+	case *array.Boolean:
+		value = func(i int) interface{} { return column.Value(i) }
+	case *array.Timestamp:
+		values := column.TimestampValues()
+		value = func(i int) interface{} { return int64(values[i]) }
+	default:
+		return func(int) interface{} { return nil }
+	}
+	if column.NullN() == 0 {
+		return value
+	}
+	return func(i int) interface{} {
+		if column.IsNull(i) {
+			return nil
+		}
+		return value(i)
+	}
+}
+
+// releaseBatches releases the records of `batches`.
+func releaseBatches(batches []*columnBatch) {
+	for _, b := range batches {
+		b.record.Release()
+	}
+}
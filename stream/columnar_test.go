@@ -0,0 +1,44 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionBatch(t *testing.T) {
+	columns := []ParquetColumn{
+		{Name: "temp", Type: "double"},
+		{Name: "ts", Type: "timestamp"},
+	}
+	var rows []columnarRow
+	for _, body := range []string{
+		`{"device":"d1","temp":21.5}`,
+		`{"device":"d2"}`,
+		`{"device":"d1","temp":22}`,
+	} {
+		r, err := parseColumnarRow(message.New(body), []string{"device"}, columns, map[string]interface{}{"ts": float64(1601553600000)})
+		assert.NoError(t, err)
+		rows = append(rows, r)
+	}
+
+	batches, err := partitionBatch(rows, []string{"device"}, columns)
+	assert.NoError(t, err)
+	defer releaseBatches(batches)
+
+	assert.Len(t, batches, 2)
+	assert.Equal(t, map[string]string{"device": "d1"}, batches[0].values)
+	assert.Equal(t, []int{0, 2}, batches[0].rows)
+	assert.Equal(t, int64(2), batches[0].record.NumRows())
+	assert.Equal(t, 21.5, arrowValues(batches[0].record.Column(0))(0))
+	assert.Equal(t, 22.0, arrowValues(batches[0].record.Column(0))(1))
+	assert.Equal(t, int64(1601553600000000), arrowValues(batches[0].record.Column(1))(0))
+
+	assert.Equal(t, []int{1}, batches[1].rows)
+	assert.Nil(t, arrowValues(batches[1].record.Column(0))(0))
+
+	data, err := encodeParquet(columns, batches[0].record)
+	assert.NoError(t, err)
+	assert.Equal(t, "PAR1", string(data[:4]))
+}
@@ -0,0 +1,57 @@
+package stream
+
+import (
+	"sync/atomic"
+
+	"github.com/bkaradzic/go-lz4"
+)
+
+// Buffers holding large backlogs (partition lanes, S3 buffer files)
+// can be compressed with LZ4, which trades CPU for memory and disk.
+// Messages are compressed one by one, so small messages compress
+// poorly: those that don't shrink are kept as is.
+
+// CompressionStats counts the bytes compressed into a buffer.
+type CompressionStats struct {
+	Raw        uint64 `json:"raw"`        // bytes of the messages
+	Compressed uint64 `json:"compressed"` // bytes buffered
+}
+
+// Ratio returns Raw / Compressed, or 0 if nothing was compressed.
+func (c CompressionStats) Ratio() float64 {
+	if c.Compressed == 0 {
+		return 0
+	}
+	return float64(c.Raw) / float64(c.Compressed)
+}
+
+// compressor compresses messages with LZ4, counting bytes.
+type compressor struct {
+	stats CompressionStats // updated atomically
+}
+
+// compress returns the LZ4 block of `data` and true, or `data` and
+// false if compressing doesn't make it smaller.
+func (c *compressor) compress(data []byte) ([]byte, bool) {
+	block, err := lz4.Encode(nil, data)
+	ok := err == nil && len(block) < len(data)
+	if !ok {
+		block = data
+	}
+	atomic.AddUint64(&c.stats.Raw, uint64(len(data)))
+	atomic.AddUint64(&c.stats.Compressed, uint64(len(block)))
+	return block, ok
+}
+
+// snapshot returns the counters of `c`.
+func (c *compressor) snapshot() CompressionStats {
+	return CompressionStats{
+		Raw:        atomic.LoadUint64(&c.stats.Raw),
+		Compressed: atomic.LoadUint64(&c.stats.Compressed),
+	}
+}
+
+// decompress returns the data of an LZ4 block.
+func decompress(block []byte) ([]byte, error) {
+	return lz4.Decode(nil, block)
+}
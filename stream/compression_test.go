@@ -0,0 +1,30 @@
+package stream
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressor(t *testing.T) {
+	c := &compressor{}
+	large := []byte(strings.Repeat(`{"a":1}`, 100))
+	block, ok := c.compress(large)
+	assert.True(t, ok)
+	assert.Less(t, len(block), len(large))
+	data, err := decompress(block)
+	assert.NoError(t, err)
+	assert.Equal(t, large, data)
+
+	// small messages don't shrink and are kept as is
+	small := []byte(`{"a":1}`)
+	block, ok = c.compress(small)
+	assert.False(t, ok)
+	assert.Equal(t, small, block)
+
+	stats := c.snapshot()
+	assert.Equal(t, uint64(len(large)+len(small)), stats.Raw)
+	assert.Greater(t, stats.Ratio(), 1.0)
+	assert.Equal(t, 0.0, CompressionStats{}.Ratio())
+}
@@ -0,0 +1,452 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// deltaLog is the directory of a Delta table's transaction log.
+const deltaLog = "_delta_log/"
+
+// DeltaLake writes JSON messages to a Delta Lake table: rows are
+// written as Parquet data files and each flush is committed to the
+// table's transaction log, so readers (Spark, Trino, DuckDB...) see
+// atomic table versions rather than loose files.
+//
+// Path is the table location, an s3://bucket/prefix URL (using
+// AWSConfig) or a local directory. The table is created with
+// Config.Columns (see ParquetColumn) and Config.PartitionBy if it
+// doesn't exist; the columns of an existing table are read from its
+// log. Commits to local tables detect concurrent writers, S3 has no
+// atomic create so an S3 table must have a single writer.
+//
+// Timestamp columns missing from a message are set to the time it
+// is written. Messages are parsed into rows when they're written,
+// rows are batched as Arrow records (see columnarRow) and committed
+// every Config.FlushEvery seconds or Config.BatchSize rows, with a
+// data file per partition. Failed commits are retried
+// Config.MaxRetries times. Messages written with WriteAsync (as pipelines do) are
+// acknowledged once their rows are committed.
+type DeltaLake struct {
+	Path       string
+	AWSConfig  *aws.Config      // defaults to the default credential chain
+	AWSSess    *session.Session // v1 session used if AWSConfig isn't set
+	RoleARN    string           // role assumed to access S3
+	ExternalID string           // external ID of RoleARN, if required
+	Config     *DeltaLakeConfig
+	store      objectStore
+	columns    []ParquetColumn
+	batcher    *batcher
+	ctx        context.Context
+	cancel     context.CancelFunc
+	clocked
+	logged
+}
+
+// DeltaLakeConfig configures the table schema and commits.
+type DeltaLakeConfig struct {
+	Columns     []ParquetColumn
+	PartitionBy []string
+	BatchSize   int // rows per commit, defaults to 100000
+	FlushEvery  int // seconds, defaults to 60
+	MaxRetries  int // retries of failed commits, defaults to 3
+}
+
+// deltaAction is an action of a Delta commit.
+type deltaAction struct {
+	Protocol   *deltaProtocol         `json:"protocol,omitempty"`
+	MetaData   *deltaMetaData         `json:"metaData,omitempty"`
+	Add        *deltaAdd              `json:"add,omitempty"`
+	CommitInfo map[string]interface{} `json:"commitInfo,omitempty"`
+}
+
+type deltaProtocol struct {
+	MinReaderVersion int `json:"minReaderVersion"`
+	MinWriterVersion int `json:"minWriterVersion"`
+}
+
+type deltaMetaData struct {
+	ID               string            `json:"id"`
+	Format           deltaFormat       `json:"format"`
+	SchemaString     string            `json:"schemaString"`
+	PartitionColumns []string          `json:"partitionColumns"`
+	Configuration    map[string]string `json:"configuration"`
+	CreatedTime      int64             `json:"createdTime"`
+}
+
+type deltaFormat struct {
+	Provider string            `json:"provider"`
+	Options  map[string]string `json:"options"`
+}
+
+type deltaAdd struct {
+	Path             string                 `json:"path"`
+	PartitionValues  map[string]interface{} `json:"partitionValues"` // null for missing values
+	Size             int64                  `json:"size"`
+	ModificationTime int64                  `json:"modificationTime"`
+	DataChange       bool                   `json:"dataChange"`
+}
+
+// deltaSchema is a table schema in Spark's JSON format.
+type deltaSchema struct {
+	Type   string             `json:"type"`
+	Fields []deltaSchemaField `json:"fields"`
+}
+
+type deltaSchemaField struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Nullable bool              `json:"nullable"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+func (d *DeltaLake) Connect() (err error) {
+	if d.Config == nil {
+		d.Config = &DeltaLakeConfig{}
+	}
+	if d.Config.BatchSize < 1 {
+		d.Config.BatchSize = 100000
+	}
+	if d.Config.FlushEvery < 1 {
+		d.Config.FlushEvery = 60
+	}
+	if d.Config.MaxRetries < 1 {
+		d.Config.MaxRetries = 3
+	}
+
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	if d.store == nil {
+		d.store, err = newObjectStore(d.ctx, d.Path, d.AWSConfig, d.AWSSess, "", d.RoleARN, d.ExternalID)
+		if err != nil {
+			return
+		}
+	}
+
+	err = d.open()
+	if err != nil {
+		d.logger().Error("DeltaLake: Failed to open table: ", err)
+		return
+	}
+
+	d.batcher = newBatcher("DeltaLake", d.logger(), d.clock(), d.Config.BatchSize, time.Duration(d.Config.FlushEvery)*time.Second, d.Config.MaxRetries, d.flush)
+
+	return
+}
+
+// open reads the schema of the table, creating the table if it
+// doesn't exist.
+func (d *DeltaLake) open() error {
+	version, err := d.version()
+	if err != nil {
+		return err
+	}
+
+	if version < 0 {
+		d.logger().Info("DeltaLake: Creating table ", d.Path)
+		err = d.create()
+		if err == errObjectExists {
+			// created concurrently
+			return d.open()
+		}
+		return err
+	}
+
+	meta, err := d.metaData(version)
+	if err != nil {
+		return err
+	}
+	var schema deltaSchema
+	err = json.Unmarshal([]byte(meta.SchemaString), &schema)
+	if err != nil {
+		return err
+	}
+	d.columns = nil
+	for _, f := range schema.Fields {
+		if _, ok := parquetTypes[f.Type]; !ok {
+			return fmt.Errorf("column %s has unsupported type %q", f.Name, f.Type)
+		}
+		d.columns = append(d.columns, ParquetColumn{Name: f.Name, Type: f.Type})
+	}
+	d.Config.PartitionBy = meta.PartitionColumns
+	return nil
+}
+
+// create commits version 0 of the table.
+func (d *DeltaLake) create() error {
+	if len(d.Config.Columns) == 0 {
+		return errors.New("columns must be configured to create a table")
+	}
+
+	schema := deltaSchema{Type: "struct"}
+	for _, c := range d.Config.Columns {
+		if _, ok := parquetTypes[c.Type]; !ok {
+			return fmt.Errorf("column %s has unsupported type %q", c.Name, c.Type)
+		}
+		schema.Fields = append(schema.Fields, deltaSchemaField{
+			Name: c.Name, Type: c.Type, Nullable: true, Metadata: map[string]string{},
+		})
+	}
+	schemaString, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+
+	partitionBy := d.Config.PartitionBy
+	if partitionBy == nil {
+		partitionBy = []string{}
+	}
+	d.columns = d.Config.Columns
+	return d.commit(0, []deltaAction{
+		{Protocol: &deltaProtocol{MinReaderVersion: 1, MinWriterVersion: 2}},
+		{MetaData: &deltaMetaData{
+			ID:               newUUID(),
+			Format:           deltaFormat{Provider: "parquet", Options: map[string]string{}},
+			SchemaString:     string(schemaString),
+			PartitionColumns: partitionBy,
+			Configuration:    map[string]string{},
+			CreatedTime:      time.Now().UnixNano() / int64(time.Millisecond),
+		}},
+	}, "CREATE TABLE")
+}
+
+// version returns the latest version of the table, or -1 if it
+// doesn't exist.
+func (d *DeltaLake) version() (int64, error) {
+	keys, err := d.store.list(d.ctx, deltaLog)
+	if err != nil {
+		return 0, err
+	}
+
+	version := int64(-1)
+	for _, key := range keys {
+		name := strings.TrimSuffix(path.Base(key), ".json")
+		if name == path.Base(key) {
+			continue
+		}
+		if v, err := strconv.ParseInt(name, 10, 64); err == nil && v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// metaData returns the latest metaData action up to `version`.
+func (d *DeltaLake) metaData(version int64) (*deltaMetaData, error) {
+	for v := version; v >= 0; v-- {
+		data, err := d.store.get(d.ctx, deltaCommit(v))
+		if err != nil {
+			return nil, err
+		}
+
+		var meta *deltaMetaData
+		for _, line := range strings.Split(string(data), "\n") {
+			var action deltaAction
+			if json.Unmarshal([]byte(line), &action) == nil && action.MetaData != nil {
+				meta = action.MetaData
+			}
+		}
+		if meta != nil {
+			return meta, nil
+		}
+	}
+	return nil, errors.New("table has no metadata")
+}
+
+// commit writes `actions` as `version` of the log.
+func (d *DeltaLake) commit(version int64, actions []deltaAction, operation string) error {
+	actions = append(actions, deltaAction{CommitInfo: map[string]interface{}{
+		"timestamp":  time.Now().UnixNano() / int64(time.Millisecond),
+		"operation":  operation,
+		"engineInfo": "manifold",
+	}})
+
+	var lines []string
+	for _, a := range actions {
+		data, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, string(data))
+	}
+	return d.store.create(d.ctx, deltaCommit(version), []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// deltaCommit returns the key of commit `version`.
+func deltaCommit(version int64) string {
+	return fmt.Sprintf("%s%020d.json", deltaLog, version)
+}
+
+// Disconnect commits buffered rows.
+func (d *DeltaLake) Disconnect() (err error) {
+	if d.batcher != nil {
+		d.batcher.close()
+		d.batcher = nil
+	}
+	if d.cancel != nil {
+		d.cancel()
+	}
+	return
+}
+
+// Resources returns the bucket of Path, if it is on S3.
+func (d *DeltaLake) Resources() []Resource {
+	return storeResources(d.Path, configRegion(d.AWSConfig, d.AWSSess))
+}
+
+func (d *DeltaLake) Capabilities() Capabilities {
+	return Capabilities{ConfirmedWrites: true, Batching: true, Schemas: true}
+}
+
+func (d *DeltaLake) Info() {
+	d.logger().Info("DeltaLake.Path: ", d.Path)
+	d.logger().Infof("DeltaLakeConfig: %+v", *d.Config)
+}
+
+func (d *DeltaLake) Write(body string) (err error) {
+	return d.WriteMessage(message.New(body))
+}
+
+// WriteMessage buffers a row for `m`.
+func (d *DeltaLake) WriteMessage(m message.Message) (err error) {
+	r, err := d.row(m)
+	if err != nil {
+		return
+	}
+	d.batcher.add(r, nil)
+	return
+}
+
+// WriteAsync buffers a row for `m` and calls `done` once it has been
+// committed.
+func (d *DeltaLake) WriteAsync(m message.Message, done func(error)) {
+	r, err := d.row(m)
+	if err != nil {
+		done(err)
+		return
+	}
+	d.batcher.add(r, done)
+}
+
+// row parses `m` into a row of the table's data files, defaulting
+// missing timestamps to the current time.
+func (d *DeltaLake) row(m message.Message) (columnarRow, error) {
+	defaults := map[string]interface{}{}
+	now := time.Now().Format(time.RFC3339Nano)
+	for _, c := range d.columns {
+		if c.Type == "timestamp" {
+			defaults[c.Name] = now
+		}
+	}
+	return parseColumnarRow(m, d.Config.PartitionBy, d.dataColumns(), defaults)
+}
+
+// dataColumns returns the columns stored in data files, partition
+// values are not.
+func (d *DeltaLake) dataColumns() []ParquetColumn {
+	partitioned := map[string]bool{}
+	for _, name := range d.Config.PartitionBy {
+		partitioned[name] = true
+	}
+	var columns []ParquetColumn
+	for _, c := range d.columns {
+		if !partitioned[c.Name] {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+// flush writes a data file per partition of `batch` and commits
+// them.
+func (d *DeltaLake) flush(batch []*batchEntry) error {
+	return d.append(batchRows(batch))
+}
+
+// append writes data files for `batch` and commits them as the next
+// version of the table.
+func (d *DeltaLake) append(batch []columnarRow) error {
+	columns := d.dataColumns()
+	parts, err := partitionBatch(batch, d.Config.PartitionBy, columns)
+	if err != nil {
+		return err
+	}
+	defer releaseBatches(parts)
+
+	var actions []deltaAction
+	for _, part := range parts {
+		data, err := encodeParquet(columns, part.record)
+		if err != nil {
+			return err
+		}
+
+		key := hivePath(d.Config.PartitionBy, part.values) +
+			fmt.Sprintf("part-00000-%s-c000.snappy.parquet", newUUID())
+		err = d.store.put(d.ctx, key, data)
+		if err != nil {
+			return err
+		}
+
+		values := map[string]interface{}{}
+		for name, v := range part.values {
+			if v == "" {
+				values[name] = nil
+			} else {
+				values[name] = v
+			}
+		}
+		actions = append(actions, deltaAction{Add: &deltaAdd{
+			Path:             key,
+			PartitionValues:  values,
+			Size:             int64(len(data)),
+			ModificationTime: time.Now().UnixNano() / int64(time.Millisecond),
+			DataChange:       true,
+		}})
+	}
+
+	for {
+		version, err := d.version()
+		if err != nil {
+			return err
+		}
+		err = d.commit(version+1, actions, "STREAMING UPDATE")
+		if err != errObjectExists {
+			if err == nil {
+				d.logger().Infof("DeltaLake: Committed version %d (%d rows)", version+1, len(batch))
+			}
+			return err
+		}
+		// a concurrent writer committed this version, retry on top
+		// of it
+	}
+}
+
+// hivePath returns the Hive-style directory of partition `values`,
+// e.g. "date=2020-10-01/region=eu/".
+func hivePath(by []string, values map[string]string) string {
+	var dirs []string
+	for _, name := range by {
+		v := values[name]
+		if v == "" {
+			v = "__HIVE_DEFAULT_PARTITION__"
+		}
+		dirs = append(dirs, url.PathEscape(name)+"="+url.PathEscape(v))
+	}
+	if len(dirs) == 0 {
+		return ""
+	}
+	return strings.Join(dirs, "/") + "/"
+}
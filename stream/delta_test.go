@@ -0,0 +1,154 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestDeltaLake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := func() *DeltaLakeConfig {
+		return &DeltaLakeConfig{
+			Columns: []ParquetColumn{
+				{Name: "region", Type: "string"},
+				{Name: "device", Type: "string"},
+				{Name: "temp", Type: "double"},
+				{Name: "count", Type: "long"},
+				{Name: "ts", Type: "timestamp"},
+			},
+			PartitionBy: []string{"region"},
+		}
+	}
+	dest := &DeltaLake{Path: dir, Config: config()}
+	assert.NoError(t, dest.Connect())
+	assert.NoError(t, dest.Write(`{"region":"eu","device":"d1","temp":21.5,"count":3,"ts":1601553600000}`))
+	assert.NoError(t, dest.Write(`{"region":"us","device":"d2","temp":19}`))
+	assert.NoError(t, dest.Write(`{"region":"eu","device":"d3","extra":true}`))
+	assert.NoError(t, dest.Disconnect())
+
+	// reopen the existing table and append
+	dest = &DeltaLake{Path: dir}
+	assert.NoError(t, dest.Connect())
+	assert.Equal(t, []string{"region"}, dest.Config.PartitionBy)
+	assert.NoError(t, dest.Write(`{"region":"eu","device":"d4"}`))
+	assert.NoError(t, dest.Disconnect())
+
+	version, err := dest.version()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), version)
+
+	// version 1 adds a file per partition
+	data, err := ioutil.ReadFile(filepath.Join(dir, "_delta_log", "00000000000000000001.json"))
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 3)
+
+	var action deltaAction
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &action))
+	assert.Equal(t, map[string]interface{}{"region": "eu"}, action.Add.PartitionValues)
+	assert.True(t, strings.HasPrefix(action.Add.Path, "region=eu/part-00000-"))
+
+	fr, err := local.NewLocalFileReader(filepath.Join(dir, action.Add.Path))
+	assert.NoError(t, err)
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, nil, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), pr.GetNumRows())
+	pr.ReadStop()
+}
+
+// failingPuts is an objectStore whose data files can't be written.
+type failingPuts struct {
+	objectStore
+}
+
+func (failingPuts) put(ctx context.Context, key string, data []byte) error {
+	return errors.New("access denied")
+}
+
+func TestDeltaLake_WriteAsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := newObjectStore(context.Background(), dir, nil, nil, "", "", "")
+	assert.NoError(t, err)
+	dest := &DeltaLake{
+		Path: dir,
+		Config: &DeltaLakeConfig{
+			Columns:    []ParquetColumn{{Name: "device", Type: "string"}},
+			MaxRetries: 1,
+		},
+		store: failingPuts{store},
+	}
+	assert.NoError(t, dest.Connect())
+
+	var results []error
+	dest.WriteAsync(message.New(`{"device":"d1"}`), func(err error) { results = append(results, err) })
+	dest.WriteAsync(message.New(`not json`), func(err error) { results = append(results, err) })
+	assert.NoError(t, dest.Disconnect())
+
+	// the row isn't acknowledged as its data file wasn't written
+	assert.Len(t, results, 2)
+	assert.Error(t, results[0], "invalid JSON")
+	assert.EqualError(t, results[1], "access denied")
+
+	version, err := dest.version()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), version)
+}
+
+func TestDeltaLake_UnsupportedType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a table created by another engine
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "_delta_log"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "_delta_log", "00000000000000000000.json"), []byte(
+		`{"metaData":{"schemaString":"{\"type\":\"struct\",\"fields\":[{\"name\":\"count\",\"type\":\"integer\"}]}","partitionColumns":[]}}`+"\n",
+	), 0644))
+
+	dest := &DeltaLake{Path: dir}
+	assert.EqualError(t, dest.Connect(), `column count has unsupported type "integer"`)
+}
+
+func TestDeltaLake_InvalidRow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dest := &DeltaLake{Path: dir, Config: &DeltaLakeConfig{
+		Columns: []ParquetColumn{{Name: "count", Type: "long"}},
+	}}
+	assert.NoError(t, dest.Connect())
+
+	var results []error
+	for _, body := range []string{`{"count":3}`, `{"count":"42"}`, `{"count":3.7}`} {
+		dest.WriteAsync(message.New(body), func(err error) { results = append(results, err) })
+	}
+	assert.NoError(t, dest.Disconnect())
+
+	// only the mismatched rows fail
+	assert.Len(t, results, 3)
+	assert.EqualError(t, results[0], `column count: "42" is not a valid long`)
+	assert.EqualError(t, results[1], `column count: 3.7 is not a valid long`)
+	assert.NoError(t, results[2])
+}
@@ -0,0 +1,102 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// Metadata keys used to track delivery attempts of a message.
+//
+// Sources that redeliver messages across restarts (e.g. RabbitMQ
+// with manual acknowledgements) seed MetaAttempts so that attempts
+// made by a previous process count towards Pipeline.MaxAttempts.
+const (
+	MetaAttempts = "manifold.attempts"
+	MetaErrors   = "manifold.errors"
+)
+
+var errAttemptsExhausted = errors.New("delivery attempts exhausted")
+
+// DeliveryError is the error a message is acknowledged with when it
+// could neither be delivered nor quarantined. It carries the attempt
+// count and error history of the message, so that sources requeueing
+// it can persist them (see RabbitMQ).
+type DeliveryError struct {
+	Err      error
+	Attempts int
+	Errors   []string
+}
+
+func (e *DeliveryError) Error() string { return e.Err.Error() }
+func (e *DeliveryError) Unwrap() error { return e.Err }
+
+// quarantinedError is the error of a message quarantined after
+// failing with `err`, it matches both message.ErrQuarantined and
+// `err`.
+type quarantinedError struct{ err error }
+
+func (e quarantinedError) Error() string        { return "message quarantined: " + e.err.Error() }
+func (e quarantinedError) Is(target error) bool { return target == message.ErrQuarantined }
+func (e quarantinedError) Unwrap() error        { return e.err }
+
+// failure returns a DeliveryError for `m` failing with `err`.
+func failure(m message.Message, err error) *DeliveryError {
+	return &DeliveryError{Err: err, Attempts: attempts(m), Errors: deliveryErrors(m)}
+}
+
+// DeadLetter is the envelope written to a DLQ for a quarantined
+// message.
+type DeadLetter struct {
+	Message  string            `json:"message"`
+	Metadata map[string]string `json:"metadata"`
+	Attempts int               `json:"attempts"`
+	Errors   []string          `json:"errors"`
+}
+
+// attempts returns the number of delivery attempts made for `m`.
+func attempts(m message.Message) int {
+	n, _ := strconv.Atoi(m.Metadata.Get(MetaAttempts))
+	return n
+}
+
+// deliveryErrors returns the error history of `m`.
+func deliveryErrors(m message.Message) (errs []string) {
+	if val := m.Metadata.Get(MetaErrors); val != "" {
+		json.Unmarshal([]byte(val), &errs)
+	}
+	return
+}
+
+// recordAttempt returns a copy of `m` with its attempt count
+// incremented and `err` (if any) appended to its error history.
+func recordAttempt(m message.Message, err error) message.Message {
+	m.Metadata = m.Metadata.Copy()
+	m.Metadata[MetaAttempts] = strconv.Itoa(attempts(m) + 1)
+	if err != nil {
+		errs, _ := json.Marshal(append(deliveryErrors(m), err.Error()))
+		m.Metadata[MetaErrors] = string(errs)
+	}
+	return m
+}
+
+// quarantine writes `m` wrapped in a DeadLetter to `dlq`.
+func quarantine(dlq Destination, m message.Message) error {
+	metadata := m.Metadata.Copy()
+	delete(metadata, MetaAttempts)
+	delete(metadata, MetaErrors)
+
+	letter, err := json.Marshal(DeadLetter{
+		Message:  m.Body,
+		Metadata: metadata,
+		Attempts: attempts(m),
+		Errors:   deliveryErrors(m),
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeMessage(dlq, message.Message{Body: string(letter), Metadata: m.Metadata})
+}
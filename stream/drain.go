@@ -0,0 +1,117 @@
+package stream
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Drainer is an optional interface implemented by connectors with
+// work to complete before a graceful stop (see Pipeline.Drain), e.g.
+// S3 uploads its buffer and Kinesis stores the checkpoints of its
+// shards. Drain returns once it is done, or with an error if `ctx`
+// is done first.
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// Drain stops the pipeline gracefully: it stops reading from the
+// source, waits for the messages read so far to be processed, drains
+// the destination and DLQ (or flushes them if they are Flushers but
+// not Drainers) and then the source, e.g. to checkpoint its position.
+// It returns ctx.Err() if `ctx` is done first, in which case the
+// pipeline can be disconnected right away (a hard stop), unfinished
+// messages being redelivered by sources that acknowledge them.
+//
+// Run drains the pipeline on SIGINT or SIGTERM within DrainTimeout,
+// and returns once it has disconnected; Drain can be called
+// concurrently with Run or RunUntilDrained as well, which disconnect
+// once it returns.
+func (p *Pipeline) Drain(ctx context.Context) error {
+	p.drainWG.Add(1)
+	return p.drainRegistered(ctx)
+}
+
+// drainRegistered drains the pipeline like Drain, once the call was
+// added to drainWG so that running pipelines wait for it before they
+// disconnect. It marks the call done.
+func (p *Pipeline) drainRegistered(ctx context.Context) error {
+	defer p.drainWG.Done()
+	p.Stop()
+
+	select {
+	case <-p.flowed():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		err := drain(ctx, p.Destination)
+		if derr := drain(ctx, p.DLQ); derr != nil {
+			err = derr
+		}
+		if s, ok := p.Source.(Drainer); ok {
+			if serr := s.Drain(ctx); serr != nil {
+				err = serr
+			}
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drain drains `dest` if it is a Drainer, or flushes it if it is a
+// Flusher.
+func drain(ctx context.Context, dest Destination) error {
+	switch d := dest.(type) {
+	case Drainer:
+		return d.Drain(ctx)
+	case Flusher:
+		return d.Flush()
+	}
+	return nil
+}
+
+// drainOnSignal drains the pipeline within DrainTimeout after an
+// interrupt signal, stopping right away on a second one.
+func (p *Pipeline) drainOnSignal(sig os.Signal, interrupt <-chan os.Signal) {
+	timeout := p.DrainTimeout
+	if timeout <= 0 {
+		timeout = 25 * time.Second
+	}
+	p.logger().Infof("%s received, draining messages in flight (for up to %s)...", sig, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-interrupt:
+			p.logger().Warn("Second signal received, stopping now.")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := p.Drain(ctx)
+	if err != nil {
+		p.logger().Error("Failed to drain the pipeline, stopping now: ", err)
+		return
+	}
+	p.logger().Info("Pipeline drained.")
+}
+
+// flowed returns a channel closed once the pipeline has stopped
+// flowing.
+func (p *Pipeline) flowed() chan struct{} {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	if p.flowDone == nil {
+		p.flowDone = make(chan struct{})
+	}
+	return p.flowDone
+}
@@ -0,0 +1,72 @@
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// draining is a connector recording the time it was drained.
+type draining struct {
+	drained chan time.Time
+}
+
+func (d draining) Drain(ctx context.Context) error {
+	d.drained <- time.Now()
+	return nil
+}
+
+type drainingSource struct {
+	channelSource
+	draining
+}
+
+type drainingDestination struct {
+	memory
+	draining
+}
+
+func TestPipeline_Drain(t *testing.T) {
+	src := drainingSource{make(channelSource), draining{make(chan time.Time, 1)}}
+	dest := &drainingDestination{draining: draining{make(chan time.Time, 1)}}
+	p := &Pipeline{Source: src, Destination: dest}
+	done := make(chan error)
+	go func() { done <- p.RunUntilDrained() }()
+	src.channelSource <- message.New("a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, p.Drain(ctx))
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{"a"}, dest.messages)
+	// the destination is drained before the source checkpoints
+	destDrained, srcDrained := <-dest.drained, <-src.drained
+	assert.False(t, srcDrained.Before(destDrained))
+}
+
+func TestPipeline_DrainDeadline(t *testing.T) {
+	src := make(channelSource)
+	dest := &hung{release: make(chan bool)}
+	p := &Pipeline{Source: src, Destination: dest}
+	done := make(chan error)
+	go func() { done <- p.RunUntilDrained() }()
+	src <- message.New("a")
+
+	// the write in flight outlasts the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, p.Drain(ctx))
+
+	close(dest.release)
+	assert.NoError(t, <-done)
+}
+
+func TestRouter_Drain(t *testing.T) {
+	s3 := &drainingDestination{draining: draining{make(chan time.Time, 1)}}
+	r := &Router{Routes: []Route{{Name: "archive", When: "true", Destination: s3}}, Default: &memory{}}
+	assert.NoError(t, drain(context.Background(), r))
+	assert.Len(t, s3.drained, 1)
+}
@@ -0,0 +1,267 @@
+package stream
+
+import (
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// DynamicDestination writes each message to a destination picked
+// by rendering the Key template against it. Destinations are
+// created on demand by New, connected and cached per key.
+//
+// Cached destinations that haven't been written to for IdleTimeout
+// are disconnected and evicted; when MaxInstances destinations are
+// cached, the least recently used one is evicted to make room.
+//
+// Example (one Kinesis stream per region):
+//
+//	dest := stream.DynamicDestination{
+//	    Key: "{{.Fields.region}}",
+//	    New: func(region string) (stream.Destination, error) {
+//	        return &stream.Kinesis{
+//	            AWSConfig: configs[region],
+//	            Args: map[string]string{
+//	                "partitionKey": "partition1",
+//	                "streamName":   "events-" + region,
+//	            },
+//	        }, nil
+//	    },
+//	}
+type DynamicDestination struct {
+	Key          string
+	New          func(key string) (Destination, error)
+	MaxInstances int           // defaults to 100
+	IdleTimeout  time.Duration // defaults to 10 minutes
+	key          *template.Template
+	instances    map[string]*instance
+	mu           sync.Mutex // guards instances
+	done         chan bool
+	closeOnce    sync.Once
+	clocked
+	logged
+}
+
+// instance is a cached destination. Writes to it are serialized by
+// its mutex, which eviction also takes so that it only disconnects
+// the destination once in-flight writes are done.
+type instance struct {
+	sync.Mutex
+	dest     Destination
+	err      error
+	ready    chan bool // closed once dest is connected (or failed to)
+	closed   bool
+	lastUsed time.Time
+}
+
+func (d *DynamicDestination) Connect() (err error) {
+	if d.MaxInstances < 1 {
+		d.MaxInstances = 100
+	}
+	if d.IdleTimeout <= 0 {
+		d.IdleTimeout = 10 * time.Minute
+	}
+
+	d.key, err = newTemplate("key", d.Key)
+	if err != nil {
+		return
+	}
+	d.instances = map[string]*instance{}
+	d.done = make(chan bool)
+	d.closeOnce = sync.Once{}
+	go d.evictor()
+
+	return
+}
+
+// Disconnect disconnects all cached destinations.
+func (d *DynamicDestination) Disconnect() (err error) {
+	d.closeOnce.Do(func() { close(d.done) })
+
+	d.mu.Lock()
+	var victims []string
+	for key := range d.instances {
+		victims = append(victims, key)
+	}
+	evicted := d.remove(victims...)
+	d.mu.Unlock()
+
+	for key, inst := range evicted {
+		inst.close(key, d.logger())
+	}
+	return
+}
+
+func (d *DynamicDestination) Info() {
+	d.logger().Info("DynamicDestination.Key: ", d.Key)
+	d.logger().Info("DynamicDestination.MaxInstances: ", d.MaxInstances)
+	d.logger().Info("DynamicDestination.IdleTimeout: ", d.IdleTimeout)
+}
+
+func (d *DynamicDestination) Write(body string) (err error) {
+	return d.WriteMessage(message.New(body))
+}
+
+// WriteMessage writes `m` to the destination of its key.
+func (d *DynamicDestination) WriteMessage(m message.Message) (err error) {
+	key, err := executeTemplate(d.key, m)
+	if err != nil {
+		return
+	}
+
+	for {
+		inst, err := d.instance(key)
+		if err != nil {
+			return err
+		}
+
+		inst.Lock()
+		if !inst.closed {
+			err = writeMessage(inst.dest, m)
+			inst.Unlock()
+			return err
+		}
+		// evicted meanwhile
+		inst.Unlock()
+	}
+}
+
+// instance returns the connected destination of `key`, creating it
+// if needed. Destinations are created and connected without holding
+// d.mu, and the least recently used destination is only evicted once
+// the new one has connected.
+func (d *DynamicDestination) instance(key string) (*instance, error) {
+	d.mu.Lock()
+	inst, ok := d.instances[key]
+	if ok {
+		inst.lastUsed = d.clock().Now()
+		d.mu.Unlock()
+		<-inst.ready
+		return inst, inst.err
+	}
+
+	inst = &instance{ready: make(chan bool), lastUsed: d.clock().Now()}
+	d.instances[key] = inst
+	d.mu.Unlock()
+
+	d.logger().Infof("DynamicDestination: creating destination for key %q", key)
+	inst.dest, inst.err = d.connect(key)
+
+	d.mu.Lock()
+	var evicted map[string]*instance
+	if inst.err != nil {
+		delete(d.instances, key)
+	} else if len(d.instances) > d.MaxInstances {
+		evicted = d.remove(d.leastRecentlyUsed())
+	}
+	close(inst.ready)
+	d.mu.Unlock()
+
+	for k, victim := range evicted {
+		victim.close(k, d.logger())
+	}
+	return inst, inst.err
+}
+
+// connect creates and connects the destination of `key`.
+func (d *DynamicDestination) connect(key string) (Destination, error) {
+	dest, err := d.New(key)
+	if err != nil {
+		return nil, err
+	}
+	// created destinations share the clock set on d
+	if c, ok := dest.(Clocked); ok && d.c != nil {
+		c.SetClock(d.c)
+	}
+	setLogger(dest, d.logger().WithField("dynamicKey", key))
+	err = dest.Connect()
+	if err != nil {
+		return nil, err
+	}
+	dest.Info()
+	return dest, nil
+}
+
+// evictor evicts idle destinations until Disconnect is called.
+func (d *DynamicDestination) evictor() {
+	ticker := d.clock().NewTicker(d.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C():
+			d.mu.Lock()
+			var idle []string
+			for key, inst := range d.instances {
+				if connected(inst) && d.clock().Now().Sub(inst.lastUsed) >= d.IdleTimeout {
+					idle = append(idle, key)
+				}
+			}
+			evicted := d.remove(idle...)
+			d.mu.Unlock()
+
+			for key, inst := range evicted {
+				inst.close(key, d.logger())
+			}
+		}
+	}
+}
+
+// leastRecentlyUsed returns the key of the least recently used
+// connected destination, d.mu must be held.
+func (d *DynamicDestination) leastRecentlyUsed() (lru string) {
+	var oldest time.Time
+	for key, inst := range d.instances {
+		if !connected(inst) {
+			continue
+		}
+		if oldest.IsZero() || inst.lastUsed.Before(oldest) {
+			lru, oldest = key, inst.lastUsed
+		}
+	}
+	return
+}
+
+// remove removes the instances of `keys` from the cache and returns
+// them to be closed, d.mu must be held.
+func (d *DynamicDestination) remove(keys ...string) map[string]*instance {
+	removed := map[string]*instance{}
+	for _, key := range keys {
+		if inst, ok := d.instances[key]; ok {
+			removed[key] = inst
+			delete(d.instances, key)
+		}
+	}
+	return removed
+}
+
+// connected reports whether `inst` has been connected.
+func connected(inst *instance) bool {
+	select {
+	case <-inst.ready:
+		return inst.err == nil
+	default:
+		return false
+	}
+}
+
+// close disconnects the destination of `inst` once in-flight writes
+// are done.
+func (inst *instance) close(key string, logger Logger) {
+	<-inst.ready
+	if inst.err != nil {
+		return
+	}
+
+	inst.Lock()
+	defer inst.Unlock()
+	logger.Infof("DynamicDestination: evicting destination for key %q", key)
+	inst.closed = true
+	err := inst.dest.Disconnect()
+	if err != nil {
+		logger.Error("DynamicDestination: disconnect: ", err)
+	}
+}
@@ -0,0 +1,88 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDynamicDestination(t *testing.T) {
+	created := map[string]*memory{}
+	dest := &DynamicDestination{
+		Key: "{{.Fields.region}}",
+		New: func(key string) (Destination, error) {
+			created[key] = &memory{}
+			return created[key], nil
+		},
+		MaxInstances: 2,
+		IdleTimeout:  time.Hour,
+	}
+	assert.NoError(t, dest.Connect())
+	defer dest.Disconnect()
+
+	for _, body := range []string{
+		`{"region":"us"}`,
+		`{"region":"eu"}`,
+		`{"region":"us"}`,
+		`{"region":"ap"}`, // evicts eu
+	} {
+		assert.NoError(t, dest.WriteMessage(message.New(body)))
+	}
+
+	assert.Len(t, created["us"].messages, 2)
+	assert.Len(t, created["eu"].messages, 1)
+	assert.Len(t, created["ap"].messages, 1)
+	assert.Len(t, dest.instances, 2)
+	assert.NotContains(t, dest.instances, "eu")
+}
+
+func TestDynamicDestination_FailedCreationKeepsInstances(t *testing.T) {
+	dest := &DynamicDestination{
+		Key: "{{.Fields.region}}",
+		New: func(key string) (Destination, error) {
+			if key == "bad" {
+				return nil, errors.New("unknown region")
+			}
+			return &memory{}, nil
+		},
+		MaxInstances: 1,
+	}
+	assert.NoError(t, dest.Connect())
+
+	assert.NoError(t, dest.WriteMessage(message.New(`{"region":"us"}`)))
+	assert.Error(t, dest.WriteMessage(message.New(`{"region":"bad"}`)))
+	assert.Contains(t, dest.instances, "us")
+
+	assert.NoError(t, dest.Disconnect())
+	assert.NoError(t, dest.Disconnect())
+}
+
+func TestDynamicDestination_SlowKeyDoesNotBlockOthers(t *testing.T) {
+	slow := &hung{release: make(chan bool)}
+	dest := &DynamicDestination{
+		Key: "{{.Fields.region}}",
+		New: func(key string) (Destination, error) {
+			if key == "slow" {
+				return slow, nil
+			}
+			return &memory{}, nil
+		},
+	}
+	assert.NoError(t, dest.Connect())
+	defer dest.Disconnect()
+
+	go dest.WriteMessage(message.New(`{"region":"slow"}`))
+	written := make(chan error)
+	go func() { written <- dest.WriteMessage(message.New(`{"region":"us"}`)) }()
+
+	select {
+	case err := <-written:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("write blocked by another key")
+	}
+	close(slow.release)
+}
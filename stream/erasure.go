@@ -0,0 +1,278 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// MetaDeleteMarker is set on delete markers to the erased subject ID.
+const MetaDeleteMarker = "manifold.delete"
+
+// Erasable is an optional interface implemented by destinations that
+// buffer messages locally (e.g. S3 buffer files): Erase removes the
+// buffered messages whose body `erased` matches and returns how many
+// it removed.
+type Erasable interface {
+	Erase(erased func(body string) bool) (int, error)
+}
+
+// Erasure processes erasure requests (e.g. GDPR right-to-be-forgotten
+// deletes) for a pipeline. Requests are read from Control: each
+// message is a subject ID, or a JSON object with a `subjectId` field.
+// For each request, the pipeline
+//   - drops messages of the subject read for Retention afterwards,
+//     and those queued in partition lanes,
+//   - erases them from the buffers of Erasable destinations (and
+//     routes or windows of Erasable destinations),
+//   - writes a delete marker to the destination with DeleteMarkers,
+//     so that compacted or upserting destinations drop the subject's
+//     records: a JSON object with SubjectField set to the ID and the
+//     MetaDeleteMarker metadata key set.
+//
+// Messages are matched on SubjectField, a dotted path to a field of
+// JSON object bodies (e.g. "user.id"), after being transformed.
+// Requests are acknowledged once applied.
+type Erasure struct {
+	Control       Source
+	SubjectField  string
+	DeleteMarkers bool
+	// Retention is how long messages of an erased subject are
+	// dropped, defaults to 24 hours.
+	Retention time.Duration
+	mu        sync.Mutex
+	subjects  map[string]time.Time // erased subject -> expiry
+	path      []string
+	pathOnce  sync.Once
+}
+
+// erasureRequest is the JSON form of an erasure request.
+type erasureRequest struct {
+	SubjectID string `json:"subjectId"`
+}
+
+// requestSubject returns the subject ID of the erasure request `m`.
+func requestSubject(m message.Message) (string, error) {
+	body := strings.TrimSpace(m.Body)
+	if strings.HasPrefix(body, "{") {
+		var r erasureRequest
+		err := json.Unmarshal([]byte(body), &r)
+		if err != nil {
+			return "", err
+		}
+		body = r.SubjectID
+	}
+	if body == "" {
+		return "", fmt.Errorf("erasure request without a subject ID: %q", m.Body)
+	}
+	return body, nil
+}
+
+// subject returns the subject ID of `body`, if it is a JSON object
+// with SubjectField set to a string or a number.
+func (e *Erasure) subject(body string) (string, bool) {
+	var v interface{}
+	if json.Unmarshal([]byte(body), &v) != nil {
+		return "", false
+	}
+	for _, key := range e.fieldPath() {
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		v = object[key]
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// fieldPath returns SubjectField split on dots.
+func (e *Erasure) fieldPath() []string {
+	e.pathOnce.Do(func() {
+		e.path = strings.Split(e.SubjectField, ".")
+	})
+	return e.path
+}
+
+// add records `subject` as erased until `now` plus Retention, and
+// forgets subjects whose retention expired.
+func (e *Erasure) add(subject string, now time.Time) {
+	retention := e.Retention
+	if retention <= 0 {
+		retention = 24 * time.Hour
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.subjects == nil {
+		e.subjects = map[string]time.Time{}
+	}
+	for s, expiry := range e.subjects {
+		if now.After(expiry) {
+			delete(e.subjects, s)
+		}
+	}
+	e.subjects[subject] = now.Add(retention)
+}
+
+// erased reports whether `body` belongs to a subject erased less
+// than Retention before `now`.
+func (e *Erasure) erased(body string, now time.Time) bool {
+	e.mu.Lock()
+	empty := len(e.subjects) == 0
+	e.mu.Unlock()
+	if empty {
+		return false
+	}
+	subject, ok := e.subject(body)
+	if !ok {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	expiry, ok := e.subjects[subject]
+	return ok && !now.After(expiry)
+}
+
+// marker returns the delete marker of `subject`.
+func (e *Erasure) marker(subject string) message.Message {
+	var body interface{} = subject
+	path := e.fieldPath()
+	for i := len(path) - 1; i >= 0; i-- {
+		body = map[string]interface{}{path[i]: body}
+	}
+	data, _ := json.Marshal(body)
+	m := message.New(string(data))
+	m.Metadata[MetaDeleteMarker] = subject
+	return m
+}
+
+// Erase removes the messages `erased` matches from the buffers of the
+// routes' Erasable destinations.
+func (r *Router) Erase(erased func(body string) bool) (n int, err error) {
+	for _, dest := range r.destinations() {
+		if e, ok := dest.(Erasable); ok {
+			erasedN, eerr := e.Erase(erased)
+			n += erasedN
+			if eerr != nil {
+				err = eerr
+			}
+		}
+	}
+	return
+}
+
+// Erase removes the messages `erased` matches from the buffers of
+// Destination, if it is Erasable. Messages already aggregated in
+// windows can't be erased.
+func (w *Window) Erase(erased func(body string) bool) (int, error) {
+	if e, ok := w.Destination.(Erasable); ok {
+		return e.Erase(erased)
+	}
+	return 0, nil
+}
+
+// erasing reports whether `msg` belongs to an erased subject, in
+// which case it is counted and acknowledged.
+func (p *Pipeline) erasing(msg message.Message) bool {
+	if p.Erasure == nil || !p.Erasure.erased(msg.Body, p.clock().Now()) {
+		return false
+	}
+	atomic.AddUint64(&p.stats.Erased, 1)
+	msg.Done(nil)
+	return true
+}
+
+// erase applies the erasure requests of `requests` until it is
+// closed or `done` is.
+func (p *Pipeline) erase(requests chan message.Message, done <-chan struct{}) {
+	for {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				return
+			}
+			req.Done(p.applyErasure(req))
+		case <-done:
+			return
+		}
+	}
+}
+
+// applyErasure applies the erasure request `req`.
+func (p *Pipeline) applyErasure(req message.Message) error {
+	subject, err := requestSubject(req)
+	if err != nil {
+		p.logger().Error("Invalid erasure request: ", err)
+		return err
+	}
+	logger := p.logger().WithField("subject", subject)
+	e := p.Erasure
+	e.add(subject, p.clock().Now())
+	atomic.AddUint64(&p.stats.Erasures, 1)
+	logger.Info("Erasing subject ", subject)
+
+	matches := func(body string) bool {
+		s, ok := e.subject(body)
+		return ok && s == subject
+	}
+	p.eraseQueued(matches)
+	if dest, ok := p.Destination.(Erasable); ok {
+		n, err := dest.Erase(matches)
+		atomic.AddUint64(&p.stats.Erased, uint64(n))
+		if err != nil {
+			logger.Error("Failed to erase buffered messages: ", err)
+			return err
+		}
+	}
+	if e.DeleteMarkers {
+		err = p.write(p.Destination, e.marker(subject))
+		if err != nil {
+			logger.Error("Failed to write delete marker: ", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// eraseQueued removes the messages `matches` matches from partition
+// lanes, acknowledging them.
+func (p *Pipeline) eraseQueued(matches func(body string) bool) {
+	if p.partitions == nil {
+		return
+	}
+	p.partitions.Lock()
+	defer p.partitions.Unlock()
+	for _, l := range p.partitions.lanes {
+		kept := l.queue[:0]
+		for _, q := range l.queue {
+			body := q.msg.Body
+			if q.block != nil {
+				data, err := decompress(q.block)
+				if err == nil {
+					body = string(data)
+				}
+			}
+			if !matches(body) {
+				kept = append(kept, q)
+				continue
+			}
+			atomic.AddUint64(&p.stats.Erased, 1)
+			q.msg.Done(nil)
+			p.partitions.pending.Done()
+		}
+		for i := len(kept); i < len(l.queue); i++ {
+			l.queue[i] = queued{}
+		}
+		l.queue = kept
+	}
+}
@@ -0,0 +1,101 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// erasable is a destination buffering messages until erased.
+type erasable struct {
+	memory
+}
+
+func (e *erasable) Erase(erased func(body string) bool) (int, error) {
+	var kept []string
+	for _, m := range e.messages {
+		if !erased(m) {
+			kept = append(kept, m)
+		}
+	}
+	n := len(e.messages) - len(kept)
+	e.messages = kept
+	return n, nil
+}
+
+func TestRequestSubject(t *testing.T) {
+	for body, want := range map[string]string{
+		"user-1":                  "user-1",
+		" user-1\n":               "user-1",
+		`{"subjectId": "user-2"}`: "user-2",
+	} {
+		subject, err := requestSubject(message.New(body))
+		assert.NoError(t, err, body)
+		assert.Equal(t, want, subject, body)
+	}
+	_, err := requestSubject(message.New(`{"id": "user-1"}`))
+	assert.Error(t, err)
+	_, err = requestSubject(message.New(`{`))
+	assert.Error(t, err)
+}
+
+func TestPipeline_Erasure(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC))
+	dest := &erasable{}
+	dest.messages = []string{`{"user":{"id":"u1"},"n":1}`, `{"user":{"id":"u2"},"n":2}`}
+	p := &Pipeline{
+		Destination: &Router{Default: dest},
+		Erasure:     &Erasure{SubjectField: "user.id", DeleteMarkers: true, Retention: time.Hour},
+		Clock:       clock,
+		partitions:  &partitions{lanes: map[string]*lane{}},
+		OnFailure:   PausePartition,
+	}
+
+	// a message queued in a lane
+	var acked []error
+	pending := message.New(`{"user":{"id":"u1"},"n":3}`)
+	pending.Ack = func(err error) { acked = append(acked, err) }
+	p.partitions.lanes["k"] = &lane{queue: []queued{{msg: pending}, {msg: message.New(`{"user":{"id":"u2"}}`)}}}
+	p.partitions.pending.Add(2)
+
+	var reqErr []error
+	req := message.New(`{"subjectId": "u1"}`)
+	req.Ack = func(err error) { reqErr = append(reqErr, err) }
+	requests := make(chan message.Message, 1)
+	requests <- req
+	close(requests)
+	p.erase(requests, nil)
+
+	assert.Equal(t, []error{nil}, reqErr)
+	assert.Equal(t, []error{nil}, acked)
+	assert.Len(t, p.partitions.lanes["k"].queue, 1)
+	assert.Equal(t, []string{`{"user":{"id":"u2"},"n":2}`, `{"user":{"id":"u1"}}`}, dest.messages)
+	stats := p.Stats()
+	assert.Equal(t, uint64(1), stats.Erasures)
+	assert.Equal(t, uint64(2), stats.Erased)
+
+	// messages of the subject are dropped for Retention
+	msg := message.New(`{"user":{"id":"u1"}}`)
+	msg.Ack = func(err error) { acked = append(acked, err) }
+	assert.True(t, p.erasing(msg))
+	assert.Len(t, acked, 2)
+	assert.False(t, p.erasing(message.New(`{"user":{"id":"u2"}}`)))
+	assert.False(t, p.erasing(message.New("u1")))
+	clock.Advance(2 * time.Hour)
+	assert.False(t, p.erasing(message.New(`{"user":{"id":"u1"}}`)))
+}
+
+func TestPipeline_ErasureErrors(t *testing.T) {
+	p := &Pipeline{Destination: &memory{fail: 1}, Erasure: &Erasure{SubjectField: "id", DeleteMarkers: true}}
+	err := p.applyErasure(message.New(""))
+	assert.Error(t, err)
+
+	err = p.applyErasure(message.New("42"))
+	assert.EqualError(t, err, "write failed")
+	// numeric subject IDs match
+	assert.True(t, p.Erasure.erased(`{"id": 42}`, time.Now()))
+	assert.NoError(t, p.applyErasure(message.New("43")))
+	assert.Equal(t, []string{`{"id":"43"}`}, p.Destination.(*memory).messages)
+}
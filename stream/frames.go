@@ -0,0 +1,40 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Frames are length-prefixed records of files appended to by
+// connectors (e.g. the buffered files of S3, see appendBuffer, and the
+// WAL of Spool): a kind byte, a big-endian uint32 length and the
+// payload.
+
+// appendFrame appends a frame of `kind` with `payload` to `data`.
+func appendFrame(data []byte, kind byte, payload []byte) []byte {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(payload)))
+	data = append(data, kind)
+	data = append(data, length[:]...)
+	return append(data, payload...)
+}
+
+// readFrame reads a frame, returning io.EOF only at a frame
+// boundary.
+func readFrame(r *bufio.Reader) (kind byte, payload []byte, err error) {
+	kind, err = r.ReadByte()
+	if err != nil {
+		return
+	}
+	var length [4]byte
+	_, err = io.ReadFull(r, length[:])
+	if err == nil {
+		payload = make([]byte, binary.BigEndian.Uint32(length[:]))
+		_, err = io.ReadFull(r, payload)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
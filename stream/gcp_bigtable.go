@@ -0,0 +1,265 @@
+//go:build gcp || all || (!aws && !kafka)
+// +build gcp all !aws,!kafka
+
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/abstractpaper/manifold/message"
+	"google.golang.org/api/option"
+)
+
+// BigTable writes messages as rows of a Cloud Bigtable table.
+//
+// RowKey is a template executed against each message (see
+// templateData), e.g. "{{.Fields.device}}#{{.Fields.timestamp}}".
+//
+// Fields of JSON object messages are written as columns of the
+// family they are mapped to in Config.Families; unmapped fields go to
+// Config.DefaultFamily (or are dropped if it is empty). Messages that
+// aren't JSON objects are written to a `body` column of
+// DefaultFamily.
+//
+// Rows are buffered and written in batches with ApplyBulk; rows that
+// fail are retried up to Config.MaxRetries times. Messages written
+// with WriteAsync (as pipelines do) are acknowledged once their row is
+// applied, errors of plain writes are logged.
+type BigTable struct {
+	Project       string
+	Instance      string
+	Table         string
+	RowKey        string
+	Config        *BigTableConfig
+	ClientOptions []option.ClientOption
+	client        *bigtable.Client
+	table         bigtableTable
+	rowKey        *template.Template
+	families      map[string]string // field -> family
+	batcher       *batcher
+	clocked
+	logged
+}
+
+// BigTableConfig configures column families and batching.
+type BigTableConfig struct {
+	Families      map[string][]string // family -> fields
+	DefaultFamily string
+	BatchSize     int // rows per ApplyBulk, defaults to 100
+	FlushEvery    int // seconds, defaults to 1
+	MaxRetries    int // retries of failed rows, defaults to 3
+}
+
+// bigtableTable is the part of *bigtable.Table used by BigTable.
+type bigtableTable interface {
+	ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error)
+}
+
+type bigtableRow struct {
+	key string
+	mut *bigtable.Mutation
+}
+
+func (b *BigTable) Connect() (err error) {
+	if b.Config == nil {
+		b.Config = &BigTableConfig{}
+	}
+	if b.Config.BatchSize < 1 {
+		b.Config.BatchSize = 100
+	}
+	if b.Config.FlushEvery < 1 {
+		b.Config.FlushEvery = 1
+	}
+	if b.Config.MaxRetries < 1 {
+		b.Config.MaxRetries = 3
+	}
+
+	b.rowKey, err = newTemplate("rowKey", b.RowKey)
+	if err != nil {
+		return
+	}
+	b.families = map[string]string{}
+	for family, fields := range b.Config.Families {
+		for _, field := range fields {
+			b.families[field] = family
+		}
+	}
+
+	if b.table == nil {
+		b.logger().Info("Establishing bigtable connection...")
+		b.client, err = bigtable.NewClient(context.Background(), b.Project, b.Instance, b.ClientOptions...)
+		if err != nil {
+			b.logger().Error("BigTable: Failed to create client: ", err)
+			return
+		}
+		b.table = b.client.Open(b.Table)
+	}
+
+	b.batcher = newBatcher("BigTable", b.logger(), b.clock(), b.Config.BatchSize, time.Duration(b.Config.FlushEvery)*time.Second, b.Config.MaxRetries, b.apply)
+
+	return
+}
+
+// Disconnect flushes buffered rows and closes the client.
+func (b *BigTable) Disconnect() (err error) {
+	if b.batcher != nil {
+		b.batcher.close()
+		b.batcher = nil
+	}
+	if b.client != nil {
+		err = b.client.Close()
+	}
+	return
+}
+
+// Resources returns the table with its column families.
+func (b *BigTable) Resources() []Resource {
+	settings := map[string]string{"project": b.Project, "instance_name": b.Instance}
+	if b.Config != nil {
+		families := map[string]bool{}
+		if b.Config.DefaultFamily != "" {
+			families[b.Config.DefaultFamily] = true
+		}
+		for family := range b.Config.Families {
+			families[family] = true
+		}
+		var names []string
+		for family := range families {
+			names = append(names, family)
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			settings["column_families"] = strings.Join(names, ",")
+		}
+	}
+	return []Resource{{Kind: "google_bigtable_table", Name: b.Table, Settings: settings}}
+}
+
+// Capabilities of BigTable: writing a message again sets the same
+// cells of its row.
+func (b *BigTable) Capabilities() Capabilities {
+	return Capabilities{ConfirmedWrites: true, Batching: true, Idempotent: true}
+}
+
+func (b *BigTable) Info() {
+	b.logger().Infof("BigTable: %s/%s/%s", b.Project, b.Instance, b.Table)
+	b.logger().Info("BigTable.RowKey: ", b.RowKey)
+	b.logger().Infof("BigTableConfig: %+v", *b.Config)
+}
+
+func (b *BigTable) Write(body string) (err error) {
+	return b.WriteMessage(message.New(body))
+}
+
+// WriteMessage buffers a row for `m`.
+func (b *BigTable) WriteMessage(m message.Message) (err error) {
+	row, err := b.row(m)
+	if err != nil {
+		return
+	}
+	b.batcher.add(row, nil)
+	return
+}
+
+// WriteAsync buffers a row for `m` and calls `done` once it has been
+// applied.
+func (b *BigTable) WriteAsync(m message.Message, done func(error)) {
+	row, err := b.row(m)
+	if err != nil {
+		done(err)
+		return
+	}
+	b.batcher.add(row, done)
+}
+
+// row creates the row of `m`.
+func (b *BigTable) row(m message.Message) (row bigtableRow, err error) {
+	key, err := executeTemplate(b.rowKey, m)
+	if err != nil {
+		return
+	}
+	if key == "" {
+		return row, errors.New("BigTable: empty row key")
+	}
+
+	cells := b.cells(m.Body)
+	if len(cells) == 0 {
+		return row, errors.New("BigTable: message has no columns to write")
+	}
+
+	mut := bigtable.NewMutation()
+	ts := bigtable.Now()
+	for family, columns := range cells {
+		for column, value := range columns {
+			mut.Set(family, column, ts, value)
+		}
+	}
+
+	return bigtableRow{key: key, mut: mut}, nil
+}
+
+// cells maps the fields of `body` to family -> column -> value.
+func (b *BigTable) cells(body string) map[string]map[string][]byte {
+	cells := map[string]map[string][]byte{}
+	set := func(family string, column string, value []byte) {
+		if family == "" {
+			return
+		}
+		if cells[family] == nil {
+			cells[family] = map[string][]byte{}
+		}
+		cells[family][column] = value
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &fields); err != nil {
+		set(b.Config.DefaultFamily, "body", []byte(body))
+		return cells
+	}
+
+	for field, raw := range fields {
+		family, ok := b.families[field]
+		if !ok {
+			family = b.Config.DefaultFamily
+		}
+
+		// strings are stored unquoted, other values as JSON
+		value := []byte(raw)
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			value = []byte(s)
+		}
+		set(family, field, value)
+	}
+	return cells
+}
+
+// apply writes a batch of rows, failed rows are retried by the
+// batcher.
+func (b *BigTable) apply(batch []*batchEntry) error {
+	keys := make([]string, len(batch))
+	muts := make([]*bigtable.Mutation, len(batch))
+	for i, e := range batch {
+		row := e.value.(bigtableRow)
+		keys[i], muts[i] = row.key, row.mut
+	}
+
+	errs, err := b.table.ApplyBulk(context.Background(), keys, muts)
+	if err != nil {
+		return err
+	}
+	for i, rowErr := range errs {
+		if rowErr != nil {
+			b.logger().Warnf("BigTable: row %q failed: %s", keys[i], rowErr)
+			batch[i].err = rowErr
+		}
+	}
+	return nil
+}
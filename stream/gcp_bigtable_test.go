@@ -0,0 +1,107 @@
+//go:build gcp || all || (!aws && !kafka)
+// +build gcp all !aws,!kafka
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTable fails the first `fail` rows it is given.
+type fakeTable struct {
+	sync.Mutex
+	fail int
+	keys []string
+}
+
+func (f *fakeTable) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	errs := make([]error, len(rowKeys))
+	for i, key := range rowKeys {
+		if f.fail > 0 {
+			f.fail--
+			errs[i] = errors.New("unavailable")
+			continue
+		}
+		f.keys = append(f.keys, key)
+	}
+	return errs, nil
+}
+
+func TestBigTable_Write(t *testing.T) {
+	table := &fakeTable{fail: 1}
+	dest := &BigTable{
+		RowKey: "{{.Fields.device}}#{{.Metadata.seq}}",
+		Config: &BigTableConfig{BatchSize: 2, DefaultFamily: "f"},
+		table:  table,
+	}
+	assert.NoError(t, dest.Connect())
+
+	for _, seq := range []string{"1", "2", "3"} {
+		m := message.New(`{"device":"d1","temp":21.5}`)
+		m.Metadata["seq"] = seq
+		assert.NoError(t, dest.WriteMessage(m))
+	}
+	assert.NoError(t, dest.Disconnect())
+
+	// the failed row is retried
+	assert.ElementsMatch(t, []string{"d1#1", "d1#2", "d1#3"}, table.keys)
+}
+
+func TestBigTable_WriteAsync(t *testing.T) {
+	table := &fakeTable{fail: 100}
+	dest := &BigTable{
+		RowKey: "{{.Fields.device}}",
+		Config: &BigTableConfig{BatchSize: 1, DefaultFamily: "f", MaxRetries: 1},
+		table:  table,
+	}
+	assert.NoError(t, dest.Connect())
+	defer dest.Disconnect()
+
+	// failures are reported once retries are exhausted
+	result := make(chan error, 1)
+	dest.WriteAsync(message.New(`{"device":"d1"}`), func(err error) { result <- err })
+	assert.EqualError(t, <-result, "unavailable")
+
+	table.Lock()
+	table.fail = 0
+	table.Unlock()
+	dest.WriteAsync(message.New(`{"device":"d1"}`), func(err error) { result <- err })
+	assert.NoError(t, <-result)
+
+	dest.WriteAsync(message.New(`{}`), func(err error) { result <- err })
+	assert.Error(t, <-result, "no row key")
+}
+
+func TestBigTable_Cells(t *testing.T) {
+	dest := &BigTable{
+		Config: &BigTableConfig{
+			Families:      map[string][]string{"readings": {"temp"}},
+			DefaultFamily: "meta",
+		},
+		families: map[string]string{"temp": "readings"},
+	}
+
+	assert.Equal(t, map[string]map[string][]byte{
+		"readings": {"temp": []byte("21.5")},
+		"meta":     {"device": []byte("d1")},
+	}, dest.cells(`{"device":"d1","temp":21.5}`))
+
+	assert.Equal(t, map[string]map[string][]byte{
+		"meta": {"body": []byte("raw")},
+	}, dest.cells("raw"))
+
+	dest.Config.DefaultFamily = ""
+	assert.Equal(t, map[string]map[string][]byte{
+		"readings": {"temp": []byte("21.5")},
+	}, dest.cells(`{"device":"d1","temp":21.5}`))
+}
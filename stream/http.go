@@ -0,0 +1,259 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// Metadata keys attached to messages received over HTTP.
+const (
+	MetaHTTPPath       = "http.path"
+	MetaHTTPRemoteAddr = "http.remote_addr"
+	MetaHTTPReplayed   = "http.replayed" // "true" on replayed messages
+)
+
+// HTTP runs an embedded HTTP server and reads messages POSTed to
+// it.
+//
+// A request body is a single message, unless its Content-Type is
+// `application/x-ndjson` in which case every non-empty line is a
+// message.
+//
+// If Token is set, requests must carry it in an
+// `Authorization: Bearer <token>` header.
+//
+// With Config.Sync, the server responds only once every message of
+// the request has been handled by the pipeline: 200 if they were all
+// written to the destination, 502 otherwise (including messages
+// quarantined to a DLQ). Without it, the server
+// responds 202 as soon as messages are queued.
+//
+// With Config.ReplayDir, received messages are also stored on disk
+// for Config.ReplayRetention hours, indexed by provider, event type
+// and time, to be replayed after an outage downstream (see
+// replayHandler). The provider and event type of a message are
+// rendered from the Config.ReplayProvider and Config.ReplayEvent
+// templates (see templateData).
+type HTTP struct {
+	Addr     string // listen address, e.g. ":8080"
+	Path     string // defaults to "/"
+	Token    string
+	Config   *HTTPConfig
+	Args     map[string]string
+	server   *http.Server
+	listener net.Listener
+	messages chan message.Message
+	store    *webhookStore
+	provider *template.Template
+	event    *template.Template
+	clocked
+	logged
+}
+
+// HTTPConfig configures request handling of the HTTP source.
+type HTTPConfig struct {
+	MaxRequestSize  int  // KB, defaults to 1024
+	Sync            bool // acknowledge after the destination write
+	SyncTimeout     int  // seconds, defaults to 30
+	ReplayDir       string
+	ReplayRetention int    // hours, defaults to 168
+	ReplayProvider  string // defaults to the request path
+	ReplayEvent     string // e.g. "{{.Fields.type}}", defaults to none
+	ReplayPath      string // path of the replay API, defaults to "/_replay"
+}
+
+var errRequestTimeout = errors.New("timed out waiting for acknowledgement")
+
+func (h *HTTP) Connect() (err error) {
+	if h.Config == nil {
+		h.Config = &HTTPConfig{}
+	}
+	if h.Config.MaxRequestSize < 1 {
+		h.Config.MaxRequestSize = 1024
+	}
+	if h.Config.SyncTimeout < 1 {
+		h.Config.SyncTimeout = 30
+	}
+	if h.Path == "" {
+		h.Path = "/"
+	}
+	h.messages = make(chan message.Message)
+
+	if h.Config.ReplayDir != "" {
+		err = h.openStore()
+		if err != nil {
+			return
+		}
+	}
+
+	h.listener, err = net.Listen("tcp", h.Addr)
+	if err != nil {
+		h.logger().Error("HTTP: Failed to listen: ", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(h.Path, h.handle)
+	if h.store != nil {
+		mux.HandleFunc(h.Config.ReplayPath, h.replayHandler)
+	}
+	h.server = &http.Server{Handler: mux}
+	go func() {
+		h.logger().Info("HTTP: Listening on ", h.listener.Addr())
+		err := h.server.Serve(h.listener)
+		if err != http.ErrServerClosed {
+			h.logger().Error("HTTP: Serve: ", err)
+		}
+	}()
+
+	return
+}
+
+// Disconnect gracefully shuts the server down.
+func (h *HTTP) Disconnect() (err error) {
+	if h.server == nil {
+		return
+	}
+
+	h.logger().Info("HTTP: Shutting down server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = h.server.Shutdown(ctx)
+	if err != nil {
+		h.logger().Error("HTTP: Shutdown: ", err)
+	}
+	return
+}
+
+// Capabilities of HTTP: with Config.Sync, requests are answered once
+// their messages are acknowledged, so clients retry failed ones.
+func (h *HTTP) Capabilities() Capabilities {
+	return Capabilities{Acks: h.Config != nil && h.Config.Sync}
+}
+
+func (h *HTTP) Info() {
+	h.logger().Info("HTTP.Addr: ", h.Addr)
+	h.logger().Info("HTTP.Path: ", h.Path)
+	h.logger().Infof("HTTPConfig: %+v", *h.Config)
+}
+
+func (h *HTTP) Read() (channel chan string, err error) {
+	messages, err := h.ReadMessages()
+	if err != nil {
+		return
+	}
+
+	channel = make(chan string)
+	go func() {
+		for m := range messages {
+			channel <- m.Body
+			m.Done(nil)
+		}
+	}()
+	return
+}
+
+// ReadMessages returns the channel received messages are pushed
+// into.
+func (h *HTTP) ReadMessages() (channel chan message.Message, err error) {
+	return h.messages, nil
+}
+
+func (h *HTTP) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(h.Config.MaxRequestSize)*1024)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	bodies := []string{string(body)}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson") {
+		bodies = splitLines(body)
+	}
+
+	acks := make(chan error, len(bodies))
+	for _, b := range bodies {
+		m := message.New(b)
+		m.Metadata[MetaHTTPPath] = r.URL.Path
+		m.Metadata[MetaHTTPRemoteAddr] = r.RemoteAddr
+		if h.store != nil {
+			h.record(m)
+		}
+		if h.Config.Sync {
+			m.Ack = func(err error) { acks <- err }
+		}
+
+		select {
+		case h.messages <- m:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if !h.Config.Sync {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	timeout := h.clock().NewTimer(time.Duration(h.Config.SyncTimeout) * time.Second)
+	defer timeout.Stop()
+	for range bodies {
+		select {
+		case err = <-acks:
+		case <-timeout.C():
+			err = errRequestTimeout
+		}
+		if err != nil {
+			h.logger().Warn("HTTP: Request failed: ", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// authorized checks the bearer token of `r` against Token.
+func (h *HTTP) authorized(r *http.Request) bool {
+	if h.Token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) == 1
+}
+
+// splitLines returns the non-empty lines of `body`.
+func splitLines(body []byte) (lines []string) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return
+}
@@ -0,0 +1,310 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// replayHour is the layout of the hourly files of a webhook store.
+const replayHour = "2006010215"
+
+// webhookStore keeps received webhooks on disk to replay them, as
+// NDJSON files per provider and hour:
+//
+//	<dir>/<provider>/2020100112.ndjson
+//
+// so that queries by provider and time only read the matching files.
+type webhookStore struct {
+	dir       string
+	retention time.Duration
+	mu        sync.Mutex
+	pruned    time.Time
+	clocked
+}
+
+// webhookRecord is a stored webhook.
+type webhookRecord struct {
+	Time     time.Time `json:"time"`
+	Provider string    `json:"provider"`
+	Event    string    `json:"event,omitempty"`
+	Path     string    `json:"path"`
+	Body     string    `json:"body"`
+}
+
+// webhookQuery selects stored webhooks, empty fields match all.
+type webhookQuery struct {
+	Provider string
+	Event    string
+	From     time.Time
+	To       time.Time // defaults to now, on the store's clock
+}
+
+// append stores `r`, pruning files past the retention every hour.
+func (s *webhookStore) append(r webhookRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(s.dir, providerDir(r.Provider))
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, r.Time.UTC().Format(replayHour)+".ndjson"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if r.Time.Sub(s.pruned) >= time.Hour {
+		s.pruned = r.Time
+		s.prune(r.Time)
+	}
+	return err
+}
+
+// prune removes the files of hours ending before `now` minus the
+// retention, s.mu must be held.
+func (s *webhookStore) prune(now time.Time) {
+	cutoff := now.Add(-s.retention).UTC().Truncate(time.Hour)
+	providers, _ := ioutil.ReadDir(s.dir)
+	for _, p := range providers {
+		files, _ := ioutil.ReadDir(filepath.Join(s.dir, p.Name()))
+		for _, f := range files {
+			hour, err := time.Parse(replayHour, strings.TrimSuffix(f.Name(), ".ndjson"))
+			if err == nil && hour.Add(time.Hour).Before(cutoff) {
+				os.Remove(filepath.Join(s.dir, p.Name(), f.Name()))
+			}
+		}
+	}
+}
+
+// query calls `fn` with the webhooks matching `q`, in order of time
+// per provider.
+func (s *webhookStore) query(q webhookQuery, fn func(webhookRecord) error) error {
+	if q.To.IsZero() {
+		q.To = s.clock().Now()
+	}
+
+	var providers []string
+	if q.Provider != "" {
+		providers = []string{providerDir(q.Provider)}
+	} else {
+		infos, err := ioutil.ReadDir(s.dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, info := range infos {
+			providers = append(providers, info.Name())
+		}
+	}
+
+	for _, p := range providers {
+		files, err := s.files(p, q.From, q.To)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			err = readRecords(file, func(r webhookRecord) error {
+				if r.Time.Before(q.From) || r.Time.After(q.To) || (q.Event != "" && r.Event != q.Event) {
+					return nil
+				}
+				return fn(r)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// files returns the files of `provider` for the hours overlapping
+// [from, to], in order.
+func (s *webhookStore) files(provider string, from, to time.Time) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, provider))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, info := range infos {
+		hour, err := time.Parse(replayHour, strings.TrimSuffix(info.Name(), ".ndjson"))
+		if err != nil || hour.Add(time.Hour).Before(from) || hour.After(to) {
+			continue
+		}
+		files = append(files, filepath.Join(s.dir, provider, info.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readRecords calls `fn` with each record of `file`.
+func readRecords(file string, fn func(webhookRecord) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var r webhookRecord
+		if json.Unmarshal(scanner.Bytes(), &r) != nil {
+			continue // partially written line
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// providerDir returns the directory name of `provider`.
+func providerDir(provider string) string {
+	provider = strings.Trim(provider, "/")
+	if provider == "" || provider == "." || provider == ".." {
+		provider = "_"
+	}
+	return url.PathEscape(provider)
+}
+
+// openStore opens the webhook store of Config.ReplayDir.
+func (h *HTTP) openStore() (err error) {
+	if h.Config.ReplayRetention < 1 {
+		h.Config.ReplayRetention = 168
+	}
+	if h.Config.ReplayProvider == "" {
+		h.Config.ReplayProvider = `{{index .Metadata "http.path"}}`
+	}
+	if h.Config.ReplayPath == "" {
+		h.Config.ReplayPath = "/_replay"
+	}
+
+	h.provider, err = newTemplate("provider", h.Config.ReplayProvider)
+	if err != nil {
+		return
+	}
+	h.event, err = newTemplate("event", h.Config.ReplayEvent)
+	if err != nil {
+		return
+	}
+	h.store = &webhookStore{
+		dir:       h.Config.ReplayDir,
+		retention: time.Duration(h.Config.ReplayRetention) * time.Hour,
+	}
+	h.store.SetClock(h.clock())
+	return os.MkdirAll(h.Config.ReplayDir, os.ModePerm)
+}
+
+// record stores `m` to be replayed, at the time of the connector's
+// clock. Failures are logged, the message is still read.
+func (h *HTTP) record(m message.Message) {
+	r := webhookRecord{Time: h.clock().Now(), Path: m.Metadata[MetaHTTPPath], Body: m.Body}
+	var err error
+	r.Provider, err = executeTemplate(h.provider, m)
+	if err == nil {
+		// "/stripe" is stored and queried as "stripe"
+		r.Provider = strings.Trim(r.Provider, "/")
+		// messages without an event type are stored without one
+		r.Event, _ = executeTemplate(h.event, m)
+		err = h.store.append(r)
+	}
+	if err != nil {
+		h.logger().Error("HTTP: Failed to store message for replay: ", err)
+	}
+}
+
+// replayHandler serves the replay API, which takes the `provider`,
+// `event`, `from` and `to` (RFC 3339) query parameters selecting
+// stored messages: GET lists them as NDJSON records, POST re-emits
+// them into the pipeline (with http.replayed metadata) and responds
+// with their count.
+func (h *HTTP) replayHandler(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q, err := parseWebhookQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		err = h.store.query(q, func(rec webhookRecord) error {
+			return encoder.Encode(rec)
+		})
+		if err != nil {
+			// the response has started
+			h.logger().Error("HTTP: Replay query failed: ", err)
+		}
+	case http.MethodPost:
+		count := 0
+		err = h.store.query(q, func(rec webhookRecord) error {
+			m := message.New(rec.Body)
+			m.Metadata[MetaHTTPPath] = rec.Path
+			m.Metadata[MetaHTTPReplayed] = "true"
+			select {
+			case h.messages <- m:
+				count++
+				return nil
+			case <-r.Context().Done():
+				return r.Context().Err()
+			}
+		})
+		if err != nil {
+			h.logger().Errorf("HTTP: Replay failed after %d message(s): %s", count, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.logger().Infof("HTTP: Replayed %d message(s)", count)
+		fmt.Fprintf(w, "{\"replayed\":%d}\n", count)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseWebhookQuery reads the replay query parameters of `r`.
+func parseWebhookQuery(r *http.Request) (q webhookQuery, err error) {
+	params := r.URL.Query()
+	q.Provider = params.Get("provider")
+	q.Event = params.Get("event")
+	if from := params.Get("from"); from != "" {
+		q.From, err = time.Parse(time.RFC3339Nano, from)
+		if err != nil {
+			return
+		}
+	}
+	if to := params.Get("to"); to != "" {
+		q.To, err = time.Parse(time.RFC3339Nano, to)
+	}
+	return
+}
@@ -0,0 +1,148 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookStore_Query(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replay")
+	defer os.RemoveAll(dir)
+	store := &webhookStore{dir: dir, retention: 24 * time.Hour}
+
+	start := time.Date(2020, 10, 1, 12, 30, 0, 0, time.UTC)
+	records := []webhookRecord{
+		{Time: start, Provider: "stripe", Event: "charge.succeeded", Body: "1"},
+		{Time: start.Add(time.Hour), Provider: "stripe", Event: "charge.failed", Body: "2"},
+		{Time: start.Add(2 * time.Hour), Provider: "stripe", Event: "charge.succeeded", Body: "3"},
+		{Time: start.Add(time.Hour), Provider: "github", Event: "push", Body: "4"},
+	}
+	for _, r := range records {
+		assert.NoError(t, store.append(r))
+	}
+
+	query := func(q webhookQuery) (bodies []string) {
+		err := store.query(q, func(r webhookRecord) error {
+			bodies = append(bodies, r.Body)
+			return nil
+		})
+		assert.NoError(t, err)
+		return
+	}
+	assert.Equal(t, []string{"1", "2", "3"}, query(webhookQuery{Provider: "stripe"}))
+	assert.Equal(t, []string{"1", "3"}, query(webhookQuery{Provider: "stripe", Event: "charge.succeeded"}))
+	assert.Equal(t, []string{"2"}, query(webhookQuery{Provider: "stripe", From: start.Add(time.Minute), To: start.Add(90 * time.Minute)}))
+	assert.ElementsMatch(t, []string{"2", "4"}, query(webhookQuery{From: start.Add(time.Hour), To: start.Add(time.Hour)}))
+	assert.Empty(t, query(webhookQuery{Provider: "shopify"}))
+}
+
+func TestWebhookStore_Prune(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replay")
+	defer os.RemoveAll(dir)
+	store := &webhookStore{dir: dir, retention: 24 * time.Hour}
+
+	start := time.Date(2020, 10, 1, 12, 30, 0, 0, time.UTC)
+	assert.NoError(t, store.append(webhookRecord{Time: start, Provider: "stripe"}))
+	assert.NoError(t, store.append(webhookRecord{Time: start.Add(48 * time.Hour), Provider: "stripe"}))
+
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "stripe"))
+	assert.Len(t, files, 1)
+	assert.Equal(t, "2020100312.ndjson", files[0].Name())
+}
+
+func TestHTTP_Replay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "replay")
+	defer os.RemoveAll(dir)
+	src, url := newTestHTTP(t, &HTTPConfig{ReplayDir: dir, ReplayEvent: "{{.Fields.type}}"})
+	defer src.Disconnect()
+
+	messages, _ := src.ReadMessages()
+	go func() {
+		for i := 0; i < 2; i++ {
+			<-messages
+		}
+	}()
+	post(t, url+"stripe", "application/x-ndjson", "{\"type\":\"a\"}\n{\"type\":\"b\"}\n")
+
+	// list
+	req, _ := http.NewRequest(http.MethodGet, url+"_replay?provider=stripe&event=b", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []webhookRecord
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var r webhookRecord
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		listed = append(listed, r)
+	}
+	resp.Body.Close()
+	assert.Len(t, listed, 1)
+	assert.Equal(t, "stripe", listed[0].Provider)
+	assert.Equal(t, "b", listed[0].Event)
+	assert.Equal(t, `{"type":"b"}`, listed[0].Body)
+
+	// replay
+	replayed := make(chan []string)
+	go func() {
+		var bodies []string
+		for i := 0; i < 2; i++ {
+			m := <-messages
+			assert.Equal(t, "true", m.Metadata[MetaHTTPReplayed])
+			assert.Equal(t, "/stripe", m.Metadata[MetaHTTPPath])
+			bodies = append(bodies, m.Body)
+		}
+		replayed <- bodies
+	}()
+	assert.Equal(t, http.StatusOK, post(t, url+"_replay?provider=stripe", "", ""))
+	assert.Equal(t, []string{`{"type":"a"}`, `{"type":"b"}`}, <-replayed)
+
+	// the replay API requires the token
+	resp, err = http.Get(url + "_replay")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = http.Post(url+"_replay?from=yesterday", "", strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestHTTP_ReplayClock(t *testing.T) {
+	dir := t.TempDir()
+	h := &HTTP{Config: &HTTPConfig{ReplayDir: dir, ReplayRetention: 24}}
+	// ahead of the wall clock, which would leave records out of queries
+	clock := NewFakeClock(time.Date(2100, 10, 1, 12, 30, 0, 0, time.UTC))
+	h.SetClock(clock)
+	assert.NoError(t, h.openStore())
+
+	m := message.New("1")
+	m.Metadata[MetaHTTPPath] = "/stripe"
+	h.record(m)
+	clock.Advance(48 * time.Hour)
+	m.Body = "2"
+	h.record(m)
+
+	// the first record is past the retention
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "stripe"))
+	assert.Len(t, files, 1)
+	var listed []webhookRecord
+	assert.NoError(t, h.store.query(webhookQuery{Provider: "stripe"}, func(r webhookRecord) error {
+		listed = append(listed, r)
+		return nil
+	}))
+	assert.Len(t, listed, 1)
+	assert.Equal(t, "2", listed[0].Body)
+	assert.True(t, clock.Now().Equal(listed[0].Time))
+}
@@ -0,0 +1,92 @@
+package stream
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHTTP(t *testing.T, config *HTTPConfig) (*HTTP, string) {
+	src := &HTTP{Addr: "127.0.0.1:0", Token: "token", Config: config}
+	if err := src.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return src, "http://" + src.listener.Addr().String() + "/"
+}
+
+func post(t *testing.T, url string, contentType string, body string) int {
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHTTP_NDJSON(t *testing.T) {
+	src, url := newTestHTTP(t, nil)
+	defer src.Disconnect()
+
+	messages, _ := src.ReadMessages()
+	var bodies []string
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 2; i++ {
+			bodies = append(bodies, (<-messages).Body)
+		}
+		done <- true
+	}()
+
+	status := post(t, url, "application/x-ndjson", "{\"a\":1}\n\n{\"a\":2}\n")
+	<-done
+
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, []string{`{"a":1}`, `{"a":2}`}, bodies)
+}
+
+func TestHTTP_Unauthorized(t *testing.T) {
+	src, url := newTestHTTP(t, nil)
+	defer src.Disconnect()
+
+	resp, err := http.Post(url, "application/json", strings.NewReader("{}"))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// the token must come with the Bearer scheme
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader("{}"))
+	req.Header.Set("Authorization", "token")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestHTTP_TooLarge(t *testing.T) {
+	src, url := newTestHTTP(t, &HTTPConfig{MaxRequestSize: 1})
+	defer src.Disconnect()
+
+	status := post(t, url, "application/json", strings.Repeat("a", 2048))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+}
+
+func TestHTTP_Sync(t *testing.T) {
+	src, url := newTestHTTP(t, &HTTPConfig{Sync: true})
+	defer src.Disconnect()
+
+	messages, _ := src.ReadMessages()
+	go func() {
+		(<-messages).Done(nil)
+		(<-messages).Done(errors.New("write failed"))
+		(<-messages).Done(quarantinedError{errors.New("write failed")})
+	}()
+
+	assert.Equal(t, http.StatusOK, post(t, url, "application/json", "{}"))
+	assert.Equal(t, http.StatusBadGateway, post(t, url, "application/json", "{}"))
+	// quarantined messages weren't written either
+	assert.Equal(t, http.StatusBadGateway, post(t, url, "application/json", "{}"))
+}
@@ -0,0 +1,126 @@
+package stream
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// MetaHeartbeat is "true" on heartbeat messages (see
+// Pipeline.Heartbeat).
+const MetaHeartbeat = "manifold.heartbeat"
+
+// heartbeat is the body of a heartbeat message.
+type heartbeat struct {
+	Heartbeat time.Time `json:"heartbeat"`
+	Pipeline  string    `json:"pipeline,omitempty"`
+	IdleSince time.Time `json:"idleSince"`
+}
+
+// idleMonitor detects a source that delivers no messages for
+// Pipeline.IdleTimeout. Its timer is re-armed lazily: reading a
+// message only records the time, and the timer checks it when it
+// fires.
+type idleMonitor struct {
+	p         *Pipeline
+	last      time.Time // time of the last message read
+	idleSince time.Time // zero while the source delivers
+	timer     Timer
+}
+
+// newIdleMonitor returns a monitor for `p`, or nil if IdleTimeout
+// isn't set.
+func (p *Pipeline) newIdleMonitor() *idleMonitor {
+	if p.IdleTimeout <= 0 {
+		return nil
+	}
+	m := &idleMonitor{p: p, last: p.clock().Now()}
+	m.arm(p.IdleTimeout)
+	return m
+}
+
+// C returns the channel of the monitor's timer, nil if it is
+// disabled.
+func (m *idleMonitor) C() <-chan time.Time {
+	if m == nil || m.timer == nil {
+		return nil
+	}
+	return m.timer.C()
+}
+
+// read records that a message was read.
+func (m *idleMonitor) read() {
+	if m == nil {
+		return
+	}
+	m.last = m.p.clock().Now()
+	if m.idleSince.IsZero() {
+		return
+	}
+	m.p.logger().Infof("Source resumed after being idle for %s.", m.last.Sub(m.idleSince).Round(time.Second))
+	m.idleSince = time.Time{}
+	atomic.StoreInt64(&m.p.idleSince, 0)
+	m.arm(m.p.IdleTimeout)
+}
+
+// restart restarts the idle timeout from now, e.g. after a pause.
+func (m *idleMonitor) restart() {
+	if m != nil {
+		m.last = m.p.clock().Now()
+	}
+}
+
+// fire handles the timer firing: it detects idleness, then sends
+// heartbeats while the source is idle.
+func (m *idleMonitor) fire() {
+	p := m.p
+	if m.idleSince.IsZero() {
+		elapsed := p.clock().Now().Sub(m.last)
+		if elapsed < p.IdleTimeout {
+			m.arm(p.IdleTimeout - elapsed)
+			return
+		}
+		m.idleSince = m.last
+		atomic.StoreInt64(&p.idleSince, m.idleSince.UnixNano())
+		atomic.AddUint64(&p.stats.Idle, 1)
+		m.p.logger().Warnf("Source delivered no messages for %s.", elapsed.Round(time.Second))
+	}
+
+	if p.Heartbeat <= 0 {
+		m.stop()
+		return
+	}
+	m.heartbeat()
+	m.arm(p.Heartbeat)
+}
+
+// heartbeat writes a heartbeat message to the destination, once.
+func (m *idleMonitor) heartbeat() {
+	p := m.p
+	body, _ := json.Marshal(heartbeat{Heartbeat: p.clock().Now().UTC(), Pipeline: p.Name, IdleSince: m.idleSince.UTC()})
+	msg := message.New(string(body))
+	msg.Metadata[MetaHeartbeat] = "true"
+
+	err := p.write(p.Destination, msg)
+	if err != nil {
+		m.p.logger().Warn("Failed to write a heartbeat: ", err)
+		return
+	}
+	atomic.AddUint64(&p.stats.Heartbeats, 1)
+}
+
+// arm replaces the timer with one firing after `d`.
+func (m *idleMonitor) arm(d time.Duration) {
+	m.stop()
+	m.timer = m.p.clock().NewTimer(d)
+}
+
+// stop stops the timer.
+func (m *idleMonitor) stop() {
+	if m != nil && m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+}
@@ -0,0 +1,146 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// Limits are the hard limits of a destination.
+type Limits struct {
+	// MaxMessageSize is the largest message body in bytes, 0 if
+	// unlimited.
+	MaxMessageSize int
+}
+
+// Limited is an optional interface implemented by destinations with
+// hard payload limits (e.g. Kinesis records are at most 1 MiB).
+// Pipelines check messages against them before writing, see
+// Pipeline.OnOversize.
+type Limited interface {
+	Limits() Limits
+}
+
+// OversizePolicy decides what happens to a message larger than the
+// pipeline's size limit.
+type OversizePolicy int
+
+const (
+	// RejectOversize quarantines the message to the DLQ.
+	RejectOversize OversizePolicy = iota
+	// TruncateOversize cuts the body to the limit (at a UTF-8
+	// character boundary) and sets MetaTruncated to its original
+	// size. Truncated JSON bodies are no longer valid JSON.
+	TruncateOversize
+	// OffloadOversize stores the body with Pipeline.Offloader and
+	// writes an OffloadPointer in its place.
+	OffloadOversize
+)
+
+// Metadata keys set on oversized messages.
+const (
+	// MetaTruncated is the size in bytes of a truncated body.
+	MetaTruncated = "manifold.truncated"
+	// MetaOffloaded is the location of an offloaded body.
+	MetaOffloaded = "manifold.offloaded"
+)
+
+// Offloader stores message bodies too large for a destination, e.g.
+// in S3 (see OffloadStore).
+type Offloader interface {
+	// Offload stores the body of `m` and returns its location.
+	Offload(m message.Message) (location string, err error)
+}
+
+// OffloadPointer is the JSON body written in place of an offloaded
+// body, consumers fetch the body from Location.
+type OffloadPointer struct {
+	Location string `json:"location"`
+	Size     int    `json:"size"`
+}
+
+// OversizeError is the error of a message larger than the size limit.
+type OversizeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *OversizeError) Error() string {
+	return fmt.Sprintf("message of %d bytes exceeds the %d bytes limit", e.Size, e.Limit)
+}
+
+// DestinationLimits returns the limits of `dest`, zero unless it
+// implements Limited.
+func DestinationLimits(dest Destination) Limits {
+	if l, ok := dest.(Limited); ok {
+		return l.Limits()
+	}
+	return Limits{}
+}
+
+// maxMessageSize returns MaxMessageSize, or the destination's limit.
+func (p *Pipeline) maxMessageSize() int {
+	if p.MaxMessageSize > 0 {
+		return p.MaxMessageSize
+	}
+	return DestinationLimits(p.Destination).MaxMessageSize
+}
+
+// guard applies OnOversize to `msg` if its body is larger than
+// `limit` bytes (unless it is 0). It returns false if the message was
+// rejected, in which case it is acknowledged.
+func (p *Pipeline) guard(msg message.Message, limit int) (message.Message, bool) {
+	size := len(msg.Body)
+	if limit <= 0 || size <= limit {
+		return msg, true
+	}
+
+	var err error = &OversizeError{Size: size, Limit: limit}
+	switch p.OnOversize {
+	case TruncateOversize:
+		msg.Metadata = msg.Metadata.Copy()
+		msg.Metadata[MetaTruncated] = strconv.Itoa(size)
+		msg.Body = truncate(msg.Body, limit)
+		return p.oversized(msg, nil)
+	case OffloadOversize:
+		if p.Offloader == nil {
+			break
+		}
+		var location string
+		location, err = p.Offloader.Offload(msg)
+		if err != nil {
+			err = fmt.Errorf("failed to offload oversized message: %w", err)
+			break
+		}
+		pointer, _ := json.Marshal(OffloadPointer{Location: location, Size: size})
+		msg.Metadata = msg.Metadata.Copy()
+		msg.Metadata[MetaOffloaded] = location
+		msg.Body = string(pointer)
+		return p.oversized(msg, nil)
+	}
+	return p.oversized(msg, err)
+}
+
+// oversized counts an oversized message and rejects it if `err` is
+// set.
+func (p *Pipeline) oversized(msg message.Message, err error) (message.Message, bool) {
+	atomic.AddUint64(&p.stats.Oversized, 1)
+	if err == nil {
+		return msg, true
+	}
+	msg.Done(p.reject(recordAttempt(msg, err), err))
+	return msg, false
+}
+
+// truncate returns the first `n` bytes of `s`, less the bytes of a
+// character cut in two.
+func truncate(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,93 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// limited is a destination with a size limit.
+type limited struct {
+	memory
+	size int
+}
+
+func (l *limited) Limits() Limits { return Limits{MaxMessageSize: l.size} }
+
+// offloader stores bodies in memory.
+type offloader struct {
+	bodies []string
+	err    error
+}
+
+func (o *offloader) Offload(m message.Message) (string, error) {
+	if o.err != nil {
+		return "", o.err
+	}
+	o.bodies = append(o.bodies, m.Body)
+	return "mem://payload", nil
+}
+
+func TestPipeline_GuardRejects(t *testing.T) {
+	dlq := &memory{}
+	p := &Pipeline{Destination: &limited{size: 4}, DLQ: dlq}
+	limit := p.maxMessageSize()
+	assert.Equal(t, 4, limit)
+
+	_, ok := p.guard(message.New("fits"), limit)
+	assert.True(t, ok)
+
+	var acked []error
+	msg := message.New("too long")
+	msg.Ack = func(err error) { acked = append(acked, err) }
+	_, ok = p.guard(msg, limit)
+	assert.False(t, ok)
+	assert.True(t, errors.Is(acked[0], message.ErrQuarantined))
+	var oversize *OversizeError
+	assert.True(t, errors.As(acked[0], &oversize))
+	assert.Equal(t, 8, oversize.Size)
+	assert.Contains(t, dlq.messages[0], `"errors":["message of 8 bytes exceeds the 4 bytes limit"]`)
+	assert.Equal(t, uint64(1), p.Stats().Oversized)
+
+	// MaxMessageSize overrides the destination's limit
+	p.MaxMessageSize = 10
+	assert.Equal(t, 10, p.maxMessageSize())
+	assert.Equal(t, 0, (&Pipeline{Destination: &memory{}}).maxMessageSize())
+}
+
+func TestPipeline_GuardTruncates(t *testing.T) {
+	p := &Pipeline{OnOversize: TruncateOversize}
+	msg, ok := p.guard(message.New("héllo"), 2)
+	assert.True(t, ok)
+	// é is two bytes, it isn't cut in two
+	assert.Equal(t, "h", msg.Body)
+	assert.Equal(t, "6", msg.Metadata.Get(MetaTruncated))
+}
+
+func TestPipeline_GuardOffloads(t *testing.T) {
+	store := &offloader{}
+	p := &Pipeline{OnOversize: OffloadOversize, Offloader: store}
+	msg, ok := p.guard(message.New("too long"), 4)
+	assert.True(t, ok)
+	assert.Equal(t, `{"location":"mem://payload","size":8}`, msg.Body)
+	assert.Equal(t, "mem://payload", msg.Metadata.Get(MetaOffloaded))
+	assert.Equal(t, []string{"too long"}, store.bodies)
+
+	// messages are rejected if offloading fails
+	dlq := &memory{}
+	p = &Pipeline{OnOversize: OffloadOversize, Offloader: &offloader{err: errors.New("denied")}, DLQ: dlq}
+	_, ok = p.guard(message.New("too long"), 4)
+	assert.False(t, ok)
+	assert.Contains(t, dlq.messages[0], "failed to offload oversized message: denied")
+}
+
+func TestRouter_Limits(t *testing.T) {
+	r := &Router{
+		Routes:  []Route{{Destination: &limited{size: 8}}, {Destination: &memory{}}},
+		Default: &limited{size: 4},
+	}
+	assert.Equal(t, Limits{MaxMessageSize: 4}, DestinationLimits(r))
+	assert.Equal(t, Limits{}, DestinationLimits(&Router{Default: &memory{}}))
+}
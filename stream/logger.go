@@ -0,0 +1,209 @@
+package stream
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Logger is the logger of pipelines and connectors. Lines carry
+// structured fields identifying where they come from: the flow (see
+// Pipeline.Logger), the connector, and what it was working on (e.g.
+// a Kinesis shard or an S3 key). It defaults to DefaultLogger, which
+// writes to the standard logrus logger; other logging libraries plug
+// in by implementing it.
+type Logger interface {
+	// WithField returns a logger adding `key` to the fields of its
+	// lines.
+	WithField(key string, value interface{}) Logger
+	// WithFields returns a logger adding `fields` to the fields of
+	// its lines.
+	WithFields(fields Fields) Logger
+
+	Trace(args ...interface{})
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+	Tracef(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Fields are the structured fields of log lines.
+type Fields map[string]interface{}
+
+// Logged is implemented by connectors that log, so that pipelines can
+// set their logger before connecting them.
+type Logged interface {
+	SetLogger(Logger)
+}
+
+// Leveled is implemented by loggers whose level can be changed while
+// they are used (see LevelLogger).
+type Leveled interface {
+	Level() Level
+	SetLevel(Level)
+}
+
+// Level is the severity of log lines, loggers write those at their
+// level or more severe.
+type Level uint32
+
+const (
+	ErrorLevel Level = iota
+	WarnLevel
+	InfoLevel
+	DebugLevel
+	TraceLevel
+)
+
+var levelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+func (l Level) String() string {
+	if int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("Level(%d)", l)
+}
+
+// ParseLevel parses a level name: error, warn (or warning), info,
+// debug or trace.
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(name)
+	if name == "warning" {
+		name = "warn"
+	}
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// logrus levels of Levels.
+var logrusLevels = []log.Level{log.ErrorLevel, log.WarnLevel, log.InfoLevel, log.DebugLevel, log.TraceLevel}
+
+// DefaultLogger writes to the standard logrus logger.
+var DefaultLogger Logger = Logrus(log.StandardLogger())
+
+// Logrus returns a Logger writing to `logger`.
+func Logrus(logger *log.Logger) Logger {
+	return logrusLogger{log.NewEntry(logger)}
+}
+
+type logrusLogger struct {
+	entry *log.Entry
+}
+
+func (l logrusLogger) WithField(key string, value interface{}) Logger {
+	return logrusLogger{l.entry.WithField(key, value)}
+}
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{l.entry.WithFields(log.Fields(fields))}
+}
+
+func (l logrusLogger) Trace(args ...interface{}) { l.entry.Trace(args...) }
+func (l logrusLogger) Debug(args ...interface{}) { l.entry.Debug(args...) }
+func (l logrusLogger) Info(args ...interface{})  { l.entry.Info(args...) }
+func (l logrusLogger) Warn(args ...interface{})  { l.entry.Warn(args...) }
+func (l logrusLogger) Error(args ...interface{}) { l.entry.Error(args...) }
+
+func (l logrusLogger) Tracef(format string, args ...interface{}) { l.entry.Tracef(format, args...) }
+func (l logrusLogger) Debugf(format string, args ...interface{}) { l.entry.Debugf(format, args...) }
+func (l logrusLogger) Infof(format string, args ...interface{})  { l.entry.Infof(format, args...) }
+func (l logrusLogger) Warnf(format string, args ...interface{})  { l.entry.Warnf(format, args...) }
+func (l logrusLogger) Errorf(format string, args ...interface{}) { l.entry.Errorf(format, args...) }
+
+// LevelLogger is a Logger with its own level, e.g. to log a flow at
+// Debug, or to keep a noisy one at Warn, while others log at Info. It
+// writes to the output of the standard logrus logger, with its
+// formatter and hooks as of NewLevelLogger. Its level can be changed
+// while it is used, including by loggers derived with WithField.
+type LevelLogger struct {
+	Logger
+	logger *log.Logger
+}
+
+// NewLevelLogger returns a LevelLogger at `level`.
+func NewLevelLogger(level Level) *LevelLogger {
+	std := log.StandardLogger()
+	logger := &log.Logger{
+		Out:          std.Out,
+		Formatter:    std.Formatter,
+		Hooks:        std.Hooks,
+		ReportCaller: std.ReportCaller,
+		ExitFunc:     std.ExitFunc,
+	}
+	l := &LevelLogger{Logger: Logrus(logger), logger: logger}
+	l.SetLevel(level)
+	return l
+}
+
+// StandardLevel returns the level of the standard logrus logger.
+func StandardLevel() Level {
+	std := log.GetLevel()
+	for i, l := range logrusLevels {
+		if std <= l {
+			return Level(i)
+		}
+	}
+	return TraceLevel
+}
+
+func (l *LevelLogger) Level() Level {
+	logger := l.logger.GetLevel()
+	for i, level := range logrusLevels {
+		if logger == level {
+			return Level(i)
+		}
+	}
+	return ErrorLevel
+}
+
+func (l *LevelLogger) SetLevel(level Level) {
+	if level > TraceLevel {
+		level = TraceLevel
+	}
+	l.logger.SetLevel(logrusLevels[level])
+}
+
+// logged is embedded by connectors to implement Logged.
+type logged struct {
+	l Logger
+}
+
+func (l *logged) SetLogger(logger Logger) {
+	l.l = logger
+}
+
+// logger returns the logger set, or DefaultLogger.
+func (l *logged) logger() Logger {
+	if l.l == nil {
+		return DefaultLogger
+	}
+	return l.l
+}
+
+// setLogger sets `logger` on `connector` if it implements Logged,
+// with a `connector` field naming it.
+func setLogger(connector interface{}, logger Logger) {
+	if l, ok := connector.(Logged); ok {
+		l.SetLogger(logger.WithField("connector", connectorName(connector)))
+	}
+}
+
+// connectorName returns the name of the type of `connector`.
+func connectorName(connector interface{}) string {
+	t := reflect.TypeOf(connector)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
@@ -0,0 +1,91 @@
+package stream
+
+import (
+	"io"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// chatty is a destination logging its writes.
+type chatty struct {
+	memory
+	logged
+}
+
+func (c *chatty) Write(message string) error {
+	c.logger().Info("wrote ", message)
+	return c.memory.Write(message)
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]Level{"error": ErrorLevel, "WARNING": WarnLevel, "warn": WarnLevel, "debug": DebugLevel, "trace": TraceLevel} {
+		level, err := ParseLevel(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, want, level, name)
+	}
+	_, err := ParseLevel("loud")
+	assert.Error(t, err)
+	assert.Equal(t, "info", InfoLevel.String())
+}
+
+func TestLevelLogger(t *testing.T) {
+	l := NewLevelLogger(WarnLevel)
+	l.logger.Out = io.Discard
+	hook := test.NewLocal(l.logger)
+	flow := l.WithField("flow", "orders")
+
+	flow.Info("hidden")
+	flow.Warn("shown")
+	l.SetLevel(DebugLevel)
+	assert.Equal(t, DebugLevel, l.Level())
+	flow.Debug("debug")
+
+	var messages []string
+	for _, e := range hook.AllEntries() {
+		messages = append(messages, e.Message)
+		assert.Equal(t, "orders", e.Data["flow"])
+	}
+	assert.Equal(t, []string{"shown", "debug"}, messages)
+}
+
+func TestPipeline_Logger(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	src := make(channelSource)
+	dest := &chatty{}
+	p := &Pipeline{
+		Name:        "orders",
+		Source:      src,
+		Destination: &Router{Default: dest},
+		Logger:      Logrus(logger),
+	}
+	done := make(chan error)
+	go func() { done <- p.RunUntilDrained() }()
+	src <- message.New("a")
+	close(src)
+	assert.NoError(t, <-done)
+
+	var wrote *log.Entry
+	for _, e := range hook.AllEntries() {
+		assert.Equal(t, "orders", e.Data["flow"], e.Message)
+		if e.Message == "wrote a" {
+			wrote = e
+		}
+	}
+	if assert.NotNil(t, wrote) {
+		assert.Equal(t, "chatty", wrote.Data["connector"])
+		assert.Equal(t, "default", wrote.Data["route"])
+	}
+
+	_, ok := p.LogLevel()
+	assert.False(t, ok)
+	assert.Error(t, p.SetLogLevel(DebugLevel))
+	p = &Pipeline{Logger: NewLevelLogger(WarnLevel)}
+	assert.NoError(t, p.SetLogLevel(DebugLevel))
+	level, ok := p.LogLevel()
+	assert.True(t, ok)
+	assert.Equal(t, DebugLevel, level)
+}
@@ -0,0 +1,363 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
+)
+
+// Neo4j runs a parameterized Cypher statement for every message,
+// or for batches of messages with UNWIND, to maintain a graph from
+// relationship events.
+//
+// Cypher is a template executed against each message (see
+// templateData), which allows picking labels or relationship types
+// that can't be parameters with the identifier function, e.g.
+// "MERGE (n:{{identifier .Fields.kind}} ...)". Values must be passed
+// as parameters: actions other than identifier are rejected. The
+// fields of a JSON object message are passed as the `event`
+// parameter and its metadata as `metadata`:
+//
+//	MERGE (a:User {id: $event.from})
+//	MERGE (b:User {id: $event.to})
+//	MERGE (a)-[:FOLLOWS]->(b)
+//
+// With Config.BatchSize > 1, messages are buffered and consecutive
+// messages rendering the same statement are run together, in order:
+// their fields are passed as the `events` list, to be unwound, and
+// their fields and metadata as the `messages` list of
+// {event, metadata} maps:
+//
+//	UNWIND $events AS event
+//	MERGE (a:User {id: event.from}) ...
+//
+// Without batching, writes are synchronous and failures are
+// returned. Failed batches are retried Config.MaxRetries times;
+// messages written with WriteAsync (as pipelines do) are
+// acknowledged once their statement has run.
+type Neo4j struct {
+	URI      string // e.g. neo4j://localhost:7687
+	Username string
+	Password string
+	Database string // defaults to the server's default database
+	Cypher   string
+	Config   *Neo4jConfig
+	driver   neo4j.Driver
+	cypher   *template.Template
+	// exec runs a statement in a write transaction.
+	exec    func(cypher string, params map[string]interface{}) error
+	batcher *batcher
+	clocked
+	logged
+}
+
+// Neo4jConfig configures batching.
+type Neo4jConfig struct {
+	BatchSize  int // messages per transaction, defaults to 1 (no batching)
+	FlushEvery int // seconds, defaults to 1
+	MaxRetries int // retries of failed batches, defaults to 3
+}
+
+// neo4jEvent is a message mapped to a statement and its
+// parameters.
+type neo4jEvent struct {
+	cypher   string
+	fields   map[string]interface{}
+	metadata map[string]interface{}
+}
+
+// cypherIdentifier matches labels, relationship types and property
+// keys that can be used in Cypher.
+var cypherIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (n *Neo4j) Connect() (err error) {
+	if n.Config == nil {
+		n.Config = &Neo4jConfig{}
+	}
+	if n.Config.BatchSize < 1 {
+		n.Config.BatchSize = 1
+	}
+	if n.Config.FlushEvery < 1 {
+		n.Config.FlushEvery = 1
+	}
+	if n.Config.MaxRetries < 1 {
+		n.Config.MaxRetries = 3
+	}
+
+	n.cypher, err = cypherTemplate(n.Cypher)
+	if err != nil {
+		return
+	}
+
+	if n.exec == nil {
+		n.logger().Info("Establishing neo4j connection...")
+		auth := neo4j.NoAuth()
+		if n.Username != "" {
+			auth = neo4j.BasicAuth(n.Username, n.Password, "")
+		}
+		n.driver, err = neo4j.NewDriver(n.URI, auth)
+		if err == nil {
+			err = n.driver.VerifyConnectivity()
+		}
+		if err != nil {
+			n.logger().Error("Neo4j: Failed to connect: ", err)
+			return
+		}
+		n.exec = n.run
+	}
+
+	if n.Config.BatchSize > 1 {
+		n.batcher = newBatcher("Neo4j", n.logger(), n.clock(), n.Config.BatchSize, time.Duration(n.Config.FlushEvery)*time.Second, n.Config.MaxRetries, n.flush)
+	}
+
+	return
+}
+
+// cypherTemplate parses `text` as a Cypher template whose actions
+// may only render identifiers (see identifier), so that message
+// values can't inject Cypher.
+func cypherTemplate(text string) (*template.Template, error) {
+	t, err := template.New("cypher").
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"identifier": identifier}).
+		Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	err = checkCypherNode(t.Tree.Root)
+	if err != nil {
+		return nil, fmt.Errorf("Neo4j: %s, values must be passed as parameters", err)
+	}
+	return t, nil
+}
+
+// checkCypherNode returns an error if `node` renders anything but
+// text and identifiers.
+func checkCypherNode(node parse.Node) error {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		for _, n := range node.Nodes {
+			if err := checkCypherNode(n); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		if len(node.Pipe.Decl) > 0 {
+			return nil // assignments render nothing
+		}
+		cmds := node.Pipe.Cmds
+		if id, ok := cmds[len(cmds)-1].Args[0].(*parse.IdentifierNode); ok && id.Ident == "identifier" {
+			return nil
+		}
+		return fmt.Errorf("action %s doesn't render an identifier", node)
+	case *parse.IfNode:
+		return checkCypherBranches(node.List, node.ElseList)
+	case *parse.RangeNode:
+		return checkCypherBranches(node.List, node.ElseList)
+	case *parse.WithNode:
+		return checkCypherBranches(node.List, node.ElseList)
+	case *parse.TemplateNode:
+		return fmt.Errorf("action %s isn't supported", node)
+	}
+	return nil
+}
+
+func checkCypherBranches(list, elseList *parse.ListNode) error {
+	err := checkCypherNode(list)
+	if err == nil {
+		err = checkCypherNode(elseList)
+	}
+	return err
+}
+
+// identifier backtick-quotes `v`, a label, relationship type or
+// property key, if it is a valid identifier.
+func identifier(v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok || !cypherIdentifier.MatchString(s) {
+		return "", fmt.Errorf("Neo4j: %v is not a valid identifier", v)
+	}
+	return "`" + s + "`", nil
+}
+
+// run runs `cypher` in a write transaction, which the driver retries
+// on transient errors.
+func (n *Neo4j) run(cypher string, params map[string]interface{}) error {
+	session := n.driver.NewSession(neo4j.SessionConfig{
+		AccessMode:   neo4j.AccessModeWrite,
+		DatabaseName: n.Database,
+	})
+	defer session.Close()
+
+	_, err := session.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		result, err := tx.Run(cypher, params)
+		if err != nil {
+			return nil, err
+		}
+		return result.Consume()
+	})
+	return err
+}
+
+// Disconnect flushes buffered messages and closes the driver.
+func (n *Neo4j) Disconnect() (err error) {
+	if n.batcher != nil {
+		n.batcher.close()
+		n.batcher = nil
+	}
+	if n.driver != nil {
+		err = n.driver.Close()
+		n.driver = nil
+	}
+	return
+}
+
+// Capabilities of Neo4j: statements aren't assumed to be idempotent,
+// although MERGE statements are.
+func (n *Neo4j) Capabilities() Capabilities {
+	batching := n.Config != nil && n.Config.BatchSize > 1
+	return Capabilities{ConfirmedWrites: true, Batching: batching, Ordering: !batching}
+}
+
+func (n *Neo4j) Info() {
+	n.logger().Infof("Neo4j: %s", n.URI)
+	n.logger().Info("Neo4j.Cypher: ", n.Cypher)
+	n.logger().Infof("Neo4jConfig: %+v", *n.Config)
+}
+
+func (n *Neo4j) Write(body string) (err error) {
+	return n.WriteMessage(message.New(body))
+}
+
+// WriteMessage runs the statement for `m`, or buffers it when
+// batching.
+func (n *Neo4j) WriteMessage(m message.Message) (err error) {
+	e, err := n.event(m)
+	if err != nil {
+		return
+	}
+
+	if n.batcher != nil {
+		n.batcher.add(e, nil)
+		return
+	}
+	return n.exec(e.cypher, map[string]interface{}{
+		"event":    e.fields,
+		"metadata": e.metadata,
+	})
+}
+
+// WriteAsync writes `m` like WriteMessage and calls `done` once its
+// statement has run.
+func (n *Neo4j) WriteAsync(m message.Message, done func(error)) {
+	if n.batcher == nil {
+		done(n.WriteMessage(m))
+		return
+	}
+
+	e, err := n.event(m)
+	if err != nil {
+		done(err)
+		return
+	}
+	n.batcher.add(e, done)
+}
+
+// Buffered reports whether messages are batched.
+func (n *Neo4j) Buffered() bool {
+	return n.batcher != nil
+}
+
+// event renders the statement of `m` and decodes its parameters.
+func (n *Neo4j) event(m message.Message) (e neo4jEvent, err error) {
+	e.cypher, err = executeTemplate(n.cypher, m)
+	if err != nil {
+		return
+	}
+	e.fields, err = neo4jFields(m.Body)
+	if err != nil {
+		return
+	}
+
+	e.metadata = map[string]interface{}{}
+	for k, v := range m.Metadata {
+		e.metadata[k] = v
+	}
+	return
+}
+
+// neo4jFields decodes a JSON object, keeping integers as int64
+// (Neo4j Integer) rather than float64.
+func neo4jFields(body string) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(body)))
+	decoder.UseNumber()
+
+	var fields map[string]interface{}
+	err := decoder.Decode(&fields)
+	if err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, errors.New("Neo4j: message is not a JSON object")
+	}
+	return neo4jValue(fields).(map[string]interface{}), nil
+}
+
+func neo4jValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, val := range v {
+			v[k] = neo4jValue(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = neo4jValue(val)
+		}
+	}
+	return v
+}
+
+// flush runs consecutive events of `batch` sharing a statement
+// together, with their fields as the `events` parameter and their
+// fields and metadata as `messages`. Once a statement fails, the
+// events of the following statements are retried too, so that
+// events are applied in order.
+func (n *Neo4j) flush(batch []*batchEntry) error {
+	for start := 0; start < len(batch); {
+		cypher := batch[start].value.(neo4jEvent).cypher
+		end := start
+		var events, messages []interface{}
+		for ; end < len(batch) && batch[end].value.(neo4jEvent).cypher == cypher; end++ {
+			e := batch[end].value.(neo4jEvent)
+			events = append(events, e.fields)
+			messages = append(messages, map[string]interface{}{"event": e.fields, "metadata": e.metadata})
+		}
+
+		err := n.exec(cypher, map[string]interface{}{"events": events, "messages": messages})
+		if err != nil {
+			for _, e := range batch[start:] {
+				e.err = err
+			}
+			return nil
+		}
+		start = end
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package stream
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+type neo4jRun struct {
+	cypher string
+	params map[string]interface{}
+}
+
+func TestNeo4j_PerMessage(t *testing.T) {
+	var runs []neo4jRun
+	dest := &Neo4j{
+		Cypher: "MERGE (a:{{identifier .Fields.kind}} {id: $event.from})",
+		exec: func(cypher string, params map[string]interface{}) error {
+			runs = append(runs, neo4jRun{cypher, params})
+			return nil
+		},
+	}
+	assert.NoError(t, dest.Connect())
+
+	m := message.New(`{"kind":"User","from":12,"score":0.5,"tags":[1]}`)
+	m.Metadata["seq"] = "7"
+	assert.NoError(t, dest.WriteMessage(m))
+	assert.Error(t, dest.Write(`[1, 2]`))
+	// labels can't inject Cypher
+	err := dest.Write(`{"kind":"User {id: 1}) DETACH DELETE a //"}`)
+	assert.Contains(t, err.Error(), "Neo4j: User {id: 1}) DETACH DELETE a // is not a valid identifier")
+	assert.NoError(t, dest.Disconnect())
+
+	assert.Equal(t, []neo4jRun{{
+		cypher: "MERGE (a:`User` {id: $event.from})",
+		params: map[string]interface{}{
+			"event": map[string]interface{}{
+				"kind": "User", "from": int64(12), "score": 0.5, "tags": []interface{}{int64(1)},
+			},
+			"metadata": map[string]interface{}{"seq": "7"},
+		},
+	}}, runs)
+}
+
+func TestNeo4j_Template(t *testing.T) {
+	for _, cypher := range []string{
+		"MERGE (a:User {id: {{.Fields.id}}})",
+		"MERGE (a:User {id: '{{.Body}}'})",
+		"{{if .Fields.kind}}MERGE (a:{{.Fields.kind}}){{end}}",
+		`{{define "x"}}{{.Body}}{{end}}{{template "x" .}}`,
+	} {
+		dest := &Neo4j{Cypher: cypher, exec: func(string, map[string]interface{}) error { return nil }}
+		assert.Error(t, dest.Connect(), cypher)
+	}
+
+	dest := &Neo4j{
+		Cypher: "MERGE (a)-[:{{with .Fields.rel}}{{identifier .}}{{else}}RELATED{{end}}]->(b)",
+		exec:   func(string, map[string]interface{}) error { return nil },
+	}
+	assert.NoError(t, dest.Connect())
+}
+
+func TestNeo4j_Batch(t *testing.T) {
+	var runs []neo4jRun
+	dest := &Neo4j{
+		Cypher: "UNWIND $events AS event MERGE (:{{identifier .Fields.kind}} {id: event.id})",
+		Config: &Neo4jConfig{BatchSize: 10},
+		exec: func(cypher string, params map[string]interface{}) error {
+			runs = append(runs, neo4jRun{cypher, params})
+			return nil
+		},
+	}
+	assert.NoError(t, dest.Connect())
+	m := message.New(`{"kind":"User","id":1}`)
+	m.Metadata["seq"] = "7"
+	assert.NoError(t, dest.WriteMessage(m))
+	assert.NoError(t, dest.Write(`{"kind":"User","id":2}`))
+	assert.NoError(t, dest.Write(`{"kind":"Post","id":3}`))
+	assert.NoError(t, dest.Write(`{"kind":"User","id":4}`))
+	assert.NoError(t, dest.Disconnect())
+
+	// consecutive events of a statement are run together, in order
+	assert.Len(t, runs, 3)
+	assert.Equal(t, "UNWIND $events AS event MERGE (:`User` {id: event.id})", runs[0].cypher)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"kind": "User", "id": int64(1)},
+		map[string]interface{}{"kind": "User", "id": int64(2)},
+	}, runs[0].params["events"])
+	assert.Equal(t, map[string]interface{}{
+		"event":    map[string]interface{}{"kind": "User", "id": int64(1)},
+		"metadata": map[string]interface{}{"seq": "7"},
+	}, runs[0].params["messages"].([]interface{})[0])
+	assert.Equal(t, "UNWIND $events AS event MERGE (:`Post` {id: event.id})", runs[1].cypher)
+	assert.Len(t, runs[1].params["events"], 1)
+	assert.Equal(t, runs[0].cypher, runs[2].cypher)
+	assert.Len(t, runs[2].params["events"], 1)
+}
+
+func TestNeo4j_WriteAsync(t *testing.T) {
+	var cyphers []string
+	failures := 1
+	dest := &Neo4j{
+		Cypher: "CREATE (:{{identifier .Fields.kind}} {id: event.id})",
+		Config: &Neo4jConfig{BatchSize: 10, MaxRetries: 1},
+		exec: func(cypher string, params map[string]interface{}) error {
+			cyphers = append(cyphers, cypher)
+			if strings.Contains(cypher, "Post") && failures > 0 {
+				failures--
+				return errors.New("deadlock detected")
+			}
+			return nil
+		},
+	}
+	assert.NoError(t, dest.Connect())
+	assert.True(t, dest.Buffered())
+
+	var results []error
+	for _, body := range []string{`{"kind":"User","id":1}`, `{"kind":"Post","id":2}`, `{"kind":"User","id":3}`, `{"kind":1}`} {
+		dest.WriteAsync(message.New(body), func(err error) { results = append(results, err) })
+	}
+	assert.NoError(t, dest.Disconnect())
+
+	// the statements following the failed one are retried with it,
+	// rather than run before it
+	assert.Equal(t, []string{
+		"CREATE (:`User` {id: event.id})",
+		"CREATE (:`Post` {id: event.id})",
+		"CREATE (:`Post` {id: event.id})",
+		"CREATE (:`User` {id: event.id})",
+	}, cyphers)
+	assert.Len(t, results, 4)
+	assert.Error(t, results[0], "invalid identifier")
+	for _, err := range results[1:] {
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,61 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// OffloadStore is an Offloader storing bodies in Location, an
+// s3://bucket/prefix URL or a local directory, as objects named
+// after the day and the SHA-256 of the body:
+//
+//	<Location>/2020-10-01/<sha256>
+//
+// so that retried messages are stored once.
+type OffloadStore struct {
+	Location   string
+	Region     string
+	AWSConfig  *aws.Config      // defaults to the default credential chain
+	Sess       *session.Session // v1 session used if AWSConfig isn't set
+	RoleARN    string           // role assumed to write to S3
+	ExternalID string           // external ID of RoleARN, if required
+	store      objectStore
+	mu         sync.Mutex
+	clocked
+}
+
+// Offload stores the body of `m` and returns its location.
+func (o *OffloadStore) Offload(m message.Message) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.store == nil {
+		store, err := newObjectStore(context.Background(), o.Location, o.AWSConfig, o.Sess, o.Region, o.RoleARN, o.ExternalID)
+		if err != nil {
+			return "", err
+		}
+		o.store = store
+	}
+
+	hash := sha256.Sum256([]byte(m.Body))
+	key := o.clock().Now().UTC().Format("2006-01-02") + "/" + hex.EncodeToString(hash[:])
+	err := o.store.put(context.Background(), key, []byte(m.Body))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(o.Location, "/") + "/" + key, nil
+}
+
+// Resources returns the bucket of Location, if it is on S3.
+func (o *OffloadStore) Resources() []Resource {
+	return storeResources(o.Location, o.Region)
+}
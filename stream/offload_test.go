@@ -0,0 +1,103 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffloadStore(t *testing.T) {
+	dir := t.TempDir()
+	o := &OffloadStore{Location: dir + "/"}
+	o.SetClock(NewFakeClock(time.Date(2020, 10, 1, 15, 4, 5, 0, time.UTC)))
+
+	location, err := o.Offload(message.New("payload"))
+	assert.NoError(t, err)
+	key := "2020-10-01/239f59ed55e737c77147cf55ad0c1b030b6d7ee748a7426952f9b852d5a935e5"
+	assert.Equal(t, dir+"/"+key, location)
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(key)))
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", string(data))
+
+	o = &OffloadStore{Location: "s3://payloads/big", Region: "eu-west-1"}
+	assert.Equal(t, []Resource{{Kind: "aws_s3_bucket", Name: "payloads", Region: "eu-west-1"}}, o.Resources())
+}
+
+// bucket is an in-memory S3 bucket, listing one object per page.
+type bucket map[string][]byte
+
+func (b bucket) PutObject(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(input.Body)
+	b[*input.Key] = data
+	return &s3.PutObjectOutput{}, err
+}
+
+func (b bucket) HeadObject(ctx context.Context, input *s3.HeadObjectInput, opts ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if _, ok := b[*input.Key]; !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{}, nil
+}
+
+func (b bucket) GetObject(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, ok := b[*input.Key]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (b bucket) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, opts ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for key := range b {
+		if strings.HasPrefix(key, *input.Prefix) && key > aws.ToString(input.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{}
+	if len(keys) > 0 {
+		out.Contents = []types.Object{{Key: aws.String(keys[0])}}
+		out.NextContinuationToken = aws.String(keys[0])
+		out.IsTruncated = aws.Bool(len(keys) > 1)
+	}
+	return out, nil
+}
+
+func TestS3Store(t *testing.T) {
+	b := bucket{}
+	store := &s3Store{client: b, bucket: "payloads", prefix: "big"}
+	ctx := context.Background()
+	o := &OffloadStore{Location: "s3://payloads/big", store: store}
+	o.SetClock(NewFakeClock(time.Date(2020, 10, 1, 15, 4, 5, 0, time.UTC)))
+
+	location, err := o.Offload(message.New("payload"))
+	assert.NoError(t, err)
+	key := "2020-10-01/239f59ed55e737c77147cf55ad0c1b030b6d7ee748a7426952f9b852d5a935e5"
+	assert.Equal(t, "s3://payloads/big/"+key, location)
+	data, err := store.get(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", string(data))
+
+	assert.NoError(t, store.create(ctx, "2020-10-01/other", []byte("other")))
+	assert.Equal(t, errObjectExists, store.create(ctx, "2020-10-01/other", []byte("again")))
+	assert.Equal(t, "other", string(b["big/2020-10-01/other"]))
+
+	keys, err := store.list(ctx, "2020-10-01/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key, "2020-10-01/other"}, keys)
+}
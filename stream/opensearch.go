@@ -0,0 +1,269 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// OpenSearch bulk-indexes JSON object messages into OpenSearch or
+// Elasticsearch.
+//
+// Index and ID are templates executed against each message (see
+// templateData) with a `.Time` field as well: the time of the message,
+// read from Config.TimeField (milliseconds since epoch, or an RFC
+// 3339 string) and defaulting to the time of writing. Time-based
+// indices are named with it, e.g.:
+//
+//	Index: `logs-{{.Time.Format "2006.01.02"}}`
+//
+// With an ID, e.g. `{{.Fields.id}}`, documents are indexed under it
+// so that a message written again replaces its document rather than
+// duplicating it; OpenSearch generates IDs otherwise.
+//
+// Documents are sent in _bulk requests of Config.BatchSize documents
+// (or every Config.FlushEvery seconds). Requests failing with a 429
+// or 5xx status, and the documents of a bulk request rejected with
+// those statuses (e.g. when the write queue is full), are retried
+// with backoff Config.MaxRetries times; documents rejected otherwise
+// (e.g. mapping errors) fail without being retried. Messages written
+// with WriteAsync (as pipelines do) are acknowledged once their
+// document is indexed.
+type OpenSearch struct {
+	URL      string // e.g. https://localhost:9200
+	Index    string
+	ID       string
+	Username string
+	Password string
+	Config   *OpenSearchConfig
+	client   *http.Client
+	index    *template.Template
+	id       *template.Template
+	batcher  *batcher
+	clocked
+	logged
+}
+
+// OpenSearchConfig configures the time of documents and bulk
+// requests.
+type OpenSearchConfig struct {
+	TimeField  string
+	BatchSize  int // documents per bulk request, defaults to 500
+	FlushEvery int // seconds, defaults to 1
+	MaxRetries int // retries of failed documents, defaults to 5
+	Timeout    int // seconds, per request, defaults to 30
+}
+
+// indexData is the data of Index and ID templates.
+type indexData struct {
+	templateData
+	Time time.Time
+}
+
+// bulkItem is the result of a document in a _bulk response.
+type bulkItem struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+func (o *OpenSearch) Connect() (err error) {
+	if o.Config == nil {
+		o.Config = &OpenSearchConfig{}
+	}
+	if o.Config.BatchSize < 1 {
+		o.Config.BatchSize = 500
+	}
+	if o.Config.FlushEvery < 1 {
+		o.Config.FlushEvery = 1
+	}
+	if o.Config.MaxRetries < 1 {
+		o.Config.MaxRetries = 5
+	}
+	if o.Config.Timeout < 1 {
+		o.Config.Timeout = 30
+	}
+	if o.URL == "" || o.Index == "" {
+		return errors.New("OpenSearch: URL and Index must be configured")
+	}
+	o.client = &http.Client{Timeout: time.Duration(o.Config.Timeout) * time.Second}
+
+	o.index, err = newTemplate("index", o.Index)
+	if err != nil {
+		return
+	}
+	if o.ID != "" {
+		o.id, err = newTemplate("id", o.ID)
+		if err != nil {
+			return
+		}
+	}
+
+	o.batcher = newBatcher("OpenSearch", o.logger(), o.clock(), o.Config.BatchSize, time.Duration(o.Config.FlushEvery)*time.Second, o.Config.MaxRetries, o.send)
+	return
+}
+
+// Disconnect sends buffered documents.
+func (o *OpenSearch) Disconnect() (err error) {
+	if o.batcher != nil {
+		o.batcher.close()
+		o.batcher = nil
+	}
+	return
+}
+
+// Capabilities of OpenSearch: documents with an ID replace those
+// indexed before.
+func (o *OpenSearch) Capabilities() Capabilities {
+	return Capabilities{ConfirmedWrites: true, Batching: true, Idempotent: o.ID != ""}
+}
+
+func (o *OpenSearch) Info() {
+	o.logger().Infof("OpenSearch: %s/%s", o.URL, o.Index)
+	o.logger().Infof("OpenSearchConfig: %+v", *o.Config)
+}
+
+func (o *OpenSearch) Write(body string) (err error) {
+	return o.WriteMessage(message.New(body))
+}
+
+// WriteMessage buffers the document of `m`.
+func (o *OpenSearch) WriteMessage(m message.Message) (err error) {
+	doc, err := o.document(m)
+	if err != nil {
+		return
+	}
+	o.batcher.add(doc, nil)
+	return
+}
+
+// WriteAsync buffers the document of `m` and calls `done` once it has
+// been indexed.
+func (o *OpenSearch) WriteAsync(m message.Message, done func(error)) {
+	doc, err := o.document(m)
+	if err != nil {
+		done(err)
+		return
+	}
+	o.batcher.add(doc, done)
+}
+
+// document returns the action and source lines of `m` in a _bulk
+// request.
+func (o *OpenSearch) document(m message.Message) ([]byte, error) {
+	data := indexData{templateData: newTemplateData(m), Time: o.clock().Now()}
+	if data.Fields == nil {
+		return nil, errors.New("OpenSearch: message isn't a JSON object")
+	}
+	if v, ok := data.Fields[o.Config.TimeField]; ok && v != nil {
+		t, err := fieldTime(v)
+		if err != nil {
+			return nil, fmt.Errorf("OpenSearch: time field %s: %s", o.Config.TimeField, err)
+		}
+		data.Time = t
+	}
+
+	action := map[string]string{}
+	var err error
+	action["_index"], err = renderTemplate(o.index, data)
+	if err != nil {
+		return nil, err
+	}
+	if o.id != nil {
+		action["_id"], err = renderTemplate(o.id, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	line, err := json.Marshal(map[string]interface{}{"index": action})
+	if err != nil {
+		return nil, err
+	}
+
+	var doc bytes.Buffer
+	doc.Write(line)
+	doc.WriteByte('\n')
+	// documents must fit on a line
+	err = json.Compact(&doc, []byte(m.Body))
+	if err != nil {
+		return nil, err
+	}
+	doc.WriteByte('\n')
+	return doc.Bytes(), nil
+}
+
+// send indexes `batch` with a _bulk request, setting the error of
+// documents that failed.
+func (o *OpenSearch) send(batch []*batchEntry) error {
+	var body bytes.Buffer
+	for _, e := range batch {
+		body.Write(e.value.([]byte))
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(o.URL, "/")+"/_bulk", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if o.Username != "" {
+		req.SetBasicAuth(o.Username, o.Password)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("OpenSearch responded %s", resp.Status)
+	case resp.StatusCode >= 300:
+		io.Copy(ioutil.Discard, resp.Body)
+		err = fmt.Errorf("OpenSearch responded %s", resp.Status)
+		for _, e := range batch {
+			e.err, e.permanent = err, true
+		}
+		return nil
+	}
+
+	var result struct {
+		Errors bool                  `json:"errors"`
+		Items  []map[string]bulkItem `json:"items"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+	if !result.Errors {
+		return nil
+	}
+	if len(result.Items) != len(batch) {
+		return fmt.Errorf("OpenSearch: %d results for %d documents", len(result.Items), len(batch))
+	}
+	for i, item := range result.Items {
+		for _, r := range item {
+			if r.Status < 300 {
+				continue
+			}
+			reason := http.StatusText(r.Status)
+			if r.Error != nil {
+				reason = r.Error.Type + ": " + r.Error.Reason
+			}
+			batch[i].err = fmt.Errorf("OpenSearch: document rejected with status %d, %s", r.Status, reason)
+			// documents rejected under load are retried
+			batch[i].permanent = r.Status != http.StatusTooManyRequests && r.Status < 500
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenSearch_Document(t *testing.T) {
+	o := &OpenSearch{URL: "http://localhost:9200", Index: `logs-{{.Time.Format "2006.01.02"}}`, ID: "{{.Fields.id}}", Config: &OpenSearchConfig{TimeField: "ts"}}
+	o.SetClock(NewFakeClock(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)))
+	assert.NoError(t, o.Connect())
+	defer o.Disconnect()
+
+	doc, err := o.document(message.New(`{"id": "a1", "ts": "2020-09-30T23:00:00Z"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"index":{"_id":"a1","_index":"logs-2020.09.30"}}`+"\n"+`{"id":"a1","ts":"2020-09-30T23:00:00Z"}`+"\n", string(doc))
+
+	// the index defaults to the time of writing
+	doc, err = o.document(message.New(`{"id": "a2"}`))
+	assert.NoError(t, err)
+	assert.Contains(t, string(doc), `"_index":"logs-2020.10.01"`)
+
+	_, err = o.document(message.New(`not json`))
+	assert.Error(t, err)
+	_, err = o.document(message.New(`{"name": "no id"}`))
+	assert.Error(t, err)
+	assert.True(t, o.Capabilities().Idempotent)
+}
+
+func TestOpenSearch_PartialFailures(t *testing.T) {
+	var mu sync.Mutex
+	var requests [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_bulk", r.URL.Path)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		user, password, _ := r.BasicAuth()
+		assert.Equal(t, "elastic:secret", user+":"+password)
+
+		var ids []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			if json.Unmarshal(scanner.Bytes(), &action) == nil && action["index"] != nil {
+				ids = append(ids, action["index"]["_id"])
+			}
+		}
+		mu.Lock()
+		requests = append(requests, ids)
+		first := len(requests) == 1
+		mu.Unlock()
+
+		if !first {
+			w.Write([]byte(`{"errors": false, "items": [{"index": {"status": 200}}]}`))
+			return
+		}
+		// the second document is rejected under load, the third
+		// doesn't match the mapping
+		w.Write([]byte(`{"errors": true, "items": [
+			{"index": {"status": 201}},
+			{"index": {"status": 429, "error": {"type": "es_rejected_execution_exception", "reason": "queue full"}}},
+			{"index": {"status": 400, "error": {"type": "mapper_parsing_exception", "reason": "failed to parse field [n]"}}}
+		]}`))
+	}))
+	defer server.Close()
+
+	clock := NewFakeClock(time.Unix(0, 0))
+	o := &OpenSearch{URL: server.URL, Index: "events", ID: "{{.Fields.id}}", Username: "elastic", Password: "secret", Config: &OpenSearchConfig{BatchSize: 3}}
+	o.SetClock(clock)
+	assert.NoError(t, o.Connect())
+
+	results := make([]chan error, 3)
+	for i, body := range []string{`{"id": "1"}`, `{"id": "2"}`, `{"id": "3", "n": "x"}`} {
+		result := make(chan error, 1)
+		results[i] = result
+		o.WriteAsync(message.New(body), func(err error) { result <- err })
+	}
+
+	// the rejected document is retried after a backoff
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Second)
+		return len(results[1]) == 1
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, <-results[0])
+	assert.NoError(t, <-results[1])
+	assert.EqualError(t, <-results[2], "OpenSearch: document rejected with status 400, mapper_parsing_exception: failed to parse field [n]")
+	assert.NoError(t, o.Disconnect())
+	assert.Equal(t, [][]string{{"1", "2", "3"}, {"2"}}, requests)
+}
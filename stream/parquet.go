@@ -0,0 +1,138 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// ParquetColumn is a column of Parquet files written from JSON
+// messages, named after the message field it is read from.
+//
+// Type is one of string, long, double, boolean or timestamp
+// (read from milliseconds since epoch or an RFC 3339 string).
+type ParquetColumn struct {
+	Name string
+	Type string
+}
+
+// parquetTypes maps column types to parquet-go schema tags.
+var parquetTypes = map[string]string{
+	"string":    "type=UTF8",
+	"long":      "type=INT64",
+	"double":    "type=DOUBLE",
+	"boolean":   "type=BOOLEAN",
+	"timestamp": "type=TIMESTAMP_MICROS",
+}
+
+// parquetMetadata returns the parquet-go CSV metadata of `columns`;
+// all columns are optional.
+func parquetMetadata(columns []ParquetColumn) ([]string, error) {
+	var md []string
+	for _, c := range columns {
+		tag, ok := parquetTypes[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("column %s has unsupported type %q", c.Name, c.Type)
+		}
+		md = append(md, fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", c.Name, tag))
+	}
+	return md, nil
+}
+
+// parquetRow converts the fields of a JSON object to the values of
+// `columns`: string, int64, float64, bool or int64 microseconds
+// since epoch for timestamps. Missing fields are nil; values of
+// other JSON types are formatted as JSON in string columns and are
+// an error in other columns, as are non integral numbers in long
+// columns.
+func parquetRow(fields map[string]interface{}, columns []ParquetColumn) ([]interface{}, error) {
+	row := make([]interface{}, len(columns))
+	for i, c := range columns {
+		v, ok := fields[c.Name]
+		if !ok || v == nil {
+			continue
+		}
+
+		converted := true
+		switch c.Type {
+		case "string":
+			if s, ok := v.(string); ok {
+				row[i] = s
+			} else {
+				data, _ := json.Marshal(v)
+				row[i] = string(data)
+			}
+		case "long":
+			f, ok := v.(float64)
+			converted = ok && f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64
+			if converted {
+				row[i] = int64(f)
+			}
+		case "double":
+			row[i], converted = v.(float64)
+		case "boolean":
+			row[i], converted = v.(bool)
+		case "timestamp":
+			t, err := fieldTime(v)
+			converted = err == nil
+			if converted {
+				row[i] = t.UnixNano() / int64(time.Microsecond)
+			}
+		}
+		if !converted {
+			data, _ := json.Marshal(v)
+			return nil, fmt.Errorf("column %s: %s is not a valid %s", c.Name, data, c.Type)
+		}
+	}
+	return row, nil
+}
+
+// encodeParquet encodes `record`, whose schema is `columns` (see
+// partitionBatch), as a Snappy compressed Parquet file. Values are
+// read column by column through arrowValues, into rows sliced from a
+// single allocation that the writer holds until it flushes them.
+func encodeParquet(columns []ParquetColumn, record array.Record) ([]byte, error) {
+	md, err := parquetMetadata(columns)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	pw, err := writer.NewCSVWriterFromWriter(md, &buf, 1)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]func(i int) interface{}, len(columns))
+	for j := range columns {
+		values[j] = arrowValues(record.Column(j))
+	}
+	n, width := int(record.NumRows()), len(columns)
+	cells := make([]interface{}, n*width)
+	for i := 0; i < n; i++ {
+		row := cells[i*width : (i+1)*width : (i+1)*width]
+		for j, value := range values {
+			row[j] = value(i)
+		}
+		err = pw.Write(row)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = pw.WriteStop()
+	return buf.Bytes(), err
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
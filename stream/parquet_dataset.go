@@ -0,0 +1,194 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// ParquetDataset writes JSON messages to a Hive-partitioned dataset
+// of Parquet files, which can be queried right away with DuckDB,
+// Spark, Athena and the like:
+//
+//	SELECT * FROM read_parquet('/data/events/**/*.parquet', hive_partitioning=1)
+//
+// Path is a local directory or an s3://bucket/prefix URL (using
+// AWSConfig). Fields are written as Config.Columns (see ParquetColumn);
+// Config.PartitionBy fields become directories (e.g.
+// date=2020-10-01/device=d1/) rather than columns.
+//
+// Messages are parsed into rows when they're written, rows are
+// batched as Arrow records (see columnarRow) and written every
+// Config.FlushEvery seconds or Config.BatchSize rows, with a file per
+// partition. Local files are
+// written to a temporary file and renamed, so readers never see
+// partial files. Messages written with WriteAsync (as pipelines do)
+// are acknowledged once their partition's file is written.
+type ParquetDataset struct {
+	Path       string
+	AWSConfig  *aws.Config      // defaults to the default credential chain
+	AWSSess    *session.Session // v1 session used if AWSConfig isn't set
+	RoleARN    string           // role assumed to access S3
+	ExternalID string           // external ID of RoleARN, if required
+	Config     *ParquetDatasetConfig
+	store      objectStore
+	columns    []ParquetColumn
+	batcher    *batcher
+	ctx        context.Context
+	cancel     context.CancelFunc
+	clocked
+	logged
+}
+
+// ParquetDatasetConfig configures the schema and files.
+type ParquetDatasetConfig struct {
+	Columns     []ParquetColumn
+	PartitionBy []string
+	BatchSize   int // rows per file, defaults to 100000
+	FlushEvery  int // seconds, defaults to 60
+	MaxRetries  int // retries of failed writes, defaults to 3
+}
+
+func (p *ParquetDataset) Connect() (err error) {
+	if p.Config == nil {
+		p.Config = &ParquetDatasetConfig{}
+	}
+	if p.Config.BatchSize < 1 {
+		p.Config.BatchSize = 100000
+	}
+	if p.Config.FlushEvery < 1 {
+		p.Config.FlushEvery = 60
+	}
+	if p.Config.MaxRetries < 1 {
+		p.Config.MaxRetries = 3
+	}
+
+	partitioned := map[string]bool{}
+	for _, name := range p.Config.PartitionBy {
+		partitioned[name] = true
+	}
+	p.columns = nil
+	for _, c := range p.Config.Columns {
+		if _, ok := parquetTypes[c.Type]; !ok {
+			return fmt.Errorf("ParquetDataset: column %s has unsupported type %q", c.Name, c.Type)
+		}
+		if !partitioned[c.Name] {
+			p.columns = append(p.columns, c)
+		}
+	}
+	if len(p.columns) == 0 {
+		return fmt.Errorf("ParquetDataset: at least one non partition column must be configured")
+	}
+
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	if p.store == nil {
+		p.store, err = newObjectStore(p.ctx, p.Path, p.AWSConfig, p.AWSSess, "", p.RoleARN, p.ExternalID)
+		if err != nil {
+			return
+		}
+	}
+
+	p.batcher = newBatcher("ParquetDataset", p.logger(), p.clock(), p.Config.BatchSize, time.Duration(p.Config.FlushEvery)*time.Second, p.Config.MaxRetries, p.flush)
+
+	return
+}
+
+// Disconnect writes buffered rows.
+func (p *ParquetDataset) Disconnect() (err error) {
+	if p.batcher != nil {
+		p.batcher.close()
+		p.batcher = nil
+	}
+	if p.cancel != nil {
+		p.cancel()
+	}
+	return
+}
+
+// Resources returns the bucket of Path, if it is on S3.
+func (p *ParquetDataset) Resources() []Resource {
+	return storeResources(p.Path, configRegion(p.AWSConfig, p.AWSSess))
+}
+
+func (p *ParquetDataset) Capabilities() Capabilities {
+	return Capabilities{ConfirmedWrites: true, Batching: true, Schemas: true}
+}
+
+func (p *ParquetDataset) Info() {
+	p.logger().Info("ParquetDataset.Path: ", p.Path)
+	p.logger().Infof("ParquetDatasetConfig: %+v", *p.Config)
+}
+
+func (p *ParquetDataset) Write(body string) (err error) {
+	return p.WriteMessage(message.New(body))
+}
+
+// WriteMessage buffers a row for `m`.
+func (p *ParquetDataset) WriteMessage(m message.Message) (err error) {
+	r, err := p.row(m)
+	if err != nil {
+		return
+	}
+	p.batcher.add(r, nil)
+	return
+}
+
+// WriteAsync buffers a row for `m` and calls `done` once it has been
+// written.
+func (p *ParquetDataset) WriteAsync(m message.Message, done func(error)) {
+	r, err := p.row(m)
+	if err != nil {
+		done(err)
+		return
+	}
+	p.batcher.add(r, done)
+}
+
+// row parses `m` into a row of the columns, so that a message whose
+// fields don't match their types fails now rather than its whole
+// batch.
+func (p *ParquetDataset) row(m message.Message) (columnarRow, error) {
+	return parseColumnarRow(m, p.Config.PartitionBy, p.columns, nil)
+}
+
+// flush writes a file per partition of `batch`, the rows of failed
+// partitions are retried by the batcher.
+func (p *ParquetDataset) flush(batch []*batchEntry) error {
+	parts, err := partitionBatch(batchRows(batch), p.Config.PartitionBy, p.columns)
+	if err != nil {
+		return err
+	}
+	defer releaseBatches(parts)
+	for _, part := range parts {
+		err = p.writeFile(part)
+		if err != nil {
+			for _, i := range part.rows {
+				batch[i].err = err
+			}
+		}
+	}
+	return nil
+}
+
+// writeFile writes the rows of `part` to a new file.
+func (p *ParquetDataset) writeFile(part *columnBatch) error {
+	data, err := encodeParquet(p.columns, part.record)
+	if err != nil {
+		return err
+	}
+
+	key := hivePath(p.Config.PartitionBy, part.values) +
+		fmt.Sprintf("part-%d-%s.parquet", time.Now().UnixNano()/int64(time.Millisecond), newUUID())
+	err = p.store.put(p.ctx, key, data)
+	if err == nil {
+		p.logger().Infof("ParquetDataset: Wrote %s (%d rows)", key, part.record.NumRows())
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestParquetDataset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dataset")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dest := &ParquetDataset{Path: dir, Config: &ParquetDatasetConfig{
+		Columns: []ParquetColumn{
+			{Name: "date", Type: "string"},
+			{Name: "device", Type: "string"},
+			{Name: "temp", Type: "double"},
+			{Name: "ok", Type: "boolean"},
+		},
+		PartitionBy: []string{"date"},
+	}}
+	assert.NoError(t, dest.Connect())
+	assert.NoError(t, dest.Write(`{"date":"2020-10-01","device":"d1","temp":21.5,"ok":true}`))
+	assert.NoError(t, dest.Write(`{"date":"2020-10-02","device":"d1","temp":20}`))
+	assert.NoError(t, dest.Write(`{"date":"2020-10-01","device":"d2"}`))
+	assert.NoError(t, dest.Disconnect())
+
+	rows := map[string]int64{}
+	for _, date := range []string{"2020-10-01", "2020-10-02"} {
+		files, err := filepath.Glob(filepath.Join(dir, "date="+date, "*.parquet"))
+		assert.NoError(t, err)
+		assert.Len(t, files, 1)
+
+		fr, err := local.NewLocalFileReader(files[0])
+		assert.NoError(t, err)
+		pr, err := reader.NewParquetReader(fr, nil, 1)
+		assert.NoError(t, err)
+		rows[date] = pr.GetNumRows()
+		// partition columns are not stored in files
+		assert.Len(t, pr.SchemaHandler.SchemaElements, 4)
+		pr.ReadStop()
+		fr.Close()
+	}
+	assert.Equal(t, map[string]int64{"2020-10-01": 2, "2020-10-02": 1}, rows)
+}
+
+// failingPartition is an objectStore failing to write files of a
+// partition.
+type failingPartition struct {
+	objectStore
+	prefix string
+}
+
+func (f failingPartition) put(ctx context.Context, key string, data []byte) error {
+	if strings.HasPrefix(key, f.prefix) {
+		return errors.New("disk full")
+	}
+	return f.objectStore.put(ctx, key, data)
+}
+
+func TestParquetDataset_WriteAsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dataset")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := newObjectStore(context.Background(), dir, nil, nil, "", "", "")
+	assert.NoError(t, err)
+	dest := &ParquetDataset{
+		Path: dir,
+		Config: &ParquetDatasetConfig{
+			Columns: []ParquetColumn{
+				{Name: "date", Type: "string"},
+				{Name: "temp", Type: "double"},
+			},
+			PartitionBy: []string{"date"},
+			MaxRetries:  1,
+		},
+		store: failingPartition{store, "date=2020-10-02/"},
+	}
+	assert.NoError(t, dest.Connect())
+
+	results := map[string]error{}
+	for _, body := range []string{
+		`{"date":"2020-10-01","temp":21.5}`,
+		`{"date":"2020-10-02","temp":20}`,
+		`{"date":"2020-10-01","temp":"warm"}`,
+	} {
+		body := body
+		dest.WriteAsync(message.New(body), func(err error) { results[body] = err })
+	}
+	assert.NoError(t, dest.Disconnect())
+
+	// only the rows of the failed partition and the invalid row fail
+	assert.Len(t, results, 3)
+	assert.NoError(t, results[`{"date":"2020-10-01","temp":21.5}`])
+	assert.EqualError(t, results[`{"date":"2020-10-02","temp":20}`], "disk full")
+	assert.EqualError(t, results[`{"date":"2020-10-01","temp":"warm"}`], `column temp: "warm" is not a valid double`)
+
+	files, err := filepath.Glob(filepath.Join(dir, "date=2020-10-01", "*.parquet"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
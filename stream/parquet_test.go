@@ -0,0 +1,41 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParquetRow(t *testing.T) {
+	columns := []ParquetColumn{
+		{Name: "device", Type: "string"},
+		{Name: "count", Type: "long"},
+		{Name: "temp", Type: "double"},
+		{Name: "ok", Type: "boolean"},
+		{Name: "ts", Type: "timestamp"},
+	}
+
+	row, err := parquetRow(map[string]interface{}{
+		"device": map[string]interface{}{"id": "d1"},
+		"count":  float64(42),
+		"temp":   21.5,
+		"ts":     "2020-10-01T12:00:00Z",
+	}, columns)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{`{"id":"d1"}`, int64(42), 21.5, nil, int64(1601553600000000)}, row)
+
+	for v, msg := range map[interface{}]string{
+		"42":          `column count: "42" is not a valid long`,
+		3.7:           `column count: 3.7 is not a valid long`,
+		float64(1e19): `column count: 10000000000000000000 is not a valid long`,
+	} {
+		_, err = parquetRow(map[string]interface{}{"count": v}, columns)
+		assert.EqualError(t, err, msg)
+	}
+	_, err = parquetRow(map[string]interface{}{"temp": "warm"}, columns)
+	assert.EqualError(t, err, `column temp: "warm" is not a valid double`)
+	_, err = parquetRow(map[string]interface{}{"ok": float64(1)}, columns)
+	assert.EqualError(t, err, `column ok: 1 is not a valid boolean`)
+	_, err = parquetRow(map[string]interface{}{"ts": "yesterday"}, columns)
+	assert.EqualError(t, err, `column ts: "yesterday" is not a valid timestamp`)
+}
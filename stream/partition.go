@@ -0,0 +1,166 @@
+package stream
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// partitionIdle is how long an empty partition lane lives.
+const partitionIdle = 1 * time.Minute
+
+// partitions holds a lane (an ordered queue and a goroutine) per
+// partition key.
+type partitions struct {
+	sync.Mutex
+	lanes map[string]*lane
+	// pending counts dispatched messages not yet delivered.
+	pending sync.WaitGroup
+}
+
+// lane is the queue of a partition. Queues are unbounded so that a
+// paused partition never blocks dispatching to the others.
+type lane struct {
+	queue []queued  // guarded by the partitions mutex
+	ready chan bool // signalled when messages are queued
+}
+
+// queued is a message of a lane, whose body is held as an LZ4 block
+// if it was compressed (see Pipeline.CompressBuffers).
+type queued struct {
+	msg   message.Message
+	block []byte
+}
+
+// dispatch queues `msg` on the lane of its partition, creating the
+// lane if needed.
+func (p *Pipeline) dispatch(msg message.Message) {
+	key := msg.Metadata.Get(p.PartitionKey)
+
+	p.partitions.Lock()
+	defer p.partitions.Unlock()
+
+	l, ok := p.partitions.lanes[key]
+	if !ok {
+		l = &lane{ready: make(chan bool, 1)}
+		p.partitions.lanes[key] = l
+		go p.runPartition(key, l)
+	}
+	p.partitions.pending.Add(1)
+	q := queued{msg: msg}
+	if p.CompressBuffers {
+		if block, ok := p.compressor.compress([]byte(msg.Body)); ok {
+			q.block = block
+			q.msg.Body = ""
+		}
+	}
+	l.queue = append(l.queue, q)
+	select {
+	case l.ready <- true:
+	default:
+	}
+}
+
+// next pops the next message of `l`, if any. It returns the error of
+// decompressing its body, the message being returned regardless so
+// that it can be acknowledged with the error.
+func (p *Pipeline) next(l *lane) (msg message.Message, ok bool, err error) {
+	p.partitions.Lock()
+	if len(l.queue) == 0 {
+		p.partitions.Unlock()
+		return
+	}
+	q := l.queue[0]
+	l.queue[0] = queued{}
+	l.queue = l.queue[1:]
+	p.partitions.Unlock()
+
+	msg = q.msg
+	if q.block != nil {
+		body, err := decompress(q.block)
+		if err != nil {
+			return msg, true, err
+		}
+		msg.Body = string(body)
+	}
+	return msg, true, nil
+}
+
+// runPartition delivers the messages of a partition in order. The
+// lane exits once it has been empty for partitionIdle.
+func (p *Pipeline) runPartition(key string, l *lane) {
+	for {
+		if msg, ok, err := p.next(l); ok {
+			if err != nil {
+				// blocks are only produced by the compressor, the
+				// source redelivers the message
+				p.logger().WithField("partition", key).Error("Failed to decompress a queued message: ", err)
+			} else {
+				err = p.deliverOrPause(key, msg)
+			}
+			msg.Done(err)
+			p.partitions.pending.Done()
+			continue
+		}
+
+		idle := p.clock().NewTimer(partitionIdle)
+		select {
+		case <-l.ready:
+			idle.Stop()
+		case <-idle.C():
+			p.partitions.Lock()
+			if len(l.queue) == 0 {
+				delete(p.partitions.lanes, key)
+				p.partitions.Unlock()
+				return
+			}
+			p.partitions.Unlock()
+		}
+	}
+}
+
+// deliverOrPause delivers `msg`, pausing the partition if it
+// exhausts its attempts until a probe delivers it.
+func (p *Pipeline) deliverOrPause(key string, msg message.Message) error {
+	msg, err := p.attempt(msg)
+	if err == nil {
+		return nil
+	}
+
+	logger := p.logger().WithField("partition", key)
+	logger.Warnf("Pausing partition %q: %s", key, err)
+	atomic.AddInt64(&p.stats.Paused, 1)
+	atomic.AddUint64(&p.stats.Pauses, 1)
+
+	interval := p.ProbeInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	for {
+		probe := p.clock().NewTimer(interval)
+		select {
+		case <-probe.C():
+		case <-p.stopping():
+			probe.Stop()
+			logger.Warnf("Pipeline stopped, partition %q gives up on its message.", key)
+			atomic.AddInt64(&p.stats.Paused, -1)
+			return err
+		}
+
+		atomic.AddUint64(&p.stats.Probes, 1)
+		err = p.write(p.Destination, msg)
+		// probe errors are not added to the error history
+		msg = recordAttempt(msg, nil)
+		if err == nil {
+			break
+		}
+		logger.Debugf("Probe of partition %q failed: %s", key, err)
+	}
+
+	logger.Infof("Resuming partition %q after %d attempts.", key, attempts(msg))
+	atomic.AddInt64(&p.stats.Paused, -1)
+	atomic.AddUint64(&p.stats.Resumes, 1)
+	return nil
+}
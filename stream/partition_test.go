@@ -0,0 +1,156 @@
+package stream
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// outage is a destination that fails writes of `down` messages
+// until it is brought back up.
+type outage struct {
+	sync.Mutex
+	down     string
+	messages []string
+}
+
+func (o *outage) Connect() error    { return nil }
+func (o *outage) Disconnect() error { return nil }
+func (o *outage) Info()             {}
+func (o *outage) Write(message string) error {
+	o.Lock()
+	defer o.Unlock()
+	if message == o.down {
+		return errors.New("outage")
+	}
+	o.messages = append(o.messages, message)
+	return nil
+}
+
+func (o *outage) written() []string {
+	o.Lock()
+	defer o.Unlock()
+	return append([]string{}, o.messages...)
+}
+
+func TestPipeline_PausePartition(t *testing.T) {
+	dest := &outage{down: "a1"}
+	p := &Pipeline{
+		Destination:   dest,
+		OnFailure:     PausePartition,
+		PartitionKey:  "key",
+		ProbeInterval: 10 * time.Millisecond,
+		partitions:    &partitions{lanes: map[string]*lane{}},
+	}
+
+	for _, m := range [][2]string{{"a", "a1"}, {"b", "b1"}, {"a", "a2"}, {"b", "b2"}} {
+		msg := message.New(m[1])
+		msg.Metadata["key"] = m[0]
+		p.dispatch(msg)
+	}
+
+	// partition "a" is paused, "b" continues
+	assert.Eventually(t, func() bool { return len(dest.written()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"b1", "b2"}, dest.written())
+	assert.Equal(t, int64(1), p.Stats().Paused)
+
+	// outage is over, "a" resumes in order
+	dest.Lock()
+	dest.down = ""
+	dest.Unlock()
+
+	assert.Eventually(t, func() bool { return len(dest.written()) == 4 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"b1", "b2", "a1", "a2"}, dest.written())
+	assert.Equal(t, int64(0), p.Stats().Paused)
+	assert.Equal(t, uint64(1), p.Stats().Resumes)
+}
+
+func TestPipeline_PausedPartitionDoesNotBlockDispatch(t *testing.T) {
+	dest := &outage{down: "a"}
+	p := &Pipeline{
+		Destination:   dest,
+		OnFailure:     PausePartition,
+		PartitionKey:  "key",
+		ProbeInterval: time.Hour,
+		partitions:    &partitions{lanes: map[string]*lane{}},
+	}
+
+	dispatched := make(chan bool)
+	go func() {
+		for i := 0; i < 5000; i++ {
+			msg := message.New("a")
+			msg.Metadata["key"] = "a"
+			p.dispatch(msg)
+		}
+		msg := message.New("b")
+		msg.Metadata["key"] = "b"
+		p.dispatch(msg)
+		close(dispatched)
+	}()
+
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch blocked on a paused partition")
+	}
+	assert.Eventually(t, func() bool { return len(dest.written()) == 1 }, time.Second, time.Millisecond)
+}
+
+func TestPipeline_CompressBuffers(t *testing.T) {
+	large := strings.Repeat(`{"event":"page_view","path":"/"}`, 50)
+	dest := &outage{down: large}
+	p := &Pipeline{
+		Destination:     dest,
+		OnFailure:       PausePartition,
+		PartitionKey:    "key",
+		ProbeInterval:   10 * time.Millisecond,
+		CompressBuffers: true,
+		partitions:      &partitions{lanes: map[string]*lane{}},
+	}
+
+	// the backlog of the paused partition is compressed
+	for _, body := range []string{large, large + "1", "small"} {
+		msg := message.New(body)
+		msg.Metadata["key"] = "a"
+		p.dispatch(msg)
+	}
+	assert.Greater(t, p.Stats().Compression.Ratio(), 2.0)
+
+	dest.Lock()
+	dest.down = ""
+	dest.Unlock()
+	assert.Eventually(t, func() bool { return len(dest.written()) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{large, large + "1", "small"}, dest.written())
+}
+
+func TestPipeline_PartitionIdle(t *testing.T) {
+	dest := &outage{}
+	clock := NewFakeClock(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC))
+	p := &Pipeline{
+		Destination:  dest,
+		PartitionKey: "key",
+		Clock:        clock,
+		partitions:   &partitions{lanes: map[string]*lane{}},
+	}
+	lanes := func() int {
+		p.partitions.Lock()
+		defer p.partitions.Unlock()
+		return len(p.partitions.lanes)
+	}
+
+	msg := message.New("a1")
+	msg.Metadata["key"] = "a"
+	p.dispatch(msg)
+	assert.Eventually(t, func() bool { return len(dest.written()) == 1 && clock.Waiters() == 1 }, time.Second, time.Millisecond)
+
+	// the empty lane lives until it has been idle for partitionIdle
+	clock.Advance(partitionIdle - time.Second)
+	assert.Equal(t, 1, lanes())
+	clock.Advance(time.Second)
+	assert.Eventually(t, func() bool { return lanes() == 0 }, time.Second, time.Millisecond)
+}
@@ -1,14 +1,19 @@
 package stream
 
 import (
+	"errors"
 	"os"
 	"os/signal"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/abstractpaper/manifold/codec"
+	"github.com/abstractpaper/manifold/message"
 	"github.com/abstractpaper/manifold/transform"
 	swissFunc "github.com/abstractpaper/swissarmy/function"
-
-	log "github.com/sirupsen/logrus"
 )
 
 // Source is an interface that must be implemented to
@@ -31,8 +36,340 @@ type Destination interface {
 	Write(message string) error
 }
 
-type stat struct {
-	count uint64
+// MessageSource is an optional interface implemented by sources
+// that attach metadata to the messages they read.
+type MessageSource interface {
+	Source
+	ReadMessages() (chan message.Message, error)
+}
+
+// MessageDestination is an optional interface implemented by
+// destinations that make use of message metadata.
+type MessageDestination interface {
+	Destination
+	WriteMessage(m message.Message) error
+}
+
+// AsyncDestination is an optional interface implemented by
+// destinations that buffer messages and write them later (e.g. in
+// batches). WriteAsync queues `m` and calls `done` exactly once with
+// the result of its write, so that pipelines acknowledge, retry or
+// quarantine it only once it has actually been written.
+//
+// Pipelines write to asynchronous destinations concurrently (see
+// Pipeline.MaxInFlight) so that batches can fill up. Destinations
+// that only buffer in some configurations also implement
+// `Buffered() bool` so that they're written to in order otherwise.
+type AsyncDestination interface {
+	Destination
+	WriteAsync(m message.Message, done func(err error))
+}
+
+// Flusher is an optional interface implemented by destinations that
+// buffer writes for a while (e.g. S3), Flush commits what they have
+// buffered now.
+type Flusher interface {
+	Flush() error
+}
+
+// Failing is an optional interface implemented by connectors whose
+// background work can fail once connected (e.g. S3 writing and
+// uploading its buffer). The pipeline stops once Failed receives an
+// error, and Run or RunUntilDrained return it, so that a Supervisor
+// restarts the flow.
+type Failing interface {
+	Failed() <-chan error
+}
+
+// Lagging is an optional interface implemented by sources that know
+// how far behind the latest record of their stream they are reading
+// (e.g. Kinesis).
+type Lagging interface {
+	Lag() time.Duration
+}
+
+// buffered reports whether `dest` buffers asynchronous writes.
+func buffered(dest Destination) bool {
+	if _, ok := dest.(AsyncDestination); !ok {
+		return false
+	}
+	if b, ok := dest.(interface{ Buffered() bool }); ok {
+		return b.Buffered()
+	}
+	return true
+}
+
+// readMessages reads from `src`, wrapping plain string messages
+// when `src` does not implement MessageSource.
+func readMessages(src Source) (chan message.Message, error) {
+	if ms, ok := src.(MessageSource); ok {
+		return ms.ReadMessages()
+	}
+
+	channel, err := src.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make(chan message.Message)
+	go func() {
+		defer close(messages)
+		for body := range channel {
+			messages <- message.New(body)
+		}
+	}()
+	return messages, nil
+}
+
+// writeMessage writes `m` to `dest`, passing its metadata along
+// when `dest` implements MessageDestination and waiting for the
+// write when it implements AsyncDestination.
+func writeMessage(dest Destination, m message.Message) error {
+	return <-startWrite(dest, m)
+}
+
+// startWrite starts writing `m` to `dest` and returns a channel
+// receiving the result. Only asynchronous destinations return before
+// the write completes.
+func startWrite(dest Destination, m message.Message) <-chan error {
+	result := make(chan error, 1)
+	switch d := dest.(type) {
+	case AsyncDestination:
+		d.WriteAsync(m, func(err error) { result <- err })
+	case MessageDestination:
+		result <- d.WriteMessage(m)
+	default:
+		result <- dest.Write(m.Body)
+	}
+	return result
+}
+
+// Stats holds the counters of a pipeline.
+type Stats struct {
+	Sent        uint64 `json:"sent"`        // messages written to the destination
+	Dropped     uint64 `json:"dropped"`     // messages dropped by the transformer
+	Quarantined uint64 `json:"quarantined"` // messages written to the DLQ
+	Paused      int64  `json:"paused"`      // partitions currently paused
+	Pauses      uint64 `json:"pauses"`      // times a partition was paused
+	Resumes     uint64 `json:"resumes"`     // times a paused partition resumed
+	Probes      uint64 `json:"probes"`      // delivery probes of paused partitions
+	Timeouts    uint64 `json:"timeouts"`    // writes that exceeded WriteTimeout
+	Trips       uint64 `json:"trips"`       // times the circuit breaker opened
+	Rejected    uint64 `json:"rejected"`    // writes rejected by the open circuit breaker
+	// bytes of messages queued in partition lanes, with CompressBuffers
+	Compression CompressionStats `json:"compression"`
+	Idle        uint64           `json:"idle"`       // times the source went idle for IdleTimeout
+	Heartbeats  uint64           `json:"heartbeats"` // heartbeat messages written
+	IdleSince   time.Time        `json:"-"`          // time of the last message if the source is idle
+	Oversized   uint64           `json:"oversized"`  // messages larger than the size limit
+	Erasures    uint64           `json:"erasures"`   // erasure requests applied
+	Erased      uint64           `json:"erased"`     // messages of erased subjects dropped
+	// messages in each worker queue, with Workers, and times reading
+	// waited on a full queue
+	Queues     []int  `json:"queues,omitempty"`
+	QueueWaits uint64 `json:"queueWaits"`
+}
+
+// Pipeline reads messages from Source, optionally transforms
+// them with Transformer and writes them to Destination. Messages are
+// decoded and encoded with Codecs, if set.
+//
+// A message that fails to be written is retried until it reaches
+// MaxAttempts delivery attempts (including attempts made before a
+// restart, see MetaAttempts), after which it is quarantined to DLQ
+// with its error history instead of blocking the pipeline.
+//
+// Alternatively, with OnFailure set to PausePartition, messages
+// are processed in order per partition (the value of the
+// PartitionKey metadata key) and a partition whose message
+// exhausts its attempts is paused while other partitions continue.
+// A paused partition retries its message every ProbeInterval and
+// resumes once it is delivered.
+//
+// Writes taking longer than WriteTimeout fail, and a circuit breaker
+// opens after BreakerThreshold consecutive failed writes: while it
+// is open, writes fail fast (messages go straight to the DLQ, or
+// their partition stays paused) instead of stalling the pipeline on
+// an unhealthy destination. After BreakerCooldown a single write
+// probes the destination and closes the breaker if it succeeds.
+//
+// Stop stops a running pipeline without dropping the messages it has
+// read: they are delivered (or quarantined) before it disconnects.
+//
+// Transformed messages larger than MaxMessageSize (or the limit of a
+// Limited destination) are quarantined, truncated or offloaded
+// depending on OnOversize.
+//
+// With Erasure, messages of subjects whose erasure was requested are
+// dropped and erased from buffers (see Erasure).
+//
+// With Workers, messages are processed by several workers: with
+// OrderedByKey, messages of the same PartitionKey value are processed
+// by the same worker in order (see OrderingMode), and the depth of
+// each worker's queue (see Stats) shows hot keys.
+type Pipeline struct {
+	// Name identifies the pipeline in logs (optional).
+	Name        string
+	Source      Source
+	Transformer transform.Transformer
+	Destination Destination
+	// DLQ is an optional destination for quarantined messages.
+	DLQ Destination
+	// Codecs decode the messages of Source and encode those written
+	// to Destination and DLQ (optional).
+	Codecs Codecs
+	// MaxAttempts is the number of delivery attempts per message,
+	// defaults to 1 (no retries).
+	MaxAttempts int
+	// RetryDelay is the pause between delivery attempts.
+	RetryDelay time.Duration
+	// OnFailure is the policy for messages that exhaust their
+	// delivery attempts, defaults to Quarantine.
+	OnFailure FailurePolicy
+	// PartitionKey is the metadata key partitions are keyed on when
+	// OnFailure is PausePartition or Ordering is OrderedByKey (e.g.
+	// MetaKinesisPartitionKey).
+	PartitionKey string
+	// ProbeInterval is how often a paused partition is probed,
+	// defaults to 10 seconds.
+	ProbeInterval time.Duration
+	// WriteTimeout bounds each destination write (optional). A timed
+	// out write is abandoned rather than cancelled and may still
+	// complete, so its message may be written twice.
+	WriteTimeout time.Duration
+	// BreakerThreshold is the number of consecutive failed writes
+	// that opens the circuit breaker, 0 disables it.
+	BreakerThreshold int
+	// BreakerCooldown is how long the breaker stays open before a
+	// probe, defaults to 30 seconds.
+	BreakerCooldown time.Duration
+	// MaxInFlight is the number of messages written concurrently to
+	// an AsyncDestination, which bounds its batch sizes, defaults to
+	// 10000.
+	MaxInFlight int
+	// Workers is the number of messages decoded, transformed and
+	// delivered concurrently, defaults to 1 (the Transformer must be
+	// safe for concurrent use otherwise). Messages are queued for
+	// them by Ordering, up to WorkerQueueSize messages per queue
+	// (1000 by default).
+	Workers         int
+	Ordering        OrderingMode
+	WorkerQueueSize int
+	// StartFrom seeks the source (which must be a SeekableSource)
+	// before reading (optional).
+	StartFrom *Position
+	// CompressBuffers compresses the bodies of messages queued in
+	// partition lanes (see PausePartition) with LZ4, trading CPU for
+	// memory when paused partitions build up backlogs.
+	CompressBuffers bool
+	// IdleTimeout is how long the source may deliver no messages
+	// before a warning is logged and Stats report it idle, so that
+	// silent upstream outages don't look like a lack of traffic
+	// (optional).
+	IdleTimeout time.Duration
+	// Heartbeat is how often a heartbeat message is written to the
+	// destination while the source is idle (optional, requires
+	// IdleTimeout). Heartbeats bypass the transformer, have the
+	// MetaHeartbeat metadata key set and a JSON body:
+	//   {"heartbeat": "<time>", "pipeline": "<Name>", "idleSince": "<time>"}
+	Heartbeat time.Duration
+	// Sampler logs sampled payloads for debugging (optional, it can
+	// be enabled at runtime, see Sampling).
+	Sampler *Sampler
+	// MaxMessageSize is the largest body in bytes written to the
+	// destination, defaults to the destination's Limits (if it is
+	// Limited).
+	MaxMessageSize int
+	// OnOversize is the policy for larger messages, defaults to
+	// RejectOversize. Messages are rejected if offloading fails.
+	OnOversize OversizePolicy
+	// Offloader stores oversized bodies with OffloadOversize.
+	Offloader Offloader
+	// Erasure applies erasure requests read from its control
+	// source (optional).
+	Erasure *Erasure
+	// Require is the guarantees the pipeline must provide given the
+	// Capabilities of its source and destination, it refuses to run
+	// otherwise (see Validate).
+	Require Guarantees
+	// Logger logs the pipeline's lines with a `flow` field set to
+	// Name (if any), and is set on the source, destination, DLQ,
+	// Offloader and erasure control source implementing Logged with
+	// a `connector` field naming them. Defaults to DefaultLogger; a
+	// LevelLogger gives the pipeline its own level (see SetLogLevel).
+	Logger Logger
+	// DrainTimeout bounds the graceful stop on SIGINT or SIGTERM
+	// (see Drain), after which the pipeline disconnects without
+	// waiting, as it does on a second signal. Defaults to 25
+	// seconds, within the 30 seconds Kubernetes grants pods by
+	// default.
+	DrainTimeout time.Duration
+	// Clock drives retry delays, probes, write timeouts and the
+	// circuit breaker, and is set on the source, destination, DLQ and
+	// Offloader implementing Clocked. Defaults to SystemClock, without setting
+	// it on connectors.
+	Clock       Clock
+	stats       Stats
+	compressor  compressor
+	writeMu     sync.Mutex
+	dlqMu       sync.Mutex // not writeMu, a hung write mustn't block the DLQ
+	partitions  *partitions
+	breaker     *breaker
+	breakerOnce sync.Once
+	stopMu      sync.Mutex // guards stop, resume and failure
+	stop        chan struct{}
+	failure     error         // of a Failing connector
+	resume      chan struct{} // closed by Resume, nil unless paused
+	pause       chan struct{} // signalled by Pause
+	idleSince   int64         // unix nanoseconds, 0 unless idle
+	samplerOnce sync.Once
+	log         Logger
+	logOnce     sync.Once
+	flowDone    chan struct{}  // closed once flow returns
+	workers     atomic.Value   // *workers, with Workers
+	drainWG     sync.WaitGroup // Drain calls in progress
+}
+
+// FailurePolicy decides what happens to a message that exhausts
+// its delivery attempts.
+type FailurePolicy int
+
+const (
+	// Quarantine writes the message to the DLQ (if any) and moves on.
+	Quarantine FailurePolicy = iota
+	// PausePartition pauses the message's partition until the
+	// message can be delivered.
+	PausePartition
+)
+
+// Stats returns a snapshot of the pipeline counters.
+func (p *Pipeline) Stats() Stats {
+	stats := Stats{
+		Sent:        atomic.LoadUint64(&p.stats.Sent),
+		Dropped:     atomic.LoadUint64(&p.stats.Dropped),
+		Quarantined: atomic.LoadUint64(&p.stats.Quarantined),
+		Paused:      atomic.LoadInt64(&p.stats.Paused),
+		Pauses:      atomic.LoadUint64(&p.stats.Pauses),
+		Resumes:     atomic.LoadUint64(&p.stats.Resumes),
+		Probes:      atomic.LoadUint64(&p.stats.Probes),
+		Timeouts:    atomic.LoadUint64(&p.stats.Timeouts),
+		Trips:       atomic.LoadUint64(&p.stats.Trips),
+		Rejected:    atomic.LoadUint64(&p.stats.Rejected),
+		Compression: p.compressor.snapshot(),
+		Idle:        atomic.LoadUint64(&p.stats.Idle),
+		Heartbeats:  atomic.LoadUint64(&p.stats.Heartbeats),
+		Oversized:   atomic.LoadUint64(&p.stats.Oversized),
+		Erasures:    atomic.LoadUint64(&p.stats.Erasures),
+		Erased:      atomic.LoadUint64(&p.stats.Erased),
+	}
+	if since := atomic.LoadInt64(&p.idleSince); since != 0 {
+		stats.IdleSince = time.Unix(0, since)
+	}
+	if w, ok := p.workers.Load().(*workers); ok {
+		stats.Queues = w.depths()
+		stats.QueueWaits = atomic.LoadUint64(&w.waits)
+	}
+	return stats
 }
 
 // Flow connects to source and destination and then launches a
@@ -47,57 +384,805 @@ type stat struct {
 //          "timestamp": func() interface{} { return time.Now() },
 //      },
 //  }
-func Flow(src Source, transformer transform.Transformer, dest Destination) {
+func Flow(src Source, transformer transform.Transformer, dest Destination) error {
+	p := &Pipeline{
+		Source:      src,
+		Transformer: transformer,
+		Destination: dest,
+	}
+	return p.Run()
+}
+
+// Run connects the pipeline's source, destination and DLQ, flows
+// data until an interrupt signal (SIGINT or SIGTERM) is received,
+// Stop is called or the source closes its channel (e.g. at the end of
+// stdin), and then disconnects. The pipeline is drained on interrupt
+// signals, within DrainTimeout (see Drain).
+// It returns the error of Validate without connecting if the pipeline
+// doesn't provide the guarantees of Require, and the error of seeking
+// or reading the source, or of a Failing connector, once
+// disconnected.
+func (p *Pipeline) Run() (err error) {
 	// interrupt channel for OS signals
 	interrupt := make(chan os.Signal, 1)
-	// register interrupt channel to receive SIGINT and SIGKILL
-	signal.Notify(interrupt, os.Interrupt, os.Kill)
+	// register interrupt channel to receive SIGINT and SIGTERM
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
-	// Connect
-	swissFunc.Retry(src.Connect, interrupt)
-	swissFunc.Retry(dest.Connect, interrupt)
+	p.setClock()
+	p.setLogger()
+	err = p.Validate()
+	if err != nil {
+		signal.Stop(interrupt)
+		return
+	}
 
-	log.Info("Source is: ", reflect.TypeOf(src))
-	src.Info()
-	log.Info("Destination is: ", reflect.TypeOf(dest))
-	dest.Info()
-	if transformer != nil {
-		transformer.Info()
+	// Connect
+	swissFunc.Retry(p.Source.Connect, interrupt)
+	swissFunc.Retry(p.Destination.Connect, interrupt)
+	if p.DLQ != nil {
+		swissFunc.Retry(p.DLQ.Connect, interrupt)
 	}
+	if p.Erasure != nil {
+		swissFunc.Retry(p.Erasure.Control.Connect, interrupt)
+	}
+
+	p.info()
+	watching := make(chan struct{})
+	defer close(watching)
+	p.watch(watching)
 
 	// do something!
-	var stat stat
+	flowing := make(chan struct{})
+	failed := make(chan error, 1)
 	go func() {
-		channel, err := src.Read()
+		defer close(flowing)
+		if p.StartFrom != nil {
+			p.logger().Info("Seeking source to ", *p.StartFrom)
+			err := seek(p.Source, *p.StartFrom)
+			if err != nil {
+				p.logger().Error("src.Seek(): ", err)
+				failed <- err
+				return
+			}
+		}
+		channel, err := readMessages(p.Source)
 		if err != nil {
-			log.Fatal("src.Read(): ", err)
+			p.logger().Error("src.Read(): ", err)
+			failed <- err
+			return
 		}
+		p.flow(channel)
+	}()
 
-		log.Info("Flowing data...")
+	select {
+	case sig := <-interrupt:
+		p.drainOnSignal(sig, interrupt)
+	case <-p.stopping():
+		p.logger().Info("Stopping, draining messages in flight...")
+		<-flowing
+		p.drainWG.Wait()
+	case <-flowing:
+		select {
+		case err = <-failed:
+		default:
+			p.logger().Info("Source closed.")
+		}
+	}
+	signal.Stop(interrupt)
+	stats := p.Stats()
+	p.logger().Info("Sent messages: ", stats.Sent)
+	if stats.Dropped > 0 {
+		p.logger().Info("Dropped messages: ", stats.Dropped)
+	}
+	if p.DLQ != nil {
+		p.logger().Info("Quarantined messages: ", stats.Quarantined)
+	}
+	if p.OnFailure == PausePartition {
+		p.logger().Info("Paused partitions: ", stats.Paused)
+	}
+	if p.BreakerThreshold > 0 {
+		p.logger().Infof("Circuit breaker trips: %d (%d writes rejected)", stats.Trips, stats.Rejected)
+	}
+	if p.IdleTimeout > 0 {
+		p.logger().Infof("Source idle periods: %d (%d heartbeats)", stats.Idle, stats.Heartbeats)
+	}
+	if p.CompressBuffers {
+		p.logger().Infof("Buffer compression ratio: %.2f (%d bytes compressed to %d)", stats.Compression.Ratio(), stats.Compression.Raw, stats.Compression.Compressed)
+	}
+	if p.Erasure != nil {
+		p.logger().Infof("Erasure requests: %d (%d messages erased)", stats.Erasures, stats.Erased)
+	}
+
+	// Disconnect
+	p.Source.Disconnect()
+	if p.Erasure != nil {
+		p.Erasure.Control.Disconnect()
+	}
+	p.Destination.Disconnect()
+	if p.DLQ != nil {
+		p.DLQ.Disconnect()
+	}
+	if err == nil {
+		err = p.failed()
+	}
+	return
+}
+
+// RunUntilDrained connects the pipeline's source, destination and
+// DLQ, flows data until the source closes its channel and every
+// message has been processed, and then disconnects.
+//
+// Unlike Run, it doesn't retry connecting or wait for a signal,
+// which makes it suitable for tests and batch jobs over finite
+// sources. It returns the error of Validate without
+// connecting if the pipeline doesn't provide the guarantees of
+// Require, and that of a Failing connector once it has stopped.
+func (p *Pipeline) RunUntilDrained() (err error) {
+	p.setClock()
+	p.setLogger()
+	err = p.Validate()
+	if err != nil {
+		return
+	}
+	err = p.Source.Connect()
+	if err != nil {
+		return
+	}
+	defer p.Source.Disconnect()
+	err = p.Destination.Connect()
+	if err != nil {
+		return
+	}
+	defer p.Destination.Disconnect()
+	if p.DLQ != nil {
+		err = p.DLQ.Connect()
+		if err != nil {
+			return
+		}
+		defer p.DLQ.Disconnect()
+	}
+	if p.Erasure != nil {
+		err = p.Erasure.Control.Connect()
+		if err != nil {
+			return
+		}
+		defer p.Erasure.Control.Disconnect()
+	}
+	p.info()
+	watching := make(chan struct{})
+	defer close(watching)
+	p.watch(watching)
+
+	if p.StartFrom != nil {
+		err = seek(p.Source, *p.StartFrom)
+		if err != nil {
+			return
+		}
+	}
+	channel, err := readMessages(p.Source)
+	if err != nil {
+		return
+	}
+	p.flow(channel)
+	p.drainWG.Wait()
+	return p.failed()
+}
 
-		for message := range channel {
-			if transformer != nil {
-				var err error
-				message, err = transformer.Transform(message)
-				if err != nil {
-					log.Error("Failed to transform message: ", err)
+// watch stops the pipeline once a Failing source, destination or DLQ
+// fails, until `done` is closed.
+func (p *Pipeline) watch(done <-chan struct{}) {
+	for _, c := range []interface{}{p.Source, p.Destination, p.DLQ} {
+		f, ok := c.(Failing)
+		if !ok {
+			continue
+		}
+		go func(failed <-chan error) {
+			select {
+			case err := <-failed:
+				p.logger().Error("Connector failed, stopping: ", err)
+				p.stopMu.Lock()
+				if p.failure == nil {
+					p.failure = err
 				}
+				p.stopMu.Unlock()
+				p.Stop()
+			case <-done:
 			}
-			err := dest.Write(message)
-			if err == nil {
-				stat.count++
-			} else {
-				log.Error(err)
+		}(f.Failed())
+	}
+}
+
+// failed returns the error of the first Failing connector that
+// failed, if any.
+func (p *Pipeline) failed() error {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	return p.failure
+}
+
+// Stop stops reading from the source, and makes Run return once the
+// messages read so far have been processed and the pipeline has
+// disconnected (RunUntilDrained returns once they are processed).
+// Paused partitions give up on their message, which is acknowledged
+// with its error for the source to redeliver it. A stopped pipeline
+// can't run again.
+func (p *Pipeline) Stop() {
+	p.stopping()
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+}
+
+// Pause stops reading from the source until Resume is called.
+// Messages already read are still delivered.
+func (p *Pipeline) Pause() {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	if p.resume == nil {
+		p.resume = make(chan struct{})
+		p.logger().Info("Pipeline paused.")
+	}
+	select {
+	case p.pausing() <- struct{}{}:
+	default:
+	}
+}
+
+// Resume resumes reading from the source after Pause.
+func (p *Pipeline) Resume() {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	if p.resume != nil {
+		close(p.resume)
+		p.resume = nil
+		p.logger().Info("Pipeline resumed.")
+	}
+}
+
+// Paused reports whether the pipeline is paused.
+func (p *Pipeline) Paused() bool {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	return p.resume != nil
+}
+
+// Flush flushes the destination and DLQ if they implement Flusher.
+func (p *Pipeline) Flush() (err error) {
+	for _, dest := range []Destination{p.Destination, p.DLQ} {
+		if f, ok := dest.(Flusher); ok {
+			if ferr := f.Flush(); ferr != nil {
+				err = ferr
 			}
 		}
+	}
+	return
+}
+
+// Lag returns how far behind its stream the source is reading, if it
+// implements Lagging.
+func (p *Pipeline) Lag() (time.Duration, bool) {
+	if l, ok := p.Source.(Lagging); ok {
+		return l.Lag(), true
+	}
+	return 0, false
+}
+
+// BreakerOpen reports whether the circuit breaker is open.
+func (p *Pipeline) BreakerOpen() bool {
+	b := p.circuit()
+	return b != nil && b.isOpen()
+}
+
+// Sampling returns Sampler, set to a disabled Sampler if it is nil
+// so that sampling can be enabled at runtime.
+func (p *Pipeline) Sampling() *Sampler {
+	p.samplerOnce.Do(func() {
+		if p.Sampler == nil {
+			p.Sampler = &Sampler{}
+		}
+		err := p.Sampler.Compile()
+		if err != nil {
+			p.logger().Error(err)
+		}
+	})
+	return p.Sampler
+}
+
+// pausing returns the channel signalled by Pause, p.stopMu must be
+// held.
+func (p *Pipeline) pausing() chan struct{} {
+	if p.pause == nil {
+		p.pause = make(chan struct{}, 1)
+	}
+	return p.pause
+}
+
+// resumed returns a channel closed by Resume if the pipeline is
+// paused, nil otherwise.
+func (p *Pipeline) resumed() <-chan struct{} {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	return p.resume
+}
+
+// stopping returns a channel closed by Stop.
+func (p *Pipeline) stopping() <-chan struct{} {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	if p.stop == nil {
+		p.stop = make(chan struct{})
+	}
+	return p.stop
+}
+
+// setClock sets Clock on the connectors implementing Clocked.
+func (p *Pipeline) setClock() {
+	if p.Clock == nil {
+		return
+	}
+	for _, c := range []interface{}{p.Source, p.Destination, p.DLQ, p.Offloader} {
+		if c, ok := c.(Clocked); ok {
+			c.SetClock(p.Clock)
+		}
+	}
+}
+
+// setLogger sets the pipeline's logger on the connectors implementing
+// Logged.
+func (p *Pipeline) setLogger() {
+	logger := p.logger()
+	for _, c := range []interface{}{p.Source, p.Destination, p.DLQ, p.Offloader} {
+		setLogger(c, logger)
+	}
+	if p.Erasure != nil {
+		setLogger(p.Erasure.Control, logger)
+	}
+}
+
+// logger returns Logger, or DefaultLogger, with the `flow` field.
+func (p *Pipeline) logger() Logger {
+	p.logOnce.Do(func() {
+		p.log = p.Logger
+		if p.log == nil {
+			p.log = DefaultLogger
+		}
+		if p.Name != "" {
+			p.log = p.log.WithField("flow", p.Name)
+		}
+	})
+	return p.log
+}
+
+// LogLevel returns the level of Logger if it is Leveled.
+func (p *Pipeline) LogLevel() (Level, bool) {
+	if l, ok := p.Logger.(Leveled); ok {
+		return l.Level(), true
+	}
+	return 0, false
+}
+
+// SetLogLevel sets the level of Logger, which must be Leveled, e.g.
+// to debug a flow while it runs.
+func (p *Pipeline) SetLogLevel(level Level) error {
+	l, ok := p.Logger.(Leveled)
+	if !ok {
+		return errors.New("the pipeline's logger has no level of its own")
+	}
+	l.SetLevel(level)
+	p.logger().Infof("Log level set to %s.", level)
+	return nil
+}
+
+// clock returns Clock, or SystemClock.
+func (p *Pipeline) clock() Clock {
+	if p.Clock == nil {
+		return SystemClock
+	}
+	return p.Clock
+}
+
+// info logs the pipeline's components.
+func (p *Pipeline) info() {
+	p.logger().Info("Source is: ", reflect.TypeOf(p.Source))
+	p.Source.Info()
+	p.logger().Info("Destination is: ", reflect.TypeOf(p.Destination))
+	p.Destination.Info()
+	if p.DLQ != nil {
+		p.logger().Info("DLQ is: ", reflect.TypeOf(p.DLQ))
+		p.DLQ.Info()
+	}
+	if p.Transformer != nil {
+		p.Transformer.Info()
+	}
+	for i, c := range []codec.Codec{p.Codecs.Source, p.Codecs.Destination, p.Codecs.DLQ} {
+		if c != nil {
+			p.logger().Infof("%s codec is: %s", [...]string{"Source", "Destination", "DLQ"}[i], reflect.TypeOf(c))
+		}
+	}
+
+	if p.Workers > 1 {
+		p.logger().Infof("Workers: %d, ordered by key: %t", p.Workers, p.Ordering == OrderedByKey)
+	}
+
+	if p.Name != "" {
+		p.logger().Info("Pipeline: ", p.Name)
+	}
+	p.logger().Info("Delivery guarantee: ", p.Guarantees())
+}
+
+// flow processes messages from `channel` until it is closed or the
+// pipeline is stopped, and all partitions have drained.
+func (p *Pipeline) flow(channel chan message.Message) {
+	defer close(p.flowed())
+	p.partitions = &partitions{lanes: map[string]*lane{}}
+
+	p.logger().Info("Flowing data...")
+
+	// messages for asynchronous destinations are processed
+	// concurrently (partitions already are)
+	var inFlight chan bool
+	if buffered(p.Destination) && p.OnFailure != PausePartition && !(p.Workers > 1 && p.Ordering == OrderedByKey) {
+		if p.MaxInFlight < 1 {
+			p.MaxInFlight = 10000
+		}
+		inFlight = make(chan bool, p.MaxInFlight)
+	}
+
+	sampler := p.Sampling()
+	limit := p.maxMessageSize()
+	if p.Erasure != nil {
+		requests, err := readMessages(p.Erasure.Control)
+		if err != nil {
+			p.logger().Error("Failed to read erasure requests: ", err)
+		} else {
+			done := make(chan struct{})
+			defer close(done)
+			go p.erase(requests, done)
+		}
+	}
+	idle := p.newIdleMonitor()
+	defer idle.stop()
+
+	handle := func(msg message.Message) {
+		msg, ok := p.decode(msg)
+		if !ok {
+			return
+		}
+		split, ok := p.split(msg)
+		if !ok {
+			return
+		}
+		for _, msg := range split {
+			if p.Transformer != nil {
+				sampler.sample(p.logger(), SampleTransform, msg)
+			}
+			if p.erasing(msg) {
+				continue
+			}
+			msg, ok = p.guard(msg, limit)
+			if !ok {
+				continue
+			}
+			switch {
+			case p.OnFailure == PausePartition:
+				p.dispatch(msg)
+			case inFlight != nil:
+				inFlight <- true
+				p.partitions.pending.Add(1)
+				go func(msg message.Message) {
+					p.process(msg)
+					p.partitions.pending.Done()
+					<-inFlight
+				}(msg)
+			default:
+				p.process(msg)
+			}
+		}
+	}
+	var w *workers
+	if p.Workers > 1 {
+		w = p.startWorkers(handle)
+	}
+
+	stop := p.stopping()
+	p.stopMu.Lock()
+	pause := p.pausing()
+	p.stopMu.Unlock()
+read:
+	for {
+		if resumed := p.resumed(); resumed != nil {
+			select {
+			case <-resumed:
+				// not idle while paused
+				idle.restart()
+			case <-stop:
+				break read
+			}
+		}
+
+		var msg message.Message
+		var ok bool
+		select {
+		case msg, ok = <-channel:
+			idle.read()
+			if ok {
+				sampler.sample(p.logger(), SampleSource, msg)
+			}
+		case <-idle.C():
+			idle.fire()
+			continue
+		case <-pause:
+			continue
+		case <-stop:
+		}
+		if !ok {
+			break
+		}
+		if w != nil {
+			w.push(msg)
+		} else {
+			handle(msg)
+		}
+	}
+	if w != nil {
+		w.stop()
+	}
+	p.partitions.pending.Wait()
+}
+
+// process delivers a single message, then acknowledges it.
+func (p *Pipeline) process(msg message.Message) {
+	err := p.deliver(msg)
+	if !message.Handled(err) {
+		p.logger().Error(err)
+	}
+	msg.Done(err)
+}
+
+// transform applies the pipeline's transformer (if any) to `msg`.
+// It returns false if the transformer dropped the message, which is
+// then acknowledged, or failed, in which case the message is
+// quarantined.
+func (p *Pipeline) transform(msg message.Message) (message.Message, bool) {
+	if p.Transformer == nil {
+		return msg, true
+	}
+
+	transformed, err := transform.Apply(p.Transformer, msg)
+	if err != nil {
+		p.transformFailed(msg, err)
+		return msg, false
+	}
+	return transformed, true
+}
+
+// split applies the pipeline's transformer to `msg` like transform,
+// returning the messages a transform.Splitter split it into. `msg`
+// is acknowledged once all of them are, with the first error one
+// wasn't handled with (so that it is redelivered as a whole). The
+// acknowledgements transforms wrap the messages with (e.g. dedup
+// recording keys) are called first.
+func (p *Pipeline) split(msg message.Message) ([]message.Message, bool) {
+	s, ok := p.Transformer.(transform.Splitter)
+	if !ok {
+		msg, ok := p.transform(msg)
+		return []message.Message{msg}, ok
+	}
+
+	// transforms wrap no Ack, msg is acknowledged below
+	unacked := msg
+	unacked.Ack = nil
+	split, err := s.Split(unacked)
+	if err == nil && len(split) == 0 {
+		err = transform.ErrDrop
+	}
+	if err != nil {
+		p.transformFailed(msg, err)
+		return nil, false
+	}
+	if len(split) == 1 {
+		own := split[0]
+		split[0].Ack = func(err error) {
+			own.Done(err)
+			msg.Done(err)
+		}
+		return split, true
+	}
+
+	var mu sync.Mutex
+	remaining := len(split)
+	var failed error
+	for i := range split {
+		own := split[i]
+		split[i].Ack = func(err error) {
+			own.Done(err)
+			mu.Lock()
+			if failed == nil && !message.Handled(err) {
+				failed = err
+			}
+			remaining--
+			done := remaining == 0
+			mu.Unlock()
+			if done {
+				msg.Done(failed)
+			}
+		}
+	}
+	return split, true
+}
+
+// transformFailed acknowledges `msg`, dropped if `err` is
+// transform.ErrDrop and quarantined otherwise.
+func (p *Pipeline) transformFailed(msg message.Message, err error) {
+	if err == transform.ErrDrop {
+		atomic.AddUint64(&p.stats.Dropped, 1)
+		msg.Done(nil)
+		return
+	}
+	p.logger().Error("Failed to transform message: ", err)
+	msg.Done(p.reject(recordAttempt(msg, err), err))
+}
+
+// write writes `msg` to `dest` through the circuit breaker (if
+// enabled).
+func (p *Pipeline) write(dest Destination, msg message.Message) (err error) {
+	msg, err = p.encode(dest, msg)
+	if err != nil {
+		return
+	}
+
+	b := p.circuit()
+	if b != nil && !b.allow() {
+		atomic.AddUint64(&p.stats.Rejected, 1)
+		return ErrBreakerOpen
+	}
+
+	err = p.send(dest, msg)
+	if err == nil && dest == p.Destination {
+		atomic.AddUint64(&p.stats.Sent, 1)
+		p.Sampler.sample(p.logger(), SampleDestination, msg)
+	}
+
+	if b != nil {
+		switch from, to := b.record(err); {
+		case from == breakerClosed && to == breakerOpen:
+			atomic.AddUint64(&p.stats.Trips, 1)
+			p.logger().Warnf("Circuit breaker opened after %d consecutive failures: %s", p.BreakerThreshold, err)
+		case from == breakerHalfOpen && to == breakerOpen:
+			p.logger().Warn("Circuit breaker probe failed: ", err)
+		case from == breakerHalfOpen && to == breakerClosed:
+			p.logger().Info("Circuit breaker closed.")
+		}
+	}
+	return
+}
+
+// send writes `msg` to `dest` within WriteTimeout. Writes are
+// serialized so that destinations don't need to be safe for
+// concurrent use (asynchronous destinations are only serialized
+// until the write is queued).
+func (p *Pipeline) send(dest Destination, msg message.Message) error {
+	start := func() <-chan error {
+		p.writeMu.Lock()
+		defer p.writeMu.Unlock()
+		return startWrite(dest, msg)
+	}
+	if p.WriteTimeout <= 0 {
+		return <-start()
+	}
+
+	var abandoned int32
+	result := make(chan error, 1)
+	go func() {
+		p.writeMu.Lock()
+		// skip writes that timed out waiting for a hung write
+		if atomic.LoadInt32(&abandoned) == 1 {
+			p.writeMu.Unlock()
+			result <- ErrWriteTimeout
+			return
+		}
+		pending := startWrite(dest, msg)
+		p.writeMu.Unlock()
+		result <- <-pending
 	}()
 
-	// Interrupt received
-	<-interrupt
-	log.Info("Interrupt received.")
-	log.Info("Sent messages: ", stat.count)
+	timer := p.clock().NewTimer(p.WriteTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C():
+		atomic.StoreInt32(&abandoned, 1)
+		atomic.AddUint64(&p.stats.Timeouts, 1)
+		return ErrWriteTimeout
+	}
+}
+
+// circuit returns the pipeline's circuit breaker, or nil if it is
+// disabled.
+func (p *Pipeline) circuit() *breaker {
+	p.breakerOnce.Do(func() {
+		if p.BreakerThreshold < 1 {
+			return
+		}
+		cooldown := p.BreakerCooldown
+		if cooldown <= 0 {
+			cooldown = 30 * time.Second
+		}
+		p.breaker = &breaker{threshold: p.BreakerThreshold, cooldown: cooldown, clock: p.clock()}
+	})
+	return p.breaker
+}
+
+// attempt writes `msg` to the destination, retrying until
+// MaxAttempts is reached. It returns `msg` with its attempts
+// recorded.
+func (p *Pipeline) attempt(msg message.Message) (message.Message, error) {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
 
-	// Disconnect
-	src.Disconnect()
-	dest.Disconnect()
+	var err error
+	for attempts(msg) < maxAttempts {
+		if attempts(msg) > 0 && p.RetryDelay > 0 {
+			sleepOn(p.clock(), p.RetryDelay)
+		}
+
+		err = p.write(p.Destination, msg)
+		msg = recordAttempt(msg, err)
+		if err == nil {
+			return msg, nil
+		}
+		p.logger().Warnf("Delivery attempt %d/%d failed: %s", attempts(msg), maxAttempts, err)
+		if err == ErrBreakerOpen {
+			// fail fast rather than retrying against an open breaker
+			break
+		}
+		if _, ok := err.(encodeError); ok {
+			// encoding fails again
+			break
+		}
+	}
+	if err == nil {
+		// attempts were exhausted before this delivery
+		err = errAttemptsExhausted
+	}
+
+	return msg, err
+}
+
+// deliver writes `msg` to the destination, retrying until
+// MaxAttempts is reached, and quarantines it to the DLQ if all
+// attempts fail.
+func (p *Pipeline) deliver(msg message.Message) (err error) {
+	msg, err = p.attempt(msg)
+	if err == nil {
+		return
+	}
+	return p.reject(msg, err)
+}
+
+// reject quarantines `msg`, which failed with `err`, to the DLQ and
+// returns `err` wrapped with message.ErrQuarantined. It returns a
+// DeliveryError if there is no DLQ or quarantining fails.
+func (p *Pipeline) reject(msg message.Message, err error) error {
+	if p.DLQ == nil {
+		return failure(msg, err)
+	}
+
+	p.logger().Warnf("Quarantining message after %d attempts.", attempts(msg))
+	p.dlqMu.Lock()
+	qerr := quarantine(p.dlq(), msg)
+	p.dlqMu.Unlock()
+	if qerr != nil {
+		p.logger().Error("Failed to quarantine message: ", qerr)
+		return failure(msg, err)
+	}
+	atomic.AddUint64(&p.stats.Quarantined, 1)
+	return quarantinedError{err}
 }
@@ -0,0 +1,395 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/abstractpaper/manifold/transform"
+	"github.com/abstractpaper/manifold/transform/dedup"
+	transformjson "github.com/abstractpaper/manifold/transform/json"
+	"github.com/stretchr/testify/assert"
+)
+
+// memory is a destination that records written messages and fails
+// the first `fail` writes.
+type memory struct {
+	fail     int
+	messages []string
+}
+
+func (m *memory) Connect() error    { return nil }
+func (m *memory) Disconnect() error { return nil }
+func (m *memory) Info()             {}
+func (m *memory) Write(message string) error {
+	if m.fail > 0 {
+		m.fail--
+		return errors.New("write failed")
+	}
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+func TestPipeline_DeliverRetries(t *testing.T) {
+	dest := &memory{fail: 2}
+	p := &Pipeline{Destination: dest, MaxAttempts: 3}
+
+	err := p.deliver(message.New("hello"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hello"}, dest.messages)
+}
+
+func TestPipeline_DeliverQuarantines(t *testing.T) {
+	dest := &memory{fail: 5}
+	dlq := &memory{}
+	p := &Pipeline{Destination: dest, DLQ: dlq, MaxAttempts: 2}
+
+	msg := message.New("poison")
+	msg.Metadata["key"] = "value"
+	err := p.deliver(msg)
+
+	assert.True(t, errors.Is(err, message.ErrQuarantined))
+	assert.Empty(t, dest.messages)
+	assert.Equal(t, uint64(1), p.Stats().Quarantined)
+
+	var letter DeadLetter
+	assert.NoError(t, json.Unmarshal([]byte(dlq.messages[0]), &letter))
+	assert.Equal(t, DeadLetter{
+		Message:  "poison",
+		Metadata: map[string]string{"key": "value"},
+		Attempts: 2,
+		Errors:   []string{"write failed", "write failed"},
+	}, letter)
+}
+
+func TestPipeline_DeliverAttemptsFromPreviousRun(t *testing.T) {
+	dest := &memory{}
+	dlq := &memory{}
+	p := &Pipeline{Destination: dest, DLQ: dlq, MaxAttempts: 3}
+
+	// redelivered message that already failed 3 times
+	msg := message.New("poison")
+	msg.Metadata[MetaAttempts] = "3"
+	err := p.deliver(msg)
+
+	assert.True(t, errors.Is(err, message.ErrQuarantined))
+	assert.Empty(t, dest.messages)
+	assert.Len(t, dlq.messages, 1)
+}
+
+func TestPipeline_DeliverNoDLQ(t *testing.T) {
+	dest := &memory{fail: 5}
+	p := &Pipeline{Destination: dest, MaxAttempts: 2}
+
+	err := p.deliver(message.New("poison"))
+
+	var failed *DeliveryError
+	assert.True(t, errors.As(err, &failed))
+	assert.Equal(t, 2, failed.Attempts)
+	assert.Equal(t, []string{"write failed", "write failed"}, failed.Errors)
+}
+
+// dropper drops messages with an empty body.
+type dropper struct{}
+
+func (dropper) Info() {}
+func (dropper) Transform(body string) (string, error) {
+	if body == "" {
+		return body, transform.ErrDrop
+	}
+	return body, nil
+}
+
+func TestPipeline_TransformDrop(t *testing.T) {
+	p := &Pipeline{Transformer: dropper{}}
+
+	var acked []error
+	msg := message.New("")
+	msg.Ack = func(err error) { acked = append(acked, err) }
+	_, ok := p.transform(msg)
+
+	assert.False(t, ok)
+	assert.Equal(t, []error{nil}, acked)
+	assert.Equal(t, uint64(1), p.Stats().Dropped)
+
+	_, ok = p.transform(message.New("hello"))
+	assert.True(t, ok)
+}
+
+// hung is a destination whose writes block until `release` is
+// closed.
+type hung struct {
+	memory
+	release chan bool
+}
+
+func (h *hung) Write(message string) error {
+	<-h.release
+	return h.memory.Write(message)
+}
+
+func TestPipeline_WriteTimeout(t *testing.T) {
+	dest := &hung{release: make(chan bool)}
+	dlq := &memory{}
+	defer close(dest.release)
+	p := &Pipeline{Destination: dest, DLQ: dlq, WriteTimeout: 10 * time.Millisecond}
+
+	assert.True(t, errors.Is(p.deliver(message.New("first")), ErrWriteTimeout))
+	assert.True(t, errors.Is(p.deliver(message.New("second")), ErrWriteTimeout))
+
+	assert.Len(t, dlq.messages, 2)
+	assert.Equal(t, uint64(2), p.Stats().Timeouts)
+	assert.Equal(t, uint64(0), p.Stats().Sent)
+}
+
+func TestPipeline_CircuitBreaker(t *testing.T) {
+	dest := &memory{fail: 3}
+	dlq := &memory{}
+	p := &Pipeline{
+		Destination:      dest,
+		DLQ:              dlq,
+		MaxAttempts:      2,
+		BreakerThreshold: 3,
+		BreakerCooldown:  20 * time.Millisecond,
+	}
+
+	// the breaker opens on the 3rd failure (b's first attempt), b's
+	// retry and c are rejected without writing
+	for _, body := range []string{"a", "b", "c"} {
+		assert.True(t, errors.Is(p.deliver(message.New(body)), message.ErrQuarantined))
+	}
+	assert.Len(t, dlq.messages, 3)
+	assert.Equal(t, 0, dest.fail)
+	assert.Equal(t, uint64(1), p.Stats().Trips)
+	assert.Equal(t, uint64(2), p.Stats().Rejected)
+
+	// the destination recovered, the probe closes the breaker
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, p.deliver(message.New("d")))
+	assert.NoError(t, p.deliver(message.New("e")))
+	assert.Equal(t, []string{"d", "e"}, dest.messages)
+}
+
+// failer fails to transform messages.
+type failer struct{}
+
+func (failer) Info() {}
+func (failer) Transform(body string) (string, error) {
+	return "", errors.New("malformed")
+}
+
+func TestPipeline_TransformErrorQuarantines(t *testing.T) {
+	dlq := &memory{}
+	p := &Pipeline{Transformer: failer{}, DLQ: dlq}
+
+	var acked []error
+	msg := message.New("{")
+	msg.Ack = func(err error) { acked = append(acked, err) }
+	_, ok := p.transform(msg)
+
+	assert.False(t, ok)
+	assert.True(t, errors.Is(acked[0], message.ErrQuarantined))
+	assert.Len(t, dlq.messages, 1)
+	assert.Contains(t, dlq.messages[0], `"errors":["malformed"]`)
+
+	// without a DLQ, the message is acknowledged with its error
+	p = &Pipeline{Transformer: failer{}}
+	msg.Ack = func(err error) { acked = append(acked, err) }
+	p.transform(msg)
+	assert.EqualError(t, acked[1], "malformed")
+	assert.False(t, message.Handled(acked[1]))
+}
+
+// lines splits messages into their lines.
+type lines struct{}
+
+func (lines) Info()                                 {}
+func (lines) Transform(body string) (string, error) { return body, nil }
+func (lines) Split(m message.Message) ([]message.Message, error) {
+	var split []message.Message
+	for _, line := range strings.Split(m.Body, "\n") {
+		split = append(split, message.Message{Body: line, Metadata: m.Metadata, Ack: m.Ack})
+	}
+	return split, nil
+}
+
+func TestPipeline_TransformSplit(t *testing.T) {
+	p := &Pipeline{Transformer: lines{}}
+
+	var acked []error
+	msg := message.New("a\nb\nc")
+	msg.Ack = func(err error) { acked = append(acked, err) }
+	split, ok := p.split(msg)
+	assert.True(t, ok)
+	assert.Len(t, split, 3)
+
+	// the message is acknowledged once all its parts are, with the
+	// error of a part that wasn't handled
+	split[0].Done(nil)
+	split[2].Done(errors.New("write failed"))
+	assert.Empty(t, acked)
+	split[1].Done(fmt.Errorf("%w: to DLQ", message.ErrQuarantined))
+	assert.EqualError(t, acked[0], "write failed")
+
+	// through a pipeline
+	src := make(channelSource)
+	dest := &memory{}
+	p = &Pipeline{Source: src, Transformer: transform.Chain{lines{}, dropper{}}, Destination: dest}
+	go func() {
+		src <- message.New("d\n\ne")
+		close(src)
+	}()
+	assert.NoError(t, p.RunUntilDrained())
+	assert.Equal(t, []string{"d", "e"}, dest.messages)
+}
+
+func TestPipeline_TransformSplitKeepsAcks(t *testing.T) {
+	// a chain is a Splitter, dedup records keys on acknowledgement
+	src := make(channelSource)
+	dest := &memory{}
+	p := &Pipeline{
+		Source:      src,
+		Transformer: transform.Chain{&dedup.Dedup{Field: "id"}, &transformjson.JSON{}},
+		Destination: dest,
+	}
+	go func() {
+		for i := 0; i < 3; i++ {
+			src <- message.New(`{"id":1}`)
+		}
+		close(src)
+	}()
+	assert.NoError(t, p.RunUntilDrained())
+	assert.Equal(t, []string{`{"id":1}`}, dest.messages)
+}
+
+func TestPipeline_StartFromNotSeekable(t *testing.T) {
+	p := &Pipeline{
+		Source:      &Stdio{},
+		Destination: &memory{},
+		StartFrom:   &Position{Type: Earliest},
+	}
+	err := p.RunUntilDrained()
+	assert.True(t, errors.Is(err, ErrNotSeekable))
+
+	// Run returns it too, once disconnected
+	p = &Pipeline{
+		Source:      &Stdio{},
+		Destination: &memory{},
+		StartFrom:   &Position{Type: Earliest},
+	}
+	err = p.Run()
+	assert.True(t, errors.Is(err, ErrNotSeekable))
+}
+
+// channelSource is a source reading messages sent on its channel.
+type channelSource chan message.Message
+
+func (c channelSource) Connect() error    { return nil }
+func (c channelSource) Disconnect() error { return nil }
+func (c channelSource) Info()             {}
+func (c channelSource) Read() (chan string, error) {
+	return nil, errors.New("not implemented")
+}
+func (c channelSource) ReadMessages() (chan message.Message, error) {
+	return c, nil
+}
+
+func TestPipeline_Stop(t *testing.T) {
+	src := make(channelSource)
+	dest := &memory{}
+	p := &Pipeline{Source: src, Destination: dest}
+	done := make(chan error)
+	go func() { done <- p.RunUntilDrained() }()
+
+	src <- message.New("a")
+	src <- message.New("b")
+	p.Stop()
+	p.Stop()
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{"a", "b"}, dest.messages)
+}
+
+func TestPipeline_StopPausedPartition(t *testing.T) {
+	src := make(channelSource)
+	p := &Pipeline{
+		Source:        src,
+		Destination:   &memory{fail: 100},
+		OnFailure:     PausePartition,
+		ProbeInterval: time.Hour,
+	}
+	done := make(chan error)
+	go func() { done <- p.RunUntilDrained() }()
+
+	acked := make(chan error, 1)
+	m := message.New("a")
+	m.Ack = func(err error) { acked <- err }
+	src <- m
+	p.Stop()
+	assert.NoError(t, <-done)
+	assert.Error(t, <-acked)
+	assert.Equal(t, int64(0), p.Stats().Paused)
+}
+
+func TestPipeline_IdleHeartbeats(t *testing.T) {
+	clock := NewFakeClock(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC))
+	src := make(channelSource)
+	dest := &memory{}
+	p := &Pipeline{
+		Name:        "orders",
+		Source:      src,
+		Destination: dest,
+		IdleTimeout: time.Minute,
+		Heartbeat:   10 * time.Second,
+		Clock:       clock,
+	}
+	done := make(chan error)
+	go func() { done <- p.RunUntilDrained() }()
+
+	waiting := func() bool { return clock.Waiters() == 1 }
+	assert.Eventually(t, waiting, time.Second, time.Millisecond)
+	clock.Advance(59 * time.Second)
+	assert.Equal(t, uint64(0), p.Stats().Idle)
+	clock.Advance(time.Second)
+	assert.Eventually(t, func() bool { return p.Stats().Heartbeats == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(1), p.Stats().Idle)
+	assert.True(t, p.Stats().IdleSince.Equal(clock.Now().Add(-time.Minute)))
+	assert.Eventually(t, waiting, time.Second, time.Millisecond)
+	clock.Advance(10 * time.Second)
+	assert.Eventually(t, func() bool { return p.Stats().Heartbeats == 2 }, time.Second, time.Millisecond)
+
+	src <- message.New("a")
+	p.Stop()
+	assert.NoError(t, <-done)
+	assert.True(t, p.Stats().IdleSince.IsZero())
+	assert.Len(t, dest.messages, 3)
+	assert.JSONEq(t, `{"heartbeat": "2020-10-01T12:01:00Z", "pipeline": "orders", "idleSince": "2020-10-01T12:00:00Z"}`, dest.messages[0])
+	assert.Equal(t, "a", dest.messages[2])
+}
+
+func TestPipeline_PauseResume(t *testing.T) {
+	src := make(channelSource)
+	dest := &memory{}
+	p := &Pipeline{Source: src, Destination: dest}
+	p.Pause()
+	assert.True(t, p.Paused())
+	done := make(chan error)
+	go func() { done <- p.RunUntilDrained() }()
+
+	select {
+	case src <- message.New("a"):
+		t.Fatal("read while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.Resume()
+	assert.False(t, p.Paused())
+	src <- message.New("a")
+	p.Stop()
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{"a"}, dest.messages)
+}
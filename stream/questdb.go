@@ -0,0 +1,267 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// QuestDB writes JSON messages to a QuestDB table using the InfluxDB
+// line protocol (ILP) over TCP.
+//
+// Fields listed in Config.Symbols are written as symbol columns and
+// fields listed in Config.Columns (all other fields if empty) as
+// columns: numbers as doubles, booleans as booleans, strings as
+// strings and other values as JSON strings. The designated timestamp
+// is read from Config.TimeField (milliseconds since epoch, or an RFC
+// 3339 string) and defaults to the current time.
+//
+// Lines are written in batches sorted by time, which keeps QuestDB's
+// out-of-order merges cheap. Messages more than Config.MaxLag behind
+// the newest message are rejected with an error. Messages written
+// with WriteAsync (as pipelines do) are acknowledged once their batch
+// is written.
+type QuestDB struct {
+	Addr    string // host:port of the ILP listener, e.g. localhost:9009
+	Table   string
+	Config  *QuestDBConfig
+	conn    net.Conn
+	columns map[string]bool
+	late    lateness
+	batcher *batcher
+	clocked
+	logged
+}
+
+// QuestDBConfig configures the column mapping and batching.
+type QuestDBConfig struct {
+	Symbols    []string
+	Columns    []string
+	TimeField  string
+	MaxLag     int // seconds, 0 accepts messages of any age
+	BatchSize  int // lines per write, defaults to 1000
+	FlushEvery int // seconds, defaults to 1
+	MaxRetries int // retries of failed writes, defaults to 3
+}
+
+func (q *QuestDB) Connect() (err error) {
+	if q.Config == nil {
+		q.Config = &QuestDBConfig{}
+	}
+	if q.Config.BatchSize < 1 {
+		q.Config.BatchSize = 1000
+	}
+	if q.Config.FlushEvery < 1 {
+		q.Config.FlushEvery = 1
+	}
+	if q.Config.MaxRetries < 1 {
+		q.Config.MaxRetries = 3
+	}
+	q.late.maxLag = time.Duration(q.Config.MaxLag) * time.Second
+
+	if len(q.Config.Columns) > 0 {
+		q.columns = map[string]bool{}
+		for _, c := range q.Config.Columns {
+			q.columns[c] = true
+		}
+	}
+
+	err = q.dial()
+	if err != nil {
+		return
+	}
+
+	q.batcher = newBatcher("QuestDB", q.logger(), q.clock(), q.Config.BatchSize, time.Duration(q.Config.FlushEvery)*time.Second, q.Config.MaxRetries, q.send)
+
+	return
+}
+
+func (q *QuestDB) dial() (err error) {
+	q.logger().Info("Establishing QuestDB connection...")
+	q.conn, err = net.DialTimeout("tcp", q.Addr, 10*time.Second)
+	if err != nil {
+		q.logger().Error("QuestDB: Failed to connect: ", err)
+	}
+	return
+}
+
+// Disconnect flushes buffered lines and closes the connection.
+func (q *QuestDB) Disconnect() (err error) {
+	if q.batcher != nil {
+		q.batcher.close()
+		q.batcher = nil
+	}
+	if q.conn != nil {
+		err = q.conn.Close()
+		q.conn = nil
+	}
+	return
+}
+
+// Capabilities of QuestDB: the line protocol doesn't confirm that
+// lines are stored.
+func (q *QuestDB) Capabilities() Capabilities {
+	return Capabilities{Batching: true}
+}
+
+func (q *QuestDB) Info() {
+	q.logger().Infof("QuestDB: %s/%s", q.Addr, q.Table)
+	q.logger().Infof("QuestDBConfig: %+v", *q.Config)
+}
+
+func (q *QuestDB) Write(body string) (err error) {
+	return q.WriteMessage(message.New(body))
+}
+
+// WriteMessage buffers a line for `m`.
+func (q *QuestDB) WriteMessage(m message.Message) (err error) {
+	p, err := q.point(m)
+	if err != nil {
+		return
+	}
+	q.batcher.add(p, nil)
+	return
+}
+
+// WriteAsync buffers a line for `m` and calls `done` once it has been
+// written.
+func (q *QuestDB) WriteAsync(m message.Message, done func(error)) {
+	p, err := q.point(m)
+	if err != nil {
+		done(err)
+		return
+	}
+	q.batcher.add(p, done)
+}
+
+// point parses `m` and checks it can be written.
+func (q *QuestDB) point(m message.Message) (p point, err error) {
+	p, err = parsePoint(m, q.Config.TimeField)
+	if err != nil {
+		return
+	}
+	err = q.late.check(p.time)
+	if err != nil {
+		return
+	}
+	if len(q.line(p)) == 0 {
+		return p, errors.New("QuestDB: message has no columns to write")
+	}
+	return
+}
+
+// line formats `p` as an ILP line, or returns nil if it has no
+// columns.
+func (q *QuestDB) line(p point) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(ilpEscape(q.Table, ", "))
+
+	symbols := map[string]bool{}
+	for _, s := range q.Config.Symbols {
+		symbols[s] = true
+		v, ok := p.fields[s]
+		if !ok || v == nil {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(ilpEscape(s, ",= "))
+		buf.WriteByte('=')
+		buf.WriteString(ilpEscape(ilpString(v), ",= "))
+	}
+
+	// sorted for a stable column order
+	var names []string
+	for name, v := range p.fields {
+		if symbols[name] || v == nil || (q.columns != nil && !q.columns[name]) {
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		if i == 0 {
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(ilpEscape(name, ",= "))
+		buf.WriteByte('=')
+		switch v := p.fields[name].(type) {
+		case float64:
+			buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			buf.WriteString(strconv.FormatBool(v))
+		default:
+			buf.WriteByte('"')
+			buf.WriteString(ilpEscape(ilpString(v), `"`))
+			buf.WriteByte('"')
+		}
+	}
+
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(p.time.UnixNano(), 10))
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// ilpString returns `v` as a string; non-string values are JSON
+// encoded.
+func ilpString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// ilpEscape escapes `chars` and newlines in `s` with a backslash.
+func ilpEscape(s string, chars string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\n' {
+			b.WriteString(`\n`)
+			continue
+		}
+		if r == '\\' || strings.ContainsRune(chars, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// send writes a batch of lines sorted by time, reconnecting first if
+// the previous write failed.
+func (q *QuestDB) send(batch []*batchEntry) (err error) {
+	points := batchPoints(batch)
+	sortPoints(points)
+	var buf bytes.Buffer
+	for _, p := range points {
+		buf.Write(q.line(p))
+	}
+
+	if q.conn == nil {
+		err = q.dial()
+		if err != nil {
+			return
+		}
+	}
+	_, err = q.conn.Write(buf.Bytes())
+	if err != nil {
+		// the connection is unusable after a failed write
+		q.conn.Close()
+		q.conn = nil
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package stream
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuestDB_Line(t *testing.T) {
+	q := &QuestDB{Table: "sensor readings", Config: &QuestDBConfig{
+		Symbols:   []string{"device"},
+		TimeField: "ts",
+	}}
+
+	p, err := parsePoint(message.New(`{"device":"d 1","temp":21.5,"ok":true,"note":"say \"hi\"","tags":["a"],"ts":1601553600000}`), "ts")
+	assert.NoError(t, err)
+	assert.Equal(t,
+		`sensor\ readings,device=d\ 1 note="say \"hi\"",ok=true,tags="[\"a\"]",temp=21.5 1601553600000000000`+"\n",
+		string(q.line(p)))
+
+	// only symbols: no columns
+	p, _ = parsePoint(message.New(`{"device":"d1"}`), "ts")
+	assert.Nil(t, q.line(p))
+}
+
+func TestQuestDB_Write(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	q := &QuestDB{Addr: listener.Addr().String(), Table: "t", Config: &QuestDBConfig{
+		TimeField: "ts",
+		MaxLag:    60,
+	}}
+	assert.NoError(t, q.Connect())
+	assert.NoError(t, q.Write(`{"v":2,"ts":1601553660000}`))
+	assert.NoError(t, q.Write(`{"v":1,"ts":1601553600000}`))
+	// more than a minute behind the newest message
+	assert.Error(t, q.Write(`{"v":0,"ts":1601553540000}`))
+	assert.Error(t, q.Write(`not json`))
+	assert.NoError(t, q.Disconnect())
+
+	// batches are sorted by time
+	assert.Equal(t, "t v=1 1601553600000000000", <-lines)
+	assert.Equal(t, "t v=2 1601553660000000000", <-lines)
+}
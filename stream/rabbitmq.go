@@ -1,48 +1,61 @@
 package stream
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/abstractpaper/manifold/message"
 	"github.com/streadway/amqp"
 )
 
+// RabbitMQ publishes to an exchange or consumes from a queue.
+//
+// Messages are acknowledged automatically on delivery unless
+// `autoAck` is "false" in Args, in which case they are acknowledged
+// once the pipeline handles them. Messages that fail are republished
+// to the tail of the queue with their attempt count and error history
+// in the x-manifold-attempts and x-manifold-errors headers, which are
+// read back into MetaAttempts and MetaErrors, so the history survives
+// restarts (if republishing fails they are requeued as is).
 type RabbitMQ struct {
 	URL     string
 	Header  http.Header
 	Args    map[string]string
 	conn    *amqp.Connection
 	channel *amqp.Channel
+	logged
 }
 
 func (r *RabbitMQ) Connect() (err error) {
 	// connect to rabbitmq
-	log.Info("Establishing rabbitmq connection...")
+	r.logger().Info("Establishing rabbitmq connection...")
 	r.conn, err = amqp.Dial(r.URL)
 	if err != nil {
-		log.Error("RabbitMQ: Failed to connect: ", err)
+		r.logger().Error("RabbitMQ: Failed to connect: ", err)
 		return
 	}
 	r.channel, err = r.conn.Channel()
 	if err != nil {
-		log.Error("RabbitMQ: Failed to open a channel: ", err)
+		r.logger().Error("RabbitMQ: Failed to open a channel: ", err)
 	}
 	return
 }
 
 func (r *RabbitMQ) Disconnect() (err error) {
 	if r.conn == nil {
-		log.Warn("RabbitMQ.Disconnect(): conn is nil")
+		r.logger().Warn("RabbitMQ.Disconnect(): conn is nil")
 		return
 	}
 
-	log.Info("Closing rabbitmq connection...")
+	r.logger().Info("Closing rabbitmq connection...")
 	err = r.conn.Close()
 	if err != nil {
-		log.Error("RabbitMQ close error: ", err)
+		r.logger().Error("RabbitMQ close error: ", err)
 		return
 	}
-	log.Info("RabbitMQ connection closed.")
+	r.logger().Info("RabbitMQ connection closed.")
 
 	return
 }
@@ -65,7 +78,7 @@ func (r *RabbitMQ) Write(message string) (err error) {
 		})
 
 	if err != nil {
-		log.Error("RabbitMQ: Failed to publish to channel: ", err)
+		r.logger().Error("RabbitMQ: Failed to publish to channel: ", err)
 		return
 	}
 
@@ -73,31 +86,142 @@ func (r *RabbitMQ) Write(message string) (err error) {
 }
 
 func (r *RabbitMQ) Read() (channel chan string, err error) {
+	messages, err := r.ReadMessages()
+	if err != nil {
+		return
+	}
+
 	channel = make(chan string)
+	go func() {
+		for m := range messages {
+			channel <- m.Body
+			m.Done(nil)
+		}
+	}()
+
+	return
+}
+
+// ReadMessages consumes from the queue in Args.
+func (r *RabbitMQ) ReadMessages() (channel chan message.Message, err error) {
+	channel = make(chan message.Message)
+	autoAck := r.Args["autoAck"] != "false"
 
 	deliveryChannel, err := r.channel.Consume(
 		r.Args["queue"],
 		r.Args["consumer"],
-		true,
+		autoAck,
 		false,
 		false,
 		false,
 		nil,
 	)
 	if err != nil {
-		log.Error("RabbitMQ: Failed to read from channel: ", err)
+		r.logger().Error("RabbitMQ: Failed to read from channel: ", err)
 		return
 	}
 
 	go func() {
-		for m := range deliveryChannel {
-			channel <- string(m.Body)
+		for d := range deliveryChannel {
+			m := message.New(string(d.Body))
+			if n, ok := d.Headers[rabbitmqAttempts].(string); ok {
+				m.Metadata[MetaAttempts] = n
+			}
+			if errs, ok := d.Headers[rabbitmqErrors].(string); ok {
+				m.Metadata[MetaErrors] = errs
+			}
+			if !autoAck {
+				m.Ack = ackFunc(d, r.requeue, r.logger())
+			}
+			channel <- m
 		}
 	}()
 
 	return
 }
 
+// Headers carrying the attempts and error history of republished
+// messages.
+const (
+	rabbitmqAttempts = "x-manifold-attempts"
+	rabbitmqErrors   = "x-manifold-errors"
+)
+
+// requeue publishes `p` to the tail of the consumed queue.
+func (r *RabbitMQ) requeue(p amqp.Publishing) error {
+	err := r.channel.Publish("", r.Args["queue"], false, false, p)
+	if err != nil {
+		r.logger().Error("RabbitMQ: Failed to republish delivery: ", err)
+	}
+	return err
+}
+
+// ackFunc acknowledges `d` on success. On failure, `d` is republished
+// with its error history (see failed) and acknowledged, or requeued
+// as is if that isn't possible.
+func ackFunc(d amqp.Delivery, publish func(amqp.Publishing) error, logger Logger) func(error) {
+	return func(err error) {
+		var failed *DeliveryError
+		switch {
+		case message.Handled(err):
+			err = d.Ack(false)
+		case errors.As(err, &failed) && publish(republished(d, failed)) == nil:
+			err = d.Ack(false)
+		default:
+			err = d.Nack(false, true)
+		}
+		if err != nil {
+			logger.Error("RabbitMQ: Failed to acknowledge delivery: ", err)
+		}
+	}
+}
+
+// republished returns a copy of `d` carrying the attempts and error
+// history of `failed` in its headers.
+func republished(d amqp.Delivery, failed *DeliveryError) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[rabbitmqAttempts] = strconv.Itoa(failed.Attempts)
+	errs, _ := json.Marshal(failed.Errors)
+	headers[rabbitmqErrors] = string(errs)
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// Resources returns the queue and the exchange of Args, if set.
+func (r *RabbitMQ) Resources() (resources []Resource) {
+	if queue := r.Args["queue"]; queue != "" {
+		resources = append(resources, Resource{Kind: "rabbitmq_queue", Name: queue})
+	}
+	if exchange := r.Args["exchange"]; exchange != "" {
+		resources = append(resources, Resource{Kind: "rabbitmq_exchange", Name: exchange})
+	}
+	return
+}
+
+// Capabilities of RabbitMQ: deliveries are acknowledged if `autoAck`
+// is "false", publishing isn't confirmed.
+func (r *RabbitMQ) Capabilities() Capabilities {
+	return Capabilities{Acks: r.Args["autoAck"] == "false", Ordering: true}
+}
+
 func (r *RabbitMQ) Info() {
-	log.Info("Args: ", r.Args)
+	r.logger().Info("Args: ", r.Args)
 }
@@ -0,0 +1,60 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// acknowledger records the acknowledgements of a delivery.
+type acknowledger struct {
+	acks, nacks int
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error { a.acks++; return nil }
+func (a *acknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacks++
+	return nil
+}
+func (a *acknowledger) Reject(tag uint64, requeue bool) error { return nil }
+
+func TestRabbitMQ_AckRepublishesErrorHistory(t *testing.T) {
+	ack := &acknowledger{}
+	d := amqp.Delivery{Acknowledger: ack, Body: []byte("poison"), Headers: amqp.Table{"tenant": "t1"}}
+
+	var published []amqp.Publishing
+	publish := func(p amqp.Publishing) error {
+		published = append(published, p)
+		return nil
+	}
+
+	m := message.New("poison")
+	m = recordAttempt(m, errors.New("write failed"))
+	m = recordAttempt(m, errors.New("timeout"))
+	ackFunc(d, publish, DefaultLogger)(failure(m, errors.New("timeout")))
+
+	assert.Equal(t, 1, ack.acks)
+	assert.Len(t, published, 1)
+	assert.Equal(t, amqp.Table{
+		"tenant":         "t1",
+		rabbitmqAttempts: "2",
+		rabbitmqErrors:   `["write failed","timeout"]`,
+	}, published[0].Headers)
+	assert.Equal(t, []byte("poison"), published[0].Body)
+}
+
+func TestRabbitMQ_AckRequeuesWhenRepublishFails(t *testing.T) {
+	ack := &acknowledger{}
+	d := amqp.Delivery{Acknowledger: ack}
+	publish := func(p amqp.Publishing) error { return errors.New("channel closed") }
+
+	ackFunc(d, publish, DefaultLogger)(failure(message.New(""), errors.New("write failed")))
+	ackFunc(d, publish, DefaultLogger)(errors.New("unknown failure"))
+	ackFunc(d, publish, DefaultLogger)(nil)
+
+	assert.Equal(t, 2, ack.nacks)
+	assert.Equal(t, 1, ack.acks)
+}
@@ -0,0 +1,360 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Metadata keys attached to messages read from Redis.
+const (
+	MetaRedisChannel = "redis.channel"
+	MetaRedisKey     = "redis.key"
+)
+
+// Redis reads from or writes to Redis, using either Pub/Sub or a
+// list as a lightweight queue.
+//
+// Args:
+//
+//	mode: "pubsub" (SUBSCRIBE / PUBLISH) or "list" (BLMOVE / RPUSH).
+//	channel: Pub/Sub channel, in pubsub mode.
+//	key: list key, in list mode.
+//	processingKey: list holding elements being processed, in list
+//	mode, defaults to `<key>:processing`.
+//
+// In list mode, elements are atomically moved from the head of the
+// list to the processing list (BLMOVE, Redis 6.2+) and removed from it
+// once acknowledged; failed elements are pushed back to the head of
+// the list. Elements left in the processing list by a crash are
+// pushed back when reading starts, so each consumer of a list must
+// use its own processingKey.
+//
+// Reading survives connection failures: the source reconnects (and
+// resubscribes) with backoff instead of failing the pipeline.
+type Redis struct {
+	URL   string // e.g. redis://:password@localhost:6379/0
+	Args  map[string]string
+	pool  *redis.Pool
+	stats RedisStats
+	done  chan bool
+	wg    sync.WaitGroup
+	logged
+}
+
+// RedisStats holds the counters of a Redis connector.
+type RedisStats struct {
+	Received   uint64
+	Sent       uint64
+	Reconnects uint64
+}
+
+const (
+	redisModePubSub = "pubsub"
+	redisModeList   = "list"
+)
+
+func (r *Redis) Connect() (err error) {
+	switch r.Args["mode"] {
+	case redisModePubSub:
+		if r.Args["channel"] == "" {
+			return errors.New("channel must be specified in Args.")
+		}
+	case redisModeList:
+		if r.Args["key"] == "" {
+			return errors.New("key must be specified in Args.")
+		}
+		if r.Args["processingKey"] == "" {
+			r.Args["processingKey"] = r.Args["key"] + ":processing"
+		}
+	default:
+		return errors.New("mode must be either pubsub or list.")
+	}
+
+	r.logger().Info("Establishing redis connection...")
+	r.pool = &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(r.URL)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	r.done = make(chan bool)
+
+	// fail early if redis is unreachable
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("PING")
+	if err != nil {
+		r.logger().Error("Redis: Failed to connect: ", err)
+	}
+	return
+}
+
+func (r *Redis) Disconnect() (err error) {
+	if r.pool == nil {
+		r.logger().Warn("Redis.Disconnect(): pool is nil")
+		return
+	}
+
+	r.logger().Info("Closing redis connections...")
+	close(r.done)
+	err = r.pool.Close()
+	r.wg.Wait()
+	if err != nil {
+		r.logger().Error("Redis close error: ", err)
+	}
+	return
+}
+
+// Capabilities of Redis: lists keep elements until they are
+// acknowledged, Pub/Sub messages are only delivered to subscribers
+// connected at the time.
+func (r *Redis) Capabilities() Capabilities {
+	list := r.Args["mode"] != redisModePubSub
+	return Capabilities{Acks: list, ConfirmedWrites: list, Ordering: true}
+}
+
+func (r *Redis) Info() {
+	r.logger().Info("Redis.Args: ", r.Args)
+}
+
+// Stats returns a snapshot of the connector counters.
+func (r *Redis) Stats() RedisStats {
+	return RedisStats{
+		Received:   atomic.LoadUint64(&r.stats.Received),
+		Sent:       atomic.LoadUint64(&r.stats.Sent),
+		Reconnects: atomic.LoadUint64(&r.stats.Reconnects),
+	}
+}
+
+// Write publishes `message` to the channel or pushes it to the
+// tail of the list.
+func (r *Redis) Write(message string) (err error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if r.Args["mode"] == redisModePubSub {
+		_, err = conn.Do("PUBLISH", r.Args["channel"], message)
+	} else {
+		_, err = conn.Do("RPUSH", r.Args["key"], message)
+	}
+	if err != nil {
+		r.logger().Error("Redis: Failed to write: ", err)
+		return
+	}
+
+	atomic.AddUint64(&r.stats.Sent, 1)
+	return
+}
+
+func (r *Redis) Read() (channel chan string, err error) {
+	messages, err := r.ReadMessages()
+	if err != nil {
+		return
+	}
+
+	channel = make(chan string)
+	go func() {
+		for m := range messages {
+			channel <- m.Body
+			m.Done(nil)
+		}
+	}()
+	return
+}
+
+// ReadMessages subscribes to the channel or pops from the head of
+// the list. Popped elements are removed from the processing list when
+// their message is acknowledged.
+func (r *Redis) ReadMessages() (channel chan message.Message, err error) {
+	channel = make(chan message.Message)
+	read := r.pop
+	if r.Args["mode"] == redisModePubSub {
+		read = r.subscribe
+	} else {
+		// only at startup: on reconnects the processing list holds
+		// elements still in flight in the pipeline
+		err = r.restore()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		backoff := time.Second
+		for {
+			err := read(channel)
+			if err == nil {
+				return // disconnected
+			}
+
+			r.logger().Warnf("Redis: Read failed: %s, reconnecting in %s...", err, backoff)
+			atomic.AddUint64(&r.stats.Reconnects, 1)
+			select {
+			case <-r.done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+	}()
+
+	return
+}
+
+// subscribe pushes messages of the channel into `channel` until
+// the connector is disconnected (nil) or the connection fails.
+func (r *Redis) subscribe(channel chan message.Message) error {
+	conn, err := r.pool.Dial()
+	if err != nil {
+		return err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	err = psc.Subscribe(r.Args["channel"])
+	if err != nil {
+		return err
+	}
+
+	// unblock Receive on disconnect
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		select {
+		case <-r.done:
+			psc.Unsubscribe()
+		case <-stop:
+		}
+	}()
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			m := message.New(string(v.Data))
+			m.Metadata[MetaRedisChannel] = v.Channel
+			if !r.push(channel, m) {
+				return nil
+			}
+		case redis.Subscription:
+			r.logger().Infof("Redis: %s %s (%d)", v.Kind, v.Channel, v.Count)
+			if v.Count == 0 {
+				return nil
+			}
+		case error:
+			select {
+			case <-r.done:
+				return nil
+			default:
+				return v
+			}
+		}
+	}
+}
+
+// pop pushes elements popped from the list into `channel` until the
+// connector is disconnected (nil) or the connection fails.
+func (r *Redis) pop(channel chan message.Message) error {
+	key, processing := r.Args["key"], r.Args["processingKey"]
+
+	for {
+		select {
+		case <-r.done:
+			return nil
+		default:
+		}
+
+		conn := r.pool.Get()
+		// block for at most a second to check for disconnects
+		value, err := redis.String(conn.Do("BLMOVE", key, processing, "LEFT", "RIGHT", 1))
+		conn.Close()
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		m := message.New(value)
+		m.Metadata[MetaRedisKey] = key
+		m.Ack = func(err error) { r.ack(value, err) }
+		if !r.push(channel, m) {
+			// left in the processing list, restored on the next read
+			return nil
+		}
+	}
+}
+
+// ack removes `value` from the processing list. If it failed (and
+// wasn't quarantined) it is pushed back to the head of the list to be
+// read again.
+func (r *Redis) ack(value string, err error) {
+	key, processing := r.Args["key"], r.Args["processingKey"]
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if message.Handled(err) {
+		_, err = conn.Do("LREM", processing, 1, value)
+	} else {
+		conn.Send("MULTI")
+		conn.Send("LREM", processing, 1, value)
+		conn.Send("LPUSH", key, value)
+		_, err = conn.Do("EXEC")
+	}
+	if err != nil {
+		r.logger().Error("Redis: Failed to acknowledge element: ", err)
+	}
+}
+
+// restore pushes elements left in the processing list back to the
+// head of the list, in their original order.
+func (r *Redis) restore() error {
+	key, processing := r.Args["key"], r.Args["processingKey"]
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	n := 0
+	for {
+		_, err := redis.String(conn.Do("LMOVE", processing, key, "RIGHT", "LEFT"))
+		if err == redis.ErrNil {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	if n > 0 {
+		r.logger().Warnf("Redis: Restored %d unacknowledged elements to %s.", n, key)
+	}
+	return nil
+}
+
+// push sends `m` into `channel`, it returns false if the connector
+// was disconnected first.
+func (r *Redis) push(channel chan message.Message, m message.Message) bool {
+	select {
+	case channel <- m:
+		atomic.AddUint64(&r.stats.Received, 1)
+		return true
+	case <-r.done:
+		return false
+	}
+}
@@ -0,0 +1,135 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedis(t *testing.T, args map[string]string) (*Redis, *miniredis.Miniredis) {
+	srv, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Redis{URL: "redis://" + srv.Addr(), Args: args}
+	assert.NoError(t, r.Connect())
+	return r, srv
+}
+
+func receive(t *testing.T, channel chan message.Message) message.Message {
+	select {
+	case m := <-channel:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return message.Message{}
+	}
+}
+
+func TestRedis_Connect(t *testing.T) {
+	r := &Redis{Args: map[string]string{"mode": "stream"}}
+	assert.Error(t, r.Connect())
+	r = &Redis{Args: map[string]string{"mode": "list"}}
+	assert.Error(t, r.Connect())
+}
+
+func TestRedis_List(t *testing.T) {
+	r, srv := newTestRedis(t, map[string]string{"mode": "list", "key": "events"})
+	defer srv.Close()
+	defer r.Disconnect()
+
+	assert.Equal(t, "events:processing", r.Args["processingKey"])
+	assert.NoError(t, r.Write("a"))
+	assert.NoError(t, r.Write("b"))
+
+	messages, err := r.ReadMessages()
+	assert.NoError(t, err)
+	a := receive(t, messages)
+	b := receive(t, messages)
+	assert.Equal(t, "a", a.Body)
+	assert.Equal(t, "events", a.Metadata[MetaRedisKey])
+	assert.Equal(t, "b", b.Body)
+
+	// popped elements are kept until acknowledged
+	processing, _ := srv.List("events:processing")
+	assert.Equal(t, []string{"a", "b"}, processing)
+
+	a.Done(nil)
+	processing, _ = srv.List("events:processing")
+	assert.Equal(t, []string{"b"}, processing)
+
+	// failed elements are read again
+	b.Done(errors.New("write failed"))
+	b = receive(t, messages)
+	assert.Equal(t, "b", b.Body)
+	b.Done(nil)
+	processing, _ = srv.List("events:processing")
+	assert.Empty(t, processing)
+	assert.Equal(t, uint64(2), r.Stats().Sent)
+}
+
+func TestRedis_ListRestoresUnacknowledged(t *testing.T) {
+	r, srv := newTestRedis(t, map[string]string{"mode": "list", "key": "events"})
+	defer srv.Close()
+	defer r.Disconnect()
+
+	// left behind by a consumer that crashed
+	srv.RPush("events:processing", "a", "b")
+	srv.RPush("events", "c")
+
+	messages, err := r.ReadMessages()
+	assert.NoError(t, err)
+	for _, body := range []string{"a", "b", "c"} {
+		m := receive(t, messages)
+		assert.Equal(t, body, m.Body)
+		m.Done(nil)
+	}
+}
+
+func TestRedis_ListReconnectKeepsInFlight(t *testing.T) {
+	r, srv := newTestRedis(t, map[string]string{"mode": "list", "key": "events"})
+	defer srv.Close()
+	defer r.Disconnect()
+
+	assert.NoError(t, r.Write("a"))
+	messages, err := r.ReadMessages()
+	assert.NoError(t, err)
+	a := receive(t, messages)
+
+	// a transient error makes the reader reconnect while "a" is in flight
+	srv.SetError("LOADING")
+	assert.Eventually(t, func() bool { return r.Stats().Reconnects > 0 }, 5*time.Second, 10*time.Millisecond)
+	srv.SetError("")
+
+	assert.NoError(t, r.Write("b"))
+	b := receive(t, messages)
+	assert.Equal(t, "b", b.Body)
+	processing, _ := srv.List("events:processing")
+	assert.Equal(t, []string{"a", "b"}, processing)
+
+	a.Done(nil)
+	b.Done(nil)
+	processing, _ = srv.List("events:processing")
+	assert.Empty(t, processing)
+	list, _ := srv.List("events")
+	assert.Empty(t, list)
+}
+
+func TestRedis_PubSub(t *testing.T) {
+	r, srv := newTestRedis(t, map[string]string{"mode": "pubsub", "channel": "events"})
+	defer srv.Close()
+	defer r.Disconnect()
+
+	messages, err := r.ReadMessages()
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(srv.PubSubChannels("")) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, r.Write("a"))
+	m := receive(t, messages)
+	assert.Equal(t, "a", m.Body)
+	assert.Equal(t, "events", m.Metadata[MetaRedisChannel])
+}
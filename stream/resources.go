@@ -0,0 +1,35 @@
+package stream
+
+// Resource is infrastructure a connector expects to exist before it
+// connects, e.g. a Kinesis stream, an S3 bucket or a DynamoDB table.
+// Resources are listed (see `manifold resources`) so that platform
+// teams can generate Terraform or CloudFormation for the
+// prerequisites of their pipelines.
+//
+// Kind is the Terraform resource type when there is one (e.g.
+// "aws_kinesis_stream"), Settings hold the arguments the connector
+// relies on, named as the resource's arguments (e.g. "hash_key" of a
+// DynamoDB table).
+type Resource struct {
+	Kind     string            `json:"kind" yaml:"kind"`
+	Name     string            `json:"name" yaml:"name"`
+	Region   string            `json:"region,omitempty" yaml:"region,omitempty"`
+	Settings map[string]string `json:"settings,omitempty" yaml:"settings,omitempty"`
+}
+
+// Provisioned is an optional interface implemented by connectors
+// that need infrastructure created beforehand, Resources describes
+// it. Connectors creating what they use (e.g. Redis streams or
+// QuestDB tables) don't implement it.
+type Provisioned interface {
+	Resources() []Resource
+}
+
+// Resources returns the resources needed by `connector`, a source or
+// a destination: nil unless it implements Provisioned.
+func Resources(connector interface{}) []Resource {
+	if p, ok := connector.(Provisioned); ok {
+		return p.Resources()
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResources(t *testing.T) {
+	assert.Nil(t, Resources(&Stdio{}))
+
+	r := &Router{
+		Routes: []Route{
+			{Name: "metrics", Destination: &TimescaleDB{Table: "metrics", Config: &TimescaleDBConfig{Columns: []string{"device", "value"}}}},
+			{Name: "raw", Destination: &Stdio{}},
+		},
+		Default: &Window{Destination: &RabbitMQ{Args: map[string]string{"exchange": "events", "key": "raw"}}},
+	}
+	assert.Equal(t, []Resource{
+		{Kind: "timescaledb_hypertable", Name: "metrics", Settings: map[string]string{"time_column": "time", "columns": "device,value"}},
+		{Kind: "rabbitmq_exchange", Name: "events"},
+	}, Resources(r))
+
+	assert.Equal(t, []Resource{{Kind: "rabbitmq_queue", Name: "jobs"}}, Resources(&RabbitMQ{Args: map[string]string{"queue": "jobs"}}))
+}
@@ -0,0 +1,250 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/abstractpaper/manifold/transform/filter"
+)
+
+// ErrNoRoute is returned by Router for messages matching no route
+// when it has no default destination.
+var ErrNoRoute = errors.New("router: no route matches the message")
+
+// Router writes each message to the destination of its route: the
+// route named by Route if set, the first route whose When expression
+// (see filter.Filter) matches otherwise. Messages matching no route
+// are written to Default, or fail with ErrNoRoute if it isn't set.
+//
+// Routes must have distinct destinations, which the router connects
+// and disconnects. Asynchronous destinations are written to
+// asynchronously, the others before WriteAsync returns.
+//
+// Example (purchases and refunds to different S3 folders):
+//
+//	dest := &stream.Router{
+//	    Routes: []stream.Route{
+//	        {Name: "purchases", When: `payload.type == "purchase"`, Destination: purchases},
+//	        {Name: "refunds", When: `payload.type == "refund"`, Destination: refunds},
+//	    },
+//	    Default: others,
+//	}
+type Router struct {
+	Routes  []Route
+	Route   func(m message.Message) string // returns a route name
+	Default Destination
+	routes  map[string]*Route
+	logged
+}
+
+// Route is a named destination of a Router.
+type Route struct {
+	Name        string
+	When        string // expression, ignored if Router.Route is set
+	Destination Destination
+	expr        *filter.Expr
+}
+
+func (r *Router) Connect() (err error) {
+	r.routes = map[string]*Route{}
+	for i := range r.Routes {
+		route := &r.Routes[i]
+		if route.Name == "" || route.Destination == nil {
+			return fmt.Errorf("router: route #%d needs a name and a destination", i+1)
+		}
+		if r.routes[route.Name] != nil {
+			return fmt.Errorf("router: duplicate route %q", route.Name)
+		}
+		r.routes[route.Name] = route
+
+		if r.Route == nil {
+			route.expr, err = filter.Compile(route.When)
+			if err != nil {
+				return fmt.Errorf("router: route %q: %s", route.Name, err)
+			}
+		}
+	}
+
+	// disconnect the destinations connected so far on failure
+	for i, dest := range r.destinations() {
+		err = dest.Connect()
+		if err != nil {
+			for _, connected := range r.destinations()[:i] {
+				connected.Disconnect()
+			}
+			return
+		}
+	}
+	return
+}
+
+func (r *Router) Disconnect() (err error) {
+	for _, dest := range r.destinations() {
+		if derr := dest.Disconnect(); derr != nil {
+			err = derr
+		}
+	}
+	return
+}
+
+// SetClock sets `clock` on the destinations implementing Clocked.
+func (r *Router) SetClock(clock Clock) {
+	for _, dest := range r.destinations() {
+		if c, ok := dest.(Clocked); ok {
+			c.SetClock(clock)
+		}
+	}
+}
+
+// SetLogger sets `logger` on the router, and on the destinations
+// implementing Logged with a `route` field naming their route.
+func (r *Router) SetLogger(logger Logger) {
+	r.logged.SetLogger(logger)
+	for _, route := range r.Routes {
+		setLogger(route.Destination, logger.WithField("route", route.Name))
+	}
+	if r.Default != nil {
+		setLogger(r.Default, logger.WithField("route", "default"))
+	}
+}
+
+// Flush flushes the destinations implementing Flusher.
+func (r *Router) Flush() (err error) {
+	for _, dest := range r.destinations() {
+		if f, ok := dest.(Flusher); ok {
+			if ferr := f.Flush(); ferr != nil {
+				err = ferr
+			}
+		}
+	}
+	return
+}
+
+// Drain drains the destinations (see Pipeline.Drain).
+func (r *Router) Drain(ctx context.Context) (err error) {
+	for _, dest := range r.destinations() {
+		if derr := drain(ctx, dest); derr != nil {
+			err = derr
+		}
+	}
+	return
+}
+
+// Limits returns the smallest limits of the routes' destinations, as
+// messages are checked before they are routed.
+func (r *Router) Limits() (limits Limits) {
+	for _, dest := range r.destinations() {
+		size := DestinationLimits(dest).MaxMessageSize
+		if size > 0 && (limits.MaxMessageSize == 0 || size < limits.MaxMessageSize) {
+			limits.MaxMessageSize = size
+		}
+	}
+	return
+}
+
+// Resources returns the resources of the routes' destinations.
+func (r *Router) Resources() (resources []Resource) {
+	for _, dest := range r.destinations() {
+		resources = append(resources, Resources(dest)...)
+	}
+	return
+}
+
+// Capabilities returns the capabilities all the routes' destinations
+// have.
+func (r *Router) Capabilities() (c Capabilities) {
+	for i, dest := range r.destinations() {
+		if i == 0 {
+			c = ConnectorCapabilities(dest)
+			continue
+		}
+		c = intersect(c, ConnectorCapabilities(dest))
+	}
+	return
+}
+
+func (r *Router) Info() {
+	for _, route := range r.Routes {
+		r.logger().Infof("Router.Route %q: %s", route.Name, route.When)
+		route.Destination.Info()
+	}
+	if r.Default != nil {
+		r.logger().Info("Router.Default:")
+		r.Default.Info()
+	}
+}
+
+func (r *Router) Write(body string) error {
+	return r.WriteMessage(message.New(body))
+}
+
+// WriteMessage writes `m` to the destination of its route.
+func (r *Router) WriteMessage(m message.Message) error {
+	dest, err := r.route(m)
+	if err != nil {
+		return err
+	}
+	return writeMessage(dest, m)
+}
+
+// WriteAsync writes `m` to the destination of its route.
+func (r *Router) WriteAsync(m message.Message, done func(err error)) {
+	dest, err := r.route(m)
+	switch {
+	case err != nil:
+		done(err)
+	case buffered(dest):
+		dest.(AsyncDestination).WriteAsync(m, done)
+	default:
+		done(writeMessage(dest, m))
+	}
+}
+
+// Buffered reports whether a destination of the router buffers
+// writes.
+func (r *Router) Buffered() bool {
+	for _, dest := range r.destinations() {
+		if buffered(dest) {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the destination of `m`.
+func (r *Router) route(m message.Message) (Destination, error) {
+	if r.Route != nil {
+		if route, ok := r.routes[r.Route(m)]; ok {
+			return route.Destination, nil
+		}
+	} else {
+		for _, route := range r.Routes {
+			match, err := route.expr.Match(m)
+			if err != nil {
+				return nil, fmt.Errorf("router: route %q: %s", route.Name, err)
+			}
+			if match {
+				return route.Destination, nil
+			}
+		}
+	}
+
+	if r.Default == nil {
+		return nil, ErrNoRoute
+	}
+	return r.Default, nil
+}
+
+// destinations returns the destinations of the routes, then Default.
+func (r *Router) destinations() []Destination {
+	var dests []Destination
+	for _, route := range r.Routes {
+		dests = append(dests, route.Destination)
+	}
+	if r.Default != nil {
+		dests = append(dests, r.Default)
+	}
+	return dests
+}
@@ -0,0 +1,91 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// queue is an asynchronous destination that completes writes when
+// flushed.
+type queue struct {
+	memory
+	pending []func(error)
+}
+
+func (q *queue) WriteAsync(m message.Message, done func(err error)) {
+	q.messages = append(q.messages, m.Body)
+	q.pending = append(q.pending, done)
+}
+
+func (q *queue) flush() {
+	for _, done := range q.pending {
+		done(nil)
+	}
+	q.pending = nil
+}
+
+func TestRouter(t *testing.T) {
+	purchases, refunds, others := &memory{}, &memory{}, &memory{}
+	r := &Router{
+		Routes: []Route{
+			{Name: "purchases", When: `payload.type == "purchase"`, Destination: purchases},
+			{Name: "refunds", When: `payload.type == "refund" || metadata.kind == "refund"`, Destination: refunds},
+		},
+		Default: others,
+	}
+	assert.NoError(t, r.Connect())
+	defer r.Disconnect()
+	assert.False(t, r.Buffered())
+
+	refund := message.New(`{"id":3}`)
+	refund.Metadata["kind"] = "refund"
+	for _, m := range []message.Message{
+		message.New(`{"id":1,"type":"purchase"}`),
+		message.New(`{"id":2,"type":"refund"}`),
+		refund,
+		message.New(`{"id":4,"type":"signup"}`),
+	} {
+		assert.NoError(t, r.WriteMessage(m))
+	}
+	assert.Error(t, r.Write("not json"))
+
+	assert.Equal(t, []string{`{"id":1,"type":"purchase"}`}, purchases.messages)
+	assert.Equal(t, []string{`{"id":2,"type":"refund"}`, `{"id":3}`}, refunds.messages)
+	assert.Equal(t, []string{`{"id":4,"type":"signup"}`}, others.messages)
+}
+
+func TestRouter_RouteFunc(t *testing.T) {
+	a, b := &memory{}, &queue{}
+	r := &Router{
+		Routes: []Route{{Name: "a", Destination: a}, {Name: "b", Destination: b}},
+		Route:  func(m message.Message) string { return m.Metadata["route"] },
+	}
+	assert.NoError(t, r.Connect())
+	assert.True(t, r.Buffered())
+
+	var acks []error
+	done := func(err error) { acks = append(acks, err) }
+	for _, route := range []string{"a", "b", "c"} {
+		m := message.New(route)
+		m.Metadata["route"] = route
+		r.WriteAsync(m, done)
+	}
+	// "a" is written right away, "c" has no route
+	assert.Equal(t, []error{nil, ErrNoRoute}, acks)
+	b.flush()
+	assert.Equal(t, []error{nil, ErrNoRoute, nil}, acks)
+	assert.Equal(t, []string{"a"}, a.messages)
+	assert.Equal(t, []string{"b"}, b.messages)
+}
+
+func TestRouter_Errors(t *testing.T) {
+	for _, r := range []*Router{
+		{Routes: []Route{{Name: "a", When: "payload.a ==", Destination: &memory{}}}},
+		{Routes: []Route{{Name: "a", When: "true"}}},
+		{Routes: []Route{{Name: "a", When: "true", Destination: &memory{}}, {Name: "a", When: "true", Destination: &memory{}}}},
+	} {
+		assert.Error(t, r.Connect())
+	}
+}
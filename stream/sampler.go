@@ -0,0 +1,160 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// Stages of a pipeline a Sampler logs messages at.
+const (
+	SampleSource      = "source"      // as read
+	SampleTransform   = "transform"   // as transformed
+	SampleDestination = "destination" // as written
+)
+
+// redacted replaces redacted values.
+const redacted = "[REDACTED]"
+
+// Sampler logs the payload of every Every-th message at the Stages
+// of a pipeline, to debug incidents without printf transforms.
+// Payloads are logged after redaction: values of the Redact JSON
+// fields (dot-separated paths, e.g. "user.email") and matches of the
+// RedactPatterns regular expressions are replaced with [REDACTED].
+// They are then truncated to MaxLength bytes.
+//
+// Sampling is off unless Enabled is set, and can be turned on and
+// off at runtime with SetEnabled (e.g. from the admin API).
+type Sampler struct {
+	Every          int      // defaults to 100
+	Stages         []string // defaults to every stage
+	MaxLength      int      // bytes, defaults to 512
+	Redact         []string
+	RedactPatterns []string
+	Enabled        bool
+	once           sync.Once
+	err            error
+	on             int32
+	counters       map[string]*uint64
+	patterns       []*regexp.Regexp
+}
+
+// Compile checks the sampler's settings, it is called by pipelines.
+func (s *Sampler) Compile() error {
+	s.once.Do(func() {
+		if s.Every < 1 {
+			s.Every = 100
+		}
+		if s.MaxLength < 1 {
+			s.MaxLength = 512
+		}
+		if len(s.Stages) == 0 {
+			s.Stages = []string{SampleSource, SampleTransform, SampleDestination}
+		}
+		s.counters = map[string]*uint64{}
+		for _, stage := range s.Stages {
+			switch stage {
+			case SampleSource, SampleTransform, SampleDestination:
+				s.counters[stage] = new(uint64)
+			default:
+				s.err = fmt.Errorf("sampler: unknown stage %q", stage)
+				return
+			}
+		}
+		for _, pattern := range s.RedactPatterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				s.err = fmt.Errorf("sampler: %s", err)
+				return
+			}
+			s.patterns = append(s.patterns, re)
+		}
+		if s.Enabled {
+			s.on = 1
+		}
+	})
+	return s.err
+}
+
+// SetEnabled turns sampling on or off.
+func (s *Sampler) SetEnabled(enabled bool) {
+	s.Compile()
+	var on int32
+	if enabled {
+		on = 1
+	}
+	atomic.StoreInt32(&s.on, on)
+}
+
+// IsEnabled reports whether sampling is on.
+func (s *Sampler) IsEnabled() bool {
+	s.Compile()
+	return atomic.LoadInt32(&s.on) == 1
+}
+
+// sample logs `m` if it is the Every-th message of `stage`.
+func (s *Sampler) sample(logger Logger, stage string, m message.Message) {
+	if s == nil || s.err != nil || atomic.LoadInt32(&s.on) == 0 {
+		return
+	}
+	counter := s.counters[stage]
+	if counter == nil {
+		return
+	}
+	n := atomic.AddUint64(counter, 1)
+	if (n-1)%uint64(s.Every) != 0 {
+		return
+	}
+
+	logger.WithFields(Fields{
+		"stage":    stage,
+		"n":        n,
+		"metadata": m.Metadata,
+	}).Info(s.redact(m.Body))
+}
+
+// redact returns `body` redacted and truncated.
+func (s *Sampler) redact(body string) string {
+	if len(s.Redact) > 0 {
+		var v interface{}
+		if json.Unmarshal([]byte(body), &v) == nil {
+			for _, path := range s.Redact {
+				redactPath(v, strings.Split(path, "."))
+			}
+			data, _ := json.Marshal(v)
+			body = string(data)
+		}
+	}
+	for _, re := range s.patterns {
+		body = re.ReplaceAllString(body, redacted)
+	}
+	if len(body) > s.MaxLength {
+		body = fmt.Sprintf("%s... (%d bytes)", body[:s.MaxLength], len(body))
+	}
+	return body
+}
+
+// redactPath redacts the value at `path` in `v`, in every element of
+// the arrays on the way.
+func redactPath(v interface{}, path []string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if _, ok := v[path[0]]; !ok {
+			return
+		}
+		if len(path) == 1 {
+			v[path[0]] = redacted
+			return
+		}
+		redactPath(v[path[0]], path[1:])
+	case []interface{}:
+		for _, e := range v {
+			redactPath(e, path)
+		}
+	}
+}
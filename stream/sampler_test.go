@@ -0,0 +1,55 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampler_Redact(t *testing.T) {
+	s := &Sampler{
+		Redact:         []string{"user.email", "items.card"},
+		RedactPatterns: []string{`\d{4}-\d{4}`},
+		MaxLength:      200,
+	}
+	assert.NoError(t, s.Compile())
+
+	body := `{"user": {"email": "a@b.c", "name": "A"}, "items": [{"card": "x"}, {"id": 1}], "phone": "5555-1234"}`
+	assert.JSONEq(t, `{"user": {"email": "[REDACTED]", "name": "A"}, "items": [{"card": "[REDACTED]"}, {"id": 1}], "phone": "[REDACTED]"}`, s.redact(body))
+	assert.Equal(t, "not json [REDACTED]", s.redact("not json 5555-1234"))
+
+	long := s.redact(`"` + string(make([]byte, 300)) + `"`)
+	assert.Contains(t, long, "... (302 bytes)")
+
+	assert.Error(t, (&Sampler{Stages: []string{"sink"}}).Compile())
+	assert.Error(t, (&Sampler{RedactPatterns: []string{"("}}).Compile())
+}
+
+func TestSampler_Every(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	s := &Sampler{Every: 2, Stages: []string{SampleSource}}
+	for i := 0; i < 4; i++ {
+		s.sample(DefaultLogger, SampleSource, message.New("m"))
+	}
+	assert.Empty(t, hook.AllEntries(), "disabled")
+
+	s.SetEnabled(true)
+	assert.True(t, s.IsEnabled())
+	for _, body := range []string{"1", "2", "3"} {
+		s.sample(DefaultLogger, SampleSource, message.New(body))
+		s.sample(DefaultLogger, SampleDestination, message.New(body))
+	}
+	var logged []string
+	for _, e := range hook.AllEntries() {
+		if e.Data["stage"] == SampleSource {
+			logged = append(logged, e.Message)
+		}
+	}
+	assert.Equal(t, []string{"1", "3"}, logged)
+}
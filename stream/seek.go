@@ -0,0 +1,71 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PositionType is the kind of a Position.
+type PositionType int
+
+const (
+	// Earliest starts from the oldest retained message (e.g. Kinesis
+	// TRIM_HORIZON).
+	Earliest PositionType = iota + 1
+	// Latest starts from new messages.
+	Latest
+	// AtTimestamp starts from the first message at or after
+	// Position.Timestamp.
+	AtTimestamp
+	// AfterOffsets resumes after Position.Offsets.
+	AfterOffsets
+)
+
+// Position is where a SeekableSource starts reading, e.g. to
+// backfill a destination.
+type Position struct {
+	Type      PositionType
+	Timestamp time.Time
+	// Offsets are the last offsets read per partition, e.g. Kinesis
+	// sequence numbers per shard id, as found in message metadata.
+	Offsets map[string]string
+}
+
+func (p Position) String() string {
+	switch p.Type {
+	case Earliest:
+		return "earliest"
+	case Latest:
+		return "latest"
+	case AtTimestamp:
+		return p.Timestamp.Format(time.RFC3339Nano)
+	case AfterOffsets:
+		return fmt.Sprintf("after offsets %v", p.Offsets)
+	}
+	return fmt.Sprintf("Position(%d)", p.Type)
+}
+
+// SeekableSource is an optional interface implemented by sources
+// whose starting position can be set. Seek is called after Connect
+// and before reading, it overrides the source's own starting
+// position for partitions without a checkpoint: checkpointed ones
+// resume from their checkpoint, so that restarts and takeovers don't
+// read them again.
+type SeekableSource interface {
+	Source
+	Seek(pos Position) error
+}
+
+// ErrNotSeekable is returned when seeking a source that doesn't
+// implement SeekableSource.
+var ErrNotSeekable = errors.New("source doesn't support seeking")
+
+// seek seeks `src` to `pos`.
+func seek(src Source, pos Position) error {
+	ss, ok := src.(SeekableSource)
+	if !ok {
+		return ErrNotSeekable
+	}
+	return ss.Seek(pos)
+}
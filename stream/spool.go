@@ -0,0 +1,667 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// errSpoolFull is returned for writes beyond SpoolOptions.MaxSize.
+var errSpoolFull = errors.New("Spool: the WAL is full")
+
+// SpoolOptions configure a spooling destination (see Spool).
+type SpoolOptions struct {
+	// Path is the directory of the WAL, which must not be shared
+	// with other spools.
+	Path string
+	// SegmentSize is the size in bytes of WAL segment files, which
+	// are deleted once forwarded. Defaults to 64 MiB.
+	SegmentSize int64
+	// MaxSize bounds the size of the WAL in bytes, writes fail
+	// beyond it. Unbounded if zero.
+	MaxSize int64
+	// Sync syncs segments to disk on every write, so that they
+	// survive a crash of the host, not only of the process.
+	Sync bool
+	// RetryDelay is the delay before retrying failed writes to the
+	// destination, doubled up to MaxRetryDelay. Defaults to 1s and
+	// 1m.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// MaxInFlight is the number of messages forwarded at once to a
+	// destination that buffers them (see AsyncDestination). Defaults
+	// to 1000.
+	MaxInFlight int
+	// MaxAttempts is the number of times a message is written to the
+	// destination before it is quarantined to DLQ, or dropped
+	// without one. Messages are retried until they are written if
+	// zero.
+	MaxAttempts int
+	// DLQ is where messages are quarantined (see MaxAttempts), e.g.
+	// the DLQ of the pipeline, which connects it.
+	DLQ Destination
+}
+
+// SpoolStats holds the counters of a spool.
+type SpoolStats struct {
+	Spooled     uint64 `json:"spooled"`     // messages written to the WAL
+	Forwarded   uint64 `json:"forwarded"`   // messages written to the destination
+	Retries     uint64 `json:"retries"`     // failed writes to the destination
+	Quarantined uint64 `json:"quarantined"` // messages written to the DLQ
+	Dropped     uint64 `json:"dropped"`     // messages dropped after MaxAttempts
+	Pending     int64  `json:"pending"`     // bytes of the WAL not forwarded yet
+}
+
+// SpoolDestination writes messages to a local write-ahead log before
+// forwarding them to Destination (see Spool).
+type SpoolDestination struct {
+	Destination Destination
+	Options     SpoolOptions
+	mu          sync.Mutex
+	segment     *os.File // active segment, appended to
+	segmentID   uint64
+	segmentSize int64
+	cursor      spoolCursor // next record to forward
+	connected   bool        // Destination is connected
+	wake        chan struct{}
+	done        chan struct{}
+	wg          sync.WaitGroup
+	stats       SpoolStats
+	clocked
+	logged
+}
+
+// Spool returns a destination writing messages to a write-ahead log
+// (WAL) in `opts.Path` and forwarding them to `dest` in the
+// background, so that messages are acknowledged once they are on
+// local disk and survive outages of `dest` and restarts of the
+// process.
+//
+// Messages are forwarded in order. Failed writes are retried with
+// backoff (see SpoolOptions.RetryDelay) and block the messages after
+// them, which accumulate in the WAL, up to SpoolOptions.MaxSize,
+// until `dest` recovers; `dest` itself is connected in the background
+// and may be down when the spool connects. The position of the next
+// message to forward is kept in the WAL, which is replayed from it on
+// Connect.
+//
+// Disconnect forwards the messages spooled so far, unless `dest` is
+// failing, in which case they are left in the WAL for the next start.
+func Spool(dest Destination, opts SpoolOptions) *SpoolDestination {
+	return &SpoolDestination{Destination: dest, Options: opts}
+}
+
+// WAL segments are files named <id>.wal of frames (see appendFrame):
+//
+//	'b' <length> <body>
+//	'm' <length> <JSON of spoolRecord>
+//
+// the latter for messages with metadata. The cursor file holds the
+// position of the next record to forward.
+const (
+	spoolBody    = 'b'
+	spoolMessage = 'm'
+
+	spoolSuffix     = ".wal"
+	spoolCursorFile = "cursor"
+)
+
+type spoolRecord struct {
+	Body     string           `json:"body"`
+	Metadata message.Metadata `json:"metadata,omitempty"`
+}
+
+type spoolCursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// spooled is a message read from the WAL, with its failed attempts
+// (see recordAttempt).
+type spooled struct {
+	m message.Message
+}
+
+func (s *SpoolDestination) Connect() (err error) {
+	if s.Options.Path == "" {
+		return errors.New("Spool: path must be configured")
+	}
+	if s.Options.SegmentSize < 1 {
+		s.Options.SegmentSize = 64 << 20
+	}
+	if s.Options.RetryDelay <= 0 {
+		s.Options.RetryDelay = time.Second
+	}
+	if s.Options.MaxRetryDelay < s.Options.RetryDelay {
+		s.Options.MaxRetryDelay = time.Minute
+		if s.Options.MaxRetryDelay < s.Options.RetryDelay {
+			s.Options.MaxRetryDelay = s.Options.RetryDelay
+		}
+	}
+	if s.Options.MaxInFlight < 1 {
+		s.Options.MaxInFlight = 1000
+	}
+
+	err = os.MkdirAll(s.Options.Path, 0755)
+	if err != nil {
+		return
+	}
+	ids, err := s.segments()
+	if err != nil {
+		return
+	}
+	var pending int64
+	for _, id := range ids {
+		info, err := os.Stat(s.segmentPath(id))
+		if err != nil {
+			return err
+		}
+		pending += info.Size()
+	}
+
+	s.segmentID = 1
+	if len(ids) > 0 {
+		s.segmentID = ids[len(ids)-1] + 1
+	}
+	s.cursor, err = s.readCursor()
+	if err != nil {
+		return
+	}
+	switch {
+	case len(ids) == 0:
+		s.cursor = spoolCursor{Segment: s.segmentID}
+	case s.cursor.Segment < ids[0] || s.cursor.Segment >= s.segmentID:
+		s.cursor = spoolCursor{Segment: ids[0]}
+	default:
+		// forwarded bytes of the first segment
+		pending -= s.cursor.Offset
+		s.logger().Infof("Replaying %d WAL segments", len(ids))
+	}
+	atomic.StoreInt64(&s.stats.Pending, pending)
+	err = s.openSegment()
+	if err != nil {
+		return
+	}
+
+	s.wake = make(chan struct{}, 1)
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go s.forward()
+	return
+}
+
+// Disconnect forwards the messages spooled so far, unless Destination
+// is failing, and disconnects it.
+func (s *SpoolDestination) Disconnect() (err error) {
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+		s.done = nil
+	}
+
+	s.mu.Lock()
+	if s.segment != nil {
+		err = s.segment.Close()
+		s.segment = nil
+	}
+	s.mu.Unlock()
+
+	if s.connected {
+		s.connected = false
+		if derr := s.Destination.Disconnect(); derr != nil {
+			err = derr
+		}
+	}
+	return
+}
+
+func (s *SpoolDestination) Info() {
+	s.logger().Infof("Spooling to %s", s.Options.Path)
+	s.Destination.Info()
+}
+
+func (s *SpoolDestination) Write(body string) error {
+	return s.WriteMessage(message.New(body))
+}
+
+// WriteMessage appends `m` to the WAL, it returns once `m` is written
+// to disk (synced with Options.Sync).
+func (s *SpoolDestination) WriteMessage(m message.Message) (err error) {
+	var frame []byte
+	if len(m.Metadata) == 0 {
+		frame = appendFrame(nil, spoolBody, []byte(m.Body))
+	} else {
+		record, err := json.Marshal(spoolRecord{Body: m.Body, Metadata: m.Metadata})
+		if err != nil {
+			return err
+		}
+		frame = appendFrame(nil, spoolMessage, record)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.segment == nil {
+		return errors.New("Spool: not connected")
+	}
+	size := int64(len(frame))
+	if s.Options.MaxSize > 0 && atomic.LoadInt64(&s.stats.Pending)+size > s.Options.MaxSize {
+		return errSpoolFull
+	}
+	_, err = s.segment.Write(frame)
+	if err == nil && s.Options.Sync {
+		err = s.segment.Sync()
+	}
+	if err != nil {
+		return
+	}
+	s.segmentSize += size
+	atomic.AddInt64(&s.stats.Pending, size)
+	atomic.AddUint64(&s.stats.Spooled, 1)
+	if s.segmentSize >= s.Options.SegmentSize {
+		err = s.segment.Close()
+		if err != nil {
+			return
+		}
+		s.segmentID++
+		err = s.openSegment()
+		if err != nil {
+			return
+		}
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return
+}
+
+// Flush flushes Destination if it buffers writes, messages still in
+// the WAL are forwarded in the background.
+func (s *SpoolDestination) Flush() error {
+	if f, ok := s.Destination.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Drain waits for the messages of the WAL to be forwarded, and drains
+// Destination (see Pipeline.Drain).
+func (s *SpoolDestination) Drain(ctx context.Context) error {
+	ticker := s.clock().NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.stats.Pending) > 0 {
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return fmt.Errorf("Spool: %d bytes not forwarded: %w", atomic.LoadInt64(&s.stats.Pending), ctx.Err())
+		}
+	}
+	return drain(ctx, s.Destination)
+}
+
+// Stats returns the counters of the spool.
+func (s *SpoolDestination) Stats() SpoolStats {
+	return SpoolStats{
+		Spooled:     atomic.LoadUint64(&s.stats.Spooled),
+		Forwarded:   atomic.LoadUint64(&s.stats.Forwarded),
+		Retries:     atomic.LoadUint64(&s.stats.Retries),
+		Quarantined: atomic.LoadUint64(&s.stats.Quarantined),
+		Dropped:     atomic.LoadUint64(&s.stats.Dropped),
+		Pending:     atomic.LoadInt64(&s.stats.Pending),
+	}
+}
+
+// SetClock sets the clock of the spool and of Destination.
+func (s *SpoolDestination) SetClock(clock Clock) {
+	s.clocked.SetClock(clock)
+	if c, ok := s.Destination.(Clocked); ok {
+		c.SetClock(clock)
+	}
+}
+
+// SetLogger sets the logger of the spool and of Destination.
+func (s *SpoolDestination) SetLogger(logger Logger) {
+	s.logged.SetLogger(logger)
+	setLogger(s.Destination, logger)
+}
+
+// Limits returns the limits of Destination.
+func (s *SpoolDestination) Limits() Limits {
+	return DestinationLimits(s.Destination)
+}
+
+// Resources returns the resources of Destination.
+func (s *SpoolDestination) Resources() []Resource {
+	return Resources(s.Destination)
+}
+
+// Capabilities of a spool: writes are confirmed once on local disk,
+// and forwarded in order unless Destination buffers them.
+func (s *SpoolDestination) Capabilities() Capabilities {
+	c := ConnectorCapabilities(s.Destination)
+	return Capabilities{
+		ConfirmedWrites: true,
+		Batching:        c.Batching,
+		Ordering:        c.Ordering && !buffered(s.Destination),
+		Schemas:         c.Schemas,
+		Idempotent:      c.Idempotent,
+	}
+}
+
+// forward writes the messages of the WAL to Destination until the
+// spool disconnects.
+func (s *SpoolDestination) forward() {
+	defer s.wg.Done()
+	var delay time.Duration
+	for {
+		if !s.connected {
+			err := s.Destination.Connect()
+			if err != nil {
+				s.logger().Warn("Spool: couldn't connect the destination: ", err)
+				if !s.backoff(&delay) {
+					return
+				}
+				continue
+			}
+			s.connected = true
+			delay = 0
+		}
+
+		batch, next, last, err := s.read()
+		if err != nil {
+			s.logger().WithField("segment", s.cursor.Segment).Error("Spool: couldn't read the WAL: ", err)
+			if !s.backoff(&delay) {
+				return
+			}
+			continue
+		}
+		if len(batch) > 0 && !s.deliver(batch) {
+			return
+		}
+		if last {
+			err = s.removeSegment(next)
+		} else if next != s.cursor {
+			err = s.writeCursor(next)
+		}
+		if err != nil {
+			s.logger().Error("Spool: couldn't commit the WAL position: ", err)
+		}
+		if len(batch) > 0 || last {
+			continue
+		}
+
+		// nothing left to forward
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// read returns up to Options.MaxInFlight messages from the cursor,
+// the position after them, and whether they are the last of a
+// segment that isn't written to anymore.
+func (s *SpoolDestination) read() (batch []*spooled, next spoolCursor, last bool, err error) {
+	next = s.cursor
+	s.mu.Lock()
+	active := s.segmentID
+	s.mu.Unlock()
+
+	f, err := os.Open(s.segmentPath(next.Segment))
+	if os.IsNotExist(err) && next.Segment < active {
+		return nil, next, true, nil
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, err = f.Seek(next.Offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(f)
+	for len(batch) < s.Options.MaxInFlight {
+		kind, payload, err := readFrame(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			// a record is being written to the active segment,
+			// or was cut by a crash
+			if next.Segment < active {
+				s.logger().WithField("segment", next.Segment).Warn("Spool: skipping a partial record at the end of a segment")
+				break
+			}
+			return batch, next, false, nil
+		}
+		if err != nil {
+			return batch, next, false, err
+		}
+
+		m := message.New(string(payload))
+		switch kind {
+		case spoolBody:
+		case spoolMessage:
+			var r spoolRecord
+			err = json.Unmarshal(payload, &r)
+			if err != nil {
+				return batch, next, false, err
+			}
+			m = message.Message{Body: r.Body, Metadata: r.Metadata}
+		default:
+			return batch, next, false, fmt.Errorf("unknown WAL frame %q", kind)
+		}
+		batch = append(batch, &spooled{m: m})
+		next.Offset += int64(5 + len(payload))
+	}
+	// the segment was complete before it was read
+	last = len(batch) < s.Options.MaxInFlight && next.Segment < active
+	return
+}
+
+// deliver writes `batch` to Destination, retrying failed writes until
+// they succeed or exceed Options.MaxAttempts. It returns false if the
+// spool disconnected while retrying.
+func (s *SpoolDestination) deliver(batch []*spooled) bool {
+	var delay time.Duration
+	pending := batch
+	for {
+		var failed []*spooled
+		if buffered(s.Destination) {
+			results := make([]<-chan error, len(pending))
+			for i, r := range pending {
+				results[i] = startWrite(s.Destination, r.m)
+			}
+			for i, result := range results {
+				if !s.written(pending[i], <-result) {
+					failed = append(failed, pending[i])
+				}
+			}
+		} else {
+			// the messages after a failed write wait for it, in
+			// order
+			for i, r := range pending {
+				if !s.written(r, writeMessage(s.Destination, r.m)) {
+					failed = pending[i:]
+					break
+				}
+			}
+		}
+		if len(failed) == 0 {
+			return true
+		}
+		pending = failed
+		if !s.backoff(&delay) {
+			return false
+		}
+	}
+}
+
+// written handles the result of writing `r`, and returns whether it
+// is done with: written, quarantined or dropped.
+func (s *SpoolDestination) written(r *spooled, err error) bool {
+	if err == nil {
+		atomic.AddUint64(&s.stats.Forwarded, 1)
+		return true
+	}
+	atomic.AddUint64(&s.stats.Retries, 1)
+	r.m = recordAttempt(r.m, err)
+	if s.Options.MaxAttempts < 1 || attempts(r.m) < s.Options.MaxAttempts {
+		s.logger().Warn("Spool: couldn't write to the destination: ", err)
+		return false
+	}
+
+	if s.Options.DLQ == nil {
+		s.logger().Errorf("Spool: dropping a message after %d attempts: %s", attempts(r.m), err)
+		atomic.AddUint64(&s.stats.Dropped, 1)
+		return true
+	}
+	qerr := quarantine(s.Options.DLQ, r.m)
+	if qerr != nil {
+		s.logger().Error("Spool: couldn't quarantine a message: ", qerr)
+		return false
+	}
+	atomic.AddUint64(&s.stats.Quarantined, 1)
+	return true
+}
+
+// backoff waits before retrying, doubling `delay` up to
+// Options.MaxRetryDelay. It returns false if the spool disconnected
+// meanwhile.
+func (s *SpoolDestination) backoff(delay *time.Duration) bool {
+	switch {
+	case *delay == 0:
+		*delay = s.Options.RetryDelay
+	case *delay < s.Options.MaxRetryDelay:
+		*delay *= 2
+		if *delay > s.Options.MaxRetryDelay {
+			*delay = s.Options.MaxRetryDelay
+		}
+	}
+	t := s.clock().NewTimer(*delay)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// segments returns the ids of the WAL segments, in order.
+func (s *SpoolDestination) segments() (ids []uint64, err error) {
+	files, err := ioutil.ReadDir(s.Options.Path)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return
+}
+
+func (s *SpoolDestination) segmentPath(id uint64) string {
+	return filepath.Join(s.Options.Path, fmt.Sprintf("%016d%s", id, spoolSuffix))
+}
+
+// openSegment opens the active segment, with s.mu held or before the
+// spool is connected.
+func (s *SpoolDestination) openSegment() (err error) {
+	s.segment, err = os.OpenFile(s.segmentPath(s.segmentID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	info, err := s.segment.Stat()
+	if err != nil {
+		return
+	}
+	s.segmentSize = info.Size()
+	return
+}
+
+// removeSegment deletes the forwarded segment of `c` and moves the
+// cursor to the next one.
+func (s *SpoolDestination) removeSegment(c spoolCursor) error {
+	path := s.segmentPath(c.Segment)
+	var size int64
+	info, err := os.Stat(path)
+	if err == nil {
+		size = info.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	// bytes before the cursor are no longer pending already
+	if s.cursor.Segment == c.Segment {
+		size -= s.cursor.Offset
+	}
+
+	err = s.writeCursor(spoolCursor{Segment: c.Segment + 1})
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.stats.Pending, -size)
+	if info == nil {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+func (s *SpoolDestination) readCursor() (c spoolCursor, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.Options.Path, spoolCursorFile))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &c)
+	return
+}
+
+// writeCursor moves the cursor to `c`, replacing the cursor file.
+func (s *SpoolDestination) writeCursor(c spoolCursor) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.Options.Path, spoolCursorFile)
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+	// forwarded bytes of the segment are no longer pending
+	if c.Segment == s.cursor.Segment {
+		atomic.AddInt64(&s.stats.Pending, s.cursor.Offset-c.Offset)
+	}
+	s.cursor = c
+	return nil
+}
@@ -0,0 +1,101 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder is a destination keeping the metadata of its writes.
+type recorder struct {
+	memory
+	metadata []message.Metadata
+}
+
+func (r *recorder) WriteMessage(m message.Message) error {
+	err := r.memory.Write(m.Body)
+	if err == nil {
+		r.metadata = append(r.metadata, m.Metadata)
+	}
+	return err
+}
+
+func TestSpool_Outage(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	dest := &recorder{memory: memory{fail: 2}}
+	s := Spool(dest, SpoolOptions{Path: t.TempDir(), SegmentSize: 20, RetryDelay: time.Second})
+	s.SetClock(clock)
+	assert.NoError(t, s.Connect())
+
+	assert.NoError(t, s.Write("a"))
+	assert.NoError(t, s.Write("b"))
+	assert.NoError(t, s.WriteMessage(message.Message{Body: "c", Metadata: message.Metadata{"shard": "1"}}))
+	assert.Equal(t, uint64(3), s.Stats().Spooled)
+
+	// writes are retried until the destination recovers
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Minute)
+		return s.Stats().Forwarded == 3
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, s.Disconnect())
+
+	assert.Equal(t, []string{"a", "b", "c"}, dest.messages)
+	assert.Equal(t, "1", dest.metadata[2].Get("shard"))
+	stats := s.Stats()
+	assert.Equal(t, uint64(2), stats.Retries)
+	assert.Equal(t, int64(0), stats.Pending)
+}
+
+func TestSpool_Replay(t *testing.T) {
+	dir := t.TempDir()
+	clock := NewFakeClock(time.Unix(0, 0))
+
+	// forwarded messages aren't replayed
+	s := Spool(&memory{}, SpoolOptions{Path: dir, SegmentSize: 20})
+	assert.NoError(t, s.Connect())
+	assert.NoError(t, s.Write("a"))
+	assert.NoError(t, s.Disconnect())
+
+	// messages are left in the WAL while the destination fails
+	s = Spool(&memory{fail: 1000}, SpoolOptions{Path: dir, SegmentSize: 20})
+	s.SetClock(clock)
+	assert.NoError(t, s.Connect())
+	for _, body := range []string{"b", "c", "d"} {
+		assert.NoError(t, s.Write(body))
+	}
+	assert.NoError(t, s.Disconnect())
+	assert.NotZero(t, s.Stats().Pending)
+
+	dest := &memory{}
+	s = Spool(dest, SpoolOptions{Path: dir, SegmentSize: 20})
+	assert.NoError(t, s.Connect())
+	assert.NoError(t, s.Write("e"))
+	assert.NoError(t, s.Disconnect())
+	assert.Equal(t, []string{"b", "c", "d", "e"}, dest.messages)
+	assert.Equal(t, int64(0), s.Stats().Pending)
+}
+
+func TestSpool_Limits(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	dlq := &memory{}
+	s := Spool(&memory{fail: 1000}, SpoolOptions{Path: t.TempDir(), MaxSize: 20, MaxAttempts: 2, DLQ: dlq})
+	s.SetClock(clock)
+	assert.NoError(t, s.Connect())
+
+	assert.NoError(t, s.Write("poison"))
+	assert.Equal(t, errSpoolFull, s.Write("too much for the WAL"))
+
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Minute)
+		return s.Stats().Quarantined == 1
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, s.Disconnect())
+	if assert.Len(t, dlq.messages, 1) {
+		assert.Contains(t, dlq.messages[0], `"attempts":2`)
+	}
+
+	// messages forwarded to a buffering destination aren't ordered
+	assert.Equal(t, Capabilities{ConfirmedWrites: true}, Spool(&orderedQueue{}, SpoolOptions{}).Capabilities())
+}
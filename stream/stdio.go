@@ -1,40 +1,235 @@
 package stream
 
 import (
-	"strings"
-	"os"
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
 )
 
-type Stdio struct{}
+// Stdio reads messages from stdin and writes them to stdout (or
+// stderr), so that manifold can be used in Unix pipelines.
+//
+// Config.Framing delimits messages, in both directions:
+//
+//	newline: one message per line (default). Empty lines are skipped.
+//	length: each message is prefixed with its length in bytes, a
+//	4-byte big-endian unsigned integer, so that messages can contain
+//	newlines.
+//
+// Config.Format is the output of the destination:
+//
+//	raw: the message body (default).
+//	json: a JSON object with the time of the write, the message
+//	metadata and its body (embedded as JSON if it is valid JSON),
+//	e.g. {"timestamp":"...","metadata":{...},"body":{...}}.
+//	pretty: the body indented if it is JSON, raw otherwise.
+//
+// The source closes its channel at the end of stdin, which ends the
+// pipeline once the messages read are delivered.
+type Stdio struct {
+	Config *StdioConfig
+	in     io.Reader // defaults to os.Stdin
+	out    io.Writer // defaults to os.Stdout, or os.Stderr
+	mu     sync.Mutex
+	done   chan bool
+	clocked
+	logged
+}
+
+// StdioConfig configures framing and output.
+type StdioConfig struct {
+	Framing        string // "newline" or "length"
+	Format         string // "raw", "json" or "pretty"
+	Stderr         bool   // write to stderr instead of stdout
+	MaxMessageSize int    // KB, length framing, defaults to 1024
+}
+
+const (
+	stdioFramingNewline = "newline"
+	stdioFramingLength  = "length"
+	stdioFormatRaw      = "raw"
+	stdioFormatJSON     = "json"
+	stdioFormatPretty   = "pretty"
+)
+
+// stdioEnvelope is a message written in the json format.
+type stdioEnvelope struct {
+	Timestamp string           `json:"timestamp"`
+	Metadata  message.Metadata `json:"metadata"`
+	Body      interface{}      `json:"body"`
+}
 
 func (s *Stdio) Connect() (err error) {
+	if s.Config == nil {
+		s.Config = &StdioConfig{}
+	}
+	switch s.Config.Framing {
+	case "":
+		s.Config.Framing = stdioFramingNewline
+	case stdioFramingNewline, stdioFramingLength:
+	default:
+		return fmt.Errorf("stdio: unknown framing %q", s.Config.Framing)
+	}
+	switch s.Config.Format {
+	case "":
+		s.Config.Format = stdioFormatRaw
+	case stdioFormatRaw, stdioFormatJSON, stdioFormatPretty:
+	default:
+		return fmt.Errorf("stdio: unknown format %q", s.Config.Format)
+	}
+	if s.Config.MaxMessageSize < 1 {
+		s.Config.MaxMessageSize = 1024
+	}
+
+	if s.in == nil {
+		s.in = os.Stdin
+	}
+	if s.out == nil {
+		s.out = os.Stdout
+		if s.Config.Stderr {
+			s.out = os.Stderr
+		}
+	}
+	s.done = make(chan bool)
 	return nil
 }
 
 func (s *Stdio) Disconnect() (err error) {
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
 	return nil
 }
 
-func (s *Stdio) Write(message string) (err error) {
-	_, err = fmt.Println(message)
+func (s *Stdio) Capabilities() Capabilities {
+	return Capabilities{ConfirmedWrites: true, Ordering: true}
+}
+
+func (s *Stdio) Info() {
+	s.logger().Infof("StdioConfig: %+v", *s.Config)
+}
+
+func (s *Stdio) Write(body string) (err error) {
+	return s.WriteMessage(message.New(body))
+}
+
+// WriteMessage writes `m` in the configured format and framing.
+func (s *Stdio) WriteMessage(m message.Message) (err error) {
+	data, err := s.format(m)
+	if err != nil {
+		return
+	}
+	if s.Config.Framing == stdioFramingLength {
+		frame := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(frame, uint32(len(data)))
+		data = append(frame, data...)
+	} else {
+		data = append(data, '\n')
+	}
+
+	// a single write per message keeps concurrent writes whole
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.out.Write(data)
 	return
 }
 
+// format returns `m` in Config.Format.
+func (s *Stdio) format(m message.Message) ([]byte, error) {
+	switch s.Config.Format {
+	case stdioFormatJSON:
+		envelope := stdioEnvelope{
+			Timestamp: s.clock().Now().UTC().Format(time.RFC3339Nano),
+			Metadata:  m.Metadata,
+			Body:      m.Body,
+		}
+		if envelope.Metadata == nil {
+			envelope.Metadata = message.Metadata{}
+		}
+		if json.Valid([]byte(m.Body)) {
+			envelope.Body = json.RawMessage(m.Body)
+		}
+		return json.Marshal(envelope)
+	case stdioFormatPretty:
+		var buf bytes.Buffer
+		if json.Indent(&buf, []byte(m.Body), "", "  ") == nil {
+			return buf.Bytes(), nil
+		}
+	}
+	return []byte(m.Body), nil
+}
+
+// Read reads framed messages from stdin until its end.
 func (s *Stdio) Read() (channel chan string, err error) {
 	channel = make(chan string)
+	done := s.done
+	next := s.readLine
+	if s.Config.Framing == stdioFramingLength {
+		next = s.readFrame
+	}
+	reader := bufio.NewReader(s.in)
+
 	go func() {
+		defer close(channel)
 		for {
-			reader := bufio.NewReader(os.Stdin)
-			text, _ := reader.ReadString('\n')
-			text = strings.TrimSuffix(text, "\n")
-			channel <- string(text)
+			body, ok, err := next(reader)
+			if err == io.EOF {
+				s.logger().Info("Stdio: End of input.")
+				return
+			}
+			if err != nil {
+				s.logger().Error("Stdio: Failed to read: ", err)
+				return
+			}
+			if !ok {
+				continue
+			}
+			select {
+			case channel <- body:
+			case <-done:
+				return
+			}
 		}
 	}()
 	return
 }
 
-func (s *Stdio) Info() {
-	return
+// readLine reads a line, ok is false for an empty line.
+func (s *Stdio) readLine(reader *bufio.Reader) (body string, ok bool, err error) {
+	body, err = reader.ReadString('\n')
+	if err == io.EOF && body != "" {
+		// last line without a newline
+		err = nil
+	}
+	body = strings.TrimRight(body, "\r\n")
+	return body, body != "", err
+}
+
+// readFrame reads a length-prefixed message.
+func (s *Stdio) readFrame(reader *bufio.Reader) (body string, ok bool, err error) {
+	var size uint32
+	err = binary.Read(reader, binary.BigEndian, &size)
+	if err != nil {
+		return
+	}
+	if max := s.Config.MaxMessageSize * 1024; int(size) > max {
+		// the stream can't be resynchronised after a bad frame
+		return "", false, fmt.Errorf("message of %d bytes exceeds %d bytes", size, max)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return string(data), true, err
 }
@@ -0,0 +1,102 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// frame returns `body` prefixed with its length.
+func frame(body string) string {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(body)))
+	return string(size) + body
+}
+
+func readAll(t *testing.T, s *Stdio) []string {
+	assert.NoError(t, s.Connect())
+	channel, err := s.Read()
+	assert.NoError(t, err)
+	var bodies []string
+	for body := range channel {
+		bodies = append(bodies, body)
+	}
+	return bodies
+}
+
+func TestStdio_Read(t *testing.T) {
+	s := &Stdio{in: strings.NewReader("a\r\n\nb\nc")}
+	assert.Equal(t, []string{"a", "b", "c"}, readAll(t, s))
+
+	s = &Stdio{
+		Config: &StdioConfig{Framing: "length"},
+		in:     strings.NewReader(frame("multi\nline") + frame("") + frame("b")),
+	}
+	assert.Equal(t, []string{"multi\nline", "", "b"}, readAll(t, s))
+
+	// oversized and truncated frames end the input
+	s = &Stdio{
+		Config: &StdioConfig{Framing: "length", MaxMessageSize: 1},
+		in:     strings.NewReader(frame("a") + frame(strings.Repeat("x", 2000)) + frame("b")),
+	}
+	assert.Equal(t, []string{"a"}, readAll(t, s))
+	s = &Stdio{
+		Config: &StdioConfig{Framing: "length"},
+		in:     strings.NewReader(frame("a") + frame("bcd")[:5]),
+	}
+	assert.Equal(t, []string{"a"}, readAll(t, s))
+}
+
+func TestStdio_Write(t *testing.T) {
+	write := func(config StdioConfig, m message.Message) string {
+		var out bytes.Buffer
+		s := &Stdio{Config: &config, out: &out}
+		clock := NewFakeClock(time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC))
+		s.SetClock(clock)
+		assert.NoError(t, s.Connect())
+		assert.NoError(t, s.WriteMessage(m))
+		return out.String()
+	}
+	m := message.New(`{"id": 1}`)
+	m.Metadata["kinesis.shard_id"] = "shard-1"
+
+	assert.Equal(t, "{\"id\": 1}\n", write(StdioConfig{}, m))
+	assert.Equal(t, frame(`{"id": 1}`), write(StdioConfig{Framing: "length"}, m))
+	assert.Equal(t, "{\n  \"id\": 1\n}\n", write(StdioConfig{Format: "pretty"}, m))
+	assert.Equal(t, "text\n", write(StdioConfig{Format: "pretty"}, message.New("text")))
+	assert.Equal(t,
+		`{"timestamp":"2021-03-04T05:06:07Z","metadata":{"kinesis.shard_id":"shard-1"},"body":{"id":1}}`+"\n",
+		write(StdioConfig{Format: "json"}, m))
+	assert.Equal(t,
+		`{"timestamp":"2021-03-04T05:06:07Z","metadata":{},"body":"text"}`+"\n",
+		write(StdioConfig{Format: "json"}, message.New("text")))
+
+	assert.Error(t, (&Stdio{Config: &StdioConfig{Format: "yaml"}}).Connect())
+	assert.Error(t, (&Stdio{Config: &StdioConfig{Framing: "csv"}}).Connect())
+}
+
+func TestStdio_Pipeline(t *testing.T) {
+	var out bytes.Buffer
+	p := &Pipeline{
+		Source:      &Stdio{in: strings.NewReader("a\nb\n")},
+		Destination: &Stdio{Config: &StdioConfig{Framing: "length"}, out: &out},
+	}
+
+	// Run returns at the end of the input
+	done := make(chan struct{})
+	go func() {
+		p.Run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return at the end of the input")
+	}
+	assert.Equal(t, frame("a")+frame("b"), out.String())
+}
@@ -0,0 +1,216 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// errObjectExists is returned by objectStore.create when the object
+// already exists.
+var errObjectExists = errors.New("object already exists")
+
+// objectStore is a minimal blob store used to write table files,
+// either to a local directory or to S3. Calls to S3 are cancelled
+// with `ctx`, local directories ignore it.
+type objectStore interface {
+	// put writes the object `key`.
+	put(ctx context.Context, key string, data []byte) error
+	// create writes the object `key` unless it exists, in which
+	// case it returns errObjectExists. It's atomic on local
+	// directories only.
+	create(ctx context.Context, key string, data []byte) error
+	get(ctx context.Context, key string) ([]byte, error)
+	// list returns the keys starting with `prefix`.
+	list(ctx context.Context, prefix string) ([]string, error)
+}
+
+// newObjectStore returns the store of `location`, an s3://bucket/prefix
+// URL or a local directory. S3 is accessed with the config of
+// connectorConfig.
+func newObjectStore(ctx context.Context, location string, cfg *aws.Config, sess *session.Session, region string, roleARN string, externalID string) (objectStore, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return &localStore{dir: location}, nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	c, err := connectorConfig(ctx, cfg, sess, region, roleARN, externalID)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{
+		client: s3.NewFromConfig(c),
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+// storeResources returns the bucket of `location` if it is an S3
+// URL, local directories aren't resources.
+func storeResources(location string, region string) []Resource {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "s3" {
+		return nil
+	}
+	return []Resource{{Kind: "aws_s3_bucket", Name: u.Host, Region: region}}
+}
+
+// localStore stores objects as files of a directory.
+type localStore struct {
+	dir string
+}
+
+func (l *localStore) put(ctx context.Context, key string, data []byte) error {
+	file := filepath.Join(l.dir, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// write then rename, so readers never see partial files
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (l *localStore) create(ctx context.Context, key string, data []byte) error {
+	file := filepath.Join(l.dir, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file and link it, which fails if the
+	// file exists
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	err = os.Link(tmp, file)
+	if os.IsExist(err) {
+		return errObjectExists
+	}
+	return err
+}
+
+func (l *localStore) get(ctx context.Context, key string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(l.dir, filepath.FromSlash(key)))
+}
+
+func (l *localStore) list(ctx context.Context, prefix string) (keys []string, err error) {
+	dir := filepath.Join(l.dir, filepath.FromSlash(path.Dir(prefix+"x")))
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		key := path.Join(path.Dir(prefix+"x"), f.Name())
+		if !f.IsDir() && strings.HasPrefix(key, prefix) && !strings.HasSuffix(key, ".tmp") {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// s3StoreAPI is the part of the S3 client used by s3Store.
+type s3StoreAPI interface {
+	PutObject(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	HeadObject(ctx context.Context, input *s3.HeadObjectInput, opts ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(ctx context.Context, input *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	s3.ListObjectsV2APIClient
+}
+
+// s3Store stores objects under a prefix of an S3 bucket.
+type s3Store struct {
+	client s3StoreAPI
+	bucket string
+	prefix string
+}
+
+func (s *s3Store) key(key string) string {
+	full := path.Join(s.prefix, key)
+	if strings.HasSuffix(key, "/") {
+		full += "/"
+	}
+	return full
+}
+
+func (s *s3Store) put(ctx context.Context, key string, data []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (s *s3Store) create(ctx context.Context, key string, data []byte) error {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err == nil {
+		return errObjectExists
+	}
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		return err
+	}
+	return s.put(ctx, key, data)
+}
+
+func (s *s3Store) get(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
+
+func (s *s3Store) list(ctx context.Context, prefix string) (keys []string, err error) {
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key(prefix)),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			key := strings.TrimPrefix(aws.ToString(obj.Key), s.prefix)
+			keys = append(keys, strings.TrimPrefix(key, "/"))
+		}
+	}
+	return
+}
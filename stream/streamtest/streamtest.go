@@ -0,0 +1,202 @@
+// Package streamtest provides in-memory connectors and helpers to
+// test flows built on manifold without external systems.
+//
+// Example:
+//
+//	src := streamtest.NewSliceSource(`{"id":1}`, `{"id":2}`)
+//	dest := &streamtest.FlakyDestination{FailFirst: 1}
+//	streamtest.RunFlowUntilDrained(t, src, transformer, dest)
+//	assert.Len(t, dest.Messages(), 1)
+package streamtest
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/abstractpaper/manifold/stream"
+	"github.com/abstractpaper/manifold/transform"
+)
+
+// DrainTimeout is how long RunFlowUntilDrained waits for a flow to
+// drain before failing the test.
+var DrainTimeout = 10 * time.Second
+
+// ErrInjected is the error returned by FlakyDestination for
+// injected failures.
+var ErrInjected = errors.New("streamtest: injected failure")
+
+// SliceSource is a source that emits Messages and then closes its
+// channel. The acknowledgement of every message is recorded and
+// available with Acks.
+type SliceSource struct {
+	Messages []message.Message
+	mu       sync.Mutex
+	acks     []error
+}
+
+// NewSliceSource returns a source emitting a message per body.
+func NewSliceSource(bodies ...string) *SliceSource {
+	s := &SliceSource{}
+	for _, body := range bodies {
+		s.Messages = append(s.Messages, message.New(body))
+	}
+	return s
+}
+
+func (s *SliceSource) Connect() error    { return nil }
+func (s *SliceSource) Disconnect() error { return nil }
+func (s *SliceSource) Info()             {}
+
+func (s *SliceSource) Read() (chan string, error) {
+	channel := make(chan string)
+	go func() {
+		defer close(channel)
+		for _, m := range s.Messages {
+			channel <- m.Body
+		}
+	}()
+	return channel, nil
+}
+
+func (s *SliceSource) ReadMessages() (chan message.Message, error) {
+	channel := make(chan message.Message)
+	go func() {
+		defer close(channel)
+		for _, m := range s.Messages {
+			m.Metadata = m.Metadata.Copy()
+			m.Ack = s.ack
+			channel <- m
+		}
+	}()
+	return channel, nil
+}
+
+func (s *SliceSource) ack(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acks = append(s.acks, err)
+}
+
+// Acks returns the errors messages were acknowledged with, in the
+// order they were acknowledged (nil for delivered messages).
+func (s *SliceSource) Acks() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]error{}, s.acks...)
+}
+
+// CaptureDestination is a destination that records the messages
+// written to it. It is safe for concurrent use.
+type CaptureDestination struct {
+	mu       sync.Mutex
+	messages []message.Message
+}
+
+func (c *CaptureDestination) Connect() error    { return nil }
+func (c *CaptureDestination) Disconnect() error { return nil }
+func (c *CaptureDestination) Info()             {}
+
+func (c *CaptureDestination) Write(body string) error {
+	return c.WriteMessage(message.New(body))
+}
+
+func (c *CaptureDestination) WriteMessage(m message.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, m)
+	return nil
+}
+
+// Messages returns the messages written so far.
+func (c *CaptureDestination) Messages() []message.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]message.Message{}, c.messages...)
+}
+
+// Bodies returns the bodies of the messages written so far.
+func (c *CaptureDestination) Bodies() (bodies []string) {
+	for _, m := range c.Messages() {
+		bodies = append(bodies, m.Body)
+	}
+	return
+}
+
+// FlakyDestination is a CaptureDestination that fails some writes
+// with ErrInjected: the first FailFirst writes, every FailEvery-th
+// write and writes of messages matching FailOn. Failed writes are
+// not recorded.
+type FlakyDestination struct {
+	CaptureDestination
+	FailFirst int
+	FailEvery int
+	FailOn    func(m message.Message) bool
+	writes    int
+	failures  int
+}
+
+func (f *FlakyDestination) Write(body string) error {
+	return f.WriteMessage(message.New(body))
+}
+
+func (f *FlakyDestination) WriteMessage(m message.Message) error {
+	f.mu.Lock()
+	f.writes++
+	fail := f.writes <= f.FailFirst ||
+		(f.FailEvery > 0 && f.writes%f.FailEvery == 0) ||
+		(f.FailOn != nil && f.FailOn(m))
+	if fail {
+		f.failures++
+	}
+	f.mu.Unlock()
+
+	if fail {
+		return ErrInjected
+	}
+	return f.CaptureDestination.WriteMessage(m)
+}
+
+// Failures returns the number of injected failures.
+func (f *FlakyDestination) Failures() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failures
+}
+
+// RunFlowUntilDrained flows `src` through `transformer` (optional)
+// to `dest` until the source is drained and returns the pipeline
+// stats. The test fails if the flow can't connect or doesn't drain
+// within DrainTimeout.
+func RunFlowUntilDrained(t testing.TB, src stream.Source, transformer transform.Transformer, dest stream.Destination) stream.Stats {
+	t.Helper()
+
+	return RunPipelineUntilDrained(t, &stream.Pipeline{
+		Source:      src,
+		Transformer: transformer,
+		Destination: dest,
+	})
+}
+
+// RunPipelineUntilDrained is like RunFlowUntilDrained for a
+// pipeline, which allows retries, a DLQ and failure policies.
+func RunPipelineUntilDrained(t testing.TB, p *stream.Pipeline) stream.Stats {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.RunUntilDrained()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("streamtest: pipeline failed: ", err)
+		}
+	case <-time.After(DrainTimeout):
+		t.Fatalf("streamtest: pipeline not drained after %s", DrainTimeout)
+	}
+	return p.Stats()
+}
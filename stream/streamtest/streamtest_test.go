@@ -0,0 +1,70 @@
+package streamtest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/abstractpaper/manifold/stream"
+	transformJSON "github.com/abstractpaper/manifold/transform/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunFlowUntilDrained(t *testing.T) {
+	src := NewSliceSource(`{"id":1}`, `{"id":2}`)
+	dest := &CaptureDestination{}
+	transformer := &transformJSON.JSON{Append: map[string]interface{}{"env": "test"}}
+
+	stats := RunFlowUntilDrained(t, src, transformer, dest)
+
+	assert.Equal(t, uint64(2), stats.Sent)
+	assert.Equal(t, []string{`{"env":"test","id":1}`, `{"env":"test","id":2}`}, dest.Bodies())
+	assert.Equal(t, []error{nil, nil}, src.Acks())
+}
+
+func TestRunPipelineUntilDrained_Flaky(t *testing.T) {
+	src := NewSliceSource("a", "b", "poison", "c")
+	dest := &FlakyDestination{
+		FailFirst: 1,
+		FailOn:    func(m message.Message) bool { return m.Body == "poison" },
+	}
+	dlq := &CaptureDestination{}
+
+	stats := RunPipelineUntilDrained(t, &stream.Pipeline{
+		Source:      src,
+		Destination: dest,
+		DLQ:         dlq,
+		MaxAttempts: 2,
+	})
+
+	assert.Equal(t, uint64(3), stats.Sent)
+	assert.Equal(t, uint64(1), stats.Quarantined)
+	assert.Equal(t, []string{"a", "b", "c"}, dest.Bodies())
+	assert.Equal(t, 3, dest.Failures())
+
+	var letter stream.DeadLetter
+	assert.NoError(t, json.Unmarshal([]byte(dlq.Bodies()[0]), &letter))
+	assert.Equal(t, "poison", letter.Message)
+}
+
+func TestRunPipelineUntilDrained_PausePartition(t *testing.T) {
+	src := &SliceSource{}
+	for i, key := range []string{"a", "b", "a", "b"} {
+		m := message.New(key + string(rune('1'+i)))
+		m.Metadata["key"] = key
+		src.Messages = append(src.Messages, m)
+	}
+	dest := &FlakyDestination{FailFirst: 1}
+
+	stats := RunPipelineUntilDrained(t, &stream.Pipeline{
+		Source:        src,
+		Destination:   dest,
+		OnFailure:     stream.PausePartition,
+		PartitionKey:  "key",
+		ProbeInterval: 1,
+	})
+
+	assert.Equal(t, uint64(4), stats.Sent)
+	assert.Len(t, dest.Messages(), 4)
+	assert.Len(t, src.Acks(), 4)
+}
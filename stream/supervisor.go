@@ -0,0 +1,511 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RestartPolicy tells a Supervisor when to restart a flow.
+type RestartPolicy int
+
+const (
+	// RestartOnFailure restarts flows that fail (the default).
+	RestartOnFailure RestartPolicy = iota
+	// RestartAlways restarts flows whose source closes as well.
+	RestartAlways
+	// RestartNever leaves flows that fail failed.
+	RestartNever
+)
+
+// States of the flows of a Supervisor.
+const (
+	FlowRunning    = "running"
+	FlowRestarting = "restarting" // waiting to restart after a failure
+	FlowFailed     = "failed"     // and not restarted (RestartNever)
+	FlowFinished   = "finished"   // its source closed
+	FlowStopped    = "stopped"    // by StopPipeline or Stop
+)
+
+// SupervisedFlow is a named flow run by a Supervisor. Build returns
+// the pipeline of each run of the flow, as a stopped pipeline can't
+// run again; it should create its connectors as well.
+type SupervisedFlow struct {
+	Name    string
+	Build   func() (*Pipeline, error)
+	Restart RestartPolicy
+}
+
+// FlowState is the state of a flow run by a Supervisor.
+type FlowState struct {
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	Restarts  uint64    `json:"restarts"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// SupervisorHealth is the state of every flow of a Supervisor, which
+// is healthy if none of them is restarting or failed.
+type SupervisorHealth struct {
+	Healthy bool                 `json:"healthy"`
+	Flows   map[string]FlowState `json:"flows"`
+}
+
+// Supervisor runs many flows in one process. Flows are started (Add,
+// StartPipeline) and stopped (StopPipeline) independently, and a
+// flow that fails is restarted with exponential backoff rather than
+// exiting the process.
+//
+// A flow fails when its pipeline can't be built, doesn't validate,
+// fails to connect, seek or read its source, has a Failing connector
+// that fails (e.g. S3 can't write its buffer) or panics; pipelines
+// run with RunUntilDrained. A flow whose source closes its channel
+// (e.g. at the end of stdin) is finished, unless its policy is
+// RestartAlways.
+//
+// Flows restart after MinBackoff (1 second by default), doubling up
+// to MaxBackoff (1 minute by default) while they keep failing. A
+// flow that ran for ResetAfter (1 minute by default) before failing
+// restarts after MinBackoff again.
+//
+// Supervisors implement admin.Flows, and their Health is reported
+// by the admin API.
+type Supervisor struct {
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	ResetAfter   time.Duration
+	DrainTimeout time.Duration // on interrupt signals, see Run
+	mu           sync.Mutex
+	flows        map[string]*supervised
+	wg           sync.WaitGroup
+	stop         chan struct{}
+	changed      chan struct{}
+	clocked
+	logged
+}
+
+// supervised is a flow of a Supervisor.
+type supervised struct {
+	flow     SupervisedFlow
+	state    FlowState
+	pipeline *Pipeline     // of the current run, nil between runs
+	stop     chan struct{} // closed by StopPipeline
+	done     chan struct{} // closed once the flow has stopped
+}
+
+// Add starts `flow`. A stopped, finished or failed flow of the same
+// name is replaced.
+func (s *Supervisor) Add(flow SupervisedFlow) error {
+	if flow.Name == "" || flow.Build == nil {
+		return errors.New("supervisor: flows must have a Name and Build")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped() {
+		return errors.New("supervisor: stopped")
+	}
+	if s.flows == nil {
+		s.flows = map[string]*supervised{}
+	}
+	if f, ok := s.flows[flow.Name]; ok && f.active() {
+		return fmt.Errorf("supervisor: flow %q is already running", flow.Name)
+	}
+	s.start(&supervised{flow: flow})
+	return nil
+}
+
+// StartPipeline starts flow `name` again after it stopped, finished
+// or failed.
+func (s *Supervisor) StartPipeline(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.flows[name]
+	if !ok {
+		return fmt.Errorf("supervisor: no flow named %q", name)
+	}
+	if f.active() {
+		return nil
+	}
+	if s.stopped() {
+		return errors.New("supervisor: stopped")
+	}
+	s.start(&supervised{flow: f.flow, state: FlowState{Restarts: f.state.Restarts}})
+	return nil
+}
+
+// StopPipeline stops flow `name`, draining the messages it has read,
+// until it is started again.
+func (s *Supervisor) StopPipeline(name string) error {
+	s.mu.Lock()
+	f, ok := s.flows[name]
+	if ok {
+		f.halt()
+	}
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("supervisor: no flow named %q", name)
+	}
+	<-f.done
+	return nil
+}
+
+// Pipelines returns the pipelines of the running flows by name.
+func (s *Supervisor) Pipelines() map[string]*Pipeline {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pipelines := map[string]*Pipeline{}
+	for name, f := range s.flows {
+		if f.pipeline != nil {
+			pipelines[name] = f.pipeline
+		}
+	}
+	return pipelines
+}
+
+// Health returns the state of every flow.
+func (s *Supervisor) Health() SupervisorHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	health := SupervisorHealth{Healthy: true, Flows: map[string]FlowState{}}
+	for name, f := range s.flows {
+		health.Flows[name] = f.state
+		if f.state.State == FlowRestarting || f.state.State == FlowFailed {
+			health.Healthy = false
+		}
+	}
+	return health
+}
+
+// Run runs until an interrupt signal (SIGINT or SIGTERM) is received,
+// Stop is called or no flow is running or restarting anymore. Flows
+// are drained on interrupt signals, within DrainTimeout (25 seconds
+// by default, see Pipeline.Drain). Flows can be added before or
+// while it runs.
+func (s *Supervisor) Run() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	s.mu.Lock()
+	stop, changed := s.stopping(), s.changing()
+	s.mu.Unlock()
+	for {
+		select {
+		case sig := <-interrupt:
+			s.drainOnSignal(sig, interrupt)
+			return
+		case <-stop:
+			s.wg.Wait()
+			return
+		case <-changed:
+			if s.idle() {
+				s.logger().Info("Supervisor: No flow is running anymore.")
+				return
+			}
+		}
+	}
+}
+
+// Stop stops every flow, draining the messages they have read, and
+// makes Run return.
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	s.halt()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// drainOnSignal drains every flow within DrainTimeout after an
+// interrupt signal, stopping right away on a second one.
+func (s *Supervisor) drainOnSignal(sig os.Signal, interrupt <-chan os.Signal) {
+	timeout := s.DrainTimeout
+	if timeout <= 0 {
+		timeout = 25 * time.Second
+	}
+	s.logger().Infof("%s received, draining flows (for up to %s)...", sig, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// drains are registered before flows are halted, so that their
+	// pipelines don't disconnect before being drained
+	var drained sync.WaitGroup
+	s.mu.Lock()
+	for _, f := range s.flows {
+		if f.pipeline == nil {
+			continue
+		}
+		p := f.pipeline
+		p.drainWG.Add(1)
+		drained.Add(1)
+		go func() {
+			defer drained.Done()
+			err := p.drainRegistered(ctx)
+			if err != nil {
+				p.logger().Error("Failed to drain the pipeline, stopping now: ", err)
+			}
+		}()
+	}
+	s.halt()
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		drained.Wait()
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.logger().Info("Supervisor: Flows drained.")
+	case <-interrupt:
+		s.logger().Warn("Second signal received, stopping now.")
+	case <-ctx.Done():
+		s.logger().Error("Supervisor: Flows failed to drain in time, stopping now.")
+	}
+}
+
+// start runs flow `f` in a goroutine.
+func (s *Supervisor) start(f *supervised) {
+	f.stop = make(chan struct{})
+	f.done = make(chan struct{})
+	s.flows[f.flow.Name] = f
+	s.wg.Add(1)
+	go s.supervise(f)
+}
+
+// supervise runs flow `f` until it stops, finishes or fails for good,
+// restarting it with backoff.
+func (s *Supervisor) supervise(f *supervised) {
+	defer s.wg.Done()
+	defer close(f.done)
+	backoff := s.minBackoff()
+	for restart := false; ; restart = true {
+		if restart {
+			s.mu.Lock()
+			f.state.Restarts++
+			s.mu.Unlock()
+		}
+		started := s.clock().Now()
+		p, err := f.build()
+		if err == nil && s.running(f, p) {
+			err = f.run(p)
+		}
+
+		s.mu.Lock()
+		f.pipeline = nil
+		var state string
+		switch {
+		case closed(f.stop):
+			state = FlowStopped
+		case err == nil && f.flow.Restart != RestartAlways:
+			state = FlowFinished
+		case err != nil && f.flow.Restart == RestartNever:
+			state = FlowFailed
+		default:
+			state = FlowRestarting
+		}
+		f.set(state, err, s.clock().Now())
+		s.mu.Unlock()
+		s.notify()
+
+		switch {
+		case state != FlowRestarting:
+			if err != nil {
+				s.logger().Errorf("Supervisor: Flow %s failed: %s", f.flow.Name, err)
+			}
+			s.logger().Infof("Supervisor: Flow %s %s.", f.flow.Name, state)
+			return
+		case err != nil:
+			s.logger().Errorf("Supervisor: Flow %s failed, restarting in %s: %s", f.flow.Name, backoff, err)
+		default:
+			s.logger().Infof("Supervisor: Flow %s finished, restarting in %s.", f.flow.Name, backoff)
+		}
+
+		// flows that ran long enough restart right after
+		if s.clock().Now().Sub(started) >= s.resetAfter() {
+			backoff = s.minBackoff()
+		}
+		timer := s.clock().NewTimer(backoff)
+		select {
+		case <-timer.C():
+		case <-f.stop:
+			timer.Stop()
+			s.mu.Lock()
+			f.set(FlowStopped, nil, s.clock().Now())
+			s.mu.Unlock()
+			s.notify()
+			return
+		}
+		backoff *= 2
+		if backoff > s.maxBackoff() {
+			backoff = s.maxBackoff()
+		}
+	}
+}
+
+// running marks `f` running `p`, unless it was stopped.
+func (s *Supervisor) running(f *supervised, p *Pipeline) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if closed(f.stop) {
+		return false
+	}
+	f.pipeline = p
+	f.set(FlowRunning, nil, s.clock().Now())
+	return true
+}
+
+// build returns the pipeline of a run of `f`.
+func (f *supervised) build() (p *Pipeline, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	p, err = f.flow.Build()
+	if err == nil && p == nil {
+		err = errors.New("no pipeline built")
+	}
+	if err == nil && p.Name == "" {
+		p.Name = f.flow.Name
+	}
+	return
+}
+
+// run runs `p` until its source closes or it is stopped.
+func (f *supervised) run(p *Pipeline) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return p.RunUntilDrained()
+}
+
+// set sets the state of `f`, keeping the last error it failed with.
+func (f *supervised) set(state string, err error, now time.Time) {
+	if state != f.state.State {
+		f.state.Since = now
+	}
+	f.state.State = state
+	if err != nil {
+		f.state.LastError = err.Error()
+	}
+}
+
+// active reports whether `f` is running or restarting.
+func (f *supervised) active() bool {
+	select {
+	case <-f.done:
+		return false
+	default:
+		return !closed(f.stop)
+	}
+}
+
+// halt stops `f`, to be called with the lock of its supervisor held.
+func (f *supervised) halt() {
+	if !closed(f.stop) {
+		close(f.stop)
+	}
+	if f.pipeline != nil {
+		f.pipeline.Stop()
+	}
+}
+
+// halt stops every flow and makes Run return, to be called with the
+// lock held.
+func (s *Supervisor) halt() {
+	for _, f := range s.flows {
+		f.halt()
+	}
+	if stop := s.stopping(); !closed(stop) {
+		close(stop)
+	}
+}
+
+// idle reports whether flows were added and none of them is running
+// or restarting anymore.
+func (s *Supervisor) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.flows) == 0 {
+		return false
+	}
+	for _, f := range s.flows {
+		if f.active() {
+			return false
+		}
+	}
+	return true
+}
+
+// stopped reports whether Stop was called, to be called with the
+// lock held.
+func (s *Supervisor) stopped() bool {
+	return closed(s.stopping())
+}
+
+// stopping returns a channel closed by Stop, to be called with the
+// lock held.
+func (s *Supervisor) stopping() chan struct{} {
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+	return s.stop
+}
+
+// changing returns a channel signalled when a flow changes state, to
+// be called with the lock held.
+func (s *Supervisor) changing() chan struct{} {
+	if s.changed == nil {
+		s.changed = make(chan struct{}, 1)
+	}
+	return s.changed
+}
+
+// notify signals a change of state to Run.
+func (s *Supervisor) notify() {
+	s.mu.Lock()
+	changed := s.changing()
+	s.mu.Unlock()
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Supervisor) minBackoff() time.Duration {
+	if s.MinBackoff <= 0 {
+		return time.Second
+	}
+	return s.MinBackoff
+}
+
+func (s *Supervisor) maxBackoff() time.Duration {
+	if s.MaxBackoff <= 0 {
+		return time.Minute
+	}
+	return s.MaxBackoff
+}
+
+func (s *Supervisor) resetAfter() time.Duration {
+	if s.ResetAfter <= 0 {
+		return time.Minute
+	}
+	return s.ResetAfter
+}
+
+// closed reports whether `c` is closed.
+func closed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,158 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// unreachable is a source failing to connect.
+type unreachable struct {
+	channelSource
+}
+
+func (unreachable) Connect() error { return errors.New("unreachable") }
+
+func TestSupervisor_Restart(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	src := make(channelSource)
+	dest := &memory{}
+	var builds int32
+	s := &Supervisor{MinBackoff: time.Second, MaxBackoff: 2 * time.Second}
+	s.SetClock(clock)
+	assert.NoError(t, s.Add(SupervisedFlow{Name: "orders", Build: func() (*Pipeline, error) {
+		// the source is down for 3 runs
+		if atomic.AddInt32(&builds, 1) <= 3 {
+			return &Pipeline{Source: unreachable{}, Destination: dest}, nil
+		}
+		return &Pipeline{Source: src, Destination: dest}, nil
+	}}))
+	restarting := func(runs int32) {
+		assert.Eventually(t, func() bool {
+			return clock.Waiters() == 1 && atomic.LoadInt32(&builds) == runs
+		}, time.Second, time.Millisecond)
+	}
+
+	restarting(1)
+	health := s.Health()
+	assert.False(t, health.Healthy)
+	assert.Equal(t, FlowRestarting, health.Flows["orders"].State)
+	assert.Equal(t, "unreachable", health.Flows["orders"].LastError)
+	clock.Advance(time.Second)
+	restarting(2)
+	// the backoff doubles up to MaxBackoff
+	clock.Advance(time.Second)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&builds))
+	clock.Advance(time.Second)
+	restarting(3)
+	clock.Advance(2 * time.Second)
+
+	assert.Eventually(t, func() bool { return s.Pipelines()["orders"] != nil }, time.Second, time.Millisecond)
+	assert.Error(t, s.Add(SupervisedFlow{Name: "orders", Build: func() (*Pipeline, error) { return nil, nil }}))
+	src <- message.New("a")
+	health = s.Health()
+	assert.True(t, health.Healthy)
+	assert.Equal(t, FlowState{State: FlowRunning, Since: clock.Now(), Restarts: 3, LastError: "unreachable"}, health.Flows["orders"])
+
+	assert.NoError(t, s.StopPipeline("orders"))
+	assert.Equal(t, FlowStopped, s.Health().Flows["orders"].State)
+	assert.Empty(t, s.Pipelines())
+	assert.Equal(t, []string{"a"}, dest.messages)
+}
+
+func TestSupervisor_Policies(t *testing.T) {
+	s := &Supervisor{}
+	stdin := func() (*Pipeline, error) {
+		src := make(channelSource)
+		close(src)
+		return &Pipeline{Source: src, Destination: &memory{}}, nil
+	}
+	assert.NoError(t, s.Add(SupervisedFlow{Name: "stdin", Build: stdin}))
+	assert.NoError(t, s.Add(SupervisedFlow{Name: "broken", Restart: RestartNever, Build: func() (*Pipeline, error) {
+		panic("nil config")
+	}}))
+
+	// Run returns once no flow is running or restarting
+	s.Run()
+	health := s.Health()
+	assert.False(t, health.Healthy)
+	assert.Equal(t, FlowFinished, health.Flows["stdin"].State)
+	assert.Equal(t, FlowFailed, health.Flows["broken"].State)
+	assert.Equal(t, "panic: nil config", health.Flows["broken"].LastError)
+
+	assert.NoError(t, s.StartPipeline("stdin"))
+	assert.Error(t, s.StartPipeline("nope"))
+	assert.Eventually(t, func() bool {
+		return s.Health().Flows["stdin"].State == FlowFinished
+	}, time.Second, time.Millisecond)
+	s.Stop()
+	assert.Error(t, s.Add(SupervisedFlow{Name: "late", Build: stdin}))
+}
+
+// broken is a destination failing in the background, as S3 does
+// when it can't write its buffer.
+type broken struct {
+	memory
+	failed chan error
+}
+
+func (b *broken) Failed() <-chan error { return b.failed }
+
+func TestSupervisor_FailingConnector(t *testing.T) {
+	s := &Supervisor{}
+	dest := &broken{failed: make(chan error, 1)}
+	assert.NoError(t, s.Add(SupervisedFlow{Name: "orders", Restart: RestartNever, Build: func() (*Pipeline, error) {
+		return &Pipeline{Source: make(channelSource), Destination: dest}, nil
+	}}))
+	assert.Eventually(t, func() bool { return s.Pipelines()["orders"] != nil }, time.Second, time.Millisecond)
+
+	// the flow fails rather than the process exiting
+	dest.failed <- errors.New("disk full")
+	s.Run()
+	assert.Equal(t, FlowFailed, s.Health().Flows["orders"].State)
+	assert.Equal(t, "disk full", s.Health().Flows["orders"].LastError)
+}
+
+// closing is a destination recording whether it was drained after
+// being disconnected.
+type closing struct {
+	memory
+	disconnected int32
+	drained      int32
+	late         int32
+}
+
+func (c *closing) Disconnect() error {
+	atomic.StoreInt32(&c.disconnected, 1)
+	return nil
+}
+
+func (c *closing) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&c.drained, 1)
+	if atomic.LoadInt32(&c.disconnected) == 1 {
+		atomic.StoreInt32(&c.late, 1)
+	}
+	return nil
+}
+
+func TestSupervisor_DrainOnSignal(t *testing.T) {
+	s := &Supervisor{}
+	dest := &closing{}
+	assert.NoError(t, s.Add(SupervisedFlow{Name: "orders", Build: func() (*Pipeline, error) {
+		return &Pipeline{Source: make(channelSource), Destination: dest}, nil
+	}}))
+	assert.Eventually(t, func() bool { return s.Pipelines()["orders"] != nil }, time.Second, time.Millisecond)
+
+	// the destination is drained before the flow disconnects it
+	s.drainOnSignal(os.Interrupt, make(chan os.Signal))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dest.drained))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dest.disconnected))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dest.late))
+	assert.Equal(t, FlowStopped, s.Health().Flows["orders"].State)
+}
@@ -0,0 +1,51 @@
+package stream
+
+import (
+	"encoding/json"
+	"strings"
+	"text/template"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// templateData is the data message templates are executed with:
+//
+//	{{.Body}}                  raw message body
+//	{{.Metadata.key}}          message metadata
+//	{{.Fields.name}}           field of a JSON object body
+type templateData struct {
+	Body     string
+	Metadata message.Metadata
+	Fields   map[string]interface{}
+}
+
+// newTemplate parses `text` as a message template. Executing it
+// fails if it references a missing field or metadata key, rather
+// than rendering "<no value>".
+func newTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+// executeTemplate renders `t` for message `m`.
+func executeTemplate(t *template.Template, m message.Message) (string, error) {
+	return renderTemplate(t, newTemplateData(m))
+}
+
+// newTemplateData returns the template data of message `m`.
+func newTemplateData(m message.Message) templateData {
+	data := templateData{
+		Body:     m.Body,
+		Metadata: m.Metadata,
+	}
+	// bodies that aren't JSON objects simply have no fields
+	json.Unmarshal([]byte(m.Body), &data.Fields)
+	return data
+}
+
+// renderTemplate executes `t` with `data`, e.g. a struct embedding
+// templateData with fields of its own.
+func renderTemplate(t *template.Template, data interface{}) (string, error) {
+	var b strings.Builder
+	err := t.Execute(&b, data)
+	return b.String(), err
+}
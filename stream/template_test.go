@@ -0,0 +1,27 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplate(t *testing.T) {
+	tmpl, err := newTemplate("url", "/events/{{.Fields.type}}/{{.Metadata.shard}}")
+	assert.NoError(t, err)
+
+	m := message.New(`{"type":"click"}`)
+	m.Metadata["shard"] = "s1"
+	out, err := executeTemplate(tmpl, m)
+	assert.NoError(t, err)
+	assert.Equal(t, "/events/click/s1", out)
+
+	// missing fields and metadata are errors
+	_, err = executeTemplate(tmpl, message.New(`{"kind":"click"}`))
+	assert.Error(t, err)
+	_, err = executeTemplate(tmpl, message.New(`{"type":"click"}`))
+	assert.Error(t, err)
+	_, err = executeTemplate(tmpl, message.New("not json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,73 @@
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeExecer records executed statements, failing with err if set.
+type fakeExecer struct {
+	queries []string
+	args    [][]interface{}
+	err     error
+}
+
+func (f *fakeExecer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	f.queries = append(f.queries, query)
+	f.args = append(f.args, args)
+	return nil, f.err
+}
+
+func TestTimescaleDB_Write(t *testing.T) {
+	exec := &fakeExecer{}
+	ts := &TimescaleDB{
+		Table: "metrics.readings",
+		Config: &TimescaleDBConfig{
+			Columns:   []string{"device", "temp", "meta"},
+			TimeField: "ts",
+			MaxLag:    60,
+		},
+		exec: exec,
+	}
+	assert.NoError(t, ts.Connect())
+	assert.NoError(t, ts.Write(`{"device":"d1","temp":21.5,"meta":{"fw":2},"ts":1601553660000}`))
+	assert.NoError(t, ts.Write(`{"device":"d2","ts":"2020-10-01T12:00:00Z"}`))
+	assert.Error(t, ts.Write(`{"device":"d3","ts":1601553540000}`))
+	assert.NoError(t, ts.Disconnect())
+
+	assert.Equal(t, []string{
+		`INSERT INTO "metrics"."readings" ("time", "device", "temp", "meta") VALUES ($1, $2, $3, $4), ($5, $6, $7, $8)`,
+	}, exec.queries)
+	// sorted by time
+	assert.Equal(t, []interface{}{
+		time.Unix(1601553600, 0).UTC(), "d2", nil, nil,
+		time.Unix(1601553660, 0), "d1", 21.5, `{"fw":2}`,
+	}, exec.args[0])
+}
+
+func TestTimescaleDB_WriteAsync(t *testing.T) {
+	exec := &fakeExecer{err: errors.New("connection refused")}
+	ts := &TimescaleDB{
+		Table:  "readings",
+		Config: &TimescaleDBConfig{Columns: []string{"temp"}, MaxRetries: 1},
+		exec:   exec,
+	}
+	assert.NoError(t, ts.Connect())
+
+	var results []error
+	ts.WriteAsync(message.New(`{"temp":21.5}`), func(err error) { results = append(results, err) })
+	ts.WriteAsync(message.New(`not json`), func(err error) { results = append(results, err) })
+	assert.NoError(t, ts.Disconnect())
+
+	// the insert is retried before the message fails
+	assert.Len(t, exec.queries, 2)
+	assert.Len(t, results, 2)
+	assert.Error(t, results[0], "invalid JSON")
+	assert.EqualError(t, results[1], "connection refused")
+}
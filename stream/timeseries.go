@@ -0,0 +1,93 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// point is a JSON object message mapped to a time-series row.
+type point struct {
+	time   time.Time
+	fields map[string]interface{}
+	msg    message.Message
+}
+
+// parsePoint decodes `m` as a JSON object and reads its time from
+// `timeField`, which is removed from the fields. The time defaults
+// to the current time.
+func parsePoint(m message.Message, timeField string) (p point, err error) {
+	p.msg = m
+	err = json.Unmarshal([]byte(m.Body), &p.fields)
+	if err != nil {
+		return
+	}
+
+	p.time = time.Now()
+	if v, ok := p.fields[timeField]; ok && v != nil {
+		p.time, err = fieldTime(v)
+		if err != nil {
+			return p, fmt.Errorf("time field %s: %s", timeField, err)
+		}
+		delete(p.fields, timeField)
+	}
+	return
+}
+
+// fieldTime parses a JSON time value: milliseconds since epoch or
+// an RFC 3339 string.
+func fieldTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case float64:
+		return time.Unix(0, int64(v)*int64(time.Millisecond)), nil
+	case string:
+		return time.Parse(time.RFC3339Nano, v)
+	}
+	return time.Time{}, fmt.Errorf("unsupported type %T", v)
+}
+
+// sortPoints sorts `points` by time, keeping the order of points
+// with equal times.
+func sortPoints(points []point) {
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].time.Before(points[j].time)
+	})
+}
+
+// batchPoints returns the points of a batcher's batch.
+func batchPoints(batch []*batchEntry) []point {
+	points := make([]point, len(batch))
+	for i, e := range batch {
+		points[i] = e.value.(point)
+	}
+	return points
+}
+
+// lateness rejects points that are more than maxLag behind the
+// newest point seen. A zero maxLag accepts any point.
+type lateness struct {
+	sync.Mutex
+	maxLag time.Duration
+	newest time.Time
+}
+
+func (l *lateness) check(t time.Time) error {
+	if l.maxLag <= 0 {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if t.After(l.newest) {
+		l.newest = t
+		return nil
+	}
+	if lag := l.newest.Sub(t); lag > l.maxLag {
+		return fmt.Errorf("point is %s behind the newest point (max lag %s)", lag, l.maxLag)
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// Webhook POSTs messages to an HTTP endpoint.
+//
+// URL and Header values are templates executed against each
+// message (see templateData), e.g.:
+//
+//	URL: "https://api.example.com/events/{{.Fields.type}}"
+//
+// If Secret is set, requests are signed with HMAC-SHA256 over the
+// request body and the hex digest is sent as `sha256=<digest>` in
+// the `X-Signature` header (overridable with `signatureHeader` in
+// Args).
+//
+// Requests that fail with a 5xx or 429 status (or a network error)
+// are retried with exponential backoff, honouring `Retry-After`.
+type Webhook struct {
+	URL    string
+	Header http.Header
+	Secret string
+	Config *WebhookConfig
+	Args   map[string]string
+	client *http.Client
+	url    *template.Template
+	header map[string][]*template.Template
+	queue  chan webhookRequest
+	wg     sync.WaitGroup
+	clocked
+	logged
+}
+
+// WebhookConfig configures batching, concurrency and retries.
+//
+// With the defaults (BatchSize and Concurrency of 1) every Write
+// sends its request synchronously and returns its error. Otherwise
+// messages are queued, grouped into batches of up to BatchSize
+// messages sharing the same URL and headers (sent as
+// newline-delimited JSON) and sent by Concurrency workers. The result
+// of a batch is reported to each of its messages written with
+// WriteAsync (as pipelines do), errors of plain writes are logged.
+type WebhookConfig struct {
+	BatchSize   int // messages per request
+	FlushEvery  int // seconds, flush incomplete batches
+	Concurrency int // parallel requests
+	MaxRetries  int // retries per request
+	Timeout     int // seconds, per request
+}
+
+type webhookRequest struct {
+	url    string
+	header http.Header
+	body   []string
+	done   []func(error)
+}
+
+// key returns the batching key of `r`: its URL and headers.
+func (r webhookRequest) key() string {
+	var b strings.Builder
+	b.WriteString(r.url + "\n")
+	r.header.Write(&b)
+	return b.String()
+}
+
+func (w *Webhook) Connect() (err error) {
+	if w.Config == nil {
+		w.Config = &WebhookConfig{}
+	}
+	if w.Config.BatchSize < 1 {
+		w.Config.BatchSize = 1
+	}
+	if w.Config.Concurrency < 1 {
+		w.Config.Concurrency = 1
+	}
+	if w.Config.FlushEvery < 1 {
+		w.Config.FlushEvery = 1
+	}
+	if w.Config.Timeout < 1 {
+		w.Config.Timeout = 30
+	}
+	w.client = &http.Client{Timeout: time.Duration(w.Config.Timeout) * time.Second}
+
+	// parse templates
+	w.url, err = newTemplate("url", w.URL)
+	if err != nil {
+		return
+	}
+	w.header = map[string][]*template.Template{}
+	for name, values := range w.Header {
+		for _, v := range values {
+			t, err := newTemplate(name, v)
+			if err != nil {
+				return err
+			}
+			w.header[name] = append(w.header[name], t)
+		}
+	}
+
+	if !w.synchronous() {
+		batches := make(chan webhookRequest)
+		w.queue = make(chan webhookRequest, w.Config.BatchSize*w.Config.Concurrency)
+		w.wg.Add(1 + w.Config.Concurrency)
+		go w.batcher(batches)
+		for i := 0; i < w.Config.Concurrency; i++ {
+			go w.worker(batches)
+		}
+	}
+
+	return
+}
+
+// Disconnect flushes queued messages and waits for in-flight
+// requests to finish.
+func (w *Webhook) Disconnect() (err error) {
+	if w.queue != nil {
+		close(w.queue)
+		w.wg.Wait()
+		w.queue = nil
+	}
+	return
+}
+
+// Capabilities of Webhook: requests are sent in order unless they
+// are batched or sent concurrently.
+func (w *Webhook) Capabilities() Capabilities {
+	queued := w.Config != nil && (w.Config.BatchSize > 1 || w.Config.Concurrency > 1)
+	return Capabilities{ConfirmedWrites: true, Batching: queued, Ordering: !queued}
+}
+
+func (w *Webhook) Info() {
+	w.logger().Info("Webhook.URL: ", w.URL)
+	w.logger().Infof("WebhookConfig: %+v", *w.Config)
+}
+
+func (w *Webhook) Write(body string) (err error) {
+	return w.WriteMessage(message.New(body))
+}
+
+// WriteMessage renders the URL and headers for `m` and sends it (or
+// queues it, see WebhookConfig).
+func (w *Webhook) WriteMessage(m message.Message) (err error) {
+	req, err := w.request(m)
+	if err != nil {
+		return
+	}
+
+	if w.synchronous() {
+		return w.send(req)
+	}
+
+	w.queue <- req
+	return
+}
+
+// WriteAsync writes `m` like WriteMessage and calls `done` once it
+// has been sent.
+func (w *Webhook) WriteAsync(m message.Message, done func(error)) {
+	req, err := w.request(m)
+	if err != nil || w.synchronous() {
+		if err == nil {
+			err = w.send(req)
+		}
+		done(err)
+		return
+	}
+
+	req.done = []func(error){done}
+	w.queue <- req
+}
+
+// Buffered reports whether messages are queued rather than sent
+// synchronously.
+func (w *Webhook) Buffered() bool {
+	return !w.synchronous()
+}
+
+// request renders the request of `m`.
+func (w *Webhook) request(m message.Message) (req webhookRequest, err error) {
+	req = webhookRequest{
+		header: http.Header{},
+		body:   []string{m.Body},
+	}
+	req.url, err = executeTemplate(w.url, m)
+	if err != nil {
+		return
+	}
+	for name, templates := range w.header {
+		for _, t := range templates {
+			var v string
+			v, err = executeTemplate(t, m)
+			if err != nil {
+				return
+			}
+			req.header.Add(name, v)
+		}
+	}
+	return
+}
+
+func (w *Webhook) synchronous() bool {
+	return w.Config.BatchSize == 1 && w.Config.Concurrency == 1
+}
+
+// batcher groups queued requests by URL and headers and hands
+// batches to the workers once full or every FlushEvery seconds.
+func (w *Webhook) batcher(batches chan webhookRequest) {
+	defer w.wg.Done()
+	defer close(batches)
+
+	pending := map[string]*webhookRequest{}
+	flush := func() {
+		for key, req := range pending {
+			batches <- *req
+			delete(pending, key)
+		}
+	}
+
+	ticker := w.clock().NewTicker(time.Duration(w.Config.FlushEvery) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case req, ok := <-w.queue:
+			if !ok {
+				flush()
+				return
+			}
+			key := req.key()
+			batch, ok := pending[key]
+			if !ok {
+				pending[key] = &req
+				batch = &req
+			} else {
+				batch.body = append(batch.body, req.body...)
+				batch.done = append(batch.done, req.done...)
+			}
+			if len(batch.body) >= w.Config.BatchSize {
+				batches <- *batch
+				delete(pending, key)
+			}
+		case <-ticker.C():
+			flush()
+		}
+	}
+}
+
+func (w *Webhook) worker(batches chan webhookRequest) {
+	defer w.wg.Done()
+	for req := range batches {
+		err := w.send(req)
+		if err != nil {
+			w.logger().Errorf("Webhook: Failed to send %d message(s): %s", len(req.body), err)
+		}
+		for _, done := range req.done {
+			done(err)
+		}
+	}
+}
+
+// send POSTs `req`, retrying on retryable failures.
+func (w *Webhook) send(req webhookRequest) (err error) {
+	body := []byte(strings.Join(req.body, "\n"))
+	contentType := "application/json"
+	if len(req.body) > 1 {
+		contentType = "application/x-ndjson"
+	}
+
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		var retryAfter time.Duration
+		retryAfter, err = w.post(req, body, contentType)
+		if err == nil || retryAfter < 0 || attempt >= w.Config.MaxRetries {
+			return
+		}
+
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		w.logger().Warnf("Webhook: %s, retrying in %s...", err, wait)
+		sleepOn(w.clock(), wait)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// post sends a single request. It returns a negative retryAfter if
+// the error is not retryable, and a positive one if the server
+// asked to wait.
+func (w *Webhook) post(req webhookRequest, body []byte, contentType string) (retryAfter time.Duration, err error) {
+	httpReq, err := http.NewRequest(http.MethodPost, req.url, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	httpReq.Header = req.header.Clone()
+	if httpReq.Header.Get("Content-Type") == "" {
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+	if w.Secret != "" {
+		httpReq.Header.Set(w.signatureHeader(), "sha256="+sign(w.Secret, body))
+	}
+
+	resp, err := w.client.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(s) * time.Second
+		}
+		return retryAfter, fmt.Errorf("%s responded %s", req.url, resp.Status)
+	default:
+		return -1, errors.New(req.url + " responded " + resp.Status)
+	}
+}
+
+func (w *Webhook) signatureHeader() string {
+	if h, ok := w.Args["signatureHeader"]; ok {
+		return h
+	}
+	return "X-Signature"
+}
+
+// sign returns the hex encoded HMAC-SHA256 of `body` using `secret`.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,153 @@
+package stream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhook_Write(t *testing.T) {
+	var gotPath, gotSignature, gotTenant, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		gotPath = r.URL.Path
+		gotSignature = r.Header.Get("X-Signature")
+		gotTenant = r.Header.Get("X-Tenant")
+		gotBody = string(body)
+	}))
+	defer server.Close()
+
+	dest := &Webhook{
+		URL:    server.URL + "/events/{{.Fields.type}}",
+		Header: http.Header{"X-Tenant": []string{"{{.Metadata.tenant}}"}},
+		Secret: "secret",
+	}
+	assert.NoError(t, dest.Connect())
+
+	m := message.New(`{"type":"purchase"}`)
+	m.Metadata["tenant"] = "acme"
+	assert.NoError(t, dest.WriteMessage(m))
+	assert.NoError(t, dest.Disconnect())
+
+	assert.Equal(t, "/events/purchase", gotPath)
+	assert.Equal(t, "acme", gotTenant)
+	assert.Equal(t, `{"type":"purchase"}`, gotBody)
+	assert.Equal(t, "sha256="+sign("secret", []byte(gotBody)), gotSignature)
+}
+
+func TestWebhook_Retry(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	dest := &Webhook{URL: server.URL, Config: &WebhookConfig{MaxRetries: 2}}
+	assert.NoError(t, dest.Connect())
+	assert.NoError(t, dest.Write("{}"))
+	assert.Equal(t, 3, calls)
+
+	// client errors are not retried
+	calls = 0
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	assert.Error(t, dest.Write("{}"))
+	assert.Equal(t, 1, calls)
+}
+
+func TestWebhook_Batch(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	dest := &Webhook{
+		URL:    server.URL,
+		Config: &WebhookConfig{BatchSize: 2, Concurrency: 2},
+	}
+	assert.NoError(t, dest.Connect())
+	for _, m := range []string{"1", "2", "3"} {
+		assert.NoError(t, dest.Write(m))
+	}
+	assert.NoError(t, dest.Disconnect())
+
+	sort.Strings(bodies)
+	assert.Equal(t, []string{"1\n2", "3"}, bodies)
+}
+
+func TestWebhook_BatchFailuresReachPipeline(t *testing.T) {
+	var mu sync.Mutex
+	batches := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		// messages of a batch aren't ordered
+		lines := strings.Split(string(body), "\n")
+		sort.Strings(lines)
+		mu.Lock()
+		batches[r.Header.Get("X-Tenant")] = strings.Join(lines, "\n")
+		mu.Unlock()
+		if r.Header.Get("X-Tenant") == "b" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	dest := &Webhook{
+		URL:    server.URL,
+		Header: http.Header{"X-Tenant": {"{{.Fields.tenant}}"}},
+		Config: &WebhookConfig{BatchSize: 2, Concurrency: 2},
+	}
+	dlq := &memory{}
+	p := &Pipeline{Destination: dest, DLQ: dlq}
+	assert.NoError(t, dest.Connect())
+
+	var acks []error
+	channel := make(chan message.Message, 3)
+	for _, body := range []string{`{"tenant":"a","n":1}`, `{"tenant":"b","n":2}`, `{"tenant":"a","n":3}`} {
+		m := message.New(body)
+		m.Ack = func(err error) {
+			mu.Lock()
+			acks = append(acks, err)
+			mu.Unlock()
+		}
+		channel <- m
+	}
+	close(channel)
+	p.flow(channel)
+	assert.NoError(t, dest.Disconnect())
+
+	// batches don't mix headers
+	assert.Equal(t, map[string]string{
+		"a": `{"tenant":"a","n":1}` + "\n" + `{"tenant":"a","n":3}`,
+		"b": `{"tenant":"b","n":2}`,
+	}, batches)
+	// the failed message was quarantined before being acknowledged
+	assert.Len(t, dlq.messages, 1)
+	assert.Contains(t, dlq.messages[0], "400 Bad Request")
+	handled := 0
+	for _, err := range acks {
+		if message.Handled(err) {
+			handled++
+		}
+	}
+	assert.Equal(t, 3, handled)
+	assert.Equal(t, uint64(2), p.Stats().Sent)
+}
@@ -8,7 +8,6 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
-	log "github.com/sirupsen/logrus"
 )
 
 // WebSocket represents a websocket connection.
@@ -30,11 +29,16 @@ type WebSocket struct {
 	swap   chan bool            // conn swap signal
 	disc   map[string]chan bool // disconnect signal map (creates multiple  channels)
 	wg     sync.WaitGroup
+	logged
+}
+
+func (w *WebSocket) Capabilities() Capabilities {
+	return Capabilities{Ordering: true}
 }
 
 // Info logs the websocket connection information.
 func (w *WebSocket) Info() {
-	log.Info("URL: ", w.URL)
+	w.logger().Info("URL: ", w.URL)
 }
 
 // Connect creates a new connection and launches a go
@@ -49,7 +53,7 @@ func (w *WebSocket) Connect() (err error) {
 	}
 
 	if _, ok := w.Args["reconnect_every"]; ok {
-		log.Info("Got `reconnect_every` arg, launching `Reconnect` goroutine...")
+		w.logger().Info("Got `reconnect_every` arg, launching `Reconnect` goroutine...")
 		w.wg.Add(1)
 		go w.Reconnect()
 	}
@@ -61,28 +65,28 @@ func (w *WebSocket) Connect() (err error) {
 // and interested parties get a notification to clean up,
 // then it closes the web socket connection.
 func (w *WebSocket) Disconnect() (err error) {
-	log.Info("WebSocket: Disconnect() started")
+	w.logger().Info("WebSocket: Disconnect() started")
 
 	// close connection
 	if w.conn != nil {
-		err = closeWebSocket(w.conn)
+		err = closeWebSocket(w.conn, w.logger())
 		w.conn = nil
 	}
 
 	// send a disconnect signal
 	if _, ok := w.Args["reconnect_every"]; ok {
-		log.Info("Sending disc signal to all channels.")
+		w.logger().Info("Sending disc signal to all channels.")
 		for name, c := range w.disc {
-			log.Infof("Sending to channel %s...", name)
+			w.logger().Infof("Sending to channel %s...", name)
 			c <- true
-			log.Infof("Sent disc signal to channel %s", name)
+			w.logger().Infof("Sent disc signal to channel %s", name)
 		}
 	}
 
 	// wait for go routines to finish
-	log.Info("Waiting for goroutines to finish...")
+	w.logger().Info("Waiting for goroutines to finish...")
 	w.wg.Wait()
-	log.Info("Goroutines finished.")
+	w.logger().Info("Goroutines finished.")
 
 	return
 }
@@ -100,21 +104,21 @@ func (w *WebSocket) Reconnect() (err error) {
 		if n, err := strconv.Atoi(val); err == nil {
 			reconnectEvery = time.Duration(n)
 		} else {
-			log.Errorln(val, "is not an integer.")
+			w.logger().Error(val, "is not an integer.")
 		}
 	}
-	log.Info("Reconnecting every ", reconnectEvery)
+	w.logger().Info("Reconnecting every ", reconnectEvery)
 
 	prevConn := w.conn
 	for {
 		// check for a disconnect signal, quit if received
 		select {
 		case <-w.disc["reconnect"]:
-			log.Warn("Reconnect(): Received disconnect signal")
+			w.logger().Warn("Reconnect(): Received disconnect signal")
 			w.wg.Done()
 			return
 		case <-time.After(reconnectEvery):
-			log.Warn("WebSocket.Reconnect(): Swapping connections...")
+			w.logger().Warn("WebSocket.Reconnect(): Swapping connections...")
 
 			// send a swapping started signal
 			w.swap <- true
@@ -125,10 +129,10 @@ func (w *WebSocket) Reconnect() (err error) {
 				continue
 			}
 
-			log.Warn("WebSocket.Reconnect(): Connection swapped successfully.")
-			log.Trace("prevConn: ", prevConn.UnderlyingConn())
-			log.Trace("w.conn: ", w.conn.UnderlyingConn())
-			closeWebSocket(prevConn)
+			w.logger().Warn("WebSocket.Reconnect(): Connection swapped successfully.")
+			w.logger().Trace("prevConn: ", prevConn.UnderlyingConn())
+			w.logger().Trace("w.conn: ", w.conn.UnderlyingConn())
+			closeWebSocket(prevConn, w.logger())
 			prevConn = w.conn
 
 			// send a swapping stopped signal
@@ -145,7 +149,7 @@ func (w *WebSocket) Write(message string) (err error) {
 
 	err = w.conn.WriteMessage(websocket.TextMessage, []byte(message))
 	if err != nil {
-		log.Error(err)
+		w.logger().Error(err)
 	}
 	return
 }
@@ -166,12 +170,12 @@ func (w *WebSocket) Read() (channel chan string, err error) {
 		for {
 			select {
 			case <-w.disc["read"]:
-				log.Warn("Read(): Received disconnect signal")
+				w.logger().Warn("Read(): Received disconnect signal")
 				w.wg.Done()
 				return
 			case swap := <-w.swap:
 				// swap signal received:
-				log.Tracef("swap signal received: %t", swap)
+				w.logger().Tracef("swap signal received: %t", swap)
 				// if swap started (true), wait for a false signal
 				if swap {
 					_ = <-w.swap
@@ -182,12 +186,12 @@ func (w *WebSocket) Read() (channel chan string, err error) {
 			default:
 				// no disc or swap signal received
 				if w.conn != nil {
-					log.Trace("Read() iteration, w.conn: ", w.conn.UnderlyingConn())
+					w.logger().Trace("Read() iteration, w.conn: ", w.conn.UnderlyingConn())
 
 					_, messageBytes, err := w.conn.ReadMessage()
-					log.Debug("ReadMessage() done")
+					w.logger().Debug("ReadMessage() done")
 					if err != nil {
-						log.Warning("ReadMessage() error: ", err)
+						w.logger().Warn("ReadMessage() error: ", err)
 
 						if w.conn != nil {
 							// ReadMessage() should not receive an error as Disconnect() nullifies w.conn
@@ -197,9 +201,9 @@ func (w *WebSocket) Read() (channel chan string, err error) {
 						continue
 					}
 
-					log.Debug("trying to push messageBytes into channel")
+					w.logger().Debug("trying to push messageBytes into channel")
 					channel <- string(messageBytes)
-					log.Debug("channel <- messageBytes successful")
+					w.logger().Debug("channel <- messageBytes successful")
 				}
 			}
 		}
@@ -210,32 +214,32 @@ func (w *WebSocket) Read() (channel chan string, err error) {
 // newConnection attempts to connect the URL in WebSocket
 // and return a connection.
 func (w *WebSocket) newConnection() (err error) {
-	log.Info("Establishing websocket connection...")
+	w.logger().Info("Establishing websocket connection...")
 	var conn *websocket.Conn
 	conn, _, err = websocket.DefaultDialer.Dial(w.URL, w.Header)
 	w.conn = conn
 	if err == nil {
-		log.Info("Websocket connection established.")
+		w.logger().Info("Websocket connection established.")
 	} else {
-		log.Error("WebSocket.newConnection: websocket.Dial: ", err)
+		w.logger().Error("WebSocket.newConnection: websocket.Dial: ", err)
 	}
 	return
 }
 
 // closeWebSocket closes the websocet connection in `conn`.
-func closeWebSocket(conn *websocket.Conn) (err error) {
+func closeWebSocket(conn *websocket.Conn, logger Logger) (err error) {
 	if conn == nil {
 		err = errors.New("conn is nil")
 		return
 	}
 
-	log.Info("Closing websocket connection...")
+	logger.Info("Closing websocket connection...")
 	err = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	if err != nil {
-		log.Error("Websocket write close error: ", err)
+		logger.Error("Websocket write close error: ", err)
 		return
 	}
-	log.Info("Websocket connection closed.")
+	logger.Info("Websocket connection closed.")
 
 	return
 }
@@ -0,0 +1,499 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// Window metadata keys set on aggregates.
+const (
+	MetaWindowKey   = "window.key"
+	MetaWindowStart = "window.start"
+	MetaWindowEnd   = "window.end"
+)
+
+// errLate is returned for messages of windows that already closed.
+var errLate = errors.New("Window: message is later than the allowed lateness")
+
+// errAhead is returned for messages too far ahead of the clock to
+// advance the watermark.
+var errAhead = errors.New("Window: message time is ahead of the clock by more than the allowed skew")
+
+// Window groups messages by key into time windows and writes an
+// aggregate per key and window to Destination when the window closes.
+//
+// Windows are Config.Size seconds long and start every Config.Slide
+// seconds: tumbling windows when Slide equals Size (the default),
+// sliding windows when it is smaller, in which case a message belongs
+// to several windows.
+//
+// Message times are read from Config.TimeField (milliseconds since
+// epoch, or an RFC 3339 string), or are the time of writing. The
+// watermark is the latest message time minus Config.AllowedLateness
+// (or the current time without TimeField); a window closes once the
+// watermark passes its end and later messages for it are rejected
+// with an error. Messages more than Config.MaxClockSkew seconds ahead
+// of the clock are rejected rather than advancing the watermark, so a
+// bad timestamp can't close every window. Open windows are flushed on
+// Disconnect.
+//
+// Messages written with WriteAsync (as pipelines do) are
+// acknowledged once the aggregates of all of their windows are
+// written, so that open windows are rebuilt from redelivered messages
+// after a restart. Windows hold up to Config.MaxPending such
+// acknowledgements, which must be below the pipeline's MaxInFlight
+// to keep it flowing: beyond it, the messages of the oldest windows
+// are acknowledged once folded.
+//
+// Aggregates are written in order of their end, outside the lock
+// messages are added under. Failed writes are retried with backoff
+// Config.MaxRetries times, then the messages of the window fail with
+// the error.
+//
+// Key is a template executed against each message (see
+// templateData), all messages share a key if it is empty. Aggregates
+// are JSON objects:
+//
+//	{"key": "d1", "start": "...", "end": "...", "count": 3,
+//	 "sum": {"temp": 64.5}, "value": ...}
+//
+// where `sum` sums the numeric Config.SumFields and `value` is the
+// result of Reduce, if set. Reduce folds a message into the
+// accumulator of its window, which is nil for the first message.
+type Window struct {
+	Destination Destination `json:"-"`
+	Key         string
+	Config      *WindowConfig
+	Reduce      func(acc interface{}, m message.Message) interface{} `json:"-"`
+	key         *template.Template
+	mu          sync.Mutex
+	windows     map[windowID]*aggregate
+	watermark   time.Time
+	pending     int  // acknowledgements held by windows
+	closing     bool // a goroutine is writing aggregates
+	failures    int  // consecutive failed writes
+	retryAt     time.Time
+	done        chan bool
+	wg          sync.WaitGroup
+	clocked
+	logged
+}
+
+// WindowConfig configures window sizes and aggregates.
+type WindowConfig struct {
+	Size            int // seconds
+	Slide           int // seconds, defaults to Size
+	AllowedLateness int // seconds
+	MaxClockSkew    int // seconds, defaults to 300
+	TimeField       string
+	SumFields       []string
+	MaxPending      int // acknowledgements held by open windows, defaults to 5000
+	MaxRetries      int // retries of failed aggregate writes, defaults to 3
+}
+
+type windowID struct {
+	key   string
+	start int64 // unix nanoseconds
+}
+
+type aggregate struct {
+	key   string
+	start time.Time
+	end   time.Time
+	count int64
+	sum   map[string]float64
+	value interface{}
+	acks  []func(error)
+}
+
+func (w *Window) Connect() (err error) {
+	if w.Config == nil || w.Config.Size < 1 {
+		return errors.New("Window: size must be configured")
+	}
+	if w.Config.Slide < 1 || w.Config.Slide > w.Config.Size {
+		w.Config.Slide = w.Config.Size
+	}
+	if w.Config.MaxClockSkew < 1 {
+		w.Config.MaxClockSkew = 300
+	}
+	if w.Config.MaxPending < 1 {
+		w.Config.MaxPending = 5000
+	}
+	if w.Config.MaxRetries < 1 {
+		w.Config.MaxRetries = 3
+	}
+
+	w.key, err = newTemplate("key", w.Key)
+	if err != nil {
+		return
+	}
+	err = w.Destination.Connect()
+	if err != nil {
+		return
+	}
+
+	w.windows = map[windowID]*aggregate{}
+	w.done = make(chan bool)
+	// processing time windows close with the clock, failed writes
+	// are retried
+	w.wg.Add(1)
+	go w.ticker()
+	return
+}
+
+// Disconnect writes the aggregates of open windows and disconnects
+// Destination.
+func (w *Window) Disconnect() (err error) {
+	if w.done != nil {
+		close(w.done)
+		w.wg.Wait()
+		w.done = nil
+	}
+
+	w.mu.Lock()
+	w.watermark = time.Unix(0, 1<<62)
+	w.mu.Unlock()
+	for {
+		w.close()
+
+		w.mu.Lock()
+		open, retryAt := len(w.windows), w.retryAt
+		w.mu.Unlock()
+		if open == 0 {
+			break
+		}
+		sleepOn(w.clock(), retryAt.Sub(w.clock().Now()))
+	}
+
+	return w.Destination.Disconnect()
+}
+
+// SetClock sets the clock of the window and of Destination.
+func (w *Window) SetClock(clock Clock) {
+	w.clocked.SetClock(clock)
+	if c, ok := w.Destination.(Clocked); ok {
+		c.SetClock(clock)
+	}
+}
+
+// SetLogger sets the logger of the window and of Destination.
+func (w *Window) SetLogger(logger Logger) {
+	w.logged.SetLogger(logger)
+	setLogger(w.Destination, logger)
+}
+
+// Resources returns the resources of Destination.
+func (w *Window) Resources() []Resource {
+	return Resources(w.Destination)
+}
+
+// Capabilities of a window: aggregates are written to Destination,
+// once.
+func (w *Window) Capabilities() Capabilities {
+	c := ConnectorCapabilities(w.Destination)
+	return Capabilities{ConfirmedWrites: c.ConfirmedWrites, Batching: true, Schemas: c.Schemas}
+}
+
+func (w *Window) Info() {
+	w.logger().Info("Window.Key: ", w.Key)
+	w.logger().Infof("WindowConfig: %+v", *w.Config)
+	w.Destination.Info()
+}
+
+func (w *Window) Write(body string) (err error) {
+	return w.WriteMessage(message.New(body))
+}
+
+// WriteMessage adds `m` to the windows it belongs to and closes the
+// windows passed by the watermark.
+func (w *Window) WriteMessage(m message.Message) (err error) {
+	_, err = w.add(m, nil)
+	w.close()
+	return
+}
+
+// WriteAsync adds `m` to the windows it belongs to like WriteMessage
+// and calls `done` once their aggregates are written.
+func (w *Window) WriteAsync(m message.Message, done func(error)) {
+	released, err := w.add(m, done)
+	if err != nil {
+		done(err)
+	}
+	for _, ack := range released {
+		ack(nil)
+	}
+	w.close()
+}
+
+// add folds `m` into the windows it belongs to. `done` (if not nil)
+// is called once all of them have been written, unless an error is
+// returned. It returns the acknowledgements released to stay within
+// Config.MaxPending.
+func (w *Window) add(m message.Message, done func(error)) (released []func(error), err error) {
+	key, err := executeTemplate(w.key, m)
+	if err != nil {
+		return
+	}
+	ts, err := w.time(m)
+	if err != nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.Config.TimeField != "" {
+		if ts.After(w.clock().Now().Add(time.Duration(w.Config.MaxClockSkew) * time.Second)) {
+			return nil, errAhead
+		}
+		watermark := ts.Add(-time.Duration(w.Config.AllowedLateness) * time.Second)
+		if watermark.After(w.watermark) {
+			w.watermark = watermark
+		}
+	}
+
+	size := time.Duration(w.Config.Size) * time.Second
+	slide := time.Duration(w.Config.Slide) * time.Second
+	// windows start every slide since the epoch, those starting in
+	// (ts - size, ts] contain the message
+	var open []*aggregate
+	first := time.Unix(0, ts.UnixNano()-ts.UnixNano()%int64(slide))
+	for start := first; start.After(ts.Add(-size)); start = start.Add(-slide) {
+		end := start.Add(size)
+		if !end.After(w.watermark) {
+			continue
+		}
+
+		id := windowID{key: key, start: start.UnixNano()}
+		agg, ok := w.windows[id]
+		if !ok {
+			agg = &aggregate{key: key, start: start, end: end, sum: map[string]float64{}}
+			w.windows[id] = agg
+		}
+		open = append(open, agg)
+	}
+	if len(open) == 0 {
+		return nil, errLate
+	}
+
+	ack := group(len(open), done)
+	for _, agg := range open {
+		w.fold(agg, m)
+		if done != nil {
+			agg.acks = append(agg.acks, ack)
+			w.pending++
+		}
+	}
+
+	// rather than stall a pipeline waiting for acknowledgements,
+	// release those of the oldest windows
+	for w.pending > w.Config.MaxPending {
+		oldest := w.oldest()
+		w.logger().Warnf("Window: %d message(s) pending, acknowledging the %d of the window of %s ending at %s", w.pending, len(oldest.acks), oldest.key, oldest.end)
+		released = append(released, oldest.acks...)
+		w.pending -= len(oldest.acks)
+		oldest.acks = nil
+	}
+	return
+}
+
+// time returns the time of `m`.
+func (w *Window) time(m message.Message) (time.Time, error) {
+	if w.Config.TimeField == "" {
+		return w.clock().Now(), nil
+	}
+
+	var fields map[string]interface{}
+	err := json.Unmarshal([]byte(m.Body), &fields)
+	if err != nil {
+		return time.Time{}, err
+	}
+	v, ok := fields[w.Config.TimeField]
+	if !ok {
+		return time.Time{}, errors.New("Window: message has no time field " + w.Config.TimeField)
+	}
+	return fieldTime(v)
+}
+
+// fold folds `m` into `agg`.
+func (w *Window) fold(agg *aggregate, m message.Message) {
+	agg.count++
+
+	if len(w.Config.SumFields) > 0 {
+		var fields map[string]interface{}
+		json.Unmarshal([]byte(m.Body), &fields)
+		for _, name := range w.Config.SumFields {
+			if v, ok := fields[name].(float64); ok {
+				agg.sum[name] += v
+			}
+		}
+	}
+
+	if w.Reduce != nil {
+		agg.value = w.Reduce(agg.value, m)
+	}
+}
+
+// oldest returns the window holding acknowledgements that ends
+// first, w.mu must be held.
+func (w *Window) oldest() *aggregate {
+	var oldest *aggregate
+	for _, agg := range w.windows {
+		if len(agg.acks) > 0 && (oldest == nil || agg.end.Before(oldest.end)) {
+			oldest = agg
+		}
+	}
+	return oldest
+}
+
+// close writes and removes the windows passed by the watermark, in
+// order of their end. A single goroutine writes at a time, without
+// holding w.mu; windows closing meanwhile are written by it too.
+func (w *Window) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closing {
+		return
+	}
+	w.closing = true
+	defer func() { w.closing = false }()
+
+	for {
+		closed := w.closed()
+		if len(closed) == 0 {
+			return
+		}
+
+		w.mu.Unlock()
+		written := 0
+		var err error
+		for _, agg := range closed {
+			err = w.emit(agg)
+			if err != nil {
+				break
+			}
+			for _, ack := range agg.acks {
+				ack(nil)
+			}
+			written++
+		}
+		w.mu.Lock()
+
+		if err == nil {
+			w.failures = 0
+			continue
+		}
+		acks := w.failed(closed[written:], err)
+		w.mu.Unlock()
+		for _, ack := range acks {
+			ack(err)
+		}
+		w.mu.Lock()
+		return
+	}
+}
+
+// closed removes and returns the windows passed by the watermark in
+// order of their end, unless failed writes are backing off, w.mu
+// must be held.
+func (w *Window) closed() []*aggregate {
+	if w.clock().Now().Before(w.retryAt) {
+		return nil
+	}
+
+	var closed []*aggregate
+	for id, agg := range w.windows {
+		if !agg.end.After(w.watermark) {
+			closed = append(closed, agg)
+			delete(w.windows, id)
+			w.pending -= len(agg.acks)
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool {
+		a, b := closed[i], closed[j]
+		if !a.end.Equal(b.end) {
+			return a.end.Before(b.end)
+		}
+		return a.key < b.key
+	})
+	return closed
+}
+
+// failed puts back `aggs`, whose first failed to be written with
+// `err`, to be retried with backoff. Once retries are exhausted the
+// first is dropped and the acknowledgements of its messages, to be
+// failed with `err`, are returned. w.mu must be held.
+func (w *Window) failed(aggs []*aggregate, err error) (acks []func(error)) {
+	if w.failures >= w.Config.MaxRetries {
+		agg := aggs[0]
+		w.logger().Errorf("Window: Failed to write aggregate of %s after %d retries: %s", agg.key, w.failures, err)
+		acks = agg.acks
+		w.failures = 0
+		aggs = aggs[1:]
+	} else {
+		backoff := 500 * time.Millisecond << uint(w.failures)
+		w.logger().Warnf("Window: Failed to write aggregate: %s, retrying in %s...", err, backoff)
+		w.failures++
+		w.retryAt = w.clock().Now().Add(backoff)
+	}
+
+	for _, agg := range aggs {
+		w.windows[windowID{key: agg.key, start: agg.start.UnixNano()}] = agg
+		w.pending += len(agg.acks)
+	}
+	return
+}
+
+// emit writes the aggregate of a closed window.
+func (w *Window) emit(agg *aggregate) error {
+	out := map[string]interface{}{
+		"key":   agg.key,
+		"start": agg.start.UTC().Format(time.RFC3339Nano),
+		"end":   agg.end.UTC().Format(time.RFC3339Nano),
+		"count": agg.count,
+	}
+	if len(w.Config.SumFields) > 0 {
+		out["sum"] = agg.sum
+	}
+	if w.Reduce != nil {
+		out["value"] = agg.value
+	}
+
+	body, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	m := message.New(string(body))
+	m.Metadata[MetaWindowKey] = agg.key
+	m.Metadata[MetaWindowStart] = out["start"].(string)
+	m.Metadata[MetaWindowEnd] = out["end"].(string)
+	return writeMessage(w.Destination, m)
+}
+
+// ticker closes processing time windows as time passes, and retries
+// failed writes.
+func (w *Window) ticker() {
+	defer w.wg.Done()
+
+	ticker := w.clock().NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case now := <-ticker.C():
+			w.mu.Lock()
+			if w.Config.TimeField == "" && now.After(w.watermark) {
+				w.watermark = now
+			}
+			w.mu.Unlock()
+			w.close()
+		}
+	}
+}
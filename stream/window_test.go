@@ -0,0 +1,160 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWindow_Tumbling(t *testing.T) {
+	dest := &memory{}
+	w := &Window{
+		Destination: dest,
+		Key:         "{{.Fields.device}}",
+		Config: &WindowConfig{
+			Size:            60,
+			AllowedLateness: 10,
+			TimeField:       "ts",
+			SumFields:       []string{"temp"},
+		},
+		Reduce: func(acc interface{}, m message.Message) interface{} {
+			if acc == nil {
+				return 1
+			}
+			return acc.(int) + 1
+		},
+	}
+	assert.NoError(t, w.Connect())
+
+	assert.NoError(t, w.Write(`{"device":"d1","temp":20,"ts":"2020-10-01T12:00:10Z"}`))
+	assert.NoError(t, w.Write(`{"device":"d2","temp":18,"ts":"2020-10-01T12:00:20Z"}`))
+	assert.NoError(t, w.Write(`{"device":"d1","temp":22,"ts":"2020-10-01T12:01:05Z"}`))
+	// within the allowed lateness
+	assert.NoError(t, w.Write(`{"device":"d1","temp":21,"ts":"2020-10-01T12:00:59Z"}`))
+	assert.Empty(t, dest.messages)
+
+	// the watermark passes 12:01, closing the first windows
+	assert.NoError(t, w.Write(`{"device":"d1","temp":23,"ts":"2020-10-01T12:01:11Z"}`))
+	assert.Equal(t, []string{
+		`{"count":2,"end":"2020-10-01T12:01:00Z","key":"d1","start":"2020-10-01T12:00:00Z","sum":{"temp":41},"value":2}`,
+		`{"count":1,"end":"2020-10-01T12:01:00Z","key":"d2","start":"2020-10-01T12:00:00Z","sum":{"temp":18},"value":1}`,
+	}, dest.messages)
+
+	assert.Equal(t, errLate, w.Write(`{"device":"d1","temp":19,"ts":"2020-10-01T12:00:30Z"}`))
+
+	assert.NoError(t, w.Disconnect())
+	assert.Len(t, dest.messages, 3)
+	assert.Equal(t, `{"count":2,"end":"2020-10-01T12:02:00Z","key":"d1","start":"2020-10-01T12:01:00Z","sum":{"temp":45},"value":2}`, dest.messages[2])
+}
+
+func TestWindow_Sliding(t *testing.T) {
+	dest := &memory{}
+	w := &Window{
+		Destination: dest,
+		Config:      &WindowConfig{Size: 60, Slide: 30, TimeField: "ts"},
+	}
+	assert.NoError(t, w.Connect())
+	assert.NoError(t, w.Write(`{"ts":"2020-10-01T12:00:40Z"}`))
+	assert.NoError(t, w.Write(`{"ts":"2020-10-01T12:01:10Z"}`))
+	assert.NoError(t, w.Disconnect())
+
+	// 12:00:40 is in [12:00:00, 12:01:00) and [12:00:30, 12:01:30),
+	// 12:01:10 in [12:00:30, 12:01:30) and [12:01:00, 12:02:00)
+	assert.Equal(t, []string{
+		`{"count":1,"end":"2020-10-01T12:01:00Z","key":"","start":"2020-10-01T12:00:00Z"}`,
+		`{"count":2,"end":"2020-10-01T12:01:30Z","key":"","start":"2020-10-01T12:00:30Z"}`,
+		`{"count":1,"end":"2020-10-01T12:02:00Z","key":"","start":"2020-10-01T12:01:00Z"}`,
+	}, dest.messages)
+}
+
+func TestWindow_WriteAsync(t *testing.T) {
+	dest := &memory{}
+	w := &Window{
+		Destination: dest,
+		Config:      &WindowConfig{Size: 60, Slide: 30, TimeField: "ts"},
+	}
+	assert.NoError(t, w.Connect())
+
+	var acks []error
+	done := func(err error) { acks = append(acks, err) }
+	w.WriteAsync(message.New(`{"ts":"2020-10-01T12:00:40Z"}`), done)
+	w.WriteAsync(message.New(`{"ts":"2020-10-01T12:00:20Z"}`), done)
+	// [12:00:00, 12:01:00) is written, the first message is still
+	// in [12:00:30, 12:01:30)
+	w.WriteAsync(message.New(`{"ts":"2020-10-01T12:01:10Z"}`), done)
+	assert.Len(t, dest.messages, 1)
+	assert.Equal(t, []error{nil}, acks)
+
+	w.WriteAsync(message.New(`{"ts":"2020-10-01T11:59:00Z"}`), done)
+	assert.Equal(t, []error{nil, errLate}, acks)
+
+	assert.NoError(t, w.Disconnect())
+	assert.Len(t, dest.messages, 3)
+	assert.Equal(t, []error{nil, errLate, nil, nil}, acks)
+}
+
+func TestWindow_WriteFailures(t *testing.T) {
+	dest := &memory{fail: 1}
+	w := &Window{
+		Destination: dest,
+		Config:      &WindowConfig{Size: 60, TimeField: "ts", MaxRetries: 1},
+	}
+	assert.NoError(t, w.Connect())
+
+	var acks []error
+	w.WriteAsync(message.New(`{"ts":"2020-10-01T12:00:10Z"}`), func(err error) { acks = append(acks, err) })
+	w.WriteAsync(message.New(`{"ts":"2020-10-01T12:01:10Z"}`), func(err error) { acks = append(acks, err) })
+	// the aggregate is kept to be retried
+	assert.Empty(t, dest.messages)
+	assert.Empty(t, acks)
+
+	dest.fail = 2
+	assert.NoError(t, w.Disconnect())
+	// the first window failed again and its message fails, the
+	// second is written once the first is given up on
+	assert.Equal(t, []string{`{"count":1,"end":"2020-10-01T12:02:00Z","key":"","start":"2020-10-01T12:01:00Z"}`}, dest.messages)
+	assert.Equal(t, []error{errors.New("write failed"), nil}, acks)
+}
+
+func TestWindow_ClockSkew(t *testing.T) {
+	dest := &memory{}
+	w := &Window{
+		Destination: dest,
+		Config:      &WindowConfig{Size: 60, TimeField: "ts"},
+	}
+	assert.NoError(t, w.Connect())
+	assert.NoError(t, w.Write(`{"ts":"2020-10-01T12:00:10Z"}`))
+	// doesn't close every window
+	assert.Equal(t, errAhead, w.Write(`{"ts":"2120-10-01T12:00:00Z"}`))
+	assert.NoError(t, w.Write(`{"ts":"2020-10-01T12:00:20Z"}`))
+	assert.Empty(t, dest.messages)
+	assert.NoError(t, w.Disconnect())
+	assert.Equal(t, []string{`{"count":2,"end":"2020-10-01T12:01:00Z","key":"","start":"2020-10-01T12:00:00Z"}`}, dest.messages)
+}
+
+func TestWindow_MaxPending(t *testing.T) {
+	dest := &memory{}
+	w := &Window{
+		Destination: dest,
+		Key:         "{{.Fields.device}}",
+		Config:      &WindowConfig{Size: 60, AllowedLateness: 60, TimeField: "ts", MaxPending: 2},
+	}
+	assert.NoError(t, w.Connect())
+
+	acks := map[string]int{}
+	for _, body := range []string{
+		`{"device":"d1","ts":"2020-10-01T12:00:10Z"}`,
+		`{"device":"d2","ts":"2020-10-01T12:01:05Z"}`,
+		`{"device":"d2","ts":"2020-10-01T12:01:20Z"}`,
+	} {
+		body := body
+		w.WriteAsync(message.New(body), func(err error) { acks[body]++ })
+	}
+	// the messages of the oldest window are acknowledged when folded
+	assert.Empty(t, dest.messages)
+	assert.Equal(t, map[string]int{`{"device":"d1","ts":"2020-10-01T12:00:10Z"}`: 1}, acks)
+	assert.NoError(t, w.Disconnect())
+	assert.Len(t, acks, 3)
+}
@@ -0,0 +1,108 @@
+package stream
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// OrderingMode decides which worker processes a message when
+// Pipeline.Workers is above 1.
+type OrderingMode int
+
+const (
+	// Unordered hands messages to the first free worker.
+	Unordered OrderingMode = iota
+	// OrderedByKey hashes messages by the value of their PartitionKey
+	// metadata key (as read from the source) onto the queue of a
+	// worker, which processes them one at a time: messages of a key
+	// are decoded, transformed and written in the order they're read,
+	// while other keys are processed by other workers.
+	OrderedByKey
+)
+
+// workers decode, transform and deliver messages read by a
+// pipeline from queues, a queue per worker with OrderedByKey and a
+// shared one otherwise.
+type workers struct {
+	queues []chan message.Message
+	byKey  bool
+	key    string // PartitionKey
+	waits  uint64 // pushes that waited on a full queue
+	wg     sync.WaitGroup
+}
+
+// startWorkers starts Workers workers calling `handle` for each
+// message pushed to them.
+func (p *Pipeline) startWorkers(handle func(message.Message)) *workers {
+	size := p.WorkerQueueSize
+	if size < 1 {
+		size = 1000
+	}
+	w := &workers{byKey: p.Ordering == OrderedByKey, key: p.PartitionKey}
+	queues := 1
+	if w.byKey {
+		queues = p.Workers
+	}
+	for i := 0; i < queues; i++ {
+		w.queues = append(w.queues, make(chan message.Message, size))
+	}
+
+	for i := 0; i < p.Workers; i++ {
+		queue := w.queues[i%queues]
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for msg := range queue {
+				handle(msg)
+			}
+		}()
+	}
+	p.workers.Store(w)
+	return w
+}
+
+// push queues `msg`, waiting for room if its queue is full.
+func (w *workers) push(msg message.Message) {
+	queue := w.queues[0]
+	if w.byKey {
+		h := fnv.New32a()
+		h.Write([]byte(msg.Metadata.Get(w.key)))
+		queue = w.queues[h.Sum32()%uint32(len(w.queues))]
+	}
+
+	select {
+	case queue <- msg:
+	default:
+		atomic.AddUint64(&w.waits, 1)
+		queue <- msg
+	}
+}
+
+// stop waits for the workers to process the messages queued so far.
+func (w *workers) stop() {
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.wg.Wait()
+}
+
+// depths returns the number of messages in each queue.
+func (w *workers) depths() []int {
+	depths := make([]int, len(w.queues))
+	for i, queue := range w.queues {
+		depths[i] = len(queue)
+	}
+	return depths
+}
+
+// ordered reports whether the messages of a partition are written in
+// the order they're read, whatever the connectors.
+func (p *Pipeline) ordered() bool {
+	if p.Workers > 1 {
+		return p.Ordering == OrderedByKey
+	}
+	return !buffered(p.Destination) || p.OnFailure == PausePartition
+}
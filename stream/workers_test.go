@@ -0,0 +1,104 @@
+package stream
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// jitter is a transformer taking a random time.
+type jitter struct{}
+
+func (jitter) Info() {}
+func (jitter) Transform(body string) (string, error) {
+	time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+	return body, nil
+}
+
+// gate is a transformer waiting for its channel to be closed.
+type gate chan struct{}
+
+func (g gate) Info() {}
+func (g gate) Transform(body string) (string, error) {
+	<-g
+	return body, nil
+}
+
+func keyed(key string, body string) message.Message {
+	m := message.New(body)
+	m.Metadata["entity"] = key
+	return m
+}
+
+func TestPipeline_OrderedByKey(t *testing.T) {
+	src := make(channelSource)
+	dest := &memory{}
+	p := &Pipeline{
+		Source:       src,
+		Transformer:  jitter{},
+		Destination:  dest,
+		PartitionKey: "entity",
+		Workers:      4,
+		Ordering:     OrderedByKey,
+	}
+	go func() {
+		for i := 0; i < 50; i++ {
+			for _, key := range []string{"a", "b", "c", "d", "e"} {
+				src <- keyed(key, fmt.Sprintf("%s:%02d", key, i))
+			}
+		}
+		close(src)
+	}()
+	assert.NoError(t, p.RunUntilDrained())
+	assert.Len(t, dest.messages, 250)
+
+	// each key's messages are written in order
+	last := map[string]string{}
+	for _, m := range dest.messages {
+		key := strings.Split(m, ":")[0]
+		assert.True(t, m > last[key], m)
+		last[key] = m
+	}
+	assert.True(t, p.ordered())
+	p.Ordering = Unordered
+	assert.False(t, p.ordered())
+}
+
+func TestPipeline_WorkerQueues(t *testing.T) {
+	src := make(channelSource)
+	g := make(gate)
+	dest := &memory{}
+	p := &Pipeline{
+		Source:          src,
+		Transformer:     g,
+		Destination:     dest,
+		PartitionKey:    "entity",
+		Workers:         2,
+		Ordering:        OrderedByKey,
+		WorkerQueueSize: 2,
+	}
+	done := make(chan error)
+	go func() { done <- p.RunUntilDrained() }()
+
+	// a hot key fills its worker's queue
+	for i := 0; i < 3; i++ {
+		src <- keyed("hot", "hot")
+	}
+	go func() {
+		src <- keyed("hot", "hot")
+		close(src)
+	}()
+	assert.Eventually(t, func() bool {
+		stats := p.Stats()
+		return stats.QueueWaits > 0 && (fmt.Sprint(stats.Queues) == "[2 0]" || fmt.Sprint(stats.Queues) == "[0 2]")
+	}, time.Second, time.Millisecond)
+
+	close(g)
+	assert.NoError(t, <-done)
+	assert.Len(t, dest.messages, 4)
+}
@@ -0,0 +1,108 @@
+// Package avro provides transforms that serialize JSON messages to
+// Avro and back, with schemas kept in a schema registry.
+package avro
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/abstractpaper/manifold/transform/schema"
+	"github.com/linkedin/goavro/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// Encoder serializes JSON messages to Avro binary with the latest
+// schema of Subject and frames them in the registry's wire format.
+// Messages are expected in Avro's JSON encoding (union values are
+// wrapped in an object keyed by their type) and fail to transform
+// if they don't match the schema.
+type Encoder struct {
+	Registry schema.Registry
+	Subject  string
+	codecs   codecs
+}
+
+func (e *Encoder) Transform(message string) (transformed string, err error) {
+	s, err := e.Registry.Latest(e.Subject)
+	if err != nil {
+		return
+	}
+	codec, err := e.codecs.get(s)
+	if err != nil {
+		return
+	}
+
+	native, _, err := codec.NativeFromTextual([]byte(message))
+	if err != nil {
+		return "", fmt.Errorf("avro: message doesn't match schema %s: %s", s.ID, err)
+	}
+	binary, err := codec.BinaryFromNative(nil, native)
+	if err != nil {
+		return "", fmt.Errorf("avro: message doesn't match schema %s: %s", s.ID, err)
+	}
+
+	data, err := e.Registry.Encode(s, binary)
+	return string(data), err
+}
+
+func (e *Encoder) Info() {
+	log.Info("Using Avro Encoder, subject: ", e.Subject)
+}
+
+// Decoder deserializes Avro messages framed in the registry's wire
+// format to JSON (in Avro's JSON encoding), using the schema they
+// were written with.
+type Decoder struct {
+	Registry schema.Registry
+	codecs   codecs
+}
+
+func (d *Decoder) Transform(message string) (transformed string, err error) {
+	s, payload, err := d.Registry.Decode([]byte(message))
+	if err != nil {
+		return
+	}
+	codec, err := d.codecs.get(s)
+	if err != nil {
+		return
+	}
+
+	native, _, err := codec.NativeFromBinary(payload)
+	if err != nil {
+		return "", fmt.Errorf("avro: failed to decode with schema %s: %s", s.ID, err)
+	}
+	textual, err := codec.TextualFromNative(nil, native)
+	return string(textual), err
+}
+
+func (d *Decoder) Info() {
+	log.Info("Using Avro Decoder.")
+}
+
+// codecs caches codecs by schema ID.
+type codecs struct {
+	sync.Mutex
+	m map[string]*goavro.Codec
+}
+
+func (c *codecs) get(s schema.Schema) (*goavro.Codec, error) {
+	if s.Type != schema.Avro {
+		return nil, fmt.Errorf("avro: schema %s is of type %s", s.ID, s.Type)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if codec, ok := c.m[s.ID]; ok {
+		return codec, nil
+	}
+
+	codec, err := goavro.NewCodec(s.Definition)
+	if err != nil {
+		return nil, fmt.Errorf("avro: invalid schema %s: %s", s.ID, err)
+	}
+	if c.m == nil {
+		c.m = map[string]*goavro.Codec{}
+	}
+	c.m[s.ID] = codec
+	return codec, nil
+}
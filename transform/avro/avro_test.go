@@ -0,0 +1,40 @@
+package avro
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abstractpaper/manifold/transform/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+const readingSchema = `{"type":"record","name":"Reading","fields":[{"name":"device","type":"string"},{"name":"temp","type":"double"},{"name":"note","type":["null","string"],"default":null}]}`
+
+func TestAvro_RoundTrip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":1,"schema":` + jsonString(readingSchema) + `}`))
+	}))
+	defer server.Close()
+	registry := &schema.Confluent{URL: server.URL}
+
+	encoder := &Encoder{Registry: registry, Subject: "readings-value"}
+	encoded, err := encoder.Transform(`{"device":"d1","temp":21.5,"note":{"string":"ok"}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0), encoded[0])
+
+	decoder := &Decoder{Registry: registry}
+	decoded, err := decoder.Transform(encoded)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"device":"d1","temp":21.5,"note":{"string":"ok"}}`, decoded)
+
+	// validation
+	_, err = encoder.Transform(`{"device":"d1"}`)
+	assert.Error(t, err)
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
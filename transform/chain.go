@@ -0,0 +1,59 @@
+package transform
+
+import "github.com/abstractpaper/manifold/message"
+
+// Chain applies a list of transformers in order. The messages a
+// Splitter splits a message into go through the transformers after
+// it one by one (when the chain is used as a Splitter, as pipelines
+// do).
+type Chain []Transformer
+
+func (c Chain) Transform(body string) (transformed string, err error) {
+	m, err := c.TransformMessage(message.New(body))
+	return m.Body, err
+}
+
+// TransformMessage passes `m` through every transformer of the
+// chain, stopping at the first error.
+func (c Chain) TransformMessage(m message.Message) (message.Message, error) {
+	for _, t := range c {
+		var err error
+		m, err = Apply(t, m)
+		if err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+// Split passes `m` through every transformer of the chain, applying
+// each one to every message the previous ones returned. Messages
+// dropped by a transformer are left out, the error of any other
+// message fails them all.
+func (c Chain) Split(m message.Message) ([]message.Message, error) {
+	messages := []message.Message{m}
+	for _, t := range c {
+		var next []message.Message
+		for _, m := range messages {
+			split, err := ApplyAll(t, m)
+			if err == ErrDrop {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, split...)
+		}
+		messages = next
+	}
+	if len(messages) == 0 {
+		return nil, ErrDrop
+	}
+	return messages, nil
+}
+
+func (c Chain) Info() {
+	for _, t := range c {
+		t.Info()
+	}
+}
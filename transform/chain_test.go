@@ -0,0 +1,73 @@
+package transform
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/stretchr/testify/assert"
+)
+
+type upper struct{}
+
+func (upper) Transform(m string) (string, error) { return strings.ToUpper(m), nil }
+func (upper) Info()                              {}
+
+type suffix string
+
+func (s suffix) Transform(m string) (string, error) { return m + string(s), nil }
+func (s suffix) Info()                              {}
+
+type failing struct{}
+
+func (failing) Transform(m string) (string, error) { return m, errors.New("failed") }
+func (failing) Info()                              {}
+
+// words splits messages into a message per word.
+type words struct{}
+
+func (words) Transform(m string) (string, error) { return m, nil }
+func (words) Info()                              {}
+func (words) Split(m message.Message) ([]message.Message, error) {
+	var split []message.Message
+	for _, w := range strings.Fields(m.Body) {
+		split = append(split, message.Message{Body: w, Metadata: m.Metadata})
+	}
+	return split, nil
+}
+
+// short drops messages of less than 3 characters.
+type short struct{}
+
+func (short) Transform(m string) (string, error) {
+	if len(m) < 3 {
+		return m, ErrDrop
+	}
+	return m, nil
+}
+func (short) Info() {}
+
+func TestChain_Split(t *testing.T) {
+	split, err := Chain{upper{}, words{}, short{}, suffix("!")}.Split(message.New("hi hello world"))
+	assert.NoError(t, err)
+	var bodies []string
+	for _, m := range split {
+		bodies = append(bodies, m.Body)
+	}
+	assert.Equal(t, []string{"HELLO!", "WORLD!"}, bodies)
+
+	_, err = Chain{words{}, short{}}.Split(message.New("a b"))
+	assert.Equal(t, ErrDrop, err)
+	_, err = Chain{words{}, failing{}}.Split(message.New("a b"))
+	assert.EqualError(t, err, "failed")
+}
+
+func TestChain(t *testing.T) {
+	transformed, err := Chain{upper{}, suffix("!")}.Transform("hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "HELLO!", transformed)
+
+	_, err = Chain{failing{}, suffix("!")}.Transform("hello")
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+// Package decode provides transforms decoding messages as they're
+// read, to chain before other transforms: base64, gzip and zstd
+// decompression and the unwrapping of JSON envelopes of records,
+// e.g. CloudWatch Logs subscription data.
+package decode
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// Codecs of Decompress.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Base64 decodes base64 messages (standard encoding, padded or not).
+type Base64 struct{}
+
+func (b *Base64) Transform(body string) (string, error) {
+	data, err := decodeBase64(body)
+	if err != nil {
+		return "", fmt.Errorf("decode: invalid base64: %s", err)
+	}
+	return string(data), nil
+}
+
+func (b *Base64) Info() {
+	log.Info("Using Base64 Decoder.")
+}
+
+// decodeBase64 decodes `s`, ignoring surrounding whitespace.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "=") {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// Decompress decompresses gzip or zstd messages.
+//
+// Codec is Gzip, Zstd or empty to detect the codec of each message
+// from its magic number, in which case messages holding base64 of
+// compressed data (e.g. Kinesis records put as base64 text) are
+// decoded as well and other messages are passed through as is.
+//
+// Messages decompressing to more than MaxSize KB (64 MB by default)
+// fail, so that a small message can't exhaust memory.
+type Decompress struct {
+	Codec   string
+	MaxSize int
+}
+
+func (d *Decompress) Transform(body string) (string, error) {
+	data := []byte(body)
+	codec := d.Codec
+	if codec == "" {
+		codec = detect(data)
+		if codec == "" {
+			// base64 of the magic numbers
+			if !strings.HasPrefix(body, "H4sI") && !strings.HasPrefix(body, "KLUv") {
+				return body, nil
+			}
+			decoded, err := decodeBase64(body)
+			if err != nil {
+				return "", fmt.Errorf("decode: invalid base64: %s", err)
+			}
+			data, codec = decoded, detect(decoded)
+		}
+	}
+
+	var r io.Reader
+	switch codec {
+	case Gzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", fmt.Errorf("decode: invalid gzip: %s", err)
+		}
+		defer gz.Close()
+		r = gz
+	case Zstd:
+		zr, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return "", fmt.Errorf("decode: invalid zstd: %s", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return "", fmt.Errorf("decode: unknown codec %q", d.Codec)
+	}
+
+	limit := int64(d.maxSize())
+	decompressed, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return "", fmt.Errorf("decode: failed to decompress %s: %s", codec, err)
+	}
+	if int64(len(decompressed)) > limit {
+		return "", fmt.Errorf("decode: message decompresses to more than %d KB", limit/1024)
+	}
+	return string(decompressed), nil
+}
+
+func (d *Decompress) Info() {
+	log.Info("Using Decompress, codec: ", d.Codec)
+}
+
+// maxSize returns the maximum size of decompressed messages in
+// bytes.
+func (d *Decompress) maxSize() int {
+	if d.MaxSize < 1 {
+		return 64 * 1024 * 1024
+	}
+	return d.MaxSize * 1024
+}
+
+// detect returns the codec `data` is compressed with, if any.
+func detect(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(data, zstdMagic):
+		return Zstd
+	}
+	return ""
+}
@@ -0,0 +1,120 @@
+package decode
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/abstractpaper/manifold/transform"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipped(s string) string {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.String()
+}
+
+func TestBase64(t *testing.T) {
+	decoded, err := (&Base64{}).Transform(base64.StdEncoding.EncodeToString([]byte("hello")) + "\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", decoded)
+
+	decoded, err = (&Base64{}).Transform(base64.RawStdEncoding.EncodeToString([]byte("hello")))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", decoded)
+
+	_, err = (&Base64{}).Transform("not base64!")
+	assert.Error(t, err)
+}
+
+func TestDecompress(t *testing.T) {
+	encoder, _ := zstd.NewWriter(nil)
+	zstdData := string(encoder.EncodeAll([]byte("zstd data"), nil))
+
+	d := &Decompress{}
+	for compressed, expected := range map[string]string{
+		gzipped("gzip data"): "gzip data",
+		zstdData:             "zstd data",
+		// base64 of compressed data, e.g. put as text
+		base64.StdEncoding.EncodeToString([]byte(gzipped("base64 data"))): "base64 data",
+		// other messages are passed through
+		`{"plain": true}`: `{"plain": true}`,
+	} {
+		decompressed, err := d.Transform(compressed)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, decompressed)
+	}
+
+	// the codec is required when set
+	_, err := (&Decompress{Codec: Gzip}).Transform(zstdData)
+	assert.Error(t, err)
+	_, err = (&Decompress{Codec: "lz4"}).Transform("data")
+	assert.EqualError(t, err, `decode: unknown codec "lz4"`)
+
+	// bombs are rejected
+	_, err = (&Decompress{MaxSize: 1}).Transform(gzipped(strings.Repeat("a", 2048)))
+	assert.EqualError(t, err, "decode: message decompresses to more than 1 KB")
+}
+
+func TestUnwrap(t *testing.T) {
+	firehose := transform.Chain{&Unwrap{Records: "records", Value: "data", Fields: []string{"invocationId"}}, &Base64{}}
+	m := message.New(`{"invocationId": "i-1", "records": [
+		{"recordId": "1", "data": "` + base64.StdEncoding.EncodeToString([]byte(`{"n": 1}`)) + `"},
+		{"recordId": "2", "data": "` + base64.StdEncoding.EncodeToString([]byte(`{"n": 2}`)) + `"}
+	]}`)
+	m.Metadata["kinesis.shard_id"] = "shardId-000000000000"
+
+	split, err := firehose.Split(m)
+	assert.NoError(t, err)
+	if assert.Len(t, split, 2) {
+		assert.Equal(t, `{"n": 1}`, split[0].Body)
+		assert.Equal(t, `{"n": 2}`, split[1].Body)
+		assert.Equal(t, "i-1", split[1].Metadata.Get("envelope.invocationId"))
+		assert.Equal(t, "shardId-000000000000", split[1].Metadata.Get("kinesis.shard_id"))
+	}
+
+	// records are emitted as JSON, on a line each as a plain transform
+	unwrap := &Unwrap{Records: "detail.items"}
+	body, err := unwrap.Transform(`{"detail": {"items": [{"id": 12345678901234567890}, "text"]}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":12345678901234567890}`+"\n"+"text", body)
+
+	_, err = unwrap.Split(message.New(`{"other": 1}`))
+	assert.Equal(t, transform.ErrDrop, err)
+	_, err = unwrap.Split(message.New(`{"detail": {"items": 1}}`))
+	assert.EqualError(t, err, "decode: detail.items isn't an array")
+	_, err = unwrap.Split(message.New(`[]`))
+	assert.Equal(t, errNotObject, err)
+}
+
+func TestCloudWatchLogs(t *testing.T) {
+	c := &CloudWatchLogs{}
+	split, err := c.Split(message.New(gzipped(`{
+		"messageType": "DATA_MESSAGE",
+		"owner": "123456789012",
+		"logGroup": "/aws/lambda/orders",
+		"logStream": "2020/10/01/[$LATEST]abc",
+		"subscriptionFilters": ["all"],
+		"logEvents": [
+			{"id": "1", "timestamp": 1601510400000, "message": "START"},
+			{"id": "2", "timestamp": 1601510400001, "message": "{\"level\": \"info\"}"}
+		]
+	}`)))
+	assert.NoError(t, err)
+	if assert.Len(t, split, 2) {
+		assert.JSONEq(t, `{"id": "2", "timestamp": 1601510400001, "message": "{\"level\": \"info\"}"}`, split[1].Body)
+		assert.Equal(t, "/aws/lambda/orders", split[1].Metadata.Get(MetaLogGroup))
+		assert.Equal(t, "2020/10/01/[$LATEST]abc", split[1].Metadata.Get(MetaLogStream))
+		assert.Equal(t, "123456789012", split[1].Metadata.Get(MetaOwner))
+	}
+
+	_, err = c.Split(message.New(gzipped(`{"messageType": "CONTROL_MESSAGE", "logEvents": [{"id": "", "message": "CWL CONTROL MESSAGE: Checking health of destination Kinesis stream."}]}`)))
+	assert.Equal(t, transform.ErrDrop, err)
+}
@@ -0,0 +1,189 @@
+package decode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/abstractpaper/manifold/transform"
+	log "github.com/sirupsen/logrus"
+)
+
+// MetaEnvelope prefixes the metadata keys of envelope fields copied
+// to their records, e.g. "envelope.logGroup".
+const MetaEnvelope = "envelope."
+
+// Unwrap splits JSON envelopes holding an array of records into a
+// message per record (see transform.Splitter), e.g.:
+//
+//	Records: "records", Value: "data" // Firehose, then Base64
+//
+// Records is the (dotted) path of the array. Records are emitted as
+// JSON, or Value of each record if set; string values are emitted
+// as is. The Fields of the envelope are copied to the metadata of
+// its records, prefixed with MetaEnvelope, and so can be added to
+// them with the json transform's Metadata.
+//
+// Envelopes without records are dropped. Used as a plain
+// transformer, Unwrap returns the records as newline-delimited JSON.
+type Unwrap struct {
+	Records string
+	Value   string
+	Fields  []string
+}
+
+func (u *Unwrap) Transform(body string) (string, error) {
+	m, err := u.TransformMessage(message.New(body))
+	return m.Body, err
+}
+
+// TransformMessage returns the records of `m` on a line each.
+func (u *Unwrap) TransformMessage(m message.Message) (message.Message, error) {
+	split, err := u.Split(m)
+	return joined(m, split), err
+}
+
+// Split returns a message per record of `m`.
+func (u *Unwrap) Split(m message.Message) ([]message.Message, error) {
+	envelope, err := decodeObject(m)
+	if err != nil {
+		return nil, err
+	}
+	return u.split(m, envelope)
+}
+
+func (u *Unwrap) Info() {
+	log.Info("Using Unwrap, records: ", u.Records)
+}
+
+// split returns a message per record of `envelope`, the object of
+// `m`.
+func (u *Unwrap) split(m message.Message, envelope map[string]interface{}) ([]message.Message, error) {
+	var value interface{} = envelope
+	for _, key := range strings.Split(u.Records, ".") {
+		obj, _ := value.(map[string]interface{})
+		value = obj[key]
+	}
+	if value == nil {
+		return nil, transform.ErrDrop
+	}
+	records, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("decode: %s isn't an array", u.Records)
+	}
+
+	metadata := m.Metadata.Copy()
+	for _, field := range u.Fields {
+		if v, ok := envelope[field]; ok && v != nil {
+			metadata[MetaEnvelope+field] = text(v)
+		}
+	}
+
+	split := make([]message.Message, 0, len(records))
+	for _, record := range records {
+		if u.Value != "" {
+			obj, ok := record.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("decode: record of %s isn't an object", u.Records)
+			}
+			record = obj[u.Value]
+		}
+		split = append(split, message.Message{Body: text(record), Metadata: metadata})
+	}
+	return split, nil
+}
+
+// CloudWatchLogs decodes CloudWatch Logs subscription data, e.g. read
+// from Kinesis: it decompresses messages (see Decompress), drops
+// control messages and splits data messages into their log events,
+// {"id": ..., "timestamp": ..., "message": ...}, with the log group,
+// log stream and owner (account) of the envelope in their metadata
+// (MetaLogGroup, MetaLogStream, MetaOwner).
+type CloudWatchLogs struct {
+	MaxSize int // KB of a decompressed message, see Decompress
+}
+
+// Metadata keys of CloudWatch Logs events.
+const (
+	MetaLogGroup  = MetaEnvelope + "logGroup"
+	MetaLogStream = MetaEnvelope + "logStream"
+	MetaOwner     = MetaEnvelope + "owner"
+)
+
+func (c *CloudWatchLogs) Transform(body string) (string, error) {
+	m, err := c.TransformMessage(message.New(body))
+	return m.Body, err
+}
+
+// TransformMessage returns the log events of `m` on a line each.
+func (c *CloudWatchLogs) TransformMessage(m message.Message) (message.Message, error) {
+	split, err := c.Split(m)
+	return joined(m, split), err
+}
+
+// Split returns a message per log event of `m`.
+func (c *CloudWatchLogs) Split(m message.Message) ([]message.Message, error) {
+	var err error
+	m, err = transform.Apply(&Decompress{MaxSize: c.MaxSize}, m)
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := decodeObject(m)
+	if err != nil {
+		return nil, err
+	}
+	if envelope["messageType"] == "CONTROL_MESSAGE" {
+		return nil, transform.ErrDrop
+	}
+	return c.unwrap().split(m, envelope)
+}
+
+func (c *CloudWatchLogs) Info() {
+	log.Info("Using CloudWatch Logs Decoder.")
+}
+
+// unwrap returns the Unwrap of log events.
+func (c *CloudWatchLogs) unwrap() *Unwrap {
+	return &Unwrap{Records: "logEvents", Fields: []string{"logGroup", "logStream", "owner"}}
+}
+
+// errNotObject is returned for envelopes that aren't JSON objects.
+var errNotObject = errors.New("decode: envelope isn't a JSON object")
+
+// decodeObject parses the JSON object of `m`, keeping numbers as
+// they're written.
+func decodeObject(m message.Message) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(m.Body))
+	decoder.UseNumber()
+	var obj map[string]interface{}
+	err := decoder.Decode(&obj)
+	if err != nil || obj == nil {
+		return nil, errNotObject
+	}
+	return obj, nil
+}
+
+// joined returns `m` with the bodies of `split` on a line each, or
+// as is if `split` is empty.
+func joined(m message.Message, split []message.Message) message.Message {
+	if len(split) == 0 {
+		return m
+	}
+	lines := make([]string, len(split))
+	for i, s := range split {
+		lines[i] = s.Body
+	}
+	m.Body = strings.Join(lines, "\n")
+	return m
+}
+
+// text returns strings as is and other values as JSON.
+func text(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
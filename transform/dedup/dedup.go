@@ -0,0 +1,136 @@
+// Package dedup provides a transform that drops duplicate messages.
+package dedup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/abstractpaper/manifold/transform"
+	log "github.com/sirupsen/logrus"
+)
+
+// Store records the keys of seen messages.
+type Store interface {
+	// Seen reports whether `key` was recorded within its window.
+	Seen(key string) (bool, error)
+	// Record records `key` for `window`.
+	Record(key string, window time.Duration) error
+}
+
+// Clock is the source of time of Memory, e.g. the stream.Clock of a
+// pipeline. It defaults to the wall clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// Dedup drops messages whose key was seen within the last Window
+// seconds by returning transform.ErrDrop.
+//
+// The key is the value of the JSON field Field, the metadata key
+// MetadataKey (e.g. stream.MetaKinesisSequenceNumber), or a SHA-256
+// hash of the body if neither is set. Messages without the key field
+// are passed through.
+//
+// Keys are kept in Store, an in-memory LRU of MaxKeys keys by
+// default; use a shared store (e.g. Redis) to deduplicate across
+// processes. Keys are recorded once a message is acknowledged as
+// handled (see message.Handled), so a message that fails to be
+// delivered is passed through when it is redelivered; duplicates
+// received while it is in flight are passed through too. Transform,
+// which has no acknowledgement, records keys right away. If the
+// store fails, messages are passed through: duplicates are preferred
+// over loss. Windows of the default store expire on Clock.
+type Dedup struct {
+	Field       string
+	MetadataKey string
+	Window      int   // seconds, defaults to 300
+	MaxKeys     int   // keys kept by the default store, defaults to 100000
+	Store       Store `json:"-"`
+	Clock       Clock `json:"-"` // clock of the default store
+	once        sync.Once
+}
+
+func (d *Dedup) Transform(body string) (string, error) {
+	m, err := d.TransformMessage(message.New(body))
+	if err == nil {
+		m.Done(nil)
+	}
+	return m.Body, err
+}
+
+// TransformMessage returns transform.ErrDrop if `m` is a duplicate.
+// Otherwise its key is recorded when it is acknowledged as handled.
+func (d *Dedup) TransformMessage(m message.Message) (message.Message, error) {
+	d.once.Do(func() {
+		if d.Window < 1 {
+			d.Window = 300
+		}
+		if d.Store == nil {
+			m := NewMemory(d.MaxKeys)
+			m.Clock = d.Clock
+			d.Store = m
+		}
+	})
+
+	key, ok := d.key(m)
+	if !ok {
+		return m, nil
+	}
+
+	seen, err := d.Store.Seen(key)
+	if err != nil {
+		log.Warn("Dedup: store failed, passing message through: ", err)
+		return m, nil
+	}
+	if seen {
+		return m, transform.ErrDrop
+	}
+
+	ack := m.Ack
+	m.Ack = func(err error) {
+		if message.Handled(err) {
+			if err := d.Store.Record(key, time.Duration(d.Window)*time.Second); err != nil {
+				log.Warn("Dedup: store failed to record key: ", err)
+			}
+		}
+		if ack != nil {
+			ack(err)
+		}
+	}
+	return m, nil
+}
+
+// key returns the deduplication key of `m`.
+func (d *Dedup) key(m message.Message) (string, bool) {
+	switch {
+	case d.MetadataKey != "":
+		key, ok := m.Metadata[d.MetadataKey]
+		return key, ok
+
+	case d.Field != "":
+		var fields map[string]interface{}
+		if json.Unmarshal([]byte(m.Body), &fields) != nil {
+			return "", false
+		}
+		val, ok := fields[d.Field]
+		if !ok || val == nil {
+			return "", false
+		}
+		if s, ok := val.(string); ok {
+			return s, true
+		}
+		return fmt.Sprint(val), true
+	}
+
+	sum := sha256.Sum256([]byte(m.Body))
+	return hex.EncodeToString(sum[:]), true
+}
+
+func (d *Dedup) Info() {
+	log.Infof("Using Dedup Transformer, window: %ds", d.Window)
+}
@@ -0,0 +1,135 @@
+package dedup
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/abstractpaper/manifold/stream"
+	"github.com/abstractpaper/manifold/transform"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedup_Field(t *testing.T) {
+	d := &Dedup{Field: "id"}
+
+	for _, c := range []struct {
+		body string
+		err  error
+	}{
+		{`{"id":1,"v":"a"}`, nil},
+		{`{"id":2,"v":"a"}`, nil},
+		{`{"id":1,"v":"b"}`, transform.ErrDrop},
+		{`{"v":"no id"}`, nil},
+		{`{"v":"no id"}`, nil},
+	} {
+		_, err := d.Transform(c.body)
+		assert.Equal(t, c.err, err, c.body)
+	}
+}
+
+func TestDedup_MetadataAndHash(t *testing.T) {
+	d := &Dedup{MetadataKey: "seq"}
+	m := message.New("a")
+	m.Metadata["seq"] = "1"
+	delivered, err := d.TransformMessage(m)
+	assert.NoError(t, err)
+	delivered.Done(nil)
+	_, err = d.TransformMessage(m)
+	assert.Equal(t, transform.ErrDrop, err)
+
+	d = &Dedup{}
+	_, err = d.Transform("a")
+	assert.NoError(t, err)
+	_, err = d.Transform("a")
+	assert.Equal(t, transform.ErrDrop, err)
+	_, err = d.Transform("b")
+	assert.NoError(t, err)
+}
+
+func TestDedup_RecordedOnAck(t *testing.T) {
+	d := &Dedup{Field: "id"}
+	var acks []error
+	m := message.New(`{"id":1}`)
+	m.Ack = func(err error) { acks = append(acks, err) }
+
+	// not recorded until delivered, a redelivery is passed through
+	first, err := d.TransformMessage(m)
+	assert.NoError(t, err)
+	second, err := d.TransformMessage(m)
+	assert.NoError(t, err)
+	first.Done(errors.New("connection refused"))
+	redelivered, err := d.TransformMessage(m)
+	assert.NoError(t, err)
+
+	// quarantined messages are handled
+	redelivered.Done(fmt.Errorf("bad row: %w", message.ErrQuarantined))
+	_, err = d.TransformMessage(m)
+	assert.Equal(t, transform.ErrDrop, err)
+	second.Done(nil)
+	assert.Len(t, acks, 3)
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory(2)
+
+	seen, _ := m.Seen("a")
+	assert.False(t, seen)
+	m.Record("a", time.Hour)
+	m.Record("b", time.Hour)
+	seen, _ = m.Seen("a")
+	assert.True(t, seen)
+
+	// "b" is the least recently seen key
+	m.Record("c", time.Hour)
+	seen, _ = m.Seen("b")
+	assert.False(t, seen)
+
+	// expired
+	clock := stream.NewFakeClock(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC))
+	m.Clock = clock
+	m.Record("d", time.Millisecond)
+	clock.Advance(time.Millisecond)
+	seen, _ = m.Seen("d")
+	assert.False(t, seen)
+}
+
+func TestDedup_Clock(t *testing.T) {
+	clock := stream.NewFakeClock(time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC))
+	d := &Dedup{Field: "id", Window: 60, Clock: clock}
+
+	_, err := d.Transform(`{"id":1}`)
+	assert.NoError(t, err)
+	clock.Advance(59 * time.Second)
+	_, err = d.Transform(`{"id":1}`)
+	assert.Equal(t, transform.ErrDrop, err)
+
+	// the window expires on the clock, not the wall clock
+	clock.Advance(time.Second)
+	_, err = d.Transform(`{"id":1}`)
+	assert.NoError(t, err)
+}
+
+func TestRedis(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer server.Close()
+	r := &Redis{URL: "redis://" + server.Addr()}
+
+	seen, err := r.Seen("a")
+	assert.NoError(t, err)
+	assert.False(t, seen)
+	assert.NoError(t, r.Record("a", time.Minute))
+	seen, err = r.Seen("a")
+	assert.NoError(t, err)
+	assert.True(t, seen)
+	assert.True(t, server.Exists("manifold:dedup:a"))
+
+	server.FastForward(time.Minute)
+	seen, err = r.Seen("a")
+	assert.NoError(t, err)
+	assert.False(t, seen)
+}
@@ -0,0 +1,71 @@
+package dedup
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Memory is an in-memory LRU store. When it is full, the least
+// recently seen key is evicted.
+type Memory struct {
+	Clock   Clock // defaults to the wall clock
+	mu      sync.Mutex
+	maxKeys int
+	keys    map[string]*list.Element
+	lru     *list.List // front is the most recently seen
+}
+
+type entry struct {
+	key     string
+	expires time.Time
+}
+
+// NewMemory returns a store holding up to `maxKeys` keys (100000
+// if < 1).
+func NewMemory(maxKeys int) *Memory {
+	if maxKeys < 1 {
+		maxKeys = 100000
+	}
+	return &Memory{maxKeys: maxKeys, keys: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (m *Memory) Seen(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.keys[key]
+	if !ok {
+		return false, nil
+	}
+	m.lru.MoveToFront(el)
+	return m.now().Before(el.Value.(*entry).expires), nil
+}
+
+func (m *Memory) Record(key string, window time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expires := m.now().Add(window)
+	if el, ok := m.keys[key]; ok {
+		el.Value.(*entry).expires = expires
+		m.lru.MoveToFront(el)
+		return nil
+	}
+
+	m.keys[key] = m.lru.PushFront(&entry{key: key, expires: expires})
+	if m.lru.Len() > m.maxKeys {
+		oldest := m.lru.Back()
+		m.lru.Remove(oldest)
+		delete(m.keys, oldest.Value.(*entry).key)
+	}
+	return nil
+}
+
+// now returns the time of Clock, or of the wall clock.
+func (m *Memory) now() time.Time {
+	if m.Clock == nil {
+		return time.Now()
+	}
+	return m.Clock.Now()
+}
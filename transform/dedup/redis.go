@@ -0,0 +1,51 @@
+package dedup
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Redis is a store keeping keys in Redis with an expiry, which lets
+// several processes share deduplication state.
+type Redis struct {
+	URL    string // e.g. redis://localhost:6379/0
+	Prefix string // prepended to keys, defaults to "manifold:dedup:"
+	once   sync.Once
+	pool   *redis.Pool
+}
+
+func (r *Redis) Seen(key string) (bool, error) {
+	conn := r.conn()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("EXISTS", r.Prefix+key))
+}
+
+func (r *Redis) Record(key string, window time.Duration) error {
+	conn := r.conn()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", r.Prefix+key, 1, "PX", window.Milliseconds())
+	return err
+}
+
+// conn returns a connection from the pool, creating it on first
+// use.
+func (r *Redis) conn() redis.Conn {
+	r.once.Do(func() {
+		if r.Prefix == "" {
+			r.Prefix = "manifold:dedup:"
+		}
+		r.pool = &redis.Pool{
+			MaxIdle:     3,
+			IdleTimeout: 4 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(r.URL)
+			},
+		}
+	})
+
+	return r.pool.Get()
+}
@@ -0,0 +1,170 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/casbin/govaluate"
+)
+
+// Expr is a compiled expression.
+type Expr struct {
+	text string
+	expr *govaluate.EvaluableExpression
+}
+
+// Compile parses an expression (see Filter for its syntax).
+func Compile(text string) (*Expr, error) {
+	parsed, err := govaluate.NewEvaluableExpressionWithFunctions(text, functions)
+	if err != nil {
+		return nil, fmt.Errorf("filter: %s", err)
+	}
+
+	// fields (payload.user.id) are looked up by vars.Get rather than
+	// walked by govaluate, so that missing ones are nil
+	tokens := parsed.Tokens()
+	for i, t := range tokens {
+		if t.Kind == govaluate.ACCESSOR {
+			tokens[i] = govaluate.ExpressionToken{Kind: govaluate.VARIABLE, Value: strings.Join(t.Value.([]string), ".")}
+		}
+	}
+	expr, err := govaluate.NewEvaluableExpressionFromTokens(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("filter: %s", err)
+	}
+	return &Expr{text: text, expr: expr}, nil
+}
+
+func (e *Expr) String() string {
+	return e.text
+}
+
+// Eval evaluates the expression against `values`, the values of its
+// root identifiers.
+func (e *Expr) Eval(values map[string]interface{}) (interface{}, error) {
+	v, err := e.expr.Eval(vars(values))
+	if err != nil {
+		return nil, fmt.Errorf("filter: %s", err)
+	}
+	return v, nil
+}
+
+// vars resolves the variables of an expression: a root identifier
+// followed by the keys of objects and indexes of lists, e.g.
+// payload.items.0.id. Missing fields are nil.
+type vars map[string]interface{}
+
+func (v vars) Get(name string) (interface{}, error) {
+	root, path := cut(name)
+	value, ok := v[root]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable %s", root)
+	}
+
+	for path != "" {
+		var key string
+		switch x := value.(type) {
+		case map[string]interface{}:
+			// keys may contain dots, e.g. metadata.http.path
+			if field, ok := x[path]; ok {
+				return field, nil
+			}
+			key, path = cut(path)
+			value = x[key]
+		case []interface{}:
+			key, path = cut(path)
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil, nil
+			}
+			value = x[i]
+		default:
+			return nil, nil
+		}
+	}
+	return value, nil
+}
+
+// cut splits `s` around its first dot.
+func cut(s string) (string, string) {
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// functions of expressions. govaluate passes the elements of a list
+// as separate arguments when it's the only one.
+var functions = map[string]govaluate.ExpressionFunction{
+	"has": func(args ...interface{}) (interface{}, error) {
+		return len(args) > 0 && args[0] != nil, nil
+	},
+	"contains":   stringTest("contains", strings.Contains),
+	"startsWith": stringTest("startsWith", strings.HasPrefix),
+	"endsWith":   stringTest("endsWith", strings.HasSuffix),
+	"matches": func(args ...interface{}) (interface{}, error) {
+		s, expr, ok, err := stringArgs("matches", args)
+		if !ok || err != nil {
+			return false, err
+		}
+		re, err := compileRegexp(expr)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(s), nil
+	},
+	"lower": stringFunc("lower", strings.ToLower),
+	"upper": stringFunc("upper", strings.ToUpper),
+}
+
+// stringTest returns a function of two strings, false if either
+// argument isn't a string.
+func stringTest(name string, test func(string, string) bool) govaluate.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		s, arg, ok, err := stringArgs(name, args)
+		return ok && test(s, arg), err
+	}
+}
+
+// stringArgs returns the two arguments of function `name`, ok if
+// both are strings.
+func stringArgs(name string, args []interface{}) (s string, arg string, ok bool, err error) {
+	if len(args) != 2 {
+		return "", "", false, fmt.Errorf("%s takes 2 arguments", name)
+	}
+	s, ok = args[0].(string)
+	arg, ok2 := args[1].(string)
+	return s, arg, ok && ok2, nil
+}
+
+// stringFunc returns a function of a string.
+func stringFunc(name string, fn func(string) string) govaluate.ExpressionFunction {
+	return func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s takes 1 argument", name)
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("%s of %v, not a string", name, args[0])
+		}
+		return fn(s), nil
+	}
+}
+
+// regexps caches the compiled regular expressions of matches.
+var regexps sync.Map
+
+func compileRegexp(expr string) (*regexp.Regexp, error) {
+	if re, ok := regexps.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	regexps.Store(expr, re)
+	return re, nil
+}
@@ -0,0 +1,107 @@
+// Package filter provides a transform that drops messages not
+// matching an expression.
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/abstractpaper/manifold/transform"
+	log "github.com/sirupsen/logrus"
+)
+
+// Filter passes messages through if Expression evaluates to true
+// against them and drops the others by returning transform.ErrDrop,
+// e.g.:
+//
+//	payload.type == "purchase" && payload.amount > 100
+//
+// Expressions are govaluate expressions
+// (https://github.com/casbin/govaluate/blob/master/MANUAL.md):
+//   - literals: numbers, "strings" or 'strings', true, false and
+//     lists (1, 2)
+//   - fields and elements: payload.user.id, payload.items.0, escaped
+//     in brackets if they aren't identifiers, e.g. [payload.user-id]
+//     or [metadata.http.path]; missing ones are nil
+//   - operators: || && ! == != < <= > >= in =~ !~ + - * / % ?: ??
+//   - functions: has(x), contains(s, sub), startsWith(s, p),
+//     endsWith(s, p), matches(s, regexp), lower(s), upper(s)
+//
+// `payload` is the JSON body of a message and `metadata` its
+// metadata. Numbers are float64, == and != compare any values while
+// ordering needs two numbers or two strings, so `payload.missing > 1`
+// fails but `(payload.missing ?? 0) > 1` doesn't. has(x) is false if x
+// is nil or an empty list.
+//
+// Messages that aren't JSON, expressions failing to evaluate (e.g.
+// arithmetic on a string) and results that aren't booleans return an
+// error.
+type Filter struct {
+	Expression string
+	expr       *Expr
+	err        error
+	once       sync.Once
+}
+
+// Compile parses Expression, it's called by the first transform
+// otherwise.
+func (f *Filter) Compile() error {
+	f.once.Do(func() {
+		f.expr, f.err = Compile(f.Expression)
+	})
+	return f.err
+}
+
+func (f *Filter) Transform(body string) (string, error) {
+	m, err := f.TransformMessage(message.New(body))
+	return m.Body, err
+}
+
+// TransformMessage returns transform.ErrDrop if `m` doesn't match
+// Expression.
+func (f *Filter) TransformMessage(m message.Message) (message.Message, error) {
+	err := f.Compile()
+	if err != nil {
+		return m, err
+	}
+
+	match, err := f.expr.Match(m)
+	if err != nil {
+		return m, err
+	}
+	if !match {
+		return m, transform.ErrDrop
+	}
+	return m, nil
+}
+
+func (f *Filter) Info() {
+	log.Infof("Using Filter Transformer, expression: %s", f.Expression)
+}
+
+// Match evaluates `e` against the JSON body (`payload`) and metadata
+// (`metadata`) of `m`. It returns an error if `m` isn't JSON or the
+// result isn't a boolean.
+func (e *Expr) Match(m message.Message) (bool, error) {
+	var payload interface{}
+	err := json.Unmarshal([]byte(m.Body), &payload)
+	if err != nil {
+		return false, fmt.Errorf("filter: %s", err)
+	}
+	metadata := make(map[string]interface{}, len(m.Metadata))
+	for k, v := range m.Metadata {
+		metadata[k] = v
+	}
+
+	v, err := e.Eval(map[string]interface{}{"payload": payload, "metadata": metadata})
+	if err != nil {
+		return false, err
+	}
+	match, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("filter: %s is %v, not a boolean", e.text, v)
+	}
+	return match, nil
+}
@@ -0,0 +1,125 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/abstractpaper/manifold/message"
+	"github.com/abstractpaper/manifold/transform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	f := &Filter{Expression: `payload.type == "purchase" && (payload.amount ?? 0) > 100`}
+
+	for _, c := range []struct {
+		body string
+		err  error
+	}{
+		{`{"type":"purchase","amount":150}`, nil},
+		{`{"type":"purchase","amount":50}`, transform.ErrDrop},
+		{`{"type":"refund","amount":150}`, transform.ErrDrop},
+		{`{"type":"purchase"}`, transform.ErrDrop},
+	} {
+		_, err := f.Transform(c.body)
+		assert.Equal(t, c.err, err, c.body)
+	}
+
+	_, err := f.Transform("not json")
+	assert.Error(t, err)
+}
+
+func TestFilter_Metadata(t *testing.T) {
+	f := &Filter{Expression: `[metadata.http.path] == "/stripe"`}
+	m := message.New(`{}`)
+	m.Metadata["http.path"] = "/stripe"
+	_, err := f.TransformMessage(m)
+	assert.NoError(t, err)
+
+	m.Metadata["http.path"] = "/github"
+	_, err = f.TransformMessage(m)
+	assert.Equal(t, transform.ErrDrop, err)
+}
+
+func TestExpr(t *testing.T) {
+	payload := map[string]interface{}{
+		"name":    "Ada Lovelace",
+		"age":     36.0,
+		"tags":    []interface{}{"math", "computing"},
+		"user":    map[string]interface{}{"id": "u1", "plan": nil},
+		"user-id": "u1",
+		"price":   2.5,
+	}
+
+	for expr, want := range map[string]interface{}{
+		`payload.age >= 36 && payload.age < 37`:              true,
+		`payload.age > 40 || payload.name == "Ada Lovelace"`: true,
+		`!(payload.age == 36)`:                               false,
+		`payload.user.id == 'u1'`:                            true,
+		`[payload.user-id] == payload.user.id`:               true,
+		`payload.tags.1`:                                     "computing",
+		`has(payload.tags.5)`:                                false,
+		`has(payload.missing.deep)`:                          false,
+		`has(payload.user.id) && !has(payload.user.plan)`:    true,
+		`payload.missing == 1`:                               false,
+		`(payload.missing ?? 0) > 1`:                         false,
+		`"math" in payload.tags`:                             true,
+		`payload.age in (30, 36)`:                            true,
+		`payload.age > 30 ? "older" : "younger"`:             "older",
+		`payload.price * 4 + 1`:                              11.0,
+		`-payload.age % 5`:                                   -1.0,
+		`1 + 2 * 3 - 4 / 2`:                                  5.0,
+		`"a" + "b"`:                                          "ab",
+		`payload.name =~ "^Ada [A-Z]"`:                       true,
+		`startsWith(payload.name, "Ada") && endsWith(payload.name, "lace")`: true,
+		`contains(lower(payload.name), "love")`:                             true,
+		`upper("a")`:                                                        "A",
+		`matches(payload.name, "^Ada [A-Z]")`:                               true,
+		`matches(payload.age, "3")`:                                         false,
+		`matches(payload.missing, "3")`:                                     false,
+		`1.5 * 10 == 15`:                                                    true,
+		`"say \"hi\""`:                                                      `say "hi"`,
+	} {
+		e, err := Compile(expr)
+		if !assert.NoError(t, err, expr) {
+			continue
+		}
+		v, err := e.Eval(map[string]interface{}{"payload": payload})
+		assert.NoError(t, err, expr)
+		assert.Equal(t, want, v, expr)
+	}
+}
+
+func TestExpr_Errors(t *testing.T) {
+	for _, expr := range []string{
+		`payload.a ==`,
+		`payload.a = 1`,
+		`(1 + 2`,
+		`"unterminated`,
+		`unknown(1)`,
+		`payload.a(1)`,
+		`-"a"`,
+		`1 2`,
+	} {
+		_, err := Compile(expr)
+		assert.Error(t, err, expr)
+	}
+
+	for _, expr := range []string{
+		`"a" * 2`,
+		`payload.missing > 1`,
+		`lower(1)`,
+		`contains("a")`,
+		`matches("a", "(")`,
+		`nope == 1`,
+	} {
+		e, err := Compile(expr)
+		if assert.NoError(t, err, expr) {
+			_, err = e.Eval(map[string]interface{}{"payload": nil})
+			assert.Error(t, err, expr)
+		}
+	}
+
+	f := &Filter{Expression: `payload.a`}
+	_, err := f.Transform(`{"a":1}`)
+	assert.Error(t, err)
+}
@@ -2,21 +2,51 @@ package json
 
 import (
 	"encoding/json"
+	"errors"
 	"reflect"
 
+	"github.com/abstractpaper/manifold/message"
 	log "github.com/sirupsen/logrus"
 )
 
+// JSON transforms JSON objects.
+//
+// Append adds static values (or values returned by a
+// `func() interface{}`) to every object.
+//
+// Metadata copies message metadata into every object, it maps
+// a field name to a metadata key:
+//
+//	Metadata: map[string]string{
+//	    "arrived_at": stream.MetaKinesisArrivalTimestamp,
+//	}
 type JSON struct {
-	Append map[string]interface{}
+	Append   map[string]interface{}
+	Metadata map[string]string
 }
 
 func (j *JSON) Transform(message string) (transformed string, err error) {
+	return j.transform(message, nil)
+}
+
+// TransformMessage transforms the body of `m` and copies the
+// fields listed in Metadata from its metadata.
+func (j *JSON) TransformMessage(m message.Message) (transformed message.Message, err error) {
+	transformed = m
+	transformed.Body, err = j.transform(m.Body, m.Metadata)
+	return
+}
+
+func (j *JSON) transform(message string, metadata message.Metadata) (transformed string, err error) {
 	// unmarshal
 	var obj map[string]interface{}
 	err = json.Unmarshal([]byte(message), &obj)
 	if err != nil {
-		log.Print(err)
+		return
+	}
+	if obj == nil {
+		err = errors.New("not a JSON object")
+		return
 	}
 
 	// do stuff
@@ -28,6 +58,11 @@ func (j *JSON) Transform(message string) (transformed string, err error) {
 			obj[k] = v
 		}
 	}
+	for field, key := range j.Metadata {
+		if val, ok := metadata[key]; ok {
+			obj[field] = val
+		}
+	}
 
 	// marshal
 	newObj, err := json.Marshal(obj)
@@ -3,6 +3,7 @@ package json
 import (
 	"testing"
 
+	"github.com/abstractpaper/manifold/message"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,4 +23,42 @@ func TestTransform(t *testing.T) {
 	}
 
 	assert.JSONEq(t, transformed, json_transformed)
-}
\ No newline at end of file
+}
+
+func TestTransformMessage(t *testing.T) {
+	transformer := &JSON{
+		Metadata: map[string]string{
+			"shard":   "kinesis.shard_id",
+			"missing": "not.set",
+		},
+	}
+
+	msg := message.Message{
+		Body:     `{"a":1}`,
+		Metadata: message.Metadata{"kinesis.shard_id": "shardId-000000000000"},
+	}
+
+	transformed, err := transformer.TransformMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"a":1, "shard":"shardId-000000000000"}`, transformed.Body)
+	assert.Equal(t, msg.Metadata, transformed.Metadata)
+}
+
+func TestTransformMessageNotObject(t *testing.T) {
+	transformer := &JSON{
+		Metadata: map[string]string{"shard": "kinesis.shard_id"},
+	}
+
+	for _, body := range []string{`null`, `[1,2]`, `{invalid`} {
+		msg := message.Message{
+			Body:     body,
+			Metadata: message.Metadata{"kinesis.shard_id": "shardId-000000000000"},
+		}
+
+		_, err := transformer.TransformMessage(msg)
+		assert.Error(t, err, body)
+	}
+}
@@ -0,0 +1,147 @@
+// Package protobuf provides transforms that serialize JSON messages
+// to Protobuf and back, with schemas kept in a schema registry.
+package protobuf
+
+import (
+	"fmt"
+
+	"github.com/abstractpaper/manifold/transform/schema"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// Encoder serializes JSON messages (in the Protobuf JSON mapping) to
+// Protobuf with the latest schema of Subject and frames them in the
+// registry's wire format.
+//
+// Messages are parsed into the Go type of Message, or of the message
+// named MessageName (e.g. "sensors.v1.Reading") which must be linked
+// into the binary and defined by the schema. Messages with unknown
+// fields fail to transform.
+type Encoder struct {
+	Registry    schema.Registry
+	Subject     string
+	Message     proto.Message
+	MessageName string
+}
+
+func (e *Encoder) Transform(message string) (transformed string, err error) {
+	s, err := e.Registry.Latest(e.Subject)
+	if err != nil {
+		return
+	}
+	if s.Type != schema.Protobuf {
+		return "", fmt.Errorf("protobuf: schema %s is of type %s", s.ID, s.Type)
+	}
+
+	m, err := newMessage(e.Message, e.MessageName)
+	if err != nil {
+		return
+	}
+	name := string(m.ProtoReflect().Descriptor().FullName())
+	err = defines(s, name)
+	if err != nil {
+		return
+	}
+	err = protojson.Unmarshal([]byte(message), m)
+	if err != nil {
+		return "", fmt.Errorf("protobuf: message doesn't match %s: %s", m.ProtoReflect().Descriptor().FullName(), err)
+	}
+	payload, err := proto.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	var data []byte
+	if r, ok := e.Registry.(schema.ProtobufRegistry); ok {
+		data, err = r.EncodeProtobuf(s, name, payload)
+	} else {
+		data, err = e.Registry.Encode(s, payload)
+	}
+	return string(data), err
+}
+
+func (e *Encoder) Info() {
+	log.Info("Using Protobuf Encoder, subject: ", e.Subject)
+}
+
+// Decoder deserializes Protobuf messages framed in the registry's
+// wire format to JSON. Messages are parsed into the type of Message,
+// or of the message named MessageName, which must be the message
+// type the payload was framed with (or, if the registry's wire
+// format doesn't say, be defined by its schema).
+type Decoder struct {
+	Registry    schema.Registry
+	Message     proto.Message
+	MessageName string
+}
+
+func (d *Decoder) Transform(message string) (transformed string, err error) {
+	m, err := newMessage(d.Message, d.MessageName)
+	if err != nil {
+		return
+	}
+	name := string(m.ProtoReflect().Descriptor().FullName())
+
+	var s schema.Schema
+	var payload []byte
+	if r, ok := d.Registry.(schema.ProtobufRegistry); ok {
+		var framed string
+		s, framed, payload, err = r.DecodeProtobuf([]byte(message))
+		if err == nil && s.Type == schema.Protobuf && framed != name {
+			return "", fmt.Errorf("protobuf: message is a %s, not a %s", framed, name)
+		}
+	} else {
+		s, payload, err = d.Registry.Decode([]byte(message))
+		if err == nil && s.Type == schema.Protobuf {
+			err = defines(s, name)
+		}
+	}
+	if err != nil {
+		return
+	}
+	if s.Type != schema.Protobuf {
+		return "", fmt.Errorf("protobuf: schema %s is of type %s", s.ID, s.Type)
+	}
+
+	err = proto.Unmarshal(payload, m)
+	if err != nil {
+		return "", fmt.Errorf("protobuf: failed to decode with schema %s: %s", s.ID, err)
+	}
+
+	data, err := protojson.Marshal(m)
+	return string(data), err
+}
+
+func (d *Decoder) Info() {
+	log.Info("Using Protobuf Decoder.")
+}
+
+// defines returns an error unless schema `s` defines message `name`.
+func defines(s schema.Schema, name string) error {
+	messages, err := schema.ProtobufMessages(s.Definition)
+	if err != nil {
+		return err
+	}
+	if _, ok := messages[name]; !ok {
+		return fmt.Errorf("protobuf: schema %s doesn't define %s", s.ID, name)
+	}
+	return nil
+}
+
+// newMessage returns a new message of the type of `m`, or of the
+// registered message `name`.
+func newMessage(m proto.Message, name string) (proto.Message, error) {
+	if m != nil {
+		return m.ProtoReflect().New().Interface(), nil
+	}
+
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("protobuf: message type %q: %s", name, err)
+	}
+	return mt.New().Interface(), nil
+}
@@ -0,0 +1,48 @@
+package protobuf
+
+import (
+	"testing"
+
+	"github.com/abstractpaper/manifold/transform/schema"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// registry is a schema.Registry holding a single protobuf schema.
+type registry struct{}
+
+var pbSchema = schema.Schema{
+	ID:         "1",
+	Type:       schema.Protobuf,
+	Definition: `syntax = "proto3"; package google.protobuf; message Struct { map<string, Value> fields = 1; }`,
+}
+
+func (registry) Latest(subject string) (schema.Schema, error) { return pbSchema, nil }
+func (registry) Encode(s schema.Schema, payload []byte) ([]byte, error) {
+	return append([]byte{'#'}, payload...), nil
+}
+func (registry) Decode(data []byte) (schema.Schema, []byte, error) {
+	return pbSchema, data[1:], nil
+}
+
+func TestProtobuf_RoundTrip(t *testing.T) {
+	encoder := &Encoder{Registry: registry{}, Subject: "readings", MessageName: "google.protobuf.Struct"}
+	encoded, err := encoder.Transform(`{"device":"d1","temp":21.5}`)
+	assert.NoError(t, err)
+
+	decoder := &Decoder{Registry: registry{}, Message: &structpb.Struct{}}
+	decoded, err := decoder.Transform(encoded)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"device":"d1","temp":21.5}`, decoded)
+
+	_, err = encoder.Transform(`not json`)
+	assert.Error(t, err)
+
+	// the message type must be defined by the schema
+	encoder.MessageName = "google.protobuf.Value"
+	_, err = encoder.Transform(`21.5`)
+	assert.EqualError(t, err, "protobuf: schema 1 doesn't define google.protobuf.Value")
+	decoder = &Decoder{Registry: registry{}, MessageName: "google.protobuf.Value"}
+	_, err = decoder.Transform(encoded)
+	assert.EqualError(t, err, "protobuf: schema 1 doesn't define google.protobuf.Value")
+}
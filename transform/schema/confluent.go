@@ -0,0 +1,208 @@
+package schema
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Confluent is a Confluent Schema Registry client.
+//
+// Payloads are framed with a zero magic byte and the 4 byte schema
+// ID; Protobuf payloads are followed by the message indexes, the
+// path of their message type in the schema (see ProtobufMessages).
+// Encode writes them as the first message of the schema, use
+// EncodeProtobuf to write the path of another message.
+type Confluent struct {
+	URL      string
+	Username string
+	Password string
+	CacheTTL int // seconds the latest schema of a subject is cached, defaults to 300
+	Client   *http.Client
+	once     sync.Once
+	cache    *cache
+}
+
+type confluentSchema struct {
+	ID         int    `json:"id"`
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType"`
+}
+
+func (c *Confluent) init() {
+	c.once.Do(func() {
+		c.cache = newCache(time.Duration(c.CacheTTL) * time.Second)
+		if c.Client == nil {
+			c.Client = &http.Client{Timeout: 10 * time.Second}
+		}
+	})
+}
+
+func (c *Confluent) Latest(subject string) (Schema, error) {
+	c.init()
+	return c.cache.bySubject(subject, func() (Schema, error) {
+		return c.get("/subjects/" + url.PathEscape(subject) + "/versions/latest")
+	})
+}
+
+func (c *Confluent) byID(id string) (Schema, error) {
+	c.init()
+	return c.cache.byID(id, func() (Schema, error) {
+		s, err := c.get("/schemas/ids/" + id)
+		s.ID = id
+		return s, err
+	})
+}
+
+func (c *Confluent) get(path string) (s Schema, err error) {
+	req, err := http.NewRequest(http.MethodGet, c.URL+path, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s, fmt.Errorf("schema: GET %s: %s", path, resp.Status)
+	}
+
+	var cs confluentSchema
+	err = json.NewDecoder(resp.Body).Decode(&cs)
+	if err != nil {
+		return
+	}
+
+	s = Schema{ID: strconv.Itoa(cs.ID), Type: cs.SchemaType, Definition: cs.Schema}
+	if s.Type == "" {
+		s.Type = Avro
+	}
+	return
+}
+
+func (c *Confluent) Encode(s Schema, payload []byte) ([]byte, error) {
+	data, err := confluentHeader(s, len(payload))
+	if err != nil {
+		return nil, err
+	}
+	if s.Type == Protobuf {
+		// message indexes [0]
+		data = append(data, 0)
+	}
+	return append(data, payload...), nil
+}
+
+// confluentHeader returns the magic byte and ID of `s`, with room
+// for the message indexes and a payload of `size` bytes.
+func confluentHeader(s Schema, size int) ([]byte, error) {
+	id, err := strconv.ParseUint(s.ID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("schema: invalid Confluent schema ID %q", s.ID)
+	}
+
+	data := make([]byte, 5, 6+size)
+	binary.BigEndian.PutUint32(data[1:], uint32(id))
+	return data, nil
+}
+
+// EncodeProtobuf frames `payload` with the message indexes of `name`
+// in schema `s`.
+func (c *Confluent) EncodeProtobuf(s Schema, name string, payload []byte) ([]byte, error) {
+	messages, err := ProtobufMessages(s.Definition)
+	if err != nil {
+		return nil, err
+	}
+	path, ok := messages[name]
+	if !ok {
+		return nil, fmt.Errorf("schema: schema %s doesn't define message %s", s.ID, name)
+	}
+
+	data, err := confluentHeader(s, len(payload))
+	if err != nil {
+		return nil, err
+	}
+	if len(path) == 1 && path[0] == 0 {
+		// [0] is written as an empty list
+		data = append(data, 0)
+	} else {
+		var buf [binary.MaxVarintLen64]byte
+		data = append(data, buf[:binary.PutVarint(buf[:], int64(len(path)))]...)
+		for _, i := range path {
+			data = append(data, buf[:binary.PutVarint(buf[:], int64(i))]...)
+		}
+	}
+	return append(data, payload...), nil
+}
+
+func (c *Confluent) Decode(data []byte) (s Schema, payload []byte, err error) {
+	s, payload, _, err = c.decode(data)
+	return
+}
+
+// DecodeProtobuf decodes framed `data`, resolving its message
+// indexes to the name of the message in the schema.
+func (c *Confluent) DecodeProtobuf(data []byte) (s Schema, name string, payload []byte, err error) {
+	s, payload, path, err := c.decode(data)
+	if err != nil {
+		return
+	}
+	if s.Type != Protobuf {
+		return s, "", payload, nil
+	}
+
+	messages, err := ProtobufMessages(s.Definition)
+	if err != nil {
+		return
+	}
+	for n, p := range messages {
+		if fmt.Sprint(p) == fmt.Sprint(path) {
+			return s, n, payload, nil
+		}
+	}
+	return s, "", nil, fmt.Errorf("schema: schema %s has no message at indexes %v", s.ID, path)
+}
+
+// decode returns the schema and payload of `data`, and the message
+// indexes of Protobuf payloads.
+func (c *Confluent) decode(data []byte) (s Schema, payload []byte, path []int, err error) {
+	if len(data) < 5 || data[0] != 0 {
+		return s, nil, nil, ErrUnknownFormat
+	}
+
+	s, err = c.byID(strconv.FormatUint(uint64(binary.BigEndian.Uint32(data[1:5])), 10))
+	if err != nil {
+		return
+	}
+	payload = data[5:]
+
+	if s.Type == Protobuf {
+		count, n := binary.Varint(payload)
+		if n <= 0 || count < 0 {
+			return s, nil, nil, ErrUnknownFormat
+		}
+		payload = payload[n:]
+		for i := int64(0); i < count; i++ {
+			index, n := binary.Varint(payload)
+			if n <= 0 {
+				return s, nil, nil, ErrUnknownFormat
+			}
+			path = append(path, int(index))
+			payload = payload[n:]
+		}
+		if count == 0 {
+			path = []int{0}
+		}
+	}
+	return
+}
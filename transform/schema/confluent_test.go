@@ -0,0 +1,83 @@
+package schema
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfluent(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/subjects/readings-value/versions/latest":
+			w.Write([]byte(`{"subject":"readings-value","version":3,"id":42,"schema":"\"string\""}`))
+		case "/schemas/ids/7":
+			w.Write([]byte(`{"schema":"syntax = \"proto3\";","schemaType":"PROTOBUF"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	registry := &Confluent{URL: server.URL}
+
+	s, err := registry.Latest("readings-value")
+	assert.NoError(t, err)
+	assert.Equal(t, Schema{ID: "42", Type: Avro, Definition: `"string"`}, s)
+
+	data, err := registry.Encode(s, []byte("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x00\x00\x00\x00\x2apayload"), data)
+
+	// cached by ID
+	decoded, payload, err := registry.Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, s, decoded)
+	assert.Equal(t, []byte("payload"), payload)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// protobuf message indexes [1, 0]
+	_, payload, err = registry.Decode([]byte("\x00\x00\x00\x00\x07\x04\x02\x00payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("payload"), payload)
+
+	_, _, err = registry.Decode([]byte("payload"))
+	assert.Equal(t, ErrUnknownFormat, err)
+	_, err = registry.Latest("unknown")
+	assert.Error(t, err)
+}
+
+func TestConfluent_Protobuf(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"schema":"package sensors; message Device {} message Reading { message Location {} }","schemaType":"PROTOBUF"}`))
+	}))
+	defer server.Close()
+	registry := &Confluent{URL: server.URL}
+	s := Schema{ID: "7", Type: Protobuf, Definition: "package sensors; message Device {} message Reading { message Location {} }"}
+
+	// [0] is written as an empty list
+	data, err := registry.EncodeProtobuf(s, "sensors.Device", []byte("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x00\x00\x00\x00\x07\x00payload"), data)
+	_, name, payload, err := registry.DecodeProtobuf(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "sensors.Device", name)
+	assert.Equal(t, []byte("payload"), payload)
+
+	// message indexes [1, 0]
+	data, err = registry.EncodeProtobuf(s, "sensors.Reading.Location", []byte("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x00\x00\x00\x00\x07\x04\x02\x00payload"), data)
+	_, name, _, err = registry.DecodeProtobuf(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "sensors.Reading.Location", name)
+
+	_, err = registry.EncodeProtobuf(s, "sensors.Unknown", []byte("payload"))
+	assert.EqualError(t, err, "schema: schema 7 doesn't define message sensors.Unknown")
+	_, _, _, err = registry.DecodeProtobuf([]byte("\x00\x00\x00\x00\x07\x02\x04payload"))
+	assert.EqualError(t, err, "schema: schema 7 has no message at indexes [2]")
+}
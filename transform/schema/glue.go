@@ -0,0 +1,149 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package schema
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abstractpaper/manifold/stream"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/glue"
+	"github.com/aws/aws-sdk-go-v2/service/glue/types"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Glue wire format header bytes.
+const (
+	glueVersion         = 3
+	glueNoCompression   = 0
+	glueZlibCompression = 5
+)
+
+// Glue is an AWS Glue Schema Registry client. Subjects are schema
+// names in RegistryName.
+//
+// Payloads are framed with a version byte, a compression byte and
+// the 16 byte schema version ID; zlib compressed payloads are
+// decompressed when decoding.
+type Glue struct {
+	RegistryName string
+	AWSConfig    *aws.Config      // defaults to the default credential chain
+	AWSSess      *session.Session // v1 session used if AWSConfig isn't set
+	CacheTTL     int              // seconds the latest version of a schema is cached, defaults to 300
+	client       glueAPI
+	once         sync.Once
+	err          error // of creating the client
+	cache        *cache
+}
+
+// glueAPI is the part of the Glue client used by the registry.
+type glueAPI interface {
+	GetSchemaVersion(ctx context.Context, input *glue.GetSchemaVersionInput, opts ...func(*glue.Options)) (*glue.GetSchemaVersionOutput, error)
+}
+
+func (g *Glue) init() error {
+	g.once.Do(func() {
+		g.cache = newCache(time.Duration(g.CacheTTL) * time.Second)
+		if g.client != nil {
+			return
+		}
+		var cfg aws.Config
+		switch {
+		case g.AWSConfig != nil:
+			cfg = *g.AWSConfig
+		case g.AWSSess != nil:
+			cfg = stream.SessionConfig(g.AWSSess)
+		default:
+			cfg, g.err = stream.AWSConfig(context.Background(), "", "")
+		}
+		g.client = glue.NewFromConfig(cfg)
+	})
+	return g.err
+}
+
+func (g *Glue) Latest(subject string) (Schema, error) {
+	if err := g.init(); err != nil {
+		return Schema{}, err
+	}
+	return g.cache.bySubject(subject, func() (Schema, error) {
+		return g.get(&glue.GetSchemaVersionInput{
+			SchemaId: &types.SchemaId{
+				RegistryName: aws.String(g.RegistryName),
+				SchemaName:   aws.String(subject),
+			},
+			SchemaVersionNumber: &types.SchemaVersionNumber{LatestVersion: true},
+		})
+	})
+}
+
+func (g *Glue) get(input *glue.GetSchemaVersionInput) (s Schema, err error) {
+	out, err := g.client.GetSchemaVersion(context.Background(), input)
+	if err != nil {
+		return
+	}
+	if out.Status != types.SchemaVersionStatusAvailable {
+		return s, fmt.Errorf("schema: version %s is %s", aws.ToString(out.SchemaVersionId), out.Status)
+	}
+
+	return Schema{
+		ID:         aws.ToString(out.SchemaVersionId),
+		Type:       string(out.DataFormat),
+		Definition: aws.ToString(out.SchemaDefinition),
+	}, nil
+}
+
+func (g *Glue) Encode(s Schema, payload []byte) ([]byte, error) {
+	id, err := hex.DecodeString(strings.Replace(s.ID, "-", "", -1))
+	if err != nil || len(id) != 16 {
+		return nil, fmt.Errorf("schema: invalid Glue schema version ID %q", s.ID)
+	}
+
+	data := make([]byte, 0, 18+len(payload))
+	data = append(data, glueVersion, glueNoCompression)
+	data = append(data, id...)
+	return append(data, payload...), nil
+}
+
+func (g *Glue) Decode(data []byte) (s Schema, payload []byte, err error) {
+	if len(data) < 18 || data[0] != glueVersion {
+		return s, nil, ErrUnknownFormat
+	}
+
+	id := hex.EncodeToString(data[2:18])
+	id = id[:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:]
+	if err = g.init(); err != nil {
+		return
+	}
+	s, err = g.cache.byID(id, func() (Schema, error) {
+		return g.get(&glue.GetSchemaVersionInput{SchemaVersionId: aws.String(id)})
+	})
+	if err != nil {
+		return
+	}
+
+	payload = data[18:]
+	switch data[1] {
+	case glueNoCompression:
+	case glueZlibCompression:
+		var r io.ReadCloser
+		r, err = zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return
+		}
+		defer r.Close()
+		payload, err = ioutil.ReadAll(r)
+	default:
+		err = fmt.Errorf("schema: unknown Glue compression %d", data[1])
+	}
+	return
+}
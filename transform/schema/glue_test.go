@@ -0,0 +1,56 @@
+//go:build aws || all || (!gcp && !kafka)
+// +build aws all !gcp,!kafka
+
+package schema
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/glue"
+	"github.com/aws/aws-sdk-go-v2/service/glue/types"
+	"github.com/stretchr/testify/assert"
+)
+
+const glueVersionID = "b7b4a7f0-9c1f-4a3a-8b0e-6f5d2c1a9e01"
+
+type fakeGlue struct{}
+
+func (f *fakeGlue) GetSchemaVersion(ctx context.Context, input *glue.GetSchemaVersionInput, opts ...func(*glue.Options)) (*glue.GetSchemaVersionOutput, error) {
+	return &glue.GetSchemaVersionOutput{
+		SchemaVersionId:  aws.String(glueVersionID),
+		DataFormat:       types.DataFormat(Avro),
+		SchemaDefinition: aws.String(`"string"`),
+		Status:           types.SchemaVersionStatusAvailable,
+	}, nil
+}
+
+func TestGlue(t *testing.T) {
+	registry := &Glue{RegistryName: "default", client: &fakeGlue{}}
+
+	s, err := registry.Latest("readings")
+	assert.NoError(t, err)
+	assert.Equal(t, glueVersionID, s.ID)
+
+	data, err := registry.Encode(s, []byte("payload"))
+	assert.NoError(t, err)
+	assert.Len(t, data, 18+len("payload"))
+
+	decoded, payload, err := registry.Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, s, decoded)
+	assert.Equal(t, []byte("payload"), payload)
+
+	// zlib compressed payload
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write([]byte("payload"))
+	w.Close()
+	compressed := append([]byte{glueVersion, glueZlibCompression}, data[2:18]...)
+	_, payload, err = registry.Decode(append(compressed, buf.Bytes()...))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("payload"), payload)
+}
@@ -0,0 +1,128 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProtobufRegistry is implemented by registries whose wire format
+// identifies the message type of Protobuf payloads within their
+// schema, as Confluent's message indexes do.
+type ProtobufRegistry interface {
+	// EncodeProtobuf frames `payload`, a message named `name` (e.g.
+	// "sensors.v1.Reading") of schema `s`.
+	EncodeProtobuf(s Schema, name string, payload []byte) ([]byte, error)
+	// DecodeProtobuf is Decode that also returns the name of the
+	// message type of the payload.
+	DecodeProtobuf(data []byte) (s Schema, name string, payload []byte, err error)
+}
+
+// ProtobufMessages returns the messages defined by the .proto
+// `definition`, by full name, along with their index path: the
+// index of each message among the messages declared at its level,
+// from the outermost (e.g. [1, 0] for the first message nested in
+// the second top-level message).
+func ProtobufMessages(definition string) (map[string][]int, error) {
+	type scope struct {
+		message  bool
+		name     string
+		path     []int
+		messages int
+	}
+	messages := map[string][]int{}
+	pkg := ""
+	stack := []*scope{{message: true}}
+
+	tokens := protoTokens(definition)
+	for i := 0; i < len(tokens); i++ {
+		top := stack[len(stack)-1]
+		switch t := tokens[i]; {
+		case t == "package" && len(stack) == 1 && i+1 < len(tokens):
+			pkg = tokens[i+1]
+			i++
+		case t == "message" && top.message && i+2 < len(tokens) && tokens[i+2] == "{":
+			name := tokens[i+1]
+			if top.name != "" {
+				name = top.name + "." + name
+			} else if pkg != "" {
+				name = pkg + "." + name
+			}
+			path := append(append([]int{}, top.path...), top.messages)
+			top.messages++
+			messages[name] = path
+			stack = append(stack, &scope{message: true, name: name, path: path})
+			i += 2
+		case t == "{":
+			// enum, service, oneof, option values...
+			stack = append(stack, &scope{})
+		case t == "}":
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("schema: unbalanced braces in Protobuf schema")
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("schema: unbalanced braces in Protobuf schema")
+	}
+	return messages, nil
+}
+
+// protoTokens splits a .proto definition into identifiers (full
+// names included), quoted strings and punctuation, skipping
+// comments.
+func protoTokens(definition string) []string {
+	var tokens []string
+	s := definition
+	for len(s) > 0 {
+		c := s[0]
+		switch {
+		case strings.HasPrefix(s, "//"):
+			end := strings.IndexByte(s, '\n')
+			if end < 0 {
+				end = len(s)
+			}
+			s = s[end:]
+		case strings.HasPrefix(s, "/*"):
+			end := strings.Index(s[2:], "*/")
+			if end < 0 {
+				end = len(s)
+			} else {
+				end += 4
+			}
+			s = s[end:]
+		case c == '"' || c == '\'':
+			end := 1
+			for end < len(s) && s[end] != c {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end < len(s) {
+				end++
+			} else {
+				end = len(s)
+			}
+			tokens = append(tokens, s[:end])
+			s = s[end:]
+		case isProtoIdent(c):
+			end := 1
+			for end < len(s) && isProtoIdent(s[end]) {
+				end++
+			}
+			tokens = append(tokens, s[:end])
+			s = s[end:]
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			s = s[1:]
+		default:
+			tokens = append(tokens, s[:1])
+			s = s[1:]
+		}
+	}
+	return tokens
+}
+
+func isProtoIdent(c byte) bool {
+	return c == '_' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
@@ -0,0 +1,44 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProtobufMessages(t *testing.T) {
+	messages, err := ProtobufMessages(`
+syntax = "proto3";
+package sensors.v1;
+
+// message Commented {}
+import "google/protobuf/timestamp.proto";
+
+enum Unit { CELSIUS = 0; }
+
+message Device {
+  string id = 1;
+  string message = 2; /* message Hidden { } */
+}
+
+message Reading {
+  message Location {
+    double lat = 1;
+    enum Source { GPS = 0; }
+  }
+  message Battery { int32 level = 1 [(validate.rules).int32 = { gte: 0 }]; }
+  oneof value { double temp = 1; string text = 2; }
+  Location location = 3;
+}
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]int{
+		"sensors.v1.Device":           {0},
+		"sensors.v1.Reading":          {1},
+		"sensors.v1.Reading.Location": {1, 0},
+		"sensors.v1.Reading.Battery":  {1, 1},
+	}, messages)
+
+	_, err = ProtobufMessages(`message Reading {`)
+	assert.Error(t, err)
+}
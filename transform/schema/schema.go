@@ -0,0 +1,103 @@
+// Package schema provides schema registry clients used by the
+// serialization transforms (see transform/avro and
+// transform/protobuf).
+//
+// A registry resolves schemas by subject or by the ID embedded in
+// serialized messages, and frames payloads in its wire format so
+// that consumers can find the schema a message was written with.
+package schema
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Schema types.
+const (
+	Avro     = "AVRO"
+	Protobuf = "PROTOBUF"
+	JSON     = "JSON"
+)
+
+// ErrUnknownFormat is returned when decoding data that isn't in the
+// registry's wire format.
+var ErrUnknownFormat = errors.New("schema: data is not in the registry wire format")
+
+// Schema is a schema version stored in a registry.
+type Schema struct {
+	ID         string // numeric ID (Confluent) or version UUID (Glue)
+	Type       string // Avro, Protobuf or JSON
+	Definition string
+}
+
+// Registry looks up schemas and frames payloads in the registry's
+// wire format. Implementations cache lookups and are safe for
+// concurrent use.
+type Registry interface {
+	// Latest returns the latest schema of `subject`.
+	Latest(subject string) (Schema, error)
+	// Encode frames `payload` serialized with schema `s`.
+	Encode(s Schema, payload []byte) ([]byte, error)
+	// Decode looks up the schema of framed `data` and returns it
+	// along with the payload.
+	Decode(data []byte) (Schema, []byte, error)
+}
+
+// cache holds schemas by ID, which are immutable, and the latest
+// schema of subjects for a TTL.
+type cache struct {
+	sync.Mutex
+	ttl    time.Duration
+	ids    map[string]Schema
+	latest map[string]latest
+}
+
+type latest struct {
+	schema  Schema
+	expires time.Time
+}
+
+func newCache(ttl time.Duration) *cache {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	return &cache{ttl: ttl, ids: map[string]Schema{}, latest: map[string]latest{}}
+}
+
+func (c *cache) byID(id string, lookup func() (Schema, error)) (Schema, error) {
+	c.Lock()
+	s, ok := c.ids[id]
+	c.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	s, err := lookup()
+	if err != nil {
+		return s, err
+	}
+	c.Lock()
+	c.ids[id] = s
+	c.Unlock()
+	return s, nil
+}
+
+func (c *cache) bySubject(subject string, lookup func() (Schema, error)) (Schema, error) {
+	c.Lock()
+	l, ok := c.latest[subject]
+	c.Unlock()
+	if ok && time.Now().Before(l.expires) {
+		return l.schema, nil
+	}
+
+	s, err := lookup()
+	if err != nil {
+		return s, err
+	}
+	c.Lock()
+	c.latest[subject] = latest{schema: s, expires: time.Now().Add(c.ttl)}
+	c.ids[s.ID] = s
+	c.Unlock()
+	return s, nil
+}
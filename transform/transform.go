@@ -1,6 +1,60 @@
 package transform
 
+import (
+	"errors"
+
+	"github.com/abstractpaper/manifold/message"
+)
+
+// ErrDrop is returned by transformers to drop a message (e.g. a
+// duplicate or a filtered out message). Pipelines acknowledge
+// dropped messages without writing them.
+var ErrDrop = errors.New("transform: message dropped")
+
 type Transformer interface {
 	Transform(string) (string, error)
 	Info()
-}
\ No newline at end of file
+}
+
+// MessageTransformer is an optional interface implemented by
+// transformers that need access to message metadata.
+type MessageTransformer interface {
+	Transformer
+	TransformMessage(message.Message) (message.Message, error)
+}
+
+// Splitter is an optional interface implemented by transformers
+// turning a message into several, e.g. unwrapping an envelope of
+// records. Pipelines deliver the messages it returns in order and
+// acknowledge the original message once all of them are handled;
+// returning none drops it.
+type Splitter interface {
+	Transformer
+	Split(message.Message) ([]message.Message, error)
+}
+
+// Apply runs `t` against `m`, using TransformMessage when `t`
+// implements MessageTransformer and Transform otherwise.
+func Apply(t Transformer, m message.Message) (message.Message, error) {
+	if mt, ok := t.(MessageTransformer); ok {
+		return mt.TransformMessage(m)
+	}
+
+	body, err := t.Transform(m.Body)
+	m.Body = body
+	return m, err
+}
+
+// ApplyAll runs `t` against `m` like Apply, using Split when `t`
+// implements Splitter, and returns the resulting messages.
+func ApplyAll(t Transformer, m message.Message) ([]message.Message, error) {
+	if s, ok := t.(Splitter); ok {
+		return s.Split(m)
+	}
+
+	m, err := Apply(t, m)
+	if err != nil {
+		return nil, err
+	}
+	return []message.Message{m}, nil
+}